@@ -16,8 +16,7 @@ func main() {
 		args = args[1:]
 		cmd.SetArgs(args)
 	}
-	err := cmd.Execute()
-	if err != nil {
-		os.Exit(1)
+	if err := cmd.Execute(); err != nil {
+		os.Exit(cli.ExitCode(err))
 	}
 }
@@ -0,0 +1,137 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/syntax"
+)
+
+//
+// Context: a long address is split into CV17 and CV18 and only used when bit 5 of CV29 is set, a short address
+// is CV1 with the bit cleared. The other bits of CV29 (speed steps, analog operation, RailCom) stay as they are,
+// so CV29 is read before it is written.
+//
+
+const (
+	cvShortAddress = 1
+	cvLongHigh     = 17
+	cvLongLow      = 18
+
+	shortAddressMin = 1
+	shortAddressMax = 127
+	longAddressMax  = 10239
+)
+
+// AddressOptions shape SetAddressAction
+type AddressOptions struct {
+	// Long programs an address below 128 as a long address
+	Long    bool
+	Verify  bool
+	Timeout time.Duration
+	Settle  time.Duration
+	// ReadBack reads the address from the decoder after it was written and compares it
+	ReadBack bool
+}
+
+// SetAddressAction programs the address of the decoder on the programming track, CV1 or CV17/CV18 together
+// with the long address bit of CV29
+func (app *LocoApp) SetAddressAction(addr uint16, options AddressOptions) error {
+	if _, err := addressCVs(addr, options.Long, 0); err != nil {
+		return err
+	}
+	read, write, cleanUp, err := app.cvAccess(string(commandstation.ProgrammingTrackMode), options.Verify, true, options.Timeout)
+	if err != nil {
+		return err
+	}
+	defer cleanUp()
+	readCV := func(cv uint16) (int, error) {
+		return read(commandstation.LocoCV{Cv: commandstation.CV{Num: commandstation.CVNum(cv)}}, commandstation.Timeout(options.Timeout))
+	}
+
+	config, err := readCV(cvConfig)
+	if err != nil {
+		return fmt.Errorf("cannot read CV29, its other bits have to be kept: %w", err)
+	}
+	entries, err := addressCVs(addr, options.Long, uint8(config))
+	if err != nil {
+		return err
+	}
+	writes := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if err := write(commandstation.LocoCV{
+			Cv: commandstation.CV{Num: commandstation.CVNum(entry.Number), Value: int(entry.Value)},
+		}, commandstation.Verify(options.Verify),
+			commandstation.Timeout(options.Timeout),
+			commandstation.Settle(options.Settle)); err != nil {
+			return fmt.Errorf("cannot set the address %d: %w", addr, err)
+		}
+		// a verified write has settled before it was read back
+		if !options.Verify {
+			time.Sleep(options.Settle)
+		}
+		writes = append(writes, fmt.Sprintf("cv%d=%d", entry.Number, entry.Value))
+	}
+	_, _ = app.P.Printf("write: %s (cv29 was %d)\n", strings.Join(writes, ", "), config)
+
+	if !options.ReadBack {
+		return nil
+	}
+	values := map[uint16]int{}
+	for _, cv := range []uint16{cvShortAddress, cvLongHigh, cvLongLow, cvConfig} {
+		if values[cv], err = readCV(cv); err != nil {
+			return fmt.Errorf("cannot read the address back: %w", err)
+		}
+	}
+	got, long, err := decoderAddress(values[cvShortAddress], values[cvLongHigh], values[cvLongLow], values[cvConfig])
+	if err != nil {
+		return fmt.Errorf("cannot read the address back: %w", err)
+	}
+	kind := "short"
+	if long {
+		kind = "long"
+	}
+	_, _ = app.P.Printf("read back: %d (%s address)\n", got, kind)
+	if got != addr || long != isLongAddress(addr, options.Long) {
+		return fmt.Errorf("the decoder answers to the %s address %d instead of %d", kind, got, addr)
+	}
+	return nil
+}
+
+// addressCVs are the writes of an address, CV29 is the current value with the long address bit changed.
+// The CVs of the address are written before CV29, so the decoder never uses a half written address.
+func addressCVs(addr uint16, long bool, cv29 uint8) ([]syntax.CVEntry, error) {
+	if addr > longAddressMax {
+		return nil, fmt.Errorf("address %d out of range (0-%d)", addr, longAddressMax)
+	}
+	if !isLongAddress(addr, long) {
+		return []syntax.CVEntry{
+			{Number: cvShortAddress, Value: addr},
+			{Number: cvConfig, Value: uint16(cv29 &^ cv29LongAddress)},
+		}, nil
+	}
+	return []syntax.CVEntry{
+		{Number: cvLongHigh, Value: 192 + addr/256},
+		{Number: cvLongLow, Value: addr % 256},
+		{Number: cvConfig, Value: uint16(cv29 | cv29LongAddress)},
+	}, nil
+}
+
+// isLongAddress tells whether addr is programmed as a long address, 0 and the addresses above 127 always are
+func isLongAddress(addr uint16, long bool) bool {
+	return long || addr < shortAddressMin || addr > shortAddressMax
+}
+
+// decoderAddress is the address the decoder answers to, long tells it is CV17/CV18.
+// A long address starts CV17 with the bits 11xxxxxx, anything else is not an address.
+func decoderAddress(cv1, cv17, cv18, cv29 int) (addr uint16, long bool, err error) {
+	if cv29&cv29LongAddress == 0 {
+		return uint16(cv1), false, nil
+	}
+	if cv17 < 192 || cv17 > 192+longAddressMax/256 {
+		return 0, true, fmt.Errorf("cv17=%d is not the high byte of a long address (192-%d)", cv17, 192+longAddressMax/256)
+	}
+	return uint16((cv17-192)*256 + cv18), true, nil
+}
@@ -0,0 +1,2023 @@
+package app
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keskad/loco/pkgs/audio"
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+	"github.com/keskad/loco/pkgs/config"
+	"github.com/keskad/loco/pkgs/decoders"
+	"github.com/keskad/loco/pkgs/syntax"
+	"github.com/keskad/loco/pkgs/throttle"
+	"github.com/stretchr/testify/assert"
+)
+
+// bufferPrinter collects everything the actions print
+type bufferPrinter struct {
+	strings.Builder
+}
+
+func (b *bufferPrinter) Printf(format string, a ...any) (int, error) {
+	return fmt.Fprintf(&b.Builder, format, a...)
+}
+
+// newMockApp returns an app using the mock command station, the state is kept between actions
+func newMockApp(t *testing.T) (*LocoApp, *bufferPrinter) {
+	t.Helper()
+	printer := &bufferPrinter{}
+	return &LocoApp{
+		Config: &config.Configuration{Server: config.Server{
+			Type:      "mock",
+			MockState: filepath.Join(t.TempDir(), "mock.json"),
+		}},
+		P: printer,
+	}, printer
+}
+
+func TestCVActions_WriteThenRead(t *testing.T) {
+	app, out := newMockApp(t)
+
+	assert.NoError(t, app.SendCVAction("cv1=17, cv29=34", CVSendOptions{Mode: "prog", Verify: true, Timeout: time.Second, Strict: true}))
+	assert.NoError(t, app.ReadCVAction("prog", 0, "cv1, cv29", false, time.Second, 0, CVOutput{}))
+	assert.Equal(t, "cv1=17\ncv29=34\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, app.ReadCVAction("prog", 0, "cv29", false, time.Second, 0, CVOutput{Base: 16}))
+	assert.NoError(t, app.ReadCVAction("prog", 0, "cv29", false, time.Second, 0, CVOutput{Base: 2, Explain: true}))
+	assert.Equal(t, "0x22\n0b00100010  # 28/128 steps, long address (CV17/CV18), analog off\n", out.String())
+}
+
+func TestCVActions_DryRunNeverSends(t *testing.T) {
+	app, _ := newMockApp(t)
+	app.Config.Server = config.Server{Type: "dccex-serial", Address: "/dev/null"}
+	app.DryRun = true
+
+	// a station that cannot simulate is not opened at all
+	assert.ErrorContains(t, app.SendCVAction("cv1=5", CVSendOptions{Mode: "prog", Timeout: time.Second, Strict: true}), "cannot simulate")
+}
+
+func TestCVActions_ReadsByPriority(t *testing.T) {
+	app, out := newMockApp(t)
+
+	assert.NoError(t, app.ReadCVAction("pom", 3, "cv300, cv40, cv5, cv8, cv1", false, time.Second, 0, CVOutput{}))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, []string{"cv1", "cv8", "cv5", "cv40", "cv300"}, cvNames(lines))
+}
+
+func cvNames(lines []string) []string {
+	names := make([]string, 0, len(lines))
+	for _, line := range lines {
+		name, _, _ := strings.Cut(line, "=")
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestCVActions_WiFi(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{}, cvs: map[uint16]int{1: 3}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+
+	assert.NoError(t, app.SendCVAction("cv1=17, cv29=34", CVSendOptions{Mode: WiFiMode, Verify: true, Timeout: time.Second, Strict: true}))
+	assert.Equal(t, map[uint16]int{1: 17, 29: 34}, decoder.cvs)
+	assert.NoError(t, app.ReadCVAction(WiFiMode, 0, "cv1, cv29", false, time.Second, 0, CVOutput{}))
+	assert.Equal(t, "cv1=17\ncv29=34\n", out.String())
+
+	out.Reset()
+	app.DryRun = true
+	assert.NoError(t, app.SendCVAction("cv1=5", CVSendOptions{Mode: WiFiMode, Timeout: time.Second, Strict: true}))
+	assert.Equal(t, "[dry-run] write cv1=5 over WiFi\n", out.String())
+	assert.Equal(t, 17, decoder.cvs[1])
+	app.DryRun = false
+
+	assert.ErrorContains(t, app.SendCVAction("cv1=5", CVSendOptions{Mode: WiFiMode, Timeout: time.Second, Strict: true, Format: "mm"}), "MM registers")
+	// an older firmware has no CV endpoint
+	decoder.cvs = nil
+	assert.ErrorIs(t, app.ReadCVAction(WiFiMode, 0, "cv1", false, time.Second, 0, CVOutput{}), decoders.ErrNotSupported)
+}
+
+func TestCVDocAction(t *testing.T) {
+	app, out := newMockApp(t)
+
+	assert.NoError(t, app.CVDocAction("cv1", "", 3))
+	assert.Equal(t, "cv1 Primary Address\n  Short address of the locomotive, used when CV29 bit 5 is cleared\n  default: 3\n  values: 1-127\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, app.CVDocAction("motor regulation", "zimo", 0))
+	assert.Contains(t, out.String(), "decoder family: zimo")
+	assert.Error(t, app.CVDocAction("no such cv", "", 0))
+}
+
+func TestExplainCVAction(t *testing.T) {
+	app, out := newMockApp(t)
+
+	assert.NoError(t, app.ExplainCVAction("cv29=0b00100010, cv3=12, cv56=55, cv200=1", "zimo"))
+	assert.Equal(t, "cv3=12  # Acceleration Rate\n"+
+		"cv29=34  # Configuration Data #1: 28/128 steps, long address (CV17/CV18), analog off\n"+
+		"cv56=55  # Motor Regulation: default\n"+
+		"cv200=1  # not described, see the manual of the decoder\n", out.String())
+	assert.Error(t, app.ExplainCVAction("cv29=300", ""))
+}
+
+func TestCVActions_Schema(t *testing.T) {
+	app, out := newMockApp(t)
+	schema := filepath.Join(t.TempDir(), "decoder.yaml")
+	assert.NoError(t, os.WriteFile(schema, []byte("cvs:\n  - cv: 3\n    name: Acceleration\n    max: 64\n  - cv: 8\n    name: Reset\n    readonly: true\n"), 0o644))
+	app.Config.Loco.DecoderType = "schema-test"
+	app.Config.Loco.DecoderSchema = schema
+
+	assert.NoError(t, app.CheckCVValues("cv3=64, cv1=3"))
+	err := app.CheckCVValues("cv3=100, cv8=8, cv1=200")
+	assert.ErrorContains(t, err, "cv1=200 is outside of the values 1-127 of Primary Address\n  cv3=100 is outside of the values 0-64 of Acceleration\n  cv8 (Reset) is read-only")
+
+	assert.NoError(t, app.SendCVAction("cv3=12, cv29=34", CVSendOptions{Mode: "prog", Timeout: time.Second, Strict: true}))
+	assert.NoError(t, app.ReadCVAction("prog", 0, "cv3, cv29", false, time.Second, 0, CVOutput{Explain: true}))
+	assert.Equal(t, "cv29=34  # Configuration Data #1: 28/128 steps, long address (CV17/CV18), analog off\ncv3=12  # Acceleration\n", out.String())
+
+	app.Config.Loco.DecoderSchema = filepath.Join(t.TempDir(), "missing.yaml")
+	assert.Error(t, app.CheckCVValues("cv3=1"))
+}
+
+func TestImportJMRIAction(t *testing.T) {
+	app, out := newMockApp(t)
+	dir := t.TempDir()
+	definition := filepath.Join("..", "cvdefs", "testdata", "jmri_decoder.xml")
+
+	assert.NoError(t, app.ImportJMRIAction([]string{definition}, dir, false))
+	assert.Contains(t, out.String(), `5 CVs of Railbox Sample Sound as the decoder type "jmri_decoder", 3 variables skipped`)
+	assert.ErrorContains(t, app.ImportJMRIAction([]string{definition}, dir, false), "use --force")
+	assert.NoError(t, app.ImportJMRIAction([]string{definition}, dir, true))
+
+	// the imported schema validates the values like a hand-written one
+	app.Config.Loco.DecoderType = "jmri_decoder"
+	app.Config.Loco.DecoderSchema = filepath.Join(dir, "jmri_decoder.yaml")
+	assert.ErrorContains(t, app.CheckCVValues("cv3=80"), "cv3=80 is outside of the values 0-64 of Accel")
+
+	out.Reset()
+	assert.NoError(t, app.ImportJMRIAction([]string{definition}, "-", false))
+	assert.Contains(t, out.String(), "  - cv: 67-94\n    name: \"Speed Table\"\n")
+	assert.Error(t, app.ImportJMRIAction([]string{definition, definition}, "-", false))
+}
+
+func TestBackupCVAction(t *testing.T) {
+	app, out := newMockApp(t)
+	assert.NoError(t, app.SendCVAction("cv1=3, cv8=151, cv7=4, cv29=6", CVSendOptions{Mode: "prog", Timeout: time.Second, Strict: true}))
+	file := filepath.Join(t.TempDir(), "loco3.cv")
+
+	out.Reset()
+	options := CVBackupOptions{Range: "29, 1-2", Mode: "prog", Timeout: time.Second}
+	assert.NoError(t, app.BackupCVAction(file, options))
+	assert.Contains(t, out.String(), "\rreading cv29 (3/3)\n3 CVs saved in "+file+", 0 unread\n")
+	assert.ErrorContains(t, app.BackupCVAction(file, options), "use --force")
+
+	content, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "# loco cv backup of the programming track, restore with: loco cv apply "+file+" --verify\n# created: ")
+	assert.Contains(t, string(content), "# decoder: manufacturer 151 (esu), version 4\n# cvs: 29, 1-2, 3 read\n"+
+		"cv1=3  # Primary Address\ncv2=0  # Vstart\ncv29=6  # Configuration Data #1\n")
+
+	// the backup is a CV file for "loco cv set"
+	entries, err := syntax.ParseCVString(string(content), "\n", syntax.Strict(true))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	out.Reset()
+	assert.NoError(t, app.BackupCVAction("-", CVBackupOptions{Range: "cv1", Mode: "prog", Timeout: time.Second}))
+	assert.Contains(t, out.String(), "restore with: loco cv apply <file> --verify\n")
+	assert.Error(t, app.BackupCVAction("-", CVBackupOptions{Range: "cv0-", Mode: "prog"}))
+}
+
+func TestApplyCVAction(t *testing.T) {
+	app, out := newMockApp(t)
+	file := filepath.Join(t.TempDir(), "loco3.cv")
+	assert.NoError(t, os.WriteFile(file, []byte("# backup\ncv8=151  # Manufacturer\ncv1=5\ncv3=300\ncv29=34\n"), 0o644))
+
+	err := app.ApplyCVAction(file, CVApplyOptions{Mode: "prog", Verify: true, Timeout: time.Second, Retries: 1})
+	assert.ErrorIs(t, err, ErrCVApplyFailed)
+	assert.ErrorContains(t, err, "1 of 3 CV(s) failed")
+	assert.Equal(t, "skipped:  cv8=151 (identifies the decoder)\n"+
+		"verified: cv1=5\n"+
+		"failed:   cv3=300: cannot write CV: value 300 out of range (0-255)\n"+
+		"verified: cv29=34\n"+
+		"report: 2 written, 2 verified, 1 failed, 1 skipped\n", out.String())
+
+	// the CVs that failed are written again on their own, CV8 was never written
+	out.Reset()
+	app.In = strings.NewReader("cv3=12\n")
+	assert.NoError(t, app.ApplyCVAction("-", CVApplyOptions{Mode: "prog", Timeout: time.Second}))
+	assert.Equal(t, "written:  cv3=12\nreport: 1 written, 0 verified, 0 failed, 0 skipped\n", out.String())
+	out.Reset()
+	assert.NoError(t, app.ReadCVAction("prog", 0, "cv1, cv3, cv8", false, time.Second, 0, CVOutput{}))
+	assert.Equal(t, "cv1=5\ncv8=13\ncv3=12\n", out.String())
+
+	assert.ErrorContains(t, app.ApplyCVAction("-", CVApplyOptions{Mode: "prog"}), "no CV to write")
+}
+
+func TestCVAssertions(t *testing.T) {
+	app, out := newMockApp(t)
+	dir := t.TempDir()
+	right := filepath.Join(dir, "right.cv")
+	wrong := filepath.Join(dir, "wrong.cv")
+	assert.NoError(t, os.WriteFile(right, []byte("cv8==13  # DIY\ncv29==6\ncv1=5\n"), 0o644))
+	assert.NoError(t, os.WriteFile(wrong, []byte("cv8==145\ncv1=7\n"), 0o644))
+
+	assert.NoError(t, app.CheckCVAssertionsAction(right, CVApplyOptions{Mode: "prog", Timeout: time.Second}))
+	assert.Equal(t, "passed:   cv8==13\npassed:   cv29==6\nreport: 2 passed, 0 failed\n", out.String())
+
+	// a failed assertion stops the apply before anything is written
+	out.Reset()
+	err := app.ApplyCVAction(wrong, CVApplyOptions{Mode: "prog", Timeout: time.Second})
+	assert.ErrorIs(t, err, ErrCVAssertion)
+	assert.Equal(t, "mismatch: cv8==145, the decoder holds 13\n", out.String())
+	out.Reset()
+	assert.NoError(t, app.ApplyCVAction(right, CVApplyOptions{Mode: "prog", Timeout: time.Second}))
+	assert.Equal(t, "passed:   cv8==13\npassed:   cv29==6\nwritten:  cv1=5\nreport: 1 written, 0 verified, 0 failed, 0 skipped\n", out.String())
+
+	assert.ErrorIs(t, app.CheckCVAssertionsAction(wrong, CVApplyOptions{Mode: "prog", Timeout: time.Second}), ErrCVAssertion)
+	app.In = strings.NewReader("cv1=3\n")
+	assert.ErrorContains(t, app.CheckCVAssertionsAction("-", CVApplyOptions{Mode: "prog"}), "no assertion")
+	// "loco cv set" never writes an assertion
+	assert.ErrorContains(t, app.SendCVAction("cv8==13", CVSendOptions{Mode: "prog", Timeout: time.Second, Strict: true}), "cannot be used here")
+}
+
+func TestApplyCVAction_Conditions(t *testing.T) {
+	app, out := newMockApp(t)
+	fleet := filepath.Join(t.TempDir(), "fleet.cv")
+	assert.NoError(t, os.WriteFile(fleet, []byte("cv3=10\n@if cv8==145\ncv4=20\n@elif cv8==13 && cv7>=1\ncv4=8\n@else\ncv4=30\n@endif\n"), 0o644))
+
+	assert.NoError(t, app.ApplyCVAction(fleet, CVApplyOptions{Mode: "prog", Timeout: time.Second}))
+	assert.Equal(t, "written:  cv3=10\nwritten:  cv4=8\nreport: 2 written, 0 verified, 0 failed, 0 skipped\n", out.String())
+
+	app.DryRun = true
+	assert.ErrorContains(t, app.ApplyCVAction(fleet, CVApplyOptions{Mode: "prog", Timeout: time.Second}), "dry-run")
+}
+
+func TestAddressCVs(t *testing.T) {
+	entries, err := addressCVs(125, false, 0x26)
+	assert.NoError(t, err)
+	assert.Equal(t, []syntax.CVEntry{{Number: 1, Value: 125}, {Number: 29, Value: 6}}, entries)
+
+	// 0 and the addresses above 127 are long, the other bits of CV29 are kept
+	entries, err = addressCVs(178, false, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, []syntax.CVEntry{{Number: 17, Value: 192}, {Number: 18, Value: 178}, {Number: 29, Value: 38}}, entries)
+	entries, err = addressCVs(10239, false, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []syntax.CVEntry{{Number: 17, Value: 231}, {Number: 18, Value: 255}, {Number: 29, Value: 32}}, entries)
+	entries, err = addressCVs(0, false, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []syntax.CVEntry{{Number: 17, Value: 192}, {Number: 18, Value: 0}, {Number: 29, Value: 32}}, entries)
+	entries, err = addressCVs(42, true, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []syntax.CVEntry{{Number: 17, Value: 192}, {Number: 18, Value: 42}, {Number: 29, Value: 34}}, entries)
+
+	_, err = addressCVs(10240, false, 0)
+	assert.ErrorContains(t, err, "out of range (0-10239)")
+}
+
+func TestSetAddressAction(t *testing.T) {
+	app, out := newMockApp(t)
+
+	assert.NoError(t, app.SetAddressAction(1234, AddressOptions{Verify: true, ReadBack: true, Timeout: time.Second}))
+	assert.Equal(t, "write: cv17=196, cv18=210, cv29=38 (cv29 was 6)\nread back: 1234 (long address)\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, app.SetAddressAction(3, AddressOptions{ReadBack: true, Timeout: time.Second}))
+	assert.Equal(t, "write: cv1=3, cv29=6 (cv29 was 38)\nread back: 3 (short address)\n", out.String())
+
+	assert.ErrorContains(t, app.SetAddressAction(20000, AddressOptions{Timeout: time.Second}), "out of range")
+}
+
+func TestDecoderAddress(t *testing.T) {
+	addr, long, err := decoderAddress(3, 196, 210, 38)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(1234), addr)
+	assert.True(t, long)
+
+	addr, long, err = decoderAddress(3, 196, 210, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(3), addr)
+	assert.False(t, long)
+
+	_, _, err = decoderAddress(3, 0, 210, 38)
+	assert.ErrorContains(t, err, "cv17=0")
+	_, _, err = decoderAddress(3, 232, 0, 38)
+	assert.ErrorContains(t, err, "cv17=232")
+}
+
+func TestCV29Actions(t *testing.T) {
+	app, out := newMockApp(t)
+
+	assert.NoError(t, app.DecodeCV29Action(34))
+	assert.Contains(t, out.String(), "cv29=34 (0x22, 0b00100010)\n  bit 0 (  1) = 0  normal direction\n  bit 1 (  2) = 1  28/128 steps\n")
+	assert.Contains(t, out.String(), "  bit 5 ( 32) = 1  long address (CV17/CV18)\n")
+
+	out.Reset()
+	assert.NoError(t, app.ComposeCV29Action([]uint8{1, 5}, false, &CVWrite{Mode: "prog", Timeout: time.Second}))
+	assert.Equal(t, "cv29=34  # 28/128 steps, long address (CV17/CV18), analog off\n", out.String())
+	out.Reset()
+	assert.NoError(t, app.ReadCVAction("prog", 0, "cv29", false, time.Second, 0, CVOutput{}))
+	assert.Equal(t, "34\n", out.String())
+
+	// the suggested bits are kept by an empty answer
+	out.Reset()
+	app.In = strings.NewReader("y\n\nn\ny\n\n\n")
+	assert.NoError(t, app.ComposeCV29Action([]uint8{1, 2}, true, nil))
+	assert.Contains(t, out.String(), "Direction: reversed direction? (no: normal direction) [y/N] Speed steps: 28/128 steps? (no: 14 steps) [Y/n] ")
+	assert.Contains(t, out.String(), "cv29=11  # reversed direction, 28/128 steps, RailCom on, analog off\n")
+
+	app.In = strings.NewReader("maybe\n")
+	assert.Error(t, app.ComposeCV29Action(nil, true, nil))
+}
+
+func TestCVActions_Modify(t *testing.T) {
+	app, out := newMockApp(t)
+
+	assert.NoError(t, app.SendCVAction("cv29|=0x20, cv29&=~0x04, cv1=5", CVSendOptions{Mode: "prog", Timeout: time.Second, Strict: true}))
+	assert.Equal(t, "modify: cv29=34 (was 6)\n", out.String())
+	out.Reset()
+	assert.NoError(t, app.ReadCVAction("prog", 0, "cv1, cv29", false, time.Second, 0, CVOutput{}))
+	assert.Equal(t, "cv1=5\ncv29=34\n", out.String())
+
+	// a CV already holding the bits is not written again
+	out.Reset()
+	assert.NoError(t, app.SendCVAction("cv29|=0x02", CVSendOptions{Mode: "prog", Timeout: time.Second, Strict: true, Optimize: true}))
+	assert.Equal(t, "modify: cv29=34 (was 34)\nunchanged: cv29=34\nplan: 0 of 1 CV(s) written\n", out.String())
+
+	app.DryRun = true
+	assert.ErrorContains(t, app.SendCVAction("cv29|=0x01", CVSendOptions{Mode: "prog", Timeout: time.Second, Strict: true}), "dry-run")
+}
+
+func TestSpeedTableAction(t *testing.T) {
+	app, out := newMockApp(t)
+
+	assert.NoError(t, app.SpeedTableAction(SpeedTableOptions{Shape: "linear", Vstart: 2, Vmax: 200}, &CVWrite{Mode: "prog", Verify: true, Timeout: time.Second}))
+	assert.Contains(t, out.String(), "# speed table: linear, vstart 2, vmax 200\n# 255 |\n")
+	assert.Contains(t, out.String(), "#     | ###########################\n#   0 +----------------------------\n#      1            14           28\n")
+	assert.Contains(t, out.String(), "cv2=2  # Vstart\ncv5=200  # Vhigh\ncv6=101  # Vmid\ncv67=9\ncv68=16\n")
+	assert.Contains(t, out.String(), "cv80=101\n")
+	assert.True(t, strings.HasSuffix(out.String(), "cv93=193\ncv94=200\n"))
+	out.Reset()
+	assert.NoError(t, app.ReadCVAction("prog", 0, "cv6, cv94", false, time.Second, 0, CVOutput{}))
+	assert.Equal(t, "cv6=101\ncv94=200\n", out.String())
+
+	// the printed table is a CV file
+	out.Reset()
+	assert.NoError(t, app.SpeedTableAction(SpeedTableOptions{Shape: "s-curve", Vmax: 255}, nil))
+	entries, err := syntax.ParseCVString(out.String(), "\n", syntax.Strict(true))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 31)
+	table := entries[3:]
+	for i := 1; i < len(table); i++ {
+		assert.GreaterOrEqual(t, table[i].Value, table[i-1].Value)
+	}
+
+	assert.ErrorContains(t, app.SpeedTableAction(SpeedTableOptions{Shape: "steep", Vmax: 255}, nil), "unknown shape")
+	assert.ErrorContains(t, app.SpeedTableAction(SpeedTableOptions{Shape: "exp", Vstart: 100, Vmax: 100}, nil), "must be higher")
+}
+
+func TestCVActions_Optimize(t *testing.T) {
+	app, out := newMockApp(t)
+	assert.NoError(t, app.SendCVAction("cv1=17, cv29=34", CVSendOptions{Mode: "prog", Timeout: time.Second, Strict: true}))
+
+	assert.NoError(t, app.SendCVAction("cv1=17, cv29=6, cv300=1, cv31=16", CVSendOptions{Mode: "prog", Timeout: time.Second, Strict: true, Optimize: true}))
+	assert.Equal(t, "unchanged: cv1=17\nwrite:     cv31=16\nwrite:     cv29=6\nwrite:     cv300=1\nplan: 3 of 4 CV(s) written\n", out.String())
+
+	out.Reset()
+	known := filepath.Join(t.TempDir(), "backup.txt")
+	assert.NoError(t, os.WriteFile(known, []byte("cv1=17\ncv29=6\n"), 0o644))
+	assert.NoError(t, app.SendCVAction("cv1=17, cv29=6, cv8=8", CVSendOptions{Mode: "prog", Timeout: time.Second, Strict: true, Optimize: true, Known: known}))
+	assert.Equal(t, "write:     cv8=8\nwrite:     cv1=17\nwrite:     cv29=6\nplan: 3 of 3 CV(s) written\n", out.String())
+}
+
+func TestPlanCVWrites(t *testing.T) {
+	current := map[uint16]int{31: 16, 32: 0, 257: 4, 258: 5, 29: 6}
+	lookup := func(cv uint16) (int, bool) {
+		value, ok := current[cv]
+		return value, ok
+	}
+
+	// the index is already right, so the paged CVs are compared
+	plan := planCVWrites([]syntax.CVEntry{{Number: 257, Value: 4}, {Number: 258, Value: 1}, {Number: 31, Value: 16}, {Number: 29, Value: 6}}, lookup)
+	assert.Equal(t, []syntax.CVEntry{{Number: 258, Value: 1}}, plan.writes)
+	assert.Len(t, plan.unchanged, 3)
+
+	// another page holds other values
+	plan = planCVWrites([]syntax.CVEntry{{Number: 257, Value: 4}, {Number: 32, Value: 1}}, lookup)
+	assert.Equal(t, []syntax.CVEntry{{Number: 32, Value: 1}, {Number: 257, Value: 4}}, plan.writes)
+	assert.Empty(t, plan.unchanged)
+}
+
+func TestCVActions_StrictRejectsConflicts(t *testing.T) {
+	app, _ := newMockApp(t)
+	assert.Error(t, app.SendCVAction("cv1=17, cv1=18", CVSendOptions{Mode: "prog", Timeout: time.Second, Strict: true}))
+}
+
+func TestFnActions(t *testing.T) {
+	app, out := newMockApp(t)
+
+	assert.NoError(t, app.SendFnAction("pom", 3, 0, commandstation.FnOn, 0, time.Second, 0))
+	assert.NoError(t, app.SendFnAction("pom", 3, 5, commandstation.FnOn, 0, time.Second, 0))
+	assert.NoError(t, app.SendFnAction("pom", 3, 5, commandstation.FnOff, 0, time.Second, 0))
+	assert.NoError(t, app.ListFnAction(3, time.Second, 0))
+	assert.Equal(t, "F0 = On\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, app.SendFnAction("pom", 3, 0, commandstation.FnToggle, 0, time.Second, 0))
+	assert.NoError(t, app.SendFnAction("pom", 3, 2, commandstation.FnToggle, 0, time.Second, 0))
+	assert.NoError(t, app.ListFnAction(3, time.Second, 0))
+	assert.Equal(t, "F2 = On\n", out.String())
+}
+
+func TestBinaryStateAction(t *testing.T) {
+	app, _ := newMockApp(t)
+
+	assert.NoError(t, app.SendBinaryStateAction(3, 200, true, 0, time.Second, 0))
+	assert.NoError(t, app.SendBinaryStateAction(3, 201, true, 0, time.Second, 0))
+	assert.NoError(t, app.SendBinaryStateAction(3, 201, false, 0, time.Second, 0))
+	assert.Error(t, app.SendBinaryStateAction(3, 40000, true, 0, time.Second, 0))
+
+	station, err := commandstation.NewMockStation(app.Config.Server.MockState)
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint16]bool{200: true}, station.Decoders[3].BinaryStates)
+}
+
+func TestSpeedActions(t *testing.T) {
+	app, out := newMockApp(t)
+
+	assert.NoError(t, app.SetSpeedAction(3, 40, false, 128, 0, time.Second, 0))
+	speed, forward, err := app.GetSpeedAction(3, time.Second, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(40), speed)
+	assert.False(t, forward)
+
+	assert.NoError(t, app.PrintSpeedAction(3, time.Second, 0))
+	assert.Equal(t, "Locomotive 3: speed=40 direction=reverse\n", out.String())
+}
+
+func TestRampSpeedAction(t *testing.T) {
+	app, _ := newMockApp(t)
+	app.Config.Throttle.StepInterval = 5
+
+	assert.NoError(t, app.SetSpeedAction(3, 10, true, 128, 0, time.Second, 0))
+	assert.NoError(t, app.RampSpeedAction(3, 50, true, 128, 50*time.Millisecond, "ease-in-out", -1, time.Second, 0))
+	speed, forward, err := app.GetSpeedAction(3, time.Second, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(50), speed)
+	assert.True(t, forward)
+
+	assert.Error(t, app.RampSpeedAction(3, 20, false, 128, 0, "", -1, time.Second, 0), "moving in the other direction")
+	assert.Error(t, app.RampSpeedAction(3, 20, true, 128, 0, "no-such-curve.csv", -1, time.Second, 0))
+}
+
+func TestReplayAction(t *testing.T) {
+	app, out := newMockApp(t)
+	path := filepath.Join(t.TempDir(), "run.json")
+	recording := throttle.Recording{Loco: 3, Events: []throttle.Event{
+		{At: 0, Type: throttle.EventSpeed, Speed: 0, Forward: true, Steps: 128},
+		{At: 10, Type: throttle.EventFunction, Function: 0, On: true},
+		{At: 20, Type: throttle.EventSpeed, Speed: 30, Forward: true, Steps: 128},
+	}}
+	assert.NoError(t, recording.Save(path))
+
+	assert.NoError(t, app.ReplayAction(path, 5, false))
+	speed, forward, err := app.GetSpeedAction(5, time.Second, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(30), speed)
+	assert.True(t, forward)
+	assert.Contains(t, out.String(), "F0 on")
+}
+
+func TestReplayAction_SessionLog(t *testing.T) {
+	app, out := newMockApp(t)
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	log := `{"format":"z21-session","version":1,"started":"2024-05-01T12:00:00Z"}
+{"time":"2024-05-01T12:00:00Z","dir":"tx","peer":"192.168.0.111:21105","data":"09 00 40 00 23 11 00 07 35"}
+{"time":"2024-05-01T12:00:00.25Z","dir":"rx","peer":"192.168.0.111:21105","data":"0A 00 40 00 64 14 00 07 91 E6"}
+`
+	assert.NoError(t, os.WriteFile(path, []byte(log), 0o644))
+
+	assert.NoError(t, app.ReplayAction(path, 0, false))
+	assert.Contains(t, out.String(), "+0s tx LAN_X_CV_READ CV8\n")
+	assert.Contains(t, out.String(), "+250ms rx LAN_X_CV_RESULT CV8=145\n")
+}
+
+func TestAuditCVAction(t *testing.T) {
+	app, out := newMockApp(t)
+	project := filepath.Join(t.TempDir(), "cv.txt")
+	assert.NoError(t, os.WriteFile(project, []byte("# BR 218\ncv1=3\ncv3=10 # not audited\ncv29=6\n"), 0o644))
+	app.Config.Audit = config.Audit{
+		CVs:   []uint16{1, 17, 18, 19, 29},
+		Locos: []config.AuditLoco{{Addr: 3, File: project}, {Addr: 5, File: project}},
+	}
+
+	assert.NoError(t, app.AuditCVAction(0, time.Second, 0))
+	assert.Equal(t, "loco 3: ok (2 CVs)\nloco 5: not on the track, skipped\n", out.String())
+
+	// reprogrammed by another throttle
+	assert.NoError(t, app.SendCVAction("cv29=38", CVSendOptions{Mode: "pom", LocoId: 3, Timeout: time.Second, Strict: true}))
+	out.Reset()
+	assert.ErrorIs(t, app.AuditCVAction(0, time.Second, 0), ErrCVDrift)
+	assert.Equal(t, "loco 3: cv29=38, expected 6\nloco 5: not on the track, skipped\n", out.String())
+}
+
+func TestCloneAction(t *testing.T) {
+	app, out := newMockApp(t)
+	// a second locomotive of the same family, with a long address
+	assert.NoError(t, app.SetSpeedAction(9, 0, true, 128, 0, time.Second, 0))
+	assert.NoError(t, app.SendCVAction("cv29=38", CVSendOptions{Mode: "pom", LocoId: 9, Timeout: time.Second, Strict: true}))
+	assert.NoError(t, app.SendCVAction("cv3=10, cv19=5", CVSendOptions{Mode: "pom", LocoId: 3, Timeout: time.Second, Strict: true}))
+
+	// the user removes CV19 from the exclusions
+	app.In = strings.NewReader("1,17,18\n")
+	assert.NoError(t, app.CloneAction(3, 9, "cv1-cv4, cv19, cv29", []uint16{1, 17, 18, 19}, true, -1, time.Second, 0))
+	assert.Equal(t, "CVs that are not copied [1,17,18,19]: cv2=0\ncv3=10\ncv4=0\ncv19=5\ncv29=38\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, app.ReadCVAction("pom", 9, "cv1, cv3, cv19, cv29", false, time.Second, 0, CVOutput{}))
+	assert.Equal(t, "cv1=9\ncv19=5\ncv29=38\ncv3=10\n", out.String())
+
+	assert.Error(t, app.CloneAction(3, 3, "cv1-cv4", nil, false, -1, time.Second, 0))
+}
+
+func TestProgSessionAction(t *testing.T) {
+	app, out := newMockApp(t)
+
+	app.In = strings.NewReader("set cv1=5\nget cv1, cv29\nbogus\nexit\nget cv1\n")
+	assert.NoError(t, app.ProgSessionAction(time.Minute, time.Minute, time.Second, 0))
+	assert.Contains(t, out.String(), "prog> cv1=5 written\nprog> cv1=5\ncv29=6\nprog> unknown command \"bogus\"")
+	assert.True(t, strings.HasSuffix(out.String(), "prog> programming session ended, restoring the track power\n"))
+
+	// nobody types anything
+	out.Reset()
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	app.In = reader
+	assert.NoError(t, app.ProgSessionAction(time.Minute, 50*time.Millisecond, time.Second, 0))
+	assert.Contains(t, out.String(), "no command for 50ms")
+}
+
+func TestPlanSoundRenames(t *testing.T) {
+	rules, err := readSoundRenameMap(strings.NewReader("from,to\n# swap the horns\nF3,F11\nF11,F3\nF2_Bell.wav,F2_Bell-old.wav\n"))
+	assert.NoError(t, err)
+
+	renames, err := planSoundRenames([]string{"F11_Horn.wav", "f3_Horn.wav", "F2_Bell.wav", "F1_Engine.wav"}, rules)
+	assert.NoError(t, err)
+	assert.Equal(t, []soundRename{
+		{From: "F11_Horn.wav", To: "F3_Horn.wav"},
+		{From: "F2_Bell.wav", To: "F2_Bell-old.wav"},
+		{From: "f3_Horn.wav", To: "F11_Horn.wav"},
+	}, renames)
+
+	// the target would be lost
+	_, err = planSoundRenames([]string{"F3_Horn.wav", "F11_Horn.wav"}, []soundRenameRule{{function: true, fromFn: 3, toFn: 11}})
+	assert.Error(t, err)
+	_, err = planSoundRenames([]string{"F1_Engine.wav"}, []soundRenameRule{{from: "F2_Bell.wav", to: "F3_Bell.wav"}})
+	assert.Error(t, err)
+	_, err = readSoundRenameMap(strings.NewReader("F3,F3_Horn.wav\n"))
+	assert.Error(t, err)
+}
+
+func TestNotSupported(t *testing.T) {
+	app, _ := newMockApp(t)
+
+	var notSupported *commandstation.ErrNotSupported
+	assert.ErrorAs(t, app.SendCVAction("cv1=2", CVSendOptions{Mode: "pom", LocoId: 3, Timeout: time.Second, Strict: true, Format: "mm"}), &notSupported)
+	assert.Equal(t, commandstation.CapabilityMMOnMain, notSupported.Capability)
+	assert.ErrorAs(t, app.SendFnAction("prog", 3, 1, commandstation.FnOn, 0, time.Second, 0), &notSupported)
+	assert.Equal(t, commandstation.CapabilityFnOnProg, notSupported.Capability)
+	assert.ErrorAs(t, app.FeedbackStatusAction(), &notSupported)
+	assert.Equal(t, commandstation.CapabilityFeedback, notSupported.Capability)
+}
+
+func TestFormatMonitorRecord(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	record := z21proto.CVResult{CV: 8, Value: 145}.Encode()
+
+	assert.Equal(t, "12:30:00.000 LAN_X_CV_RESULT CV8=145", formatMonitorRecord(MonitorText, at, "default", "", record))
+	assert.Equal(t, "12:30:00.000 [bench] 0A 00 40 00 64 14 00 07 91 E6", formatMonitorRecord(MonitorHex, at, "bench", "[bench] ", record))
+
+	line := formatMonitorRecord(MonitorJSON, at, "default", "", record)
+	assert.Contains(t, line, `"name":"LAN_X_CV_RESULT"`)
+	assert.Contains(t, line, `"message":{"CV":8,"Value":145}`)
+
+	assert.Contains(t, formatMonitorRecord(MonitorJSON, at, "default", "", []byte{0x04, 0x00, 0xEE, 0x00}), `"error":`)
+}
+
+func TestMonitorAction_StationProfiles(t *testing.T) {
+	// a Z21 that takes the subscription and stays silent
+	bench, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer bench.Close()
+	subscribed := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 64)
+		if n, _, err := bench.ReadFrom(buf); err == nil {
+			subscribed <- buf[:n]
+		}
+	}()
+
+	app, _ := newMockApp(t)
+	app.Config.Stations = map[string]config.Server{
+		"bench": {Type: "z21", Address: "127.0.0.1", Port: uint16(bench.LocalAddr().(*net.UDPAddr).Port)},
+		"desk":  app.Config.Server,
+	}
+	assert.ErrorContains(t, app.MonitorAction([]string{"attic"}, MonitorText, false, "", 0), "unknown station profile 'attic'")
+
+	// a later station that cannot be monitored stops the ones already listened to
+	done := make(chan error, 1)
+	go func() { done <- app.MonitorAction([]string{"bench", "desk"}, MonitorText, false, "", 0) }()
+	select {
+	case err := <-done:
+		var notSupported *commandstation.ErrNotSupported
+		assert.ErrorAs(t, err, &notSupported)
+		assert.Equal(t, commandstation.CapabilityMonitor, notSupported.Capability)
+		assert.ErrorContains(t, err, "station 'desk'")
+	case <-time.After(5 * time.Second):
+		t.Fatal("MonitorAction did not return")
+	}
+	select {
+	case packet := <-subscribed:
+		assert.Equal(t, "LAN_SET_BROADCASTFLAGS", strings.Fields(z21proto.Annotate(packet))[0])
+	case <-time.After(time.Second):
+		t.Fatal("the bench station was not subscribed to")
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	probes := newHealthProbes(time.Minute)
+	now := probes.started
+	probes.now = func() time.Time { return now }
+	health := probes.station("default")
+	handler := probes.handler()
+
+	get := func(path string) (int, string) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	code, _ := get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, body := get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "not connected")
+
+	health.setConnected(true)
+	health.subscribed(now)
+	health.packetReceived(now)
+	now = now.Add(30 * time.Second)
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"last_packet_age_seconds":30`)
+
+	// the subscription is renewed, but the station went silent
+	health.subscribed(now)
+	now = now.Add(45 * time.Second)
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "silent")
+}
+
+func TestSyncReason(t *testing.T) {
+	lastSync := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	unchanged := &syncLocalFile{sizeBytes: 10 * 1024, modTime: lastSync}
+	edited := &syncLocalFile{sizeBytes: 20 * 1024, modTime: lastSync.Add(time.Hour)}
+	size := func(kb int64) *int64 { return &kb }
+	record := &syncedFile{SizeKB: 10, ModTime: lastSync}
+	hashed := &syncedFile{SizeKB: 10, ModTime: lastSync, SHA256: "aa"}
+	same := &syncLocalFile{sizeBytes: 10 * 1024, modTime: lastSync.Add(time.Hour), hash: "aa"}
+	rewritten := &syncLocalFile{sizeBytes: 10 * 1024, modTime: lastSync, hash: "bb"}
+
+	tests := []struct {
+		name      string
+		direction SyncDirection
+		local     *syncLocalFile
+		remote    *int64
+		synced    *syncedFile
+		want      string
+	}{
+		{"push uploads a new file", SyncPush, unchanged, nil, nil, SyncReasonNew},
+		{"push deletes a remote only file", SyncPush, nil, size(10), nil, SyncReasonOrphan},
+		{"push overwrites a changed file", SyncPush, unchanged, size(30), record, SyncReasonChanged},
+		{"pull downloads a remote only file", SyncPull, nil, size(10), nil, SyncReasonRemote},
+		{"pull keeps a local only file", SyncPull, unchanged, nil, nil, SyncReasonLocalOnly},
+		{"pull overwrites a changed file", SyncPull, edited, size(10), record, SyncReasonRemoteChanged},
+		{"both downloads a remote only file", SyncBoth, nil, size(10), nil, SyncReasonRemote},
+		{"both uploads a local only file", SyncBoth, unchanged, nil, nil, SyncReasonNew},
+		{"both uploads a local edit", SyncBoth, edited, size(10), record, SyncReasonChanged},
+		{"both downloads a remote edit", SyncBoth, unchanged, size(30), record, SyncReasonRemoteChanged},
+		{"both keeps an edit on both sides", SyncBoth, edited, size(30), record, SyncReasonConflict},
+		{"both cannot tell without a record", SyncBoth, unchanged, size(30), nil, SyncReasonConflict},
+		{"both skips the same file", SyncBoth, unchanged, size(10), record, SyncReasonSame},
+		{"push skips a touched file of the same content", SyncPush, same, size(10), hashed, SyncReasonSame},
+		{"push uploads an edit keeping the size", SyncPush, rewritten, size(10), hashed, SyncReasonChanged},
+		{"push uploads over a file replaced on the decoder", SyncPush, same, size(11), hashed, SyncReasonChanged},
+		{"pull downloads over a local edit keeping the size", SyncPull, rewritten, size(10), hashed, SyncReasonRemoteChanged},
+		{"both uploads an edit keeping the size", SyncBoth, rewritten, size(10), hashed, SyncReasonChanged},
+		{"both downloads a file replaced on the decoder", SyncBoth, same, size(11), hashed, SyncReasonRemoteChanged},
+		{"both keeps an edit keeping the size on both sides", SyncBoth, rewritten, size(11), hashed, SyncReasonConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, syncReason(tt.direction, tt.local, tt.remote, tt.synced))
+		})
+	}
+}
+
+func TestSyncState(t *testing.T) {
+	dir := t.TempDir()
+	state, err := loadSyncState(dir)
+	assert.NoError(t, err)
+	modTime := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	state.slot(2)["F1_Horn.wav"] = syncedFile{SizeKB: 12, ModTime: modTime}
+	assert.NoError(t, state.save(dir))
+
+	state, err = loadSyncState(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]syncedFile{"F1_Horn.wav": {SizeKB: 12, ModTime: modTime}}, state.slot(2))
+	assert.Empty(t, state.slot(1))
+
+	local := syncLocalFile{sizeBytes: 4 << 20, modTime: modTime}
+	state.uploaded(2, "F2_Engine.wav", local, 1<<20)
+	onDecoder := int64(1024)
+	assert.Equal(t, int64(1<<20), state.resumeOffset(2, "F2_Engine.wav", local, &onDecoder))
+	edited := syncLocalFile{sizeBytes: local.sizeBytes, modTime: modTime.Add(time.Minute)}
+	assert.Zero(t, state.resumeOffset(2, "F2_Engine.wav", edited, &onDecoder), "the local file changed")
+	replaced := int64(3000)
+	assert.Zero(t, state.resumeOffset(2, "F2_Engine.wav", local, &replaced), "the file on the decoder changed")
+	state.uploaded(2, "F2_Engine.wav", local, local.sizeBytes)
+	assert.Zero(t, state.resumeOffset(2, "F2_Engine.wav", local, &onDecoder), "the upload is complete")
+
+	_, err = ParseSyncDirection("sideways")
+	assert.Error(t, err)
+}
+
+func TestRunSyncItems(t *testing.T) {
+	var items []syncItem
+	for i := range 6 {
+		name := fmt.Sprintf("F%d.wav", i)
+		item := syncItem{compared: SyncEvent{Kind: SyncCompare, File: name}}
+		if i != 2 {
+			delay := time.Duration(6-i) * 5 * time.Millisecond
+			item.transfer = func(progress SyncProgressFunc) error {
+				progress(SyncEvent{Kind: SyncUploadStart, File: name})
+				time.Sleep(delay)
+				if i == 4 {
+					return fmt.Errorf("upload %q failed", name)
+				}
+				progress(SyncEvent{Kind: SyncUploadDone, File: name})
+				return nil
+			}
+		}
+		items = append(items, item)
+	}
+
+	var events []string
+	err := runSyncItems(items, 3, func(event SyncEvent) {
+		events = append(events, string(event.Kind)+" "+event.File)
+	})
+	assert.EqualError(t, err, `upload "F4.wav" failed`)
+	assert.Equal(t, []string{
+		"compare F0.wav", "upload-start F0.wav", "upload-done F0.wav",
+		"compare F1.wav", "upload-start F1.wav", "upload-done F1.wav",
+		"compare F2.wav",
+		"compare F3.wav", "upload-start F3.wav", "upload-done F3.wav",
+		"compare F4.wav", "upload-start F4.wav",
+		"compare F5.wav", "upload-start F5.wav", "upload-done F5.wav",
+	}, events)
+}
+
+// fakeRailbox serves the sound slots of a Railbox decoder over HTTP, truncate cuts the next uploads of a file,
+// drop loses them and the next unavailable requests are answered with 503. With capacityKB the storage space is reported,
+// info is the status page of the firmware, the CVs are served when cvs is set.
+type fakeRailbox struct {
+	mu          sync.Mutex
+	files       map[string][]byte
+	truncate    map[string]int
+	drop        map[string]int
+	unavailable int
+	capacityKB  int64
+	info        string
+	cvs         map[uint16]int
+}
+
+func (f *fakeRailbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.unavailable > 0 {
+		f.unavailable--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Query().Get("p"), "/")
+	switch {
+	case r.URL.Path == "/upload":
+		data := formFile(r, decoders.UPLOAD_FORM_FIELD)
+		if f.truncate[path] > 0 {
+			f.truncate[path]--
+			data = data[:len(data)/2]
+		}
+		if f.drop[path] > 0 {
+			f.drop[path]--
+			return
+		}
+		f.files[path] = data
+	case r.URL.Path == "/delete":
+		delete(f.files, path)
+	case r.URL.Path == "/update":
+		// the image of a test is the version it installs
+		image := formFile(r, decoders.FIRMWARE_FORM_FIELD)
+		f.info = "firmware: " + string(image)
+	case r.URL.Path == "/cv" && f.cvs != nil:
+		num, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		if value := r.URL.Query().Get("v"); value != "" {
+			f.cvs[uint16(num)], _ = strconv.Atoi(value)
+		}
+		fmt.Fprintf(w, "cv%d=%d\n", num, f.cvs[uint16(num)])
+	case r.URL.Path == "/cv":
+		http.NotFound(w, r)
+	case r.URL.Path == "/info":
+		if f.info == "" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, f.info)
+	case path == "":
+		slots := map[string]bool{}
+		for name := range f.files {
+			if slot, _, ok := strings.Cut(name, "/"); ok && !slots[slot] {
+				slots[slot] = true
+				fmt.Fprintf(w, "<tr><td><input placeholder='%s'> </td><td>dir</td><td></td></tr>", slot)
+			}
+		}
+		if f.capacityKB > 0 {
+			var used int
+			for _, data := range f.files {
+				used += len(data)
+			}
+			fmt.Fprintf(w, "<p>Used: %d KB Total: %d KB</p>", (used+1023)/1024, f.capacityKB)
+		}
+	case strings.HasSuffix(path, "/"):
+		for name, data := range f.files {
+			if file, ok := strings.CutPrefix(name, path); ok {
+				fmt.Fprintf(w, "<tr><td><input placeholder='%s'> </td><td>file</td><td align='right'>%d</td></tr>", file, (len(data)+1023)/1024)
+			}
+		}
+	default:
+		data, ok := f.files[path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	}
+}
+
+// formFile reads the file of an upload form, as the firmware does
+func formFile(r *http.Request, field string) []byte {
+	file, _, err := r.FormFile(field)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	data, _ := io.ReadAll(file)
+	return data
+}
+
+func TestSyncSoundSlot(t *testing.T) {
+	decoder := &fakeRailbox{
+		files:    map[string][]byte{"1/F9_Old.wav": make([]byte, 2048), "1/F3_Bell.wav": make([]byte, 5000)},
+		truncate: map[string]int{"1/F1_Horn.wav": 1},
+	}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F1_Horn.wav"), make([]byte, 20000), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F2_Engine.wav"), make([]byte, 30000), 0o644))
+
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+
+	// pull brings the files of the decoder, nothing is deleted on either side
+	_, err := app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPull}, nil)
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, "F3_Bell.wav"))
+	assert.FileExists(t, filepath.Join(dir, "F1_Horn.wav"))
+	assert.NotContains(t, decoder.files, "1/F1_Horn.wav")
+	assert.NoError(t, os.Remove(filepath.Join(dir, "F9_Old.wav")))
+
+	// push uploads the horn twice, as the first upload is truncated, and deletes the orphan afterwards
+	_, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush, Parallel: 2, MismatchRetries: 1}, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "mismatch: F1_Horn.wav (local 20 KB, decoder 10 KB after the upload)")
+	assert.Contains(t, out.String(), "retry:    F1_Horn.wav")
+	assert.Len(t, decoder.files["1/F1_Horn.wav"], 20000)
+	assert.Len(t, decoder.files["1/F2_Engine.wav"], 30000)
+	assert.NotContains(t, decoder.files, "1/F9_Old.wav")
+
+	// without retries a truncated upload fails the sync
+	decoder.truncate["1/F2_Engine.wav"] = 1
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F2_Engine.wav"), make([]byte, 40000), 0o644))
+	_, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncBoth}, nil)
+	assert.ErrorContains(t, err, "1 uploaded file(s) differ on the decoder: F2_Engine.wav")
+}
+
+func TestSyncSoundSlot_Events(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{"1/F9_Old.wav": make([]byte, 2048)}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F1_Horn.wav"), make([]byte, 3000), 0o644))
+
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+
+	events := make(chan SyncEvent, 100)
+	_, err := app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush}, SyncEventsToChannel(events))
+	assert.NoError(t, err)
+	close(events)
+	var kinds []SyncEventKind
+	var uploaded int64
+	for event := range events {
+		if event.Kind == SyncUploadProgress {
+			uploaded = event.Bytes
+			continue
+		}
+		kinds = append(kinds, event.Kind)
+		switch event.Kind {
+		case SyncScan:
+			assert.Equal(t, SyncEvent{Kind: SyncScan, Slot: 1, LocalFiles: 1, RemoteFiles: 1}, event)
+		case SyncCompare:
+			assert.Equal(t, SyncEvent{Kind: SyncCompare, Slot: 1, File: "F1_Horn.wav", Reason: SyncReasonNew, LocalSizeKB: 3}, event)
+		case SyncDelete:
+			assert.Equal(t, "F9_Old.wav", event.File)
+		}
+	}
+	assert.Equal(t, []SyncEventKind{SyncScan, SyncCompare, SyncUploadStart, SyncUploadDone, SyncDelete}, kinds)
+	assert.Equal(t, int64(3000), uploaded)
+	// a callback replaces the printing
+	assert.Empty(t, out.String())
+
+	encoded, err := json.Marshal(SyncEvent{Kind: SyncCompare, Slot: 1, File: "F1_Horn.wav", Reason: SyncReasonNew, LocalSizeKB: 3})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"kind":"compare","slot":1,"file":"F1_Horn.wav","reason":"new","localSizeKB":3}`, string(encoded))
+}
+
+func TestSyncSoundSlot_MissingAfterUpload(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{}, drop: map[string]int{"1/F1_Horn.wav": 1}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F1_Horn.wav"), make([]byte, 2000), 0o644))
+
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+
+	var mismatches []SyncEvent
+	record := func(event SyncEvent) {
+		if event.Kind == SyncMismatch {
+			mismatches = append(mismatches, event)
+		}
+		app.printSyncEvent(event)
+	}
+	_, err := app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush, MismatchRetries: 1}, record)
+	assert.NoError(t, err)
+	assert.Equal(t, []SyncEvent{{Kind: SyncMismatch, Slot: 1, File: "F1_Horn.wav", Reason: SyncReasonMissing, LocalSizeKB: 2}}, mismatches)
+	assert.Contains(t, out.String(), "mismatch: F1_Horn.wav is missing on the decoder after the upload\nretry:    F1_Horn.wav\n")
+	assert.Len(t, decoder.files["1/F1_Horn.wav"], 2000)
+
+	// the retries run out, the file is not taken for synced and is uploaded by the next sync
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F1_Horn.wav"), make([]byte, 3000), 0o644))
+	decoder.drop["1/F1_Horn.wav"] = 2
+	delete(decoder.files, "1/F1_Horn.wav")
+	mismatches = nil
+	_, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush, MismatchRetries: 1}, record)
+	assert.ErrorContains(t, err, "1 uploaded file(s) differ on the decoder: F1_Horn.wav")
+	assert.Len(t, mismatches, 2)
+	_, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, decoder.files["1/F1_Horn.wav"], 3000)
+}
+
+func TestSyncSoundSlot_RetriesUnavailableDecoder(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{}, unavailable: 2}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F1_Horn.wav"), make([]byte, 2000), 0o644))
+
+	app, _ := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	fast := decoders.WithRetryPolicy(decoders.RetryPolicy{Attempts: 3, Backoff: time.Millisecond})
+
+	_, err := app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush}, nil, fast)
+	assert.NoError(t, err)
+	assert.Len(t, decoder.files["1/F1_Horn.wav"], 2000)
+
+	// the last answer is passed on when the attempts run out
+	decoder.unavailable = 3
+	_, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush}, nil, fast)
+	assert.ErrorContains(t, err, "503")
+}
+
+func TestSlotManifest(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F1_Horn.wav"), make([]byte, 2000), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F2_Engine.wav"), make([]byte, 2000), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, slotManifestFile), []byte(`sounds:
+  - function: F1
+    file: F1_Horn.wav
+    volume: 120
+  - function: 3
+    file: F2_Engine.wav
+    loop: true
+  - function: F4
+    file: F4_Missing.wav
+`), 0o644))
+
+	app, _ := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+
+	_, err := app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush}, nil)
+	assert.ErrorContains(t, err, "sound 1 (F1_Horn.wav): volume 120 is out of 0-100")
+	assert.ErrorContains(t, err, "sound 2 (F2_Engine.wav): the file of F3 has to be named F3_...")
+	assert.ErrorContains(t, err, "sound 3 (F4_Missing.wav): the file is not in the directory")
+	assert.Empty(t, decoder.files)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, slotManifestFile), []byte(`sounds:
+  - function: F1
+    file: F1_Horn.wav
+    volume: 80
+`), 0o644))
+	manifest, err := loadSlotManifest(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 80, *manifest.Sounds[0].Volume)
+
+	_, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush}, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, decoder.files, "1/"+slotManifestFile)
+	assert.Contains(t, decoder.files, "1/F2_Engine.wav")
+}
+
+func TestImportSoundProjectAction(t *testing.T) {
+	project := t.TempDir()
+	var native bytes.Buffer
+	assert.NoError(t, audio.WriteWAV(&native, &audio.Clip{SampleRate: decoders.SOUND_FORMAT.SampleRate, Samples: [][]float64{make([]float64, 100)}}, 16))
+	for name, data := range map[string][]byte{
+		"Slot 01 - Diesel/start.wav":   []byte("start"),
+		"Slot 01 - Diesel/loop.wav":    []byte("loop"),
+		"Slot 04 - Horn (F2)/horn.wav": native.Bytes(),
+	} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(project, filepath.Dir(name)), 0o755))
+		assert.NoError(t, os.WriteFile(filepath.Join(project, name), data, 0o644))
+	}
+
+	app, out := newMockApp(t)
+	dir := filepath.Join(t.TempDir(), "br218")
+	assert.NoError(t, app.ImportSoundProjectAction(project, dir, ImportOptions{Functions: map[int]int{1: 3}}))
+	assert.Contains(t, out.String(), "import:   F2_Horn.wav <- Slot 04 - Horn (F2)/horn.wav\n")
+	assert.Contains(t, out.String(), "imported 3 sample(s) of 2 slot(s)")
+	assert.Contains(t, out.String(), "2 sample(s) are not in the format of the decoder")
+
+	horn, err := os.ReadFile(filepath.Join(dir, "F2_Horn.wav"))
+	assert.NoError(t, err)
+	assert.Equal(t, native.Bytes(), horn)
+	manifest, err := loadSlotManifest(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []slotSound{
+		{Function: "F3", File: "F3_Diesel_loop.wav", Loop: true},
+		{Function: "F3", File: "F3_Diesel_start.wav"},
+		{Function: "F2", File: "F2_Horn.wav"},
+	}, manifest.Sounds)
+	assert.NoError(t, checkSlotManifest(dir, map[string]syncLocalFile{"F3_Diesel_loop.wav": {}, "F3_Diesel_start.wav": {}, "F2_Horn.wav": {}}))
+
+	assert.ErrorContains(t, app.ImportSoundProjectAction(project, dir, ImportOptions{}), "is not empty")
+	assert.NoError(t, app.ImportSoundProjectAction(project, dir, ImportOptions{Force: true}))
+	assert.FileExists(t, filepath.Join(dir, "F1_Diesel_loop.wav"))
+}
+
+func TestInspectSoundProjectAction_Zimo(t *testing.T) {
+	var sample bytes.Buffer
+	assert.NoError(t, audio.WriteWAV(&sample, &audio.Clip{SampleRate: 22050, Samples: [][]float64{make([]float64, 1000)}}, 16))
+	path := filepath.Join(t.TempDir(), "BR218.zpp")
+	assert.NoError(t, os.WriteFile(path, append([]byte("ZPP\x00Pfiff.wav\x00"), sample.Bytes()...), 0o644))
+
+	app, out := newMockApp(t)
+	assert.NoError(t, app.InspectSoundProjectAction(path, ""))
+	assert.Equal(t, "format:   zimo\nslot 1: Pfiff (function unknown)\n  Pfiff.wav                            2 KB  1 ch, 22050 Hz, 16 bit\n1 sample(s) in 1 slot(s), 0 other file(s)\n", out.String())
+
+	dir := t.TempDir()
+	assert.NoError(t, app.ImportSoundProjectAction(path, dir, ImportOptions{Functions: map[int]int{1: 4}}))
+	assert.FileExists(t, filepath.Join(dir, "F4_Pfiff.wav"))
+
+	assert.ErrorContains(t, app.InspectSoundProjectAction(filepath.Join(dir, "F4_Pfiff.wav"), ""), "cannot tell the format")
+}
+
+func TestSoundPackage_ExportImport(t *testing.T) {
+	decoder := &fakeRailbox{
+		files: map[string][]byte{"1/F1_Horn.wav": []byte("horn"), "1/" + slotManifestFile: []byte("sounds: []\n"), "2/F5_Other.wav": []byte("other")},
+		info:  "model: RB2300\nfirmware: 1.4.2",
+	}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+
+	archive := filepath.Join(t.TempDir(), "br218.zip")
+	assert.NoError(t, app.ExportSoundSlotAction(1, archive))
+	assert.Contains(t, out.String(), "exported 2 file(s) of slot 1 into "+archive)
+	assert.ErrorContains(t, app.ExportSoundSlotAction(7, archive), "slot 7 is empty")
+
+	out.Reset()
+	assert.NoError(t, app.InspectSoundProjectAction(archive, ""))
+	assert.Contains(t, out.String(), "format:   loco, slot 1 exported")
+	assert.Contains(t, out.String(), "decoder:  RB2300 1.4.2\n")
+
+	dir := filepath.Join(t.TempDir(), "br218")
+	assert.NoError(t, app.ImportSoundProjectAction(archive, dir, ImportOptions{}))
+	horn, err := os.ReadFile(filepath.Join(dir, "F1_Horn.wav"))
+	assert.NoError(t, err)
+	assert.Equal(t, "horn", string(horn))
+	assert.FileExists(t, filepath.Join(dir, slotManifestFile))
+	assert.NoFileExists(t, filepath.Join(dir, soundPackageManifestFile))
+	assert.ErrorContains(t, app.ImportSoundProjectAction(archive, dir, ImportOptions{Functions: map[int]int{1: 2}}), "named after their functions")
+
+	// a file changed after the export is refused
+	damaged := filepath.Join(t.TempDir(), "damaged.zip")
+	f, err := os.Create(damaged)
+	assert.NoError(t, err)
+	w := zip.NewWriter(f)
+	entry, _ := w.Create("F1_Horn.wav")
+	_, _ = entry.Write([]byte("HORN"))
+	entry, _ = w.Create(soundPackageManifestFile)
+	_, _ = entry.Write([]byte(`{"slot": 1, "files": [{"name": "F1_Horn.wav", "sha256": "` + fmt.Sprintf("%x", sha256.Sum256([]byte("horn"))) + `"}]}`))
+	assert.NoError(t, w.Close())
+	assert.NoError(t, f.Close())
+	assert.ErrorContains(t, app.ImportSoundProjectAction(damaged, t.TempDir(), ImportOptions{}), "is damaged")
+}
+
+func TestWatchSoundSlot_SyncsPendingChangeOnStop(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+	// the change is only synced when the watch stops
+	debounce := watchDebounce
+	watchDebounce = time.Minute
+	defer func() { watchDebounce = debounce }()
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F1_Horn.wav"), []byte("horn"), 0o644))
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- app.WatchSoundSlot(ctx, 1, dir, SyncOptions{Direction: SyncPush}, func(SyncEvent) {})
+	}()
+
+	assert.Eventually(t, func() bool {
+		decoder.mu.Lock()
+		defer decoder.mu.Unlock()
+		return decoder.files["1/F1_Horn.wav"] != nil
+	}, 5*time.Second, 10*time.Millisecond, "the initial sync")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F2_Bell.wav"), []byte("bell"), 0o644))
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watch did not stop")
+	}
+	assert.Equal(t, []byte("bell"), decoder.files["1/F2_Bell.wav"])
+	assert.Contains(t, out.String(), "watch: stopping, syncing the pending change")
+	assert.Contains(t, out.String(), "watch: stopped after 2 sync(s), 0 failed, 2 file(s) transferred, 0 deleted\n")
+}
+
+func TestSyncSoundSlot_Subdirectories(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{"F1/Horn.wav": "horn", "diesel/F2/start.wav": "start", "F3_Bell.wav": "bell", ".git/config": "git"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	app, _ := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	options := SyncOptions{Direction: SyncPush}
+	_, err := app.SyncSoundSlot(1, dir, options, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"1/F1_Horn.wav": []byte("horn"), "1/diesel_F2_start.wav": []byte("start"), "1/F3_Bell.wav": []byte("bell")}, decoder.files)
+
+	// a changed file on the decoder is stored where it came from
+	decoder.files["1/F1_Horn.wav"] = make([]byte, 3000)
+	_, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPull}, nil)
+	assert.NoError(t, err)
+	horn, err := os.ReadFile(filepath.Join(dir, "F1", "Horn.wav"))
+	assert.NoError(t, err)
+	assert.Len(t, horn, 3000)
+	assert.NoFileExists(t, filepath.Join(dir, "F1_Horn.wav"))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F1_Horn.wav"), []byte("horn"), 0o644))
+	_, err = app.SyncSoundSlot(1, dir, options, nil)
+	assert.ErrorContains(t, err, "would be uploaded as \"F1_Horn.wav\"")
+}
+
+func TestSyncSoundSlot_Checksums(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	dir := t.TempDir()
+	horn := filepath.Join(dir, "F1_Horn.wav")
+	assert.NoError(t, os.WriteFile(horn, []byte("horn-1"), 0o644))
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	_, err := app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush}, nil)
+	assert.NoError(t, err)
+
+	// touched only, the content is the same
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(horn, later, later))
+	out.Reset()
+	_, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush}, nil)
+	assert.NoError(t, err)
+	assert.NotContains(t, out.String(), "F1_Horn.wav")
+
+	// an edit of the same size
+	assert.NoError(t, os.WriteFile(horn, []byte("horn-2"), 0o644))
+	out.Reset()
+	_, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush}, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "changed:  F1_Horn.wav")
+	assert.Equal(t, []byte("horn-2"), decoder.files["1/F1_Horn.wav"])
+
+	state, err := loadSyncState(dir)
+	assert.NoError(t, err)
+	sum := sha256.Sum256([]byte("horn-2"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), state.slot(1)["F1_Horn.wav"].SHA256)
+}
+
+func TestSyncSoundSlot_Plan(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{"1/gone.wav": []byte("gone"), "1/F2_Bell.wav": []byte("bell"), "1/F3_Brake.wav": []byte("brake"), "1/old.flac": []byte("old")}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{"F1/Horn.wav": "horn", "F2_Bell.wav": "bell", "F3_Brake.wav": string(make([]byte, 3000))} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	options := SyncOptions{Direction: SyncPush, DryRun: true, Exclude: []string{"*.flac"}}
+	plan, err := app.SyncSoundSlot(1, dir, options, func(SyncEvent) {})
+	assert.NoError(t, err)
+	assert.Len(t, decoder.files, 4, "a dry run changes nothing")
+	assert.Empty(t, out.String())
+
+	assert.Equal(t, []SyncPlanEntry{{File: "F1_Horn.wav", Reason: SyncReasonNew, Source: "F1/Horn.wav", LocalSizeKB: 1}}, plan.Uploads)
+	assert.Equal(t, []SyncPlanEntry{{File: "F3_Brake.wav", Reason: SyncReasonChanged, LocalSizeKB: 3, RemoteSizeKB: 1}}, plan.Reuploads)
+	assert.Equal(t, []SyncPlanEntry{{File: "gone.wav", Reason: SyncReasonOrphan, RemoteSizeKB: 1}}, plan.Deletions)
+	assert.Equal(t, []SyncPlanEntry{
+		{File: "old.flac", Reason: SyncReasonExcluded, RemoteSizeKB: 1},
+		{File: "F2_Bell.wav", Reason: SyncReasonSame, LocalSizeKB: 1, RemoteSizeKB: 1},
+	}, plan.Skipped)
+	assert.Empty(t, plan.Downloads)
+	assert.Equal(t, 3, plan.Changes())
+
+	assert.NoError(t, app.PrintSyncPlan(plan))
+	assert.Contains(t, out.String(), `"downloads": []`)
+	assert.Contains(t, out.String(), `"source": "F1/Horn.wav"`)
+}
+
+// renamingDecoder is a Railbox that can rename its sound files in place
+type renamingDecoder struct {
+	decoders.Decoder
+	fake    *fakeRailbox
+	renamed []string
+}
+
+func (d *renamingDecoder) RenameSoundFile(slot uint8, from string, to string) error {
+	d.fake.mu.Lock()
+	defer d.fake.mu.Unlock()
+	prefix := fmt.Sprintf("%d/", slot)
+	d.fake.files[prefix+to] = d.fake.files[prefix+from]
+	delete(d.fake.files, prefix+from)
+	d.renamed = append(d.renamed, from+" -> "+to)
+	return nil
+}
+
+func TestSyncSoundSlot_Renames(t *testing.T) {
+	fake := &fakeRailbox{files: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{"F1_Horn.wav": "horn", "F2_Bell.wav": "bell"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	_, err := app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush}, nil)
+	assert.NoError(t, err)
+
+	// the RB23xx cannot rename, the file is sent again under the new name
+	assert.NoError(t, os.Rename(filepath.Join(dir, "F1_Horn.wav"), filepath.Join(dir, "F3_Horn.wav")))
+	plan, err := app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush, DryRun: true}, func(SyncEvent) {})
+	assert.NoError(t, err)
+	assert.Equal(t, []SyncPlanEntry{{File: "F3_Horn.wav", Reason: SyncReasonRename, From: "F1_Horn.wav", LocalSizeKB: 1}}, plan.Renames)
+	assert.Empty(t, plan.Uploads)
+	assert.Empty(t, plan.Deletions)
+	out.Reset()
+	_, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush}, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "rename:   F1_Horn.wav -> F3_Horn.wav")
+	assert.Equal(t, map[string][]byte{"1/F3_Horn.wav": []byte("horn"), "1/F2_Bell.wav": []byte("bell")}, fake.files)
+
+	// a decoder that renames in place does not receive the file again
+	renaming := &renamingDecoder{fake: fake}
+	decoders.Register(func(opts ...decoders.Option) decoders.Decoder {
+		rb, _ := decoders.New(decoders.DEFAULT_DECODER_TYPE, opts...)
+		renaming.Decoder = rb
+		return renaming
+	}, "test-renaming")
+	app.Config.Loco.DecoderType = "test-renaming"
+	assert.NoError(t, os.Rename(filepath.Join(dir, "F2_Bell.wav"), filepath.Join(dir, "F4_Bell.wav")))
+	out.Reset()
+	_, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"F2_Bell.wav -> F4_Bell.wav"}, renaming.renamed)
+	assert.NotContains(t, out.String(), "upload")
+	assert.Equal(t, map[string][]byte{"1/F3_Horn.wav": []byte("horn"), "1/F4_Bell.wav": []byte("bell")}, fake.files)
+
+	state, err := loadSyncState(dir)
+	assert.NoError(t, err)
+	assert.Contains(t, state.slot(1), "F4_Bell.wav")
+	assert.NotContains(t, state.slot(1), "F2_Bell.wav")
+}
+
+func TestSyncSoundSlot_Exclude(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{"1/old.flac": []byte("old"), "1/gone.wav": []byte("gone")}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		".locoignore":   "# masters and system files\n*.flac\n!keep.flac\n.DS_Store\nmasters/\n",
+		"F1_Horn.wav":   "horn",
+		"F1_Horn.wav~":  "backup",
+		"F1_Horn.flac":  "master",
+		"keep.flac":     "keep",
+		".DS_Store":     "finder",
+		"masters/a.wav": "master",
+		"F2/.DS_Store":  "finder",
+	} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	app, _ := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	options := SyncOptions{Direction: SyncPush, Exclude: []string{"*~"}}
+	_, err := app.SyncSoundSlot(1, dir, options, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"1/old.flac": []byte("old"), "1/F1_Horn.wav": []byte("horn"), "1/keep.flac": []byte("keep")}, decoder.files)
+
+	_, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPull}, nil)
+	assert.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(dir, "old.flac"))
+
+	options.Exclude = []string{"[a-"}
+	_, err = app.SyncSoundSlot(1, dir, options, nil)
+	assert.ErrorContains(t, err, "invalid pattern")
+}
+
+func TestSyncSoundSlot_Protected(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{
+		"1/F0_Startup.wav":  []byte("startup"),
+		"1/F0_Shutdown.wav": []byte("shutdown"),
+		"1/F8_Loop.wav":     []byte("loop"),
+		"1/F9_Old.wav":      []byte("old"),
+	}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{"F0_Startup.wav": "startup", "F1_Horn.wav": "horn", slotManifestFile: "protected:\n  - F0_*\n"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+
+	plan, err := app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush, Keep: []string{"F8_*"}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []SyncPlanEntry{{File: "F9_Old.wav", Reason: SyncReasonOrphan, RemoteSizeKB: 1}}, plan.Deletions)
+	assert.Contains(t, out.String(), "keep:     F0_Shutdown.wav is protected, use --force to delete it from the decoder")
+	assert.Contains(t, decoder.files, "1/F0_Shutdown.wav")
+	assert.Contains(t, decoder.files, "1/F8_Loop.wav")
+	assert.NotContains(t, decoder.files, "1/F9_Old.wav")
+
+	// a protected file is not renamed away either, the new name is uploaded next to it
+	assert.NoError(t, os.Rename(filepath.Join(dir, "F0_Startup.wav"), filepath.Join(dir, "F3_Startup.wav")))
+	plan, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush, DryRun: true, Keep: []string{"F8_*"}}, func(SyncEvent) {})
+	assert.NoError(t, err)
+	assert.Empty(t, plan.Renames)
+	assert.Equal(t, []SyncPlanEntry{{File: "F3_Startup.wav", Reason: SyncReasonNew, LocalSizeKB: 1}}, plan.Uploads)
+	assert.Empty(t, plan.Deletions)
+
+	plan, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush, Force: true}, func(SyncEvent) {})
+	assert.NoError(t, err)
+	assert.Len(t, plan.Renames, 1)
+	assert.Equal(t, map[string][]byte{"1/F1_Horn.wav": []byte("horn"), "1/F3_Startup.wav": []byte("startup"), "1/" + slotManifestFile: []byte("protected:\n  - F0_*\n")}, decoder.files)
+
+	_, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush, Keep: []string{"[a-"}}, nil)
+	assert.ErrorContains(t, err, "--keep: invalid pattern")
+}
+
+func TestSyncSoundSlot_Lock(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F1_Horn.wav"), []byte("horn"), 0o644))
+	app, _ := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	rb, err := app.decoder()
+	assert.NoError(t, err)
+
+	// a second sync of the directory or of the slot does not start while the first one runs
+	lock, err := app.lockSync(rb, 1, dir)
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, syncLockFile))
+	assert.Contains(t, decoder.files, "1/"+syncLockFile)
+	_, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush}, func(SyncEvent) {})
+	assert.ErrorContains(t, err, "is being synchronised with slot 1 by process")
+	_, err = app.lockSync(rb, 1, t.TempDir())
+	assert.ErrorContains(t, err, "slot 1 is being synchronised by process")
+	lock.release()
+	assert.NoFileExists(t, filepath.Join(dir, syncLockFile))
+	assert.Empty(t, decoder.files)
+
+	// a dry run changes nothing and takes no lock
+	lock, err = app.lockSync(rb, 1, dir)
+	assert.NoError(t, err)
+	_, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush, DryRun: true}, func(SyncEvent) {})
+	assert.NoError(t, err)
+	lock.release()
+
+	// a lock of another machine that was not refreshed is taken over, the sentinel is no orphan of the slot
+	stale, err := json.Marshal(syncLockHolder{Host: "other", PID: 1, Slot: 1, Started: time.Now().Add(-time.Hour), Refreshed: time.Now().Add(-time.Hour)})
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, syncLockFile), stale, 0o644))
+	decoder.files["1/"+syncLockFile] = stale
+	plan, err := app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush}, func(SyncEvent) {})
+	assert.NoError(t, err)
+	assert.Empty(t, plan.Deletions)
+	assert.Equal(t, map[string][]byte{"1/F1_Horn.wav": []byte("horn")}, decoder.files)
+	assert.NoFileExists(t, filepath.Join(dir, syncLockFile))
+}
+
+func TestWatchSoundSlot_Subdirectories(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+	debounce := watchDebounce
+	watchDebounce = 50 * time.Millisecond
+	defer func() { watchDebounce = debounce }()
+
+	dir := t.TempDir()
+	app, _ := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = app.WatchSoundSlot(ctx, 1, dir, SyncOptions{Direction: SyncPush}, func(SyncEvent) {})
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "F1"), 0o755))
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F1", "Horn.wav"), []byte("horn"), 0o644))
+	assert.Eventually(t, func() bool {
+		decoder.mu.Lock()
+		defer decoder.mu.Unlock()
+		return string(decoder.files["1/F1_Horn.wav"]) == "horn"
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestSyncSoundSlot_Transcode(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	dir := t.TempDir()
+	var stereo, native bytes.Buffer
+	clip := &audio.Clip{SampleRate: 48000, Samples: [][]float64{make([]float64, 4800), make([]float64, 4800)}}
+	assert.NoError(t, audio.WriteWAV(&stereo, clip, 16))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F1_Horn.wav"), stereo.Bytes(), 0o644))
+	assert.NoError(t, audio.WriteWAV(&native, audio.Convert(clip, 1, decoders.SOUND_FORMAT.SampleRate), 16))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F2_Engine.wav"), native.Bytes(), 0o644))
+
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	options := SyncOptions{Direction: SyncPush, Transcoder: audio.Native{}, TranscodeCache: t.TempDir()}
+
+	_, err := app.SyncSoundSlot(1, dir, options, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "convert:  F1_Horn.wav -> F1_Horn.wav")
+	assert.NotContains(t, out.String(), "convert:  F2_Engine.wav")
+	header, err := audio.ReadHeader(bytes.NewReader(decoder.files["1/F1_Horn.wav"]))
+	assert.NoError(t, err)
+	assert.Equal(t, decoders.SOUND_FORMAT, header.Format)
+	assert.Equal(t, native.Bytes(), decoder.files["1/F2_Engine.wav"])
+
+	// the converted copy is reused and matches the decoder
+	out.Reset()
+	_, err = app.SyncSoundSlot(1, dir, options, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "everything is up to date\n", out.String())
+
+	// an MP3 is uploaded as WAV, but only ffmpeg reads it
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F3_Bell.mp3"), []byte("ID3"), 0o644))
+	_, err = app.SyncSoundSlot(1, dir, options, nil)
+	assert.ErrorContains(t, err, `cannot convert "F3_Bell.mp3" without ffmpeg`)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F1_Horn.mp3"), []byte("ID3"), 0o644))
+	assert.NoError(t, os.Remove(filepath.Join(dir, "F3_Bell.mp3")))
+	_, err = app.SyncSoundSlot(1, dir, options, nil)
+	assert.ErrorContains(t, err, `both "F1_Horn.mp3" and "F1_Horn.wav" would be uploaded as "F1_Horn.wav"`)
+}
+
+func TestDecoderCredentials(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{"1/F1_Horn.wav": []byte("horn")}}
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		user, password, ok := r.BasicAuth()
+		if r.Header.Get("Authorization") != "Bearer t0ken" && (!ok || user != "admin" || password != "secret") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		decoder.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	app, _ := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	err := app.SoundSlotsAction()
+	assert.ErrorIs(t, err, decoders.ErrUnauthorized)
+	assert.ErrorContains(t, err, "decoder_username")
+	assert.Equal(t, 1, requests, "a refused request is not sent again")
+
+	app.Config.Loco.DecoderUsername, app.Config.Loco.DecoderPassword = "admin", "wrong"
+	assert.ErrorContains(t, app.SoundSlotsAction(), "check the credentials")
+
+	app.Config.Loco.DecoderPassword = "secret"
+	assert.NoError(t, app.SoundSlotsAction())
+
+	app.Config.Loco.DecoderUsername = ""
+	assert.NoError(t, app.SoundSlotsAction(decoders.WithToken("t0ken")))
+}
+
+func TestWithManagedWiFi(t *testing.T) {
+	app, _ := newMockApp(t)
+	assert.NoError(t, app.SendCVAction("cv200=5", CVSendOptions{Mode: "pom", LocoId: 3, Timeout: time.Second}))
+	interval := wifiPollInterval
+	wifiPollInterval = 10 * time.Millisecond
+	defer func() { wifiPollInterval = interval }()
+
+	// the decoder answers only while F5 of loco 3 is on
+	wifiOn := func() bool {
+		station, err := commandstation.NewMockStation(app.Config.Server.MockState)
+		assert.NoError(t, err)
+		return station.Decoders[3] != nil && station.Decoders[3].Functions&(1<<5) != 0
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !wifiOn() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		(&fakeRailbox{files: map[string][]byte{}}).ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	app.Config.Loco.DecoderAddress = server.URL
+
+	wifi := &ManagedWiFi{Mode: "pom", LocoId: 3, Timeout: time.Second, Wait: time.Second}
+	ran := false
+	assert.NoError(t, app.WithManagedWiFi(wifi, func() error {
+		ran = true
+		assert.True(t, wifiOn(), "the WiFi is on while the operation runs")
+		return nil
+	}))
+	assert.True(t, ran)
+	assert.False(t, wifiOn(), "the WiFi is switched off afterwards")
+
+	// a failed operation switches it off too
+	assert.ErrorContains(t, app.WithManagedWiFi(wifi, func() error { return fmt.Errorf("sync failed") }), "sync failed")
+	assert.False(t, wifiOn())
+
+	// a decoder answering already is left on
+	assert.NoError(t, app.SendFnAction("pom", 3, 5, commandstation.FnOn, 0, time.Second, 0))
+	assert.NoError(t, app.WithManagedWiFi(wifi, func() error { return nil }))
+	assert.True(t, wifiOn())
+	assert.NoError(t, app.SendFnAction("pom", 3, 5, commandstation.FnOff, 0, time.Second, 0))
+
+	// another function does not bring the decoder up
+	assert.NoError(t, app.SendCVAction("cv200=6", CVSendOptions{Mode: "pom", LocoId: 3, Timeout: time.Second}))
+	wifi.Wait = 50 * time.Millisecond
+	assert.ErrorContains(t, app.WithManagedWiFi(wifi, func() error { return nil }), "did not answer within 50ms")
+}
+
+func TestSoundLintAction(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"F1_Horn.wav":      "horn",
+		"f2_bell.wav":      "bell",
+		"F03_Whistle.wav":  "whistle",
+		"F1_Horn2.wav":     "horn",
+		"Engine.wav":       "engine",
+		"F40_Scenario.wav": "scenario",
+		"F5_Brake.mp3":     "brake",
+		"F6_Kurve ä.wav":   "curve",
+		"readme.txt":       "notes",
+		"F7/Coupler.wav":   "coupler",
+		"f7/coupler.wav":   "coupler",
+		".locoignore":      "readme.txt\n",
+	} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	app, out := newMockApp(t)
+
+	err := app.SoundLintAction(dir, []string{"F5_*"})
+	assert.ErrorContains(t, err, "3 file name(s)")
+	assert.Equal(t, `error:    Engine.wav: not assigned to a function, name it F<n>_Engine.wav
+warning:  F03_Whistle.wav: F03 is read as F3, name it F3_...
+warning:  F1_Horn2.wav: F1 has another sound already, F1_Horn.wav, the decoder plays only one of them
+error:    F40_Scenario.wav: F40 is beyond F31, the decoder never plays it
+warning:  F6_Kurve ä.wav: use letters, digits, '_', '-' and '.' only, the firmware may not store the other characters
+warning:  f2_bell.wav: write the prefix as F2_
+error:    f7_coupler.wav: the decoder does not tell it from F7_Coupler.wav, the names differ only in case
+warning:  f7_coupler.wav: write the prefix as F7_
+warning:  f7_coupler.wav: F7 has another sound already, F7_Coupler.wav, the decoder plays only one of them
+3 error(s), 6 warning(s)
+`, out.String())
+
+	// a sync with --lint uploads nothing while there are errors
+	decoder := &fakeRailbox{files: map[string][]byte{}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+	app.Config.Loco.DecoderAddress = server.URL
+	_, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush, Exclude: []string{"F5_*"}, Lint: true}, func(SyncEvent) {})
+	assert.ErrorContains(t, err, "Engine.wav: not assigned to a function")
+	assert.Empty(t, decoder.files)
+
+	for _, name := range []string{"Engine.wav", "F40_Scenario.wav", "f7/coupler.wav", "F6_Kurve ä.wav"} {
+		assert.NoError(t, os.Remove(filepath.Join(dir, name)))
+	}
+	_, err = app.SyncSoundSlot(1, dir, SyncOptions{Direction: SyncPush, Exclude: []string{"F5_*"}, Lint: true}, func(SyncEvent) {})
+	assert.NoError(t, err)
+	assert.Contains(t, decoder.files, "1/F1_Horn.wav")
+}
+
+func TestSoundTestAction(t *testing.T) {
+	app, out := newMockApp(t)
+	functions := func() uint32 {
+		station, err := commandstation.NewMockStation(app.Config.Server.MockState)
+		assert.NoError(t, err)
+		return station.Decoders[3].Functions
+	}
+	// the looped sound of F2 plays already
+	assert.NoError(t, app.SendFnAction("pom", 3, 2, commandstation.FnOn, 0, time.Second, 0))
+
+	audition := Audition{LocoId: 3, Length: time.Millisecond, Timeout: time.Second}
+	assert.NoError(t, app.SoundTestAction(audition, []int{1, 2}))
+	assert.Equal(t, "play:     F1 for 1ms\nplay:     F2 for 1ms\n", out.String())
+	assert.Equal(t, uint32(1<<2), functions(), "F1 is switched off again, F2 is left on")
+
+	assert.ErrorContains(t, app.SoundTestAction(Audition{Length: time.Millisecond}, []int{1}), "a locomotive address is required")
+}
+
+func TestSyncSoundSlot_Audition(t *testing.T) {
+	app, out := newMockApp(t)
+	decoder := &fakeRailbox{files: map[string][]byte{"1/F3_Bell.wav": make([]byte, 2048)}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+	app.Config.Loco.DecoderAddress = server.URL
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F1_Horn.wav"), make([]byte, 3000), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F3_Bell.wav"), make([]byte, 2048), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("horn from the archive"), 0o644))
+
+	options := SyncOptions{Audition: &Audition{LocoId: 3, Length: time.Millisecond, Timeout: time.Second}}
+	var played []string
+	_, err := app.SyncSoundSlot(1, dir, options, func(event SyncEvent) {
+		if event.Kind == SyncAudition {
+			played = append(played, event.File)
+		}
+	})
+	assert.NoError(t, err)
+	// the unchanged F3 and the file without a function are not played
+	assert.Equal(t, []string{"F1_Horn.wav"}, played)
+
+	// nothing is played by a dry run or when nothing was uploaded
+	options.DryRun = true
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F4_Whistle.wav"), make([]byte, 1000), 0o644))
+	_, err = app.SyncSoundSlot(1, dir, options, nil)
+	assert.NoError(t, err)
+	assert.NotContains(t, out.String(), "play:")
+	options.DryRun = false
+	assert.NoError(t, os.Remove(filepath.Join(dir, "F4_Whistle.wav")))
+	out.Reset()
+	_, err = app.SyncSoundSlot(1, dir, options, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "everything is up to date\n", out.String())
+}
+
+func TestDecoderType(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{"1/F1_Horn.wav": []byte("horn")}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	for _, decoderType := range []string{"", "rb2300", "RB23xx"} {
+		app.Config.Loco.DecoderType = decoderType
+		out.Reset()
+		assert.NoError(t, app.SoundSlotsAction(), decoderType)
+		assert.Contains(t, out.String(), "   1      1      1 KB")
+	}
+
+	app.Config.Loco.DecoderType = "esu"
+	assert.ErrorIs(t, app.SoundSlotsAction(), decoders.ErrUnknownDecoderType)
+	assert.ErrorIs(t, app.DecoderInfoAction("prog", 3, time.Second, 0), decoders.ErrUnknownDecoderType)
+}
+
+func TestSoundSlotsAction(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{
+		"1/F1_Horn.wav": make([]byte, 2048), "1/F2_Engine.wav": make([]byte, 3000), "12/F3_Bell.wav": make([]byte, 1024),
+	}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	assert.NoError(t, app.SoundSlotsAction())
+	assert.Equal(t, "slot  files      size\n"+
+		"   1      2      5 KB\n"+
+		"  12      1      1 KB\n", out.String())
+
+	decoder.files = map[string][]byte{}
+	out.Reset()
+	assert.NoError(t, app.SoundSlotsAction())
+	assert.Equal(t, "no sound slots on the decoder\n", out.String())
+}
+
+func TestSyncSoundSlot_Storage(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{"1/F1_Horn.wav": make([]byte, 1<<20)}, capacityKB: 2048}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	assert.NoError(t, app.SoundSlotsAction())
+	assert.Contains(t, out.String(), "storage: 1.0 MB used of 2.0 MB, 1.0 MB free\n")
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F1_Horn.wav"), make([]byte, 1<<20), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F2_Engine.wav"), make([]byte, 3<<20+200<<10), 0o644))
+	options := SyncOptions{Direction: SyncPush}
+
+	// the unchanged horn takes no more space, the engine does not fit
+	_, err := app.SyncSoundSlot(1, dir, options, nil)
+	assert.EqualError(t, err, "not enough space on the decoder: need 3.2 MB, only 1.0 MB free")
+	assert.NotContains(t, decoder.files, "1/F2_Engine.wav")
+
+	// a dry run prints the plan before the failure
+	out.Reset()
+	options.DryRun = true
+	_, err = app.SyncSoundSlot(1, dir, options, nil)
+	assert.Error(t, err)
+	assert.Contains(t, out.String(), "upload:   F2_Engine.wav")
+
+	options.DryRun = false
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "F2_Engine.wav"), make([]byte, 900<<10), 0o644))
+	_, err = app.SyncSoundSlot(1, dir, options, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, decoder.files, "1/F2_Engine.wav")
+}
+
+func TestDecoderInfoAction(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{}, info: "<table><tr><td>Model</td><td>RB2310</td></tr>" +
+		"<tr><td>Firmware:</td><td>1.4.2</td></tr></table><p>Serial number: 00A1B2</p>"}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	assert.NoError(t, app.DecoderInfoAction("prog", 0, time.Second, 0))
+	assert.Equal(t, "model:        RB2310\n"+
+		"firmware:     1.4.2\n"+
+		"serial:       00A1B2\n"+
+		"source:       wifi\n", out.String())
+
+	// without the status page the identity CVs are read over the track
+	decoder.info = ""
+	out.Reset()
+	assert.NoError(t, app.DecoderInfoAction("prog", 0, time.Second, 0))
+	assert.Equal(t, "manufacturer: 13\n"+
+		"version:      1\n"+
+		"source:       track, CV7 and CV8\n", out.String())
+}
+
+func TestLocoInfoAction(t *testing.T) {
+	app, out := newMockApp(t)
+	assert.ErrorContains(t, app.LocoInfoAction(), "no loco.json")
+
+	locoDir := t.TempDir()
+	t.Chdir(locoDir)
+	app.Config.Loco = config.Loco{LocoAddr: 218, Name: "218 466-1", Class: "BR 218", Owner: "club", Image: "218.jpg"}
+	assert.NoError(t, app.LocoInfoAction())
+	assert.Equal(t, "name:         218 466-1\n"+
+		"address:      218\n"+
+		"class:        BR 218\n"+
+		"era:          unknown\n"+
+		"owner:        club\n"+
+		"decoder:      unknown\n"+
+		"image:        "+filepath.Join(locoDir, "218.jpg")+" (missing)\n", out.String())
+
+	assert.NoError(t, os.WriteFile(filepath.Join(locoDir, "218.jpg"), []byte{0xff, 0xd8}, 0o644))
+	out.Reset()
+	assert.NoError(t, app.LocoInfoAction())
+	assert.Contains(t, out.String(), "image:        "+filepath.Join(locoDir, "218.jpg")+"\n")
+}
+
+func TestFirmwareUploadAction(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{}, info: "firmware: 1.4.2"}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	image := filepath.Join(t.TempDir(), "rb23xx.bin")
+	assert.NoError(t, os.WriteFile(image, []byte("1.5.0"), 0o644))
+	sum := sha256.Sum256([]byte("1.5.0"))
+	checksum := hex.EncodeToString(sum[:])
+
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	options := FirmwareOptions{PollInterval: time.Millisecond, ExpectVersion: "1.5.0"}
+
+	// nothing is uploaded without a matching checksum
+	assert.ErrorContains(t, app.FirmwareUploadAction(image, options), "no checksum")
+	options.SHA256 = strings.Repeat("0", 64)
+	assert.ErrorContains(t, app.FirmwareUploadAction(image, options), "does not match, nothing was uploaded")
+	assert.Equal(t, "firmware: 1.4.2", decoder.info)
+
+	options.SHA256 = ""
+	assert.NoError(t, os.WriteFile(image+".sha256", []byte(checksum+"  rb23xx.bin\n"), 0o644))
+	assert.NoError(t, app.FirmwareUploadAction(image, options))
+	assert.Equal(t, "image:        rb23xx.bin (1 KB, sha256 "+checksum+")\n"+
+		"installed:    1.4.2\n"+
+		"uploading:    100%\n"+
+		"restarting\n"+
+		"installed:    1.5.0\n", out.String())
+
+	options.ExpectVersion = "1.6.0"
+	assert.EqualError(t, app.FirmwareUploadAction(image, options), "the decoder runs firmware 1.5.0 after the update, 1.6.0 was expected")
+}
+
+func TestDecoderBackupAction(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{
+		"1/F1_Horn.wav": []byte("horn"), "2/F2_Engine.wav": make([]byte, 3000), "outputs.txt": []byte("O1:F0>\n"),
+	}, info: "firmware: 1.4.2"}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	dir := filepath.Join(t.TempDir(), "loco-3")
+	options := BackupOptions{CVs: "cv1,cv7-cv8,cv29", Mode: "prog", Timeout: time.Second, DownloadSounds: true}
+	assert.NoError(t, app.DecoderBackupAction(dir, options))
+	assert.Contains(t, out.String(), "cvs:          4 read, 0 unread\n")
+	assert.Contains(t, out.String(), "slot 2:       1 file(s)\n")
+
+	cvs, err := os.ReadFile(filepath.Join(dir, backupCVFile))
+	assert.NoError(t, err)
+	assert.Equal(t, "cv1=3\ncv7=1\ncv8=13\ncv29=6\n", string(cvs))
+	assert.FileExists(t, filepath.Join(dir, "outputs.txt"))
+	horn, err := os.ReadFile(filepath.Join(dir, "slots", "1", "F1_Horn.wav"))
+	assert.NoError(t, err)
+	assert.Equal(t, "horn", string(horn))
+
+	data, err := os.ReadFile(filepath.Join(dir, backupManifestFile))
+	assert.NoError(t, err)
+	var manifest backupManifest
+	assert.NoError(t, json.Unmarshal(data, &manifest))
+	assert.Equal(t, "1.4.2", manifest.Decoder.Firmware)
+	assert.Equal(t, "outputs.txt", manifest.OutputMap)
+	assert.Len(t, manifest.Slots, 2)
+	assert.Equal(t, "slots/1", manifest.Slots[0].Dir)
+	sum := sha256.Sum256([]byte("horn"))
+	assert.Equal(t, backupFile{Name: "F1_Horn.wav", SizeKB: 1, SHA256: hex.EncodeToString(sum[:])}, manifest.Slots[0].Files[0])
+}
+
+func TestApplyOutputsAction(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{"outputs.txt": []byte("O1:F0>\nO2:F0<\n")}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	mapFile := filepath.Join(t.TempDir(), "map.txt")
+	assert.NoError(t, os.WriteFile(mapFile, []byte("# Pc1 (F0)\nO1:F0>\nO3:F5<\n"), 0o644))
+
+	assert.NoError(t, app.ApplyOutputsAction(mapFile, true))
+	assert.Equal(t, "add:          O3:F5<\nremove:       O2:F0<\n[dry-run] the output map was not written\n", out.String())
+	assert.Equal(t, "O1:F0>\nO2:F0<\n", string(decoder.files["outputs.txt"]))
+
+	out.Reset()
+	assert.NoError(t, app.ApplyOutputsAction(mapFile, false))
+	assert.Contains(t, out.String(), "output map:   2 mapping line(s) written and verified\n")
+	assert.Equal(t, "# Pc1 (F0)\nO1:F0>\nO3:F5<\n", string(decoder.files["outputs.txt"]))
+
+	out.Reset()
+	assert.NoError(t, app.ApplyOutputsAction(mapFile, false))
+	assert.Equal(t, "the decoder already has this output map\n", out.String())
+
+	assert.NoError(t, os.WriteFile(mapFile, []byte("O1=F0\n"), 0o644))
+	assert.Error(t, app.ApplyOutputsAction(mapFile, false))
+}
+
+func TestDecoderRestoreAction(t *testing.T) {
+	decoder := &fakeRailbox{files: map[string][]byte{
+		"1/F1_Horn.wav": []byte("horn"), "2/F2_Engine.wav": make([]byte, 3000), "outputs.txt": []byte("O1:F0>\n"),
+	}}
+	server := httptest.NewServer(decoder)
+	defer server.Close()
+
+	app, out := newMockApp(t)
+	app.Config.Loco.DecoderAddress = server.URL
+	dir := filepath.Join(t.TempDir(), "loco-3")
+	backup := BackupOptions{CVs: "cv1,cv29", Mode: "prog", Timeout: time.Second, DownloadSounds: true}
+	assert.NoError(t, app.DecoderBackupAction(dir, backup))
+
+	// a replaced decoder
+	decoder.files = map[string][]byte{"1/F9_Other.wav": []byte("other")}
+	assert.NoError(t, app.SendCVAction("cv1=9", CVSendOptions{Mode: "prog", Timeout: time.Second, Strict: true}))
+
+	out.Reset()
+	assert.NoError(t, app.DecoderRestoreAction(dir, RestoreOptions{Timeout: time.Second, DryRun: true}))
+	assert.Contains(t, out.String(), "cvs:          2 to write on loco 0 (prog), verified\n")
+	assert.Contains(t, out.String(), "slot 2:       1 file(s)\n")
+	assert.Equal(t, map[string][]byte{"1/F9_Other.wav": []byte("other")}, decoder.files, "a dry run changes nothing")
+
+	app.In = strings.NewReader("n\n")
+	assert.NoError(t, app.DecoderRestoreAction(dir, RestoreOptions{Timeout: time.Second}))
+	assert.Len(t, decoder.files, 1)
+
+	app.In = strings.NewReader("y\n")
+	assert.NoError(t, app.DecoderRestoreAction(dir, RestoreOptions{Timeout: time.Second}))
+	assert.Equal(t, []byte("horn"), decoder.files["1/F1_Horn.wav"])
+	assert.Equal(t, []byte("O1:F0>\n"), decoder.files["outputs.txt"])
+	assert.NotContains(t, decoder.files, "1/F9_Other.wav")
+	out.Reset()
+	assert.NoError(t, app.ReadCVAction("prog", 0, "cv1", false, time.Second, 0, CVOutput{}))
+	assert.Equal(t, "3\n", out.String())
+
+	// a sound file changed after the backup is not uploaded
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "slots", "1", "F1_Horn.wav"), []byte("changed"), 0o644))
+	assert.ErrorContains(t, app.DecoderRestoreAction(dir, RestoreOptions{Timeout: time.Second, Yes: true}), "checksum does not match")
+}
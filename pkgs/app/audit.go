@@ -0,0 +1,163 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/config"
+	"github.com/keskad/loco/pkgs/syntax"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: other throttles on a shared layout can reprogram a locomotive by accident (a wrong address on PoM is enough).
+// The audit re-reads the critical CVs on the main track and compares them with the CV files of the projects.
+// Locomotives that do not answer are not on the track, they are skipped rather than reported.
+//
+
+// ErrCVDrift is returned when an audited locomotive has a CV different from its project file
+var ErrCVDrift = errors.New("CV drift detected")
+
+// cvDrift is a single CV that does not match the project file
+type cvDrift struct {
+	Loco     uint16
+	CV       uint16
+	Expected uint16
+	Actual   int
+}
+
+func (d cvDrift) String() string {
+	return fmt.Sprintf("loco %d: cv%d=%d, expected %d", d.Loco, d.CV, d.Actual, d.Expected)
+}
+
+// AuditCVAction compares the configured critical CVs of locomotives on the track with their project files.
+// With every > 0 the audit is repeated until interrupted, drifts are then reported on each round instead of failing.
+func (app *LocoApp) AuditCVAction(every time.Duration, timeout time.Duration, retries uint8) error {
+	audit := app.Config.Audit
+	if len(audit.Locos) == 0 {
+		return errors.New("no locomotives to audit, add them to the audit section of ~/.loco.yaml")
+	}
+	if len(audit.CVs) == 0 {
+		return errors.New("no CVs to audit, set audit.cvs in ~/.loco.yaml")
+	}
+
+	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
+		return cmdErr
+	}
+	defer app.station.CleanUp()
+
+	if every <= 0 {
+		drifts, err := app.auditRound(audit, timeout, retries)
+		if err != nil {
+			return err
+		}
+		if len(drifts) > 0 {
+			return fmt.Errorf("%w on %d CV(s)", ErrCVDrift, len(drifts))
+		}
+		return nil
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		drifts, err := app.auditRound(audit, timeout, retries)
+		if err != nil {
+			logrus.Errorf("audit: %s", err)
+		} else if len(drifts) > 0 {
+			logrus.Warnf("audit: %s on %d CV(s)", ErrCVDrift, len(drifts))
+		}
+		select {
+		case <-interrupt:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// auditRound checks every configured locomotive once. The project files are read on each round, so they can be edited meanwhile.
+func (app *LocoApp) auditRound(audit config.Audit, timeout time.Duration, retries uint8) ([]cvDrift, error) {
+	var drifts []cvDrift
+	for _, loco := range audit.Locos {
+		expected, err := readExpectedCVs(loco.File, audit.CVs)
+		if err != nil {
+			return drifts, fmt.Errorf("loco %d: %w", loco.Addr, err)
+		}
+		if len(expected) == 0 {
+			logrus.Warnf("loco %d: %s defines none of the audited CVs", loco.Addr, loco.File)
+			continue
+		}
+
+		locoDrifts, present := app.auditLoco(loco.Addr, expected, timeout, retries)
+		if !present {
+			app.P.Printf("loco %d: not on the track, skipped\n", loco.Addr)
+			continue
+		}
+		for _, drift := range locoDrifts {
+			app.P.Printf("%s\n", drift)
+		}
+		if len(locoDrifts) == 0 {
+			app.P.Printf("loco %d: ok (%d CVs)\n", loco.Addr, len(expected))
+		}
+		drifts = append(drifts, locoDrifts...)
+	}
+	return drifts, nil
+}
+
+// auditLoco reads the expected CVs from the locomotive. It is not present when the first read is not answered,
+// a later failed read is only logged, as RailCom answers get lost on a busy track.
+func (app *LocoApp) auditLoco(addr uint16, expected []syntax.CVEntry, timeout time.Duration, retries uint8) ([]cvDrift, bool) {
+	var drifts []cvDrift
+	for i, entry := range expected {
+		actual, err := app.station.ReadCV(commandstation.MainTrackMode, commandstation.LocoCV{
+			LocoId: commandstation.LocoAddr(addr),
+			Cv:     commandstation.CV{Num: commandstation.CVNum(entry.Number)},
+		}, commandstation.Timeout(timeout), commandstation.Retries(retries))
+		if err != nil {
+			if i == 0 {
+				logrus.Debugf("loco %d: %s", addr, err)
+				return nil, false
+			}
+			logrus.Warnf("loco %d: cannot read cv%d: %s", addr, entry.Number, err)
+			continue
+		}
+		if actual != int(entry.Value) {
+			drifts = append(drifts, cvDrift{Loco: addr, CV: entry.Number, Expected: entry.Value, Actual: actual})
+		}
+	}
+	return drifts, true
+}
+
+// readExpectedCVs returns the audited CVs defined in the project file, in the order of audited
+func readExpectedCVs(path string, audited []uint16) ([]syntax.CVEntry, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the project file: %w", err)
+	}
+	// the assertions of a project file are expected values too, a value of the same CV comes after its assertion
+	entries, err := syntax.ParseCVString(string(content), "\n", syntax.Strict(true), syntax.Assertions(true), syntax.IncludeDir(filepath.Dir(path)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %q: %w", path, err)
+	}
+	defined := make(map[uint16]uint16, len(entries))
+	for _, entry := range entries {
+		defined[entry.Number] = entry.Value
+	}
+
+	var expected []syntax.CVEntry
+	for _, num := range audited {
+		if value, ok := defined[num]; ok {
+			expected = append(expected, syntax.CVEntry{Number: num, Value: value})
+		}
+	}
+	return expected, nil
+}
@@ -0,0 +1,112 @@
+package app
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+)
+
+//
+// Context: after a new sample is uploaded it has to be heard on the locomotive, a file of the wrong format or
+// assigned to the wrong function is silent. The decoder plays the sound of "F<n>_..." while Fn is on, an audition
+// switches the function on over the command station, waits and switches it off again.
+//
+
+// defaultAuditionLength is how long a function is kept on when Audition.Length is 0
+const defaultAuditionLength = 3 * time.Second
+
+// Audition selects the locomotive playing the sounds, on the main track
+type Audition struct {
+	LocoId uint8
+	// Length is how long every function is kept on, 0 is three seconds
+	Length  time.Duration
+	Timeout time.Duration
+	Retries uint8
+}
+
+// SoundTestAction plays the sounds of the functions one after another
+func (app *LocoApp) SoundTestAction(audition Audition, functions []int) error {
+	return app.playFunctions(audition, functions, func(fn int, length time.Duration) {
+		_, _ = app.P.Printf("play:     F%d for %s\n", fn, length)
+	})
+}
+
+// playFunctions switches every function on for the length of the audition, playing is called before.
+// A function that is on already, e.g. a looped sound, is switched off first so its sound starts again, and is left on.
+func (app *LocoApp) playFunctions(audition Audition, functions []int, playing func(fn int, length time.Duration)) error {
+	if audition.LocoId == 0 {
+		return fmt.Errorf("the sounds are played on the main track, a locomotive address is required")
+	}
+	length := audition.Length
+	if length <= 0 {
+		length = defaultAuditionLength
+	}
+	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
+		return cmdErr
+	}
+	defer app.station.CleanUp()
+	if err := app.takeOver(audition.LocoId, audition.Timeout, audition.Retries); err != nil {
+		return err
+	}
+	active, err := app.station.ListFunctions(commandstation.LocoAddr(audition.LocoId), commandstation.Timeout(audition.Timeout), commandstation.Retries(audition.Retries))
+	if err != nil {
+		return fmt.Errorf("cannot read the functions of loco %d: %w", audition.LocoId, err)
+	}
+
+	send := func(fn int, action commandstation.FnAction) error {
+		if err := app.station.SendFn(commandstation.MainTrackMode, commandstation.LocoAddr(audition.LocoId), commandstation.FuncNum(fn), action,
+			commandstation.Timeout(audition.Timeout), commandstation.Retries(audition.Retries)); err != nil {
+			return fmt.Errorf("cannot switch F%d of loco %d: %w", fn, audition.LocoId, err)
+		}
+		return nil
+	}
+	for _, fn := range functions {
+		playing(fn, length)
+		wasOn := slices.Contains(active, fn)
+		if wasOn {
+			if err := send(fn, commandstation.FnOff); err != nil {
+				return err
+			}
+		}
+		if err := send(fn, commandstation.FnOn); err != nil {
+			return err
+		}
+		time.Sleep(length)
+		if !wasOn {
+			if err := send(fn, commandstation.FnOff); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// auditionSyncedSounds plays the sounds uploaded by a sync, every function once
+func (app *LocoApp) auditionSyncedSounds(slot uint8, plan *SyncPlan, audition Audition, progress SyncProgressFunc) error {
+	files := map[int]string{}
+	var functions []int
+	for _, entries := range [][]SyncPlanEntry{plan.Uploads, plan.Reuploads, plan.Renames} {
+		for _, entry := range entries {
+			fn, ok := soundFunction(entry.File)
+			if !ok {
+				continue
+			}
+			if _, seen := files[fn]; !seen {
+				functions = append(functions, fn)
+			}
+			files[fn] = entry.File
+		}
+	}
+	if len(functions) == 0 {
+		return nil
+	}
+	slices.Sort(functions)
+	if err := app.playFunctions(audition, functions, func(fn int, length time.Duration) {
+		progress(SyncEvent{Kind: SyncAudition, Slot: slot, File: files[fn]})
+	}); err != nil {
+		return fmt.Errorf("the sounds were uploaded, but cannot be played: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/decoders"
+	"github.com/keskad/loco/pkgs/syntax"
+)
+
+//
+// Context: a decoder that failed or was replaced. Everything that makes up its configuration is kept
+// in a directory that can be committed to a repository: the CVs in the format of "loco cv set",
+// the AUX output mapping, the sound slots and a manifest tying them to the decoder.
+//
+
+// backupManifestFile describes a backup project
+const backupManifestFile = "loco-backup.json"
+
+// backupCVFile holds the CVs as "cv<n>=<value>" lines
+const backupCVFile = "cvs.txt"
+
+// backupManifest is the content of backupManifestFile
+type backupManifest struct {
+	Created time.Time      `json:"created"`
+	Loco    uint8          `json:"loco,omitempty"`
+	Track   string         `json:"track,omitempty"`
+	Decoder *decoders.Info `json:"decoder,omitempty"`
+	// CVs are the ranges read into CVFile, Unread the CVs of them the decoder did not answer
+	CVs       string       `json:"cvs,omitempty"`
+	CVFile    string       `json:"cvFile,omitempty"`
+	Unread    []uint16     `json:"unreadCVs,omitempty"`
+	OutputMap string       `json:"outputMap,omitempty"`
+	Slots     []backupSlot `json:"slots"`
+}
+
+// backupSlot lists a sound slot, with Downloaded the files are kept in Dir, relative to the backup with forward slashes
+type backupSlot struct {
+	Slot       uint8        `json:"slot"`
+	Dir        string       `json:"dir,omitempty"`
+	Downloaded bool         `json:"downloaded"`
+	Files      []backupFile `json:"files"`
+}
+
+type backupFile struct {
+	Name   string `json:"name"`
+	SizeKB int64  `json:"sizeKB"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// BackupOptions select what DecoderBackupAction captures
+type BackupOptions struct {
+	// CVs are the ranges read over the track, e.g. "cv1-cv256", empty skips the CVs
+	CVs     string
+	Mode    string
+	LocoId  uint8
+	Timeout time.Duration
+	Retries uint8
+	// SkipWiFi leaves out everything read over the decoder WiFi: the info, the output map and the sound slots
+	SkipWiFi bool
+	// DownloadSounds keeps the sound files too, otherwise the slots are only listed
+	DownloadSounds bool
+}
+
+// DecoderBackupAction captures the configuration of a decoder into dir, see BackupOptions
+func (app *LocoApp) DecoderBackupAction(dir string, options BackupOptions, opts ...decoders.Option) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("cannot create the backup directory: %w", err)
+	}
+	manifest := backupManifest{Created: time.Now().UTC().Truncate(time.Second), Slots: []backupSlot{}}
+
+	if options.CVs != "" {
+		if err := app.backupCVs(dir, &manifest, options); err != nil {
+			return err
+		}
+	}
+	if !options.SkipWiFi {
+		if err := app.backupWiFi(dir, &manifest, options, opts...); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, backupManifestFile), append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("cannot write the backup manifest: %w", err)
+	}
+	_, _ = app.P.Printf("backup of the decoder saved in %s\n", dir)
+	return nil
+}
+
+// backupCVs reads the CVs over the track, a CV the decoder does not answer is recorded and skipped
+func (app *LocoApp) backupCVs(dir string, manifest *backupManifest, options BackupOptions) error {
+	entries, err := syntax.ParseCVString(options.CVs, ",")
+	if err != nil {
+		return fmt.Errorf("invalid CV list: %w", err)
+	}
+	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
+		return cmdErr
+	}
+	defer app.station.CleanUp()
+	mode := commandstation.Mode(options.Mode)
+	if err := app.preflight(mode, options.Timeout); err != nil {
+		return err
+	}
+
+	var lines strings.Builder
+	for _, entry := range entries {
+		value, err := app.station.ReadCV(mode, commandstation.LocoCV{
+			LocoId: commandstation.LocoAddr(options.LocoId),
+			Cv:     commandstation.CV{Num: commandstation.CVNum(entry.Number)},
+		}, commandstation.Timeout(options.Timeout), commandstation.Retries(options.Retries))
+		if err != nil {
+			logrus.Warnf("backup: cannot read cv%d, it is not in the backup: %s", entry.Number, err)
+			manifest.Unread = append(manifest.Unread, entry.Number)
+			continue
+		}
+		fmt.Fprintf(&lines, "cv%d=%d\n", entry.Number, value)
+	}
+	if len(manifest.Unread) == len(entries) {
+		return fmt.Errorf("no CV of %s could be read, is the locomotive on the track?", options.CVs)
+	}
+	if err := os.WriteFile(filepath.Join(dir, backupCVFile), []byte(lines.String()), 0o644); err != nil {
+		return fmt.Errorf("cannot write the CVs: %w", err)
+	}
+	manifest.Loco, manifest.Track, manifest.CVs, manifest.CVFile = options.LocoId, options.Mode, options.CVs, backupCVFile
+	_, _ = app.P.Printf("cvs:          %d read, %d unread\n", len(entries)-len(manifest.Unread), len(manifest.Unread))
+	return nil
+}
+
+// backupWiFi captures what the web interface of the decoder holds
+func (app *LocoApp) backupWiFi(dir string, manifest *backupManifest, options BackupOptions, opts ...decoders.Option) error {
+	rb, err := app.decoder(opts...)
+	if err != nil {
+		return err
+	}
+	if info, err := rb.Info(); err == nil {
+		manifest.Decoder = &info
+	} else {
+		logrus.Debugf("backup: the decoder info is not known: %s", err)
+	}
+
+	outputMap, err := rb.DownloadOutputMap()
+	switch {
+	case errors.Is(err, decoders.ErrNoOutputMap):
+		logrus.Infof("backup: %s", err)
+	case err != nil:
+		return fmt.Errorf("cannot back up the AUX output map: %w", err)
+	default:
+		if err := os.WriteFile(filepath.Join(dir, decoders.OUTPUT_MAP_FILE), outputMap, 0o644); err != nil {
+			return fmt.Errorf("cannot write the AUX output map: %w", err)
+		}
+		manifest.OutputMap = decoders.OUTPUT_MAP_FILE
+		_, _ = app.P.Printf("output map:   %s\n", decoders.OUTPUT_MAP_FILE)
+	}
+
+	slots, err := rb.ListSoundSlotNumbers()
+	if err != nil {
+		return fmt.Errorf("cannot list the sound slots on decoder: %w", err)
+	}
+	for _, slot := range slots {
+		files, err := rb.ListSoundSlot(slot)
+		if err != nil {
+			return fmt.Errorf("cannot list slot %d on decoder: %w", slot, err)
+		}
+		entry := backupSlot{Slot: slot, Downloaded: options.DownloadSounds, Files: make([]backupFile, 0, len(files))}
+		if options.DownloadSounds {
+			entry.Dir = path.Join("slots", fmt.Sprint(slot))
+			if err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(entry.Dir)), 0o755); err != nil {
+				return fmt.Errorf("cannot create the directory of slot %d: %w", slot, err)
+			}
+		}
+		for _, file := range files {
+			record := backupFile{Name: file.Name, SizeKB: file.SizeKB}
+			if options.DownloadSounds {
+				data, err := rb.DownloadSoundFile(slot, file.Name)
+				if err != nil {
+					return fmt.Errorf("cannot back up slot %d: %w", slot, err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(entry.Dir), file.Name), data, 0o644); err != nil {
+					return fmt.Errorf("cannot write %q: %w", file.Name, err)
+				}
+				sum := sha256.Sum256(data)
+				record.SHA256 = hex.EncodeToString(sum[:])
+			}
+			entry.Files = append(entry.Files, record)
+		}
+		manifest.Slots = append(manifest.Slots, entry)
+		_, _ = app.P.Printf("%-14s%d file(s)\n", fmt.Sprintf("slot %d:", slot), len(files))
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/syntax"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: fleets of identical locomotives. The CVs of a configured decoder are copied to another one
+// of the same family (CV7 version, CV8 manufacturer), except the identity CVs that make each locomotive unique.
+//
+
+const (
+	cvVersion      = 7
+	cvManufacturer = 8
+	cvConfig       = 29
+	// cv29LongAddress selects the long address (CV17/18) instead of CV1
+	cv29LongAddress = 0x20
+)
+
+// CloneAction copies the CVs in cvRange from one locomotive to another, both programmed on the main track.
+// With ask the exclusion list is confirmed on the input first. A soundSlot of 0 or more copies that RB23xx sound slot too,
+// the user is asked to switch between the decoder WiFi networks.
+func (app *LocoApp) CloneAction(fromLoco, toLoco uint8, cvRange string, exclude []uint16, ask bool, soundSlot int, timeout time.Duration, retries uint8) error {
+	if fromLoco == toLoco {
+		return fmt.Errorf("cannot clone locomotive %d onto itself", fromLoco)
+	}
+	entries, err := syntax.ParseCVString(cvRange, ",")
+	if err != nil {
+		return fmt.Errorf("invalid CV list: %w", err)
+	}
+	input := bufio.NewReader(app.input())
+	if ask {
+		if exclude, err = app.askExclusions(input, exclude); err != nil {
+			return err
+		}
+	}
+	excluded := map[uint16]bool{cvVersion: true, cvManufacturer: true} // read-only
+	for _, cv := range exclude {
+		excluded[cv] = true
+	}
+
+	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
+		return cmdErr
+	}
+	defer app.station.CleanUp()
+	if err := app.preflight(commandstation.MainTrackMode, timeout); err != nil {
+		return err
+	}
+
+	read := func(loco uint8, cv uint16) (int, error) {
+		return app.station.ReadCV(commandstation.MainTrackMode, commandstation.LocoCV{
+			LocoId: commandstation.LocoAddr(loco),
+			Cv:     commandstation.CV{Num: commandstation.CVNum(cv)},
+		}, commandstation.Timeout(timeout), commandstation.Retries(retries))
+	}
+	for _, cv := range []uint16{cvVersion, cvManufacturer} {
+		source, err := read(fromLoco, cv)
+		if err != nil {
+			return fmt.Errorf("cannot identify the decoder of locomotive %d: %w", fromLoco, err)
+		}
+		target, err := read(toLoco, cv)
+		if err != nil {
+			return fmt.Errorf("cannot identify the decoder of locomotive %d: %w", toLoco, err)
+		}
+		if source != target {
+			return fmt.Errorf("the decoders are not of the same family: cv%d is %d on locomotive %d and %d on locomotive %d", cv, source, fromLoco, target, toLoco)
+		}
+	}
+
+	// backup of the source, printed in the CV file format
+	var copied []syntax.CVEntry
+	for _, entry := range entries {
+		if excluded[entry.Number] {
+			continue
+		}
+		value, err := read(fromLoco, entry.Number)
+		if err != nil {
+			logrus.Warnf("cannot read cv%d of locomotive %d, it is not copied: %s", entry.Number, fromLoco, err)
+			continue
+		}
+		if entry.Number == cvConfig && excluded[1] && excluded[17] && excluded[18] {
+			// the addresses are not copied, so the target keeps its kind of address
+			target, err := read(toLoco, cvConfig)
+			if err != nil {
+				return fmt.Errorf("cannot read cv%d of locomotive %d: %w", cvConfig, toLoco, err)
+			}
+			value = value&^cv29LongAddress | target&cv29LongAddress
+		}
+		_, _ = app.P.Printf("cv%d=%d\n", entry.Number, value)
+		copied = append(copied, syntax.CVEntry{Number: entry.Number, Value: uint16(value)})
+	}
+
+	for _, entry := range copied {
+		if err := app.station.WriteCV(commandstation.MainTrackMode, commandstation.LocoCV{
+			LocoId: commandstation.LocoAddr(toLoco),
+			Cv:     commandstation.CV{Num: commandstation.CVNum(entry.Number), Value: int(entry.Value)},
+		}, commandstation.Timeout(timeout)); err != nil {
+			return fmt.Errorf("cannot write cv%d to locomotive %d: %w", entry.Number, toLoco, err)
+		}
+	}
+	logrus.Infof("clone: %d CV(s) copied from locomotive %d to %d", len(copied), fromLoco, toLoco)
+
+	if soundSlot < 0 {
+		return nil
+	}
+	return app.cloneSoundSlot(input, fromLoco, toLoco, uint8(soundSlot))
+}
+
+// cloneSoundSlot downloads the slot from the source decoder and synchronises it to the target
+func (app *LocoApp) cloneSoundSlot(input *bufio.Reader, fromLoco, toLoco uint8, slot uint8) error {
+	dir, err := os.MkdirTemp("", "loco-clone-")
+	if err != nil {
+		return fmt.Errorf("cannot create a directory for the sound files: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := app.waitForEnter(input, fmt.Sprintf("Connect to the WiFi of locomotive %d and press Enter", fromLoco)); err != nil {
+		return err
+	}
+	rb, err := app.decoder()
+	if err != nil {
+		return err
+	}
+	files, err := rb.ListSoundSlot(slot)
+	if err != nil {
+		return fmt.Errorf("cannot list slot %d on locomotive %d: %w", slot, fromLoco, err)
+	}
+	for _, file := range files {
+		data, err := rb.DownloadSoundFile(slot, file.Name)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, file.Name), data, 0o644); err != nil {
+			return fmt.Errorf("cannot store %q: %w", file.Name, err)
+		}
+		_, _ = app.P.Printf("download: %s\n", file.Name)
+	}
+
+	if err := app.waitForEnter(input, fmt.Sprintf("Connect to the WiFi of locomotive %d and press Enter", toLoco)); err != nil {
+		return err
+	}
+	_, err = app.SyncSoundSlot(slot, dir, SyncOptions{Direction: SyncPush}, nil)
+	return err
+}
+
+// askExclusions shows the identity CVs that are not copied and lets the user change them, an empty answer keeps them
+func (app *LocoApp) askExclusions(input *bufio.Reader, exclude []uint16) ([]uint16, error) {
+	names := make([]string, 0, len(exclude))
+	for _, cv := range exclude {
+		names = append(names, fmt.Sprintf("%d", cv))
+	}
+	_, _ = app.P.Printf("CVs that are not copied [%s]: ", strings.Join(names, ","))
+	answer, err := input.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("cannot read the answer: %w", err)
+	}
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return exclude, nil
+	}
+	entries, err := syntax.ParseCVString(answer, ",")
+	if err != nil {
+		return nil, fmt.Errorf("invalid CV list: %w", err)
+	}
+	exclude = make([]uint16, 0, len(entries))
+	for _, entry := range entries {
+		exclude = append(exclude, entry.Number)
+	}
+	sort.Slice(exclude, func(i, j int) bool { return exclude[i] < exclude[j] })
+	return exclude, nil
+}
+
+func (app *LocoApp) waitForEnter(input *bufio.Reader, prompt string) error {
+	_, _ = app.P.Printf("%s ", prompt)
+	if _, err := input.ReadString('\n'); err != nil && err != io.EOF {
+		return fmt.Errorf("cannot read the answer: %w", err)
+	}
+	return nil
+}
+
+// input is where the answers to questions are read from
+func (app *LocoApp) input() io.Reader {
+	if app.In != nil {
+		return app.In
+	}
+	return os.Stdin
+}
@@ -2,37 +2,150 @@ package app
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/cvdefs"
+	"github.com/keskad/loco/pkgs/decoders"
 	"github.com/keskad/loco/pkgs/syntax"
 	"github.com/sirupsen/logrus"
 )
 
-func (app *LocoApp) SendCVAction(mode string, locoId uint8, cvNumRaw string, verify bool, timeout time.Duration, settle time.Duration) error {
-	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
-		return cmdErr
-	}
-	defer app.station.CleanUp()
+// CVSendOptions shape SendCVAction
+type CVSendOptions struct {
+	Mode    string
+	LocoId  uint8
+	Verify  bool
+	Timeout time.Duration
+	Settle  time.Duration
+	// Strict fails on a CV defined twice with different values
+	Strict bool
+	// Format selects the decoder protocol, "dcc" or "mm", empty means DCC
+	Format string
+	// Optimize skips the CVs that already hold their value and prints the plan
+	Optimize bool
+	// Known is a CV file with the current values, read by Optimize instead of the decoder
+	Known string
+	// Position names the positions of the entries in the errors, e.g. the lines of stdin, see syntax.Positions
+	Position func(pos int) string
+}
 
-	entries, parseErr := syntax.ParseCVString(cvNumRaw, ",")
+// SendCVAction writes all CVs from cvNumRaw. In strict mode a CV defined twice with different values is an error.
+// With Optimize the CVs that already hold their value are not written and the plan is printed, the current values
+// are read from the decoder or, when Known is set, from that CV file. The mode WiFiMode writes over the WiFi
+// of the decoder the opts reach.
+// A modification "cv29|=0x04" or "cv29&=~0x10" reads the CV first and writes it back verified with the bits changed.
+func (app *LocoApp) SendCVAction(cvNumRaw string, options CVSendOptions, opts ...decoders.Option) error {
+	parseOptions := []syntax.ParseOption{syntax.Strict(options.Strict), syntax.Modifications(true)}
+	if options.Position != nil {
+		parseOptions = append(parseOptions, syntax.Positions(options.Position))
+	}
+	entries, parseErr := syntax.ParseCVString(cvNumRaw, ",", parseOptions...)
 	if parseErr != nil {
 		return parseErr
 	}
+	modifies := false
+	for _, entry := range entries {
+		modifies = modifies || entry.Modify
+	}
+
+	decoderFormat := commandstation.DCCFormat
+	if options.Format != "" {
+		decoderFormat = commandstation.Format(options.Format)
+	}
+	if decoderFormat != commandstation.DCCFormat && decoderFormat != commandstation.MMFormat {
+		return fmt.Errorf("invalid format: %s. Must be either 'dcc' or 'mm'", options.Format)
+	}
+
+	if app.DryRun && options.Verify {
+		return fmt.Errorf("--verify cannot be used in dry-run mode, nothing is written")
+	}
+	if options.Optimize && decoderFormat == commandstation.MMFormat && options.Known == "" {
+		return fmt.Errorf("MM registers cannot be read, --optimize needs the known values")
+	}
+	if options.Optimize && app.DryRun && options.Known == "" {
+		return fmt.Errorf("--optimize cannot read the decoder in dry-run mode, provide the known values")
+	}
+
+	if modifies && decoderFormat == commandstation.MMFormat {
+		return fmt.Errorf("MM registers cannot be read, write the whole value instead of changing its bits")
+	}
+	if modifies && app.DryRun {
+		return fmt.Errorf("the bits of a CV cannot be changed in dry-run mode, the CV cannot be read")
+	}
+
+	if options.Mode == WiFiMode && decoderFormat == commandstation.MMFormat {
+		return fmt.Errorf("MM registers cannot be written over WiFi, use a command station")
+	}
+	read, write, cleanUp, err := app.cvAccess(options.Mode, options.Verify, len(entries) > 1, options.Timeout, opts...)
+	if err != nil {
+		return err
+	}
+	defer cleanUp()
+
+	modified := map[uint16]bool{}
+	for i, entry := range entries {
+		if !entry.Modify {
+			continue
+		}
+		current, err := read(commandstation.LocoCV{
+			LocoId: commandstation.LocoAddr(options.LocoId),
+			Cv:     commandstation.CV{Num: commandstation.CVNum(entry.Number)},
+		}, commandstation.Timeout(options.Timeout))
+		if err != nil {
+			return fmt.Errorf("cannot read cv%d to change its bits: %w", entry.Number, err)
+		}
+		entries[i] = syntax.CVEntry{Number: entry.Number, Value: entry.Apply(uint16(current))}
+		modified[entry.Number] = true
+		app.P.Printf("modify: cv%d=%d (was %d)\n", entry.Number, entries[i].Value, current)
+	}
+
+	if options.Optimize {
+		current := func(cv uint16) (int, bool) {
+			value, err := read(commandstation.LocoCV{
+				LocoId: commandstation.LocoAddr(options.LocoId),
+				Cv:     commandstation.CV{Num: commandstation.CVNum(cv)},
+			}, commandstation.Timeout(options.Timeout))
+			if err != nil {
+				logrus.Warnf("cannot read cv%d, it is written: %s", cv, err)
+				return 0, false
+			}
+			return value, true
+		}
+		if options.Known != "" {
+			values, err := readKnownCVs(options.Known)
+			if err != nil {
+				return err
+			}
+			current = func(cv uint16) (int, bool) {
+				value, ok := values[cv]
+				return value, ok
+			}
+		}
+		plan := planCVWrites(entries, current)
+		app.printCVWritePlan(plan)
+		entries = plan.writes
+	}
 
 	var writeErr error
 	for _, entry := range entries {
-		writeErr = app.station.WriteCV(commandstation.Mode(mode), commandstation.LocoCV{
-			LocoId: commandstation.LocoAddr(locoId),
+		writeErr = write(commandstation.LocoCV{
+			LocoId: commandstation.LocoAddr(options.LocoId),
 			Cv: commandstation.CV{
 				Num:   commandstation.CVNum(entry.Number),
 				Value: int(entry.Value),
 			},
 		},
-			commandstation.Verify(verify),
-			commandstation.Timeout(timeout))
+			commandstation.Verify(options.Verify || modified[entry.Number]),
+			commandstation.Timeout(options.Timeout),
+			commandstation.Settle(options.Settle),
+			commandstation.ProgrammingFormat(decoderFormat))
 
-		time.Sleep(settle)
+		if !app.DryRun {
+			time.Sleep(options.Settle)
+		}
 
 		if writeErr != nil {
 			return writeErr
@@ -42,19 +155,35 @@ func (app *LocoApp) SendCVAction(mode string, locoId uint8, cvNumRaw string, ver
 	return nil
 }
 
-func (app *LocoApp) ReadCVAction(mode string, locoId uint8, cvNumRaw string, verify bool, timeout time.Duration, retries uint8) error {
-	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
-		return cmdErr
+// CVOutput selects how ReadCVAction prints the values
+type CVOutput struct {
+	// Base is 10, 16 or 2, see syntax.FormatCVValue
+	Base int
+	// Explain appends the meaning of a value as a comment, which the CV syntax skips when the output is read back
+	Explain bool
+}
+
+// ReadCVAction prints the CVs of cvNumRaw, of the track of mode or, with WiFiMode, of the decoder the opts reach
+func (app *LocoApp) ReadCVAction(mode string, locoId uint8, cvNumRaw string, verify bool, timeout time.Duration, retries uint8, output CVOutput, opts ...decoders.Option) error {
+	read, _, cleanUp, err := app.cvAccess(mode, verify, false, timeout, opts...)
+	if err != nil {
+		return err
+	}
+	defer cleanUp()
+
+	// the CVs of a decoder with a schema are printed with their names
+	named, schemaErr := app.loadDecoderSchema()
+	if schemaErr != nil {
+		return schemaErr
 	}
-	defer app.station.CleanUp()
 
 	// Try to parse as a single CV
 	entries, parseErr := syntax.ParseCVString(cvNumRaw, ",")
 	if parseErr == nil {
 		var lastError error
 
-		for _, entry := range entries {
-			result, err := app.station.ReadCV(commandstation.Mode(mode), commandstation.LocoCV{
+		for _, entry := range byPriority(entries) {
+			result, err := read(commandstation.LocoCV{
 				LocoId: commandstation.LocoAddr(locoId),
 				Cv: commandstation.CV{
 					Num: commandstation.CVNum(entry.Number),
@@ -70,13 +199,13 @@ func (app *LocoApp) ReadCVAction(mode string, locoId uint8, cvNumRaw string, ver
 					logrus.Error(err)
 					lastError = err
 				} else {
-					app.P.Printf("cv%d=%d\n", entry.Number, result)
+					app.P.Printf("cv%d=%s%s\n", entry.Number, syntax.FormatCVValue(result, output.Base), app.cvComment(output, named, entry.Number, result))
 				}
 			} else {
 				if err != nil {
 					return err
 				}
-				app.P.Printf("%d\n", result)
+				app.P.Printf("%s%s\n", syntax.FormatCVValue(result, output.Base), app.cvComment(output, false, entry.Number, result))
 			}
 		}
 		return lastError
@@ -84,3 +213,98 @@ func (app *LocoApp) ReadCVAction(mode string, locoId uint8, cvNumRaw string, ver
 
 	return fmt.Errorf("invalid format: %s", cvNumRaw)
 }
+
+// cvComment is the comment printed after a value: the name of the CV in the schema of the decoder,
+// and the explanation of the value when it is asked for. It is empty when there is nothing to tell.
+func (app *LocoApp) cvComment(output CVOutput, named bool, cv uint16, value int) string {
+	if !output.Explain && !named {
+		return ""
+	}
+	def, ok := cvdefs.Find(cv, app.schemaFamily())
+	if !ok {
+		return ""
+	}
+	var comment []string
+	if named {
+		comment = append(comment, def.Name)
+	}
+	if explanation := def.Explain(uint8(value)); output.Explain && explanation != "" {
+		comment = append(comment, explanation)
+	}
+	if len(comment) == 0 {
+		return ""
+	}
+	return "  # " + strings.Join(comment, ": ")
+}
+
+// cvReader and cvWriter are the CV access of the actions, by the command station or over the WiFi
+type (
+	cvReader func(lcv commandstation.LocoCV, options ...commandstation.RequestOption) (int, error)
+	cvWriter func(lcv commandstation.LocoCV, options ...commandstation.RequestOption) error
+)
+
+// cvAccess reads and writes the CVs with WiFiMode over the WiFi of the decoder the opts reach, otherwise through
+// the command station on the track of mode, see wifiCVAccess and stationCVAccess. The cleanup ends the access.
+func (app *LocoApp) cvAccess(mode string, verify bool, preflight bool, timeout time.Duration, opts ...decoders.Option) (cvReader, cvWriter, func(), error) {
+	if mode != WiFiMode {
+		return app.stationCVAccess(mode, preflight, timeout)
+	}
+	read, write, err := app.wifiCVAccess(verify, opts...)
+	return read, write, func() {}, err
+}
+
+// stationCVAccess reads and writes the CVs through the command station, a session of the programming track
+// is ended by the returned cleanup
+func (app *LocoApp) stationCVAccess(mode string, preflight bool, timeout time.Duration) (cvReader, cvWriter, func(), error) {
+	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
+		return nil, nil, nil, cmdErr
+	}
+	cleanUp := func() { _ = app.station.CleanUp() }
+	if preflight {
+		if err := app.preflight(commandstation.Mode(mode), timeout); err != nil {
+			cleanUp()
+			return nil, nil, nil, err
+		}
+	}
+
+	read := func(lcv commandstation.LocoCV, options ...commandstation.RequestOption) (int, error) {
+		return app.station.ReadCV(commandstation.Mode(mode), lcv, options...)
+	}
+	write := func(lcv commandstation.LocoCV, options ...commandstation.RequestOption) error {
+		return app.station.WriteCV(commandstation.Mode(mode), lcv, options...)
+	}
+	if commandstation.Mode(mode) != commandstation.ProgrammingTrackMode {
+		return read, write, cleanUp, nil
+	}
+	session := commandstation.BeginProgSession(app.station)
+	read = func(lcv commandstation.LocoCV, options ...commandstation.RequestOption) (int, error) {
+		return session.ReadCV(lcv.Cv.Num, options...)
+	}
+	write = func(lcv commandstation.LocoCV, options ...commandstation.RequestOption) error {
+		return session.WriteCV(lcv.Cv, options...)
+	}
+	return read, write, func() {
+		app.endProgSession(session)
+		cleanUp()
+	}, nil
+}
+
+// byPriority orders the CVs of a long read, so an interrupted backup already holds the identity
+// and configuration CVs before the function mapping and sound banks are read
+func byPriority(entries []syntax.CVEntry) []syntax.CVEntry {
+	sorted := append([]syntax.CVEntry(nil), entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if pi, pj := cvdefs.PriorityOf(sorted[i].Number), cvdefs.PriorityOf(sorted[j].Number); pi != pj {
+			return pi < pj
+		}
+		return sorted[i].Number < sorted[j].Number
+	})
+	return sorted
+}
+
+// endProgSession powers the main track again after a batch on the programming track
+func (app *LocoApp) endProgSession(session *commandstation.ProgSession) {
+	if err := session.End(); err != nil {
+		logrus.Error(err)
+	}
+}
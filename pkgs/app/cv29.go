@@ -0,0 +1,101 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/keskad/loco/pkgs/cvdefs"
+	"github.com/keskad/loco/pkgs/syntax"
+)
+
+// CV29Flags are the bits of CV29 by the flags of "loco cv29 compose", bit 7 (accessory decoder) is never composed
+var CV29Flags = []struct {
+	Flag string
+	Bit  uint8
+}{
+	{"reversed", 0},
+	{"28steps", 1},
+	{"analog", 2},
+	{"railcom", 3},
+	{"speed-table", 4},
+	{"long-address", 5},
+}
+
+// CVWrite is where a composed value is written to, see SendCVAction
+type CVWrite struct {
+	Mode    string
+	LocoId  uint8
+	Verify  bool
+	Timeout time.Duration
+}
+
+// DecodeCV29Action prints the bits of a CV29 value, each with its meaning
+func (app *LocoApp) DecodeCV29Action(value uint8) error {
+	def, _ := cvdefs.Find(cvConfig, "")
+	_, _ = app.P.Printf("cv%d=%d (%s, %s)\n", cvConfig, value, syntax.FormatCVValue(int(value), 16), syntax.FormatCVValue(int(value), 2))
+	for _, bit := range def.Bits {
+		state, meaning := 0, bit.Off
+		if value&(1<<bit.Bit) != 0 {
+			state, meaning = 1, bit.On
+		}
+		_, _ = app.P.Printf("  bit %d (%3d) = %d  %s\n", bit.Bit, 1<<bit.Bit, state, meaning)
+	}
+	return nil
+}
+
+// ComposeCV29Action prints the CV29 value with the bits of set, with ask every bit is asked for and the bits
+// of set are the suggested answers. The value is written to the decoder when write is not nil.
+func (app *LocoApp) ComposeCV29Action(set []uint8, ask bool, write *CVWrite) error {
+	var value uint8
+	for _, bit := range set {
+		value |= 1 << bit
+	}
+	if ask {
+		var err error
+		if value, err = app.askCV29(bufio.NewReader(app.input()), value); err != nil {
+			return err
+		}
+	}
+	def, _ := cvdefs.Find(cvConfig, "")
+	_, _ = app.P.Printf("cv%d=%d  # %s\n", cvConfig, value, def.Explain(value))
+	if write == nil {
+		return nil
+	}
+	return app.SendCVAction(fmt.Sprintf("cv%d=%d", cvConfig, value), CVSendOptions{Mode: write.Mode, LocoId: write.LocoId, Verify: write.Verify, Timeout: write.Timeout, Strict: true})
+}
+
+// askCV29 asks for the bits of CV29 one by one, an empty answer keeps the bit of value
+func (app *LocoApp) askCV29(input *bufio.Reader, value uint8) (uint8, error) {
+	def, _ := cvdefs.Find(cvConfig, "")
+	for _, flag := range CV29Flags {
+		var bit cvdefs.Bit
+		for _, b := range def.Bits {
+			if b.Bit == flag.Bit {
+				bit = b
+			}
+		}
+		mask := uint8(1) << flag.Bit
+		suggested := "y/N"
+		if value&mask != 0 {
+			suggested = "Y/n"
+		}
+		_, _ = app.P.Printf("%s: %s? (no: %s) [%s] ", bit.Name, bit.On, bit.Off, suggested)
+		answer, err := input.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return 0, fmt.Errorf("cannot read the answer: %w", err)
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "":
+		case "y", "yes":
+			value |= mask
+		case "n", "no":
+			value &^= mask
+		default:
+			return 0, fmt.Errorf("invalid answer %q, expected y or n", strings.TrimSpace(answer))
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/decoders"
+)
+
+//
+// Context: a decoder on the workbench is powered from a bare supply, there is no command station to program it.
+// The RB23xx reads and writes its CVs over its WiFi, "loco cv get/set --via wifi" uses the mode WiFiMode
+// in place of a track. The locomotive address is not needed, the decoder is the one of the WiFi.
+//
+
+// WiFiMode reads and writes the CVs through the web interface of the decoder, see decoders.CVAccessor
+const WiFiMode = "wifi"
+
+// wifiCVAccess reads and writes the CVs of the decoder over its WiFi. The request options are meant for
+// the command station, the write is read back with verify, the read is repeated with verify until two
+// reads agree. In dry-run mode the writes are printed only.
+func (app *LocoApp) wifiCVAccess(verify bool, opts ...decoders.Option) (cvReader, cvWriter, error) {
+	rb, err := app.decoder(opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	readOnce := func(num uint16) (int, error) {
+		value, err := rb.ReadCV(num)
+		if err != nil {
+			return 0, fmt.Errorf("cannot read cv%d over WiFi: %w", num, err)
+		}
+		return value, nil
+	}
+	read := func(lcv commandstation.LocoCV, _ ...commandstation.RequestOption) (int, error) {
+		num := uint16(lcv.Cv.Num)
+		value, err := readOnce(num)
+		if err != nil || !verify {
+			return value, err
+		}
+		again, err := readOnce(num)
+		if err != nil {
+			return 0, err
+		}
+		if again != value {
+			return 0, fmt.Errorf("cannot read cv%d over WiFi, it read %d and then %d", num, value, again)
+		}
+		return value, nil
+	}
+	write := func(lcv commandstation.LocoCV, _ ...commandstation.RequestOption) error {
+		num := uint16(lcv.Cv.Num)
+		if app.DryRun {
+			_, _ = app.P.Printf("[dry-run] write cv%d=%d over WiFi\n", num, lcv.Cv.Value)
+			return nil
+		}
+		logrus.Debugf("Writing CV over WiFi: CV%d=%d", num, lcv.Cv.Value)
+		if err := rb.WriteCV(num, lcv.Cv.Value); err != nil {
+			return fmt.Errorf("cannot write CV: %w", err)
+		}
+		if !verify {
+			return nil
+		}
+		stored, err := readOnce(num)
+		if err != nil {
+			return fmt.Errorf("cannot verify CV was written: %w", err)
+		}
+		if stored != lcv.Cv.Value {
+			return fmt.Errorf("cannot write CV, the value differs after a write")
+		}
+		return nil
+	}
+	return read, write, nil
+}
@@ -0,0 +1,235 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/decoders"
+	"github.com/keskad/loco/pkgs/syntax"
+)
+
+//
+// Context: restoring a backup of "loco cv backup" onto a decoder, often on a noisy programming track. A failed CV
+// does not stop the restore, every CV is tried and the report tells which of them have to be written again.
+// The assertions of a file, e.g. "cv8==145", make sure it is the right decoder before anything is written,
+// the blocks "@if cv8==145" let a single file of a fleet hold the CVs of each brand.
+//
+
+// ErrCVApplyFailed is returned when some CVs of a file could not be written or verified
+var ErrCVApplyFailed = errors.New("CVs not applied")
+
+// ErrCVAssertion is returned when the decoder does not hold the value of an assertion
+var ErrCVAssertion = errors.New("CV assertion failed")
+
+// CVApplyOptions shape ApplyCVAction and CheckCVAssertionsAction
+type CVApplyOptions struct {
+	Mode    string
+	LocoId  uint8
+	Verify  bool
+	Timeout time.Duration
+	Settle  time.Duration
+	// Retries is how many times a failed CV is written again
+	Retries uint8
+	// Validate checks the values against the schema of the decoder first, see CheckCVValues
+	Validate bool
+}
+
+// ApplyCVAction writes the CVs of a CV file, "-" reads them from the input. The assertions of the file are checked
+// first, nothing is written when one of them fails. Every CV is written even when another fails, with verify it is
+// read back. The identity CVs (CV7, CV8) of a backup are skipped, writing CV8 resets most decoders.
+// The report lists every CV, ErrCVApplyFailed is returned when one of them failed.
+func (app *LocoApp) ApplyCVAction(file string, options CVApplyOptions, opts ...decoders.Option) error {
+	if app.DryRun && options.Verify {
+		return fmt.Errorf("--verify cannot be used in dry-run mode, nothing is written")
+	}
+	// the conditions of the file are evaluated on the decoder
+	read, write, cleanUp, err := app.cvAccess(options.Mode, options.Verify, true, options.Timeout, opts...)
+	if err != nil {
+		return err
+	}
+	defer cleanUp()
+	entries, err := app.readCVFile(file, app.conditionReader(read, options))
+	if err != nil {
+		return err
+	}
+
+	var assertions, values []syntax.CVEntry
+	for _, entry := range entries {
+		if entry.Assert {
+			assertions = append(assertions, entry)
+		} else {
+			values = append(values, entry)
+		}
+	}
+	// the index CVs are written before the paged CVs, like by "loco cv set --optimize"
+	unknown := func(uint16) (int, bool) { return 0, false }
+	var skipped, writes []syntax.CVEntry
+	for _, entry := range planCVWrites(values, unknown).writes {
+		if entry.Number == cvVersion || entry.Number == cvManufacturer {
+			skipped = append(skipped, entry)
+			continue
+		}
+		writes = append(writes, entry)
+	}
+	if len(writes) == 0 {
+		return fmt.Errorf("no CV to write in %s", file)
+	}
+	if options.Validate {
+		values := make([]string, 0, len(writes))
+		for _, entry := range writes {
+			values = append(values, fmt.Sprintf("cv%d=%d", entry.Number, entry.Value))
+		}
+		if err := app.CheckCVValues(strings.Join(values, ", ")); err != nil {
+			return err
+		}
+	}
+
+	if app.DryRun {
+		for _, entry := range assertions {
+			_, _ = app.P.Printf("skipped:  cv%d==%d (dry-run)\n", entry.Number, entry.Value)
+		}
+	} else if failed := app.checkCVAssertions(read, assertions, options); failed > 0 {
+		return fmt.Errorf("%w: %d of %d assertion(s) failed, nothing was written", ErrCVAssertion, failed, len(assertions))
+	}
+	for _, entry := range skipped {
+		_, _ = app.P.Printf("skipped:  cv%d=%d (identifies the decoder)\n", entry.Number, entry.Value)
+	}
+	var failed int
+	for _, entry := range writes {
+		var writeErr error
+		for attempt := 0; attempt <= int(options.Retries); attempt++ {
+			if attempt > 0 {
+				logrus.Debugf("Writing cv%d again (%d/%d): %s", entry.Number, attempt, options.Retries, writeErr)
+			}
+			writeErr = write(commandstation.LocoCV{
+				LocoId: commandstation.LocoAddr(options.LocoId),
+				Cv:     commandstation.CV{Num: commandstation.CVNum(entry.Number), Value: int(entry.Value)},
+			}, commandstation.Verify(options.Verify),
+				commandstation.Timeout(options.Timeout),
+				commandstation.Settle(options.Settle))
+			if !app.DryRun {
+				time.Sleep(options.Settle)
+			}
+			if writeErr == nil {
+				break
+			}
+		}
+
+		switch {
+		case writeErr != nil:
+			failed++
+			_, _ = app.P.Printf("failed:   cv%d=%d: %s\n", entry.Number, entry.Value, writeErr)
+		case options.Verify:
+			_, _ = app.P.Printf("verified: cv%d=%d\n", entry.Number, entry.Value)
+		default:
+			_, _ = app.P.Printf("written:  cv%d=%d\n", entry.Number, entry.Value)
+		}
+	}
+
+	written := len(writes) - failed
+	verified := 0
+	if options.Verify {
+		verified = written
+	}
+	_, _ = app.P.Printf("report: %d written, %d verified, %d failed, %d skipped\n", written, verified, failed, len(skipped))
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d CV(s) failed, write them again with \"loco cv set\"", ErrCVApplyFailed, failed, len(writes))
+	}
+	return nil
+}
+
+// CheckCVAssertionsAction compares the decoder with the assertions of a CV file, "-" reads them from the input.
+// The values of the file are not written, ErrCVAssertion is returned when an assertion fails.
+func (app *LocoApp) CheckCVAssertionsAction(file string, options CVApplyOptions, opts ...decoders.Option) error {
+	read, _, cleanUp, err := app.cvAccess(options.Mode, false, true, options.Timeout, opts...)
+	if err != nil {
+		return err
+	}
+	defer cleanUp()
+	entries, err := app.readCVFile(file, app.conditionReader(read, options))
+	if err != nil {
+		return err
+	}
+	var assertions []syntax.CVEntry
+	for _, entry := range byPriority(entries) {
+		if entry.Assert {
+			assertions = append(assertions, entry)
+		}
+	}
+	if len(assertions) == 0 {
+		return fmt.Errorf("no assertion in %s, e.g. \"cv8==145\"", file)
+	}
+	failed := app.checkCVAssertions(read, assertions, options)
+	_, _ = app.P.Printf("report: %d passed, %d failed\n", len(assertions)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d assertion(s)", ErrCVAssertion, failed, len(assertions))
+	}
+	return nil
+}
+
+// checkCVAssertions reads the CVs of the assertions and prints each result, it returns how many failed
+func (app *LocoApp) checkCVAssertions(read cvReader, assertions []syntax.CVEntry, options CVApplyOptions) int {
+	failed := 0
+	for _, entry := range assertions {
+		value, err := read(commandstation.LocoCV{
+			LocoId: commandstation.LocoAddr(options.LocoId),
+			Cv:     commandstation.CV{Num: commandstation.CVNum(entry.Number)},
+		}, commandstation.Timeout(options.Timeout),
+			commandstation.Retries(options.Retries))
+		switch {
+		case err != nil:
+			failed++
+			_, _ = app.P.Printf("unread:   cv%d==%d: %s\n", entry.Number, entry.Value, err)
+		case value != int(entry.Value):
+			failed++
+			_, _ = app.P.Printf("mismatch: cv%d==%d, the decoder holds %d\n", entry.Number, entry.Value, value)
+		default:
+			_, _ = app.P.Printf("passed:   cv%d==%d\n", entry.Number, entry.Value)
+		}
+	}
+	return failed
+}
+
+// conditionReader reads the CVs of the conditions of a CV file, in dry-run mode nothing can be read
+func (app *LocoApp) conditionReader(read cvReader, options CVApplyOptions) func(cv uint16) (int, error) {
+	return func(cv uint16) (int, error) {
+		if app.DryRun {
+			return 0, errors.New("the conditions cannot be evaluated in dry-run mode")
+		}
+		return read(commandstation.LocoCV{
+			LocoId: commandstation.LocoAddr(options.LocoId),
+			Cv:     commandstation.CV{Num: commandstation.CVNum(cv)},
+		}, commandstation.Timeout(options.Timeout),
+			commandstation.Retries(options.Retries))
+	}
+}
+
+// readCVFile parses a CV file with its assertions, "-" is read from the input. The includes of a file are relative
+// to its directory, of the input to the current directory. The conditions of the file are evaluated with read.
+func (app *LocoApp) readCVFile(file string, read func(cv uint16) (int, error)) ([]syntax.CVEntry, error) {
+	var content []byte
+	var err error
+	dir := "."
+	if file == "-" {
+		content, err = io.ReadAll(app.input())
+	} else {
+		content, err = os.ReadFile(file)
+		dir = filepath.Dir(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the CV file: %w", err)
+	}
+	entries, err := syntax.ParseCVString(string(content), "\n", syntax.Strict(true), syntax.Assertions(true), syntax.IncludeDir(dir), syntax.Conditions(read))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the CV file %q: %w", file, err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/cvdefs"
+	"github.com/keskad/loco/pkgs/decoders"
+	"github.com/keskad/loco/pkgs/syntax"
+)
+
+//
+// Context: before a decoder is reprogrammed, reset or replaced its CVs are saved in a file. The file is a CV file
+// of "loco cv set", sorted, with the decoder it was read from and the names of the CVs as comments, so it is
+// restored with "loco cv apply loco3.cv" and still tells later which locomotive it belongs to.
+//
+
+// CVBackupOptions select what BackupCVAction reads
+type CVBackupOptions struct {
+	// Range are the CVs read, e.g. "1-256" or "cv1-cv8, cv29"
+	Range   string
+	Mode    string
+	LocoId  uint8
+	Verify  bool
+	Timeout time.Duration
+	Retries uint8
+	// Force replaces an existing file
+	Force bool
+}
+
+// BackupCVAction reads the CVs of the range into file, with "-" they are printed. A CV the decoder does not answer
+// is left out and listed in the header, the backup fails only when no CV could be read.
+func (app *LocoApp) BackupCVAction(file string, options CVBackupOptions, opts ...decoders.Option) error {
+	entries, err := syntax.ParseCVString(options.Range, ",")
+	if err != nil {
+		return fmt.Errorf("invalid CV range: %w", err)
+	}
+	if len(entries) == 0 {
+		return errors.New("no CV to back up, select them with --range")
+	}
+	toFile := file != "" && file != "-"
+	if toFile && !options.Force {
+		if _, err := os.Stat(file); err == nil {
+			return fmt.Errorf("%s already exists, use --force to replace it", file)
+		}
+	}
+
+	read, _, cleanUp, err := app.cvAccess(options.Mode, options.Verify, true, options.Timeout, opts...)
+	if err != nil {
+		return err
+	}
+	defer cleanUp()
+	if _, err := app.loadDecoderSchema(); err != nil {
+		return err
+	}
+	readCV := func(cv uint16) (int, error) {
+		return read(commandstation.LocoCV{
+			LocoId: commandstation.LocoAddr(options.LocoId),
+			Cv:     commandstation.CV{Num: commandstation.CVNum(cv)},
+		}, commandstation.Verify(options.Verify),
+			commandstation.Timeout(options.Timeout),
+			commandstation.Retries(options.Retries))
+	}
+
+	manufacturer, err := readCV(cvManufacturer)
+	if err != nil {
+		return fmt.Errorf("cannot identify the decoder: %w", err)
+	}
+	version, err := readCV(cvVersion)
+	if err != nil {
+		return fmt.Errorf("cannot identify the decoder: %w", err)
+	}
+
+	var lines strings.Builder
+	var unread []string
+	for i, entry := range entries {
+		if toFile {
+			_, _ = app.P.Printf("\rreading cv%d (%d/%d)", entry.Number, i+1, len(entries))
+		}
+		value, err := readCV(entry.Number)
+		if err != nil {
+			unread = append(unread, fmt.Sprintf("cv%d", entry.Number))
+			continue
+		}
+		fmt.Fprintf(&lines, "cv%d=%d%s\n", entry.Number, value, app.cvComment(CVOutput{}, true, entry.Number, value))
+	}
+	if toFile {
+		_, _ = app.P.Printf("\n")
+	}
+	if len(unread) == len(entries) {
+		return fmt.Errorf("no CV of %s could be read, is the locomotive on the track?", options.Range)
+	}
+
+	content := app.cvBackupHeader(file, options, uint8(manufacturer), uint8(version), len(entries)-len(unread), unread) + lines.String()
+	if !toFile {
+		_, _ = app.P.Printf("%s", content)
+		return nil
+	}
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		return fmt.Errorf("cannot write the CVs: %w", err)
+	}
+	_, _ = app.P.Printf("%d CVs saved in %s, %d unread\n", len(entries)-len(unread), file, len(unread))
+	if len(unread) > 0 {
+		_, _ = app.P.Printf("unread: %s\n", strings.Join(unread, ", "))
+	}
+	return nil
+}
+
+// cvBackupHeader describes the backup in comments that "loco cv set" skips
+func (app *LocoApp) cvBackupHeader(file string, options CVBackupOptions, manufacturer, version uint8, read int, unread []string) string {
+	var header strings.Builder
+	source, restore := "the decoder WiFi", "loco cv apply --via wifi"
+	if options.Mode != WiFiMode {
+		source = "the programming track"
+		restore = "loco cv apply"
+		if options.LocoId != 0 {
+			source = fmt.Sprintf("locomotive %d (%s)", options.LocoId, options.Mode)
+			restore = fmt.Sprintf("loco cv apply -l %d", options.LocoId)
+		}
+	}
+	if file == "" || file == "-" {
+		file = "<file>"
+	}
+	fmt.Fprintf(&header, "# loco cv backup of %s, restore with: %s %s --verify\n", source, restore, file)
+	fmt.Fprintf(&header, "# created: %s\n", time.Now().UTC().Truncate(time.Second).Format(time.RFC3339))
+	decoder := fmt.Sprintf("manufacturer %d, version %d", manufacturer, version)
+	if family := cvdefs.Family(manufacturer); family != "" {
+		decoder = fmt.Sprintf("manufacturer %d (%s), version %d", manufacturer, family, version)
+	}
+	fmt.Fprintf(&header, "# decoder: %s\n", decoder)
+	fmt.Fprintf(&header, "# cvs: %s, %d read", options.Range, read)
+	if len(unread) > 0 {
+		fmt.Fprintf(&header, ", unread: %s", strings.Join(unread, ", "))
+	}
+	header.WriteString("\n")
+	return header.String()
+}
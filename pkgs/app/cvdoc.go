@@ -0,0 +1,107 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/cvdefs"
+	"github.com/keskad/loco/pkgs/syntax"
+	"github.com/sirupsen/logrus"
+)
+
+// CVDocAction prints the description of a CV, found by its number or name. The decoder family selects the manufacturer
+// specific definitions: the given one, the decoder type of loco.json with its schema, or detected from CV8 of locoId
+// when it is not 0.
+func (app *LocoApp) CVDocAction(query string, family string, locoId uint8) error {
+	if family == "" {
+		if _, err := app.loadDecoderSchema(); err != nil {
+			return err
+		}
+		family = app.schemaFamily()
+	}
+	if family == "" && locoId != 0 {
+		family = app.detectFamily(locoId)
+	}
+
+	def, err := cvdefs.Lookup(query, family)
+	if err != nil {
+		return err
+	}
+	_, _ = app.P.Printf("%s %s\n", def.Range(), def.Name)
+	_, _ = app.P.Printf("  %s\n", def.Description)
+	if def.ReadOnly {
+		_, _ = app.P.Printf("  read-only\n")
+	}
+	if def.Default != nil {
+		_, _ = app.P.Printf("  default: %d\n", *def.Default)
+	}
+	if def.Min != 0 || def.Max != 0 {
+		_, _ = app.P.Printf("  values: %d-%d\n", def.Min, maxOrByte(def.Max))
+	}
+	for _, bit := range def.Bits {
+		_, _ = app.P.Printf("  bit %d (%d) %s: 0 = %s, 1 = %s\n", bit.Bit, 1<<bit.Bit, bit.Name, bit.Off, bit.On)
+	}
+	if family != "" {
+		_, _ = app.P.Printf("  decoder family: %s\n", family)
+	}
+	return nil
+}
+
+// ExplainCVAction prints the meaning of the values of cvString, e.g. "cv29=34  # Configuration Data #1: 28/128 steps, ..."
+// The definitions of the decoder family are used, or of the decoder type of loco.json with its schema.
+func (app *LocoApp) ExplainCVAction(cvString string, family string) error {
+	entries, err := syntax.ParseCVString(cvString, ",")
+	if err != nil {
+		return err
+	}
+	if family == "" {
+		if _, err := app.loadDecoderSchema(); err != nil {
+			return err
+		}
+		family = app.schemaFamily()
+	}
+	for _, entry := range entries {
+		if entry.Value > 255 {
+			return fmt.Errorf("invalid value %d of cv%d, must be between 0 and 255", entry.Value, entry.Number)
+		}
+		def, ok := cvdefs.Find(entry.Number, family)
+		if !ok {
+			_, _ = app.P.Printf("cv%d=%d  # not described, see the manual of the decoder\n", entry.Number, entry.Value)
+			continue
+		}
+		explanation := def.Name
+		if meaning := def.Explain(uint8(entry.Value)); meaning != "" {
+			explanation += ": " + meaning
+		}
+		_, _ = app.P.Printf("cv%d=%d  # %s\n", entry.Number, entry.Value, explanation)
+	}
+	return nil
+}
+
+// detectFamily reads the manufacturer ID on the main track, the NMRA definitions are used when it cannot be read
+func (app *LocoApp) detectFamily(locoId uint8) string {
+	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
+		logrus.Warnf("cannot detect the decoder family: %s", cmdErr)
+		return ""
+	}
+	defer app.station.CleanUp()
+
+	manufacturer, err := app.station.ReadCV(commandstation.MainTrackMode, commandstation.LocoCV{
+		LocoId: commandstation.LocoAddr(locoId),
+		Cv:     commandstation.CV{Num: cvManufacturer},
+	})
+	if err != nil {
+		logrus.Warnf("cannot detect the decoder family of locomotive %d: %s", locoId, err)
+		return ""
+	}
+	family := cvdefs.Family(uint8(manufacturer))
+	logrus.Debugf("cv%d=%d, decoder family %q", cvManufacturer, manufacturer, family)
+	return family
+}
+
+func maxOrByte(max uint8) uint8 {
+	if max == 0 {
+		return 255
+	}
+	return max
+}
@@ -0,0 +1,107 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/keskad/loco/pkgs/syntax"
+)
+
+//
+// Context: large sound decoder configurations. Most CVs of a file already hold their value, and every write
+// costs a packet, an acknowledgement and an EEPROM cycle. The plan drops such writes and orders the rest,
+// so a CV a later write depends on is written first.
+//
+
+const (
+	cvIndexHigh = 31
+	cvIndexLow  = 32
+	// cvPagedFirst and cvPagedLast are the indexed CVs, their meaning depends on CV31 and CV32
+	cvPagedFirst = 257
+	cvPagedLast  = 512
+)
+
+// cvWritePlan is what remains to be written from a CV file, in the order it is written
+type cvWritePlan struct {
+	writes    []syntax.CVEntry
+	unchanged []syntax.CVEntry
+}
+
+// writeStage orders the writes: a decoder reset (writing CV8) first, then the index CVs, the paged CVs last
+func writeStage(cv uint16) int {
+	switch {
+	case cv == cvManufacturer:
+		return 0
+	case cv == cvIndexHigh || cv == cvIndexLow:
+		return 1
+	case cv >= cvPagedFirst && cv <= cvPagedLast:
+		return 3
+	}
+	return 2
+}
+
+// planCVWrites orders the entries and drops the ones whose current value is already right. current returns
+// the value held by the decoder, false when it is not known; it is asked only about CVs that could be skipped.
+// A reset makes every current value meaningless and a changed index moves the paged CVs, so neither is compared then.
+func planCVWrites(entries []syntax.CVEntry, current func(cv uint16) (int, bool)) cvWritePlan {
+	ordered := append([]syntax.CVEntry(nil), entries...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if a, b := writeStage(ordered[i].Number), writeStage(ordered[j].Number); a != b {
+			return a < b
+		}
+		return ordered[i].Number < ordered[j].Number
+	})
+
+	plan := cvWritePlan{}
+	reset, indexChanged := false, false
+	for _, entry := range ordered {
+		compare := !reset
+		switch {
+		case entry.Number == cvManufacturer:
+			// CV8 is read-only, a write to it is a reset command
+			reset, compare = true, false
+		case writeStage(entry.Number) == 3 && indexChanged:
+			compare = false
+		}
+		if compare {
+			if value, ok := current(entry.Number); ok && value == int(entry.Value) {
+				plan.unchanged = append(plan.unchanged, entry)
+				continue
+			}
+		}
+		if entry.Number == cvIndexHigh || entry.Number == cvIndexLow {
+			indexChanged = true
+		}
+		plan.writes = append(plan.writes, entry)
+	}
+	return plan
+}
+
+// readKnownCVs reads a CV file holding the values the decoder is known to have, e.g. a backup made by "cv get"
+func readKnownCVs(path string) (map[uint16]int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the known CV values: %w", err)
+	}
+	entries, err := syntax.ParseCVString(string(content), "\n", syntax.IncludeDir(filepath.Dir(path)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the known CV values %q: %w", path, err)
+	}
+	known := make(map[uint16]int, len(entries))
+	for _, entry := range entries {
+		known[entry.Number] = int(entry.Value)
+	}
+	return known, nil
+}
+
+func (app *LocoApp) printCVWritePlan(plan cvWritePlan) {
+	for _, entry := range plan.unchanged {
+		_, _ = app.P.Printf("unchanged: cv%d=%d\n", entry.Number, entry.Value)
+	}
+	for _, entry := range plan.writes {
+		_, _ = app.P.Printf("write:     cv%d=%d\n", entry.Number, entry.Value)
+	}
+	_, _ = app.P.Printf("plan: %d of %d CV(s) written\n", len(plan.writes), len(plan.writes)+len(plan.unchanged))
+}
@@ -0,0 +1,156 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/keskad/loco/pkgs/cvdefs"
+	"github.com/keskad/loco/pkgs/syntax"
+)
+
+// decoderSchemaDir keeps the schemas of the decoder types in the home directory, "<type>.yaml"
+var decoderSchemaDir = filepath.Join(".loco", "decoders")
+
+// loadDecoderSchema registers the schema of the decoder of loco.json as the family of its decoder type, see
+// cvdefs.Schema. It tells if there is a schema, a decoder without one is described by the NMRA definitions.
+func (app *LocoApp) loadDecoderSchema() (bool, error) {
+	loco := app.Config.Loco
+	path := loco.DecoderSchema
+	if path == "" {
+		if loco.DecoderType == "" {
+			return false, nil
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return false, nil
+		}
+		path = filepath.Join(home, decoderSchemaDir, strings.ToLower(loco.DecoderType)+".yaml")
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+	}
+	schema, err := cvdefs.LoadSchema(path)
+	if err != nil {
+		return false, err
+	}
+	definitions, err := schema.Definitions()
+	if err != nil {
+		return false, err
+	}
+	cvdefs.RegisterFamily(app.schemaFamily(), definitions)
+	return true, nil
+}
+
+// schemaFamily is the family the schema is registered as, the decoder type or the file of loco.json
+func (app *LocoApp) schemaFamily() string {
+	if app.Config.Loco.DecoderType != "" {
+		return app.Config.Loco.DecoderType
+	}
+	return app.Config.Loco.DecoderSchema
+}
+
+// CheckCVValues validates the values of cvString against the schema of the decoder, all problems are returned
+// together. Without a schema nothing is checked, neither are the modifications of bits.
+func (app *LocoApp) CheckCVValues(cvString string) error {
+	found, err := app.loadDecoderSchema()
+	if err != nil || !found {
+		return err
+	}
+	entries, err := syntax.ParseCVString(cvString, ",", syntax.Modifications(true))
+	if err != nil {
+		return err
+	}
+	var problems []string
+	for _, entry := range entries {
+		// the value of a modification "cv29|=0x04" is known only once the CV was read
+		if entry.Modify {
+			continue
+		}
+		def, ok := cvdefs.Find(entry.Number, app.schemaFamily())
+		if !ok {
+			continue
+		}
+		if err := def.Check(entry.Number, entry.Value); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("the values do not match the schema of the decoder, nothing was written (use --no-validate to write them anyway):\n  %s",
+			strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// ImportJMRIAction converts JMRI decoder definitions into the schemas of dir, ~/.loco/decoders when empty. A schema
+// is named after its file, e.g. ESU_LokSound5.xml is the decoder type "esu_loksound5", with dir "-" it is printed.
+func (app *LocoApp) ImportJMRIAction(files []string, dir string, force bool) error {
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("cannot find the home directory: %w", err)
+		}
+		dir = filepath.Join(home, decoderSchemaDir)
+	}
+	if dir == "-" && len(files) > 1 {
+		return errors.New("only a single definition can be printed, select a directory with --output")
+	}
+	if dir != "-" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("cannot create %s: %w", dir, err)
+		}
+	}
+
+	for _, file := range files {
+		decoderType := strings.ToLower(strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)))
+		if err := app.importJMRI(file, dir, decoderType, force); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (app *LocoApp) importJMRI(file, dir, decoderType string, force bool) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("cannot open %s: %w", file, err)
+	}
+	defer in.Close()
+	schema, skipped, err := cvdefs.ImportJMRI(in)
+	if err != nil {
+		return fmt.Errorf("cannot import %s: %w", file, err)
+	}
+	for _, note := range skipped {
+		logrus.Debugf("%s: skipped %s", file, note)
+	}
+	if dir == "-" {
+		var out strings.Builder
+		if err := schema.WriteYAML(&out); err != nil {
+			return err
+		}
+		_, _ = app.P.Printf("%s", out.String())
+		return nil
+	}
+
+	path := filepath.Join(dir, decoderType+".yaml")
+	if _, err := os.Stat(path); err == nil && !force {
+		return fmt.Errorf("%s already exists, use --force to replace it", path)
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("cannot write the decoder schema: %w", err)
+	}
+	if err := schema.WriteYAML(out); err != nil {
+		_ = out.Close()
+		return fmt.Errorf("cannot write the decoder schema: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("cannot write the decoder schema: %w", err)
+	}
+	_, _ = app.P.Printf("%s: %d CVs of %s as the decoder type %q, %d variables skipped\n", path, len(schema.CVs), schema.Name, decoderType, len(skipped))
+	return nil
+}
@@ -0,0 +1,65 @@
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/cvdefs"
+	"github.com/keskad/loco/pkgs/decoders"
+)
+
+// DecoderInfoAction prints the model, the firmware version and the serial number reported by the decoder over WiFi.
+// When the WiFi interface cannot tell, CV7 (version) and CV8 (manufacturer) are read over the track instead.
+func (app *LocoApp) DecoderInfoAction(mode string, locoId uint8, timeout time.Duration, retries uint8, opts ...decoders.Option) error {
+	decoder, err := app.decoder(opts...)
+	if err != nil {
+		return err
+	}
+	info, wifiErr := decoder.Info()
+	if wifiErr == nil {
+		_, _ = app.P.Printf("model:        %s\n", orUnknown(info.Model))
+		_, _ = app.P.Printf("firmware:     %s\n", orUnknown(info.Firmware))
+		_, _ = app.P.Printf("serial:       %s\n", orUnknown(info.Serial))
+		_, _ = app.P.Printf("source:       wifi\n")
+		return nil
+	}
+	logrus.Infof("cannot read the decoder info over WiFi, reading CV%d and CV%d over the track: %s", cvVersion, cvManufacturer, wifiErr)
+
+	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
+		return fmt.Errorf("%w, and over the track: %w", wifiErr, cmdErr)
+	}
+	defer app.station.CleanUp()
+	if err := app.preflight(commandstation.Mode(mode), timeout); err != nil {
+		return err
+	}
+	values := map[uint16]int{}
+	for _, cv := range []uint16{cvVersion, cvManufacturer} {
+		value, err := app.station.ReadCV(commandstation.Mode(mode), commandstation.LocoCV{
+			LocoId: commandstation.LocoAddr(locoId),
+			Cv:     commandstation.CV{Num: commandstation.CVNum(cv)},
+		}, commandstation.Timeout(timeout), commandstation.Retries(retries))
+		if err != nil {
+			return fmt.Errorf("%w, and CV%d cannot be read over the track: %w", wifiErr, cv, err)
+		}
+		values[cv] = value
+	}
+
+	manufacturer := fmt.Sprintf("%d", values[cvManufacturer])
+	if family := cvdefs.Family(uint8(values[cvManufacturer])); family != "" {
+		manufacturer += fmt.Sprintf(" (%s)", family)
+	}
+	_, _ = app.P.Printf("manufacturer: %s\n", manufacturer)
+	_, _ = app.P.Printf("version:      %d\n", values[cvVersion])
+	_, _ = app.P.Printf("source:       track, CV%d and CV%d\n", cvVersion, cvManufacturer)
+	return nil
+}
+
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
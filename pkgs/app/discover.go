@@ -0,0 +1,61 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/keskad/loco/pkgs/config"
+	"github.com/keskad/loco/pkgs/decoders"
+)
+
+// DiscoverDecodersAction lists the RB23xx decoders found on the local networks, see decoders.Discover.
+// When one is found and it is not the configured one, storing its address as loco.decoder_address is offered,
+// with save it is stored without asking.
+func (app *LocoApp) DiscoverDecodersAction(scan bool, timeout time.Duration, save bool) error {
+	found, err := decoders.Discover(decoders.DiscoverOptions{Timeout: timeout, Scan: scan})
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		hint := ""
+		if !scan {
+			hint = ", try --scan to probe every host of the local networks"
+		}
+		return fmt.Errorf("no RB23xx decoder found, is the WiFi function of the decoder on?%s", hint)
+	}
+	for _, decoder := range found {
+		_, _ = app.P.Printf("%s\t(%s)\n", decoder.Address, decoder.Source)
+	}
+	if len(found) > 1 {
+		_, _ = app.P.Printf("more decoders found, store one with --decoder-address or loco.decoder_address\n")
+		return nil
+	}
+
+	address := found[0].Address
+	configured := ""
+	if app.Config != nil {
+		configured = app.Config.Loco.DecoderAddress
+	}
+	if configured == address || (configured == "" && found[0].Source == "default") {
+		return nil
+	}
+	if !save {
+		_, _ = app.P.Printf("Store %s as loco.decoder_address? [y/N] ", address)
+		answer, err := bufio.NewReader(app.input()).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("cannot read the answer: %w", err)
+		}
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			return nil
+		}
+	}
+	path, err := config.SaveDecoderAddress(address)
+	if err != nil {
+		return err
+	}
+	_, _ = app.P.Printf("loco.decoder_address = %s stored in %s\n", address, path)
+	return nil
+}
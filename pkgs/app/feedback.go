@@ -0,0 +1,65 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+)
+
+// FeedbackStatusAction prints occupied inputs of all R-BUS feedback modules
+func (app *LocoApp) FeedbackStatusAction() error {
+	z21, err := app.z21Station(commandstation.CapabilityFeedback, "feedback modules are supported only by the z21 command station")
+	if err != nil {
+		return err
+	}
+	defer z21.CleanUp()
+
+	anyOccupied := false
+	for group := uint8(0); group <= 1; group++ {
+		status, statusErr := z21.FeedbackStatus(group)
+		if statusErr != nil {
+			return statusErr
+		}
+		first := int(group)*z21proto.RMBusModulesPerGroup + 1
+		for module := first; module < first+z21proto.RMBusModulesPerGroup; module++ {
+			var inputs []string
+			for input := 1; input <= 8; input++ {
+				if status.Occupied(module, input) {
+					inputs = append(inputs, fmt.Sprintf("%d", input))
+				}
+			}
+			if len(inputs) > 0 {
+				anyOccupied = true
+				_, _ = app.P.Printf("module %d: %s\n", module, strings.Join(inputs, ", "))
+			}
+		}
+	}
+	if !anyOccupied {
+		_, _ = app.P.Printf("No occupied inputs\n")
+	}
+	return nil
+}
+
+// FeedbackAddressAction programs the address of a single R-BUS feedback module.
+// waitForUser is called while the Z21 is sending the programming sequence, it returns when the user is done.
+func (app *LocoApp) FeedbackAddressAction(address uint8, waitForUser func() error) error {
+	z21, err := app.z21Station(commandstation.CapabilityFeedback, "feedback modules are supported only by the z21 command station")
+	if err != nil {
+		return err
+	}
+	defer z21.CleanUp()
+
+	if err := z21.StartFeedbackProgramming(address); err != nil {
+		return fmt.Errorf("cannot start programming the feedback module: %w", err)
+	}
+	_, _ = app.P.Printf("Programming address %d. Make sure only one feedback module is connected to the R-BUS,\n", address)
+	_, _ = app.P.Printf("press the programming button on the module and wait until its LED stops blinking, then press Enter.\n")
+
+	waitErr := waitForUser()
+	if err := z21.StopFeedbackProgramming(); err != nil {
+		return fmt.Errorf("cannot stop programming the feedback module: %w", err)
+	}
+	return waitErr
+}
@@ -0,0 +1,137 @@
+package app
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/keskad/loco/pkgs/decoders"
+)
+
+// FirmwareOptions shape FirmwareUploadAction
+type FirmwareOptions struct {
+	// SHA256 is the expected checksum of the image, empty reads it from <image>.sha256
+	SHA256 string
+	// SkipChecksum uploads an image without a known checksum
+	SkipChecksum bool
+	// ExpectVersion fails the update when the decoder reports another firmware version after the restart
+	ExpectVersion string
+	// RestartTimeout and PollInterval shape the wait for the restart, zero values are the defaults of the decoder
+	RestartTimeout time.Duration
+	PollInterval   time.Duration
+}
+
+// FirmwareUploadAction verifies the checksum of a firmware image, uploads it to the decoder and waits
+// for the decoder to restart. The firmware version is compared before and after the update.
+func (app *LocoApp) FirmwareUploadAction(imagePath string, options FirmwareOptions, opts ...decoders.Option) error {
+	image, err := os.ReadFile(imagePath)
+	if err != nil {
+		return fmt.Errorf("cannot read the firmware image: %w", err)
+	}
+	if len(image) == 0 {
+		return fmt.Errorf("the firmware image %q is empty", imagePath)
+	}
+	sum := sha256.Sum256(image)
+	actual := hex.EncodeToString(sum[:])
+	if err := verifyFirmwareChecksum(imagePath, actual, options); err != nil {
+		return err
+	}
+	_, _ = app.P.Printf("image:        %s (%s, sha256 %s)\n", filepath.Base(imagePath), formatSize(int64(len(image))), actual)
+
+	decoder, err := app.decoder(opts...)
+	if err != nil {
+		return err
+	}
+	rb, ok := decoder.(decoders.FirmwareUpdater)
+	if !ok {
+		return fmt.Errorf("firmware update over WiFi: %w", decoders.ErrNotSupported)
+	}
+	before, infoErr := decoder.Info()
+	if infoErr == nil {
+		_, _ = app.P.Printf("installed:    %s\n", orUnknown(before.Firmware))
+	} else {
+		logrus.Debugf("firmware: the version before the update is not known: %s", infoErr)
+	}
+
+	reported := 0
+	err = rb.UploadFirmware(image, func(sent int64) {
+		// every tenth is reported
+		if percent := int(sent * 100 / int64(len(image))); percent/10 > reported/10 {
+			reported = percent
+			_, _ = app.P.Printf("uploading:    %d%%\n", percent)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	restartTimeout := options.RestartTimeout
+	if restartTimeout == 0 {
+		restartTimeout = decoders.FIRMWARE_RESTART_TIMEOUT
+	}
+	pollInterval := options.PollInterval
+	if pollInterval == 0 {
+		pollInterval = decoders.FIRMWARE_POLL_INTERVAL
+	}
+	_, _ = app.P.Printf("restarting\n")
+	if err := rb.WaitForRestart(restartTimeout, pollInterval); err != nil {
+		return err
+	}
+
+	after, err := decoder.Info()
+	if errors.Is(err, decoders.ErrInfoUnavailable) {
+		if options.ExpectVersion != "" {
+			return fmt.Errorf("the decoder is back, but it does not report its firmware version to compare with %s", options.ExpectVersion)
+		}
+		_, _ = app.P.Printf("updated, the decoder does not report its firmware version\n")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("the decoder is back, but its firmware version cannot be read: %w", err)
+	}
+	_, _ = app.P.Printf("installed:    %s\n", orUnknown(after.Firmware))
+	if options.ExpectVersion != "" && after.Firmware != options.ExpectVersion {
+		return fmt.Errorf("the decoder runs firmware %s after the update, %s was expected", orUnknown(after.Firmware), options.ExpectVersion)
+	}
+	if infoErr == nil && before.Firmware != "" && before.Firmware == after.Firmware {
+		logrus.Warnf("firmware: the decoder still reports version %s, the image may have been the same version or rejected after the restart", after.Firmware)
+	}
+	return nil
+}
+
+// verifyFirmwareChecksum compares the checksum of the image with the expected one, given in the options
+// or in a <image>.sha256 file as written by sha256sum
+func verifyFirmwareChecksum(imagePath string, actual string, options FirmwareOptions) error {
+	expected := strings.ToLower(strings.TrimSpace(options.SHA256))
+	if expected == "" {
+		file, err := os.Open(imagePath + ".sha256")
+		switch {
+		case errors.Is(err, os.ErrNotExist) && options.SkipChecksum:
+			logrus.Warnf("firmware: uploading %q without checking its checksum", filepath.Base(imagePath))
+			return nil
+		case errors.Is(err, os.ErrNotExist):
+			return fmt.Errorf("no checksum of %q: pass --sha256, put it in %s.sha256 or use --skip-checksum", filepath.Base(imagePath), filepath.Base(imagePath))
+		case err != nil:
+			return fmt.Errorf("cannot read the checksum: %w", err)
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		if scanner.Scan() {
+			if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+				expected = strings.ToLower(fields[0])
+			}
+		}
+	}
+	if expected != actual {
+		return fmt.Errorf("the checksum of %q does not match, nothing was uploaded: expected %s, got %s", filepath.Base(imagePath), expected, actual)
+	}
+	return nil
+}
@@ -1,22 +1,46 @@
 package app
 
-import "github.com/keskad/loco/pkgs/commandstation"
+import (
+	"time"
 
-func (app *LocoApp) SendFnAction(mode string, locoId uint8, fnNum int, toggle bool) error {
+	"github.com/keskad/loco/pkgs/commandstation"
+)
+
+// SendFnAction switches the function on or off, or toggles it. The command is sent repeat more times.
+// timeout and retries apply to the questions asked to the station on the way, e.g. about the other functions of the group.
+func (app *LocoApp) SendFnAction(mode string, locoId uint8, fnNum int, action commandstation.FnAction, repeat uint8, timeout time.Duration, retries uint8) error {
+	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
+		return cmdErr
+	}
+	defer app.station.CleanUp()
+	if commandstation.Mode(mode) == commandstation.MainTrackMode {
+		if err := app.takeOver(locoId, timeout, retries); err != nil {
+			return err
+		}
+	}
+	return app.station.SendFn(commandstation.Mode(mode), commandstation.LocoAddr(locoId), commandstation.FuncNum(fnNum), action,
+		commandstation.Repeat(repeat), commandstation.Timeout(timeout), commandstation.Retries(retries))
+}
+
+// SendBinaryStateAction switches a DCC binary state, e.g. a lighting scenario of a sound decoder beyond F31
+func (app *LocoApp) SendBinaryStateAction(locoId uint8, state uint16, on bool, repeat uint8, timeout time.Duration, retries uint8) error {
 	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
 		return cmdErr
 	}
 	defer app.station.CleanUp()
-	return app.station.SendFn(commandstation.Mode(mode), commandstation.LocoAddr(locoId), commandstation.FuncNum(fnNum), toggle)
+	if err := app.takeOver(locoId, timeout, retries); err != nil {
+		return err
+	}
+	return app.station.SendBinaryState(commandstation.LocoAddr(locoId), state, on, commandstation.Repeat(repeat))
 }
 
-func (app *LocoApp) ListFnAction(locoId uint8) error {
+func (app *LocoApp) ListFnAction(locoId uint8, timeout time.Duration, retries uint8) error {
 	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
 		return cmdErr
 	}
 	defer app.station.CleanUp()
 
-	activeFunctions, err := app.station.ListFunctions(commandstation.LocoAddr(locoId))
+	activeFunctions, err := app.station.ListFunctions(commandstation.LocoAddr(locoId), commandstation.Timeout(timeout), commandstation.Retries(retries))
 	if err != nil {
 		return err
 	}
@@ -29,6 +53,9 @@ func (app *LocoApp) ListFnAction(locoId uint8) error {
 			app.P.Printf("F%d = On\n", fnNum)
 		}
 	}
+	if note := app.controlNote(locoId, timeout, retries); note != "" {
+		app.P.Printf("Locomotive %d is%s\n", locoId, note)
+	}
 
 	return nil
 }
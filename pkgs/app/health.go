@@ -0,0 +1,159 @@
+package app
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: health and readiness probes of the long-running monitor, for systemd, containers and monitoring.
+// /healthz only tells the process is alive, /readyz tells whether every station is connected,
+// its broadcast subscription is renewed and it keeps sending packets.
+//
+
+// DefaultMaxSilence is how long a station may stay silent until it is reported as not ready
+const DefaultMaxSilence = 2 * time.Minute
+
+// stationHealth is updated by the monitor, read by the probes. A nil stationHealth ignores the updates.
+type stationHealth struct {
+	mu           sync.Mutex
+	connected    bool
+	subscribedAt time.Time
+	lastPacketAt time.Time
+}
+
+func (s *stationHealth) setConnected(connected bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = connected
+}
+
+func (s *stationHealth) subscribed(at time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribedAt = at
+}
+
+func (s *stationHealth) packetReceived(at time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastPacketAt = at
+}
+
+// stationReadiness is the /readyz report of a single station
+type stationReadiness struct {
+	Ready      bool    `json:"ready"`
+	Connected  bool    `json:"connected"`
+	Subscribed bool    `json:"subscribed"`
+	LastPacket float64 `json:"last_packet_age_seconds"` // -1 when nothing was received yet
+	Reason     string  `json:"reason,omitempty"`
+}
+
+// healthProbes serves /healthz and /readyz
+type healthProbes struct {
+	stations map[string]*stationHealth
+	// maxSilence is the longest allowed time without a packet, maxSubscriptionAge the longest time since the last renewal
+	maxSilence         time.Duration
+	maxSubscriptionAge time.Duration
+	started            time.Time
+	now                func() time.Time
+}
+
+func newHealthProbes(maxSilence time.Duration) *healthProbes {
+	if maxSilence <= 0 {
+		maxSilence = DefaultMaxSilence
+	}
+	return &healthProbes{
+		stations:           map[string]*stationHealth{},
+		maxSilence:         maxSilence,
+		maxSubscriptionAge: 2 * monitorKeepAlive,
+		started:            time.Now(),
+		now:                time.Now,
+	}
+}
+
+// station registers a station, it has to be called before the probes are served
+func (h *healthProbes) station(name string) *stationHealth {
+	health := &stationHealth{}
+	h.stations[name] = health
+	return health
+}
+
+func (h *healthProbes) readiness(s *stationHealth) stationReadiness {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := h.now()
+	report := stationReadiness{
+		Connected:  s.connected,
+		Subscribed: !s.subscribedAt.IsZero() && now.Sub(s.subscribedAt) <= h.maxSubscriptionAge,
+		LastPacket: -1,
+	}
+	// the silence is counted from the start until the first packet arrives
+	lastPacketAt := h.started
+	if !s.lastPacketAt.IsZero() {
+		lastPacketAt = s.lastPacketAt
+		report.LastPacket = now.Sub(s.lastPacketAt).Round(time.Millisecond).Seconds()
+	}
+	switch {
+	case !report.Connected:
+		report.Reason = "not connected"
+	case !report.Subscribed:
+		report.Reason = "broadcast subscription was not renewed"
+	case now.Sub(lastPacketAt) > h.maxSilence:
+		report.Reason = "the station is silent for longer than " + h.maxSilence.String()
+	default:
+		report.Ready = true
+	}
+	return report
+}
+
+func (h *healthProbes) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		report := map[string]stationReadiness{}
+		status := http.StatusOK
+		for name, station := range h.stations {
+			report[name] = h.readiness(station)
+			if !report[name].Ready {
+				status = http.StatusServiceUnavailable
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(report)
+	})
+	return mux
+}
+
+// serve runs the probes on listen until the returned server is closed
+func (h *healthProbes) serve(listen string) (*http.Server, error) {
+	server := &http.Server{Addr: listen, Handler: h.handler(), ReadHeaderTimeout: 5 * time.Second}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("health probes: %s", err)
+		}
+	}()
+	return server, nil
+}
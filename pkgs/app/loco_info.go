@@ -0,0 +1,35 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// LocoInfoAction prints the locomotive described by loco.json of the current directory
+func (app *LocoApp) LocoInfoAction() error {
+	loco := app.Config.Loco
+	if loco.LocoAddr == 0 && loco.Name == "" && loco.DecoderType == "" {
+		return errors.New("no locomotive, the current directory has no loco.json")
+	}
+	_, _ = app.P.Printf("name:         %s\n", orUnknown(loco.Name))
+	_, _ = app.P.Printf("address:      %d\n", loco.LocoAddr)
+	_, _ = app.P.Printf("class:        %s\n", orUnknown(loco.Class))
+	_, _ = app.P.Printf("era:          %s\n", orUnknown(loco.Era))
+	_, _ = app.P.Printf("owner:        %s\n", orUnknown(loco.Owner))
+	_, _ = app.P.Printf("decoder:      %s\n", orUnknown(loco.DecoderType))
+	if loco.Image == "" {
+		return nil
+	}
+	image, err := filepath.Abs(loco.Image)
+	if err != nil {
+		return fmt.Errorf("cannot resolve the image %q: %w", loco.Image, err)
+	}
+	if _, err := os.Stat(image); err != nil {
+		_, _ = app.P.Printf("image:        %s (missing)\n", image)
+		return nil
+	}
+	_, _ = app.P.Printf("image:        %s\n", image)
+	return nil
+}
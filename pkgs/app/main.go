@@ -2,10 +2,14 @@ package app
 
 import (
 	"fmt"
+	"io"
+	"strings"
+	"time"
 
 	"github.com/keskad/loco/pkgs/output"
 
 	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
 	"github.com/keskad/loco/pkgs/config"
 	"github.com/sirupsen/logrus"
 )
@@ -23,7 +27,15 @@ type LocoApp struct {
 
 	// runtime parameters
 	Debug bool
-	P     output.Printer
+	// DryRun prints packets instead of sending them to the command station
+	DryRun bool
+	// Steal takes over locomotives driven by another device, see takeOver
+	Steal bool
+	// SessionLog is a file where all the traffic with a Z21 is recorded, see "loco replay"
+	SessionLog string
+	P          output.Printer
+	// In is where the answers to interactive questions are read from, stdin when nil
+	In io.Reader
 }
 
 // Initialize is running after parsing the arguments, so we know how to configure the app
@@ -43,17 +55,77 @@ func (app *LocoApp) Initialize() error {
 	return nil
 }
 
+// requestDefaults translates the configured request policy into station defaults
+func requestDefaults(server config.Server) []commandstation.RequestOption {
+	return []commandstation.RequestOption{
+		commandstation.Retries(server.Retries),
+		commandstation.RetryDelay(time.Millisecond * time.Duration(server.RetryDelay)),
+		commandstation.Settle(time.Millisecond * time.Duration(server.Settle)),
+		commandstation.Repeat(server.Repeat),
+		commandstation.RepeatInterval(time.Millisecond * time.Duration(server.RepeatInterval)),
+	}
+}
+
 func (app *LocoApp) initializeCommandStation() error {
 	// initialize Command Station communication
 	logrus.Debug("Initializing command station")
-	if app.Config.Server.Type == "z21" {
-		cmd, cmdErr := commandstation.NewZ21Roco(app.Config.Server.Address, app.Config.Server.Port)
-		app.station = cmd
-		if cmdErr != nil {
-			return fmt.Errorf("cannot initialize app: %s", cmdErr)
-		}
-	} else {
-		return fmt.Errorf("unknown command station type '%s'", app.Config.Server.Type)
+	cmd, cmdErr := app.openStation(app.Config.Server)
+	if cmdErr != nil {
+		return fmt.Errorf("cannot initialize app: %w", cmdErr)
 	}
+	app.station = cmd
 	return nil
 }
+
+// openStation opens a station profile with the backend registered for its type, see commandstation.Register
+func (app *LocoApp) openStation(server config.Server) (commandstation.Station, error) {
+	backend, ok := commandstation.Lookup(server.Type)
+	if !ok {
+		return nil, fmt.Errorf("unknown command station type '%s', known types: %s", server.Type, strings.Join(commandstation.Backends(), ", "))
+	}
+	backendConfig := backend.Config()
+	if err := server.Decode(backendConfig); err != nil {
+		return nil, err
+	}
+	env := commandstation.Environment{Defaults: requestDefaults(server), SessionLog: app.SessionLog}
+	if app.DryRun {
+		env.DryRun = app.printDryRunPacket
+	}
+	return backend.Open(backendConfig, env)
+}
+
+// printDryRunPacket describes a packet that would be sent, in debug mode the raw bytes are shown too
+// so they can be passed to the vendor support
+func (app *LocoApp) printDryRunPacket(packet []byte) {
+	_, _ = app.P.Printf("[dry-run] %s\n", z21proto.Annotate(packet))
+	if app.Debug {
+		_, _ = app.P.Printf("[dry-run]   % X\n", packet)
+	}
+}
+
+// preflight checks the command station before a batch of operations, so the batch is not abandoned in its middle.
+// Only a Z21 can be asked, the other stations are assumed to be ready.
+func (app *LocoApp) preflight(mode commandstation.Mode, timeout time.Duration) error {
+	z21, ok := app.station.(*commandstation.Z21Roco)
+	if !ok {
+		return nil
+	}
+	if err := z21.Preflight(mode, timeout); err != nil {
+		return fmt.Errorf("nothing was changed: %w", err)
+	}
+	return nil
+}
+
+// z21Station initializes the command station and returns it as Z21, for features that exist only in the Z21 protocol.
+// For other stations an ErrNotSupported with the given capability and reason is returned.
+func (app *LocoApp) z21Station(capability commandstation.Capability, reason string) (*commandstation.Z21Roco, error) {
+	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
+		return nil, cmdErr
+	}
+	z21, ok := app.station.(*commandstation.Z21Roco)
+	if !ok {
+		app.station.CleanUp()
+		return nil, commandstation.NotSupported(capability, reason)
+	}
+	return z21, nil
+}
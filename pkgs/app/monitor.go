@@ -0,0 +1,204 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+)
+
+// monitorKeepAlive is shorter than the 60 seconds after which Z21 forgets a silent client
+const monitorKeepAlive = 30 * time.Second
+
+// monitorBroadcasts are the broadcasts the monitor subscribes to
+const monitorBroadcasts = z21proto.BroadcastDrivingSwitching | z21proto.BroadcastRMBus | z21proto.BroadcastRailCom | z21proto.BroadcastSystemState
+
+// Output formats of the monitor
+const (
+	MonitorText = "text"
+	MonitorHex  = "hex"
+	MonitorJSON = "json"
+)
+
+// monitorRecord is a single line of the JSON output
+type monitorRecord struct {
+	Time        time.Time        `json:"time"`
+	Station     string           `json:"station"`
+	Name        string           `json:"name,omitempty"`
+	Description string           `json:"description"`
+	Raw         string           `json:"raw"`
+	Message     z21proto.Message `json:"message,omitempty"`
+	Error       string           `json:"error,omitempty"`
+}
+
+// MonitorAction prints every packet received from one or more stations until interrupted.
+// Stations are profile names from the configuration file, an empty list means the default server.
+// With multiple stations every text line is prefixed with the profile name.
+// format is one of MonitorText, MonitorHex or MonitorJSON (one object per line).
+// allLocos subscribes to LAN_X_LOCO_INFO of all locomotives, not only the ones this client asked for.
+// healthListen other than "" serves /healthz and /readyz on that address, a station silent for longer than maxSilence is not ready.
+func (app *LocoApp) MonitorAction(stations []string, format string, allLocos bool, healthListen string, maxSilence time.Duration) error {
+	if len(stations) == 0 {
+		stations = []string{"default"}
+	}
+	switch format {
+	case MonitorText, MonitorHex, MonitorJSON:
+	default:
+		return fmt.Errorf("invalid output format: %s. Must be one of 'text', 'hex' or 'json'", format)
+	}
+	broadcasts := monitorBroadcasts
+	if allLocos {
+		broadcasts |= z21proto.BroadcastAllLocoInfo
+	}
+
+	probes := newHealthProbes(maxSilence)
+	var printMu sync.Mutex
+	stop := make(chan struct{})
+	errs := make(chan error, len(stations))
+	var wg sync.WaitGroup
+	var opened []commandstation.Station
+	// on every return, also when a later station cannot be opened, the stations already listened to are stopped
+	defer func() {
+		close(stop)
+		wg.Wait()
+		for _, station := range opened {
+			_ = station.CleanUp()
+		}
+	}()
+
+	for _, name := range stations {
+		profile, err := app.Config.Station(name)
+		if err != nil {
+			return err
+		}
+		backend, err := app.openStation(profile)
+		if err != nil {
+			return fmt.Errorf("station '%s': %w", name, err)
+		}
+		opened = append(opened, backend)
+		station, ok := backend.(*commandstation.Z21Roco)
+		if !ok {
+			return fmt.Errorf("station '%s': %w", name, commandstation.NotSupported(commandstation.CapabilityMonitor,
+				fmt.Sprintf("monitor is supported only for z21, not '%s'", profile.Type)))
+		}
+
+		prefix := ""
+		if len(stations) > 1 {
+			prefix = fmt.Sprintf("[%s] ", name)
+		}
+		var health *stationHealth
+		if healthListen != "" {
+			health = probes.station(name)
+		}
+		health.setConnected(true)
+		station.OnRecord(func(record []byte) {
+			health.packetReceived(time.Now())
+			line := formatMonitorRecord(format, time.Now(), name, prefix, record)
+			printMu.Lock()
+			defer printMu.Unlock()
+			_, _ = app.P.Printf("%s\n", line)
+		})
+
+		wg.Add(1)
+		go func(name string, station *commandstation.Z21Roco) {
+			defer wg.Done()
+			defer health.setConnected(false)
+			if err := app.monitorStation(station, broadcasts, stop, health); err != nil {
+				errs <- fmt.Errorf("station '%s': %w", name, err)
+			}
+		}(name, station)
+	}
+
+	if healthListen != "" {
+		server, err := probes.serve(healthListen)
+		if err != nil {
+			return fmt.Errorf("cannot serve health probes: %w", err)
+		}
+		defer server.Close()
+		logrus.Infof("health probes on http://%s/healthz and /readyz", healthListen)
+	}
+
+	// SIGTERM is how systemd and container runtimes stop the monitor
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	var result error
+	select {
+	case <-interrupt:
+		logrus.Debug("monitor: interrupted")
+	case result = <-errs:
+	}
+	return result
+}
+
+// formatMonitorRecord renders a single received packet in the selected output format
+func formatMonitorRecord(format string, at time.Time, station, prefix string, record []byte) string {
+	switch format {
+	case MonitorHex:
+		return fmt.Sprintf("%s %s% X", at.Format("15:04:05.000"), prefix, record)
+	case MonitorJSON:
+		out := monitorRecord{Time: at, Station: station, Raw: fmt.Sprintf("% X", record)}
+		if msg, err := z21proto.Decode(record); err != nil {
+			out.Description = z21proto.Annotate(record)
+			out.Error = err.Error()
+		} else {
+			out.Name = z21proto.Name(msg)
+			out.Description = z21proto.Describe(msg)
+			out.Message = msg
+		}
+		encoded, err := json.Marshal(out)
+		if err != nil {
+			return fmt.Sprintf(`{"error": %q}`, err.Error())
+		}
+		return string(encoded)
+	}
+	return fmt.Sprintf("%s %s%s", at.Format("15:04:05.000"), prefix, z21proto.Annotate(record))
+}
+
+// monitorStation keeps the broadcast subscription alive and reads until stop is closed.
+// health may be nil, otherwise every renewal of the subscription is reported and the system state is polled with it,
+// so a healthy station is never silent for longer than monitorKeepAlive.
+func (app *LocoApp) monitorStation(station *commandstation.Z21Roco, broadcasts z21proto.BroadcastFlags, stop chan struct{}, health *stationHealth) error {
+	if err := station.Subscribe(broadcasts); err != nil {
+		return fmt.Errorf("cannot subscribe to broadcasts: %w", err)
+	}
+	health.subscribed(time.Now())
+	if health != nil {
+		if err := station.PollSystemState(); err != nil {
+			return fmt.Errorf("cannot poll the system state: %w", err)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(monitorKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := station.Subscribe(broadcasts); err != nil {
+					logrus.Warnf("monitor: cannot renew the subscription: %s", err)
+					continue
+				}
+				health.subscribed(time.Now())
+				if health != nil {
+					if err := station.PollSystemState(); err != nil {
+						logrus.Warnf("monitor: cannot poll the system state: %s", err)
+					}
+				}
+			}
+		}
+	}()
+
+	return station.Listen(stop)
+}
@@ -1,11 +1,13 @@
 package app
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
 	"sort"
 
+	"github.com/keskad/loco/pkgs/decoders"
 	"github.com/keskad/loco/pkgs/syntax/outputmap"
 )
 
@@ -60,6 +62,85 @@ func (app *LocoApp) PrintOutputsAction(mapFile string) error {
 	return nil
 }
 
+// ApplyOutputsAction writes the AUX output mapping file at mapFile to the decoder. The RB23xx keeps its
+// mapping in a file and not in CVs, so the checked file is uploaded as it is, with its role comments,
+// and read back. The mapping lines added and removed against the decoder are printed first.
+func (app *LocoApp) ApplyOutputsAction(mapFile string, dryRun bool, opts ...decoders.Option) error {
+	data, err := os.ReadFile(mapFile)
+	if err != nil {
+		return fmt.Errorf("cannot open map file %q: %w", mapFile, err)
+	}
+	entries, err := outputmap.ParseEntries(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("cannot parse map file %q: %w", mapFile, err)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("map file %q has no mapping lines", mapFile)
+	}
+
+	rb, err := app.decoder(opts...)
+	if err != nil {
+		return err
+	}
+	current, err := rb.DownloadOutputMap()
+	if err != nil && !errors.Is(err, decoders.ErrNoOutputMap) {
+		return fmt.Errorf("cannot read the output map of the decoder: %w", err)
+	}
+	if bytes.Equal(current, data) {
+		_, _ = app.P.Printf("the decoder already has this output map\n")
+		return nil
+	}
+	// a map the decoder holds but cannot be parsed is replaced as a whole
+	currentEntries, parseErr := outputmap.ParseEntries(bytes.NewReader(current))
+	if parseErr != nil {
+		_, _ = app.P.Printf("replace:      the current map of the decoder cannot be parsed: %s\n", parseErr)
+		currentEntries = nil
+	}
+	added, removed := diffOutputEntries(currentEntries, entries)
+	for _, entry := range added {
+		_, _ = app.P.Printf("add:          %s\n", entry)
+	}
+	for _, entry := range removed {
+		_, _ = app.P.Printf("remove:       %s\n", entry)
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		_, _ = app.P.Printf("unchanged:    only the comments differ\n")
+	}
+	if dryRun {
+		_, _ = app.P.Printf("[dry-run] the output map was not written\n")
+		return nil
+	}
+
+	if err := rb.UploadOutputMap(data); err != nil {
+		return err
+	}
+	_, _ = app.P.Printf("output map:   %d mapping line(s) written and verified\n", len(entries))
+	return nil
+}
+
+// diffOutputEntries returns the mapping lines of next missing in current, and the ones of current missing in next
+func diffOutputEntries(current []outputmap.OutputEntry, next []outputmap.OutputEntry) (added []outputmap.OutputEntry, removed []outputmap.OutputEntry) {
+	in := func(entries []outputmap.OutputEntry, entry outputmap.OutputEntry) bool {
+		for _, e := range entries {
+			if e == entry {
+				return true
+			}
+		}
+		return false
+	}
+	for _, entry := range next {
+		if !in(current, entry) && !in(added, entry) {
+			added = append(added, entry)
+		}
+	}
+	for _, entry := range current {
+		if !in(next, entry) && !in(removed, entry) {
+			removed = append(removed, entry)
+		}
+	}
+	return added, removed
+}
+
 // formatOutputList renders a slice of output numbers as "O1, O3, O6" or "(none)".
 func formatOutputList(outputs []uint8) string {
 	if len(outputs) == 0 {
@@ -0,0 +1,125 @@
+package app
+
+import (
+	"bufio"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/syntax"
+)
+
+//
+// Context: service mode switches the main track off until the command station is told to power it again.
+// The session keeps a single connection for many commands and always leaves with the track powered,
+// also when the user walks away from the terminal.
+//
+
+const progSessionPrompt = "prog> "
+
+const progSessionHelp = `Commands:
+  get CVS    read CVs, e.g. "get cv1, cv29"
+  set CVS    write CVs, e.g. "set cv1=3, cv29=6"
+  help       show this help
+  exit       leave the session and restore the track power
+`
+
+// ProgSessionAction runs programming track commands typed on the input until the user exits, the input ends,
+// nothing is typed for idle or the session lasted max. The track power is restored when the session ends.
+func (app *LocoApp) ProgSessionAction(max, idle time.Duration, timeout time.Duration, retries uint8) error {
+	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
+		return cmdErr
+	}
+	defer app.station.CleanUp()
+	session := commandstation.BeginProgSession(app.station)
+	defer app.endProgSession(session)
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(app.input())
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	deadline := time.NewTimer(max)
+	defer deadline.Stop()
+	inactivity := time.NewTimer(idle)
+	defer inactivity.Stop()
+
+	_, _ = app.P.Printf("programming session: ends after %s, or %s without a command. Type help for commands.\n", max, idle)
+	for {
+		_, _ = app.P.Printf(progSessionPrompt)
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				_, _ = app.P.Printf("\nprogramming session ended, restoring the track power\n")
+				return nil
+			}
+			if done := app.progSessionCommand(session, strings.TrimSpace(line), timeout, retries); done {
+				_, _ = app.P.Printf("programming session ended, restoring the track power\n")
+				return nil
+			}
+			inactivity.Reset(idle)
+		case <-inactivity.C:
+			_, _ = app.P.Printf("\nprogramming session ended: no command for %s, restoring the track power\n", idle)
+			return nil
+		case <-deadline.C:
+			_, _ = app.P.Printf("\nprogramming session ended: the limit of %s was reached, restoring the track power\n", max)
+			return nil
+		case <-interrupt:
+			_, _ = app.P.Printf("\nprogramming session interrupted, restoring the track power\n")
+			return nil
+		}
+	}
+}
+
+// progSessionCommand runs a single line of the session, errors are printed so the session goes on. It returns true on exit.
+func (app *LocoApp) progSessionCommand(session *commandstation.ProgSession, line string, timeout time.Duration, retries uint8) bool {
+	command, argument, _ := strings.Cut(line, " ")
+	switch strings.ToLower(command) {
+	case "":
+	case "exit", "quit":
+		return true
+	case "help":
+		_, _ = app.P.Printf(progSessionHelp)
+	case "get":
+		entries, err := syntax.ParseCVString(argument, ",")
+		if err != nil {
+			_, _ = app.P.Printf("error: %s\n", err)
+			return false
+		}
+		for _, entry := range entries {
+			value, err := session.ReadCV(commandstation.CVNum(entry.Number), commandstation.Timeout(timeout), commandstation.Retries(retries))
+			if err != nil {
+				_, _ = app.P.Printf("cv%d=ERROR (%s)\n", entry.Number, err)
+				continue
+			}
+			_, _ = app.P.Printf("cv%d=%d\n", entry.Number, value)
+		}
+	case "set":
+		entries, err := syntax.ParseCVString(argument, ",", syntax.Strict(true))
+		if err != nil {
+			_, _ = app.P.Printf("error: %s\n", err)
+			return false
+		}
+		for _, entry := range entries {
+			if err := session.WriteCV(commandstation.CV{Num: commandstation.CVNum(entry.Number), Value: int(entry.Value)}, commandstation.Timeout(timeout)); err != nil {
+				_, _ = app.P.Printf("error: cannot write cv%d: %s\n", entry.Number, err)
+				return false
+			}
+			_, _ = app.P.Printf("cv%d=%d written\n", entry.Number, entry.Value)
+		}
+	default:
+		_, _ = app.P.Printf("unknown command %q, type help for commands\n", command)
+	}
+	return false
+}
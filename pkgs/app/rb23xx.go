@@ -1,10 +1,17 @@
 package app
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -18,11 +25,14 @@ const wifiCV = 200
 
 // RBWifiAction reads CV200 to determine which function number controls the WiFi router,
 // then enables or disables that function on the decoder.
-func (app *LocoApp) RBWifiAction(mode string, locoId uint8, enable bool, timeout time.Duration) error {
+func (app *LocoApp) RBWifiAction(mode string, locoId uint8, enable bool, timeout time.Duration, retries uint8) error {
 	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
 		return cmdErr
 	}
 	defer app.station.CleanUp()
+	if err := app.preflight(commandstation.Mode(mode), timeout); err != nil {
+		return err
+	}
 
 	// Read CV200 to find the function number assigned to the WiFi router
 	fnNum, err := app.station.ReadCV(commandstation.Mode(mode), commandstation.LocoCV{
@@ -30,7 +40,7 @@ func (app *LocoApp) RBWifiAction(mode string, locoId uint8, enable bool, timeout
 		Cv: commandstation.CV{
 			Num: commandstation.CVNum(wifiCV),
 		},
-	}, commandstation.Timeout(timeout))
+	}, commandstation.Timeout(timeout), commandstation.Retries(retries))
 	if err != nil {
 		return fmt.Errorf("failed to read CV%d (WiFi function number): %w", wifiCV, err)
 	}
@@ -38,207 +48,737 @@ func (app *LocoApp) RBWifiAction(mode string, locoId uint8, enable bool, timeout
 	logrus.Debugf("CV%d = %d, toggling F%d to enabled=%v", wifiCV, fnNum, fnNum, enable)
 
 	// Send the function command
-	return app.station.SendFn(commandstation.Mode(mode), commandstation.LocoAddr(locoId), commandstation.FuncNum(fnNum), enable)
+	return app.station.SendFn(commandstation.Mode(mode), commandstation.LocoAddr(locoId), commandstation.FuncNum(fnNum), commandstation.FnSwitch(enable),
+		commandstation.Timeout(timeout), commandstation.Retries(retries))
+}
+
+// decoder returns the client of the decoder of the locomotive, its type is the DecoderType of loco.json.
+// It is reached at the configured address, opts may override it.
+func (app *LocoApp) decoder(opts ...decoders.Option) (decoders.Decoder, error) {
+	decoderType := ""
+	if app.Config != nil {
+		decoderType = app.Config.Loco.DecoderType
+		// the options of the command come last and win
+		var configured []decoders.Option
+		if app.Config.Loco.DecoderAddress != "" {
+			configured = append(configured, decoders.WithBaseURL(app.Config.Loco.DecoderAddress))
+		}
+		if app.Config.Loco.DecoderUsername != "" {
+			configured = append(configured, decoders.WithCredentials(app.Config.Loco.DecoderUsername, app.Config.Loco.DecoderPassword))
+		}
+		if app.Config.Loco.DecoderToken != "" {
+			configured = append(configured, decoders.WithToken(app.Config.Loco.DecoderToken))
+		}
+		opts = append(configured, opts...)
+	}
+	return decoders.New(decoderType, opts...)
 }
 
 func (app *LocoApp) ClearSoundSlot(slot uint8, opts ...decoders.Option) error {
-	rb := decoders.NewRailboxRB23xx(opts...)
+	rb, err := app.decoder(opts...)
+	if err != nil {
+		return err
+	}
 	return rb.ClearSoundSlot(slot)
 }
 
-// SyncSoundSlot synchronises a local directory with the given sound slot on the decoder:
-//   - files present locally but missing on the decoder are uploaded
-//   - files present on the decoder but missing locally are deleted from the decoder
-//   - files present on both sides but differing in size (KB) are re-uploaded
-//   - unless syncWithoutLast is true, the 5 most recently modified local files
-//     (modified within the last 24 h) are always re-uploaded
-//
-// When dryRun is true, no changes are made – only a summary is printed.
-func (app *LocoApp) SyncSoundSlot(slot uint8, localDir string, dryRun bool, syncWithoutLast bool, opts ...decoders.Option) error {
-	rb := decoders.NewRailboxRB23xx(opts...)
-
-	if dryRun {
-		_, _ = app.P.Printf("[dry-run] no changes will be made\n")
+// SoundSlotsAction prints every sound slot of the decoder with the number of its files and their total size,
+// followed by the space of the decoder storage when the firmware reports it
+func (app *LocoApp) SoundSlotsAction(opts ...decoders.Option) error {
+	rb, err := app.decoder(opts...)
+	if err != nil {
+		return err
 	}
-
-	// --- build map of local files: name → size in bytes ---
-	entries, err := os.ReadDir(localDir)
+	slots, err := rb.ListSoundSlotNumbers()
 	if err != nil {
-		return fmt.Errorf("cannot read local directory %q: %w", localDir, err)
+		return fmt.Errorf("cannot list the sound slots on decoder: %w", err)
 	}
-	type localInfo struct {
-		sizeBytes int64
-		modTime   time.Time
+	if len(slots) == 0 {
+		_, _ = app.P.Printf("no sound slots on the decoder\n")
+		return nil
 	}
-	localFiles := make(map[string]localInfo, len(entries))
-	for _, e := range entries {
-		if e.IsDir() {
+	_, _ = app.P.Printf("slot  files      size\n")
+	for _, slot := range slots {
+		files, err := rb.ListSoundSlot(slot)
+		if err != nil {
+			return fmt.Errorf("cannot list slot %d on decoder: %w", slot, err)
+		}
+		if len(files) == 0 {
+			_, _ = app.P.Printf("%4d  %5d     empty\n", slot, 0)
 			continue
 		}
-		fi, statErr := e.Info()
-		if statErr != nil {
-			return fmt.Errorf("cannot stat %q: %w", e.Name(), statErr)
+		var sizeKB int64
+		for _, file := range files {
+			sizeKB += file.SizeKB
 		}
-		localFiles[e.Name()] = localInfo{sizeBytes: fi.Size(), modTime: fi.ModTime()}
+		_, _ = app.P.Printf("%4d  %5d  %5d KB\n", slot, len(files), sizeKB)
 	}
 
-	// --- determine the set of "recently modified" files to always re-upload ---
-	// Up to 5 local files modified within the last 24 h, sorted newest-first.
-	recentlyModified := make(map[string]bool)
-	if !syncWithoutLast {
-		cutoff := time.Now().Add(-24 * time.Hour)
+	storage, err := rb.Storage()
+	if errors.Is(err, decoders.ErrStorageUnknown) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read the storage space of the decoder: %w", err)
+	}
+	_, _ = app.P.Printf("storage: %s used of %s, %s free\n", formatSize(storage.Used), formatSize(storage.Total), formatSize(storage.Free()))
+	return nil
+}
 
-		type nameTime struct {
-			name    string
-			modTime time.Time
+// SyncSoundSlot synchronises a local directory with the given sound slot on the decoder, in the given direction.
+// With SyncPush:
+//   - files present locally but missing on the decoder are uploaded
+//   - files present on the decoder but missing locally are deleted from the decoder, unless they are protected,
+//     see loadSyncProtection, and options.Force is not set
+//   - files present on both sides are re-uploaded when the local file changed since its last transfer,
+//     by its SHA-256 checksum, or the decoder lists another size than it did then
+//   - files not transferred by this machine yet are re-uploaded when they differ in size (KB)
+//   - a file missing locally whose content is found under a new local name is renamed, see syncRenames,
+//     in place by a decoders.SoundRenamer, otherwise by an upload and a delete
+//
+// SyncPull downloads the files missing or differing locally instead, SyncBoth copies the missing files both ways
+// and keeps the newer version of a changed file, see syncReason. Neither of them deletes anything.
+//
+// With decoders.WithResumableUploads large files are sent in chunks, an upload interrupted by a dropped WiFi
+// connection is continued by the next sync, as long as the local file did not change.
+//
+// The files are transferred by options.Parallel workers, a failed transfer does not stop the others
+// and all the errors are returned together. The uploads are checked in a new listing of the slot, see checkUploads.
+// The orphaned files are deleted only when every upload succeeded. Nothing is transferred when the uploads
+// do not fit in the free space of the decoder, see checkStorage.
+//
+// With options.Transcoder the sound files in another format than decoders.SOUND_FORMAT are converted
+// before the upload, see transcodeLocalFiles.
+//
+// Only one sync of a directory and of a slot runs at a time, see lockSync.
+//
+// An optional slot.yaml manifest of the directory is validated before anything is uploaded and is synchronised
+// like the sounds, see slotManifest.
+//
+// What is going to change is decided before any transfer and is returned as a SyncPlan, also when the sync fails
+// after the plan was made. When options.DryRun is true, no changes are made – only the plan is reported.
+// Progress is reported as SyncEvents to the progress callback, a nil callback prints them to the console.
+func (app *LocoApp) SyncSoundSlot(slot uint8, localDir string, options SyncOptions, progress SyncProgressFunc, opts ...decoders.Option) (plan *SyncPlan, err error) {
+	rb, err := app.decoder(opts...)
+	if err != nil {
+		return plan, err
+	}
+	if progress == nil {
+		progress = app.printSyncEvent
+	}
+	if !options.DryRun {
+		lock, lockErr := app.lockSync(rb, slot, localDir)
+		if lockErr != nil {
+			return plan, lockErr
 		}
-		var candidates []nameTime
-		for name, info := range localFiles {
-			if info.modTime.After(cutoff) {
-				candidates = append(candidates, nameTime{name, info.modTime})
+		defer lock.release()
+	}
+
+	state, err := loadSyncState(localDir)
+	if err != nil {
+		return plan, err
+	}
+	synced := state.slot(slot)
+	if !options.DryRun {
+		// the transfers done before a failure are remembered too
+		defer func() {
+			if saveErr := state.save(localDir); saveErr != nil && err == nil {
+				err = saveErr
 			}
+		}()
+	}
+
+	ignore, err := loadSyncIgnore(localDir, options.Exclude)
+	if err != nil {
+		return plan, err
+	}
+	var protected *syncIgnore
+	if options.Direction == SyncPush {
+		if protected, err = loadSyncProtection(localDir, options.Keep); err != nil {
+			return plan, err
 		}
-		sort.Slice(candidates, func(i, j int) bool {
-			return candidates[i].modTime.After(candidates[j].modTime)
-		})
-		if len(candidates) > 5 {
-			candidates = candidates[:5]
+	}
+
+	// --- build map of local files: name on the decoder → size in bytes ---
+	localFiles, err := listSyncLocalFiles(localDir, ignore)
+	if err != nil {
+		return plan, err
+	}
+	if options.Direction != SyncPull {
+		if options.Lint {
+			if err := checkSoundNames(localDir, options.Exclude); err != nil {
+				return plan, err
+			}
 		}
-		for _, c := range candidates {
-			recentlyModified[c.name] = true
+		if err := checkSlotManifest(localDir, localFiles); err != nil {
+			return plan, err
 		}
-		if len(recentlyModified) > 0 {
-			logrus.Debugf("sync: %d recently modified file(s) will be force-uploaded (modified within last 24 h)", len(recentlyModified))
+	}
+	if options.Transcoder != nil && options.Direction != SyncPull {
+		if localFiles, err = app.transcodeLocalFiles(slot, localDir, localFiles, options, progress); err != nil {
+			return plan, err
 		}
 	}
 
+	// --- the checksums of the local files tell an edit keeping the size ---
+	for name, local := range localFiles {
+		if local.hash, err = local.checksum(localDir, name); err != nil {
+			return plan, err
+		}
+		localFiles[name] = local
+	}
+
 	// --- build map of remote files: name → size in KB ---
 	remoteList, err := rb.ListSoundSlot(slot)
 	if err != nil {
-		return fmt.Errorf("cannot list slot %d on decoder: %w", slot, err)
+		return plan, fmt.Errorf("cannot list slot %d on decoder: %w", slot, err)
 	}
 	remoteFiles := make(map[string]int64, len(remoteList))
+	var excluded []SyncPlanEntry
+	var lockKB int64
 	for _, info := range remoteList {
+		if info.Name == syncLockFile {
+			lockKB = info.SizeKB
+			continue
+		}
+		// an excluded file of the decoder is neither downloaded nor deleted as an orphan
+		if ignore.match(info.Name, false) {
+			logrus.Debugf("sync: %q on the decoder is excluded, left alone", info.Name)
+			excluded = append(excluded, SyncPlanEntry{File: info.Name, Reason: SyncReasonExcluded, RemoteSizeKB: info.SizeKB})
+			continue
+		}
 		remoteFiles[info.Name] = info.SizeKB
 	}
+	progress(SyncEvent{Kind: SyncScan, Slot: slot, DryRun: options.DryRun, LocalFiles: len(localFiles), RemoteFiles: len(remoteFiles)})
+	plan = newSyncPlan(slot, options)
+	plan.Skipped = append(plan.Skipped, excluded...)
 
-	// --- upload missing or changed files ---
-	changes := 0
-	for name, local := range localFiles {
-		remoteSizeKB, existsRemotely := remoteFiles[name]
-		if existsRemotely {
-			// decoder reports size in KB (1 KB = 1024 bytes); round up local size
-			localSizeKB := (local.sizeBytes + 1023) / 1024
-			diff := localSizeKB - remoteSizeKB
-			if diff < 0 {
-				diff = -diff
-			}
-			if diff <= 1 {
-				if recentlyModified[name] {
-					_, _ = app.P.Printf("recent:   %s (modified within last 24 h)\n", name)
-					logrus.Infof("sync: force-uploading %q – modified within last 24 h", name)
-				} else {
-					logrus.Debugf("sync: skipping %q (size within tolerance: local %d KB, remote %d KB)", name, localSizeKB, remoteSizeKB)
-					continue
-				}
+	// a record of a file that is on neither side anymore is not needed
+	for name := range synced {
+		_, existsLocally := localFiles[name]
+		_, existsRemotely := remoteFiles[name]
+		if !existsLocally && !existsRemotely {
+			delete(synced, name)
+		}
+	}
+	for name := range state.Partial[slot] {
+		if _, existsLocally := localFiles[name]; !existsLocally {
+			delete(state.Partial[slot], name)
+		}
+	}
+
+	names := make([]string, 0, len(localFiles)+len(remoteFiles))
+	for name := range localFiles {
+		names = append(names, name)
+	}
+	for name := range remoteFiles {
+		if _, exists := localFiles[name]; !exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// a renamed file is not deleted and sent again when the decoder renames it
+	renameSources := remoteFiles
+	if !options.Force {
+		renameSources = withoutProtected(remoteFiles, localFiles, protected)
+	}
+	renames := syncRenames(options.Direction, localFiles, renameSources, synced)
+	renamedFrom := make(map[string]bool, len(renames))
+	for _, from := range renames {
+		renamedFrom[from] = true
+	}
+	renamer, canRename := rb.(decoders.SoundRenamer)
+
+	// --- upload and download missing or changed files ---
+	// the records are updated by the transfers, from several workers
+	var stateMu sync.Mutex
+	var needBytes int64
+	var orphans []string
+	var items []syncItem
+	uploads := map[string]syncUpload{}
+	for _, name := range names {
+		var local *syncLocalFile
+		var remoteSizeKB *int64
+		var record *syncedFile
+		if info, ok := localFiles[name]; ok {
+			local = &info
+		}
+		if size, ok := remoteFiles[name]; ok {
+			remoteSizeKB = &size
+		}
+		if entry, ok := synced[name]; ok {
+			record = &entry
+		}
+
+		reason := syncReason(options.Direction, local, remoteSizeKB, record)
+		var resumeAt int64
+		if local != nil {
+			resumeAt = state.resumeOffset(slot, name, *local, remoteSizeKB)
+		}
+		if reason == SyncReasonRemoteChanged && local.path != "" {
+			// the converted copy cannot be turned back into the file of the directory
+			reason = SyncReasonConflict
+		}
+		if resumeAt > 0 && options.Direction == SyncPull {
+			// the file on the decoder is incomplete
+			reason = SyncReasonConflict
+		} else if resumeAt > 0 {
+			reason = SyncReasonResume
+		}
+		if renamedFrom[name] {
+			// planned with the new name
+			continue
+		}
+		from, renamed := renames[name]
+		if renamed {
+			reason = SyncReasonRename
+		}
+		if reason == SyncReasonOrphan && protected.match(name, false) {
+			if !options.Force {
+				reason = SyncReasonProtected
 			} else {
-				_, _ = app.P.Printf("changed:  %s (local %d KB, remote %d KB)\n", name, localSizeKB, remoteSizeKB)
-				logrus.Infof("sync: re-uploading %q (local %d KB, remote %d KB)", name, localSizeKB, remoteSizeKB)
+				logrus.Warnf("sync: deleting the protected %q, --force is given", name)
 			}
-		} else {
-			_, _ = app.P.Printf("upload:   %s\n", name)
-			logrus.Infof("sync: uploading new file %q to slot %d", name, slot)
 		}
+		entry := SyncPlanEntry{File: name, Reason: reason, From: from}
+		if local != nil {
+			entry.Source, entry.LocalSizeKB = local.rel, local.sizeKB()
+		}
+		if remoteSizeKB != nil {
+			entry.RemoteSizeKB = *remoteSizeKB
+		}
+		plan.add(entry)
+		if reason == SyncReasonOrphan {
+			orphans = append(orphans, name)
+			continue
+		}
+		item := syncItem{compared: SyncEvent{Kind: SyncCompare, Slot: slot, File: name, DryRun: options.DryRun, Reason: reason, From: from, LocalSizeKB: entry.LocalSizeKB, RemoteSizeKB: entry.RemoteSizeKB}}
+		items = append(items, item)
 
-		changes++
-		if dryRun {
+		switch reason {
+		case SyncReasonSame:
+			// a file found the same by its size is known by its content from now on
+			if record == nil || record.SHA256 == "" {
+				synced[name] = syncedFile{SizeKB: *remoteSizeKB, ModTime: local.modTime, SHA256: local.hash}
+			}
+			continue
+		case SyncReasonConflict, SyncReasonLocalOnly, SyncReasonProtected:
 			continue
 		}
 
-		f, openErr := os.Open(filepath.Join(localDir, name))
-		if openErr != nil {
-			return fmt.Errorf("cannot open %q: %w", name, openErr)
+		if renamed && !canRename {
+			// the file is sent under the new name and the old one is deleted like a file missing locally
+			orphans = append(orphans, from)
 		}
-		uploadErr := rb.UploadSoundFile(slot, name, f)
-		_ = f.Close()
-		if uploadErr != nil {
-			return fmt.Errorf("upload %q failed: %w", name, uploadErr)
+		if reason != SyncReasonRemote && reason != SyncReasonRemoteChanged && !(renamed && canRename) {
+			// an upload replaces the file on the decoder, a resumed one adds only the rest
+			needBytes += local.sizeBytes - resumeAt
+			if remoteSizeKB != nil && resumeAt == 0 {
+				needBytes -= *remoteSizeKB * 1024
+			}
+		}
+		if options.DryRun {
+			continue
 		}
-	}
 
-	// --- delete orphaned files ---
-	for name := range remoteFiles {
-		if _, exists := localFiles[name]; exists {
+		if reason == SyncReasonRemote || reason == SyncReasonRemoteChanged {
+			items[len(items)-1].transfer = func(progress SyncProgressFunc) error {
+				target := filepath.Join(localDir, name)
+				if local != nil {
+					target = local.file(localDir, name)
+				}
+				downloaded, downloadErr := app.downloadSyncedFile(rb, slot, target, name, progress)
+				if downloadErr != nil {
+					return downloadErr
+				}
+				stateMu.Lock()
+				defer stateMu.Unlock()
+				synced[name] = syncedFile{SizeKB: *remoteSizeKB, ModTime: downloaded.modTime, SHA256: downloaded.hash}
+				return nil
+			}
 			continue
 		}
-		_, _ = app.P.Printf("delete:   %s\n", name)
-		logrus.Infof("sync: deleting %q from slot %d on decoder", name, slot)
-		changes++
-		if dryRun {
+
+		upload := func(progress SyncProgressFunc, resumeAt int64) error {
+			path := local.path
+			if path == "" {
+				path = local.file(localDir, name)
+			}
+			f, openErr := os.Open(path)
+			if openErr != nil {
+				return fmt.Errorf("cannot open %q: %w", name, openErr)
+			}
+			defer f.Close()
+			transfer := SyncEvent{Kind: SyncUploadStart, Slot: slot, File: name, Bytes: resumeAt, Total: local.sizeBytes}
+			progress(transfer)
+			var uploadErr error
+			if rb.Resumable(local.sizeBytes) {
+				uploadErr = rb.UploadSoundFileResumable(slot, name, f, local.sizeBytes, resumeAt, func(offset int64) {
+					stateMu.Lock()
+					state.uploaded(slot, name, *local, offset)
+					stateMu.Unlock()
+					transfer.Bytes = offset
+					progress(SyncEvent{Kind: SyncUploadProgress, Slot: slot, File: name, Bytes: offset, Total: local.sizeBytes})
+				})
+			} else {
+				body := &progressReader{r: f, event: SyncEvent{Kind: SyncUploadProgress, Slot: slot, File: name, Total: local.sizeBytes}, progress: progress}
+				uploadErr = rb.UploadSoundFile(slot, name, body)
+				transfer.Bytes = body.event.Bytes
+			}
+			if uploadErr != nil {
+				return fmt.Errorf("upload %q failed: %w", name, uploadErr)
+			}
+			transfer.Kind = SyncUploadDone
+			progress(transfer)
+			stateMu.Lock()
+			defer stateMu.Unlock()
+			synced[name] = syncedFile{SizeKB: local.sizeKB(), ModTime: local.modTime, SHA256: local.hash}
+			return nil
+		}
+		// the size is recorded as the decoder lists it, see checkUploads
+		listed := func(sizeKB int64) {
+			stateMu.Lock()
+			defer stateMu.Unlock()
+			if record, ok := synced[name]; ok {
+				record.SizeKB = sizeKB
+				synced[name] = record
+			}
+		}
+		uploads[name] = syncUpload{sizeKB: local.sizeKB(), run: upload, listed: listed}
+		items[len(items)-1].transfer = func(progress SyncProgressFunc) error {
+			return upload(progress, resumeAt)
+		}
+		if renamed && canRename {
+			// a file the rename did not leave on the decoder is uploaded by a retry of checkUploads
+			items[len(items)-1].transfer = func(progress SyncProgressFunc) error {
+				if renameErr := renamer.RenameSoundFile(slot, from, name); renameErr != nil {
+					return fmt.Errorf("rename %q to %q failed: %w", from, name, renameErr)
+				}
+				stateMu.Lock()
+				defer stateMu.Unlock()
+				synced[name] = syncedFile{SizeKB: synced[from].SizeKB, ModTime: local.modTime, SHA256: local.hash}
+				delete(synced, from)
+				return nil
+			}
+		}
+	}
+	plan.NeedBytes = needBytes
+
+	// a dry run prints the whole plan first
+	if !options.DryRun {
+		// the sentinel of the lock is deleted after the sync, its space is not taken from the uploads
+		if err := checkStorage(rb, needBytes, lockKB*1024); err != nil {
+			return plan, err
+		}
+	}
+	if err := runSyncItems(items, options.Parallel, progress); err != nil {
+		// nothing is deleted while files are missing on the decoder
+		return plan, err
+	}
+	if options.DryRun {
+		if err := checkStorage(rb, needBytes, 0); err != nil {
+			return plan, err
+		}
+	}
+	if mismatched, err := app.checkUploads(rb, slot, uploads, options, progress); err != nil {
+		// the next sync must not take the truncated files for the newer ones
+		for _, name := range mismatched {
+			delete(synced, name)
+		}
+		return plan, err
+	}
+
+	// --- delete orphaned files ---
+	for _, name := range orphans {
+		progress(SyncEvent{Kind: SyncDelete, Slot: slot, File: name, DryRun: options.DryRun})
+		if options.DryRun {
 			continue
 		}
 		if delErr := rb.DeleteSoundFile(slot, name); delErr != nil {
-			return fmt.Errorf("delete %q failed: %w", name, delErr)
+			return plan, fmt.Errorf("delete %q failed: %w", name, delErr)
 		}
+		delete(synced, name)
 	}
 
-	if changes == 0 {
-		_, _ = app.P.Printf("everything is up to date\n")
+	if plan.Changes() == 0 {
+		progress(SyncEvent{Kind: SyncUpToDate, Slot: slot, DryRun: options.DryRun})
+	}
+	if options.Audition != nil && !options.DryRun {
+		if err := app.auditionSyncedSounds(slot, plan, *options.Audition, progress); err != nil {
+			return plan, err
+		}
 	}
 
+	return plan, nil
+}
+
+// checkStorage fails when the uploads need more space than is free on the decoder.
+// A decoder that does not report its storage space is trusted to have enough. The reservedBytes are used
+// by the sync itself and are counted as free.
+func checkStorage(rb decoders.Decoder, needBytes int64, reservedBytes int64) error {
+	if needBytes <= 0 {
+		return nil
+	}
+	storage, err := rb.Storage()
+	if errors.Is(err, decoders.ErrStorageUnknown) {
+		logrus.Debugf("sync: %s, the uploads need %s", err, formatSize(needBytes))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read the storage space of the decoder: %w", err)
+	}
+	storage.Used -= reservedBytes
+	if needBytes > storage.Free() {
+		return fmt.Errorf("not enough space on the decoder: need %s, only %s free", formatSize(needBytes), formatSize(storage.Free()))
+	}
+	logrus.Debugf("sync: the uploads need %s of %s free", formatSize(needBytes), formatSize(storage.Free()))
 	return nil
 }
 
-// WatchSoundSlot watches localDir for filesystem changes and triggers SyncSoundSlot
+// formatSize prints a size in KB below a megabyte, in MB with a decimal above
+func formatSize(bytes int64) string {
+	if bytes < 1<<20 {
+		return fmt.Sprintf("%d KB", (bytes+1023)/1024)
+	}
+	return fmt.Sprintf("%.1f MB", float64(bytes)/(1<<20))
+}
+
+// syncUpload uploads a single local file, starting at a byte of an interrupted upload
+type syncUpload struct {
+	sizeKB int64
+	run    func(progress SyncProgressFunc, resumeAt int64) error
+	// listed records the size of the uploaded file in the listing of the decoder
+	listed func(sizeKB int64)
+}
+
+// checkUploads lists the slot again after the uploads. The firmware answers a truncated upload like a complete one,
+// so a file missing on the decoder or of another size than the local one is reported and uploaded again,
+// up to options.MismatchRetries times. The files that still differ are returned with the error.
+func (app *LocoApp) checkUploads(rb decoders.Decoder, slot uint8, uploads map[string]syncUpload, options SyncOptions, progress SyncProgressFunc) ([]string, error) {
+	if len(uploads) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(uploads))
+	for name := range uploads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for attempt := 0; ; attempt++ {
+		remoteList, err := rb.ListSoundSlot(slot)
+		if err != nil {
+			return nil, fmt.Errorf("cannot verify the uploads to slot %d: %w", slot, err)
+		}
+		remoteFiles := make(map[string]int64, len(remoteList))
+		for _, info := range remoteList {
+			remoteFiles[info.Name] = info.SizeKB
+		}
+
+		var mismatched []string
+		for _, name := range names {
+			event := SyncEvent{Kind: SyncMismatch, Slot: slot, File: name, LocalSizeKB: uploads[name].sizeKB}
+			sizeKB, exists := remoteFiles[name]
+			if !exists {
+				event.Reason = SyncReasonMissing
+			} else if !sameSize(sizeKB, uploads[name].sizeKB) {
+				event.Reason = SyncReasonTruncated
+				event.RemoteSizeKB = sizeKB
+			} else {
+				uploads[name].listed(sizeKB)
+				continue
+			}
+			progress(event)
+			mismatched = append(mismatched, name)
+		}
+		if len(mismatched) == 0 {
+			return nil, nil
+		}
+		if attempt >= options.MismatchRetries {
+			return mismatched, fmt.Errorf("%d uploaded file(s) differ on the decoder: %s", len(mismatched), strings.Join(mismatched, ", "))
+		}
+
+		items := make([]syncItem, 0, len(mismatched))
+		for _, name := range mismatched {
+			upload := uploads[name]
+			items = append(items, syncItem{
+				compared: SyncEvent{Kind: SyncCompare, Slot: slot, File: name, Reason: SyncReasonRetry, LocalSizeKB: upload.sizeKB, RemoteSizeKB: remoteFiles[name]},
+				transfer: func(progress SyncProgressFunc) error { return upload.run(progress, 0) },
+			})
+		}
+		if err := runSyncItems(items, options.Parallel, progress); err != nil {
+			return mismatched, err
+		}
+		names = mismatched
+	}
+}
+
+// downloadSyncedFile stores a file of the slot at path in the local directory, replacing the local one
+func (app *LocoApp) downloadSyncedFile(rb decoders.Decoder, slot uint8, path string, name string, progress SyncProgressFunc) (syncLocalFile, error) {
+	transfer := SyncEvent{Kind: SyncDownloadStart, Slot: slot, File: name}
+	progress(transfer)
+	data, err := rb.DownloadSoundFile(slot, name)
+	if err != nil {
+		return syncLocalFile{}, err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return syncLocalFile{}, fmt.Errorf("cannot store %q: %w", name, err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return syncLocalFile{}, fmt.Errorf("cannot stat %q: %w", name, err)
+	}
+	transfer.Kind = SyncDownloadDone
+	transfer.Bytes = int64(len(data))
+	transfer.Total = transfer.Bytes
+	progress(transfer)
+	sum := sha256.Sum256(data)
+	return syncLocalFile{sizeBytes: fi.Size(), modTime: fi.ModTime(), hash: hex.EncodeToString(sum[:])}, nil
+}
+
+// watchRecursively adds a directory of localDir and its subdirectories to the watcher, the hidden and
+// the excluded ones are left out as by the sync
+func watchRecursively(watcher *fsnotify.Watcher, localDir string, dir string, ignore *syncIgnore) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("cannot watch directory %q: %w", path, err)
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if path != localDir && (strings.HasPrefix(entry.Name(), ".") || ignore.match(watchedPath(localDir, path), true)) {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			return fmt.Errorf("cannot watch directory %q: %w", path, err)
+		}
+		return nil
+	})
+}
+
+// watchedPath returns the path of a watched file relative to localDir, with forward slashes
+func watchedPath(localDir string, path string) string {
+	rel, err := filepath.Rel(localDir, path)
+	if err != nil {
+		return filepath.Base(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// watchDebounce is how long the watch waits for more changes before a sync
+var watchDebounce = 500 * time.Millisecond
+
+// WatchSoundSlot watches localDir and its subdirectories for filesystem changes and triggers SyncSoundSlot
 // each time a file is created, written or removed. A debounce of 500 ms is applied
 // so that rapid bursts of events (e.g. an editor saving atomically) produce only
-// one synchronisation run. The function blocks until the process is interrupted
-// (i.e. the watcher channels are closed). Errors – including a failed initial sync
+// one synchronisation run. The function blocks until ctx is cancelled, e.g. by Ctrl+C,
+// or the watcher channels are closed. A change still waiting for its debounce is synced
+// before it returns, and a summary of the run is printed. Errors – including a failed initial sync
 // or a failed triggered sync – are logged and printed, but never stop the watch loop.
-func (app *LocoApp) WatchSoundSlot(slot uint8, localDir string, dryRun bool, syncWithoutLast bool, opts ...decoders.Option) error {
+func (app *LocoApp) WatchSoundSlot(ctx context.Context, slot uint8, localDir string, options SyncOptions, progress SyncProgressFunc, opts ...decoders.Option) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return fmt.Errorf("cannot create filesystem watcher: %w", err)
 	}
 	defer watcher.Close()
 
-	if err = watcher.Add(localDir); err != nil {
-		return fmt.Errorf("cannot watch directory %q: %w", localDir, err)
+	ignore, err := loadSyncIgnore(localDir, options.Exclude)
+	if err != nil {
+		return err
+	}
+	if err = watchRecursively(watcher, localDir, localDir, ignore); err != nil {
+		return err
 	}
 
 	_, _ = app.P.Printf("watch: watching %q for changes (Ctrl+C to stop)\n", localDir)
 	logrus.Infof("watch: fsnotify watcher started on %q", localDir)
 
+	if progress == nil {
+		progress = app.printSyncEvent
+	}
+	var syncs, failed, transferred, deleted int
+	counted := func(event SyncEvent) {
+		switch event.Kind {
+		case SyncUploadDone, SyncDownloadDone:
+			transferred++
+		case SyncDelete:
+			deleted++
+		}
+		progress(event)
+	}
 	runSync := func(reason string) {
 		_, _ = app.P.Printf("watch: %s, syncing…\n", reason)
 		logrus.Infof("watch: %s, triggering sync of %q → slot %d", reason, localDir, slot)
-		if syncErr := app.SyncSoundSlot(slot, localDir, dryRun, syncWithoutLast, opts...); syncErr != nil {
+		syncs++
+		if _, syncErr := app.SyncSoundSlot(slot, localDir, options, counted, opts...); syncErr != nil {
+			failed++
 			_, _ = app.P.Printf("watch: sync error: %v\n", syncErr)
 			logrus.Errorf("watch: sync failed: %v", syncErr)
 		}
 	}
+	defer func() {
+		_, _ = app.P.Printf("watch: stopped after %d sync(s), %d failed, %d file(s) transferred, %d deleted\n", syncs, failed, transferred, deleted)
+	}()
 
 	// Run an initial sync before entering the watch loop.
 	// Errors are non-fatal – the loop still starts afterwards.
 	runSync("starting initial sync")
 
-	const debounce = 500 * time.Millisecond
-	var timer *time.Timer
+	// the syncs run here, one at a time, the events arriving meanwhile wait in the watcher
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+	pending := false
 
 	for {
 		select {
+		case <-ctx.Done():
+			logrus.Debug("watch: interrupted")
+			if pending {
+				timer.Stop()
+				runSync("stopping, syncing the pending change")
+			}
+			return nil
+
+		case <-timer.C:
+			pending = false
+			runSync("change detected")
+
 		case event, ok := <-watcher.Events:
 			if !ok {
 				return nil
 			}
 			// React to write, create and remove events; ignore chmod/rename noise.
+			// The sync state and the lock are written by every sync, reacting to them would never stop.
+			// The excluded files are not synced, a change of them is not either.
+			if base := filepath.Base(event.Name); base == syncStateFile || base == syncLockFile {
+				continue
+			}
+			rel := watchedPath(localDir, event.Name)
+			if rel == syncIgnoreFile {
+				// the changed patterns apply from the next event, the sync reads them itself
+				if reloaded, ignoreErr := loadSyncIgnore(localDir, options.Exclude); ignoreErr != nil {
+					logrus.Errorf("watch: %v", ignoreErr)
+				} else {
+					ignore = reloaded
+				}
+			}
+			fi, statErr := os.Stat(event.Name)
+			isDir := statErr == nil && fi.IsDir()
+			if ignore.match(rel, isDir) {
+				logrus.Debugf("watch: %q is excluded, event %s ignored", rel, event.Op)
+				continue
+			}
+			if event.Has(fsnotify.Create) && isDir {
+				// a new subdirectory is watched too, with what was put in it already
+				if watchErr := watchRecursively(watcher, localDir, event.Name, ignore); watchErr != nil {
+					logrus.Errorf("watch: %v", watchErr)
+				}
+			}
 			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Remove) {
 				logrus.Debugf("watch: fsnotify event %s on %q", event.Op, event.Name)
 				// Debounce: reset the timer on every new event within the window.
-				if timer != nil {
-					timer.Stop()
-				}
-				timer = time.AfterFunc(debounce, func() { runSync("change detected") })
+				timer.Reset(watchDebounce)
+				pending = true
 			}
 
 		case watchErr, ok := <-watcher.Errors:
@@ -0,0 +1,278 @@
+package app
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/keskad/loco/pkgs/decoders"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: reorganizing a sound project. The RB23xx firmware has no rename endpoint and assigns sounds
+// to functions by the "F<n>_" prefix of the file name, so a rename is a download, an upload under the new name
+// and a delete of the old file. All new files are uploaded before anything is deleted,
+// a failed upload restores the slot as it was.
+//
+
+// reFunctionPrefix matches the function a sound file is assigned to, e.g. "F11_" in "F11_Decouple.wav"
+var reFunctionPrefix = regexp.MustCompile(`^[Ff](\d+)_`)
+
+// reFunction matches a function in the rename map, e.g. "F11"
+var reFunction = regexp.MustCompile(`^[Ff](\d+)$`)
+
+// soundRenameRule is a single row of the rename map: a file name, or a function moving all of its files
+type soundRenameRule struct {
+	from, to string
+	// fromFn and toFn are set for function rules, e.g. "F11,F12"
+	fromFn, toFn int
+	function     bool
+}
+
+type soundRename struct {
+	From, To string
+}
+
+// readSoundRenameMap parses "from,to" rows. A row of two functions ("F11,F12") moves every file of the function,
+// other rows rename a single file. A "from,to" header and lines starting with # are skipped.
+func readSoundRenameMap(r io.Reader) ([]soundRenameRule, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	var rules []soundRenameRule
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		from, to := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+		if row == 1 && strings.EqualFold(from, "from") && strings.EqualFold(to, "to") {
+			continue
+		}
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("row %d: both columns are required, got %q", row, record)
+		}
+		if strings.ContainsAny(from+to, "/\\") {
+			return nil, fmt.Errorf("row %d: file names cannot contain a path, got %q", row, record)
+		}
+		rule := soundRenameRule{from: from, to: to}
+		fromFn, isFromFn := parseFunction(from)
+		toFn, isToFn := parseFunction(to)
+		if isFromFn != isToFn {
+			return nil, fmt.Errorf("row %d: a function can be moved only to another function, got %q", row, record)
+		}
+		if isFromFn {
+			rule.function, rule.fromFn, rule.toFn = true, fromFn, toFn
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseFunction(s string) (int, bool) {
+	m := reFunction.FindStringSubmatch(s)
+	if m == nil {
+		return 0, false
+	}
+	fn, err := strconv.Atoi(m[1])
+	return fn, err == nil
+}
+
+// planSoundRenames applies the rules to the files of a slot. A file is renamed by the first matching rule.
+// Renaming onto a file that stays in the slot, or a file rule without its file, is an error.
+func planSoundRenames(files []string, rules []soundRenameRule) ([]soundRename, error) {
+	present := make(map[string]bool, len(files))
+	for _, name := range files {
+		present[name] = true
+	}
+	for _, rule := range rules {
+		if !rule.function && !present[rule.from] {
+			return nil, fmt.Errorf("%q is not in the slot", rule.from)
+		}
+	}
+
+	sorted := append([]string(nil), files...)
+	sort.Strings(sorted)
+	var renames []soundRename
+	renamed := map[string]bool{}
+	for _, name := range sorted {
+		for _, rule := range rules {
+			to, ok := rule.apply(name)
+			if !ok {
+				continue
+			}
+			if to != name {
+				renames = append(renames, soundRename{From: name, To: to})
+				renamed[name] = true
+			}
+			break
+		}
+	}
+
+	targets := map[string]string{}
+	for _, rename := range renames {
+		if previous, exists := targets[rename.To]; exists {
+			return nil, fmt.Errorf("both %q and %q would be renamed to %q", previous, rename.From, rename.To)
+		}
+		if present[rename.To] && !renamed[rename.To] {
+			return nil, fmt.Errorf("cannot rename %q to %q, the file exists and is not renamed", rename.From, rename.To)
+		}
+		targets[rename.To] = rename.From
+	}
+	return renames, nil
+}
+
+func (r soundRenameRule) apply(name string) (string, bool) {
+	if !r.function {
+		return r.to, name == r.from
+	}
+	m := reFunctionPrefix.FindStringSubmatch(name)
+	if m == nil {
+		return "", false
+	}
+	if fn, err := strconv.Atoi(m[1]); err != nil || fn != r.fromFn {
+		return "", false
+	}
+	return fmt.Sprintf("F%d_%s", r.toFn, name[len(m[0]):]), true
+}
+
+// RenameSoundFiles renames files in a sound slot as described by the CSV map, see readSoundRenameMap.
+// When localDir is set, the files of the local sound project are renamed too, so the next sync keeps the new names.
+func (app *LocoApp) RenameSoundFiles(slot uint8, mapPath string, localDir string, dryRun bool, opts ...decoders.Option) error {
+	mapFile, err := os.Open(mapPath)
+	if err != nil {
+		return fmt.Errorf("cannot read rename map: %w", err)
+	}
+	rules, err := readSoundRenameMap(mapFile)
+	_ = mapFile.Close()
+	if err != nil {
+		return fmt.Errorf("cannot parse rename map %q: %w", mapPath, err)
+	}
+
+	rb, err := app.decoder(opts...)
+	if err != nil {
+		return err
+	}
+	remote, err := rb.ListSoundSlot(slot)
+	if err != nil {
+		return fmt.Errorf("cannot list slot %d on decoder: %w", slot, err)
+	}
+	names := make([]string, 0, len(remote))
+	for _, file := range remote {
+		names = append(names, file.Name)
+	}
+	renames, err := planSoundRenames(names, rules)
+	if err != nil {
+		return fmt.Errorf("cannot rename files in slot %d: %w", slot, err)
+	}
+
+	if dryRun {
+		_, _ = app.P.Printf("[dry-run] no changes will be made\n")
+	}
+	for _, rename := range renames {
+		_, _ = app.P.Printf("rename:   %s -> %s\n", rename.From, rename.To)
+	}
+	if len(renames) == 0 {
+		_, _ = app.P.Printf("nothing to rename in slot %d\n", slot)
+		return nil
+	}
+	if dryRun {
+		return nil
+	}
+
+	if err := renameInSlot(rb, slot, renames); err != nil {
+		return err
+	}
+	if localDir != "" {
+		return renameLocalSounds(localDir, renames)
+	}
+	return nil
+}
+
+// renameInSlot uploads all files under their new names first, then deletes the old names that were not reused
+func renameInSlot(rb decoders.Decoder, slot uint8, renames []soundRename) error {
+	contents := make(map[string][]byte, len(renames))
+	for _, rename := range renames {
+		data, err := rb.DownloadSoundFile(slot, rename.From)
+		if err != nil {
+			return fmt.Errorf("cannot rename %q: %w", rename.From, err)
+		}
+		contents[rename.From] = data
+	}
+
+	var uploaded []string
+	for _, rename := range renames {
+		logrus.Infof("rename: uploading %q as %q to slot %d", rename.From, rename.To, slot)
+		if err := rb.UploadSoundFile(slot, rename.To, bytes.NewReader(contents[rename.From])); err != nil {
+			rollbackSoundRenames(rb, slot, uploaded, contents)
+			return fmt.Errorf("cannot rename %q to %q, slot %d restored: %w", rename.From, rename.To, slot, err)
+		}
+		uploaded = append(uploaded, rename.To)
+	}
+
+	reused := make(map[string]bool, len(renames))
+	for _, rename := range renames {
+		reused[rename.To] = true
+	}
+	for _, rename := range renames {
+		if reused[rename.From] {
+			continue // overwritten by another rename, e.g. when two files are swapped
+		}
+		if err := rb.DeleteSoundFile(slot, rename.From); err != nil {
+			return fmt.Errorf("cannot delete %q after it was renamed to %q: %w", rename.From, rename.To, err)
+		}
+	}
+	return nil
+}
+
+// rollbackSoundRenames restores overwritten files and removes the new ones, errors are only logged
+func rollbackSoundRenames(rb decoders.Decoder, slot uint8, uploaded []string, contents map[string][]byte) {
+	for _, name := range uploaded {
+		var err error
+		if original, overwritten := contents[name]; overwritten {
+			err = rb.UploadSoundFile(slot, name, bytes.NewReader(original))
+		} else {
+			err = rb.DeleteSoundFile(slot, name)
+		}
+		if err != nil {
+			logrus.Errorf("rename: cannot restore %q in slot %d: %s", name, slot, err)
+		}
+	}
+}
+
+// renameLocalSounds renames the local files through temporary names, so swapped files do not overwrite each other
+func renameLocalSounds(localDir string, renames []soundRename) error {
+	const tmpSuffix = ".loco-rename"
+	var moved []soundRename
+	for _, rename := range renames {
+		from := filepath.Join(localDir, rename.From)
+		if _, err := os.Stat(from); errors.Is(err, os.ErrNotExist) {
+			logrus.Warnf("rename: %q is not in %s, renamed only on the decoder", rename.From, localDir)
+			continue
+		}
+		if err := os.Rename(from, from+tmpSuffix); err != nil {
+			return fmt.Errorf("cannot rename local %q: %w", rename.From, err)
+		}
+		moved = append(moved, rename)
+	}
+	for _, rename := range moved {
+		if err := os.Rename(filepath.Join(localDir, rename.From+tmpSuffix), filepath.Join(localDir, rename.To)); err != nil {
+			return fmt.Errorf("cannot rename local %q to %q: %w", rename.From, rename.To, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+	"github.com/keskad/loco/pkgs/throttle"
+)
+
+// recordBroadcasts deliver LAN_X_LOCO_INFO of the subscribed locomotive
+const recordBroadcasts = z21proto.BroadcastDrivingSwitching
+
+// RecordAction records speed and function changes of a locomotive until interrupted, then saves them to out.
+// The locomotive may be driven by any throttle, the changes are observed from the Z21 broadcasts.
+func (app *LocoApp) RecordAction(locoId uint8, out string) error {
+	z21, err := app.z21Station(commandstation.CapabilityMonitor, "recording is supported only by the z21 command station")
+	if err != nil {
+		return err
+	}
+	defer z21.CleanUp()
+
+	addr := uint16(locoId)
+	recorder := throttle.NewRecorder(addr)
+	var mu sync.Mutex
+	started := time.Now()
+	z21.OnLocoInfo(func(info z21proto.LocoInfo) {
+		if info.Addr != addr {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		at := time.Since(started)
+		recorded := len(recorder.Recording().Events)
+		recorder.Observe(at, throttle.State{
+			Speed:     info.Speed,
+			Forward:   info.Forward,
+			Steps:     uint8(info.Steps),
+			Functions: uint32(info.Functions),
+		})
+		for _, event := range recorder.Recording().Events[recorded:] {
+			_, _ = app.P.Printf("%8s %s\n", at.Round(100*time.Millisecond), event)
+		}
+	})
+
+	// asking for the loco info records the initial state and subscribes to the locomotive
+	if _, _, err := z21.GetSpeed(commandstation.LocoAddr(locoId)); err != nil {
+		return fmt.Errorf("cannot read the state of locomotive %d: %w", locoId, err)
+	}
+	_, _ = app.P.Printf("Recording locomotive %d, press Ctrl+C to stop\n", locoId)
+
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- app.monitorStation(z21, recordBroadcasts, stop, nil)
+	}()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	var listenErr error
+	select {
+	case <-interrupt:
+		logrus.Debug("record: interrupted")
+		close(stop)
+		<-errs
+	case listenErr = <-errs:
+	}
+
+	mu.Lock()
+	recording := recorder.Recording()
+	mu.Unlock()
+	if err := recording.Save(out); err != nil {
+		return err
+	}
+	_, _ = app.P.Printf("Saved %d events to %s\n", len(recording.Events), out)
+	return listenErr
+}
+
+// ReplayAction sends the commands of a recording with the original timing.
+// locoId other than 0 replays the recording on another locomotive. With loop the recording is repeated until interrupted.
+// When interrupted the locomotive is stopped.
+// A session log recorded with --session-log is only decoded and printed, nothing is sent.
+func (app *LocoApp) ReplayAction(path string, locoId uint8, loop bool) error {
+	if datagrams, err := readSessionLog(path); err == nil {
+		app.printSessionLog(datagrams)
+		return nil
+	} else if !errors.Is(err, commandstation.ErrNotSession) {
+		return err
+	}
+
+	recording, err := throttle.LoadRecording(path)
+	if err != nil {
+		return err
+	}
+	addr := commandstation.LocoAddr(recording.Loco)
+	if locoId != 0 {
+		addr = commandstation.LocoAddr(locoId)
+	}
+
+	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
+		return cmdErr
+	}
+	defer app.station.CleanUp()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	steps := uint8(128)
+	forward := true
+	for {
+		began := time.Now()
+		for _, event := range recording.Events {
+			select {
+			case <-interrupt:
+				_, _ = app.P.Printf("Interrupted, stopping locomotive %d\n", addr)
+				return app.station.SetSpeed(addr, 0, forward, steps)
+			case <-time.After(time.Until(began.Add(event.Offset()))):
+			}
+
+			_, _ = app.P.Printf("%8s %s\n", event.Offset().Round(100*time.Millisecond), event)
+			switch event.Type {
+			case throttle.EventSpeed:
+				if event.Steps != 0 {
+					steps = event.Steps
+				}
+				forward = event.Forward
+				err = app.station.SetSpeed(addr, event.Speed, event.Forward, steps)
+			case throttle.EventFunction:
+				err = app.station.SendFn(commandstation.MainTrackMode, addr, commandstation.FuncNum(event.Function), commandstation.FnSwitch(event.On))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if !loop {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package app
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/keskad/loco/pkgs/decoders"
+)
+
+// RestoreOptions shape DecoderRestoreAction
+type RestoreOptions struct {
+	// Mode and LocoId select where the CVs are written, an empty Mode takes both from the backup
+	Mode    string
+	LocoId  uint8
+	Timeout time.Duration
+	Settle  time.Duration
+	// SkipCVs and SkipWiFi leave out what is written over the track or over the decoder WiFi
+	SkipCVs  bool
+	SkipWiFi bool
+	// DryRun only prints the plan, Yes does not ask before the changes
+	DryRun bool
+	Yes    bool
+}
+
+// DecoderRestoreAction replays a backup written by DecoderBackupAction: the CVs are written with verification,
+// then the AUX output map and the downloaded sound slots are uploaded. The plan is printed before any change.
+func (app *LocoApp) DecoderRestoreAction(dir string, options RestoreOptions, opts ...decoders.Option) error {
+	manifest, err := loadBackupManifest(dir)
+	if err != nil {
+		return err
+	}
+	mode, locoId := options.Mode, options.LocoId
+	if mode == "" {
+		mode, locoId = manifest.Track, manifest.Loco
+	}
+	if mode == "" {
+		mode = "prog"
+	}
+
+	restoreCVs := manifest.CVFile != "" && !options.SkipCVs
+	restoreOutputs := manifest.OutputMap != "" && !options.SkipWiFi
+	var cvs string
+	if restoreCVs {
+		if cvs, err = readBackupCVs(filepath.Join(dir, filepath.FromSlash(manifest.CVFile))); err != nil {
+			return err
+		}
+	}
+	var slots []backupSlot
+	if !options.SkipWiFi {
+		for _, slot := range manifest.Slots {
+			if !slot.Downloaded {
+				continue
+			}
+			if err := verifyBackupSlot(dir, slot); err != nil {
+				return err
+			}
+			slots = append(slots, slot)
+		}
+	}
+
+	// --- the plan ---
+	if options.DryRun {
+		_, _ = app.P.Printf("[dry-run] no changes will be made\n")
+	}
+	_, _ = app.P.Printf("backup:       %s, created %s\n", dir, manifest.Created.Local().Format(time.DateTime))
+	if manifest.Decoder != nil {
+		_, _ = app.P.Printf("decoder:      %s, firmware %s\n", orUnknown(manifest.Decoder.Model), orUnknown(manifest.Decoder.Firmware))
+	}
+	if restoreCVs {
+		_, _ = app.P.Printf("cvs:          %d to write on loco %d (%s), verified\n", strings.Count(cvs, ",")+1, locoId, mode)
+		if len(manifest.Unread) > 0 {
+			logrus.Warnf("restore: %d CV(s) could not be read during the backup and are not restored", len(manifest.Unread))
+		}
+	}
+	if restoreOutputs {
+		_, _ = app.P.Printf("output map:   %s\n", manifest.OutputMap)
+	}
+	if !options.SkipWiFi {
+		for _, slot := range manifest.Slots {
+			plan := fmt.Sprintf("%d file(s)", len(slot.Files))
+			if !slot.Downloaded {
+				plan = "listed only, not restored"
+			}
+			_, _ = app.P.Printf("%-14s%s\n", fmt.Sprintf("slot %d:", slot.Slot), plan)
+		}
+	}
+	if !restoreCVs && !restoreOutputs && len(slots) == 0 {
+		return fmt.Errorf("nothing to restore from %s", dir)
+	}
+	if options.DryRun {
+		return nil
+	}
+	if !options.Yes {
+		_, _ = app.P.Printf("Restore the decoder? [y/N] ")
+		answer, err := bufio.NewReader(app.input()).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("cannot read the answer: %w", err)
+		}
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			_, _ = app.P.Printf("nothing was changed\n")
+			return nil
+		}
+	}
+
+	// --- the changes ---
+	rb, err := app.decoder(opts...)
+	if err != nil {
+		return err
+	}
+	if restoreCVs {
+		if err := app.SendCVAction(cvs, CVSendOptions{Mode: mode, LocoId: locoId, Verify: true, Timeout: options.Timeout, Settle: options.Settle, Strict: true}); err != nil {
+			return fmt.Errorf("cannot restore the CVs: %w", err)
+		}
+		_, _ = app.P.Printf("cvs:          restored\n")
+	}
+	if restoreOutputs {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(manifest.OutputMap)))
+		if err != nil {
+			return fmt.Errorf("cannot read the AUX output map: %w", err)
+		}
+		if err := rb.UploadOutputMap(data); err != nil {
+			return fmt.Errorf("cannot restore the AUX output map: %w", err)
+		}
+		_, _ = app.P.Printf("output map:   restored\n")
+	}
+	for _, slot := range slots {
+		syncOptions := SyncOptions{Direction: SyncPush, MismatchRetries: 1}
+		if _, err := app.SyncSoundSlot(slot.Slot, filepath.Join(dir, filepath.FromSlash(slot.Dir)), syncOptions, nil, opts...); err != nil {
+			return fmt.Errorf("cannot restore slot %d: %w", slot.Slot, err)
+		}
+	}
+	_, _ = app.P.Printf("decoder restored from %s\n", dir)
+	return nil
+}
+
+func loadBackupManifest(dir string) (backupManifest, error) {
+	var manifest backupManifest
+	data, err := os.ReadFile(filepath.Join(dir, backupManifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest, fmt.Errorf("%s is not a backup of a decoder, %s is missing", dir, backupManifestFile)
+	}
+	if err != nil {
+		return manifest, fmt.Errorf("cannot read the backup manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid backup manifest %s: %w", backupManifestFile, err)
+	}
+	return manifest, nil
+}
+
+// readBackupCVs returns the "cv<n>=<value>" lines of the backup as a list for SendCVAction
+func readBackupCVs(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read the CVs of the backup: %w", err)
+	}
+	var entries []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			entries = append(entries, line)
+		}
+	}
+	if len(entries) == 0 {
+		return "", fmt.Errorf("the backup has no CVs in %s", filepath.Base(path))
+	}
+	return strings.Join(entries, ","), nil
+}
+
+// verifyBackupSlot compares the sound files kept in the backup with their checksums in the manifest
+func verifyBackupSlot(dir string, slot backupSlot) error {
+	for _, file := range slot.Files {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(slot.Dir), file.Name))
+		if err != nil {
+			return fmt.Errorf("slot %d of the backup is incomplete: %w", slot.Slot, err)
+		}
+		sum := sha256.Sum256(data)
+		if file.SHA256 != "" && hex.EncodeToString(sum[:]) != file.SHA256 {
+			return fmt.Errorf("%q of slot %d was changed since the backup, its checksum does not match", file.Name, slot.Slot)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+)
+
+// readSessionLog reads a session recorded with --session-log, commandstation.ErrNotSession is returned for other files
+func readSessionLog(path string) ([]commandstation.SessionDatagram, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %w", path, err)
+	}
+	defer file.Close()
+	_, datagrams, err := commandstation.ReadSession(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %q: %w", path, err)
+	}
+	return datagrams, nil
+}
+
+// printSessionLog decodes the recorded traffic offline, without connecting to the command station.
+// The station address is shown only when the traffic of more stations was recorded.
+func (app *LocoApp) printSessionLog(datagrams []commandstation.SessionDatagram) {
+	peers := map[string]bool{}
+	for _, datagram := range datagrams {
+		peers[datagram.Peer] = true
+	}
+
+	for _, datagram := range datagrams {
+		offset := datagram.Time.Sub(datagrams[0].Time).Round(time.Millisecond)
+		peer := ""
+		if len(peers) > 1 {
+			peer = datagram.Peer + " "
+		}
+		records, splitErr := z21proto.Split(datagram.Data)
+		for _, record := range records {
+			_, _ = app.P.Printf("%10s %s %s%s\n", "+"+offset.String(), datagram.Direction, peer, z21proto.Annotate(record))
+		}
+		if splitErr != nil || app.Debug {
+			_, _ = app.P.Printf("%10s %s %s% X\n", "", datagram.Direction, peer, []byte(datagram.Data))
+		}
+	}
+	_, _ = app.P.Printf("%d datagrams\n", len(datagrams))
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/keskad/loco/pkgs/sim"
+)
+
+// SimZ21Action runs a simulated Z21 on the UDP address until interrupted
+func (app *LocoApp) SimZ21Action(listen string, options sim.Z21Options) error {
+	conn, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %w", listen, err)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		<-interrupt
+		_ = conn.Close()
+	}()
+
+	_, _ = app.P.Printf("Z21 simulator listening on %s (Ctrl+C to stop)\n", conn.LocalAddr())
+	_, _ = app.P.Printf("locomotives: %v, programming track: %d, NACK rate: %.2f, RailCom: %t\n",
+		options.Locos, options.ProgTrackLoco, options.NackRate, options.RailCom)
+
+	return sim.NewZ21(options).Serve(conn)
+}
+
+// SimRBAction runs a simulated RB23xx decoder on the TCP address until interrupted
+func (app *LocoApp) SimRBAction(listen string, options sim.RB23xxOptions) error {
+	decoder, err := sim.NewRB23xx(options)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %w", listen, err)
+	}
+	server := &http.Server{Handler: decoder}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		<-interrupt
+		_ = server.Close()
+	}()
+
+	_, _ = app.P.Printf("RB23xx simulator listening on http://%s (Ctrl+C to stop)\n", listener.Addr())
+	storage := "in memory"
+	if options.Dir != "" {
+		storage = options.Dir
+	}
+	_, _ = app.P.Printf("files: %s (%d), use --decoder-address %s\n", storage, len(decoder.Files()), listener.Addr())
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
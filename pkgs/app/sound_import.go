@@ -0,0 +1,207 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/keskad/loco/pkgs/audio"
+	"github.com/keskad/loco/pkgs/decoders"
+	"github.com/keskad/loco/pkgs/soundproject"
+)
+
+//
+// Context: a user migrating a locomotive from another sound decoder. The samples of its sound project are copied
+// into a sound directory of the Railbox, named after the functions that play them, with a slot.yaml describing them.
+// The directory is then uploaded with "loco decoder rb sound sync".
+//
+
+// ImportOptions shape ImportSoundProjectAction
+type ImportOptions struct {
+	// Format of the project, empty detects it from the path
+	Format string
+	// Functions assigns the slots of the project to functions, a slot not listed plays on the function
+	// named by the project or on the function of its number
+	Functions map[int]int
+	// Force imports into a directory that is not empty, files of the same name are replaced
+	Force bool
+}
+
+// reUnsafeName matches what is replaced in the names of the imported files
+var reUnsafeName = regexp.MustCompile(`[^A-Za-z0-9-]+`)
+
+// ImportSoundProjectAction copies the samples of a sound project of another manufacturer into dir
+// A slot exported by ExportSoundSlotAction is copied as it is.
+func (app *LocoApp) ImportSoundProjectAction(projectPath string, dir string, options ImportOptions) error {
+	format, err := soundProjectFormat(projectPath, options.Format)
+	if err != nil {
+		return err
+	}
+	if format == soundPackageFormat {
+		return app.importSoundPackage(projectPath, dir, options)
+	}
+	project, err := readSoundProject(projectPath, format)
+	if err != nil {
+		return err
+	}
+	if err := prepareImportDir(dir, options.Force); err != nil {
+		return err
+	}
+
+	manifest := []slotSound{}
+	names := map[string]bool{}
+	incompatible := 0
+	for _, slot := range project.Slots {
+		fn := slot.Number
+		if slot.Function >= 0 {
+			fn = slot.Function
+		}
+		if assigned, ok := options.Functions[slot.Number]; ok {
+			fn = assigned
+		}
+		base := reUnsafeName.ReplaceAllString(slot.Name, "")
+		if base == "" {
+			base = fmt.Sprintf("Slot%d", slot.Number)
+		}
+		for _, sample := range slot.Samples {
+			stem := strings.TrimSuffix(sample.Name, path.Ext(sample.Name))
+			name := fmt.Sprintf("F%d_%s", fn, base)
+			if len(slot.Samples) > 1 {
+				name += "_" + strings.Trim(reUnsafeName.ReplaceAllString(stem, "_"), "_")
+			}
+			unique := name
+			for i := 2; names[strings.ToLower(unique)]; i++ {
+				unique = fmt.Sprintf("%s_%d", name, i)
+			}
+			names[strings.ToLower(unique)] = true
+			file := unique + ".wav"
+
+			if err := os.WriteFile(filepath.Join(dir, file), sample.Data, 0o644); err != nil {
+				return fmt.Errorf("cannot write %q: %w", file, err)
+			}
+			if header, err := audio.ReadHeader(bytes.NewReader(sample.Data)); err != nil || header.Float || header.Format != decoders.SOUND_FORMAT {
+				incompatible++
+			}
+			manifest = append(manifest, slotSound{Function: fmt.Sprintf("F%d", fn), File: file, Loop: strings.Contains(strings.ToLower(stem), "loop")})
+			_, _ = app.P.Printf("import:   %s <- %s\n", file, sample.Path)
+		}
+	}
+	if err := writeSlotManifest(dir, manifest, fmt.Sprintf("imported from %s (%s)", filepath.Base(projectPath), project.Format)); err != nil {
+		return err
+	}
+	for _, skipped := range project.Skipped {
+		logrus.Debugf("import: %q is not a sample of a sound slot, skipped", skipped)
+	}
+
+	_, _ = app.P.Printf("imported %d sample(s) of %d slot(s) into %s\n", project.Samples(), len(project.Slots), dir)
+	if incompatible > 0 {
+		_, _ = app.P.Printf("%d sample(s) are not in the format of the decoder (%s), sync them with --transcode\n", incompatible, decoders.SOUND_FORMAT)
+	}
+	return nil
+}
+
+// InspectSoundProjectAction lists the slots and the samples of a sound project of another manufacturer
+func (app *LocoApp) InspectSoundProjectAction(projectPath string, format string) error {
+	format, err := soundProjectFormat(projectPath, format)
+	if err != nil {
+		return err
+	}
+	if format == soundPackageFormat {
+		return app.inspectSoundPackage(projectPath)
+	}
+	project, err := readSoundProject(projectPath, format)
+	if err != nil {
+		return err
+	}
+	_, _ = app.P.Printf("format:   %s\n", project.Format)
+	for _, slot := range project.Slots {
+		function := "function unknown"
+		if slot.Function >= 0 {
+			function = fmt.Sprintf("F%d", slot.Function)
+		}
+		_, _ = app.P.Printf("slot %d: %s (%s)\n", slot.Number, slot.Name, function)
+		for _, sample := range slot.Samples {
+			described := "not a WAV file"
+			if header, err := audio.ReadHeader(bytes.NewReader(sample.Data)); err == nil {
+				described = header.Format.String()
+			}
+			_, _ = app.P.Printf("  %-32s %8s  %s\n", sample.Name, formatSize(int64(len(sample.Data))), described)
+		}
+	}
+	_, _ = app.P.Printf("%d sample(s) in %d slot(s), %d other file(s)\n", project.Samples(), len(project.Slots), len(project.Skipped))
+	return nil
+}
+
+// soundProjectFormat returns the format of a project, an empty format is detected from the path.
+// A .zip archive is a LokSound project unless it is a sound package, see isSoundPackage.
+func soundProjectFormat(projectPath string, format string) (string, error) {
+	if format != "" {
+		return strings.ToLower(format), nil
+	}
+	info, err := os.Stat(projectPath)
+	if err != nil {
+		return "", fmt.Errorf("cannot open the sound project: %w", err)
+	}
+	switch ext := strings.ToLower(filepath.Ext(projectPath)); {
+	case ext == ".zip" && !info.IsDir() && isSoundPackage(projectPath):
+		return soundPackageFormat, nil
+	case info.IsDir(), ext == ".esux", ext == ".zip":
+		return "esu", nil
+	case ext == ".zpp":
+		return "zimo", nil
+	}
+	return "", fmt.Errorf("cannot tell the format of the sound project %q, select it with --format", filepath.Base(projectPath))
+}
+
+// readSoundProject reads a project of another manufacturer in the format of soundProjectFormat
+func readSoundProject(projectPath string, format string) (*soundproject.Project, error) {
+	switch format {
+	case "esu":
+		return soundproject.ReadESU(projectPath)
+	case "zimo":
+		return soundproject.ReadZimo(projectPath)
+	}
+	return nil, fmt.Errorf("unknown sound project format %q, known: esu, zimo, %s", format, soundPackageFormat)
+}
+
+// prepareImportDir creates the sound directory of an import, a directory that is not empty needs force
+func prepareImportDir(dir string, force bool) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("cannot create the sound directory: %w", err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil {
+		return fmt.Errorf("cannot read the sound directory: %w", err)
+	} else if len(entries) > 0 && !force {
+		return fmt.Errorf("%s is not empty, use --force to import into it", dir)
+	}
+	return nil
+}
+
+// writeSlotManifest writes slot.yaml of a directory, the names of the files need no quoting
+func writeSlotManifest(dir string, sounds []slotSound, comment string) error {
+	var out strings.Builder
+	if comment != "" {
+		fmt.Fprintf(&out, "# %s\n", comment)
+	}
+	out.WriteString("sounds:\n")
+	for _, sound := range sounds {
+		fmt.Fprintf(&out, "  - function: %s\n    file: %s\n", sound.Function, sound.File)
+		if sound.Volume != nil {
+			fmt.Fprintf(&out, "    volume: %d\n", *sound.Volume)
+		}
+		if sound.Loop {
+			out.WriteString("    loop: true\n")
+		}
+	}
+	path := filepath.Join(dir, slotManifestFile)
+	if err := os.WriteFile(path, []byte(out.String()), 0o644); err != nil {
+		return fmt.Errorf("cannot write the slot manifest: %w", err)
+	}
+	return nil
+}
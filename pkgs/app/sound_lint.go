@@ -0,0 +1,167 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/keskad/loco/pkgs/audio"
+)
+
+//
+// Context: the RB23xx plays the sound of "F<n>_..." while Fn is on, a file named otherwise is uploaded and stays
+// silent. The linter reads the names of a sound directory as the decoder will, before anything is uploaded,
+// and is run by "loco decoder rb sound sync --lint" as well.
+//
+
+// maxSoundFunction is the last function the RB23xx assigns a sound to
+const maxSoundFunction = 31
+
+// reSoundName are the characters of a name the firmware stores as it is, e.g. "F11_Decouple.wav"
+var reSoundName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// SoundLintIssue is a problem of a file of a sound directory, an error fails the lint
+type SoundLintIssue struct {
+	File    string
+	Error   bool
+	Message string
+}
+
+// SoundLintAction prints the problems of the names of a sound directory, it fails when any of them is an error
+func (app *LocoApp) SoundLintAction(localDir string, exclude []string) error {
+	issues, err := lintSoundDir(localDir, exclude)
+	if err != nil {
+		return err
+	}
+	errorCount := 0
+	for _, issue := range issues {
+		if issue.Error {
+			errorCount++
+			_, _ = app.P.Printf("error:    %s: %s\n", issue.File, issue.Message)
+		} else {
+			_, _ = app.P.Printf("warning:  %s: %s\n", issue.File, issue.Message)
+		}
+	}
+	if len(issues) == 0 {
+		_, _ = app.P.Printf("no problems found in %s\n", localDir)
+		return nil
+	}
+	_, _ = app.P.Printf("%d error(s), %d warning(s)\n", errorCount, len(issues)-errorCount)
+	if errorCount > 0 {
+		return fmt.Errorf("%d file name(s) in %q do not follow the naming of the decoder", errorCount, localDir)
+	}
+	return nil
+}
+
+// lintSoundDir checks the files of a directory by their names on the decoder, see listSyncLocalFiles:
+//   - a sound is assigned to a function by its "F<n>_" prefix, F0 to maxSoundFunction
+//   - two names differing only in case are the same file for the firmware
+//   - a function has a single sound, the others of it are never played
+//   - the sounds and the functions of slot.yaml match the files, see slotManifest
+//
+// The issues are sorted by file.
+func lintSoundDir(localDir string, exclude []string) ([]SoundLintIssue, error) {
+	ignore, err := loadSyncIgnore(localDir, exclude)
+	if err != nil {
+		return nil, err
+	}
+	localFiles, err := listSyncLocalFiles(localDir, ignore)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(localFiles))
+	for name := range localFiles {
+		if name != slotManifestFile {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var issues []SoundLintIssue
+	add := func(file string, isError bool, format string, args ...any) {
+		issues = append(issues, SoundLintIssue{File: file, Error: isError, Message: fmt.Sprintf(format, args...)})
+	}
+	byFolded := map[string]string{}
+	byFunction := map[int][]string{}
+	for _, name := range names {
+		if other, taken := byFolded[strings.ToLower(name)]; taken {
+			add(name, true, "the decoder does not tell it from %s, the names differ only in case", other)
+		}
+		byFolded[strings.ToLower(name)] = name
+
+		if !audio.IsSound(name) {
+			add(name, false, "not a sound file, it is uploaded but never played")
+			continue
+		}
+		if !strings.EqualFold(filepath.Ext(name), ".wav") {
+			add(name, false, "the decoder plays WAV files only, sync it with --transcode")
+		}
+		if !reSoundName.MatchString(name) {
+			add(name, false, "use letters, digits, '_', '-' and '.' only, the firmware may not store the other characters")
+		}
+		m := reFunctionPrefix.FindStringSubmatch(name)
+		if m == nil {
+			add(name, true, "not assigned to a function, name it F<n>_%s", name)
+			continue
+		}
+		fn, _ := soundFunction(name)
+		switch {
+		case fn > maxSoundFunction:
+			add(name, true, "F%d is beyond F%d, the decoder never plays it", fn, maxSoundFunction)
+			continue
+		case name[0] == 'f':
+			add(name, false, "write the prefix as F%d_", fn)
+		case len(m[1]) > 1 && m[1][0] == '0':
+			add(name, false, "%s is read as F%d, name it F%d_...", name[:len(m[0])-1], fn, fn)
+		}
+		byFunction[fn] = append(byFunction[fn], name)
+	}
+	for fn, files := range byFunction {
+		for _, name := range files[1:] {
+			add(name, false, "F%d has another sound already, %s, the decoder plays only one of them", fn, files[0])
+		}
+	}
+
+	manifest, err := loadSlotManifest(localDir)
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil {
+		problems, unlisted := manifest.problems(localFiles)
+		for _, problem := range problems {
+			add(slotManifestFile, true, "%s", problem)
+		}
+		for _, name := range unlisted {
+			if fn, ok := soundFunction(name); ok && audio.IsSound(name) {
+				add(name, false, "F%d is not mapped in %s", fn, slotManifestFile)
+			}
+		}
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].File < issues[j].File })
+	return issues, nil
+}
+
+// checkSoundNames fails a sync of a directory with errors of lintSoundDir, the warnings are logged
+func checkSoundNames(localDir string, exclude []string) error {
+	issues, err := lintSoundDir(localDir, exclude)
+	if err != nil {
+		return err
+	}
+	var problems []string
+	for _, issue := range issues {
+		if issue.Error {
+			problems = append(problems, fmt.Sprintf("%s: %s", issue.File, issue.Message))
+		} else {
+			logrus.Warnf("sync: %s: %s", issue.File, issue.Message)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("the names of the sounds do not follow the naming of the decoder:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
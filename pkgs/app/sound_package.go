@@ -0,0 +1,223 @@
+package app
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/keskad/loco/pkgs/decoders"
+)
+
+//
+// Context: club members share the sounds of their locomotives. A slot is exported into a single .zip archive,
+// its files as they are on the decoder with a manifest of their checksums, and imported by another member
+// into a local sound directory, which is then uploaded with "loco decoder rb sound sync" as any other.
+//
+
+// soundPackageFormat is the format of ImportSoundProjectAction reading an exported slot
+const soundPackageFormat = "loco"
+
+// soundPackageManifestFile describes the exported slot, it tells a sound package from other .zip archives
+const soundPackageManifestFile = "loco-package.json"
+
+// soundPackageManifest is the content of soundPackageManifestFile
+type soundPackageManifest struct {
+	Created time.Time      `json:"created"`
+	Slot    uint8          `json:"slot"`
+	Decoder *decoders.Info `json:"decoder,omitempty"`
+	Files   []backupFile   `json:"files"`
+}
+
+// ExportSoundSlotAction downloads the files of a slot into a .zip archive, with a manifest of their checksums.
+// The archive is written next to archivePath first and replaces it only when complete.
+func (app *LocoApp) ExportSoundSlotAction(slot uint8, archivePath string, opts ...decoders.Option) (err error) {
+	rb, err := app.decoder(opts...)
+	if err != nil {
+		return err
+	}
+	files, err := rb.ListSoundSlot(slot)
+	if err != nil {
+		return fmt.Errorf("cannot list slot %d on decoder: %w", slot, err)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("slot %d is empty, there is nothing to export", slot)
+	}
+	manifest := soundPackageManifest{Created: time.Now().UTC().Truncate(time.Second), Slot: slot, Files: make([]backupFile, 0, len(files))}
+	if info, infoErr := rb.Info(); infoErr == nil {
+		manifest.Decoder = &info
+	} else {
+		logrus.Debugf("export: the decoder info is not known: %s", infoErr)
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(archivePath), "."+filepath.Base(archivePath)+".*")
+	if err != nil {
+		return fmt.Errorf("cannot create the archive: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = out.Close()
+			_ = os.Remove(out.Name())
+		}
+	}()
+	archive := zip.NewWriter(out)
+	for _, file := range files {
+		data, err := rb.DownloadSoundFile(slot, file.Name)
+		if err != nil {
+			return fmt.Errorf("cannot export slot %d: %w", slot, err)
+		}
+		entry, err := archive.CreateHeader(&zip.FileHeader{Name: file.Name, Method: zip.Deflate, Modified: manifest.Created})
+		if err != nil {
+			return fmt.Errorf("cannot add %q to the archive: %w", file.Name, err)
+		}
+		if _, err := entry.Write(data); err != nil {
+			return fmt.Errorf("cannot add %q to the archive: %w", file.Name, err)
+		}
+		sum := sha256.Sum256(data)
+		manifest.Files = append(manifest.Files, backupFile{Name: file.Name, SizeKB: file.SizeKB, SHA256: hex.EncodeToString(sum[:])})
+		_, _ = app.P.Printf("export:   %s\n", file.Name)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	entry, err := archive.CreateHeader(&zip.FileHeader{Name: soundPackageManifestFile, Method: zip.Deflate, Modified: manifest.Created})
+	if err != nil {
+		return fmt.Errorf("cannot write the manifest of the archive: %w", err)
+	}
+	if _, err := entry.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("cannot write the manifest of the archive: %w", err)
+	}
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("cannot write the archive: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("cannot write the archive: %w", err)
+	}
+	if err := os.Rename(out.Name(), archivePath); err != nil {
+		return fmt.Errorf("cannot write the archive: %w", err)
+	}
+	_, _ = app.P.Printf("exported %d file(s) of slot %d into %s\n", len(files), slot, archivePath)
+	return nil
+}
+
+// isSoundPackage tells if a .zip archive was written by ExportSoundSlotAction
+func isSoundPackage(archivePath string) bool {
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return false
+	}
+	defer archive.Close()
+	for _, file := range archive.File {
+		if file.Name == soundPackageManifestFile {
+			return true
+		}
+	}
+	return false
+}
+
+// readSoundPackage reads the manifest and the files of an exported slot, every file is checked against its checksum
+func readSoundPackage(archivePath string) (*soundPackageManifest, map[string][]byte, error) {
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot open the sound package: %w", err)
+	}
+	defer archive.Close()
+
+	entries := map[string]*zip.File{}
+	for _, file := range archive.File {
+		entries[file.Name] = file
+	}
+	manifestData, err := readZipEntry(entries[soundPackageManifestFile])
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read the manifest of the sound package: %w", err)
+	}
+	manifest := &soundPackageManifest{}
+	if err := json.Unmarshal(manifestData, manifest); err != nil {
+		return nil, nil, fmt.Errorf("cannot parse the manifest of the sound package: %w", err)
+	}
+
+	files := make(map[string][]byte, len(manifest.Files))
+	for _, record := range manifest.Files {
+		// a file of a slot has no directory, anything else would be written outside of the sound directory
+		if record.Name == "" || record.Name != filepath.Base(record.Name) || strings.ContainsAny(record.Name, `/\`) || strings.HasPrefix(record.Name, ".") {
+			return nil, nil, fmt.Errorf("invalid file name %q in the sound package", record.Name)
+		}
+		data, err := readZipEntry(entries[record.Name])
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read %q of the sound package: %w", record.Name, err)
+		}
+		if sum := sha256.Sum256(data); record.SHA256 != "" && hex.EncodeToString(sum[:]) != record.SHA256 {
+			return nil, nil, fmt.Errorf("%q of the sound package is damaged, its checksum differs from the manifest", record.Name)
+		}
+		files[record.Name] = data
+	}
+	for name := range entries {
+		if _, listed := files[name]; !listed && name != soundPackageManifestFile {
+			logrus.Debugf("import: %q is not listed in the manifest of the sound package, skipped", name)
+		}
+	}
+	return manifest, files, nil
+}
+
+func readZipEntry(file *zip.File) ([]byte, error) {
+	if file == nil {
+		return nil, errors.New("missing in the archive")
+	}
+	r, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// importSoundPackage copies the files of an exported slot into dir, as they are
+func (app *LocoApp) importSoundPackage(archivePath string, dir string, options ImportOptions) error {
+	if len(options.Functions) > 0 {
+		return fmt.Errorf("the files of a sound package are named after their functions already, rename them with \"loco decoder rb sound rename\"")
+	}
+	manifest, files, err := readSoundPackage(archivePath)
+	if err != nil {
+		return err
+	}
+	if err := prepareImportDir(dir, options.Force); err != nil {
+		return err
+	}
+	for _, record := range manifest.Files {
+		if err := os.WriteFile(filepath.Join(dir, record.Name), files[record.Name], 0o644); err != nil {
+			return fmt.Errorf("cannot write %q: %w", record.Name, err)
+		}
+		_, _ = app.P.Printf("import:   %s\n", record.Name)
+	}
+	_, _ = app.P.Printf("imported %d file(s) of slot %d into %s, upload them with \"loco decoder rb sound sync <slot> %s\"\n",
+		len(manifest.Files), manifest.Slot, dir, dir)
+	return nil
+}
+
+// inspectSoundPackage lists the files of an exported slot
+func (app *LocoApp) inspectSoundPackage(archivePath string) error {
+	manifest, files, err := readSoundPackage(archivePath)
+	if err != nil {
+		return err
+	}
+	_, _ = app.P.Printf("format:   %s, slot %d exported %s\n", soundPackageFormat, manifest.Slot, manifest.Created.Format(time.DateOnly))
+	if manifest.Decoder != nil {
+		_, _ = app.P.Printf("decoder:  %s %s\n", manifest.Decoder.Model, manifest.Decoder.Firmware)
+	}
+	for _, record := range manifest.Files {
+		_, _ = app.P.Printf("  %-32s %8s\n", record.Name, formatSize(int64(len(files[record.Name]))))
+	}
+	_, _ = app.P.Printf("%d file(s)\n", len(manifest.Files))
+	return nil
+}
@@ -1,23 +1,120 @@
 package app
 
-import "github.com/keskad/loco/pkgs/commandstation"
+import (
+	"errors"
+	"fmt"
+	"time"
 
-// SetSpeedAction sets the speed and direction of a locomotive
-func (app *LocoApp) SetSpeedAction(locoId uint8, speed uint8, forward bool, speedSteps uint8) error {
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/throttle"
+	"github.com/sirupsen/logrus"
+)
+
+// SetSpeedAction sets the speed and direction of a locomotive, the command is sent repeat more times
+func (app *LocoApp) SetSpeedAction(locoId uint8, speed uint8, forward bool, speedSteps uint8, repeat uint8, timeout time.Duration, retries uint8) error {
 	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
 		return cmdErr
 	}
 	defer app.station.CleanUp()
+	if err := app.takeOver(locoId, timeout, retries); err != nil {
+		return err
+	}
 
-	return app.station.SetSpeed(commandstation.LocoAddr(locoId), speed, forward, speedSteps)
+	return app.station.SetSpeed(commandstation.LocoAddr(locoId), speed, forward, speedSteps, commandstation.Repeat(repeat))
 }
 
 // GetSpeedAction retrieves the current speed and direction of a locomotive
-func (app *LocoApp) GetSpeedAction(locoId uint8) (speed uint8, forward bool, err error) {
+func (app *LocoApp) GetSpeedAction(locoId uint8, timeout time.Duration, retries uint8) (speed uint8, forward bool, err error) {
 	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
 		return 0, false, cmdErr
 	}
 	defer app.station.CleanUp()
 
-	return app.station.GetSpeed(commandstation.LocoAddr(locoId))
+	return app.station.GetSpeed(commandstation.LocoAddr(locoId), commandstation.Timeout(timeout), commandstation.Retries(retries))
+}
+
+// PrintSpeedAction prints the speed and direction of a locomotive, and whether another device drives it
+func (app *LocoApp) PrintSpeedAction(locoId uint8, timeout time.Duration, retries uint8) error {
+	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
+		return cmdErr
+	}
+	defer app.station.CleanUp()
+
+	speed, forward, err := app.station.GetSpeed(commandstation.LocoAddr(locoId), commandstation.Timeout(timeout), commandstation.Retries(retries))
+	if err != nil {
+		return err
+	}
+	direction := "reverse"
+	if forward {
+		direction = "forward"
+	}
+	_, _ = app.P.Printf("Locomotive %d: speed=%d direction=%s%s\n", locoId, speed, direction, app.controlNote(locoId, timeout, retries))
+	return nil
+}
+
+// RampSpeedAction changes the speed gradually within duration, shaped by the acceleration curve.
+// curve is a curve name or a CSV file, empty uses the configured one. from < 0 starts at the current speed read from the station.
+func (app *LocoApp) RampSpeedAction(locoId uint8, target uint8, forward bool, speedSteps uint8, duration time.Duration, curveName string, from int, timeout time.Duration, retries uint8) error {
+	if curveName == "" {
+		curveName = app.Config.Throttle.Curve
+	}
+	curve, curveErr := throttle.NewCurve(curveName)
+	if curveErr != nil {
+		return curveErr
+	}
+
+	if cmdErr := app.initializeCommandStation(); cmdErr != nil {
+		return cmdErr
+	}
+	defer app.station.CleanUp()
+	addr := commandstation.LocoAddr(locoId)
+	if err := app.takeOver(locoId, timeout, retries); err != nil {
+		return err
+	}
+
+	start := uint8(0)
+	if from >= 0 {
+		start = uint8(from)
+	} else {
+		speed, currentForward, err := app.station.GetSpeed(addr, commandstation.Timeout(timeout), commandstation.Retries(retries))
+		var notSupported *commandstation.ErrNotSupported
+		switch {
+		case errors.As(err, &notSupported):
+			logrus.Warnf("cannot read the current speed, ramping from 0 (use --from to set it): %s", err)
+		case err != nil:
+			return fmt.Errorf("cannot read the current speed: %w", err)
+		case speed > 0 && currentForward != forward:
+			return fmt.Errorf("locomotive %d is moving in the other direction, stop it first", locoId)
+		default:
+			start = speed
+		}
+	}
+
+	ramp := throttle.Ramp{
+		From:     start,
+		To:       target,
+		Duration: duration,
+		Interval: time.Duration(app.Config.Throttle.StepInterval) * time.Millisecond,
+		Curve:    curve,
+	}
+	// in 14 and 128 speed steps the value 1 is an emergency stop
+	if speedSteps != 28 {
+		ramp.AvoidSpeed = 1
+	}
+
+	began := time.Now()
+	steps := ramp.Steps()
+	for i, step := range steps {
+		time.Sleep(time.Until(began.Add(step.At)))
+		logrus.Debugf("ramp: %s speed=%d", step.At, step.Speed)
+		// the next step follows shortly, only the target speed is repeated
+		var options []commandstation.RequestOption
+		if i < len(steps)-1 {
+			options = append(options, commandstation.Repeat(0))
+		}
+		if err := app.station.SetSpeed(addr, step.Speed, forward, speedSteps, options...); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,124 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/keskad/loco/pkgs/syntax"
+)
+
+//
+// Context: the 28 CVs of a speed table are tedious to calculate by hand. The generated table is printed as a CV file,
+// the graph as its comments, so it can be saved, edited and written later with "loco cv apply".
+//
+
+const (
+	cvVstart          = 2
+	cvVhigh           = 5
+	cvVmid            = 6
+	cvSpeedTableFirst = 67
+	cvSpeedTableLast  = 94
+
+	// speedTableGraphHeight is the number of rows of the graph of a speed table
+	speedTableGraphHeight = 10
+)
+
+// SpeedTableShapes are the shapes of a generated speed table: "linear", "exp" (a low speed range of fine steps)
+// and "s-curve" (fine steps at the start and at the top)
+var SpeedTableShapes = []string{"linear", "exp", "s-curve"}
+
+// SpeedTableOptions shape a generated speed table, the table rises from Vstart at standstill to Vmax at step 28
+type SpeedTableOptions struct {
+	Shape  string
+	Vstart uint8
+	Vmax   uint8
+}
+
+// SpeedTableAction generates the speed table CV67-CV94 and the three-point curve CV2, CV5 and CV6 of the same shape,
+// prints them with a graph and, with write, writes them to the decoder
+func (app *LocoApp) SpeedTableAction(options SpeedTableOptions, write *CVWrite) error {
+	table, err := speedTable(options)
+	if err != nil {
+		return err
+	}
+	vmid := speedTableValue(options, 0.5)
+
+	_, _ = app.P.Printf("# speed table: %s, vstart %d, vmax %d\n", options.Shape, options.Vstart, options.Vmax)
+	for _, line := range speedTableGraph(table) {
+		_, _ = app.P.Printf("# %s\n", line)
+	}
+	curve := []syntax.CVEntry{{Number: cvVstart, Value: uint16(options.Vstart)}, {Number: cvVhigh, Value: uint16(options.Vmax)}, {Number: cvVmid, Value: uint16(vmid)}}
+	cvs := make([]string, 0, len(curve)+len(table))
+	for _, entry := range curve {
+		_, _ = app.P.Printf("cv%d=%d%s\n", entry.Number, entry.Value, app.cvComment(CVOutput{}, true, entry.Number, int(entry.Value)))
+		cvs = append(cvs, fmt.Sprintf("cv%d=%d", entry.Number, entry.Value))
+	}
+	for i, value := range table {
+		_, _ = app.P.Printf("cv%d=%d\n", cvSpeedTableFirst+i, value)
+		cvs = append(cvs, fmt.Sprintf("cv%d=%d", cvSpeedTableFirst+i, value))
+	}
+	if write == nil {
+		return nil
+	}
+	return app.SendCVAction(strings.Join(cvs, ", "), CVSendOptions{Mode: write.Mode, LocoId: write.LocoId, Verify: write.Verify, Timeout: write.Timeout, Strict: true})
+}
+
+// speedTable returns the values of CV67-CV94, step n is the shape at n/28
+func speedTable(options SpeedTableOptions) ([]uint8, error) {
+	known := false
+	for _, shape := range SpeedTableShapes {
+		known = known || shape == options.Shape
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown shape %q, expected one of: %s", options.Shape, strings.Join(SpeedTableShapes, ", "))
+	}
+	if options.Vmax <= options.Vstart {
+		return nil, fmt.Errorf("vmax %d must be higher than vstart %d", options.Vmax, options.Vstart)
+	}
+	steps := cvSpeedTableLast - cvSpeedTableFirst + 1
+	table := make([]uint8, steps)
+	for i := range table {
+		table[i] = speedTableValue(options, float64(i+1)/float64(steps))
+	}
+	return table, nil
+}
+
+// speedTableValue is the voltage of the shape at x, 0 at standstill and 1 at the top speed
+func speedTableValue(options SpeedTableOptions, x float64) uint8 {
+	y := x
+	switch options.Shape {
+	case "exp":
+		y = (math.Exp(3*x) - 1) / (math.Exp(3) - 1)
+	case "s-curve":
+		y = x * x * (3 - 2*x)
+	}
+	return uint8(math.Round(float64(options.Vstart) + float64(options.Vmax-options.Vstart)*y))
+}
+
+// speedTableGraph draws the table, a column for each speed step and the full voltage (255) at the top row
+func speedTableGraph(table []uint8) []string {
+	lines := make([]string, 0, speedTableGraphHeight+2)
+	for row := speedTableGraphHeight; row >= 1; row-- {
+		var columns strings.Builder
+		for _, value := range table {
+			if int(math.Round(float64(value)*speedTableGraphHeight/255)) >= row {
+				columns.WriteString("#")
+			} else {
+				columns.WriteString(" ")
+			}
+		}
+		label := ""
+		if row == speedTableGraphHeight {
+			label = "255"
+		}
+		lines = append(lines, strings.TrimRight(fmt.Sprintf("%3s |%s", label, columns.String()), " "))
+	}
+	lines = append(lines, "  0 +"+strings.Repeat("-", len(table)))
+
+	steps := []byte(strings.Repeat(" ", len(table)))
+	copy(steps[0:], "1")
+	copy(steps[len(table)/2-1:], fmt.Sprint(len(table)/2))
+	copy(steps[len(table)-2:], fmt.Sprint(len(table)))
+	return append(lines, "     "+string(steps))
+}
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"strings"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+)
+
+// StatusAction prints the state of the command station: its conditions, currents and voltages
+func (app *LocoApp) StatusAction(timeout time.Duration) error {
+	z21, err := app.z21Station(commandstation.CapabilityStationState, "the state can be read only from the z21 command station")
+	if err != nil {
+		return err
+	}
+	defer z21.CleanUp()
+
+	state, err := z21.ReadStationState(timeout)
+	if err != nil {
+		return err
+	}
+	conditions := commandstation.StationState{Central: state.CentralState, CentralEx: state.CentralStateEx}.Conditions()
+	status := "normal operation"
+	if len(conditions) > 0 {
+		status = strings.Join(conditions, ", ")
+	}
+	_, _ = app.P.Printf("state:        %s\n", status)
+	_, _ = app.P.Printf("main track:   %d mA\n", state.MainCurrent)
+	_, _ = app.P.Printf("prog track:   %d mA\n", state.ProgCurrent)
+	_, _ = app.P.Printf("temperature:  %d °C\n", state.Temperature)
+	_, _ = app.P.Printf("supply:       %.2f V\n", float64(state.SupplyVoltage)/1000)
+	_, _ = app.P.Printf("track:        %.2f V\n", float64(state.VCCVoltage)/1000)
+	return nil
+}
+
+// UnlockStatusAction prints the hardware of the command station and whether a z21start is unlocked for programming over LAN
+func (app *LocoApp) UnlockStatusAction(timeout time.Duration) error {
+	z21, err := app.z21Station(commandstation.CapabilityLANProgramming, "the feature lock is reported only by the z21 command station")
+	if err != nil {
+		return err
+	}
+	defer z21.CleanUp()
+
+	status, err := z21.ReadUnlockStatus(timeout)
+	if err != nil {
+		return err
+	}
+	_, _ = app.P.Printf("hardware:     %s\n", status.Hardware)
+	_, _ = app.P.Printf("firmware:     %s\n", status.Firmware)
+	_, _ = app.P.Printf("features:     %s\n", status.Lock)
+	if status.Locked() {
+		_, _ = app.P.Printf("\nCVs cannot be read or written over LAN. Unlock the z21start with the activation code\n" +
+			"(Roco 10814 or 10818) using the Z21 Maintenance Tool, or program through the multiMAUS.\n")
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package app
+
+import (
+	"errors"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SyncEventKind tells which stage of the sound slot synchronisation an event describes
+type SyncEventKind string
+
+const (
+	SyncScan           SyncEventKind = "scan"
+	SyncTranscode      SyncEventKind = "transcode"
+	SyncCompare        SyncEventKind = "compare"
+	SyncUploadStart    SyncEventKind = "upload-start"
+	SyncUploadProgress SyncEventKind = "upload-progress"
+	SyncUploadDone     SyncEventKind = "upload-done"
+	SyncDownloadStart  SyncEventKind = "download-start"
+	SyncDownloadDone   SyncEventKind = "download-done"
+	SyncMismatch       SyncEventKind = "mismatch"
+	SyncDelete         SyncEventKind = "delete"
+	SyncUpToDate       SyncEventKind = "up-to-date"
+	// SyncAudition is sent before the function of an uploaded File is switched on, see SyncOptions.Audition
+	SyncAudition SyncEventKind = "audition"
+)
+
+// Reasons of a SyncCompare event
+const (
+	SyncReasonNew     = "new"
+	SyncReasonChanged = "changed"
+	SyncReasonSame    = "same"
+	// the decoder side is copied, see SyncPull and SyncBoth
+	SyncReasonRemote        = "remote"
+	SyncReasonRemoteChanged = "remote-changed"
+	// the upload of the file was interrupted and is continued
+	SyncReasonResume = "resume"
+	// both sides changed since the last sync, nothing is copied
+	SyncReasonConflict = "conflict"
+	// the file is missing on the decoder and kept as it is by SyncPull
+	SyncReasonLocalOnly = "local-only"
+	// the file is missing locally and deleted from the decoder by SyncPush, reported as a SyncDelete event
+	SyncReasonOrphan = "orphan"
+	// the file differed on the decoder after the upload and is uploaded again
+	SyncReasonRetry = "retry"
+	// the local file is a file of the decoder under a new name, see SyncPlan.Renames
+	SyncReasonRename = "rename"
+	// the file of the decoder matches a .locoignore pattern or an --exclude, it is only listed in the SyncPlan
+	SyncReasonExcluded = "excluded"
+	// the file is missing locally, but protected by slot.yaml or a --keep, it is deleted only with --force
+	SyncReasonProtected = "protected"
+)
+
+// Reasons of a SyncMismatch event
+const (
+	SyncReasonMissing   = "missing"
+	SyncReasonTruncated = "truncated"
+)
+
+// SyncEvent is a single progress notification emitted by SyncSoundSlot
+type SyncEvent struct {
+	Kind   SyncEventKind `json:"kind"`
+	Slot   uint8         `json:"slot"`
+	File   string        `json:"file,omitempty"`
+	DryRun bool          `json:"dryRun,omitempty"`
+
+	// SyncScan
+	LocalFiles  int `json:"localFiles,omitempty"`
+	RemoteFiles int `json:"remoteFiles,omitempty"`
+
+	// SyncTranscode, the local file converted to File
+	Source string `json:"source,omitempty"`
+
+	// SyncCompare, SyncMismatch
+	Reason string `json:"reason,omitempty"`
+	// From is the old name of a file with SyncReasonRename
+	From         string `json:"from,omitempty"`
+	LocalSizeKB  int64  `json:"localSizeKB,omitempty"`
+	RemoteSizeKB int64  `json:"remoteSizeKB,omitempty"`
+
+	// SyncUploadStart, SyncUploadProgress, SyncUploadDone, SyncDownloadStart, SyncDownloadDone
+	Bytes int64 `json:"bytes,omitempty"`
+	Total int64 `json:"total,omitempty"`
+}
+
+// SyncProgressFunc receives SyncEvents in the order they happen. It is called synchronously,
+// so a slow consumer slows down the synchronisation.
+type SyncProgressFunc func(event SyncEvent)
+
+// SyncEventsToChannel adapts a channel to a SyncProgressFunc, the caller is responsible for draining the channel
+func SyncEventsToChannel(ch chan<- SyncEvent) SyncProgressFunc {
+	return func(event SyncEvent) {
+		ch <- event
+	}
+}
+
+// printSyncEvent is the default, human-readable presentation of the sync progress
+func (app *LocoApp) printSyncEvent(event SyncEvent) {
+	switch event.Kind {
+	case SyncScan:
+		if event.DryRun {
+			_, _ = app.P.Printf("[dry-run] no changes will be made\n")
+		}
+		logrus.Debugf("sync: %d local file(s), %d file(s) in slot %d", event.LocalFiles, event.RemoteFiles, event.Slot)
+	case SyncTranscode:
+		_, _ = app.P.Printf("convert:  %s -> %s\n", event.Source, event.File)
+		logrus.Infof("sync: converting %q to the format of the decoder", event.Source)
+	case SyncCompare:
+		switch event.Reason {
+		case SyncReasonNew:
+			_, _ = app.P.Printf("upload:   %s\n", event.File)
+			logrus.Infof("sync: uploading new file %q to slot %d", event.File, event.Slot)
+		case SyncReasonChanged:
+			_, _ = app.P.Printf("changed:  %s (local %d KB, remote %d KB)\n", event.File, event.LocalSizeKB, event.RemoteSizeKB)
+			logrus.Infof("sync: re-uploading %q (local %d KB, remote %d KB)", event.File, event.LocalSizeKB, event.RemoteSizeKB)
+		case SyncReasonRename:
+			_, _ = app.P.Printf("rename:   %s -> %s\n", event.From, event.File)
+			logrus.Infof("sync: %q was renamed to %q in the local directory", event.From, event.File)
+		case SyncReasonResume:
+			_, _ = app.P.Printf("resume:   %s (%d KB of %d KB on the decoder)\n", event.File, event.RemoteSizeKB, event.LocalSizeKB)
+			logrus.Infof("sync: continuing the interrupted upload of %q to slot %d", event.File, event.Slot)
+		case SyncReasonRemote:
+			_, _ = app.P.Printf("download: %s\n", event.File)
+			logrus.Infof("sync: downloading %q from slot %d", event.File, event.Slot)
+		case SyncReasonRemoteChanged:
+			_, _ = app.P.Printf("pull:     %s (local %d KB, remote %d KB)\n", event.File, event.LocalSizeKB, event.RemoteSizeKB)
+			logrus.Infof("sync: downloading the newer %q from slot %d (local %d KB, remote %d KB)", event.File, event.Slot, event.LocalSizeKB, event.RemoteSizeKB)
+		case SyncReasonConflict:
+			_, _ = app.P.Printf("conflict: %s changed on both sides, use --direction push or pull to choose (local %d KB, remote %d KB)\n", event.File, event.LocalSizeKB, event.RemoteSizeKB)
+			logrus.Warnf("sync: %q changed locally and on the decoder since the last sync, skipping", event.File)
+		case SyncReasonProtected:
+			_, _ = app.P.Printf("keep:     %s is protected, use --force to delete it from the decoder\n", event.File)
+			logrus.Infof("sync: keeping the protected %q in slot %d", event.File, event.Slot)
+		case SyncReasonLocalOnly:
+			logrus.Debugf("sync: keeping %q, it is not on the decoder", event.File)
+		case SyncReasonRetry:
+			_, _ = app.P.Printf("retry:    %s\n", event.File)
+			logrus.Infof("sync: uploading %q to slot %d again", event.File, event.Slot)
+		default:
+			logrus.Debugf("sync: skipping %q (size within tolerance: local %d KB, remote %d KB)", event.File, event.LocalSizeKB, event.RemoteSizeKB)
+		}
+	case SyncUploadStart:
+		logrus.Debugf("sync: sending %q (%d bytes)", event.File, event.Total)
+	case SyncUploadProgress:
+		logrus.Debugf("sync: %q %d/%d bytes", event.File, event.Bytes, event.Total)
+	case SyncUploadDone:
+		logrus.Debugf("sync: %q uploaded", event.File)
+	case SyncDownloadStart:
+		logrus.Debugf("sync: fetching %q", event.File)
+	case SyncDownloadDone:
+		logrus.Debugf("sync: %q downloaded (%d bytes)", event.File, event.Bytes)
+	case SyncMismatch:
+		if event.Reason == SyncReasonMissing {
+			_, _ = app.P.Printf("mismatch: %s is missing on the decoder after the upload\n", event.File)
+		} else {
+			_, _ = app.P.Printf("mismatch: %s (local %d KB, decoder %d KB after the upload)\n", event.File, event.LocalSizeKB, event.RemoteSizeKB)
+		}
+		logrus.Warnf("sync: %q is %s in slot %d after the upload", event.File, event.Reason, event.Slot)
+	case SyncDelete:
+		_, _ = app.P.Printf("delete:   %s\n", event.File)
+		logrus.Infof("sync: deleting %q from slot %d on decoder", event.File, event.Slot)
+	case SyncUpToDate:
+		_, _ = app.P.Printf("everything is up to date\n")
+	case SyncAudition:
+		fn, _ := soundFunction(event.File)
+		_, _ = app.P.Printf("play:     %s (F%d)\n", event.File, fn)
+		logrus.Infof("sync: playing %q with F%d", event.File, fn)
+	}
+}
+
+// progressReader emits SyncUploadProgress events while the upload body is consumed
+type progressReader struct {
+	r        io.Reader
+	event    SyncEvent
+	progress SyncProgressFunc
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.event.Bytes += int64(n)
+		p.progress(p.event)
+	}
+	return n, err
+}
+
+// Seek lets the decoder stream the file and rewind it when the upload is sent again, the progress follows it
+func (p *progressReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := p.r.(io.Seeker)
+	if !ok {
+		return 0, errors.New("the upload body cannot seek")
+	}
+	position, err := seeker.Seek(offset, whence)
+	if err == nil {
+		p.event.Bytes = position
+	}
+	return position, err
+}
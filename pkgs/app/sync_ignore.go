@@ -0,0 +1,128 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+//
+// Context: a sound directory that is also a workspace, with editor backups, .DS_Store files of macOS or the FLAC
+// masters the WAV files were made from. A .locoignore file in the directory lists them with the patterns of
+// .gitignore, the sync neither uploads them nor deletes the files of the decoder they match.
+//
+
+// syncIgnoreFile is read from the root of the synchronised directory and is never uploaded
+const syncIgnoreFile = ".locoignore"
+
+// ignorePattern is a line of .locoignore or an --exclude
+type ignorePattern struct {
+	// segments of the pattern split at "/", "**" matches any number of them
+	segments []string
+	// negate re-includes what the earlier patterns excluded ("!keep.wav")
+	negate bool
+	// dirOnly matches directories only ("backup/")
+	dirOnly bool
+	// anchored patterns contain a "/" and match the path from the root of the directory,
+	// the others match the name of a file or directory at any depth
+	anchored bool
+}
+
+// syncIgnore are the patterns of the files a sync leaves alone, the last matching pattern decides
+type syncIgnore struct {
+	patterns []ignorePattern
+}
+
+// loadSyncIgnore reads .locoignore of a directory, a missing file is no patterns, and appends the excludes
+func loadSyncIgnore(localDir string, exclude []string) (*syncIgnore, error) {
+	ignore := &syncIgnore{}
+	data, err := os.ReadFile(filepath.Join(localDir, syncIgnoreFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("cannot read %s: %w", syncIgnoreFile, err)
+	}
+	for number, line := range strings.Split(string(data), "\n") {
+		if err := ignore.add(line); err != nil {
+			return nil, fmt.Errorf("%s, line %d: %w", syncIgnoreFile, number+1, err)
+		}
+	}
+	for _, pattern := range exclude {
+		if err := ignore.add(pattern); err != nil {
+			return nil, fmt.Errorf("--exclude: %w", err)
+		}
+	}
+	return ignore, nil
+}
+
+// add parses a pattern, blank lines and "#" comments are skipped
+func (i *syncIgnore) add(line string) error {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	pattern := ignorePattern{}
+	if strings.HasPrefix(line, "!") {
+		pattern.negate, line = true, line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly, line = true, strings.TrimRight(line, "/")
+	}
+	pattern.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return fmt.Errorf("empty pattern")
+	}
+	pattern.segments = strings.Split(line, "/")
+	for _, segment := range pattern.segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", line, err)
+		}
+	}
+	i.patterns = append(i.patterns, pattern)
+	return nil
+}
+
+// match tells if a file or a directory is left out, rel is its path in the directory with forward slashes
+func (i *syncIgnore) match(rel string, dir bool) bool {
+	if i == nil {
+		return false
+	}
+	ignored := false
+	for _, pattern := range i.patterns {
+		if pattern.dirOnly && !dir {
+			continue
+		}
+		var matched bool
+		if pattern.anchored {
+			matched = matchSegments(pattern.segments, strings.Split(rel, "/"))
+		} else {
+			matched = matchSegments(pattern.segments, []string{path.Base(rel)})
+		}
+		if matched {
+			ignored = !pattern.negate
+		}
+	}
+	return ignored
+}
+
+// matchSegments matches a path against the segments of a pattern
+func matchSegments(pattern []string, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for skipped := 0; skipped <= len(name); skipped++ {
+			if matchSegments(pattern[1:], name[skipped:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	matched, _ := path.Match(pattern[0], name[0])
+	return matched && matchSegments(pattern[1:], name[1:])
+}
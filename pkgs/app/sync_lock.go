@@ -0,0 +1,226 @@
+package app
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/keskad/loco/pkgs/decoders"
+)
+
+//
+// Context: a watch keeps syncing the directory while a manual sync of the same slot is started in another terminal,
+// or a second laptop syncs its copy of the project. Their uploads and deletions would interleave. A sync takes
+// a lockfile in the directory and a sentinel file in the slot of the decoder, the other syncs refuse to start.
+// A lock left by a sync that was killed is taken over when its process is gone, or when it was not refreshed
+// for syncLockStale.
+//
+
+// syncLockFile is the lock in the synchronised directory and the sentinel in the slot, it is never synchronised
+const syncLockFile = ".loco-sync.lock"
+
+// syncLockStale is how long a lock that is not refreshed is respected, a running sync refreshes it every syncLockRefresh
+var (
+	syncLockStale   = 10 * time.Minute
+	syncLockRefresh = time.Minute
+)
+
+// syncLockHolder is the content of the lockfile and of the sentinel
+type syncLockHolder struct {
+	Host      string    `json:"host"`
+	PID       int       `json:"pid"`
+	Slot      uint8     `json:"slot"`
+	Token     string    `json:"token"`
+	Started   time.Time `json:"started"`
+	Refreshed time.Time `json:"refreshed"`
+}
+
+func (h syncLockHolder) String() string {
+	return fmt.Sprintf("process %d on %s since %s", h.PID, h.Host, h.Started.Local().Format(time.TimeOnly))
+}
+
+// stale tells if the holder is gone: its process does not run on this machine, or it stopped refreshing the lock
+func (h syncLockHolder) stale(now time.Time) bool {
+	if host, _ := os.Hostname(); h.Host == host && !processRunning(h.PID) {
+		return true
+	}
+	return now.Sub(h.Refreshed) > syncLockStale
+}
+
+// processRunning tells if a process of this machine is running, on Windows finding it is enough
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	return !errors.Is(process.Signal(syscall.Signal(0)), os.ErrProcessDone)
+}
+
+// syncLock is held by a sync from its start until it is released
+type syncLock struct {
+	rb        decoders.Decoder
+	localPath string
+	holder    syncLockHolder
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+// lockSync takes the lockfile of localDir and the sentinel of the slot, and refreshes both until released.
+// The sentinel is checked, uploaded and read back, two syncs started at the same moment find only one of them.
+func (app *LocoApp) lockSync(rb decoders.Decoder, slot uint8, localDir string) (*syncLock, error) {
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	now := time.Now().UTC()
+	lock := &syncLock{
+		rb:        rb,
+		localPath: filepath.Join(localDir, syncLockFile),
+		holder:    syncLockHolder{Host: host, PID: os.Getpid(), Slot: slot, Token: hex.EncodeToString(token), Started: now, Refreshed: now},
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	if err := lock.lockLocal(); err != nil {
+		return nil, err
+	}
+	if err := lock.lockRemote(); err != nil {
+		_ = os.Remove(lock.localPath)
+		return nil, err
+	}
+	go lock.keepRefreshed()
+	return lock, nil
+}
+
+func (l *syncLock) lockLocal() error {
+	data, err := json.Marshal(l.holder)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(l.localPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			_, err = f.Write(data)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				_ = os.Remove(l.localPath)
+				return fmt.Errorf("cannot write the sync lock: %w", err)
+			}
+			return nil
+		}
+		if !errors.Is(err, os.ErrExist) || attempt > 0 {
+			return fmt.Errorf("cannot create the sync lock: %w", err)
+		}
+
+		content, readErr := os.ReadFile(l.localPath)
+		holder := syncLockHolder{}
+		if readErr == nil && json.Unmarshal(content, &holder) == nil && !holder.stale(time.Now()) {
+			return fmt.Errorf("%q is being synchronised with slot %d by %s, remove %s if it is not",
+				filepath.Dir(l.localPath), holder.Slot, holder, syncLockFile)
+		}
+		logrus.Warnf("sync: taking over the stale lock of %s", holder)
+		if err := os.Remove(l.localPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("cannot remove the stale sync lock: %w", err)
+		}
+	}
+}
+
+func (l *syncLock) lockRemote() error {
+	files, err := l.rb.ListSoundSlot(l.holder.Slot)
+	if err != nil {
+		return fmt.Errorf("cannot list slot %d on decoder: %w", l.holder.Slot, err)
+	}
+	if slices.ContainsFunc(files, func(file decoders.RemoteFileInfo) bool { return file.Name == syncLockFile }) {
+		holder, err := l.readRemote()
+		if err == nil && !holder.stale(time.Now()) {
+			return fmt.Errorf("slot %d is being synchronised by %s, delete %s from the slot if it is not",
+				l.holder.Slot, holder, syncLockFile)
+		}
+		logrus.Warnf("sync: taking over the stale lock of slot %d of %s", l.holder.Slot, holder)
+	}
+	if err := l.writeRemote(); err != nil {
+		return err
+	}
+	holder, err := l.readRemote()
+	if err != nil {
+		return err
+	}
+	if holder.Token != l.holder.Token {
+		return fmt.Errorf("slot %d is being synchronised by %s", l.holder.Slot, holder)
+	}
+	return nil
+}
+
+func (l *syncLock) readRemote() (syncLockHolder, error) {
+	holder := syncLockHolder{}
+	data, err := l.rb.DownloadSoundFile(l.holder.Slot, syncLockFile)
+	if err != nil {
+		return holder, fmt.Errorf("cannot read the sync lock of slot %d: %w", l.holder.Slot, err)
+	}
+	if err := json.Unmarshal(data, &holder); err != nil {
+		return holder, fmt.Errorf("cannot parse the sync lock of slot %d: %w", l.holder.Slot, err)
+	}
+	return holder, nil
+}
+
+func (l *syncLock) writeRemote() error {
+	data, err := json.Marshal(l.holder)
+	if err != nil {
+		return err
+	}
+	if err := l.rb.UploadSoundFile(l.holder.Slot, syncLockFile, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("cannot lock slot %d on decoder: %w", l.holder.Slot, err)
+	}
+	return nil
+}
+
+// keepRefreshed rewrites the lockfile and the sentinel every syncLockRefresh until the lock is released
+func (l *syncLock) keepRefreshed() {
+	defer close(l.stopped)
+	ticker := time.NewTicker(syncLockRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.holder.Refreshed = time.Now().UTC()
+			if data, err := json.Marshal(l.holder); err == nil {
+				if err := os.WriteFile(l.localPath, data, 0o644); err != nil {
+					logrus.Warnf("sync: cannot refresh the sync lock: %s", err)
+				}
+			}
+			if err := l.writeRemote(); err != nil {
+				logrus.Warnf("sync: cannot refresh the sync lock: %s", err)
+			}
+		}
+	}
+}
+
+// release removes the sentinel and the lockfile, a sentinel left on the decoder goes stale by itself
+func (l *syncLock) release() {
+	close(l.stop)
+	<-l.stopped
+	if err := l.rb.DeleteSoundFile(l.holder.Slot, syncLockFile); err != nil {
+		logrus.Warnf("sync: cannot remove the sync lock of slot %d: %s", l.holder.Slot, err)
+	}
+	if err := os.Remove(l.localPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logrus.Warnf("sync: cannot remove the sync lock: %s", err)
+	}
+}
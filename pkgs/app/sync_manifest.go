@@ -0,0 +1,158 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+//
+// Context: a sound project kept in a repository. The slot manifest describes what every function plays,
+// so a reviewer does not have to decode it from the file names. It is checked against the directory before a sync
+// and is uploaded with the sounds, the decoder keeps it next to them.
+//
+
+// slotManifestFile is the optional manifest of a sound directory
+const slotManifestFile = "slot.yaml"
+
+// slotManifest is the content of slot.yaml, e.g.
+//
+//	sounds:
+//	  - function: F1
+//	    file: F1_Horn.wav
+//	    volume: 80
+//	  - function: F2
+//	    file: F2_Engine.wav
+//	    loop: true
+//	protected:
+//	  - F0_*
+type slotManifest struct {
+	Sounds []slotSound
+	// Protected are the patterns of the files of the decoder a sync does not delete, see loadSyncProtection
+	Protected []string
+}
+
+// slotSound assigns a file to a function, the function is given as "F1" or 1
+type slotSound struct {
+	Function string
+	File     string
+	// Volume is in percent, nil plays the file as it is
+	Volume *int
+	Loop   bool
+}
+
+// loadSlotManifest reads slot.yaml of a directory, a missing file returns a nil manifest
+func loadSlotManifest(localDir string) (*slotManifest, error) {
+	path := filepath.Join(localDir, slotManifestFile)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("yaml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("cannot read the slot manifest %q: %s", path, err)
+	}
+	manifest := &slotManifest{}
+	if err := v.Unmarshal(manifest); err != nil {
+		return nil, fmt.Errorf("cannot parse the slot manifest %q: %s", path, err)
+	}
+	return manifest, nil
+}
+
+// validate checks the manifest against the files of the directory. Every listed file has to be present
+// and named after its function, as the decoder assigns the sounds by the "F<n>_" prefix. All problems are returned together.
+// The files of the directory that are not listed are returned too, they are uploaded, but nothing describes them.
+func (m *slotManifest) validate(localFiles map[string]syncLocalFile) (unlisted []string, err error) {
+	problems, unlisted := m.problems(localFiles)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid slot manifest %s:\n  %s", slotManifestFile, strings.Join(problems, "\n  "))
+	}
+	return unlisted, nil
+}
+
+// problems are what validate reports, one per line
+func (m *slotManifest) problems(localFiles map[string]syncLocalFile) (problems []string, unlisted []string) {
+	listed := make(map[string]bool, len(m.Sounds))
+	for i, sound := range m.Sounds {
+		entry := fmt.Sprintf("sound %d", i+1)
+		if sound.File != "" {
+			entry = fmt.Sprintf("sound %d (%s)", i+1, sound.File)
+		}
+		fn, ok := parseManifestFunction(sound.Function)
+		switch {
+		case sound.Function == "":
+			problems = append(problems, entry+": the function is missing")
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s: invalid function %q, expected e.g. F1", entry, sound.Function))
+		}
+		if sound.File == "" {
+			problems = append(problems, entry+": the file is missing")
+			continue
+		}
+		if listed[sound.File] {
+			problems = append(problems, entry+": the file is listed more than once")
+		}
+		listed[sound.File] = true
+		if _, present := localFiles[sound.File]; !present {
+			problems = append(problems, entry+": the file is not in the directory")
+		}
+		if prefixFn, hasPrefix := soundFunction(sound.File); ok && (!hasPrefix || prefixFn != fn) {
+			problems = append(problems, fmt.Sprintf("%s: the file of F%d has to be named F%d_...", entry, fn, fn))
+		}
+		if sound.Volume != nil && (*sound.Volume < 0 || *sound.Volume > 100) {
+			problems = append(problems, fmt.Sprintf("%s: volume %d is out of 0-100", entry, *sound.Volume))
+		}
+	}
+	for name := range localFiles {
+		if name != slotManifestFile && !listed[name] {
+			unlisted = append(unlisted, name)
+		}
+	}
+	sort.Strings(unlisted)
+	return problems, unlisted
+}
+
+// parseManifestFunction accepts "F1", "f1" and "1"
+func parseManifestFunction(s string) (int, bool) {
+	s = strings.TrimSpace(s)
+	if fn, ok := parseFunction(s); ok {
+		return fn, true
+	}
+	fn, err := strconv.Atoi(s)
+	return fn, err == nil && fn >= 0
+}
+
+// soundFunction returns the function a sound file is assigned to by its name
+func soundFunction(name string) (int, bool) {
+	m := reFunctionPrefix.FindStringSubmatch(name)
+	if m == nil {
+		return 0, false
+	}
+	fn, err := strconv.Atoi(m[1])
+	return fn, err == nil
+}
+
+// checkSlotManifest validates slot.yaml of a directory that is about to be uploaded, when there is one
+func checkSlotManifest(localDir string, localFiles map[string]syncLocalFile) error {
+	manifest, err := loadSlotManifest(localDir)
+	if manifest == nil || err != nil {
+		return err
+	}
+	unlisted, err := manifest.validate(localFiles)
+	if err != nil {
+		return err
+	}
+	for _, name := range unlisted {
+		logrus.Warnf("sync: %q is not listed in %s", name, slotManifestFile)
+	}
+	logrus.Debugf("sync: %s describes %d sound(s)", slotManifestFile, len(manifest.Sounds))
+	return nil
+}
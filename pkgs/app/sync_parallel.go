@@ -0,0 +1,93 @@
+package app
+
+import (
+	"errors"
+	"sync"
+)
+
+//
+// Context: provisioning a slot with dozens of samples. The decoder accepts a few uploads at once,
+// so the files are transferred by a pool of workers, while the output stays in the order of the files.
+//
+
+// syncItem is a single file of SyncSoundSlot, transfer is nil when nothing is copied
+type syncItem struct {
+	compared SyncEvent
+	transfer func(progress SyncProgressFunc) error
+}
+
+// orderedProgress passes the events of the items on in their order, as if they ran one by one.
+// The events of the first unfinished item are passed on at once, the others are held back until it finishes.
+type orderedProgress struct {
+	mu       sync.Mutex
+	out      SyncProgressFunc
+	next     int
+	held     map[int][]SyncEvent
+	finished map[int]bool
+}
+
+func newOrderedProgress(out SyncProgressFunc) *orderedProgress {
+	return &orderedProgress{out: out, held: map[int][]SyncEvent{}, finished: map[int]bool{}}
+}
+
+// of returns the progress callback of the item at index
+func (o *orderedProgress) of(index int) SyncProgressFunc {
+	return func(event SyncEvent) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		if index == o.next {
+			o.out(event)
+			return
+		}
+		o.held[index] = append(o.held[index], event)
+	}
+}
+
+// finish passes on the held events of the items that are next in order
+func (o *orderedProgress) finish(index int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.finished[index] = true
+	for o.finished[o.next] {
+		delete(o.finished, o.next)
+		o.next++
+		for _, event := range o.held[o.next] {
+			o.out(event)
+		}
+		delete(o.held, o.next)
+	}
+}
+
+// runSyncItems transfers the items with up to parallel workers, a failed transfer does not stop the others.
+// The errors are returned together, in the order of the items.
+func runSyncItems(items []syncItem, parallel int, progress SyncProgressFunc) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+	ordered := newOrderedProgress(progress)
+	errs := make([]error, len(items))
+	queue := make(chan int, len(items))
+
+	var wg sync.WaitGroup
+	for range min(parallel, len(items)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range queue {
+				errs[index] = items[index].transfer(ordered.of(index))
+				ordered.finish(index)
+			}
+		}()
+	}
+	for index, item := range items {
+		ordered.of(index)(item.compared)
+		if item.transfer == nil {
+			ordered.finish(index)
+			continue
+		}
+		queue <- index
+	}
+	close(queue)
+	wg.Wait()
+	return errors.Join(errs...)
+}
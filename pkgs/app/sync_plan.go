@@ -0,0 +1,90 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// SyncPlan is what SyncSoundSlot does to a slot, decided before anything is transferred.
+// A dry run returns the plan without carrying it out, e.g. for "loco decoder rb sound sync --dry-run --output json".
+type SyncPlan struct {
+	Slot      uint8         `json:"slot"`
+	Direction SyncDirection `json:"direction"`
+	DryRun    bool          `json:"dryRun"`
+	// Uploads are the files missing on the decoder
+	Uploads []SyncPlanEntry `json:"uploads"`
+	// Reuploads replace the changed files of the decoder or continue their interrupted uploads
+	Reuploads []SyncPlanEntry `json:"reuploads"`
+	Downloads []SyncPlanEntry `json:"downloads"`
+	// Renames are the files of the decoder found under a new name locally, renamed on the decoder when it can,
+	// otherwise uploaded under the new name before the old file is deleted
+	Renames []SyncPlanEntry `json:"renames"`
+	// Deletions are the files of the decoder missing locally, deleted after all the uploads succeeded
+	Deletions []SyncPlanEntry `json:"deletions"`
+	// Skipped are the files left as they are, the reason tells why
+	Skipped []SyncPlanEntry `json:"skipped"`
+	// NeedBytes is the space the uploads take on the decoder, less what the replaced files free
+	NeedBytes int64 `json:"needBytes"`
+}
+
+// SyncPlanEntry is a file of a SyncPlan, with the reason of a SyncCompare event
+type SyncPlanEntry struct {
+	// File is the name on the decoder
+	File   string `json:"file"`
+	Reason string `json:"reason"`
+	// Source is the file of the local directory uploaded as File, when it is not File itself:
+	// a file of a subdirectory or a converted sound
+	Source string `json:"source,omitempty"`
+	// From is the old name of a renamed file
+	From         string `json:"from,omitempty"`
+	LocalSizeKB  int64  `json:"localSizeKB,omitempty"`
+	RemoteSizeKB int64  `json:"remoteSizeKB,omitempty"`
+}
+
+// newSyncPlan returns an empty plan, its lists are empty rather than null in JSON
+func newSyncPlan(slot uint8, options SyncOptions) *SyncPlan {
+	return &SyncPlan{
+		Slot:      slot,
+		Direction: options.Direction,
+		DryRun:    options.DryRun,
+		Uploads:   []SyncPlanEntry{},
+		Reuploads: []SyncPlanEntry{},
+		Downloads: []SyncPlanEntry{},
+		Renames:   []SyncPlanEntry{},
+		Deletions: []SyncPlanEntry{},
+		Skipped:   []SyncPlanEntry{},
+	}
+}
+
+// add puts an entry on the list of its reason
+func (p *SyncPlan) add(entry SyncPlanEntry) {
+	switch entry.Reason {
+	case SyncReasonNew:
+		p.Uploads = append(p.Uploads, entry)
+	case SyncReasonChanged, SyncReasonResume:
+		p.Reuploads = append(p.Reuploads, entry)
+	case SyncReasonRemote, SyncReasonRemoteChanged:
+		p.Downloads = append(p.Downloads, entry)
+	case SyncReasonRename:
+		p.Renames = append(p.Renames, entry)
+	case SyncReasonOrphan:
+		p.Deletions = append(p.Deletions, entry)
+	default:
+		p.Skipped = append(p.Skipped, entry)
+	}
+}
+
+// Changes is the number of files the plan transfers or deletes
+func (p *SyncPlan) Changes() int {
+	return len(p.Uploads) + len(p.Reuploads) + len(p.Downloads) + len(p.Renames) + len(p.Deletions)
+}
+
+// PrintSyncPlan prints a plan as an indented JSON document
+func (app *LocoApp) PrintSyncPlan(plan *SyncPlan) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot encode the sync plan: %w", err)
+	}
+	_, _ = app.P.Printf("%s\n", data)
+	return nil
+}
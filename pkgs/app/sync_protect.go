@@ -0,0 +1,44 @@
+package app
+
+import "fmt"
+
+//
+// Context: the startup and shutdown loops of a slot come with the sound project of the manufacturer and are not
+// kept in every working directory. A sync of a directory without them would delete them from the decoder as orphans.
+// The protected files are listed in slot.yaml or with --keep, the patterns of .locoignore, and are deleted by
+// a push only with --force.
+//
+
+// loadSyncProtection reads the protected patterns of slot.yaml of a directory and appends the keeps
+func loadSyncProtection(localDir string, keep []string) (*syncIgnore, error) {
+	protected := &syncIgnore{}
+	manifest, err := loadSlotManifest(localDir)
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil {
+		for _, pattern := range manifest.Protected {
+			if err := protected.add(pattern); err != nil {
+				return nil, fmt.Errorf("invalid slot manifest %s, protected: %w", slotManifestFile, err)
+			}
+		}
+	}
+	for _, pattern := range keep {
+		if err := protected.add(pattern); err != nil {
+			return nil, fmt.Errorf("--keep: %w", err)
+		}
+	}
+	return protected, nil
+}
+
+// withoutProtected leaves out the protected files of the decoder missing locally, so they are not renamed either
+func withoutProtected(remoteFiles map[string]int64, localFiles map[string]syncLocalFile, protected *syncIgnore) map[string]int64 {
+	kept := make(map[string]int64, len(remoteFiles))
+	for name, sizeKB := range remoteFiles {
+		if _, existsLocally := localFiles[name]; !existsLocally && protected.match(name, false) {
+			continue
+		}
+		kept[name] = sizeKB
+	}
+	return kept
+}
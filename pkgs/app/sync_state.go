@@ -0,0 +1,372 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keskad/loco/pkgs/audio"
+)
+
+//
+// Context: a sound slot edited by more than one person. The decoder lists only names and sizes, so the time
+// a file on the decoder was last changed is only known when this machine put it there or fetched it.
+// That is remembered in a state file in the local directory, per slot.
+//
+
+// SyncDirection selects which side SyncSoundSlot changes
+type SyncDirection string
+
+const (
+	// SyncPush makes the slot a copy of the local directory, files missing locally are deleted from the decoder
+	SyncPush SyncDirection = "push"
+	// SyncPull downloads the files missing or differing locally, local files missing on the decoder are kept
+	SyncPull SyncDirection = "pull"
+	// SyncBoth copies the files missing on either side and keeps the newer version of a file, nothing is deleted
+	SyncBoth SyncDirection = "both"
+)
+
+// SyncOptions shape a run of SyncSoundSlot
+type SyncOptions struct {
+	Direction SyncDirection
+	// DryRun only reports the changes
+	DryRun bool
+	// Parallel is the number of files transferred at once, 0 and 1 transfer them one by one
+	Parallel int
+	// MismatchRetries is how many times a file missing or truncated on the decoder after the upload is sent again
+	MismatchRetries int
+	// Transcoder converts the sound files the decoder cannot play before the upload, nil uploads them as they are
+	Transcoder audio.Transcoder
+	// TranscodeCache keeps the converted files, empty is a directory of the user cache
+	TranscodeCache string
+	// Exclude are patterns of the files left alone in addition to the ones of .locoignore, see syncIgnore
+	Exclude []string
+	// Keep are patterns of the protected files in addition to the ones of slot.yaml, see loadSyncProtection
+	Keep []string
+	// Force deletes the protected files missing locally as well
+	Force bool
+	// Lint checks the names of the sounds before an upload, see lintSoundDir
+	Lint bool
+	// Audition plays the uploaded sounds over the command station after the sync, nil does not
+	Audition *Audition
+}
+
+// ParseSyncDirection validates the --direction of a sync, empty is SyncPush
+func ParseSyncDirection(direction string) (SyncDirection, error) {
+	switch SyncDirection(direction) {
+	case "", SyncPush:
+		return SyncPush, nil
+	case SyncPull, SyncBoth:
+		return SyncDirection(direction), nil
+	}
+	return "", fmt.Errorf("invalid sync direction %q: must be 'push', 'pull' or 'both'", direction)
+}
+
+// syncStateFile is kept in the synchronised directory and is never uploaded
+const syncStateFile = ".loco-sync.json"
+
+// syncedFile is a file as it was when it was last uploaded or downloaded
+type syncedFile struct {
+	// SizeKB is the size listed by the decoder
+	SizeKB int64 `json:"sizeKB"`
+	// ModTime is the modification time of the local file at that moment
+	ModTime time.Time `json:"modTime"`
+	// SHA256 is the checksum of the content, missing in the records of the older versions
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// partialUpload is a file whose upload was interrupted, it is continued at Offset while the local file stays the same
+type partialUpload struct {
+	SizeBytes int64     `json:"sizeBytes"`
+	ModTime   time.Time `json:"modTime"`
+	Offset    int64     `json:"offset"`
+}
+
+type syncState struct {
+	Slots map[uint8]map[string]syncedFile `json:"slots"`
+	// Partial uploads by slot and file name
+	Partial map[uint8]map[string]partialUpload `json:"partial,omitempty"`
+}
+
+// loadSyncState reads the state file of a directory, a missing file is an empty state
+func loadSyncState(localDir string) (*syncState, error) {
+	state := &syncState{Slots: map[uint8]map[string]syncedFile{}}
+	data, err := os.ReadFile(filepath.Join(localDir, syncStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the sync state: %w", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("cannot parse the sync state %q: %w", syncStateFile, err)
+	}
+	if state.Slots == nil {
+		state.Slots = map[uint8]map[string]syncedFile{}
+	}
+	return state, nil
+}
+
+func (s *syncState) save(localDir string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(localDir, syncStateFile), data, 0o644); err != nil {
+		return fmt.Errorf("cannot save the sync state: %w", err)
+	}
+	return nil
+}
+
+// resumeOffset returns where an interrupted upload of the local file continues, 0 when it has to start again
+func (s *syncState) resumeOffset(slot uint8, name string, local syncLocalFile, remoteSizeKB *int64) int64 {
+	partial, ok := s.Partial[slot][name]
+	if !ok || partial.SizeBytes != local.sizeBytes || !partial.ModTime.Equal(local.modTime) {
+		return 0
+	}
+	// the decoder has to hold what was recorded, a file replaced on the decoder in the meantime is sent whole
+	if remoteSizeKB == nil || !sameSize(*remoteSizeKB, (partial.Offset+1023)/1024) {
+		return 0
+	}
+	return partial.Offset
+}
+
+// uploaded records how much of a local file is stored on the decoder, a complete upload clears the record
+func (s *syncState) uploaded(slot uint8, name string, local syncLocalFile, offset int64) {
+	if offset >= local.sizeBytes {
+		delete(s.Partial[slot], name)
+		return
+	}
+	if s.Partial == nil {
+		s.Partial = map[uint8]map[string]partialUpload{}
+	}
+	if s.Partial[slot] == nil {
+		s.Partial[slot] = map[string]partialUpload{}
+	}
+	s.Partial[slot][name] = partialUpload{SizeBytes: local.sizeBytes, ModTime: local.modTime, Offset: offset}
+}
+
+func (s *syncState) slot(slot uint8) map[string]syncedFile {
+	files, ok := s.Slots[slot]
+	if !ok {
+		files = map[string]syncedFile{}
+		s.Slots[slot] = files
+	}
+	return files
+}
+
+// syncLocalFile is a file of the synchronised directory
+type syncLocalFile struct {
+	sizeBytes int64
+	modTime   time.Time
+	// path is set when another file is uploaded in place of the file of the directory, e.g. a converted copy
+	path string
+	// rel is the file of the directory uploaded under another name, with forward slashes:
+	// a file of a subdirectory, see flattenSoundPath, or the source of a converted copy
+	rel string
+	// hash is the SHA-256 checksum of the uploaded content, see checksum
+	hash string
+}
+
+// checksum returns the SHA-256 checksum of what is uploaded under name
+func (f syncLocalFile) checksum(localDir string, name string) (string, error) {
+	path := f.path
+	if path == "" {
+		path = f.file(localDir, name)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read %q: %w", name, err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("cannot read %q: %w", name, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// file returns where the file uploaded under name is kept in the directory
+func (f syncLocalFile) file(localDir string, name string) string {
+	if f.rel != "" {
+		return filepath.Join(localDir, filepath.FromSlash(f.rel))
+	}
+	return filepath.Join(localDir, name)
+}
+
+// flattenSoundPath returns the name on the decoder of a file in a subdirectory, the slots of the decoder
+// have no subdirectories: "F1/Horn.wav" is uploaded as "F1_Horn.wav", "diesel/F2/start.wav" as "diesel_F2_start.wav"
+func flattenSoundPath(rel string) string {
+	return strings.ReplaceAll(rel, "/", "_")
+}
+
+// listSyncLocalFiles returns the files of a sound directory and of its subdirectories by their names on the decoder.
+// Hidden subdirectories, e.g. ".git", and what the ignore patterns match are left out.
+func listSyncLocalFiles(localDir string, ignore *syncIgnore) (map[string]syncLocalFile, error) {
+	localFiles := map[string]syncLocalFile{}
+	sources := map[string]string{}
+	err := filepath.WalkDir(localDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, filePath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if entry.IsDir() {
+			if rel != "." && (strings.HasPrefix(entry.Name(), ".") || ignore.match(rel, true)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if rel == syncStateFile || rel == syncLockFile || rel == syncIgnoreFile || ignore.match(rel, false) {
+			return nil
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("cannot stat %q: %w", rel, err)
+		}
+		name := flattenSoundPath(rel)
+		if source, taken := sources[name]; taken {
+			return fmt.Errorf("both %q and %q would be uploaded as %q, rename one of them", source, rel, name)
+		}
+		sources[name] = rel
+		local := syncLocalFile{sizeBytes: fi.Size(), modTime: fi.ModTime()}
+		if name != rel {
+			local.rel = rel
+		}
+		localFiles[name] = local
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read local directory %q: %w", localDir, err)
+	}
+	return localFiles, nil
+}
+
+func (f syncLocalFile) sizeKB() int64 {
+	// decoder reports size in KB (1 KB = 1024 bytes); round up local size
+	return (f.sizeBytes + 1023) / 1024
+}
+
+// sameSize tells if the sizes of a file match within the rounding of the decoder listing
+func sameSize(aKB, bKB int64) bool {
+	diff := aKB - bKB
+	return diff >= -1 && diff <= 1
+}
+
+// syncRenames pairs the files of the decoder missing locally with the new local files of the same content,
+// by the checksums recorded when they were transferred. It returns the old names by the new ones.
+// Only a push renames, the other directions do not delete the old files.
+func syncRenames(direction SyncDirection, localFiles map[string]syncLocalFile, remoteFiles map[string]int64, synced map[string]syncedFile) map[string]string {
+	renames := map[string]string{}
+	if direction != SyncPush {
+		return renames
+	}
+	// the file of the decoder has to be what was recorded, the first one by name is taken for a copied file
+	var gone []string
+	for name, sizeKB := range remoteFiles {
+		_, existsLocally := localFiles[name]
+		if record, ok := synced[name]; !existsLocally && ok && record.SHA256 != "" && record.SizeKB == sizeKB {
+			gone = append(gone, name)
+		}
+	}
+	sort.Strings(gone)
+	byHash := make(map[string]string, len(gone))
+	for _, name := range gone {
+		if _, taken := byHash[synced[name].SHA256]; !taken {
+			byHash[synced[name].SHA256] = name
+		}
+	}
+
+	var added []string
+	for name := range localFiles {
+		if _, existsRemotely := remoteFiles[name]; !existsRemotely {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	for _, name := range added {
+		if from, ok := byHash[localFiles[name].hash]; ok && localFiles[name].hash != "" {
+			renames[name] = from
+			delete(byHash, localFiles[name].hash)
+		}
+	}
+	return renames
+}
+
+// syncReason decides what happens to a file present on at least one side, local and remote are nil when it is missing there.
+// The reason tells the direction: SyncReasonNew and SyncReasonChanged upload the local file,
+// SyncReasonRemote and SyncReasonRemoteChanged download it and SyncReasonOrphan deletes it from the decoder.
+//
+// A file with a checksum recorded at its last transfer is the same while its content and the size listed by
+// the decoder are unchanged, an edit keeping the size is found too. Without a record only the sizes are compared,
+// within the rounding of the listing.
+func syncReason(direction SyncDirection, local *syncLocalFile, remoteSizeKB *int64, synced *syncedFile) string {
+	switch {
+	case remoteSizeKB == nil && direction == SyncPull:
+		return SyncReasonLocalOnly
+	case remoteSizeKB == nil:
+		return SyncReasonNew
+	case local == nil && direction == SyncPush:
+		return SyncReasonOrphan
+	case local == nil:
+		return SyncReasonRemote
+	}
+
+	if synced != nil && synced.SHA256 != "" && local.hash != "" {
+		localChanged := local.hash != synced.SHA256
+		remoteChanged := *remoteSizeKB != synced.SizeKB
+		switch {
+		case !localChanged && !remoteChanged:
+			return SyncReasonSame
+		case direction == SyncPush:
+			return SyncReasonChanged
+		case direction == SyncPull:
+			return SyncReasonRemoteChanged
+		case localChanged && remoteChanged:
+			return SyncReasonConflict
+		case remoteChanged:
+			return SyncReasonRemoteChanged
+		}
+		return SyncReasonChanged
+	}
+
+	differs := !sameSize(local.sizeKB(), *remoteSizeKB)
+	switch direction {
+	case SyncPull:
+		if differs {
+			return SyncReasonRemoteChanged
+		}
+		return SyncReasonSame
+	case SyncBoth:
+		// without a record of the last transfer neither side is known to be newer
+		remoteChanged := synced == nil || !sameSize(synced.SizeKB, *remoteSizeKB)
+		localChanged := synced == nil || local.modTime.After(synced.ModTime)
+		if !differs {
+			return SyncReasonSame
+		}
+		if remoteChanged && localChanged {
+			return SyncReasonConflict
+		}
+		if remoteChanged {
+			return SyncReasonRemoteChanged
+		}
+		return SyncReasonChanged
+	}
+
+	if differs {
+		return SyncReasonChanged
+	}
+	return SyncReasonSame
+}
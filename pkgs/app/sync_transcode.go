@@ -0,0 +1,114 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/keskad/loco/pkgs/audio"
+	"github.com/keskad/loco/pkgs/decoders"
+)
+
+//
+// Context: sounds exported by an editor or downloaded from a library, in stereo, at 48 kHz or as MP3.
+// The decoder plays only its own WAV format, so such files are converted before the upload. The converted copies
+// are kept in a cache outside of the sound directory, the directory stays as the author left it.
+//
+
+// transcodeLocalFiles replaces the sound files the decoder cannot play by converted copies, uploaded under
+// the name with a .wav extension. A copy is made once for every version of the local file.
+func (app *LocoApp) transcodeLocalFiles(slot uint8, localDir string, localFiles map[string]syncLocalFile, options SyncOptions, progress SyncProgressFunc) (map[string]syncLocalFile, error) {
+	cacheDir := options.TranscodeCache
+	if cacheDir == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("cannot find a cache directory for the converted sounds: %w", err)
+		}
+		cacheDir = filepath.Join(userCache, "loco", "transcoded")
+	}
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return nil, fmt.Errorf("cannot create the cache of the converted sounds: %w", err)
+	}
+
+	names := make([]string, 0, len(localFiles))
+	for name := range localFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// the names are checked before anything is converted
+	targets := make(map[string]string, len(localFiles))
+	sources := map[string]string{}
+	for _, name := range names {
+		target := name
+		if ext := filepath.Ext(name); audio.IsSound(name) && !strings.EqualFold(ext, ".wav") {
+			target = strings.TrimSuffix(name, ext) + ".wav"
+		}
+		if source, taken := sources[target]; taken {
+			return nil, fmt.Errorf("both %q and %q would be uploaded as %q, remove one of them", source, name, target)
+		}
+		sources[target] = name
+		targets[name] = target
+	}
+
+	converted := make(map[string]syncLocalFile, len(localFiles))
+	for _, name := range names {
+		local := localFiles[name]
+		if audio.IsSound(name) {
+			path := local.file(localDir, name)
+			compatible, err := audio.Compatible(path, decoders.SOUND_FORMAT)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read %q: %w", name, err)
+			}
+			if !compatible {
+				if local, err = app.transcodeCached(slot, name, targets[name], path, local, cacheDir, options, progress); err != nil {
+					return nil, err
+				}
+			}
+		}
+		converted[targets[name]] = local
+	}
+	return converted, nil
+}
+
+// transcodeCached returns the converted copy of a local file, converting it when the cache has none
+func (app *LocoApp) transcodeCached(slot uint8, name, target, path string, local syncLocalFile, cacheDir string, options SyncOptions, progress SyncProgressFunc) (syncLocalFile, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return local, err
+	}
+	key := sha256.Sum256(fmt.Appendf(nil, "%s|%d|%d|%s|%s", absPath, local.sizeBytes, local.modTime.UnixNano(), decoders.SOUND_FORMAT, options.Transcoder.Name()))
+	cached := filepath.Join(cacheDir, hex.EncodeToString(key[:16])+".wav")
+
+	if _, err := os.Stat(cached); err == nil {
+		logrus.Debugf("sync: using the converted copy %s of %q", cached, name)
+	} else {
+		progress(SyncEvent{Kind: SyncTranscode, Slot: slot, File: target, Source: name, DryRun: options.DryRun})
+		// an interrupted conversion does not leave a truncated copy behind
+		partial := cached + ".part"
+		if err := options.Transcoder.Transcode(path, partial, decoders.SOUND_FORMAT); err != nil {
+			_ = os.Remove(partial)
+			return local, err
+		}
+		if err := os.Rename(partial, cached); err != nil {
+			return local, fmt.Errorf("cannot store the converted %q: %w", name, err)
+		}
+	}
+
+	info, err := os.Stat(cached)
+	if err != nil {
+		return local, err
+	}
+	// the copy changes only together with the local file
+	source := local.rel
+	if source == "" {
+		source = name
+	}
+	return syncLocalFile{sizeBytes: info.Size(), modTime: local.modTime, path: cached, rel: source}, nil
+}
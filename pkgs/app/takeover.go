@@ -0,0 +1,53 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: the Z21 gives a locomotive to the last device that drove it. A speed or function command sent
+// while the Z21 app or a handset drives it silently takes it away from that operator, so it is refused
+// unless the takeover is deliberate (Steal).
+//
+
+// ErrLocoBusy is returned when the locomotive is driven by another device and Steal was not set
+var ErrLocoBusy = errors.New("controlled by another device")
+
+// controlledElsewhere tells whether another device drives the locomotive, false for stations that do not know it
+func (app *LocoApp) controlledElsewhere(locoId uint8, timeout time.Duration, retries uint8) bool {
+	z21, ok := app.station.(*commandstation.Z21Roco)
+	if !ok || app.DryRun {
+		return false
+	}
+	busy, err := z21.ControlledElsewhere(commandstation.LocoAddr(locoId), commandstation.Timeout(timeout), commandstation.Retries(retries))
+	if err != nil {
+		logrus.Warnf("cannot tell who controls locomotive %d: %s", locoId, err)
+		return false
+	}
+	return busy
+}
+
+// takeOver lets a driving command through, unless another device drives the locomotive and Steal is not set
+func (app *LocoApp) takeOver(locoId uint8, timeout time.Duration, retries uint8) error {
+	if !app.controlledElsewhere(locoId, timeout, retries) {
+		return nil
+	}
+	if !app.Steal {
+		return fmt.Errorf("locomotive %d is %w, use --steal to take it over", locoId, ErrLocoBusy)
+	}
+	logrus.Warnf("taking locomotive %d over from another device", locoId)
+	return nil
+}
+
+// controlNote is appended to the state of a locomotive driven by another device
+func (app *LocoApp) controlNote(locoId uint8, timeout time.Duration, retries uint8) string {
+	if app.controlledElsewhere(locoId, timeout, retries) {
+		return " (controlled by another device)"
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/keskad/loco/pkgs/decoders"
+)
+
+//
+// Context: the WiFi router of a RB23xx draws a lot of current and is left off while the locomotive runs.
+// With --manage-wifi a sound operation switches it on over the track, see RBWifiAction, waits until the web
+// interface of the decoder answers and switches it off again when the operation is done.
+//
+
+// defaultWiFiWait is how long the web interface is waited for after the WiFi was switched on, the decoder
+// starts its access point and this computer has to join it
+const defaultWiFiWait = time.Minute
+
+// wifiPollInterval is the pause between two attempts to reach the web interface
+var wifiPollInterval = 2 * time.Second
+
+// ManagedWiFi selects the locomotive whose WiFi function WithManagedWiFi switches
+type ManagedWiFi struct {
+	// Mode is "pom" or "prog", as for RBWifiAction
+	Mode    string
+	LocoId  uint8
+	Timeout time.Duration
+	Retries uint8
+	// Wait is how long the web interface is waited for, 0 is a minute
+	Wait time.Duration
+}
+
+// WithManagedWiFi runs fn with the WiFi of the decoder switched on, a nil wifi runs fn as it is.
+// The WiFi is switched off afterwards also when fn failed, a decoder answering already is left as it was.
+// The steps are logged, not printed, the output of fn stays as it is, e.g. a JSON document.
+func (app *LocoApp) WithManagedWiFi(wifi *ManagedWiFi, fn func() error, opts ...decoders.Option) (err error) {
+	if wifi == nil {
+		return fn()
+	}
+	if app.decoderAnswers(opts...) {
+		logrus.Infof("wifi: the decoder answers already, its WiFi is left on")
+		return fn()
+	}
+
+	logrus.Infof("wifi: switching the WiFi of loco %d on (%s)", wifi.LocoId, wifi.Mode)
+	if err := app.RBWifiAction(wifi.Mode, wifi.LocoId, true, wifi.Timeout, wifi.Retries); err != nil {
+		return fmt.Errorf("cannot switch the WiFi of the decoder on: %w", err)
+	}
+	defer func() {
+		logrus.Infof("wifi: switching the WiFi of loco %d off (%s)", wifi.LocoId, wifi.Mode)
+		if offErr := app.RBWifiAction(wifi.Mode, wifi.LocoId, false, wifi.Timeout, wifi.Retries); offErr != nil {
+			offErr = fmt.Errorf("cannot switch the WiFi of the decoder off, use \"loco decoder rb wifi off\": %w", offErr)
+			if err == nil {
+				err = offErr
+			} else {
+				logrus.Error(offErr)
+			}
+		}
+	}()
+
+	wait := wifi.Wait
+	if wait <= 0 {
+		wait = defaultWiFiWait
+	}
+	deadline := time.Now().Add(wait)
+	for !app.decoderAnswers(opts...) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the decoder did not answer within %s after its WiFi was switched on, is this computer connected to the WiFi of the decoder?", wait)
+		}
+		time.Sleep(wifiPollInterval)
+	}
+	logrus.Infof("wifi: the decoder answers")
+	return fn()
+}
+
+// decoderAnswers tells if the web interface of the decoder is reached, a request is sent once
+func (app *LocoApp) decoderAnswers(opts ...decoders.Option) bool {
+	probe := append(append([]decoders.Option{}, opts...), decoders.WithTimeout(2), decoders.WithRetryPolicy(decoders.RetryPolicy{Attempts: 1}))
+	rb, err := app.decoder(probe...)
+	if err != nil {
+		return false
+	}
+	_, err = rb.ListSoundSlotNumbers()
+	// a decoder asking for credentials is up
+	return err == nil || errors.Is(err, decoders.ErrUnauthorized)
+}
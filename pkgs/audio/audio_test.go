@@ -0,0 +1,114 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sine returns a clip of a sine wave of the given frequency, one second long, on every channel
+func sine(channels int, sampleRate int, frequency float64) *Clip {
+	clip := &Clip{SampleRate: sampleRate, Samples: make([][]float64, channels)}
+	for ch := range clip.Samples {
+		clip.Samples[ch] = make([]float64, sampleRate)
+		for i := range clip.Samples[ch] {
+			clip.Samples[ch][i] = 0.5 * math.Sin(2*math.Pi*frequency*float64(i)/float64(sampleRate))
+		}
+	}
+	return clip
+}
+
+func peak(samples []float64) float64 {
+	var p float64
+	for _, v := range samples {
+		p = math.Max(p, math.Abs(v))
+	}
+	return p
+}
+
+func TestWAV_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WriteWAV(&buf, sine(2, 8000, 440), 16))
+
+	header, err := ReadHeader(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, Format{Channels: 2, SampleRate: 8000, BitsPerSample: 16}, header.Format)
+	assert.Equal(t, int64(8000*2*2), header.DataSize)
+
+	clip, err := ReadWAV(&buf)
+	assert.NoError(t, err)
+	assert.Len(t, clip.Samples, 2)
+	assert.Len(t, clip.Samples[1], 8000)
+	assert.InDelta(t, 0.5, peak(clip.Samples[0]), 0.001)
+}
+
+func TestReadHeader_FloatAndChunks(t *testing.T) {
+	var wav bytes.Buffer
+	wav.WriteString("RIFF\x00\x00\x00\x00WAVE")
+	// a LIST chunk of an odd size before the format
+	wav.WriteString("LIST\x03\x00\x00\x00abc\x00")
+	format := make([]byte, 16)
+	binary.LittleEndian.PutUint16(format[0:], formatFloat)
+	binary.LittleEndian.PutUint16(format[2:], 1)
+	binary.LittleEndian.PutUint32(format[4:], 48000)
+	binary.LittleEndian.PutUint16(format[14:], 32)
+	wav.WriteString("fmt \x10\x00\x00\x00")
+	wav.Write(format)
+	wav.WriteString("data\x04\x00\x00\x00")
+	_ = binary.Write(&wav, binary.LittleEndian, float32(-0.25))
+
+	clip, err := ReadWAV(&wav)
+	assert.NoError(t, err)
+	assert.Equal(t, 48000, clip.SampleRate)
+	assert.Equal(t, [][]float64{{-0.25}}, clip.Samples)
+
+	_, err = ReadHeader(bytes.NewReader([]byte("ID3\x03not a wav file")))
+	assert.ErrorIs(t, err, ErrNotWAV)
+}
+
+func TestConvert(t *testing.T) {
+	stereo := sine(2, 48000, 440)
+	stereo.Samples[1] = make([]float64, 48000)
+
+	mono := Convert(stereo, 1, 22050)
+	assert.Len(t, mono.Samples, 1)
+	assert.Equal(t, 22050, mono.SampleRate)
+	assert.Len(t, mono.Samples[0], 22050)
+	// the average of the tone and the silent channel
+	assert.InDelta(t, 0.25, peak(mono.Samples[0][100:22000]), 0.01)
+
+	// a tone above the new Nyquist frequency is filtered out
+	high := Convert(sine(1, 48000, 15000), 1, 22050)
+	assert.Less(t, peak(high.Samples[0][100:22000]), 0.05)
+
+	// a single channel is copied
+	assert.Len(t, Convert(sine(1, 8000, 440), 2, 8000).Samples, 2)
+}
+
+func TestNative_Transcode(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "F1_Horn.wav")
+	var buf bytes.Buffer
+	assert.NoError(t, WriteWAV(&buf, sine(2, 44100, 440), 16))
+	assert.NoError(t, os.WriteFile(src, buf.Bytes(), 0o644))
+
+	target := Format{Channels: 1, SampleRate: 22050, BitsPerSample: 16}
+	compatible, err := Compatible(src, target)
+	assert.NoError(t, err)
+	assert.False(t, compatible)
+
+	dst := filepath.Join(dir, "converted.wav")
+	assert.NoError(t, Native{}.Transcode(src, dst, target))
+	compatible, err = Compatible(dst, target)
+	assert.NoError(t, err)
+	assert.True(t, compatible)
+
+	assert.ErrorContains(t, Native{}.Transcode(filepath.Join(dir, "F2_Engine.mp3"), dst, target), "without ffmpeg")
+	assert.True(t, IsSound("F2_Engine.MP3"))
+	assert.False(t, IsSound("slot.yaml"))
+}
@@ -0,0 +1,71 @@
+package audio
+
+import "math"
+
+// RESAMPLE_TAPS is the number of source samples on each side of an output sample, at the lower of the two rates
+const RESAMPLE_TAPS = 16
+
+// Convert mixes the clip to the given number of channels and resamples it to the sample rate.
+// More channels are mixed down to their average, a single channel is copied to all of them.
+func Convert(clip *Clip, channels int, sampleRate int) *Clip {
+	mixed := mix(clip.Samples, channels)
+	if clip.SampleRate == sampleRate {
+		return &Clip{SampleRate: sampleRate, Samples: mixed}
+	}
+	out := &Clip{SampleRate: sampleRate, Samples: make([][]float64, len(mixed))}
+	for ch, samples := range mixed {
+		out.Samples[ch] = resample(samples, clip.SampleRate, sampleRate)
+	}
+	return out
+}
+
+func mix(samples [][]float64, channels int) [][]float64 {
+	if len(samples) == channels || len(samples) == 0 {
+		return samples
+	}
+	frames := len(samples[0])
+	mono := samples[0]
+	if len(samples) > 1 {
+		mono = make([]float64, frames)
+		for _, channel := range samples {
+			for i, v := range channel {
+				mono[i] += v / float64(len(samples))
+			}
+		}
+	}
+	out := make([][]float64, channels)
+	for ch := range out {
+		out[ch] = mono
+	}
+	return out
+}
+
+// resample is a windowed sinc interpolation. When the rate is lowered the kernel is widened,
+// so the frequencies above the new Nyquist frequency are filtered out instead of folding back.
+func resample(samples []float64, from, to int) []float64 {
+	ratio := float64(from) / float64(to)
+	cutoff := math.Min(1, 1/ratio)
+	halfWidth := float64(RESAMPLE_TAPS) / cutoff
+
+	out := make([]float64, len(samples)*to/from)
+	for i := range out {
+		center := float64(i) * ratio
+		first := max(0, int(math.Ceil(center-halfWidth)))
+		last := min(len(samples)-1, int(math.Floor(center+halfWidth)))
+		var sum float64
+		for k := first; k <= last; k++ {
+			x := center - float64(k)
+			window := 0.5 * (1 + math.Cos(math.Pi*x/halfWidth))
+			sum += samples[k] * cutoff * sinc(cutoff*x) * window
+		}
+		out[i] = sum
+	}
+	return out
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
@@ -0,0 +1,122 @@
+package audio
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SOUND_EXTENSIONS are the audio files a transcoder is asked to convert, the other files are left alone
+var SOUND_EXTENSIONS = []string{".wav", ".mp3", ".flac", ".ogg", ".opus", ".m4a", ".aac", ".aif", ".aiff"}
+
+// IsSound tells by the extension if a file is audio
+func IsSound(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, known := range SOUND_EXTENSIONS {
+		if ext == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Compatible tells if a file is a PCM WAV file of exactly the given format, such a file is used as it is
+func Compatible(path string, format Format) (bool, error) {
+	if !strings.EqualFold(filepath.Ext(path), ".wav") {
+		return false, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	header, err := ReadHeader(file)
+	if err != nil {
+		// a broken file is reported by the transcoder
+		return false, nil
+	}
+	return !header.Float && header.Format == format, nil
+}
+
+// Transcoder converts an audio file into a PCM WAV file of the given format
+type Transcoder interface {
+	// Name identifies the transcoder, files converted by another one are converted again
+	Name() string
+	Transcode(src, dst string, format Format) error
+}
+
+// Native converts WAV files of any sample rate, channel count and sample encoding without external tools
+type Native struct{}
+
+func (Native) Name() string {
+	return "native"
+}
+
+func (Native) Transcode(src, dst string, format Format) error {
+	if !strings.EqualFold(filepath.Ext(src), ".wav") {
+		return fmt.Errorf("cannot convert %q without ffmpeg, only WAV files are converted natively", filepath.Base(src))
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	clip, err := ReadWAV(in)
+	if err != nil {
+		return fmt.Errorf("cannot decode %q: %w", filepath.Base(src), err)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := WriteWAV(out, Convert(clip, format.Channels, format.SampleRate), format.BitsPerSample); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// FFmpeg converts every format ffmpeg can read, Path is the binary, empty looks for "ffmpeg" in the PATH
+type FFmpeg struct {
+	Path string
+}
+
+func (FFmpeg) Name() string {
+	return "ffmpeg"
+}
+
+func (f FFmpeg) Transcode(src, dst string, format Format) error {
+	codec := "pcm_s16le"
+	if format.BitsPerSample == 8 {
+		codec = "pcm_u8"
+	}
+	binary := f.Path
+	if binary == "" {
+		binary = "ffmpeg"
+	}
+	cmd := exec.Command(binary, "-nostdin", "-y", "-loglevel", "error", "-i", src,
+		"-ac", strconv.Itoa(format.Channels), "-ar", strconv.Itoa(format.SampleRate), "-c:a", codec,
+		"-map_metadata", "-1", "-f", "wav", dst)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg cannot convert %q: %w: %s", filepath.Base(src), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// NewTranscoder returns the transcoder selected by its name, "native" or "ffmpeg"
+func NewTranscoder(name string, ffmpegPath string) (Transcoder, error) {
+	switch name {
+	case "native":
+		return Native{}, nil
+	case "ffmpeg":
+		return FFmpeg{Path: ffmpegPath}, nil
+	}
+	return nil, fmt.Errorf("unknown transcoder %q: must be 'native' or 'ffmpeg'", name)
+}
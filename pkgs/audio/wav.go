@@ -0,0 +1,215 @@
+package audio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+//
+// Context: sound decoders play uncompressed PCM WAV files of a single format, while sound recordings
+// come in whatever format the recorder or the editor saved. This package reads the common WAV variants
+// and writes the format a decoder expects.
+//
+
+// Format of PCM audio
+type Format struct {
+	Channels      int
+	SampleRate    int
+	BitsPerSample int
+}
+
+func (f Format) String() string {
+	return fmt.Sprintf("%d ch, %d Hz, %d bit", f.Channels, f.SampleRate, f.BitsPerSample)
+}
+
+// WAV format tags of the fmt chunk
+const (
+	formatPCM        = 1
+	formatFloat      = 3
+	formatExtensible = 0xFFFE
+)
+
+// ErrNotWAV is returned for files that are not RIFF WAVE files
+var ErrNotWAV = errors.New("not a WAV file")
+
+// Header describes a WAV file without reading its samples
+type Header struct {
+	Format
+	// Float is set for IEEE float samples, the others are integers
+	Float bool
+	// DataSize is the size of the samples in bytes
+	DataSize int64
+}
+
+// Clip is decoded audio, a slice of samples in the range -1..1 per channel
+type Clip struct {
+	SampleRate int
+	Samples    [][]float64
+}
+
+// ReadHeader reads the header of a WAV file up to the start of the samples
+func ReadHeader(r io.Reader) (Header, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return Header{}, ErrNotWAV
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return Header{}, ErrNotWAV
+	}
+
+	var header Header
+	var haveFormat bool
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return Header{}, fmt.Errorf("WAV file without samples: %w", err)
+		}
+		id, size := string(chunk[0:4]), int64(binary.LittleEndian.Uint32(chunk[4:8]))
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return Header{}, fmt.Errorf("invalid WAV fmt chunk of %d bytes", size)
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return Header{}, fmt.Errorf("truncated WAV fmt chunk: %w", err)
+			}
+			tag := binary.LittleEndian.Uint16(data[0:2])
+			if tag == formatExtensible && size >= 26 {
+				// the first two bytes of the sub format GUID are the actual tag
+				tag = binary.LittleEndian.Uint16(data[24:26])
+			}
+			header.Channels = int(binary.LittleEndian.Uint16(data[2:4]))
+			header.SampleRate = int(binary.LittleEndian.Uint32(data[4:8]))
+			header.BitsPerSample = int(binary.LittleEndian.Uint16(data[14:16]))
+			switch {
+			case tag == formatPCM && (header.BitsPerSample == 8 || header.BitsPerSample == 16 || header.BitsPerSample == 24 || header.BitsPerSample == 32):
+			case tag == formatFloat && (header.BitsPerSample == 32 || header.BitsPerSample == 64):
+				header.Float = true
+			default:
+				return Header{}, fmt.Errorf("unsupported WAV encoding %#x with %d bit samples", tag, header.BitsPerSample)
+			}
+			if header.Channels == 0 || header.SampleRate == 0 {
+				return Header{}, fmt.Errorf("invalid WAV format: %s", header.Format)
+			}
+			haveFormat = true
+		case "data":
+			if !haveFormat {
+				return Header{}, errors.New("WAV samples before the fmt chunk")
+			}
+			header.DataSize = size
+			return header, nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, size); err != nil {
+				return Header{}, fmt.Errorf("truncated WAV %q chunk: %w", id, err)
+			}
+		}
+		// chunks are padded to an even size
+		if size%2 == 1 {
+			if _, err := io.CopyN(io.Discard, r, 1); err != nil {
+				return Header{}, err
+			}
+		}
+	}
+}
+
+// ReadWAV decodes a whole WAV file. A data chunk longer than the file, as written by some recorders
+// that were interrupted, is read up to the end of the file.
+func ReadWAV(r io.Reader) (*Clip, error) {
+	br := bufio.NewReader(r)
+	header, err := ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	width := header.BitsPerSample / 8
+	frame := width * header.Channels
+	data, err := io.ReadAll(io.LimitReader(br, header.DataSize))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the WAV samples: %w", err)
+	}
+
+	frames := len(data) / frame
+	clip := &Clip{SampleRate: header.SampleRate, Samples: make([][]float64, header.Channels)}
+	for ch := range clip.Samples {
+		clip.Samples[ch] = make([]float64, frames)
+	}
+	for i := 0; i < frames; i++ {
+		for ch := 0; ch < header.Channels; ch++ {
+			offset := i*frame + ch*width
+			clip.Samples[ch][i] = decodeSample(data[offset:offset+width], header.Float)
+		}
+	}
+	return clip, nil
+}
+
+func decodeSample(b []byte, float bool) float64 {
+	switch {
+	case float && len(b) == 4:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	case float:
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	}
+	switch len(b) {
+	case 1:
+		// 8 bit samples are unsigned
+		return (float64(b[0]) - 128) / 128
+	case 2:
+		return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15)
+	case 3:
+		return float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+	default:
+		return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31)
+	}
+}
+
+// WriteWAV encodes the clip as a PCM WAV file with 8 or 16 bit integer samples, samples out of -1..1 are clipped
+func WriteWAV(w io.Writer, clip *Clip, bitsPerSample int) error {
+	if bitsPerSample != 8 && bitsPerSample != 16 {
+		return fmt.Errorf("cannot write %d bit samples, only 8 and 16 bit are supported", bitsPerSample)
+	}
+	channels := len(clip.Samples)
+	if channels == 0 {
+		return errors.New("cannot write a clip without channels")
+	}
+	width := bitsPerSample / 8
+	frames := len(clip.Samples[0])
+	dataSize := frames * channels * width
+
+	header := make([]byte, 44)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(36+dataSize))
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], formatPCM)
+	binary.LittleEndian.PutUint16(header[22:], uint16(channels))
+	binary.LittleEndian.PutUint32(header[24:], uint32(clip.SampleRate))
+	binary.LittleEndian.PutUint32(header[28:], uint32(clip.SampleRate*channels*width))
+	binary.LittleEndian.PutUint16(header[32:], uint16(channels*width))
+	binary.LittleEndian.PutUint16(header[34:], uint16(bitsPerSample))
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], uint32(dataSize))
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+	sample := make([]byte, width)
+	for i := 0; i < frames; i++ {
+		for ch := 0; ch < channels; ch++ {
+			v := math.Max(-1, math.Min(1, clip.Samples[ch][i]))
+			if width == 1 {
+				sample[0] = byte(math.Round(v*127) + 128)
+			} else {
+				binary.LittleEndian.PutUint16(sample, uint16(int16(math.Round(v*32767))))
+			}
+			if _, err := bw.Write(sample); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
@@ -10,17 +10,11 @@ import (
 	"github.com/spf13/cobra"
 )
 
-const (
-	shortAddressMin = 1
-	shortAddressMax = 127
-	longAddressMin  = 0
-	longAddressMax  = 10239
-)
-
 func NewAddrCommand(app *app.LocoApp) *cobra.Command {
 	command := &cobra.Command{
-		Use:   "addr",
-		Short: "Set locomotive short or long DCC address",
+		Use:     "addr",
+		Aliases: []string{"address"},
+		Short:   "Set locomotive short or long DCC address",
 		RunE: func(command *cobra.Command, args []string) error {
 			return errors.New("please select a command")
 		},
@@ -30,20 +24,31 @@ func NewAddrCommand(app *app.LocoApp) *cobra.Command {
 	return command
 }
 
-func NewAddrSetCommand(app *app.LocoApp) *cobra.Command {
+func NewAddrSetCommand(a *app.LocoApp) *cobra.Command {
 	type SetArgs struct {
-		Verify  bool
-		Timeout uint16
-		Settle  uint16
+		Verify   bool
+		ReadBack bool
+		Long     bool
+		Timeout  uint16
+		Settle   uint16
 	}
 
 	cmdArgs := SetArgs{}
 	command := &cobra.Command{
 		Use:   "set <address>",
 		Short: "Program decoder short or long address",
-		Args:  cobra.ExactArgs(1),
+		Long: `Programs the address of the decoder on the programming track. The addresses 1-127 are written
+into CV1, the addresses 0 and 128-10239 (or any with --long) into CV17/CV18, and the long address bit
+of CV29 is set or cleared. The other bits of CV29 are read first and kept.
+
+Examples:
+  loco address set 3
+  loco address set 1234 --verify --read-back
+  loco address set 42 --long`,
+		Annotations: writesCVs(""),
+		Args:        cobra.ExactArgs(1),
 		RunE: func(command *cobra.Command, args []string) error {
-			if err := app.Initialize(); err != nil {
+			if err := a.Initialize(); err != nil {
 				return err
 			}
 
@@ -52,40 +57,22 @@ func NewAddrSetCommand(app *app.LocoApp) *cobra.Command {
 				return fmt.Errorf("invalid address %q: %w", args[0], parseErr)
 			}
 
-			cvString, buildErr := addressToCVString(uint16(addr64))
-			if buildErr != nil {
-				return buildErr
-			}
-
-			return app.SendCVAction(
-				"prog",
-				0,
-				cvString,
-				cmdArgs.Verify,
-				time.Second*time.Duration(cmdArgs.Timeout),
-				time.Millisecond*time.Duration(cmdArgs.Settle),
-			)
+			return a.SetAddressAction(uint16(addr64), app.AddressOptions{
+				Long:     cmdArgs.Long,
+				Verify:   cmdArgs.Verify,
+				ReadBack: cmdArgs.ReadBack,
+				Timeout:  time.Second * time.Duration(cmdArgs.Timeout),
+				Settle:   time.Millisecond * time.Duration(flagOrDefault(command, "settle", cmdArgs.Settle, a.Config.Server.Settle)),
+			})
 		},
 	}
 
-	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().BoolVarP(&a.Debug, "debug", "v", false, "Increase verbosity to the debug level")
 	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
-	command.Flags().Uint16VarP(&cmdArgs.Settle, "settle", "", 300, "Time in miliseconds between writes")
+	command.Flags().Uint16VarP(&cmdArgs.Settle, "settle", "", 0, "Time in miliseconds between writes (default: server.settle from the configuration file)")
 	command.Flags().BoolVarP(&cmdArgs.Verify, "verify", "", false, "Verify the value after writting")
+	command.Flags().BoolVarP(&cmdArgs.ReadBack, "read-back", "", false, "Read the address back from the decoder after writing and compare it")
+	command.Flags().BoolVarP(&cmdArgs.Long, "long", "", false, "Program an address below 128 as a long address")
 
 	return command
 }
-
-func addressToCVString(addr uint16) (string, error) {
-	if addr < longAddressMin || addr > longAddressMax {
-		return "", fmt.Errorf("address %d out of range (%d-%d)", addr, longAddressMin, longAddressMax)
-	}
-
-	if addr >= shortAddressMin && addr <= shortAddressMax {
-		return fmt.Sprintf("cv1=%d, cv17=0, cv18=0, cv29=0", addr), nil
-	}
-
-	cv17 := 192 + (addr / 256)
-	cv18 := addr % 256
-	return fmt.Sprintf("cv17=%d, cv18=%d, cv29=32", cv17, cv18), nil
-}
@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"os"
+	"time"
+
+	"github.com/keskad/loco/pkgs/app"
+	"github.com/spf13/cobra"
+)
+
+func NewCloneCommand(app *app.LocoApp) *cobra.Command {
+	type Args struct {
+		From         uint8
+		To           uint8
+		CVs          string
+		Exclude      []uint
+		IncludeSound bool
+		Slot         uint8
+		Yes          bool
+		Timeout      uint16
+		Retries      uint8
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "clone",
+		Short: "Copy the CVs of one decoder to another decoder of the same family",
+		Long: `Reads the CVs of the source locomotive and programs them into the target, both on the main track (requires RailCom).
+The decoders must be of the same family: CV7 (version) and CV8 (manufacturer) have to match.
+
+The identity CVs are not copied, by default the short address, the long address and the consist address (1, 17, 18, 19).
+The list is confirmed interactively unless --exclude or --yes is given. The long address bit of CV29 is kept from the target.
+The copied values are printed in the CV file format, so the output is a backup of the source decoder.
+
+--include-sound copies a sound slot of Railbox RB23xx decoders too. The decoders are reached through their own WiFi networks,
+you are asked to connect to the source and then to the target.`,
+		Example:     "  loco clone --from-loco 3 --to-loco 9\n  loco clone --from-loco 3 --to-loco 9 --cvs cv1-cv512 --exclude 1,17,18,19,105,106 --include-sound --slot 1",
+		Annotations: writesCVs(""),
+		Args:        cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+			exclude := make([]uint16, 0, len(cmdArgs.Exclude))
+			for _, cv := range cmdArgs.Exclude {
+				exclude = append(exclude, uint16(cv))
+			}
+			ask := !cmdArgs.Yes && !command.Flags().Changed("exclude") && isTerminal(os.Stdin)
+			soundSlot := -1
+			if cmdArgs.IncludeSound {
+				soundSlot = int(cmdArgs.Slot)
+			}
+			return app.CloneAction(cmdArgs.From, cmdArgs.To, cmdArgs.CVs, exclude, ask, soundSlot,
+				time.Second*time.Duration(cmdArgs.Timeout), flagOrDefault(command, "retry", cmdArgs.Retries, app.Config.Server.Retries))
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().Uint8VarP(&cmdArgs.From, "from-loco", "", 0, "Address of the locomotive to copy from")
+	command.Flags().Uint8VarP(&cmdArgs.To, "to-loco", "", 0, "Address of the locomotive to copy to")
+	command.Flags().StringVarP(&cmdArgs.CVs, "cvs", "", "cv1-cv256", "CVs to copy")
+	command.Flags().UintSliceVarP(&cmdArgs.Exclude, "exclude", "", []uint{1, 17, 18, 19}, "Identity CVs that are not copied")
+	command.Flags().BoolVarP(&cmdArgs.Yes, "yes", "y", false, "Do not ask for the CVs that are not copied")
+	command.Flags().BoolVarP(&cmdArgs.IncludeSound, "include-sound", "", false, "Copy a sound slot of Railbox RB23xx decoders too")
+	command.Flags().Uint8VarP(&cmdArgs.Slot, "slot", "", 1, "Sound slot copied with --include-sound")
+	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
+	command.Flags().Uint8VarP(&cmdArgs.Retries, "retry", "", 0, "Retry request multiple times if required (default: server.retries from the configuration file)")
+	command.MarkFlagRequired("from-loco")
+	command.MarkFlagRequired("to-loco")
+
+	return command
+}
+
+// isTerminal tells if the file is an interactive terminal rather than a pipe or a file
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
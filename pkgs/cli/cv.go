@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/keskad/loco/pkgs/app"
+	"github.com/keskad/loco/pkgs/decoders"
 	"github.com/spf13/cobra"
 )
 
@@ -23,51 +24,120 @@ func NewCVCommand(app *app.LocoApp) *cobra.Command {
 
 	command.AddCommand(NewSetCommand(app))
 	command.AddCommand(NewGetCommand(app))
+	command.AddCommand(NewCVBackupCommand(app))
+	command.AddCommand(NewCVApplyCommand(app))
+	command.AddCommand(NewCVCheckCommand(app))
+	command.AddCommand(NewAuditCommand(app))
+	command.AddCommand(NewCVDocCommand(app))
+	command.AddCommand(NewCVExplainCommand(app))
+	command.AddCommand(NewCVSpeedTableCommand(app))
 	return command
 }
 
-func NewSetCommand(app *app.LocoApp) *cobra.Command {
+func NewSetCommand(a *app.LocoApp) *cobra.Command {
 	type SetArgs struct {
-		LocoId  uint8
-		Cv      uint8
-		Value   uint16
-		Track   string
-		Verify  bool
-		Timeout uint16
-		Settle  uint16
+		LocoId     uint8
+		Cv         uint8
+		Value      uint16
+		Track      string
+		Verify     bool
+		Timeout    uint16
+		Settle     uint16
+		Strict     bool
+		Format     string
+		Optimize   bool
+		Known      string
+		Via        string
+		Address    string
+		NoValidate bool
 	}
 
 	cmdArgs := SetArgs{}
 	command := &cobra.Command{
 		Use:   "set",
 		Short: "Send a CV value to the decoder",
+		Long: `Send CV values to the decoder. A value is decimal, hexadecimal "0x2E" or binary "0b00101110".
+
+When the same CV is defined multiple times with different values the last one wins and a warning is printed.
+Use --strict to fail instead. Strict mode is enabled by default when reading CVs from a file via stdin ("-- -").
+
+Märklin-Motorola decoders can be programmed with --format mm on the programming track, where cvN means register N (1-79).
+MM registers cannot be read back, so --verify is not available.
+
+With --optimize the current values are read first and the CVs that already hold their value are skipped,
+a decoder reset (cv8) is written first and the index CVs (cv31, cv32) before the paged CVs 257-512.
+--known takes the current values from a CV file instead, e.g. a backup made by "loco cv get".
+
+"cv29|=0x04" sets and "cv29&=~0x10" clears bits of a CV: the CV is read, the bits are changed and the new value
+is written and verified, the other bits stay as they are.
+
+Use --dry-run to print the packets that would be sent, with --debug also their raw bytes. Only a Z21 and
+the WiFi of a decoder can be simulated, the other command stations refuse --dry-run.
+
+With --via wifi the CVs are written over the WiFi of a RB23xx decoder, without a command station,
+e.g. on the workbench. --loco and --track are not needed then.
+
+When the decoder type of loco.json has a schema, ~/.loco/decoders/<type>.yaml or decoder_schema of loco.json,
+the values are checked against its ranges and read-only CVs before anything is written.`,
+		Annotations: writesCVs(""),
 		RunE: func(command *cobra.Command, args []string) error {
-			if err := app.Initialize(); err != nil {
+			if err := a.Initialize(); err != nil {
 				return err
 			}
 
 			// mode selection and validation
-			track, trackErr := trackOrDefault(cmdArgs.Track, cmdArgs.LocoId)
+			track, trackErr := cvMode(cmdArgs.Via, cmdArgs.Track, cmdArgs.LocoId)
 			if trackErr != nil {
 				return trackErr
 			}
 
 			// Join all args as CV string
-			cvString, parseErr := parseArgsAsCVs(args)
+			cvString, position, parseErr := readCVArgs(args)
 			if parseErr != nil {
 				return parseErr
 			}
 
-			return app.SendCVAction(track, cmdArgs.LocoId, cvString, cmdArgs.Verify, time.Second*time.Duration(cmdArgs.Timeout), time.Millisecond*time.Duration(cmdArgs.Settle))
+			if !cmdArgs.NoValidate {
+				if err := a.CheckCVValues(cvString); err != nil {
+					return err
+				}
+			}
+
+			// files are strict by default, as concatenated templates easily contain conflicting entries
+			strict := cmdArgs.Strict
+			if !command.Flags().Changed("strict") && readsFromStdin(args) {
+				strict = true
+			}
+
+			return a.SendCVAction(cvString, app.CVSendOptions{
+				Mode:     track,
+				LocoId:   cmdArgs.LocoId,
+				Verify:   cmdArgs.Verify,
+				Timeout:  time.Second * time.Duration(cmdArgs.Timeout),
+				Settle:   time.Millisecond * time.Duration(flagOrDefault(command, "settle", cmdArgs.Settle, a.Config.Server.Settle)),
+				Strict:   strict,
+				Format:   cmdArgs.Format,
+				Optimize: cmdArgs.Optimize || cmdArgs.Known != "",
+				Known:    cmdArgs.Known,
+				Position: position,
+			}, decoders.WithTimeout(cmdArgs.Timeout), decoders.WithBaseURL(cmdArgs.Address))
 		},
 	}
 
-	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().BoolVarP(&a.Debug, "debug", "v", false, "Increase verbosity to the debug level")
 	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
-	command.Flags().Uint16VarP(&cmdArgs.Settle, "settle", "", 300, "Time in miliseconds between writes")
+	command.Flags().Uint16VarP(&cmdArgs.Settle, "settle", "", 0, "Time in miliseconds between writes (default: server.settle from the configuration file)")
 	command.Flags().BoolVarP(&cmdArgs.Verify, "verify", "", false, "Verify the value after writting")
+	command.Flags().BoolVarP(&a.DryRun, "dry-run", "", false, "Print the packets instead of sending them, together with --debug the raw bytes are printed too")
+	command.Flags().StringVarP(&cmdArgs.Format, "format", "", "dcc", "Decoder format: 'dcc' or 'mm' (Märklin-Motorola, programming track only)")
+	command.Flags().BoolVarP(&cmdArgs.Strict, "strict", "", false, "Fail when the same CV is defined multiple times with different values (default when reading from stdin)")
+	command.Flags().BoolVarP(&cmdArgs.Optimize, "optimize", "", false, "Skip the CVs that already hold their value and print the plan")
+	command.Flags().StringVarP(&cmdArgs.Known, "known", "", "", "CV file with the current values of the decoder, implies --optimize")
+	command.Flags().BoolVarP(&cmdArgs.NoValidate, "no-validate", "", false, "Write the values without checking them against the schema of the decoder")
 	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Use locomotive under specific address")
 	command.Flags().StringVarP(&cmdArgs.Track, "track", "t", "", "Track type: 'pom' for programming on main, 'prog' for programming track, or empty for automatic selection")
+	command.Flags().StringVarP(&cmdArgs.Via, "via", "", "station", "Reach the decoder 'station' through the command station, or 'wifi' through the WiFi of the decoder")
+	command.Flags().StringVar(&cmdArgs.Address, "decoder-address", "", "Address of the decoder WiFi with --via wifi (default loco.decoder_address or 192.168.4.1)")
 
 	return command
 }
@@ -79,20 +149,33 @@ func NewGetCommand(app *app.LocoApp) *cobra.Command {
 		Verify  bool
 		Timeout uint16
 		Retries uint8
+		Via     string
+		Address string
+		Hex     bool
+		Binary  bool
+		Explain bool
 	}
 
 	cmdArgs := GetArgs{}
 	command := &cobra.Command{
 		Use:   "get",
 		Short: "Retrieve a CV value from the decoder",
-		Args:  cobra.ArbitraryArgs,
+		Long: `Reads CV values from the decoder.
+
+With --via wifi the CVs are read over the WiFi of a RB23xx decoder, without a command station.
+
+The values are printed in decimal, with --hex as "0x2E" and with --bin as "0b00101110".
+"loco cv set" reads all three forms back. --explain adds the meaning of the standard CVs as a comment,
+e.g. "cv29=34  # 28/128 steps, long address (CV17/CV18), analog off".`,
+		Example: "  loco cv get cv1 cv29 --loco 3\n  loco cv get cv29 --via wifi\n  loco cv get cv29 --bin",
+		Args:    cobra.ArbitraryArgs,
 		RunE: func(command *cobra.Command, args []string) error {
 			if err := app.Initialize(); err != nil {
 				return err
 			}
 
 			// mode selection and validation
-			track, trackErr := trackOrDefault(cmdArgs.Track, cmdArgs.LocoId)
+			track, trackErr := cvMode(cmdArgs.Via, cmdArgs.Track, cmdArgs.LocoId)
 			if trackErr != nil {
 				return trackErr
 			}
@@ -103,7 +186,9 @@ func NewGetCommand(app *app.LocoApp) *cobra.Command {
 				return parseErr
 			}
 
-			return app.ReadCVAction(track, cmdArgs.LocoId, cvString, cmdArgs.Verify, time.Second*time.Duration(cmdArgs.Timeout), cmdArgs.Retries)
+			return app.ReadCVAction(track, cmdArgs.LocoId, cvString, cmdArgs.Verify, time.Second*time.Duration(cmdArgs.Timeout), flagOrDefault(command, "retry", cmdArgs.Retries, app.Config.Server.Retries),
+				cvOutput(cmdArgs.Hex, cmdArgs.Binary, cmdArgs.Explain),
+				decoders.WithTimeout(cmdArgs.Timeout), decoders.WithBaseURL(cmdArgs.Address))
 		},
 	}
 
@@ -111,8 +196,367 @@ func NewGetCommand(app *app.LocoApp) *cobra.Command {
 	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
 	command.Flags().BoolVarP(&cmdArgs.Verify, "verify", "", false, "Verify the value after writting")
 	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Use locomotive under specific address")
-	command.Flags().Uint8VarP(&cmdArgs.Retries, "retry", "", 0, "Retry request multiple times if required")
+	command.Flags().Uint8VarP(&cmdArgs.Retries, "retry", "", 0, "Retry request multiple times if required (default: server.retries from the configuration file)")
+	command.Flags().StringVarP(&cmdArgs.Track, "track", "t", "", "Track type: 'pom' for programming on main, 'prog' for programming track, or empty for automatic selection")
+	command.Flags().StringVarP(&cmdArgs.Via, "via", "", "station", "Reach the decoder 'station' through the command station, or 'wifi' through the WiFi of the decoder")
+	command.Flags().StringVar(&cmdArgs.Address, "decoder-address", "", "Address of the decoder WiFi with --via wifi (default loco.decoder_address or 192.168.4.1)")
+	command.Flags().BoolVarP(&cmdArgs.Hex, "hex", "", false, "Print the values in hexadecimal, e.g. 0x2E")
+	command.Flags().BoolVarP(&cmdArgs.Binary, "bin", "", false, "Print the values in binary, e.g. 0b00101110")
+	command.MarkFlagsMutuallyExclusive("hex", "bin")
+	command.Flags().BoolVarP(&cmdArgs.Explain, "explain", "", false, "Add the meaning of the values as a comment")
+
+	return command
+}
+
+func NewCVBackupCommand(a *app.LocoApp) *cobra.Command {
+	type BackupArgs struct {
+		Range   string
+		Output  string
+		Force   bool
+		LocoId  uint8
+		Track   string
+		Verify  bool
+		Timeout uint16
+		Retries uint8
+		Via     string
+		Address string
+	}
+
+	cmdArgs := BackupArgs{}
+	command := &cobra.Command{
+		Use:   "backup",
+		Short: "Save the CVs of the decoder in a CV file",
+		Long: `Reads a range of CVs and saves them sorted in a CV file, with the decoder (CV7, CV8), the time of the backup
+and the names of the CVs as comments. Without --output the file is printed.
+
+A CV the decoder does not answer is left out of the file and listed in its header,
+use --retry and --verify for unreliable readings. The file is restored with "loco cv apply":
+
+  loco cv apply loco3.cv -l 3 --verify`,
+		Example: "  loco cv backup --range 1-256 -o loco3.cv -l 3\n" +
+			"  loco cv backup --range cv1-cv8,cv29 --track prog\n" +
+			"  loco cv backup --range 1-512 -o rb2300.cv --via wifi",
+		Args: cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := a.Initialize(); err != nil {
+				return err
+			}
+			track, trackErr := cvMode(cmdArgs.Via, cmdArgs.Track, cmdArgs.LocoId)
+			if trackErr != nil {
+				return trackErr
+			}
+			return a.BackupCVAction(cmdArgs.Output, app.CVBackupOptions{
+				Range:   cmdArgs.Range,
+				Mode:    track,
+				LocoId:  cmdArgs.LocoId,
+				Verify:  cmdArgs.Verify,
+				Timeout: time.Second * time.Duration(cmdArgs.Timeout),
+				Retries: flagOrDefault(command, "retry", cmdArgs.Retries, a.Config.Server.Retries),
+				Force:   cmdArgs.Force,
+			}, decoders.WithTimeout(cmdArgs.Timeout), decoders.WithBaseURL(cmdArgs.Address))
+		},
+	}
+
+	command.Flags().BoolVarP(&a.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().StringVarP(&cmdArgs.Range, "range", "r", "1-256", "CVs to read, e.g. '1-256' or 'cv1-cv8,cv29'")
+	command.Flags().StringVarP(&cmdArgs.Output, "output", "o", "-", "CV file to write, '-' prints the CVs")
+	command.Flags().BoolVarP(&cmdArgs.Force, "force", "", false, "Replace an existing file")
+	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
+	command.Flags().BoolVarP(&cmdArgs.Verify, "verify", "", false, "Read every CV twice and compare the values")
+	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Use locomotive under specific address")
+	command.Flags().Uint8VarP(&cmdArgs.Retries, "retry", "", 0, "Retry request multiple times if required (default: server.retries from the configuration file)")
+	command.Flags().StringVarP(&cmdArgs.Track, "track", "t", "", "Track type: 'pom' for programming on main, 'prog' for programming track, or empty for automatic selection")
+	command.Flags().StringVarP(&cmdArgs.Via, "via", "", "station", "Reach the decoder 'station' through the command station, or 'wifi' through the WiFi of the decoder")
+	command.Flags().StringVar(&cmdArgs.Address, "decoder-address", "", "Address of the decoder WiFi with --via wifi (default loco.decoder_address or 192.168.4.1)")
+
+	return command
+}
+
+func NewCVApplyCommand(a *app.LocoApp) *cobra.Command {
+	type ApplyArgs struct {
+		LocoId     uint8
+		Track      string
+		Verify     bool
+		Timeout    uint16
+		Settle     uint16
+		Retries    uint8
+		Via        string
+		Address    string
+		NoValidate bool
+	}
+
+	cmdArgs := ApplyArgs{}
+	command := &cobra.Command{
+		Use:   "apply <file>",
+		Short: "Write the CVs of a CV file one by one and report each of them",
+		Long: `Writes the CVs of a CV file, e.g. a backup of "loco cv backup", "-" reads the file from stdin.
+Unlike "loco cv set" a failed CV does not stop the writing, it is retried and the next CV is written.
+With --verify every CV is read back after it was written.
+
+CV7 and CV8 identify the decoder and are skipped, writing CV8 resets most decoders,
+use "loco cv set cv8=8" for a reset.
+
+An assertion "cv8==145" of the file is read and compared, never written. The assertions are checked
+before anything is written, when one of them fails nothing is written and the command exits with code 4.
+
+The lines between "@if cv8==145 && cv7>=4" and "@endif" (with "@elif" and "@else") are written only when
+the decoder holds the values of the condition.
+
+The report lists every CV as written, verified or failed. When a CV failed the command exits with code 6.`,
+		Example: "  loco cv apply loco3.cv -l 3 --verify\n" +
+			"  loco cv apply loco3.cv --track prog --verify --retry 3",
+		Annotations: writesCVs(""),
+		Args:        cobra.ExactArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := a.Initialize(); err != nil {
+				return err
+			}
+			track, trackErr := cvMode(cmdArgs.Via, cmdArgs.Track, cmdArgs.LocoId)
+			if trackErr != nil {
+				return trackErr
+			}
+			return a.ApplyCVAction(args[0], app.CVApplyOptions{
+				Mode:     track,
+				LocoId:   cmdArgs.LocoId,
+				Verify:   cmdArgs.Verify,
+				Timeout:  time.Second * time.Duration(cmdArgs.Timeout),
+				Settle:   time.Millisecond * time.Duration(flagOrDefault(command, "settle", cmdArgs.Settle, a.Config.Server.Settle)),
+				Retries:  flagOrDefault(command, "retry", cmdArgs.Retries, a.Config.Server.Retries),
+				Validate: !cmdArgs.NoValidate,
+			}, decoders.WithTimeout(cmdArgs.Timeout), decoders.WithBaseURL(cmdArgs.Address))
+		},
+	}
+
+	command.Flags().BoolVarP(&a.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
+	command.Flags().Uint16VarP(&cmdArgs.Settle, "settle", "", 0, "Time in miliseconds between writes (default: server.settle from the configuration file)")
+	command.Flags().BoolVarP(&cmdArgs.Verify, "verify", "", false, "Read every CV back after it was written")
+	command.Flags().Uint8VarP(&cmdArgs.Retries, "retry", "", 0, "Write a failed CV again multiple times (default: server.retries from the configuration file)")
+	command.Flags().BoolVarP(&a.DryRun, "dry-run", "", false, "Print the packets instead of sending them")
+	command.Flags().BoolVarP(&cmdArgs.NoValidate, "no-validate", "", false, "Write the values without checking them against the schema of the decoder")
+	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Use locomotive under specific address")
+	command.Flags().StringVarP(&cmdArgs.Track, "track", "t", "", "Track type: 'pom' for programming on main, 'prog' for programming track, or empty for automatic selection")
+	command.Flags().StringVarP(&cmdArgs.Via, "via", "", "station", "Reach the decoder 'station' through the command station, or 'wifi' through the WiFi of the decoder")
+	command.Flags().StringVar(&cmdArgs.Address, "decoder-address", "", "Address of the decoder WiFi with --via wifi (default loco.decoder_address or 192.168.4.1)")
+
+	return command
+}
+
+func NewCVCheckCommand(a *app.LocoApp) *cobra.Command {
+	type CheckArgs struct {
+		LocoId  uint8
+		Track   string
+		Timeout uint16
+		Retries uint8
+		Via     string
+		Address string
+	}
+
+	cmdArgs := CheckArgs{}
+	command := &cobra.Command{
+		Use:   "check <file>",
+		Short: "Compare the decoder with the assertions of a CV file",
+		Long: `Reads the CVs of the assertions of a CV file, e.g. "cv8==145", and compares them with the decoder.
+The values of the file ("cv3=12") are not written, "-" reads the file from stdin.
+
+Use it as an acceptance test, e.g. that the right decoder is on the track before a batch write,
+"loco cv apply" checks the assertions of a file before writing it too.
+The command exits with code 4 when an assertion fails.`,
+		Example: "  loco cv check br218.cv -l 3\n" +
+			"  echo 'cv8==145' | loco cv check - --track prog",
+		Args: cobra.ExactArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := a.Initialize(); err != nil {
+				return err
+			}
+			track, trackErr := cvMode(cmdArgs.Via, cmdArgs.Track, cmdArgs.LocoId)
+			if trackErr != nil {
+				return trackErr
+			}
+			return a.CheckCVAssertionsAction(args[0], app.CVApplyOptions{
+				Mode:    track,
+				LocoId:  cmdArgs.LocoId,
+				Timeout: time.Second * time.Duration(cmdArgs.Timeout),
+				Retries: flagOrDefault(command, "retry", cmdArgs.Retries, a.Config.Server.Retries),
+			}, decoders.WithTimeout(cmdArgs.Timeout), decoders.WithBaseURL(cmdArgs.Address))
+		},
+	}
+
+	command.Flags().BoolVarP(&a.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
+	command.Flags().Uint8VarP(&cmdArgs.Retries, "retry", "", 0, "Retry request multiple times if required (default: server.retries from the configuration file)")
+	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Use locomotive under specific address")
+	command.Flags().StringVarP(&cmdArgs.Track, "track", "t", "", "Track type: 'pom' for programming on main, 'prog' for programming track, or empty for automatic selection")
+	command.Flags().StringVarP(&cmdArgs.Via, "via", "", "station", "Reach the decoder 'station' through the command station, or 'wifi' through the WiFi of the decoder")
+	command.Flags().StringVar(&cmdArgs.Address, "decoder-address", "", "Address of the decoder WiFi with --via wifi (default loco.decoder_address or 192.168.4.1)")
+
+	return command
+}
+
+func NewAuditCommand(app *app.LocoApp) *cobra.Command {
+	type AuditArgs struct {
+		Every   time.Duration
+		Timeout uint16
+		Retries uint8
+	}
+
+	cmdArgs := AuditArgs{}
+	command := &cobra.Command{
+		Use:   "audit",
+		Short: "Compare critical CVs of locomotives on the track with their project files",
+		Long: `Re-reads the critical CVs (by default the address, CV29 and the consist address) on the main track
+and reports every value that differs from the CV file of the locomotive, e.g. after an accidental reprogramming by another throttle.
+Locomotives that do not answer are not on the track and are skipped.
+
+The audited locomotives and CVs are configured in ~/.loco.yaml:
+  audit:
+    cvs: [1, 17, 18, 19, 29]
+    locos:
+      - addr: 3
+        file: /home/pi/trains/br218/cv.txt
+
+Reading on the main track requires RailCom. A single audit exits with code 4 when a drift is found,
+with --every the audit is repeated until Ctrl+C and drifts are logged as warnings.`,
+		Example: "  loco cv audit\n  loco cv audit --every 24h",
+		Args:    cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+			return app.AuditCVAction(cmdArgs.Every, time.Second*time.Duration(cmdArgs.Timeout), flagOrDefault(command, "retry", cmdArgs.Retries, app.Config.Server.Retries))
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().DurationVarP(&cmdArgs.Every, "every", "", 0, "Repeat the audit in this interval until interrupted, e.g. 24h")
+	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
+	command.Flags().Uint8VarP(&cmdArgs.Retries, "retry", "", 0, "Retry request multiple times if required (default: server.retries from the configuration file)")
+
+	return command
+}
+
+func NewCVDocCommand(app *app.LocoApp) *cobra.Command {
+	type DocArgs struct {
+		LocoId uint8
+		Family string
+	}
+
+	cmdArgs := DocArgs{}
+	command := &cobra.Command{
+		Use:   "doc CV",
+		Short: "Describe a CV: its purpose, bits, default and safe values",
+		Long: `Describes a standard NMRA CV, found by its number or by a part of its name.
+
+Manufacturers use some CVs differently. The decoder family is taken from --family, from the decoder type
+in loco.json, or detected by reading CV8 of the locomotive selected with --loco. Known families: esu, zimo.`,
+		Example: "  loco cv doc 29\n  loco cv doc \"speed table\"\n  loco cv doc 56 --family zimo\n  loco cv doc 54 --loco 3",
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+			return app.CVDocAction(strings.Join(args, " "), cmdArgs.Family, cmdArgs.LocoId)
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().StringVarP(&cmdArgs.Family, "family", "f", "", "Decoder family, e.g. 'esu' or 'zimo' (default: detected)")
+	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Detect the decoder family of the locomotive on the main track (requires RailCom)")
+
+	return command
+}
+
+func NewCVExplainCommand(app *app.LocoApp) *cobra.Command {
+	type ExplainArgs struct {
+		Family string
+	}
+
+	cmdArgs := ExplainArgs{}
+	command := &cobra.Command{
+		Use:   "explain CV[=VALUE]...",
+		Short: "Tell what the values of CVs mean",
+		Long: `Tells the meaning of CV values, e.g. the bits of CV29, in the CV syntax of "loco cv set".
+A CV without a value is described like by "loco cv doc".
+
+Manufacturers use some CVs differently. The decoder family is taken from --family or from the decoder type
+in loco.json. Known families: esu, zimo.`,
+		Example: "  loco cv explain 29\n  loco cv explain cv29=34 cv19=0x85\n  loco cv get cv1-cv30 -l 3 | loco cv explain -- -",
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+			cvString, parseErr := parseArgsAsCVs(args)
+			if parseErr != nil {
+				return parseErr
+			}
+			if !strings.Contains(cvString, "=") {
+				return app.CVDocAction(cvString, cmdArgs.Family, 0)
+			}
+			return app.ExplainCVAction(cvString, cmdArgs.Family)
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().StringVarP(&cmdArgs.Family, "family", "f", "", "Decoder family, e.g. 'esu' or 'zimo' (default: the decoder type of loco.json)")
+
+	return command
+}
+
+func NewCVSpeedTableCommand(a *app.LocoApp) *cobra.Command {
+	type SpeedTableArgs struct {
+		Shape   string
+		Vstart  uint8
+		Vmax    uint8
+		Write   bool
+		LocoId  uint8
+		Track   string
+		Verify  bool
+		Timeout uint16
+	}
+
+	cmdArgs := SpeedTableArgs{}
+	command := &cobra.Command{
+		Use:   "speedtable",
+		Short: "Generate a speed table (CV67-CV94) and the three-point curve (CV2, CV5, CV6)",
+		Long: `Generates the 28 steps of a speed table rising from --vstart to --vmax, together with CV2 (Vstart),
+CV5 (Vhigh) and CV6 (Vmid) of the same shape, and prints them as a CV file with a graph in its comments.
+The shapes are "linear", "exp" (fine steps at low speed, for shunting) and "s-curve" (fine steps at
+the start and at the top).
+
+With --write the CVs are written to the decoder and verified, on the track selected like by "loco cv set".
+The decoder uses the table once bit 4 of CV29 is set: loco cv set "cv29|=0x10".`,
+		Example: "  loco cv speedtable --shape s-curve --vmax 180\n" +
+			"  loco cv speedtable --shape exp --vstart 4 --vmax 200 --write -l 3\n" +
+			"  loco cv speedtable --shape linear > br218-speed.cv",
+		Annotations: writesCVs("write"),
+		Args:        cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := a.Initialize(); err != nil {
+				return err
+			}
+
+			var write *app.CVWrite
+			if cmdArgs.Write {
+				track, trackErr := trackOrDefault(cmdArgs.Track, cmdArgs.LocoId)
+				if trackErr != nil {
+					return trackErr
+				}
+				write = &app.CVWrite{Mode: track, LocoId: cmdArgs.LocoId, Verify: cmdArgs.Verify, Timeout: time.Second * time.Duration(cmdArgs.Timeout)}
+			}
+			return a.SpeedTableAction(app.SpeedTableOptions{Shape: cmdArgs.Shape, Vstart: cmdArgs.Vstart, Vmax: cmdArgs.Vmax}, write)
+		},
+	}
+
+	command.Flags().BoolVarP(&a.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().StringVarP(&cmdArgs.Shape, "shape", "", "linear", "Shape of the curve: "+strings.Join(app.SpeedTableShapes, ", "))
+	command.Flags().Uint8VarP(&cmdArgs.Vstart, "vstart", "", 0, "Motor voltage at standstill (0-254), written into CV2")
+	command.Flags().Uint8VarP(&cmdArgs.Vmax, "vmax", "", 255, "Motor voltage at the top speed step (1-255), written into CV5")
+	command.Flags().BoolVarP(&cmdArgs.Write, "write", "w", false, "Write the CVs to the decoder")
+	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Use locomotive under specific address")
 	command.Flags().StringVarP(&cmdArgs.Track, "track", "t", "", "Track type: 'pom' for programming on main, 'prog' for programming track, or empty for automatic selection")
+	command.Flags().BoolVarP(&cmdArgs.Verify, "verify", "", true, "Verify the values after writting")
+	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
 
 	return command
 }
@@ -131,23 +575,81 @@ func trackOrDefault(chosenTrack string, locoId uint8) (string, error) {
 	return track, nil
 }
 
+// cvMode selects the mode of a CV command, a --track or the WiFi of the decoder with --via wifi
+func cvMode(via string, chosenTrack string, locoId uint8) (string, error) {
+	switch via {
+	case "", "station":
+		return trackOrDefault(chosenTrack, locoId)
+	case app.WiFiMode:
+		if chosenTrack != "" {
+			return "", fmt.Errorf("--track %s cannot be used with --via wifi, the decoder is reached over its WiFi", chosenTrack)
+		}
+		return app.WiFiMode, nil
+	}
+	return "", fmt.Errorf("invalid --via %s. Must be either 'station' or 'wifi'", via)
+}
+
+// cvOutput is the printing of the values selected by --hex, --bin and --explain
+func cvOutput(hex bool, binary bool, explain bool) app.CVOutput {
+	output := app.CVOutput{Base: 10, Explain: explain}
+	if hex {
+		output.Base = 16
+	} else if binary {
+		output.Base = 2
+	}
+	return output
+}
+
+// flagOrDefault returns the flag value when it was explicitly set, otherwise the configured default
+func flagOrDefault[T any](command *cobra.Command, name string, value T, configured T) T {
+	if command.Flags().Changed(name) {
+		return value
+	}
+	return configured
+}
+
+// readsFromStdin tells if "-- -" was specified at the end of the commandline arguments
+func readsFromStdin(args []string) bool {
+	return len(args) >= 1 && args[len(args)-1] == "-"
+}
+
 func parseArgsAsCVs(args []string) (string, error) {
+	cvString, _, err := readCVArgs(args)
+	return cvString, err
+}
+
+// readCVArgs joins the CVs of the arguments and of stdin into one input of the "," separator.
+// position names where an entry of the input comes from, the line of stdin or the entry of the arguments,
+// see syntax.Positions.
+func readCVArgs(args []string) (cvs string, position func(pos int) string, err error) {
 	// read data from stdin if "-- -" was specified at the end of the commandline arguments
 	stdinString := ""
-	if len(args) >= 1 && args[len(args)-1] == "-" {
+	var stdinLines []int
+	if readsFromStdin(args) {
 		// remove "-- -" form the arguments
 		args = args[:len(args)-1]
 
 		data, err := io.ReadAll(os.Stdin)
 		if err != nil {
-			return "", fmt.Errorf("failed to read from stdin: %v", err)
+			return "", nil, fmt.Errorf("failed to read from stdin: %v", err)
 		}
-		stdinString = strings.Trim(strings.ReplaceAll(string(data), "\n", ", "), ", ")
+		// the comments end with their line, e.g. the explanations of "loco cv get --explain" hold commas
+		var lines []string
+		for number, line := range strings.Split(string(data), "\n") {
+			if line, _, _ = strings.Cut(line, "#"); strings.TrimSpace(line) != "" {
+				lines = append(lines, strings.TrimSpace(line))
+				// a line may hold several entries
+				for range strings.Split(line, ",") {
+					stdinLines = append(stdinLines, number+1)
+				}
+			}
+		}
+		stdinString = strings.Join(lines, ", ")
 		args = append(args, "") // hack to pass the args > 0 validation later
 	}
 
 	if len(args) == 0 {
-		return "", fmt.Errorf("no CV argument provided")
+		return "", nil, fmt.Errorf("no CV argument provided")
 	}
 
 	// parse
@@ -170,5 +672,11 @@ func parseArgsAsCVs(args []string) (string, error) {
 		completeString = completeString + ", " + stdinString
 	}
 
-	return completeString, nil
+	arguments := len(strings.Split(cvString, ","))
+	return completeString, func(pos int) string {
+		if pos > arguments && pos-arguments <= len(stdinLines) {
+			return fmt.Sprintf("line %d of stdin", stdinLines[pos-arguments-1])
+		}
+		return fmt.Sprintf("entry %d", pos)
+	}, nil
 }
@@ -0,0 +1,122 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/keskad/loco/pkgs/app"
+	"github.com/keskad/loco/pkgs/syntax"
+	"github.com/spf13/cobra"
+)
+
+// cv29Usages describe the flags of app.CV29Flags
+var cv29Usages = map[string]string{
+	"reversed":     "Reverse the direction of travel",
+	"28steps":      "Use 28/128 speed steps instead of 14",
+	"analog":       "Allow the analog operation",
+	"railcom":      "Enable RailCom",
+	"speed-table":  "Use the speed table CV67-CV94 instead of CV2, CV5 and CV6",
+	"long-address": "Use the long address of CV17 and CV18",
+}
+
+func NewCV29Command(a *app.LocoApp) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "cv29",
+		Short: "Decode and compose the configuration CV29",
+		RunE: func(command *cobra.Command, args []string) error {
+			return errors.New("please select a command")
+		},
+	}
+
+	command.AddCommand(NewCV29DecodeCommand(a))
+	command.AddCommand(NewCV29ComposeCommand(a))
+	return command
+}
+
+func NewCV29DecodeCommand(a *app.LocoApp) *cobra.Command {
+	command := &cobra.Command{
+		Use:     "decode <value>",
+		Short:   "Print the bits of a CV29 value",
+		Example: "  loco cv29 decode 34\n  loco cv29 decode 0b00100010",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := a.Initialize(); err != nil {
+				return err
+			}
+			value, err := syntax.ParseCVValue(args[0])
+			if err != nil || value > 255 {
+				return fmt.Errorf("invalid CV29 value %q, must be between 0 and 255", args[0])
+			}
+			return a.DecodeCV29Action(uint8(value))
+		},
+	}
+
+	command.Flags().BoolVarP(&a.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+
+	return command
+}
+
+func NewCV29ComposeCommand(a *app.LocoApp) *cobra.Command {
+	type ComposeArgs struct {
+		Interactive bool
+		Write       bool
+		LocoId      uint8
+		Track       string
+		Verify      bool
+		Timeout     uint16
+	}
+
+	cmdArgs := ComposeArgs{}
+	bits := make([]bool, len(app.CV29Flags))
+	command := &cobra.Command{
+		Use:   "compose",
+		Short: "Compose a CV29 value from its bits",
+		Long: `Composes a CV29 value from the flags, the bits without a flag are cleared.
+Without any flag, or with --interactive, every bit is asked for on a terminal.
+
+With --write the value is written to the decoder, on the track selected like by "loco cv set".
+A long address is taken from CV17 and CV18, set them with "loco addr set".`,
+		Example: "  loco cv29 compose --28steps --long-address --railcom\n" +
+			"  loco cv29 compose --interactive --write -l 3",
+		Annotations: writesCVs("write"),
+		Args:        cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := a.Initialize(); err != nil {
+				return err
+			}
+
+			var set []uint8
+			for i, flag := range app.CV29Flags {
+				if bits[i] {
+					set = append(set, flag.Bit)
+				}
+			}
+			ask := cmdArgs.Interactive || (len(set) == 0 && isTerminal(os.Stdin))
+
+			var write *app.CVWrite
+			if cmdArgs.Write {
+				track, trackErr := trackOrDefault(cmdArgs.Track, cmdArgs.LocoId)
+				if trackErr != nil {
+					return trackErr
+				}
+				write = &app.CVWrite{Mode: track, LocoId: cmdArgs.LocoId, Verify: cmdArgs.Verify, Timeout: time.Second * time.Duration(cmdArgs.Timeout)}
+			}
+			return a.ComposeCV29Action(set, ask, write)
+		},
+	}
+
+	command.Flags().BoolVarP(&a.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	for i, flag := range app.CV29Flags {
+		command.Flags().BoolVar(&bits[i], flag.Flag, false, cv29Usages[flag.Flag])
+	}
+	command.Flags().BoolVarP(&cmdArgs.Interactive, "interactive", "i", false, "Ask for every bit, the flags are the suggested answers")
+	command.Flags().BoolVarP(&cmdArgs.Write, "write", "w", false, "Write the value to the decoder")
+	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Use locomotive under specific address")
+	command.Flags().StringVarP(&cmdArgs.Track, "track", "t", "", "Track type: 'pom' for programming on main, 'prog' for programming track, or empty for automatic selection")
+	command.Flags().BoolVarP(&cmdArgs.Verify, "verify", "", false, "Verify the value after writting")
+	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
+
+	return command
+}
@@ -4,6 +4,8 @@ import (
 	"os"
 	"testing"
 
+	"github.com/keskad/loco/pkgs/syntax"
+	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -38,6 +40,36 @@ func TestParseArgsAsCVs_Stdin(t *testing.T) {
 	assert.Contains(t, result, "cv5", "expected stdin content in result")
 }
 
+func TestParseArgsAsCVs_StdinComments(t *testing.T) {
+	// mocking
+	originalStdin := os.Stdin
+	r, w, _ := os.Pipe()
+	w.WriteString("cv29=34  # 28/128 steps, long address (CV17/CV18), analog off\n# a, b\ncv1=3\n")
+	w.Close()
+	os.Stdin = r
+	defer func() { os.Stdin = originalStdin }()
+
+	result, err := parseArgsAsCVs([]string{"-"})
+	assert.Equal(t, nil, err, "unexpected error")
+	assert.Equal(t, ", cv29=34, cv1=3", result, "result mismatch")
+}
+
+func TestReadCVArgs_StdinLines(t *testing.T) {
+	originalStdin := os.Stdin
+	r, w, _ := os.Pipe()
+	w.WriteString("cv1=3\n\n# the lights\ncv49=2, cv50=2\ncv1=4\n")
+	w.Close()
+	os.Stdin = r
+	defer func() { os.Stdin = originalStdin }()
+
+	cvs, position, err := readCVArgs([]string{"cv29=6", "-"})
+	assert.NoError(t, err)
+	// the conflict is reported at the lines of the file, not at the entries of the joined input
+	_, err = syntax.ParseCVString(cvs, ",", syntax.Strict(true), syntax.Positions(position))
+	assert.EqualError(t, err, "conflicting values for cv1: 3 (line 1 of stdin) and 4 (line 5 of stdin)")
+	assert.Equal(t, "entry 1", position(1))
+}
+
 func TestParseArgsAsCVs_IgnoreEmptyStrings(t *testing.T) {
 	args := []string{"hell", "", "o"}
 	result, err := parseArgsAsCVs(args)
@@ -73,3 +105,29 @@ func TestTrackOrDefault_DefaultProg(t *testing.T) {
 	assert.Equal(t, nil, err, "unexpected error")
 	assert.Equal(t, "prog", track, "track mismatch")
 }
+
+func TestCVMode(t *testing.T) {
+	mode, err := cvMode("wifi", "", 0)
+	assert.Equal(t, nil, err, "unexpected error")
+	assert.Equal(t, "wifi", mode, "mode mismatch")
+
+	mode, err = cvMode("station", "", 3)
+	assert.Equal(t, nil, err, "unexpected error")
+	assert.Equal(t, "pom", mode, "mode mismatch")
+
+	_, err = cvMode("wifi", "prog", 0)
+	assert.NotNil(t, err, "expected error for a track with --via wifi")
+	_, err = cvMode("bluetooth", "", 0)
+	assert.NotNil(t, err, "expected error for an invalid --via")
+}
+
+func TestFlagOrDefault(t *testing.T) {
+	command := &cobra.Command{}
+	var settle uint16
+	command.Flags().Uint16Var(&settle, "settle", 0, "")
+
+	// the configuration applies unless the flag is given, even when it is given as 0
+	assert.Equal(t, uint16(300), flagOrDefault(command, "settle", settle, 300))
+	assert.NoError(t, command.Flags().Set("settle", "0"))
+	assert.Equal(t, uint16(0), flagOrDefault(command, "settle", settle, 300))
+}
@@ -3,10 +3,15 @@ package cli
 import (
 	"errors"
 	"fmt"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/keskad/loco/pkgs/app"
+	"github.com/keskad/loco/pkgs/audio"
 	"github.com/keskad/loco/pkgs/decoders"
 	"github.com/spf13/cobra"
 )
@@ -21,6 +26,7 @@ func NewDecoderCommand(app *app.LocoApp) *cobra.Command {
 	}
 
 	command.AddCommand(NewDecoderRBCommand(app))
+	command.AddCommand(NewDecoderSchemaCommand(app))
 
 	return command
 }
@@ -36,6 +42,11 @@ func NewDecoderRBCommand(app *app.LocoApp) *cobra.Command {
 
 	command.AddCommand(NewDecoderRBSoundCommand(app))
 	command.AddCommand(NewDecoderRBWifiCommand(app))
+	command.AddCommand(NewDecoderRBInfoCommand(app))
+	command.AddCommand(NewDecoderRBFirmwareCommand(app))
+	command.AddCommand(NewDecoderRBBackupCommand(app))
+	command.AddCommand(NewDecoderRBRestoreCommand(app))
+	command.AddCommand(NewDecoderRBDiscoverCommand(app))
 	command.AddCommand(NewDecoderRBOutputsCommand(app))
 
 	return command
@@ -50,15 +61,283 @@ func NewDecoderRBSoundCommand(app *app.LocoApp) *cobra.Command {
 		},
 	}
 
+	command.AddCommand(NewDecoderRBSoundSlotsCommand(app))
 	command.AddCommand(NewDecoderRBSoundClearCommand(app))
 	command.AddCommand(NewDecoderRBSoundSyncCommand(app))
+	command.AddCommand(NewDecoderRBSoundRenameCommand(app))
+	command.AddCommand(NewDecoderRBSoundImportCommand(app))
+	command.AddCommand(NewDecoderRBSoundInspectCommand(app))
+	command.AddCommand(NewDecoderRBSoundTestCommand(app))
+	command.AddCommand(NewDecoderRBSoundExportCommand(app))
+	command.AddCommand(NewDecoderRBSoundLintCommand(app))
 
 	return command
 }
 
-func NewDecoderRBSoundClearCommand(app *app.LocoApp) *cobra.Command {
+func NewDecoderRBSoundLintCommand(a *app.LocoApp) *cobra.Command {
+	exclude := []string{}
+
+	command := &cobra.Command{
+		Use:   "lint <local-dir>",
+		Short: "Check the names of the sounds of a local directory against the naming of the RB23xx",
+		Long: `Reads the files of a sound directory by their names on the decoder, as "loco decoder rb sound sync" uploads them,
+and reports the names the decoder does not play as intended:
+
+  errors    a sound without the "F<n>_" prefix of its function, e.g. F11_Decouple.wav for F11,
+            a function beyond F31, two names differing only in case, a slot.yaml not matching the files
+  warnings  a second sound of a function, a prefix like f1_ or F01_, a file that is no WAV sound,
+            characters the firmware may not store, a function not mapped in slot.yaml
+
+The files of .locoignore and of --exclude are left out. The command fails when there is an error,
+use "loco decoder rb sound sync --lint" to check the directory before every sync.`,
+		Example: "  loco decoder rb sound lint ./sounds/br218",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			return a.SoundLintAction(args[0], exclude)
+		},
+	}
+
+	command.Flags().StringArrayVar(&exclude, "exclude", nil, "Leave out the files matching a .locoignore pattern, e.g. '*.flac' (repeatable)")
+
+	return command
+}
+
+func NewDecoderRBSoundImportCommand(a *app.LocoApp) *cobra.Command {
 	type Args struct {
+		Format    string
+		Functions []string
+		Force     bool
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "import <project> <dir>",
+		Short: "Copy the samples of a sound project of another decoder into a local sound directory",
+		Long: `Reads a sound project of another manufacturer and writes its samples into a local sound directory,
+named after the functions that play them, together with a slot.yaml describing them.
+The directory is then uploaded with "loco decoder rb sound sync".
+
+Formats:
+  esu   a LokSound project exported by the LokProgrammer, a directory or a .esux/.zip archive,
+        with the samples of every sound slot in a folder like "Slot 04 - Horn" or "Slot 04 - Horn (F2)"
+  zimo  a ZIMO .zpp sound project, every embedded WAV sample is a slot of its own, in the order
+        they are stored, the schedules of the project are not read
+  loco  a .zip archive of a slot written by "loco decoder rb sound export", its files are copied
+        as they are after their checksums were checked
+
+A slot plays on the function named by its folder, otherwise on the function of its number,
+use --function to assign it to another one.`,
+		Example: "  loco decoder rb sound import ./BR218.esux ./sounds/br218 --function 1=F2 --function 4=F1\n" +
+			"  loco decoder rb sound import ./br218-club.zip ./sounds/br218",
+		Args: cobra.ExactArgs(2),
+		RunE: func(command *cobra.Command, args []string) error {
+			functions, err := parseSlotFunctions(cmdArgs.Functions)
+			if err != nil {
+				return err
+			}
+			return a.ImportSoundProjectAction(args[0], args[1], app.ImportOptions{Format: cmdArgs.Format, Functions: functions, Force: cmdArgs.Force})
+		},
+	}
+
+	command.Flags().BoolVarP(&a.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().StringVar(&cmdArgs.Format, "format", "", "Format of the project: esu, zimo or loco (default: detected from the path)")
+	command.Flags().StringArrayVar(&cmdArgs.Functions, "function", nil, "Assign a slot of the project to a function, e.g. \"4=F2\", can be repeated")
+	command.Flags().BoolVar(&cmdArgs.Force, "force", false, "Import into a directory that is not empty")
+
+	return command
+}
+
+func NewDecoderRBSoundInspectCommand(a *app.LocoApp) *cobra.Command {
+	format := ""
+
+	command := &cobra.Command{
+		Use:   "inspect <project>",
+		Short: "List the slots and the samples of a sound project of another decoder",
+		Long: `Prints the sound slots of an ESU or ZIMO sound project with their samples, the size and the audio format
+of every sample, as they would be copied by "loco decoder rb sound import".`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			return a.InspectSoundProjectAction(args[0], format)
+		},
+	}
+
+	command.Flags().BoolVarP(&a.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().StringVar(&format, "format", "", "Format of the project: esu or zimo (default: detected from the path)")
+
+	return command
+}
+
+// parseSlotFunctions parses the "<slot>=F<n>" assignments of the import command
+func parseSlotFunctions(values []string) (map[int]int, error) {
+	functions := make(map[int]int, len(values))
+	for _, value := range values {
+		slotRaw, fnRaw, ok := strings.Cut(value, "=")
+		slot, slotErr := strconv.Atoi(strings.TrimSpace(slotRaw))
+		fn, fnErr := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(fnRaw)), "F"))
+		if !ok || slotErr != nil || fnErr != nil || slot < 0 || fn < 0 {
+			return nil, fmt.Errorf("invalid --function %q, expected e.g. \"4=F2\"", value)
+		}
+		functions[slot] = fn
+	}
+	return functions, nil
+}
+
+// decoderArgs are the HTTP settings shared by the sound commands
+type decoderArgs struct {
+	Timeout uint16
+	// Address is empty for loco.decoder_address
+	Address string
+	Retries int
+	Backoff time.Duration
+}
+
+func (d *decoderArgs) addFlags(command *cobra.Command) {
+	command.Flags().Uint16VarP(&d.Timeout, "timeout", "", 10, "HTTP connection timeout in seconds")
+	command.Flags().StringVar(&d.Address, "decoder-address", "", "Address of the decoder WiFi, e.g. \"10.0.0.20:8080\" behind a port forward (default loco.decoder_address or 192.168.4.1)")
+	command.Flags().IntVar(&d.Retries, "http-retries", decoders.DefaultRetryPolicy.Attempts-1, "How many times a request is sent again when the decoder WiFi drops it")
+	command.Flags().DurationVar(&d.Backoff, "http-backoff", decoders.DefaultRetryPolicy.Backoff, "Pause before the first repeated request, doubled for every next one")
+}
+
+func (d *decoderArgs) options() []decoders.Option {
+	return []decoders.Option{
+		decoders.WithTimeout(d.Timeout),
+		decoders.WithBaseURL(d.Address),
+		decoders.WithRetryPolicy(decoders.RetryPolicy{Attempts: d.Retries + 1, Backoff: d.Backoff}),
+	}
+}
+
+// wifiArgs switch the WiFi of the decoder on around a command, see app.WithManagedWiFi
+type wifiArgs struct {
+	Manage bool
+	Wait   time.Duration
+}
+
+func (w *wifiArgs) addFlags(command *cobra.Command) {
+	command.Flags().BoolVar(&w.Manage, "manage-wifi", false, "Switch the WiFi of the decoder on over the track before the command and off after it")
+	command.Flags().DurationVar(&w.Wait, "wifi-wait", time.Minute, "How long the decoder is waited for after --manage-wifi switched its WiFi on")
+}
+
+// managed returns the WiFi the command switches, nil without --manage-wifi
+func (w *wifiArgs) managed(mode string, locoId uint8, timeout time.Duration, retries uint8) *app.ManagedWiFi {
+	if !w.Manage {
+		return nil
+	}
+	return &app.ManagedWiFi{Mode: mode, LocoId: locoId, Timeout: timeout, Retries: retries, Wait: w.Wait}
+}
+
+func NewDecoderRBSoundExportCommand(a *app.LocoApp) *cobra.Command {
+	type Args struct {
+		HTTP decoderArgs
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "export <slot> <file.zip>",
+		Short: "Save the files of a sound slot on the Railbox RB23xx decoder into a .zip archive",
+		Long: `Downloads every file of the slot, including its slot.yaml, into a .zip archive for sharing the sounds
+of a locomotive. A loco-package.json in the archive lists the files with their checksums and the decoder
+they come from. The archive is read by "loco decoder rb sound import", which copies the files into
+a local sound directory, to be uploaded with "loco decoder rb sound sync".`,
+		Example: "  loco decoder rb sound export 1 ./br218-club.zip\n" +
+			"  loco decoder rb sound import ./br218-club.zip ./sounds/br218 && loco decoder rb sound sync 1 ./sounds/br218",
+		Args: cobra.ExactArgs(2),
+		RunE: func(command *cobra.Command, args []string) error {
+			slot, err := strconv.ParseUint(args[0], 10, 8)
+			if err != nil {
+				return fmt.Errorf("invalid slot number %q: %w", args[0], err)
+			}
+			if err := a.Initialize(); err != nil {
+				return err
+			}
+			return a.ExportSoundSlotAction(uint8(slot), args[1], cmdArgs.HTTP.options()...)
+		},
+	}
+
+	command.Flags().BoolVarP(&a.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	cmdArgs.HTTP.addFlags(command)
+
+	return command
+}
+
+func NewDecoderRBSoundTestCommand(a *app.LocoApp) *cobra.Command {
+	type Args struct {
+		LocoId  uint8
+		Length  time.Duration
 		Timeout uint16
+		Retries uint8
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "test <function>...",
+		Short: "Play sounds of the decoder by switching their functions on over the command station",
+		Long: `Switches every given function of the locomotive on for --length and off again, one after another,
+to hear if a new sample plays, e.g. F1 after F1_Horn.wav was uploaded. A function that is on already,
+e.g. a looped engine sound, is switched off first so its sound starts again, and is left on.
+The locomotive is reached on the main track.`,
+		Example: "  loco decoder rb sound test F1 F5 -l 3\n  loco decoder rb sound test 2 -l 3 --length 10s",
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			functions := make([]int, 0, len(args))
+			for _, arg := range args {
+				fn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(arg), "F"), 10, 8)
+				if err != nil || fn > 31 {
+					return fmt.Errorf("invalid function %q, expected e.g. F1 or 1 (F0-F31)", arg)
+				}
+				functions = append(functions, int(fn))
+			}
+			if cmdArgs.LocoId == 0 {
+				return fmt.Errorf("select the locomotive with --loco")
+			}
+
+			if err := a.Initialize(); err != nil {
+				return err
+			}
+			return a.SoundTestAction(app.Audition{
+				LocoId:  cmdArgs.LocoId,
+				Length:  cmdArgs.Length,
+				Timeout: time.Second * time.Duration(cmdArgs.Timeout),
+				Retries: flagOrDefault(command, "retry", cmdArgs.Retries, a.Config.Server.Retries),
+			}, functions)
+		},
+	}
+
+	command.Flags().BoolVarP(&a.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Use locomotive under specific address")
+	command.Flags().DurationVar(&cmdArgs.Length, "length", 3*time.Second, "How long every function is kept on")
+	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout in seconds")
+	command.Flags().Uint8VarP(&cmdArgs.Retries, "retry", "", 0, "Retry request multiple times if required (default: server.retries from the configuration file)")
+
+	return command
+}
+
+func NewDecoderRBSoundSlotsCommand(app *app.LocoApp) *cobra.Command {
+	type Args struct {
+		HTTP decoderArgs
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "slots",
+		Short: "List the sound slots on the Railbox RB23xx decoder with their number of files and size, and the free space",
+		Args:  cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+			return app.SoundSlotsAction(cmdArgs.HTTP.options()...)
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	cmdArgs.HTTP.addFlags(command)
+
+	return command
+}
+
+func NewDecoderRBSoundClearCommand(app *app.LocoApp) *cobra.Command {
+	type Args struct {
+		HTTP decoderArgs
 	}
 	cmdArgs := Args{}
 
@@ -72,22 +351,42 @@ func NewDecoderRBSoundClearCommand(app *app.LocoApp) *cobra.Command {
 				return fmt.Errorf("invalid slot number %q: %w", args[0], err)
 			}
 
-			return app.ClearSoundSlot(uint8(slot64), decoders.WithTimeout(cmdArgs.Timeout))
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+			return app.ClearSoundSlot(uint8(slot64), cmdArgs.HTTP.options()...)
 		},
 	}
 
 	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
-	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "HTTP connection timeout in seconds")
+	cmdArgs.HTTP.addFlags(command)
 
 	return command
 }
 
-func NewDecoderRBSoundSyncCommand(app *app.LocoApp) *cobra.Command {
+func NewDecoderRBSoundSyncCommand(a *app.LocoApp) *cobra.Command {
 	type Args struct {
-		Timeout     uint16
+		HTTP        decoderArgs
 		DryRun      bool
 		WithoutLast bool
 		Watch       bool
+		Verify      bool
+		Resume      bool
+		Direction   string
+		Parallel    int
+		Retries     int
+		Transcode   string
+		FFmpeg      string
+		Exclude     []string
+		Keep        []string
+		Force       bool
+		Output      string
+		WiFi        wifiArgs
+		LocoId      uint8
+		Track       string
+		Audition    bool
+		Length      time.Duration
+		Lint        bool
 	}
 	cmdArgs := Args{}
 
@@ -97,10 +396,57 @@ func NewDecoderRBSoundSyncCommand(app *app.LocoApp) *cobra.Command {
 		Long: `Compares the contents of a local directory with the given sound slot on the decoder.
 Files present locally but missing on the decoder are uploaded.
 Files present on the decoder but missing locally are deleted from the decoder.
-Files present on both sides but differing in size are re-uploaded.
-By default the 5 most recently modified local files (modified within the last 24 h) are always re-uploaded.
-Use --without-last to disable this behaviour.
-Use --watch to keep watching the directory and re-sync automatically on every change.`,
+Files present on both sides are re-uploaded when the local file changed since it was last transferred,
+by its SHA-256 checksum kept in .loco-sync.json, or when the decoder lists another size than it did then.
+A file not transferred from this directory yet is re-uploaded when it differs in size.
+A local file renamed since the last sync is found by its checksum and reported as a rename, the RB23xx cannot
+rename a file in place, so it is uploaded under the new name and the old one is deleted.
+The slots of the decoder have no subdirectories, a file of a subdirectory is uploaded under its path
+joined with "_": F1/Horn.wav as F1_Horn.wav. Hidden subdirectories, e.g. .git, are skipped.
+A .locoignore file in the local directory lists the files left alone with the patterns of .gitignore,
+e.g. "*.flac", ".DS_Store" or "masters/", more of them are given with --exclude. An excluded file is not
+uploaded, and an excluded file on the decoder is neither downloaded nor deleted.
+The core samples that are not kept in the local directory, e.g. the startup and shutdown loops, are protected
+with --keep patterns or the "protected" list of slot.yaml. A protected file missing locally is not deleted
+from the decoder, unless --force is given.
+Use --direction pull to download the files of the decoder instead, or --direction both to copy the missing files
+both ways and keep the newer version of a changed file. Neither of them deletes any file. The time of the last
+transfer of every file is kept in .loco-sync.json in the local directory, a file changed on both sides since then
+is reported as a conflict and left alone.
+Use --watch to keep watching the directory and re-sync automatically on every change.
+A sync locks the directory with .loco-sync.lock and the slot with a file of the same name on the decoder,
+a second sync of either of them, e.g. by a --watch running in another terminal, refuses to start.
+Use --manage-wifi to switch the WiFi of the decoder on over the track before the sync and off after it,
+the function of the router is read from CV200 of the locomotive given with --loco and --track.
+Use --audition to hear the uploaded sounds: after the sync the function of every uploaded "F<n>_" file
+of the locomotive given with --loco is switched on over the command station for --audition-length.
+Use --output json to print the plan of the sync as a JSON document instead of the progress, with --dry-run
+nothing is changed: the files to upload, re-upload, download and delete and the skipped ones with the reasons.
+Use --lint to check the names of the sounds before the upload, see "loco decoder rb sound lint".
+Use --verify to read every uploaded file back (first and last block) instead of trusting the HTTP status.
+Use --resume to send files larger than 256 KB in chunks, when the WiFi connection drops the next sync continues
+the upload where it stopped, as long as the local file did not change.
+Use --parallel to transfer a few files at once, e.g. when a slot is filled for the first time.
+After the uploads the slot is listed again, a file missing on the decoder or of another size is reported
+and, with --retry-mismatched, uploaded again.
+Use --transcode to convert stereo, 48 kHz or compressed sounds to the mono 16 bit 22.05 kHz WAV files
+played by the decoder. The native converter reads WAV files only, --transcode ffmpeg converts e.g. MP3 and FLAC
+as well. The converted copies are kept in the user cache directory and uploaded with a .wav extension,
+the local directory is not changed.
+An optional slot.yaml in the local directory describes the sounds of the slot:
+
+  sounds:
+    - function: F1
+      file: F1_Horn.wav
+      volume: 80
+    - function: F2
+      file: F2_Engine.wav
+      loop: true
+  protected:
+    - F0_*
+
+Before an upload every listed file has to be present and named after its function, the manifest itself
+is uploaded with the sounds.`,
 		Args: cobra.ExactArgs(2),
 		RunE: func(command *cobra.Command, args []string) error {
 			slot64, err := strconv.ParseUint(args[0], 10, 8)
@@ -108,20 +454,188 @@ Use --watch to keep watching the directory and re-sync automatically on every ch
 				return fmt.Errorf("invalid slot number %q: %w", args[0], err)
 			}
 
-			opts := []decoders.Option{decoders.WithTimeout(cmdArgs.Timeout)}
+			if err := a.Initialize(); err != nil {
+				return err
+			}
+			opts := cmdArgs.HTTP.options()
+			if cmdArgs.Verify {
+				opts = append(opts, decoders.WithUploadVerification())
+			}
+			if cmdArgs.Resume {
+				opts = append(opts, decoders.WithResumableUploads())
+			}
+			direction, err := app.ParseSyncDirection(cmdArgs.Direction)
+			if err != nil {
+				return err
+			}
 
-			if cmdArgs.Watch {
-				return app.WatchSoundSlot(uint8(slot64), args[1], cmdArgs.DryRun, cmdArgs.WithoutLast, opts...)
+			if cmdArgs.Parallel < 1 {
+				return fmt.Errorf("invalid --parallel %d: at least one file has to be transferred at once", cmdArgs.Parallel)
+			}
+			if cmdArgs.Output != "text" && cmdArgs.Output != "json" {
+				return fmt.Errorf("invalid output format: %s. Must be one of 'text' or 'json'", cmdArgs.Output)
+			}
+			if cmdArgs.Output == "json" && cmdArgs.Watch {
+				return fmt.Errorf("--output json cannot be used with --watch")
+			}
+			options := app.SyncOptions{
+				Direction:       direction,
+				DryRun:          cmdArgs.DryRun,
+				Parallel:        cmdArgs.Parallel,
+				MismatchRetries: cmdArgs.Retries,
+				Exclude:         cmdArgs.Exclude,
+				Keep:            cmdArgs.Keep,
+				Force:           cmdArgs.Force,
+				Lint:            cmdArgs.Lint,
+			}
+			if cmdArgs.Transcode != "" {
+				if options.Transcoder, err = audio.NewTranscoder(cmdArgs.Transcode, cmdArgs.FFmpeg); err != nil {
+					return err
+				}
+			}
+
+			if cmdArgs.Audition {
+				if cmdArgs.LocoId == 0 {
+					return fmt.Errorf("--audition plays the sounds on the main track, select the locomotive with --loco")
+				}
+				options.Audition = &app.Audition{
+					LocoId:  cmdArgs.LocoId,
+					Length:  cmdArgs.Length,
+					Timeout: time.Second * time.Duration(cmdArgs.HTTP.Timeout),
+					Retries: a.Config.Server.Retries,
+				}
+			}
+
+			track, trackErr := trackOrDefault(cmdArgs.Track, cmdArgs.LocoId)
+			if trackErr != nil {
+				return trackErr
 			}
-			return app.SyncSoundSlot(uint8(slot64), args[1], cmdArgs.DryRun, cmdArgs.WithoutLast, opts...)
+			wifi := cmdArgs.WiFi.managed(track, cmdArgs.LocoId, time.Second*time.Duration(cmdArgs.HTTP.Timeout), a.Config.Server.Retries)
+
+			return a.WithManagedWiFi(wifi, func() error {
+				if cmdArgs.Watch {
+					// Ctrl+C stops the watch after the pending sync
+					ctx, stop := signal.NotifyContext(command.Context(), os.Interrupt, syscall.SIGTERM)
+					defer stop()
+					return a.WatchSoundSlot(ctx, uint8(slot64), args[1], options, nil, opts...)
+				}
+				if cmdArgs.Output == "json" {
+					// the plan is printed also when the sync failed after it was made
+					plan, syncErr := a.SyncSoundSlot(uint8(slot64), args[1], options, func(app.SyncEvent) {}, opts...)
+					if plan != nil {
+						if err := a.PrintSyncPlan(plan); err != nil {
+							return err
+						}
+					}
+					return syncErr
+				}
+				_, err := a.SyncSoundSlot(uint8(slot64), args[1], options, nil, opts...)
+				return err
+			}, opts...)
 		},
 	}
 
-	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
-	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "HTTP connection timeout in seconds")
+	command.Flags().BoolVarP(&a.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	cmdArgs.HTTP.addFlags(command)
 	command.Flags().BoolVar(&cmdArgs.DryRun, "dry-run", false, "Preview changes without uploading or deleting any files")
 	command.Flags().BoolVarP(&cmdArgs.WithoutLast, "without-last", "l", false, "Disable automatic re-upload of the 5 most recently modified files (last 24 h)")
+	_ = command.Flags().MarkDeprecated("without-last", "the changed files are found by their checksums, nothing is re-uploaded without a change")
 	command.Flags().BoolVarP(&cmdArgs.Watch, "watch", "w", false, "Watch the local directory and re-sync automatically on every file change")
+	command.Flags().BoolVar(&cmdArgs.Verify, "verify", false, "Read uploaded files back from the decoder and compare them with the local ones")
+	command.Flags().BoolVar(&cmdArgs.Resume, "resume", false, "Upload large files in chunks and continue an interrupted upload on the next sync")
+	command.Flags().IntVar(&cmdArgs.Parallel, "parallel", 1, "Number of files transferred at once")
+	command.Flags().IntVar(&cmdArgs.Retries, "retry-mismatched", 0, "How many times a file missing or truncated on the decoder after the upload is sent again")
+	command.Flags().StringVar(&cmdArgs.Direction, "direction", "push", "Which side is changed: 'push' (the decoder), 'pull' (the local directory) or 'both'")
+	command.Flags().StringVar(&cmdArgs.Transcode, "transcode", "", "Convert the sounds the decoder cannot play before the upload: 'native' (WAV files only) or 'ffmpeg'")
+	command.Flags().StringVar(&cmdArgs.FFmpeg, "ffmpeg", "ffmpeg", "Path of the ffmpeg binary used by --transcode ffmpeg")
+	command.Flags().StringVarP(&cmdArgs.Output, "output", "o", "text", "Output format: 'text' or 'json' (the plan of the sync)")
+	cmdArgs.WiFi.addFlags(command)
+	command.Flags().Uint8Var(&cmdArgs.LocoId, "loco", 0, "Locomotive whose WiFi --manage-wifi switches and which plays the sounds of --audition")
+	command.Flags().StringVarP(&cmdArgs.Track, "track", "t", "", "Track type of --manage-wifi: 'pom' for programming on main, 'prog' for programming track, or empty for automatic selection")
+	command.Flags().BoolVar(&cmdArgs.Audition, "audition", false, "Play every uploaded sound by switching its function on after the sync")
+	command.Flags().DurationVar(&cmdArgs.Length, "audition-length", 3*time.Second, "How long the function of an uploaded sound is kept on by --audition")
+	command.Flags().StringArrayVar(&cmdArgs.Exclude, "exclude", nil, "Leave out the files matching a .locoignore pattern, e.g. '*.flac' (repeatable)")
+	command.Flags().StringArrayVar(&cmdArgs.Keep, "keep", nil, "Never delete the files of the decoder matching a pattern, e.g. 'F0_*' (repeatable)")
+	command.Flags().BoolVar(&cmdArgs.Force, "force", false, "Delete the protected files missing locally as well")
+	command.Flags().BoolVar(&cmdArgs.Lint, "lint", false, "Check the names of the sounds as 'loco decoder rb sound lint' before anything is uploaded")
+
+	return command
+}
+
+func NewDecoderRBSoundRenameCommand(app *app.LocoApp) *cobra.Command {
+	type Args struct {
+		HTTP   decoderArgs
+		Slot   uint8
+		Map    string
+		Local  string
+		DryRun bool
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "rename",
+		Short: "Rename sound files in a slot on the Railbox RB23xx decoder, moving them between functions",
+		Long: `Renames files in a sound slot as listed in a CSV map of "from,to" rows.
+A row of two functions, e.g. "F11,F12", moves every file of F11 to F12 by changing the "F11_" prefix of its name.
+
+  from,to
+  F11_Decouple.wav,F11_Coupling.wav
+  F11,F12
+  F3,F11
+
+The decoder cannot rename files, so each file is downloaded and uploaded under the new name before the old one is deleted.
+When an upload fails the slot is restored. Use --local to rename the files of the local sound directory as well,
+otherwise the next sync would upload the old names again.`,
+		Example: "  loco decoder rb sound rename --slot 1 --map rename.csv --local ./sounds/br218",
+		Args:    cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+			return app.RenameSoundFiles(cmdArgs.Slot, cmdArgs.Map, cmdArgs.Local, cmdArgs.DryRun, cmdArgs.HTTP.options()...)
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	cmdArgs.HTTP.addFlags(command)
+	command.Flags().Uint8VarP(&cmdArgs.Slot, "slot", "s", 0, "Sound slot on the decoder")
+	command.Flags().StringVarP(&cmdArgs.Map, "map", "m", "", "CSV file with \"from,to\" rows")
+	command.Flags().StringVarP(&cmdArgs.Local, "local", "", "", "Local sound directory to rename the files in as well")
+	command.Flags().BoolVar(&cmdArgs.DryRun, "dry-run", false, "Print the renames without changing anything")
+	command.MarkFlagRequired("slot")
+	command.MarkFlagRequired("map")
+
+	return command
+}
+
+func NewDecoderRBDiscoverCommand(app *app.LocoApp) *cobra.Command {
+	type Args struct {
+		Scan    bool
+		Timeout uint16
+		Yes     bool
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "discover",
+		Short: "Find Railbox RB23xx decoders on the local network",
+		Long: `Looks for the web interface of RB23xx decoders: at 192.168.4.1 when connected to the WiFi of the decoder,
+at the devices answering an mDNS query for web servers and at the neighbours in the ARP table.
+Use --scan to probe every host of the local networks too. When a single decoder is found, storing its address
+as loco.decoder_address in ~/.loco.yaml is offered.`,
+		Args: cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+			return app.DiscoverDecodersAction(cmdArgs.Scan, time.Duration(cmdArgs.Timeout)*time.Second, cmdArgs.Yes)
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().BoolVar(&cmdArgs.Scan, "scan", false, "Probe every host of the local networks, up to 254 per network")
+	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 2, "Seconds to wait for the mDNS answers and for every host")
+	command.Flags().BoolVarP(&cmdArgs.Yes, "yes", "y", false, "Store the address of the decoder without asking")
 
 	return command
 }
@@ -131,6 +645,7 @@ func NewDecoderRBWifiCommand(app *app.LocoApp) *cobra.Command {
 		LocoId  uint8
 		Track   string
 		Timeout uint16
+		Retries uint8
 	}
 	cmdArgs := Args{}
 
@@ -157,18 +672,245 @@ then enables or disables that function on the decoder.`,
 			}
 
 			enable := args[0] == "on"
-			return app.RBWifiAction(track, cmdArgs.LocoId, enable, time.Second*time.Duration(cmdArgs.Timeout))
+			return app.RBWifiAction(track, cmdArgs.LocoId, enable, time.Second*time.Duration(cmdArgs.Timeout), flagOrDefault(command, "retry", cmdArgs.Retries, app.Config.Server.Retries))
 		},
 	}
 
 	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
 	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout in seconds")
+	command.Flags().Uint8VarP(&cmdArgs.Retries, "retry", "", 0, "Retry request multiple times if required (default: server.retries from the configuration file)")
 	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Use locomotive under specific address")
 	command.Flags().StringVarP(&cmdArgs.Track, "track", "t", "", "Track type: 'pom' for programming on main, 'prog' for programming track, or empty for automatic selection")
 
 	return command
 }
 
+func NewDecoderRBInfoCommand(app *app.LocoApp) *cobra.Command {
+	type Args struct {
+		HTTP    decoderArgs
+		LocoId  uint8
+		Track   string
+		Retries uint8
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "info",
+		Short: "Print the model, firmware version and serial number of a Railbox RB23xx decoder",
+		Long: `Reads the model, the firmware version and the serial number from the WiFi interface of the decoder.
+When the decoder cannot be reached over WiFi, or its firmware does not report them, CV7 (version)
+and CV8 (manufacturer) are read over the track instead, use --loco and --track to select the locomotive.`,
+		Args: cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+
+			track, trackErr := trackOrDefault(cmdArgs.Track, cmdArgs.LocoId)
+			if trackErr != nil {
+				return trackErr
+			}
+			return app.DecoderInfoAction(track, cmdArgs.LocoId, time.Second*time.Duration(cmdArgs.HTTP.Timeout),
+				flagOrDefault(command, "retry", cmdArgs.Retries, app.Config.Server.Retries), cmdArgs.HTTP.options()...)
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	cmdArgs.HTTP.addFlags(command)
+	command.Flags().Uint8VarP(&cmdArgs.Retries, "retry", "", 0, "Retry reading a CV over the track multiple times if required (default: server.retries from the configuration file)")
+	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Read the CVs of the locomotive under specific address")
+	command.Flags().StringVarP(&cmdArgs.Track, "track", "t", "", "Track type: 'pom' for programming on main, 'prog' for programming track, or empty for automatic selection")
+
+	return command
+}
+
+func NewDecoderRBFirmwareCommand(app *app.LocoApp) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "firmware",
+		Short: "Firmware updates of Railbox RB23xx decoders",
+		RunE: func(command *cobra.Command, args []string) error {
+			return errors.New("please select a command")
+		},
+	}
+
+	command.AddCommand(NewDecoderRBFirmwareUploadCommand(app))
+
+	return command
+}
+
+func NewDecoderRBFirmwareUploadCommand(a *app.LocoApp) *cobra.Command {
+	type Args struct {
+		HTTP           decoderArgs
+		SHA256         string
+		SkipChecksum   bool
+		ExpectVersion  string
+		RestartTimeout time.Duration
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "upload <file>",
+		Short: "Upload a firmware image to a Railbox RB23xx decoder over WiFi",
+		Long: `Checks the SHA-256 checksum of the image, uploads it to the decoder and waits until the decoder restarts.
+The checksum is given with --sha256 or read from <file>.sha256, as written by sha256sum.
+The firmware version reported by the decoder is printed before and after the update, use --expect-version
+to fail when the decoder does not run the new version after the restart.
+Keep the locomotive on a powered track during the update, an interrupted upload keeps the running firmware.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := a.Initialize(); err != nil {
+				return err
+			}
+			return a.FirmwareUploadAction(args[0], app.FirmwareOptions{
+				SHA256:         cmdArgs.SHA256,
+				SkipChecksum:   cmdArgs.SkipChecksum,
+				ExpectVersion:  cmdArgs.ExpectVersion,
+				RestartTimeout: cmdArgs.RestartTimeout,
+			}, cmdArgs.HTTP.options()...)
+		},
+	}
+
+	command.Flags().BoolVarP(&a.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	cmdArgs.HTTP.addFlags(command)
+	command.Flags().StringVar(&cmdArgs.SHA256, "sha256", "", "Expected SHA-256 checksum of the image (default: read from <file>.sha256)")
+	command.Flags().BoolVar(&cmdArgs.SkipChecksum, "skip-checksum", false, "Upload an image without a known checksum")
+	command.Flags().StringVar(&cmdArgs.ExpectVersion, "expect-version", "", "Firmware version the decoder has to report after the update")
+	command.Flags().DurationVar(&cmdArgs.RestartTimeout, "restart-timeout", decoders.FIRMWARE_RESTART_TIMEOUT, "How long to wait for the decoder to restart after the upload")
+
+	return command
+}
+
+func NewDecoderRBBackupCommand(a *app.LocoApp) *cobra.Command {
+	type Args struct {
+		HTTP           decoderArgs
+		LocoId         uint8
+		Track          string
+		Retries        uint8
+		CVs            string
+		SkipCVs        bool
+		SkipWiFi       bool
+		DownloadSounds bool
+		WiFi           wifiArgs
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "backup <dir>",
+		Short: "Save the CVs, the AUX output map and the sound slots of a Railbox RB23xx decoder into a directory",
+		Long: `Captures everything needed to reconstruct a decoder into a directory that can be kept in a repository:
+  cvs.txt           the CVs read over the track, in the format of "loco cv set"
+  outputs.txt       the AUX output mapping read over WiFi
+  slots/<n>/        the sound files, with --download-sounds, otherwise the slots are only listed
+  loco-backup.json  the manifest: the decoder, the CV ranges and the files of every slot
+The CVs are read through the command station, everything else through the WiFi of the decoder.
+Use --skip-cvs or --skip-wifi when only one of them is reachable, or --manage-wifi to switch the WiFi
+of the decoder on over the track for the backup and off after it.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := a.Initialize(); err != nil {
+				return err
+			}
+			track, trackErr := trackOrDefault(cmdArgs.Track, cmdArgs.LocoId)
+			if trackErr != nil {
+				return trackErr
+			}
+			if cmdArgs.SkipCVs && cmdArgs.SkipWiFi {
+				return errors.New("nothing to back up with both --skip-cvs and --skip-wifi")
+			}
+			options := app.BackupOptions{
+				CVs:            cmdArgs.CVs,
+				Mode:           track,
+				LocoId:         cmdArgs.LocoId,
+				Timeout:        time.Second * time.Duration(cmdArgs.HTTP.Timeout),
+				Retries:        flagOrDefault(command, "retry", cmdArgs.Retries, a.Config.Server.Retries),
+				SkipWiFi:       cmdArgs.SkipWiFi,
+				DownloadSounds: cmdArgs.DownloadSounds,
+			}
+			if cmdArgs.SkipCVs {
+				options.CVs = ""
+			}
+			var wifi *app.ManagedWiFi
+			if !cmdArgs.SkipWiFi {
+				wifi = cmdArgs.WiFi.managed(track, cmdArgs.LocoId, options.Timeout, options.Retries)
+			}
+			return a.WithManagedWiFi(wifi, func() error {
+				return a.DecoderBackupAction(args[0], options, cmdArgs.HTTP.options()...)
+			}, cmdArgs.HTTP.options()...)
+		},
+	}
+
+	command.Flags().BoolVarP(&a.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	cmdArgs.HTTP.addFlags(command)
+	command.Flags().Uint8VarP(&cmdArgs.Retries, "retry", "", 0, "Retry reading a CV multiple times if required (default: server.retries from the configuration file)")
+	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Read the CVs of the locomotive under specific address")
+	command.Flags().StringVarP(&cmdArgs.Track, "track", "t", "", "Track type: 'pom' for programming on main, 'prog' for programming track, or empty for automatic selection")
+	command.Flags().StringVar(&cmdArgs.CVs, "cvs", "cv1-cv256", "CVs to back up, e.g. \"cv1-cv256,cv257-cv512\"")
+	command.Flags().BoolVar(&cmdArgs.SkipCVs, "skip-cvs", false, "Do not read the CVs over the track")
+	command.Flags().BoolVar(&cmdArgs.SkipWiFi, "skip-wifi", false, "Do not read the output map and the sound slots over WiFi")
+	command.Flags().BoolVar(&cmdArgs.DownloadSounds, "download-sounds", false, "Download the sound files, not only their listing")
+	cmdArgs.WiFi.addFlags(command)
+
+	return command
+}
+
+func NewDecoderRBRestoreCommand(a *app.LocoApp) *cobra.Command {
+	type Args struct {
+		HTTP     decoderArgs
+		LocoId   uint8
+		Track    string
+		Settle   uint16
+		SkipCVs  bool
+		SkipWiFi bool
+		DryRun   bool
+		Yes      bool
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "restore <dir>",
+		Short: "Write a backup made by \"loco decoder rb backup\" back to a Railbox RB23xx decoder",
+		Long: `Replays a backup directory: the CVs are written with verification through the command station,
+then the AUX output map and the downloaded sound slots are uploaded over the WiFi of the decoder.
+The CVs go to the locomotive and the track of the backup, unless --loco or --track is given.
+The plan is printed and confirmed before any change, --dry-run stops after the plan.`,
+		Annotations: writesCVs(""),
+		Args:        cobra.ExactArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := a.Initialize(); err != nil {
+				return err
+			}
+			options := app.RestoreOptions{
+				Timeout:  time.Second * time.Duration(cmdArgs.HTTP.Timeout),
+				Settle:   time.Millisecond * time.Duration(flagOrDefault(command, "settle", cmdArgs.Settle, a.Config.Server.Settle)),
+				SkipCVs:  cmdArgs.SkipCVs,
+				SkipWiFi: cmdArgs.SkipWiFi,
+				DryRun:   cmdArgs.DryRun,
+				Yes:      cmdArgs.Yes,
+			}
+			if command.Flags().Changed("loco") || command.Flags().Changed("track") {
+				track, trackErr := trackOrDefault(cmdArgs.Track, cmdArgs.LocoId)
+				if trackErr != nil {
+					return trackErr
+				}
+				options.Mode, options.LocoId = track, cmdArgs.LocoId
+			}
+			return a.DecoderRestoreAction(args[0], options, cmdArgs.HTTP.options()...)
+		},
+	}
+
+	command.Flags().BoolVarP(&a.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	cmdArgs.HTTP.addFlags(command)
+	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Write the CVs to the locomotive under specific address (default: the locomotive of the backup)")
+	command.Flags().StringVarP(&cmdArgs.Track, "track", "t", "", "Track type: 'pom' for programming on main, 'prog' for programming track (default: the track of the backup)")
+	command.Flags().Uint16VarP(&cmdArgs.Settle, "settle", "", 0, "Time in miliseconds between writes (default: server.settle from the configuration file)")
+	command.Flags().BoolVar(&cmdArgs.SkipCVs, "skip-cvs", false, "Do not write the CVs over the track")
+	command.Flags().BoolVar(&cmdArgs.SkipWiFi, "skip-wifi", false, "Do not upload the output map and the sound slots over WiFi")
+	command.Flags().BoolVar(&cmdArgs.DryRun, "dry-run", false, "Only print what would be restored")
+	command.Flags().BoolVarP(&cmdArgs.Yes, "yes", "y", false, "Restore without asking")
+
+	return command
+}
+
 func NewDecoderRBOutputsCommand(app *app.LocoApp) *cobra.Command {
 	command := &cobra.Command{
 		Use:   "outputs",
@@ -179,6 +921,7 @@ func NewDecoderRBOutputsCommand(app *app.LocoApp) *cobra.Command {
 	}
 
 	command.AddCommand(NewDecoderRBOutputsPrintCommand(app))
+	command.AddCommand(NewDecoderRBOutputsApplyCommand(app))
 
 	return command
 }
@@ -200,3 +943,81 @@ the cabin light, together with its active driving direction.`,
 
 	return command
 }
+
+func NewDecoderRBOutputsApplyCommand(app *app.LocoApp) *cobra.Command {
+	type Args struct {
+		HTTP   decoderArgs
+		DryRun bool
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "apply <map.txt>",
+		Short: "Write an AUX output mapping file to the decoder",
+		Long: `Checks the given RB23xx AUX output mapping file, prints the mapping lines added and removed
+against the map on the decoder, uploads the file over WiFi and reads it back to verify it.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+			return app.ApplyOutputsAction(args[0], cmdArgs.DryRun, cmdArgs.HTTP.options()...)
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	cmdArgs.HTTP.addFlags(command)
+	command.Flags().BoolVar(&cmdArgs.DryRun, "dry-run", false, "Only print the changes, do not write the map")
+
+	return command
+}
+
+func NewDecoderSchemaCommand(a *app.LocoApp) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "schema",
+		Short: "Schemas describing the CVs of the decoder types",
+		RunE: func(command *cobra.Command, args []string) error {
+			return errors.New("please select a command")
+		},
+	}
+
+	command.AddCommand(NewDecoderSchemaImportJMRICommand(a))
+
+	return command
+}
+
+func NewDecoderSchemaImportJMRICommand(a *app.LocoApp) *cobra.Command {
+	type Args struct {
+		Output string
+		Force  bool
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "import-jmri <decoder.xml>...",
+		Short: "Convert JMRI (DecoderPro) decoder definitions into decoder schemas",
+		Long: `Converts the decoder definitions of JMRI, the XML files of xml/decoders in a JMRI installation,
+into the schemas read by "loco cv get", "loco cv set" and "loco cv doc".
+
+A schema is named after its file, e.g. ESU_LokSound5.xml is written to ~/.loco/decoders/esu_loksound5.yaml,
+and is used for a locomotive with the decoderType "esu_loksound5" in loco.json.
+
+Indexed CVs, fields of several bits and the files included by a definition are skipped, list them with --debug.`,
+		Example: "  loco decoder schema import-jmri /usr/share/jmri/xml/decoders/ESU_LokSound5.xml\n" +
+			"  loco decoder schema import-jmri ./Zimo_MX6*.xml --output ./schemas\n" +
+			"  loco decoder schema import-jmri ./Railbox_RB23xx.xml -o -",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := a.Initialize(); err != nil {
+				return err
+			}
+			return a.ImportJMRIAction(args, cmdArgs.Output, cmdArgs.Force)
+		},
+	}
+
+	command.Flags().BoolVarP(&a.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().StringVarP(&cmdArgs.Output, "output", "o", "", "Directory of the schemas, '-' prints a single schema (default: ~/.loco/decoders)")
+	command.Flags().BoolVar(&cmdArgs.Force, "force", false, "Replace the schemas that already exist")
+
+	return command
+}
@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/keskad/loco/pkgs/app"
+	"github.com/spf13/cobra"
+)
+
+func NewFeedbackCommand(app *app.LocoApp) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "feedback",
+		Short: "R-BUS feedback modules (Roco 10787, 10819, 10808 in R-BUS emulation)",
+		Long: `Read and configure feedback modules connected to the Z21 R-BUS.
+
+Input modes and emulation settings of the CAN occupancy detector 10808 are not available in the Z21 LAN protocol,
+use the Z21 Maintenance Tool for them.`,
+		RunE: func(command *cobra.Command, args []string) error {
+			return errors.New("please select a command")
+		},
+	}
+
+	command.AddCommand(NewFeedbackStatusCommand(app))
+	command.AddCommand(NewFeedbackAddressCommand(app))
+	return command
+}
+
+func NewFeedbackStatusCommand(app *app.LocoApp) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "status",
+		Short: "List occupied inputs of all feedback modules",
+		Args:  cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+			return app.FeedbackStatusAction()
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	return command
+}
+
+func NewFeedbackAddressCommand(app *app.LocoApp) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "address <1-20>",
+		Short: "Program the address of a feedback module",
+		Long: `Program the R-BUS address of a feedback module. Only the module being programmed may be connected to the R-BUS.
+The Z21 sends the programming sequence until Enter is pressed.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+
+			addr64, parseErr := strconv.ParseUint(args[0], 10, 8)
+			if parseErr != nil || addr64 < 1 || addr64 > 20 {
+				return fmt.Errorf("invalid feedback module address %q, must be 1-20", args[0])
+			}
+
+			return app.FeedbackAddressAction(uint8(addr64), func() error {
+				_, err := bufio.NewReader(os.Stdin).ReadString('\n')
+				return err
+			})
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	return command
+}
@@ -4,8 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/keskad/loco/pkgs/app"
+	"github.com/keskad/loco/pkgs/commandstation"
 	"github.com/spf13/cobra"
 )
 
@@ -30,13 +32,27 @@ func NewFnSetCommand(app *app.LocoApp) *cobra.Command {
 		LocoId  uint8
 		Track   string
 		Timeout uint16
+		Retries uint8
 		Off     bool
+		Toggle  bool
+		Repeat  uint8
+		Binary  uint16
 	}
 
 	cmdArgs := Args{}
 	command := &cobra.Command{
 		Use:   "set",
 		Short: "Sends a function request to the decoder",
+		Long: `Switches a function on, or off with --off.
+
+--toggle inverts the function in a single command, which triggers momentary sounds (horn, whistle)
+without switching them on and off again. It is not repeated with --repeat, every repetition would invert the function again.
+
+--binary switches a DCC binary state (1-32767) instead of a function, modern sound decoders use them beyond F31
+e.g. for lighting scenarios. Binary states cannot be toggled.
+
+A locomotive driven by another device (e.g. the Z21 app) is not taken over, unless --steal is used.`,
+		Example: "  loco fn set 0 --loco 3\n  loco fn set 2 --loco 3 --toggle\n  loco fn set --binary 120 --loco 3",
 		RunE: func(command *cobra.Command, args []string) error {
 			if err := app.Initialize(); err != nil {
 				return err
@@ -47,6 +63,19 @@ func NewFnSetCommand(app *app.LocoApp) *cobra.Command {
 			if trackErr != nil {
 				return trackErr
 			}
+			repeat := flagOrDefault(command, "repeat", cmdArgs.Repeat, app.Config.Server.Repeat)
+			if command.Flags().Changed("binary") {
+				if len(args) > 0 {
+					return errors.New("--binary replaces the function number")
+				}
+				if cmdArgs.Toggle {
+					return errors.New("binary states cannot be toggled")
+				}
+				if track != "pom" {
+					return errors.New("binary states can be sent only on the main track")
+				}
+				return app.SendBinaryStateAction(cmdArgs.LocoId, cmdArgs.Binary, !cmdArgs.Off, repeat, time.Second*time.Duration(cmdArgs.Timeout), flagOrDefault(command, "retry", cmdArgs.Retries, app.Config.Server.Retries))
+			}
 			if len(args) == 0 {
 				return errors.New("need to specify a function number")
 			}
@@ -56,14 +85,27 @@ func NewFnSetCommand(app *app.LocoApp) *cobra.Command {
 				return fmt.Errorf("invalid function number %q: %w", args[0], err)
 			}
 
-			return app.SendFnAction(track, cmdArgs.LocoId, int(fnNum64), !cmdArgs.Off)
+			if cmdArgs.Off && cmdArgs.Toggle {
+				return errors.New("--off and --toggle cannot be used together")
+			}
+			action := commandstation.FnSwitch(!cmdArgs.Off)
+			if cmdArgs.Toggle {
+				action = commandstation.FnToggle
+			}
+
+			return app.SendFnAction(track, cmdArgs.LocoId, int(fnNum64), action, repeat, time.Second*time.Duration(cmdArgs.Timeout), flagOrDefault(command, "retry", cmdArgs.Retries, app.Config.Server.Retries))
 		},
 	}
 
 	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
 	command.Flags().BoolVarP(&cmdArgs.Off, "off", "d", false, "Toggle the function off")
+	command.Flags().BoolVarP(&cmdArgs.Toggle, "toggle", "", false, "Invert the function, e.g. to sound the horn")
+	command.Flags().Uint16VarP(&cmdArgs.Binary, "binary", "", 0, "Switch the DCC binary state with this number instead of a function")
 	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
+	command.Flags().Uint8VarP(&cmdArgs.Retries, "retry", "", 0, "Retry request multiple times if required (default: server.retries from the configuration file)")
+	command.Flags().Uint8VarP(&cmdArgs.Repeat, "repeat", "", 0, "Send the command again this many times, e.g. on dirty track (default: server.repeat from the configuration file)")
 	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Use locomotive under specific address")
+	command.Flags().BoolVarP(&app.Steal, "steal", "", false, "Take the locomotive over when another device (e.g. the Z21 app) drives it")
 	command.Flags().StringVarP(&cmdArgs.Track, "track", "t", "", "Track type: 'pom' for programming on main, 'prog' for programming track, or empty for automatic selection")
 
 	// Add the list subcommand
@@ -76,6 +118,7 @@ func NewFnListCommand(app *app.LocoApp) *cobra.Command {
 	type Args struct {
 		LocoId  uint8
 		Timeout uint16
+		Retries uint8
 	}
 
 	cmdArgs := Args{}
@@ -87,12 +130,13 @@ func NewFnListCommand(app *app.LocoApp) *cobra.Command {
 				return err
 			}
 
-			return app.ListFnAction(cmdArgs.LocoId)
+			return app.ListFnAction(cmdArgs.LocoId, time.Second*time.Duration(cmdArgs.Timeout), flagOrDefault(command, "retry", cmdArgs.Retries, app.Config.Server.Retries))
 		},
 	}
 
 	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
 	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
+	command.Flags().Uint8VarP(&cmdArgs.Retries, "retry", "", 0, "Retry request multiple times if required (default: server.retries from the configuration file)")
 	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Use locomotive under specific address")
 
 	return command
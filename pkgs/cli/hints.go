@@ -0,0 +1,39 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/spf13/cobra"
+)
+
+// capabilityHints are alternatives suggested when the station does not support what was requested
+var capabilityHints = map[commandstation.Capability]string{
+	commandstation.CapabilityReadBack:       "nothing is received in --dry-run mode, run the command without it",
+	commandstation.CapabilityLocoState:      "use 'loco monitor' to follow the loco state from the station broadcasts",
+	commandstation.CapabilityFnOnProg:       "functions can be switched on the main track only, use 'loco fn set --track pom'",
+	commandstation.CapabilityMMRead:         "MM decoders are write-only, write the registers with 'loco cv set --format mm' without --verify",
+	commandstation.CapabilityMMOnMain:       "put the loco on the programming track and use 'loco cv set --track prog --format mm'",
+	commandstation.CapabilityFeedback:       "set server.type to 'z21' in the configuration",
+	commandstation.CapabilityMonitor:        "select a z21 station profile with 'loco monitor --station <name>'",
+	commandstation.CapabilityCVProgramming:  "program through a backend that talks to the command station itself, e.g. server.type 'dccex-tcp' or 'loconet-tcp'",
+	commandstation.CapabilityLANProgramming: "check the lock with 'loco station unlock-status', or program through the multiMAUS",
+}
+
+// Hints appends a suggestion to errors caused by a capability the command station does not implement
+func Hints() Middleware {
+	return func(next RunE) RunE {
+		return func(command *cobra.Command, args []string) error {
+			err := next(command, args)
+			var notSupported *commandstation.ErrNotSupported
+			if err == nil || !errors.As(err, &notSupported) {
+				return err
+			}
+			if hint, ok := capabilityHints[notSupported.Capability]; ok {
+				return fmt.Errorf("%w\nhint: %s", err, hint)
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package cli
+
+import (
+	"github.com/keskad/loco/pkgs/app"
+	"github.com/spf13/cobra"
+)
+
+func NewInfoCommand(app *app.LocoApp) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "info",
+		Short: "Show the locomotive of the current directory",
+		Long: `Shows the locomotive described by loco.json of the current directory: its name, address, class, era,
+owner, decoder type and the photo in "image", resolved against the directory.`,
+		Args: cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+			return app.LocoInfoAction()
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+
+	return command
+}
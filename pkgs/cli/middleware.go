@@ -0,0 +1,119 @@
+package cli
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/keskad/loco/pkgs/app"
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+//
+// Context: cross-cutting behaviour wrapped around the RunE handlers of all commands.
+// Middlewares are applied once to the whole command tree in NewRootCommand.
+//
+
+// RunE is the cobra command handler
+type RunE func(command *cobra.Command, args []string) error
+
+// Middleware wraps a handler, it decides if and when the next handler is called
+type Middleware func(next RunE) RunE
+
+// Chain wraps run with middlewares, the first middleware is the outermost one
+func Chain(run RunE, middlewares ...Middleware) RunE {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		run = middlewares[i](run)
+	}
+	return run
+}
+
+// Use applies middlewares to the command and all of its subcommands
+func Use(command *cobra.Command, middlewares ...Middleware) {
+	if command.RunE != nil {
+		command.RunE = Chain(command.RunE, middlewares...)
+	}
+	for _, sub := range command.Commands() {
+		Use(sub, middlewares...)
+	}
+}
+
+// Timing logs how long the command took, visible with --debug
+func Timing() Middleware {
+	return func(next RunE) RunE {
+		return func(command *cobra.Command, args []string) error {
+			started := time.Now()
+			err := next(command, args)
+			logrus.Debugf("%s finished in %s", command.CommandPath(), time.Since(started).Round(time.Millisecond))
+			return err
+		}
+	}
+}
+
+// Exit codes returned by the process
+const (
+	ExitOK      = 0
+	ExitFailure = 1
+	ExitTimeout = 3
+	ExitDrift   = 4 // "cv audit" found CVs different from the project files, or an assertion of a CV file failed
+	ExitDenied  = 5 // the policy file does not allow the command
+	ExitApply   = 6 // "cv apply" could not write or verify some CVs
+)
+
+// ExitError carries the process exit code together with the error
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string { return e.Err.Error() }
+func (e *ExitError) Unwrap() error { return e.Err }
+
+// ExitCodes maps errors returned by commands to exit codes, so scripts can tell a timeout from other failures
+func ExitCodes() Middleware {
+	return func(next RunE) RunE {
+		return func(command *cobra.Command, args []string) error {
+			err := next(command, args)
+			if err == nil {
+				return nil
+			}
+			var exitErr *ExitError
+			if errors.As(err, &exitErr) {
+				return err
+			}
+			return &ExitError{Code: classifyError(err), Err: err}
+		}
+	}
+}
+
+func classifyError(err error) int {
+	var netErr net.Error
+	if errors.Is(err, commandstation.ErrTimeout) || errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ExitTimeout
+	}
+	if errors.Is(err, app.ErrCVDrift) || errors.Is(err, app.ErrCVAssertion) {
+		return ExitDrift
+	}
+	if errors.Is(err, ErrDenied) {
+		return ExitDenied
+	}
+	if errors.Is(err, app.ErrCVApplyFailed) {
+		return ExitApply
+	}
+	return ExitFailure
+}
+
+// ExitCode returns the process exit code for an error returned by the root command
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+	return ExitFailure
+}
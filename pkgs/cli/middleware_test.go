@@ -0,0 +1,150 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keskad/loco/pkgs/app"
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChain_Order(t *testing.T) {
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next RunE) RunE {
+			return func(command *cobra.Command, args []string) error {
+				calls = append(calls, name+":before")
+				err := next(command, args)
+				calls = append(calls, name+":after")
+				return err
+			}
+		}
+	}
+
+	run := Chain(func(command *cobra.Command, args []string) error {
+		calls = append(calls, "run")
+		return nil
+	}, record("outer"), record("inner"))
+
+	assert.NoError(t, run(&cobra.Command{}, nil))
+	assert.Equal(t, []string{"outer:before", "inner:before", "run", "inner:after", "outer:after"}, calls)
+}
+
+func TestUse_WrapsSubcommands(t *testing.T) {
+	wrapped := 0
+	count := func(next RunE) RunE {
+		return func(command *cobra.Command, args []string) error {
+			wrapped++
+			return next(command, args)
+		}
+	}
+
+	root := &cobra.Command{Use: "root", RunE: func(*cobra.Command, []string) error { return nil }}
+	sub := &cobra.Command{Use: "sub", RunE: func(*cobra.Command, []string) error { return nil }}
+	noRun := &cobra.Command{Use: "group"}
+	root.AddCommand(sub, noRun)
+
+	Use(root, count)
+
+	assert.NoError(t, root.RunE(root, nil))
+	assert.NoError(t, sub.RunE(sub, nil))
+	assert.Nil(t, noRun.RunE)
+	assert.Equal(t, 2, wrapped)
+}
+
+func TestExitCodes(t *testing.T) {
+	failWith := func(err error) RunE {
+		return Chain(func(*cobra.Command, []string) error { return err }, ExitCodes())
+	}
+
+	assert.Equal(t, ExitOK, ExitCode(failWith(nil)(&cobra.Command{}, nil)))
+	assert.Equal(t, ExitFailure, ExitCode(failWith(errors.New("boom"))(&cobra.Command{}, nil)))
+	assert.Equal(t, ExitTimeout, ExitCode(failWith(fmt.Errorf("upload failed: %w", os.ErrDeadlineExceeded))(&cobra.Command{}, nil)))
+	assert.Equal(t, ExitDrift, ExitCode(failWith(fmt.Errorf("%w on 1 CV(s)", app.ErrCVDrift))(&cobra.Command{}, nil)))
+	assert.Equal(t, ExitDrift, ExitCode(failWith(fmt.Errorf("%w: 1 of 2 assertion(s)", app.ErrCVAssertion))(&cobra.Command{}, nil)))
+	assert.Equal(t, ExitApply, ExitCode(failWith(fmt.Errorf("%w: 1 of 3 CV(s) failed", app.ErrCVApplyFailed))(&cobra.Command{}, nil)))
+	assert.Equal(t, 7, ExitCode(failWith(&ExitError{Code: 7, Err: errors.New("custom")})(&cobra.Command{}, nil)))
+}
+
+func TestExitCodes_StationTimeout(t *testing.T) {
+	// a command station that is switched off
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer silent.Close()
+	station, err := commandstation.NewZ21Roco(commandstation.TransportUDP, "127.0.0.1", uint16(silent.LocalAddr().(*net.UDPAddr).Port), commandstation.Retries(0))
+	assert.NoError(t, err)
+	defer station.CleanUp()
+
+	run := Chain(func(*cobra.Command, []string) error {
+		_, err := station.ReadCV(commandstation.ProgrammingTrackMode, commandstation.LocoCV{Cv: commandstation.CV{Num: 8}},
+			commandstation.Timeout(100*time.Millisecond))
+		return err
+	}, ExitCodes())
+	err = run(&cobra.Command{}, nil)
+	assert.ErrorIs(t, err, commandstation.ErrTimeout)
+	assert.Equal(t, ExitTimeout, ExitCode(err))
+}
+
+func TestHints(t *testing.T) {
+	failWith := func(err error) error {
+		return Chain(func(*cobra.Command, []string) error { return err }, Hints())(&cobra.Command{}, nil)
+	}
+
+	notSupported := fmt.Errorf("cannot read: %w", commandstation.NotSupported(commandstation.CapabilityMMRead, "MM decoders cannot be read"))
+	err := failWith(notSupported)
+	assert.ErrorIs(t, err, notSupported)
+	assert.Contains(t, err.Error(), "hint: MM decoders are write-only")
+
+	var typed *commandstation.ErrNotSupported
+	assert.ErrorAs(t, err, &typed)
+	assert.Equal(t, commandstation.CapabilityMMRead, typed.Capability)
+
+	assert.Equal(t, "boom", failWith(errors.New("boom")).Error())
+	assert.NoError(t, failWith(nil))
+}
+
+func TestPermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`default: operator
+users:
+    `+currentUser()+`: operator
+profiles:
+    operator:
+        deny: ["cv set", "decoder", "addr"]
+    admin: {}
+`), 0o644))
+
+	root := &cobra.Command{Use: "loco"}
+	cv := &cobra.Command{Use: "cv"}
+	set := &cobra.Command{Use: "set", RunE: func(*cobra.Command, []string) error { return nil }}
+	get := &cobra.Command{Use: "get", RunE: func(*cobra.Command, []string) error { return nil }}
+	session := &cobra.Command{Use: "prog-session", Annotations: writesCVs(""), RunE: func(*cobra.Command, []string) error { return nil }}
+	compose := &cobra.Command{Use: "compose", Annotations: writesCVs("write"), RunE: func(*cobra.Command, []string) error { return nil }}
+	compose.Flags().Bool("write", false, "")
+	root.AddCommand(cv, session, compose)
+	cv.AddCommand(set, get)
+	Use(root, ExitCodes(), Permissions(path))
+
+	err := set.RunE(set, nil)
+	assert.ErrorIs(t, err, ErrDenied)
+	assert.Equal(t, ExitDenied, ExitCode(err))
+	assert.Equal(t, "'loco cv set' is not allowed on this machine for the 'operator' profile", errors.Unwrap(err).Error())
+	assert.NoError(t, get.RunE(get, nil))
+
+	// denying "cv set" denies the other commands writing CVs
+	assert.ErrorIs(t, session.RunE(session, nil), ErrDenied)
+	assert.NoError(t, compose.RunE(compose, nil))
+	assert.NoError(t, compose.Flags().Set("write", "true"))
+	assert.ErrorIs(t, compose.RunE(compose, nil), ErrDenied)
+
+	// without the file nothing is restricted
+	assert.NoError(t, os.Remove(path))
+	assert.NoError(t, set.RunE(set, nil))
+}
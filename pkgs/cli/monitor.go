@@ -0,0 +1,54 @@
+package cli
+
+import (
+	"time"
+
+	"github.com/keskad/loco/pkgs/app"
+	"github.com/spf13/cobra"
+)
+
+func NewMonitorCommand(app *app.LocoApp) *cobra.Command {
+	type Args struct {
+		Stations []string
+		Output   string
+		AllLocos bool
+		Health   string
+		Silence  time.Duration
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "monitor",
+		Short: "Print every packet sent by the command station",
+		Long: `Subscribes to the command station broadcasts (locomotives, turnouts, feedback, RailCom, system state) and prints every received packet until Ctrl+C.
+
+The output is decoded into a human-readable form by default. Use --output hex for the raw bytes,
+or --output json for one JSON object per packet, e.g. to process it with jq.
+By default Z21 reports only locomotives this client asked for, --all-locos includes the ones driven by other throttles (e.g. the smartphone app).
+
+When the monitor runs as a service, --health-listen serves probes for systemd, containers and monitoring:
+  /healthz  the process is alive
+  /readyz   every station is connected, its broadcast subscription is renewed and it sent a packet within --max-silence
+            (503 with the reason otherwise)
+
+Multiple stations can be watched at once by passing --station several times, each line is then prefixed with the station name.
+Station names are profiles from the "stations" section of ~/.loco.yaml, "default" is the "server" section.`,
+		Example: "  loco monitor --station home --station bench\n  loco monitor --all-locos --output json | jq .description",
+		Args:    cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+			return app.MonitorAction(cmdArgs.Stations, cmdArgs.Output, cmdArgs.AllLocos, cmdArgs.Health, cmdArgs.Silence)
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().StringArrayVarP(&cmdArgs.Stations, "station", "s", nil, "Station profile to monitor, can be repeated")
+	command.Flags().StringVarP(&cmdArgs.Output, "output", "o", "text", "Output format: 'text', 'hex' or 'json'")
+	command.Flags().StringVarP(&cmdArgs.Health, "health-listen", "", "", "Serve /healthz and /readyz on this address, e.g. ':8021'")
+	command.Flags().DurationVarP(&cmdArgs.Silence, "max-silence", "", 0, "Report a station as not ready when it sends nothing for this long, 0 means 2m")
+	command.Flags().BoolVarP(&cmdArgs.AllLocos, "all-locos", "", false, "Receive LAN_X_LOCO_INFO of all locomotives, generates a lot of traffic")
+
+	return command
+}
@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strings"
+
+	"github.com/keskad/loco/pkgs/config"
+	"github.com/spf13/cobra"
+)
+
+// ErrDenied is returned for commands the policy of the machine does not allow
+var ErrDenied = errors.New("not allowed on this machine")
+
+// Annotations of the commands read by Permissions
+const (
+	// annotationCapability is the capability the command needs, e.g. config.CapabilityCVWrite
+	annotationCapability = "capability"
+	// annotationCapabilityFlag is the flag the capability is needed with, e.g. "write" of "cv29 compose"
+	annotationCapabilityFlag = "capability-flag"
+)
+
+// writesCVs annotates the commands writing CVs, a rule denying "cv set" denies them as well
+func writesCVs(flag string) map[string]string {
+	annotations := map[string]string{annotationCapability: config.CapabilityCVWrite}
+	if flag != "" {
+		annotations[annotationCapabilityFlag] = flag
+	}
+	return annotations
+}
+
+// Permissions refuses the commands denied to the current system user by the policy file, see config.Policy.
+// The file is read on every command, so a changed policy applies without restarting anything.
+func Permissions(policyPath string) Middleware {
+	return func(next RunE) RunE {
+		return func(command *cobra.Command, args []string) error {
+			policy, err := config.LoadPolicy(policyPath)
+			if err != nil {
+				return err
+			}
+			if policy == nil {
+				return next(command, args)
+			}
+			name := currentUser()
+			path := strings.TrimSpace(strings.TrimPrefix(command.CommandPath(), command.Root().Name()))
+			if !policy.Allows(name, path, capabilities(command)...) {
+				return fmt.Errorf("'loco %s' is %w for the '%s' profile", path, ErrDenied, policy.ProfileOf(name))
+			}
+			return next(command, args)
+		}
+	}
+}
+
+func currentUser() string {
+	current, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return current.Username
+}
+
+// capabilities are the capabilities the command needs with its current flags
+func capabilities(command *cobra.Command) []string {
+	capability, ok := command.Annotations[annotationCapability]
+	if !ok {
+		return nil
+	}
+	if flag, ok := command.Annotations[annotationCapabilityFlag]; ok && !command.Flags().Changed(flag) {
+		return nil
+	}
+	return []string{capability}
+}
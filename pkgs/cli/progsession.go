@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"time"
+
+	"github.com/keskad/loco/pkgs/app"
+	"github.com/spf13/cobra"
+)
+
+func NewProgSessionCommand(app *app.LocoApp) *cobra.Command {
+	type Args struct {
+		Max     time.Duration
+		Idle    time.Duration
+		Timeout uint16
+		Retries uint8
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "prog-session",
+		Short: "Program decoders on the programming track interactively, for a limited time",
+		Long: `Opens a session for reading and writing CVs on the programming track, commands are typed at the "prog>" prompt.
+
+The command station switches the main track off while it is in the programming mode. The session ends after --max,
+after --idle without a command, on Ctrl+C or on "exit", and the track power is always restored then,
+so the layout is not left dark when somebody forgets to leave the programming mode.`,
+		Example:     "  loco prog-session\n  loco prog-session --max 15m --idle 2m",
+		Annotations: writesCVs(""),
+		Args:        cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+			return app.ProgSessionAction(cmdArgs.Max, cmdArgs.Idle, time.Second*time.Duration(cmdArgs.Timeout), flagOrDefault(command, "retry", cmdArgs.Retries, app.Config.Server.Retries))
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().DurationVarP(&cmdArgs.Max, "max", "", 5*time.Minute, "End the session after this time")
+	command.Flags().DurationVarP(&cmdArgs.Idle, "idle", "", time.Minute, "End the session when no command was typed for this time")
+	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
+	command.Flags().Uint8VarP(&cmdArgs.Retries, "retry", "", 0, "Retry request multiple times if required (default: server.retries from the configuration file)")
+
+	return command
+}
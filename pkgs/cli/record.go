@@ -0,0 +1,72 @@
+package cli
+
+import (
+	"github.com/keskad/loco/pkgs/app"
+	"github.com/spf13/cobra"
+)
+
+func NewRecordCommand(app *app.LocoApp) *cobra.Command {
+	type Args struct {
+		LocoId uint8
+		Out    string
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "record",
+		Short: "Record a driving session of a locomotive",
+		Long: `Records speed and function changes of a locomotive until Ctrl+C, then saves them with their timing to a JSON file.
+
+The locomotive can be driven by any throttle (the smartphone app, a handheld controller, another loco command),
+the changes are observed from the Z21 broadcasts. Use "loco replay" to reproduce the session.`,
+		Example: "  loco record --loco 3 --out run.json",
+		Args:    cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+			return app.RecordAction(cmdArgs.LocoId, cmdArgs.Out)
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Locomotive address (required)")
+	command.Flags().StringVarP(&cmdArgs.Out, "out", "o", "run.json", "File to save the recording to")
+
+	command.MarkFlagRequired("loco")
+
+	return command
+}
+
+func NewReplayCommand(app *app.LocoApp) *cobra.Command {
+	type Args struct {
+		LocoId uint8
+		Loop   bool
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "replay <file>",
+		Short: "Replay a driving session recorded with 'loco record', or decode a session log",
+		Long: `Sends the speed and function commands of a recording with the original timing.
+
+With --loop the recording is repeated until Ctrl+C, e.g. for exhibitions. When interrupted the locomotive is stopped.
+
+A session log recorded with --session-log is decoded and printed offline instead, nothing is sent to the command station.
+Attach such a log to a bug report, together with the output of --debug.`,
+		Example: "  loco replay run.json\n  loco replay run.json --loco 5 --loop\n  loco cv get cv8 --session-log session.jsonl && loco replay session.jsonl",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+			return app.ReplayAction(args[0], cmdArgs.LocoId, cmdArgs.Loop)
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Replay on another locomotive, by default the recorded one is used")
+	command.Flags().BoolVarP(&cmdArgs.Loop, "loop", "", false, "Repeat the recording until interrupted")
+
+	return command
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 
 	"github.com/keskad/loco/pkgs/app"
+	"github.com/keskad/loco/pkgs/config"
 	"github.com/spf13/cobra"
 )
 
@@ -16,12 +17,27 @@ func NewRootCommand(app *app.LocoApp) *cobra.Command {
 		},
 	}
 
+	command.PersistentFlags().StringVarP(&app.SessionLog, "session-log", "", "", "Record all the traffic with the Z21 to a file, decode it later with 'loco replay <file>'")
+
 	command.AddCommand(NewCVCommand(app))
+	command.AddCommand(NewCV29Command(app))
 	command.AddCommand(NewAddrCommand(app))
 	command.AddCommand(NewFnCommand(app))
 	command.AddCommand(NewSpeedCommand(app))
 	command.AddCommand(NewDecoderCommand(app))
 	command.AddCommand(NewAppCommand(app))
+	command.AddCommand(NewMonitorCommand(app))
+	command.AddCommand(NewFeedbackCommand(app))
+	command.AddCommand(NewSimCommand(app))
+	command.AddCommand(NewRecordCommand(app))
+	command.AddCommand(NewReplayCommand(app))
+	command.AddCommand(NewCloneCommand(app))
+	command.AddCommand(NewProgSessionCommand(app))
+	command.AddCommand(NewStatusCommand(app))
+	command.AddCommand(NewStationCommand(app))
+	command.AddCommand(NewInfoCommand(app))
+
+	Use(command, Timing(), ExitCodes(), Hints(), Permissions(config.DefaultPolicyPath))
 
 	return command
 }
@@ -0,0 +1,126 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/keskad/loco/pkgs/app"
+	"github.com/keskad/loco/pkgs/sim"
+	"github.com/spf13/cobra"
+)
+
+func NewSimCommand(app *app.LocoApp) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "sim",
+		Short: "Run simulated hardware, for trying the tool without a layout",
+		RunE: func(command *cobra.Command, args []string) error {
+			return errors.New("please select a command")
+		},
+	}
+
+	command.AddCommand(NewSimZ21Command(app))
+	command.AddCommand(NewSimRBCommand(app))
+	return command
+}
+
+func NewSimZ21Command(app *app.LocoApp) *cobra.Command {
+	type Args struct {
+		Listen    string
+		Locos     []uint
+		ProgLoco  uint16
+		NackRate  float64
+		NoRailCom bool
+		Seed      int64
+		Locked    bool
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "z21",
+		Short: "Run a fake Z21 command station",
+		Long: `Runs a fake Z21 answering the LAN protocol over UDP, with virtual locomotives.
+Point server.address of another loco configuration (or the Z21 app) to it.
+
+The same --seed reproduces the same sequence of NACKs, which helps reproducing bug reports.`,
+		Example: "  loco sim z21 --loco 3 --loco 1000 --prog-loco 3 --nack-rate 0.1 --no-railcom",
+		Args:    cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			locos := make([]uint16, 0, len(cmdArgs.Locos))
+			for _, addr := range cmdArgs.Locos {
+				if addr < 1 || addr > 10239 {
+					return fmt.Errorf("invalid locomotive address %d", addr)
+				}
+				locos = append(locos, uint16(addr))
+			}
+			if cmdArgs.NackRate < 0 || cmdArgs.NackRate > 1 {
+				return fmt.Errorf("invalid --nack-rate %v, must be between 0 and 1", cmdArgs.NackRate)
+			}
+			return app.SimZ21Action(cmdArgs.Listen, sim.Z21Options{
+				Locos:         locos,
+				ProgTrackLoco: cmdArgs.ProgLoco,
+				NackRate:      cmdArgs.NackRate,
+				RailCom:       !cmdArgs.NoRailCom,
+				Seed:          cmdArgs.Seed,
+				LockedStart:   cmdArgs.Locked,
+			})
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().StringVarP(&cmdArgs.Listen, "listen", "", "0.0.0.0:21105", "UDP address to listen on")
+	command.Flags().UintSliceVarP(&cmdArgs.Locos, "loco", "l", []uint{3}, "Address of a virtual locomotive, can be repeated")
+	command.Flags().Uint16VarP(&cmdArgs.ProgLoco, "prog-loco", "", 3, "Locomotive standing on the programming track, 0 for an empty track")
+	command.Flags().Float64VarP(&cmdArgs.NackRate, "nack-rate", "", 0, "Probability (0-1) that a programming track operation is not acknowledged")
+	command.Flags().BoolVarP(&cmdArgs.NoRailCom, "no-railcom", "", false, "Do not answer POM reads, like a layout without RailCom")
+	command.Flags().Int64VarP(&cmdArgs.Seed, "seed", "", 1, "Seed of the NACK generator")
+	command.Flags().BoolVarP(&cmdArgs.Locked, "locked-z21start", "", false, "Behave like a z21start without the activation code, ignoring CV commands")
+
+	return command
+}
+
+func NewSimRBCommand(app *app.LocoApp) *cobra.Command {
+	type Args struct {
+		Listen     string
+		Dir        string
+		CapacityKB int64
+		Firmware   string
+		Latency    time.Duration
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "rb",
+		Short: "Run a fake Railbox RB23xx decoder",
+		Long: `Runs a fake RB23xx answering the web interface of its WiFi: listing, uploading, downloading
+and deleting the sound files, reading and writing the CVs. Point --decoder-address (or loco.decoder_address) to it
+to try the sound sync, watch and backup commands without a decoder on the bench.
+
+With --dir the files are kept in a directory, one subdirectory per slot, and survive a restart.`,
+		Example: "  loco sim rb --listen 127.0.0.1:8080 --dir ./decoder --capacity 3904\n" +
+			"  loco decoder rb sound sync ./sounds --slot 1 --decoder-address 127.0.0.1:8080",
+		Args: cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if cmdArgs.CapacityKB < 0 {
+				return fmt.Errorf("invalid --capacity %d", cmdArgs.CapacityKB)
+			}
+			return app.SimRBAction(cmdArgs.Listen, sim.RB23xxOptions{
+				Dir:        cmdArgs.Dir,
+				CapacityKB: cmdArgs.CapacityKB,
+				Model:      "RB2300",
+				Firmware:   cmdArgs.Firmware,
+				Latency:    cmdArgs.Latency,
+				CVs:        map[uint16]int{1: 3, 7: 10, 8: 97, 29: 6},
+			})
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().StringVarP(&cmdArgs.Listen, "listen", "", "127.0.0.1:8080", "TCP address to listen on")
+	command.Flags().StringVarP(&cmdArgs.Dir, "dir", "", "", "Directory keeping the files, in memory when empty")
+	command.Flags().Int64VarP(&cmdArgs.CapacityKB, "capacity", "", 3904, "Storage space of the decoder in KB, 0 for unlimited")
+	command.Flags().StringVarP(&cmdArgs.Firmware, "firmware", "", "1.0.0-sim", "Firmware version reported by the status page")
+	command.Flags().DurationVarP(&cmdArgs.Latency, "latency", "", 0, "Delay of every answer, e.g. 200ms for a weak WiFi")
+
+	return command
+}
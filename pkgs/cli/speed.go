@@ -3,6 +3,7 @@ package cli
 import (
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/keskad/loco/pkgs/app"
 	"github.com/spf13/cobra"
@@ -19,6 +20,7 @@ func NewSpeedCommand(app *app.LocoApp) *cobra.Command {
 
 	command.AddCommand(NewSpeedSetCommand(app))
 	command.AddCommand(NewSpeedGetCommand(app))
+	command.AddCommand(NewSpeedRampCommand(app))
 
 	return command
 }
@@ -29,6 +31,8 @@ func NewSpeedSetCommand(app *app.LocoApp) *cobra.Command {
 		Forward    bool
 		SpeedSteps uint8
 		Timeout    uint16
+		Retries    uint8
+		Repeat     uint8
 	}
 
 	cmdArgs := Args{SpeedSteps: 128} // Default to 128 speed steps
@@ -42,6 +46,8 @@ SPEED should be a value from 0 to the maximum for your speed steps:
   - For 28 speed steps: 0-28 (0=stop, 1=emergency stop, 2-28=steps 1-27)
   - For 128 speed steps: 0-127 (0=stop, 1=emergency stop, 2-127=steps 1-126)
 
+A locomotive driven by another device (e.g. the Z21 app) is not taken over, unless --steal is used.
+
 Examples:
   loco speed set 50 --loco 3 --forward
   loco speed set 0 --loco 3                    # Stop locomotive
@@ -53,39 +59,118 @@ Examples:
 				return err
 			}
 
-			// Parse speed value
-			speed64, err := strconv.ParseUint(args[0], 10, 8)
+			speed, err := parseSpeed(args[0], cmdArgs.SpeedSteps)
 			if err != nil {
-				return fmt.Errorf("invalid speed value %q: %w", args[0], err)
+				return err
 			}
-			speed := uint8(speed64)
-
-			// Validate speed based on speed steps
-			var maxSpeed uint8
-			switch cmdArgs.SpeedSteps {
-			case 14:
-				maxSpeed = 15
-			case 28:
-				maxSpeed = 28
-			case 128:
-				maxSpeed = 127
-			default:
-				return fmt.Errorf("invalid speed steps %d (must be 14, 28, or 128)", cmdArgs.SpeedSteps)
+
+			return app.SetSpeedAction(cmdArgs.LocoId, speed, cmdArgs.Forward, cmdArgs.SpeedSteps, flagOrDefault(command, "repeat", cmdArgs.Repeat, app.Config.Server.Repeat),
+				time.Second*time.Duration(cmdArgs.Timeout), flagOrDefault(command, "retry", cmdArgs.Retries, app.Config.Server.Retries))
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
+	command.Flags().Uint8VarP(&cmdArgs.Retries, "retry", "", 0, "Retry request multiple times if required (default: server.retries from the configuration file)")
+	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Locomotive address (required)")
+	command.Flags().BoolVarP(&app.Steal, "steal", "", false, "Take the locomotive over when another device (e.g. the Z21 app) drives it")
+	command.Flags().BoolVarP(&cmdArgs.Forward, "forward", "f", false, "Set direction to forward (default is reverse)")
+	command.Flags().Uint8VarP(&cmdArgs.SpeedSteps, "steps", "s", 128, "Speed steps: 14, 28, or 128 (default: 128)")
+	command.Flags().Uint8VarP(&cmdArgs.Repeat, "repeat", "", 0, "Send the command again this many times, e.g. on dirty track (default: server.repeat from the configuration file)")
+
+	command.MarkFlagRequired("loco")
+
+	return command
+}
+
+// parseSpeed parses the speed value and validates it against the speed steps
+func parseSpeed(raw string, speedSteps uint8) (uint8, error) {
+	speed64, err := strconv.ParseUint(raw, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid speed value %q: %w", raw, err)
+	}
+	speed := uint8(speed64)
+
+	// Validate speed based on speed steps
+	var maxSpeed uint8
+	switch speedSteps {
+	case 14:
+		maxSpeed = 15
+	case 28:
+		maxSpeed = 28
+	case 128:
+		maxSpeed = 127
+	default:
+		return 0, fmt.Errorf("invalid speed steps %d (must be 14, 28, or 128)", speedSteps)
+	}
+
+	if speed > maxSpeed {
+		return 0, fmt.Errorf("speed %d exceeds maximum %d for %d speed steps", speed, maxSpeed, speedSteps)
+	}
+	return speed, nil
+}
+
+func NewSpeedRampCommand(app *app.LocoApp) *cobra.Command {
+	type Args struct {
+		LocoId     uint8
+		Forward    bool
+		SpeedSteps uint8
+		Duration   time.Duration
+		Curve      string
+		From       int
+		Timeout    uint16
+		Retries    uint8
+	}
+
+	cmdArgs := Args{}
+	command := &cobra.Command{
+		Use:   "ramp SPEED",
+		Short: "Change the speed of a locomotive gradually",
+		Long: `Change the speed of a locomotive gradually, giving it momentum even when the decoder momentum (CV3/CV4) is disabled.
+
+The ramp starts at the current speed read from the command station, or at --from.
+The shape of the ramp is the acceleration curve:
+  - linear:       the speed changes at a constant rate
+  - ease-in-out:  slow start and slow end, like a real train
+  - path to a CSV file with "progress,speed" rows in percent, e.g. "50,20" reaches 20% of the change in the half of the time
+
+The default curve and the interval between speed commands are set in ~/.loco.yaml:
+  throttle:
+    curve: ease-in-out
+    step_interval: 100
+
+Examples:
+  loco speed ramp 60 --loco 3 --forward --duration 5s
+  loco speed ramp 0 --loco 3 --forward --duration 3s --curve ease-in-out
+  loco speed ramp 40 --loco 3 --forward --curve ./shunting.csv`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
 			}
 
-			if speed > maxSpeed {
-				return fmt.Errorf("speed %d exceeds maximum %d for %d speed steps", speed, maxSpeed, cmdArgs.SpeedSteps)
+			speed, err := parseSpeed(args[0], cmdArgs.SpeedSteps)
+			if err != nil {
+				return err
+			}
+			if cmdArgs.From > 127 {
+				return fmt.Errorf("invalid --from speed %d", cmdArgs.From)
 			}
 
-			return app.SetSpeedAction(cmdArgs.LocoId, speed, cmdArgs.Forward, cmdArgs.SpeedSteps)
+			return app.RampSpeedAction(cmdArgs.LocoId, speed, cmdArgs.Forward, cmdArgs.SpeedSteps, cmdArgs.Duration, cmdArgs.Curve, cmdArgs.From, time.Second*time.Duration(cmdArgs.Timeout), flagOrDefault(command, "retry", cmdArgs.Retries, app.Config.Server.Retries))
 		},
 	}
 
 	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
 	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
+	command.Flags().Uint8VarP(&cmdArgs.Retries, "retry", "", 0, "Retry request multiple times if required (default: server.retries from the configuration file)")
 	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Locomotive address (required)")
+	command.Flags().BoolVarP(&app.Steal, "steal", "", false, "Take the locomotive over when another device (e.g. the Z21 app) drives it")
 	command.Flags().BoolVarP(&cmdArgs.Forward, "forward", "f", false, "Set direction to forward (default is reverse)")
 	command.Flags().Uint8VarP(&cmdArgs.SpeedSteps, "steps", "s", 128, "Speed steps: 14, 28, or 128 (default: 128)")
+	command.Flags().DurationVarP(&cmdArgs.Duration, "duration", "d", 3*time.Second, "Time to reach the target speed")
+	command.Flags().StringVarP(&cmdArgs.Curve, "curve", "c", "", "Acceleration curve: 'linear', 'ease-in-out' or a CSV file (default from the configuration)")
+	command.Flags().IntVarP(&cmdArgs.From, "from", "", -1, "Start speed, by default the current speed is read from the command station")
 
 	command.MarkFlagRequired("loco")
 
@@ -96,6 +181,7 @@ func NewSpeedGetCommand(app *app.LocoApp) *cobra.Command {
 	type Args struct {
 		LocoId  uint8
 		Timeout uint16
+		Retries uint8
 	}
 
 	cmdArgs := Args{}
@@ -113,23 +199,13 @@ Examples:
 				return err
 			}
 
-			speed, forward, err := app.GetSpeedAction(cmdArgs.LocoId)
-			if err != nil {
-				return err
-			}
-
-			direction := "reverse"
-			if forward {
-				direction = "forward"
-			}
-
-			fmt.Printf("Locomotive %d: speed=%d direction=%s\n", cmdArgs.LocoId, speed, direction)
-			return nil
+			return app.PrintSpeedAction(cmdArgs.LocoId, time.Second*time.Duration(cmdArgs.Timeout), flagOrDefault(command, "retry", cmdArgs.Retries, app.Config.Server.Retries))
 		},
 	}
 
 	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
 	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
+	command.Flags().Uint8VarP(&cmdArgs.Retries, "retry", "", 0, "Retry request multiple times if required (default: server.retries from the configuration file)")
 	command.Flags().Uint8VarP(&cmdArgs.LocoId, "loco", "l", 0, "Locomotive address (required)")
 
 	command.MarkFlagRequired("loco")
@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"time"
+
+	"github.com/keskad/loco/pkgs/app"
+	"github.com/spf13/cobra"
+)
+
+func NewStationCommand(app *app.LocoApp) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "station",
+		Short: "Inspect the command station hardware",
+	}
+
+	command.AddCommand(NewStationUnlockStatusCommand(app))
+	return command
+}
+
+func NewStationUnlockStatusCommand(app *app.LocoApp) *cobra.Command {
+	type Args struct {
+		Timeout uint16
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "unlock-status",
+		Short: "Show whether the command station is unlocked for programming over LAN",
+		Long: `Shows the hardware and firmware of the command station and the features it has unlocked.
+A z21start is sold locked: it ignores CV commands over LAN until the activation code is entered.`,
+		Args: cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+			return app.UnlockStatusAction(time.Second * time.Duration(cmdArgs.Timeout))
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
+
+	return command
+}
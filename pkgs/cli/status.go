@@ -0,0 +1,34 @@
+package cli
+
+import (
+	"time"
+
+	"github.com/keskad/loco/pkgs/app"
+	"github.com/spf13/cobra"
+)
+
+func NewStatusCommand(app *app.LocoApp) *cobra.Command {
+	type Args struct {
+		Timeout uint16
+	}
+	cmdArgs := Args{}
+
+	command := &cobra.Command{
+		Use:   "status",
+		Short: "Show the state of the command station",
+		Long: `Shows whether the command station works normally or is in an emergency stop, without track voltage,
+in a short circuit or in the programming mode, together with its currents, temperature and voltages.`,
+		Args: cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.Initialize(); err != nil {
+				return err
+			}
+			return app.StatusAction(time.Second * time.Duration(cmdArgs.Timeout))
+		},
+	}
+
+	command.Flags().BoolVarP(&app.Debug, "debug", "v", false, "Increase verbosity to the debug level")
+	command.Flags().Uint16VarP(&cmdArgs.Timeout, "timeout", "", 10, "Connection timeout")
+
+	return command
+}
@@ -0,0 +1,477 @@
+package commandstation
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/dccexproto"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: EX-CommandStation, the Arduino based command station of DCC-EX. It speaks a text protocol
+// over the USB serial port, reads CVs only on the programming track (there is no RailCom)
+// and boots with the track power off.
+//
+
+// DCCEXFunctionMax is the highest function number of DCC-EX
+const DCCEXFunctionMax = 68
+
+// errDCCEXDisconnected is returned to the waiting requests when the connection is lost
+var errDCCEXDisconnected = errors.New("the connection to DCC-EX was lost")
+
+// DCCEXSerialConfig is the configuration of the "dccex-serial" station type
+type DCCEXSerialConfig struct {
+	// Address is the serial port, e.g. "/dev/ttyACM0"
+	Address string
+	// Baud is the speed of the serial port, 0 is the default 115200
+	Baud int
+}
+
+func init() {
+	register("dccex-serial", func(config *DCCEXSerialConfig, env Environment) (*DCCEX, error) {
+		if err := refuseDryRun("dccex-serial", env); err != nil {
+			return nil, err
+		}
+		return NewDCCEXSerial(config.Address, config.Baud, env.Defaults...)
+	})
+}
+
+// NewDCCEXSerial opens the serial port of an EX-CommandStation, e.g. "/dev/ttyACM0".
+// Opening the port resets the Arduino, so the station is asked for its status until it has booted.
+func NewDCCEXSerial(device string, baud int, defaults ...ctxOptions) (*DCCEX, error) {
+	if baud == 0 {
+		baud = dccexproto.DefaultBaudRate
+	}
+	port, err := openSerial(device, baud)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the DCC-EX serial port %q: %w", device, err)
+	}
+	d := newDCCEX(port, defaults)
+	if err := d.handshake(); err != nil {
+		_ = d.CleanUp()
+		return nil, err
+	}
+	return d, nil
+}
+
+func newDCCEX(conn io.ReadWriteCloser, defaults []ctxOptions) *DCCEX {
+	d := &DCCEX{
+		Timeout:  time.Second * 10,
+		defaults: defaults,
+		replies:  make(chan dccexproto.Reply, 64),
+	}
+	d.attach(conn)
+	return d
+}
+
+// attach starts reading the replies from a new connection
+func (d *DCCEX) attach(conn io.ReadWriteCloser) {
+	d.conn = conn
+	d.closed = make(chan struct{})
+	go d.readReplies(conn, d.closed)
+}
+
+// DCCEX implements Station for EX-CommandStation
+type DCCEX struct {
+	conn     io.ReadWriteCloser
+	Timeout  time.Duration
+	defaults []ctxOptions
+	// dial opens the connection again when it is lost, nil does not reconnect
+	dial func() (io.ReadWriteCloser, error)
+	// Version is reported by the station, e.g. "DCC-EX V-5.0.4 / MEGA / STANDARD_MOTOR_SHIELD G-c389fe9"
+	Version string
+
+	// replies are the messages read from conn, broadcasts included
+	replies chan dccexproto.Reply
+	// closed is closed when conn cannot be read anymore
+	closed chan struct{}
+	// mu serializes the requests, so every one of them sees only the replies to itself
+	mu sync.Mutex
+
+	powerMu sync.Mutex
+	// mainPowered is the last reported power of the main track
+	mainPowered bool
+}
+
+// readReplies parses the messages from conn until it is closed, the track power is tracked on the way
+func (d *DCCEX) readReplies(conn io.Reader, closed chan struct{}) {
+	defer close(closed)
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(dccexproto.SplitMessages)
+	for scanner.Scan() {
+		reply, err := dccexproto.Parse(scanner.Text())
+		if err != nil {
+			logrus.Debugf("dccex: %s", err)
+			continue
+		}
+		logrus.Debugf("dccex: res %s", reply)
+		if power, ok := reply.Power(); ok && power.Track != dccexproto.TrackProg {
+			d.powerMu.Lock()
+			d.mainPowered = power.On
+			d.powerMu.Unlock()
+		}
+		select {
+		case d.replies <- reply:
+		default:
+			logrus.Debugf("dccex: nobody waits, dropping %s", reply)
+		}
+	}
+}
+
+// newRequestContext builds the context from built-in defaults, station defaults and request options, in this order
+func (d *DCCEX) newRequestContext(options []ctxOptions) RequestContext {
+	ctx := RequestContext{
+		timeout:        d.Timeout,
+		retries:        2,
+		retryDelay:     200 * time.Millisecond,
+		settle:         200 * time.Millisecond,
+		format:         DCCFormat,
+		repeatInterval: 50 * time.Millisecond,
+	}
+	applyMethodsToCtx(&ctx, d.defaults)
+	applyMethodsToCtx(&ctx, options)
+	return ctx
+}
+
+// handshake waits until the station answers the status request, the Arduino ignores everything while it boots
+func (d *DCCEX) handshake() error {
+	deadline := time.Now().Add(d.Timeout)
+	for time.Now().Before(deadline) {
+		reply, err := d.requestReconnecting(dccexproto.Status{}, time.Second, func(reply dccexproto.Reply) bool {
+			_, ok := reply.Version()
+			return ok
+		}, false)
+		if err == nil {
+			d.Version, _ = reply.Version()
+			logrus.Debugf("dccex: connected to %s", d.Version)
+			return nil
+		}
+		if !errors.Is(err, errResponseTimeout) {
+			return err
+		}
+	}
+	return fmt.Errorf("DCC-EX did not answer within %s: %w", d.Timeout, errResponseTimeout)
+}
+
+func (d *DCCEX) write(cmd dccexproto.Command) error {
+	logrus.Debugf("dccex: req %s", cmd.Encode())
+	if _, err := io.WriteString(d.conn, cmd.Encode()); err != nil {
+		return fmt.Errorf("%w: cannot send %s: %w", errDCCEXDisconnected, cmd.Encode(), err)
+	}
+	return nil
+}
+
+// send writes a command that is not answered
+func (d *DCCEX) send(cmd dccexproto.Command) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.write(cmd)
+	if errors.Is(err, errDCCEXDisconnected) && d.dial != nil {
+		if err := d.reconnect(); err != nil {
+			return err
+		}
+		return d.write(cmd)
+	}
+	return err
+}
+
+// sendRepeated sends a driving command and then repeats it as requested, see Repeat
+func (d *DCCEX) sendRepeated(cmd dccexproto.Command, ctx RequestContext) error {
+	if err := d.send(cmd); err != nil {
+		return err
+	}
+	for i := 0; i < int(ctx.repeat); i++ {
+		time.Sleep(ctx.repeatInterval)
+		if err := d.send(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// request sends the command and waits for the first reply accepted by match, other messages are skipped.
+// A lost connection is established again and the command is sent once more. A connection that stays silent
+// is replaced too, as a WiFi drop is often noticed only by the missing answer, but the timeout is returned to be retried.
+func (d *DCCEX) request(cmd dccexproto.Command, timeout time.Duration, match func(dccexproto.Reply) bool) (dccexproto.Reply, error) {
+	return d.requestReconnecting(cmd, timeout, match, true)
+}
+
+// requestReconnecting is request, a silent connection is replaced only when replaceSilent is set.
+// The handshake does not replace it, as a booting station is silent too.
+func (d *DCCEX) requestReconnecting(cmd dccexproto.Command, timeout time.Duration, match func(dccexproto.Reply) bool, replaceSilent bool) (dccexproto.Reply, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	reply, err := d.exchange(cmd, timeout, match)
+	if d.dial == nil || !(errors.Is(err, errDCCEXDisconnected) || (replaceSilent && errors.Is(err, errResponseTimeout))) {
+		return reply, err
+	}
+	if reconnectErr := d.reconnect(); reconnectErr != nil || errors.Is(err, errResponseTimeout) {
+		return reply, err
+	}
+	return d.exchange(cmd, timeout, match)
+}
+
+// exchange is a single attempt of request
+func (d *DCCEX) exchange(cmd dccexproto.Command, timeout time.Duration, match func(dccexproto.Reply) bool) (dccexproto.Reply, error) {
+	// late replies to previous requests and broadcasts nobody asked for
+	for drained := false; !drained; {
+		select {
+		case <-d.replies:
+		default:
+			drained = true
+		}
+	}
+	if err := d.write(cmd); err != nil {
+		return dccexproto.Reply{}, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case reply := <-d.replies:
+			if reply.Failed() {
+				return dccexproto.Reply{}, fmt.Errorf("DCC-EX did not accept %s", cmd.Encode())
+			}
+			if match(reply) {
+				return reply, nil
+			}
+		case <-d.closed:
+			return dccexproto.Reply{}, errDCCEXDisconnected
+		case <-timer.C:
+			return dccexproto.Reply{}, errResponseTimeout
+		}
+	}
+}
+
+// ensureMainPower switches the main track on when the station reports it off, EX-CommandStation boots without power
+func (d *DCCEX) ensureMainPower(ctx RequestContext) error {
+	d.powerMu.Lock()
+	powered := d.mainPowered
+	d.powerMu.Unlock()
+	if powered {
+		return nil
+	}
+	logrus.Info("dccex: switching the main track power on")
+	if _, err := d.request(dccexproto.PowerOn{Track: dccexproto.TrackMain}, ctx.timeout, func(reply dccexproto.Reply) bool {
+		power, ok := reply.Power()
+		return ok && power.On
+	}); err != nil {
+		return fmt.Errorf("cannot switch the main track power on: %w", err)
+	}
+	return nil
+}
+
+// readCVResult sends a programming track command and waits for the result for the given CV
+func (d *DCCEX) readCVResult(cmd dccexproto.Command, cv uint16, ctx RequestContext) (int, error) {
+	var lastErr error
+	for i := 0; i <= int(ctx.retries); i++ {
+		logrus.Debugf("Try [%d/%d]", i, ctx.retries)
+		reply, err := d.request(cmd, ctx.timeout, func(reply dccexproto.Reply) bool {
+			result, ok := reply.CVResult()
+			return ok && result.CV == cv
+		})
+		if err == nil {
+			result, _ := reply.CVResult()
+			if result.Value >= 0 {
+				return result.Value, nil
+			}
+			err = fmt.Errorf("the decoder did not acknowledge cv%d, is the locomotive on the programming track?", cv)
+		}
+		if errors.Is(err, errDCCEXDisconnected) {
+			return 0, err
+		}
+		lastErr = err
+		time.Sleep(ctx.retryDelay)
+	}
+	return 0, lastErr
+}
+
+func (d *DCCEX) WriteCV(mode Mode, lcv LocoCV, options ...ctxOptions) error {
+	ctx := d.newRequestContext(options)
+	if ctx.format == MMFormat {
+		return NotSupported(CapabilityMMFormat, "DCC-EX programs only DCC decoders")
+	}
+	if lcv.Cv.Value < 0 || lcv.Cv.Value > 255 {
+		return fmt.Errorf("cannot write CV: value %d out of range (0-255)", lcv.Cv.Value)
+	}
+	cv, value := uint16(lcv.Cv.Num), byte(lcv.Cv.Value)
+	logrus.Debugf("Writing CV: loco=%d, CV%d=%d", lcv.LocoId, lcv.Cv.Num, lcv.Cv.Value)
+
+	switch mode {
+	case MainTrackMode:
+		if ctx.verify {
+			return NotSupported(CapabilityReadBack, "DCC-EX reads CVs only on the programming track, a main track write cannot be verified")
+		}
+		if err := d.ensureMainPower(ctx); err != nil {
+			return fmt.Errorf("cannot write CV: %w", err)
+		}
+		if err := d.send(dccexproto.WritePom{Cab: uint16(lcv.LocoId), CV: cv, Value: value}); err != nil {
+			return fmt.Errorf("cannot write CV: %w", err)
+		}
+		return nil
+	case ProgrammingTrackMode:
+		// the station reads the value back after the write, -1 means the decoder did not acknowledge it
+		ctx.retries = 0
+		if _, err := d.readCVResult(dccexproto.WriteCV{CV: cv, Value: value}, cv, ctx); err != nil {
+			return fmt.Errorf("cannot write CV: %w", err)
+		}
+		if ctx.verify {
+			logrus.Debug("Verifying written CV")
+			time.Sleep(ctx.settle)
+			read, err := d.readCVResult(dccexproto.ReadCV{CV: cv}, cv, d.newRequestContext(options))
+			if err != nil {
+				return fmt.Errorf("cannot verify CV was written: %w", err)
+			}
+			if read != int(value) {
+				return fmt.Errorf("cannot write CV, the value differs after a write")
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot write CV: unsupported mode %s", mode)
+}
+
+func (d *DCCEX) ReadCV(mode Mode, lcv LocoCV, options ...ctxOptions) (int, error) {
+	ctx := d.newRequestContext(options)
+	if ctx.format == MMFormat {
+		return 0, NotSupported(CapabilityMMRead, "MM decoders cannot be read")
+	}
+	if mode != ProgrammingTrackMode {
+		return 0, NotSupported(CapabilityReadBack, "DCC-EX reads CVs only on the programming track")
+	}
+	value, err := d.readCVResult(dccexproto.ReadCV{CV: uint16(lcv.Cv.Num)}, uint16(lcv.Cv.Num), ctx)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read CV: %w", err)
+	}
+	return value, nil
+}
+
+// locoState asks the station for the speed and functions of the locomotive
+func (d *DCCEX) locoState(addr LocoAddr, ctx RequestContext) (dccexproto.LocoState, error) {
+	var lastErr error
+	for i := 0; i <= int(ctx.retries); i++ {
+		reply, err := d.request(dccexproto.RequestLocoState{Cab: uint16(addr)}, ctx.timeout, func(reply dccexproto.Reply) bool {
+			state, ok := reply.LocoState()
+			return ok && state.Cab == uint16(addr)
+		})
+		if err == nil {
+			state, _ := reply.LocoState()
+			return state, nil
+		}
+		if errors.Is(err, errDCCEXDisconnected) {
+			return dccexproto.LocoState{}, err
+		}
+		lastErr = err
+		time.Sleep(ctx.retryDelay)
+	}
+	return dccexproto.LocoState{}, fmt.Errorf("cannot read the state of locomotive %d: %w", addr, lastErr)
+}
+
+func (d *DCCEX) SendFn(mode Mode, addr LocoAddr, num FuncNum, action FnAction, options ...ctxOptions) error {
+	if mode != MainTrackMode {
+		return NotSupported(CapabilityFnOnProg, fmt.Sprintf("SendFn: unsupported mode %s", mode))
+	}
+	if num < 0 || num > DCCEXFunctionMax {
+		return fmt.Errorf("SendFn: unsupported function number %d (must be 0-%d)", num, DCCEXFunctionMax)
+	}
+	ctx := d.newRequestContext(options)
+	if err := d.ensureMainPower(ctx); err != nil {
+		return fmt.Errorf("SendFn: %w", err)
+	}
+
+	on := action == FnOn
+	if action == FnToggle {
+		// DCC-EX has no toggle command
+		state, err := d.locoState(addr, ctx)
+		if err != nil {
+			return fmt.Errorf("SendFn: %w", err)
+		}
+		on = !state.Function(int(num))
+		ctx.repeat = 0
+	}
+	if err := d.sendRepeated(dccexproto.SetFunction{Cab: uint16(addr), Function: uint8(num), On: on}, ctx); err != nil {
+		return fmt.Errorf("SendFn: cannot write function command: %w", err)
+	}
+	return nil
+}
+
+func (d *DCCEX) SendBinaryState(addr LocoAddr, state uint16, on bool, options ...ctxOptions) error {
+	return NotSupported(CapabilityBinaryState, "DCC-EX has no binary state command")
+}
+
+func (d *DCCEX) ListFunctions(addr LocoAddr, options ...ctxOptions) ([]int, error) {
+	state, err := d.locoState(addr, d.newRequestContext(options))
+	if err != nil {
+		return nil, err
+	}
+	var active []int
+	for fn := 0; fn < 64; fn++ {
+		if state.Function(fn) {
+			active = append(active, fn)
+		}
+	}
+	return active, nil
+}
+
+// SetSpeed sets the speed and direction of a locomotive, the speed has the meaning of Z21Roco.SetSpeed.
+// DCC-EX always drives in 128 steps, slower speed steps are scaled.
+func (d *DCCEX) SetSpeed(addr LocoAddr, speed uint8, forward bool, speedSteps uint8, options ...ctxOptions) error {
+	var steps int
+	switch speedSteps {
+	case 14:
+		steps = scaleSpeed(speed, 1, 14)
+	case 28:
+		steps = scaleSpeed(speed, 0, 28)
+	case 128:
+		steps = scaleSpeed(speed, 1, 126)
+	default:
+		return fmt.Errorf("invalid speed steps: %d (must be 14, 28, or 128)", speedSteps)
+	}
+	ctx := d.newRequestContext(options)
+	if err := d.ensureMainPower(ctx); err != nil {
+		return fmt.Errorf("SetSpeed: %w", err)
+	}
+	if err := d.sendRepeated(dccexproto.Throttle{Cab: uint16(addr), Speed: steps, Forward: forward}, ctx); err != nil {
+		return fmt.Errorf("SetSpeed: cannot write speed command: %w", err)
+	}
+	return nil
+}
+
+// scaleSpeed converts a speed to the 0-126 steps of DCC-EX. With offset 1 the speed 1 is an emergency stop (-1)
+// and the steps start at 2, max is the number of steps.
+func scaleSpeed(speed uint8, offset int, max int) int {
+	switch {
+	case speed == 0:
+		return 0
+	case offset == 1 && speed == 1:
+		return -1
+	}
+	step := int(speed) - offset
+	if step > max {
+		step = max
+	}
+	return (step*126 + max/2) / max
+}
+
+// GetSpeed asks the station for the speed and direction of a locomotive.
+// Returns: speed (0-127 as in 128 steps), forward (true for forward, false for reverse), error
+func (d *DCCEX) GetSpeed(addr LocoAddr, options ...ctxOptions) (uint8, bool, error) {
+	state, err := d.locoState(addr, d.newRequestContext(options))
+	if err != nil {
+		return 0, false, err
+	}
+	return state.Speed, state.Forward, nil
+}
+
+func (d *DCCEX) CleanUp() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dial = nil
+	return d.conn.Close()
+}
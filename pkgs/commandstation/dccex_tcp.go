@@ -0,0 +1,79 @@
+package commandstation
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/dccexproto"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: the WiFi or Ethernet interface of EX-CommandStation. It carries the same text protocol as the serial port,
+// but WiFi connections drop, e.g. when the station is out of range of the access point for a moment.
+//
+
+// dccexDialTimeout is how long connecting to the station may take
+const dccexDialTimeout = 5 * time.Second
+
+// DCCEXTCPConfig is the configuration of the "dccex-tcp" station type
+type DCCEXTCPConfig struct {
+	Address string
+	Port    uint16
+}
+
+func init() {
+	register("dccex-tcp", func(config *DCCEXTCPConfig, env Environment) (*DCCEX, error) {
+		if err := refuseDryRun("dccex-tcp", env); err != nil {
+			return nil, err
+		}
+		return NewDCCEXTCP(config.Address, config.Port, env.Defaults...)
+	})
+}
+
+// NewDCCEXTCP connects to the WiFi or Ethernet interface of an EX-CommandStation, port 0 is the default 2560.
+// A connection that is lost is established again by the next request.
+func NewDCCEXTCP(address string, port uint16, defaults ...ctxOptions) (*DCCEX, error) {
+	if port == 0 {
+		port = dccexproto.DefaultTCPPort
+	}
+	netAddr := net.JoinHostPort(address, strconv.Itoa(int(port)))
+	dial := func() (io.ReadWriteCloser, error) {
+		conn, err := net.DialTimeout("tcp", netAddr, dccexDialTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("TCP dial error while connecting to DCC-EX: %w", err)
+		}
+		return conn, nil
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	d := newDCCEX(conn, defaults)
+	d.dial = dial
+	if err := d.handshake(); err != nil {
+		_ = d.CleanUp()
+		return nil, err
+	}
+	return d, nil
+}
+
+// reconnect replaces a lost or silent connection. The serial port is not opened again,
+// as that restarts the Arduino.
+func (d *DCCEX) reconnect() error {
+	if d.dial == nil {
+		return errDCCEXDisconnected
+	}
+	logrus.Warn("dccex: the connection was lost, reconnecting")
+	_ = d.conn.Close()
+	conn, err := d.dial()
+	if err != nil {
+		return fmt.Errorf("cannot reconnect to DCC-EX: %w", err)
+	}
+	d.attach(conn)
+	// the station may have restarted in the meantime, the status refreshes the track power
+	return d.write(dccexproto.Status{})
+}
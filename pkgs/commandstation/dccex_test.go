@@ -0,0 +1,244 @@
+package commandstation
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/dccexproto"
+)
+
+// fakeDCCEX answers the commands like an EX-CommandStation with a decoder on both tracks
+type fakeDCCEX struct {
+	mu       sync.Mutex
+	cvs      map[uint16]int
+	received []string
+	// booting is the number of messages ignored at start, like an Arduino that boots
+	booting int
+}
+
+func (f *fakeDCCEX) serve(conn io.ReadWriter) {
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(dccexproto.SplitMessages)
+	for scanner.Scan() {
+		f.mu.Lock()
+		f.received = append(f.received, scanner.Text())
+		reply := f.answer(scanner.Text())
+		if f.booting > 0 {
+			f.booting--
+			reply = ""
+		}
+		f.mu.Unlock()
+		if reply != "" {
+			if _, err := io.WriteString(conn, reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (f *fakeDCCEX) answer(message string) string {
+	var cv, value int
+	switch {
+	case message == "<s>":
+		return "<p0><iDCC-EX V-5.0.4 / MEGA / STANDARD_MOTOR_SHIELD G-c389fe9>"
+	case message == "<1 MAIN>":
+		return "<p1 MAIN>"
+	case strings.HasPrefix(message, "<R "):
+		_, _ = fmt.Sscanf(message, "<R %d>", &cv)
+		if v, ok := f.cvs[uint16(cv)]; ok {
+			// a broadcast before the answer
+			return fmt.Sprintf("<l 3 0 128 0><r %d %d>", cv, v)
+		}
+		return fmt.Sprintf("<r %d -1>", cv)
+	case strings.HasPrefix(message, "<W "):
+		_, _ = fmt.Sscanf(message, "<W %d %d>", &cv, &value)
+		f.cvs[uint16(cv)] = value
+		return fmt.Sprintf("<r %d %d>", cv, value)
+	case message == "<t 3>":
+		return "<l 3 0 170 5>"
+	}
+	return ""
+}
+
+// waitFor waits until the commands were received, the commands without a reply may still be on their way
+func (f *fakeDCCEX) waitFor(t *testing.T, expected ...string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		f.mu.Lock()
+		received := strings.Join(f.received, "")
+		f.mu.Unlock()
+		missing := ""
+		for _, command := range expected {
+			if !strings.Contains(received, command) {
+				missing = command
+				break
+			}
+		}
+		if missing == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s was not sent, got %s", missing, received)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func startFakeDCCEX(t *testing.T) (*fakeDCCEX, *DCCEX) {
+	t.Helper()
+	client, server := net.Pipe()
+	fake := &fakeDCCEX{cvs: map[uint16]int{1: 3, 29: 6}}
+	go fake.serve(server)
+	t.Cleanup(func() { _ = server.Close() })
+
+	d := newDCCEX(client, []ctxOptions{RetryDelay(0)})
+	d.Timeout = time.Second
+	t.Cleanup(func() { _ = d.CleanUp() })
+	if err := d.handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	return fake, d
+}
+
+func TestDCCEX_CV(t *testing.T) {
+	fake, d := startFakeDCCEX(t)
+	if !strings.HasPrefix(d.Version, "DCC-EX V-5.0.4") {
+		t.Fatalf("Version = %q", d.Version)
+	}
+
+	if err := d.WriteCV(ProgrammingTrackMode, LocoCV{Cv: CV{Num: 3, Value: 5}}, Verify(true)); err != nil {
+		t.Fatalf("WriteCV: %v", err)
+	}
+	if value, err := d.ReadCV(ProgrammingTrackMode, LocoCV{Cv: CV{Num: 3}}); err != nil || value != 5 {
+		t.Fatalf("ReadCV = %d, %v", value, err)
+	}
+	if _, err := d.ReadCV(ProgrammingTrackMode, LocoCV{Cv: CV{Num: 200}}, Retries(1)); err == nil || !strings.Contains(err.Error(), "did not acknowledge") {
+		t.Fatalf("ReadCV of a missing CV = %v", err)
+	}
+
+	var notSupported *ErrNotSupported
+	if _, err := d.ReadCV(MainTrackMode, LocoCV{LocoId: 3, Cv: CV{Num: 1}}); !errors.As(err, &notSupported) || notSupported.Capability != CapabilityReadBack {
+		t.Fatalf("ReadCV on the main track = %v", err)
+	}
+
+	// the main track is powered before the first command on it
+	if err := d.WriteCV(MainTrackMode, LocoCV{LocoId: 3, Cv: CV{Num: 3, Value: 10}}); err != nil {
+		t.Fatalf("WriteCV on the main track: %v", err)
+	}
+	fake.waitFor(t, "<1 MAIN><w 3 3 10>")
+}
+
+func TestDCCEX_Driving(t *testing.T) {
+	fake, d := startFakeDCCEX(t)
+
+	if err := d.SetSpeed(3, 41, true, 128); err != nil {
+		t.Fatalf("SetSpeed: %v", err)
+	}
+	if err := d.SetSpeed(3, 14, false, 28); err != nil {
+		t.Fatalf("SetSpeed: %v", err)
+	}
+	if err := d.SetSpeed(3, 1, true, 128); err != nil {
+		t.Fatalf("SetSpeed: %v", err)
+	}
+	// F2 is on, toggling switches it off
+	if err := d.SendFn(MainTrackMode, 3, 2, FnToggle); err != nil {
+		t.Fatalf("SendFn: %v", err)
+	}
+	if err := d.SendFn(MainTrackMode, 3, 68, FnOn); err != nil {
+		t.Fatalf("SendFn: %v", err)
+	}
+	fake.waitFor(t, "<t 3 40 1>", "<t 3 63 0>", "<t 3 -1 1>", "<F 3 2 0>", "<F 3 68 1>")
+
+	speed, forward, err := d.GetSpeed(3)
+	if err != nil || speed != 42 || !forward {
+		t.Fatalf("GetSpeed = %d %v %v", speed, forward, err)
+	}
+	functions, err := d.ListFunctions(3)
+	if err != nil || len(functions) != 2 || functions[0] != 0 || functions[1] != 2 {
+		t.Fatalf("ListFunctions = %v %v", functions, err)
+	}
+	if err := d.SendBinaryState(3, 100, true); err == nil {
+		t.Fatal("SendBinaryState succeeded")
+	}
+}
+
+func TestDCCEX_Reconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	fake := &fakeDCCEX{cvs: map[uint16]int{1: 3}}
+	connections := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connections <- conn
+			go fake.serve(conn)
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	d, err := NewDCCEXTCP("127.0.0.1", uint16(port), RetryDelay(0))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer d.CleanUp()
+
+	// the WiFi drops
+	_ = (<-connections).Close()
+	if value, err := d.ReadCV(ProgrammingTrackMode, LocoCV{Cv: CV{Num: 1}}, Retries(0)); err != nil || value != 3 {
+		t.Fatalf("ReadCV after the connection was lost = %d, %v", value, err)
+	}
+	select {
+	case <-connections:
+	default:
+		t.Fatal("the station was not connected again")
+	}
+}
+
+func TestDCCEX_HandshakeWhileBooting(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	fake := &fakeDCCEX{cvs: map[uint16]int{1: 3}, booting: 1}
+	connections := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connections <- conn
+			go fake.serve(conn)
+		}
+	}()
+
+	// the status is asked again on the same connection until the station answers
+	port := listener.Addr().(*net.TCPAddr).Port
+	d, err := NewDCCEXTCP("127.0.0.1", uint16(port), RetryDelay(0))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer d.CleanUp()
+	<-connections
+	select {
+	case <-connections:
+		t.Fatal("the booting station was connected again")
+	default:
+	}
+	fake.waitFor(t, "<s><s>")
+}
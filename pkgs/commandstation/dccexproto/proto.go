@@ -0,0 +1,285 @@
+// Package dccexproto is a codec for the native text protocol of the DCC-EX EX-CommandStation.
+//
+// Every command and every reply is a single message in angle brackets:
+//
+//	<OPCODE parameters…>
+//
+// where OPCODE is a single character and the parameters are separated by spaces,
+// e.g. "<W 1 3>" writes 3 to CV1 on the programming track and "<r 1 3>" is its reply.
+// Replies are interleaved with broadcasts, e.g. "<l …>" when a throttle drives a locomotive,
+// so a client matches them by the opcode and the parameters.
+//
+// The same messages are sent over the USB serial port and over the WiFi/Ethernet interface of the station.
+package dccexproto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// DefaultTCPPort is the port of the WiFi/Ethernet interface of EX-CommandStation
+const DefaultTCPPort = 2560
+
+// DefaultBaudRate is the speed of the USB serial port of EX-CommandStation
+const DefaultBaudRate = 115200
+
+// ErrMalformed is returned by Parse when the message is empty or not in angle brackets
+var ErrMalformed = errors.New("malformed DCC-EX message")
+
+// Command is a single message sent to the station
+type Command interface {
+	// Encode returns the message including the angle brackets
+	Encode() string
+}
+
+// Tracks named in the power commands, an empty track means all of them
+const (
+	TrackMain = "MAIN"
+	TrackProg = "PROG"
+	// TrackJoin powers the programming track with the main track signal
+	TrackJoin = "JOIN"
+)
+
+// PowerOn is "<1>", switching the track power on
+type PowerOn struct {
+	Track string
+}
+
+func (m PowerOn) Encode() string {
+	return withParams("1", m.Track)
+}
+
+// PowerOff is "<0>", switching the track power off
+type PowerOff struct {
+	Track string
+}
+
+func (m PowerOff) Encode() string {
+	return withParams("0", m.Track)
+}
+
+// Status is "<s>", answered with the track power and the version of the station ("<iDCC-EX V-…>")
+type Status struct{}
+
+func (m Status) Encode() string {
+	return "<s>"
+}
+
+// ReadCV is "<R cv>", reading a CV on the programming track, answered with CVResult
+type ReadCV struct {
+	CV uint16
+}
+
+func (m ReadCV) Encode() string {
+	return fmt.Sprintf("<R %d>", m.CV)
+}
+
+// WriteCV is "<W cv value>", writing a CV on the programming track, answered with CVResult
+type WriteCV struct {
+	CV    uint16
+	Value byte
+}
+
+func (m WriteCV) Encode() string {
+	return fmt.Sprintf("<W %d %d>", m.CV, m.Value)
+}
+
+// WritePom is "<w cab cv value>", writing a CV on the main track, there is no reply
+type WritePom struct {
+	Cab   uint16
+	CV    uint16
+	Value byte
+}
+
+func (m WritePom) Encode() string {
+	return fmt.Sprintf("<w %d %d %d>", m.Cab, m.CV, m.Value)
+}
+
+// Throttle is "<t cab speed dir>", Speed is 0-126 and -1 is an emergency stop
+type Throttle struct {
+	Cab     uint16
+	Speed   int
+	Forward bool
+}
+
+func (m Throttle) Encode() string {
+	dir := 0
+	if m.Forward {
+		dir = 1
+	}
+	return fmt.Sprintf("<t %d %d %d>", m.Cab, m.Speed, dir)
+}
+
+// RequestLocoState is "<t cab>", answered with the LocoState of the locomotive
+type RequestLocoState struct {
+	Cab uint16
+}
+
+func (m RequestLocoState) Encode() string {
+	return fmt.Sprintf("<t %d>", m.Cab)
+}
+
+// SetFunction is "<F cab function state>", the functions are F0-F68
+type SetFunction struct {
+	Cab      uint16
+	Function uint8
+	On       bool
+}
+
+func (m SetFunction) Encode() string {
+	state := 0
+	if m.On {
+		state = 1
+	}
+	return fmt.Sprintf("<F %d %d %d>", m.Cab, m.Function, state)
+}
+
+func withParams(opcode string, params ...string) string {
+	var b strings.Builder
+	b.WriteString("<" + opcode)
+	for _, param := range params {
+		if param != "" {
+			b.WriteString(" " + param)
+		}
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// Reply is a single message received from the station
+type Reply struct {
+	Opcode byte
+	Params []string
+}
+
+// Parse parses a single message, e.g. "<r 1 3>". The parameters of a single-character message
+// may follow the opcode without a space, so "<p1>" has the parameter "1".
+func Parse(message string) (Reply, error) {
+	s := strings.TrimSpace(message)
+	if !strings.HasPrefix(s, "<") || !strings.HasSuffix(s, ">") {
+		return Reply{}, fmt.Errorf("%w: %q", ErrMalformed, message)
+	}
+	s = strings.TrimSpace(s[1 : len(s)-1])
+	if s == "" {
+		return Reply{}, fmt.Errorf("%w: %q", ErrMalformed, message)
+	}
+	return Reply{Opcode: s[0], Params: strings.Fields(s[1:])}, nil
+}
+
+func (r Reply) String() string {
+	return withParams(string(r.Opcode), r.Params...)
+}
+
+// SplitMessages is a bufio.SplitFunc returning one message per token. Text outside of the angle brackets,
+// e.g. what the Arduino prints while it boots, is dropped.
+func SplitMessages(data []byte, atEOF bool) (int, []byte, error) {
+	start := bytes.IndexByte(data, '<')
+	if start < 0 {
+		return len(data), nil, nil
+	}
+	end := bytes.IndexByte(data[start:], '>')
+	if end < 0 {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return start, nil, nil
+	}
+	return start + end + 1, data[start : start+end+1], nil
+}
+
+// Failed tells whether the message is "<X>", the answer to a command the station did not accept
+func (r Reply) Failed() bool {
+	return r.Opcode == 'X'
+}
+
+// CVResult is the answer to ReadCV and WriteCV, "<r cv value>". Value is -1 when the decoder did not acknowledge.
+// The older form with a callback, "<r callbacknum|callbacksub|cv value>", is accepted too.
+type CVResult struct {
+	CV    uint16
+	Value int
+}
+
+// CVResult decodes the message as a CVResult
+func (r Reply) CVResult() (CVResult, bool) {
+	if r.Opcode != 'r' || len(r.Params) != 2 {
+		return CVResult{}, false
+	}
+	fields := strings.Split(r.Params[0], "|")
+	cv, err := strconv.ParseUint(fields[len(fields)-1], 10, 16)
+	if err != nil {
+		return CVResult{}, false
+	}
+	value, err := strconv.Atoi(r.Params[1])
+	if err != nil {
+		return CVResult{}, false
+	}
+	return CVResult{CV: uint16(cv), Value: value}, true
+}
+
+// LocoState is "<l cab reg speedbyte functions>", sent after RequestLocoState and whenever a throttle changes the locomotive
+type LocoState struct {
+	Cab uint16
+	// Speed is the DCC 128 steps speed: 0=stop, 1=emergency stop, 2-127 are steps 1-126
+	Speed   uint8
+	Forward bool
+	// Functions has bit N set when FN is on, functions above F63 are not kept
+	Functions uint64
+}
+
+// LocoState decodes the message as a LocoState
+func (r Reply) LocoState() (LocoState, bool) {
+	if r.Opcode != 'l' || len(r.Params) != 4 {
+		return LocoState{}, false
+	}
+	cab, err := strconv.ParseUint(r.Params[0], 10, 16)
+	if err != nil {
+		return LocoState{}, false
+	}
+	speed, err := strconv.ParseUint(r.Params[2], 10, 8)
+	if err != nil {
+		return LocoState{}, false
+	}
+	// F0-F68 do not fit into 64 bits
+	functions, ok := new(big.Int).SetString(r.Params[3], 10)
+	if !ok || functions.Sign() < 0 {
+		return LocoState{}, false
+	}
+	low := new(big.Int).And(functions, new(big.Int).SetUint64(^uint64(0)))
+	return LocoState{Cab: uint16(cab), Speed: uint8(speed) & 0x7F, Forward: speed&0x80 != 0, Functions: low.Uint64()}, true
+}
+
+// Function tells whether the function is on
+func (s LocoState) Function(fn int) bool {
+	return fn >= 0 && fn < 64 && s.Functions&(1<<fn) != 0
+}
+
+// Power is "<p0>" or "<p1>", optionally followed by the track, e.g. "<p1 MAIN>"
+type Power struct {
+	On bool
+	// Track is empty when the power of all tracks changed
+	Track string
+}
+
+// Power decodes the message as Power
+func (r Reply) Power() (Power, bool) {
+	if r.Opcode != 'p' || len(r.Params) == 0 || (r.Params[0] != "0" && r.Params[0] != "1") {
+		return Power{}, false
+	}
+	power := Power{On: r.Params[0] == "1"}
+	if len(r.Params) > 1 {
+		power.Track = strings.ToUpper(r.Params[1])
+	}
+	return power, true
+}
+
+// Version is the answer to Status, e.g. "<iDCC-EX V-5.0.4 / MEGA / STANDARD_MOTOR_SHIELD G-c389fe9>"
+func (r Reply) Version() (string, bool) {
+	if r.Opcode != 'i' {
+		return "", false
+	}
+	return strings.Join(r.Params, " "), true
+}
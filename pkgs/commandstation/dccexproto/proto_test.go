@@ -0,0 +1,87 @@
+package dccexproto
+
+import (
+	"bufio"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	cases := []struct {
+		cmd      Command
+		expected string
+	}{
+		{PowerOn{}, "<1>"},
+		{PowerOn{Track: TrackMain}, "<1 MAIN>"},
+		{PowerOff{}, "<0>"},
+		{Status{}, "<s>"},
+		{ReadCV{CV: 29}, "<R 29>"},
+		{WriteCV{CV: 1, Value: 3}, "<W 1 3>"},
+		{WritePom{Cab: 3, CV: 3, Value: 10}, "<w 3 3 10>"},
+		{Throttle{Cab: 3, Speed: 40, Forward: true}, "<t 3 40 1>"},
+		{Throttle{Cab: 1234, Speed: -1}, "<t 1234 -1 0>"},
+		{RequestLocoState{Cab: 3}, "<t 3>"},
+		{SetFunction{Cab: 3, Function: 68, On: true}, "<F 3 68 1>"},
+	}
+	for _, c := range cases {
+		if got := c.cmd.Encode(); got != c.expected {
+			t.Errorf("%T.Encode() = %q; want %q", c.cmd, got, c.expected)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	reply, err := Parse("<p1 MAIN>")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if power, ok := reply.Power(); !ok || !power.On || power.Track != TrackMain {
+		t.Errorf("Power() = %+v, %v", power, ok)
+	}
+
+	for message, expected := range map[string]CVResult{
+		"<r 29 6>":       {CV: 29, Value: 6},
+		"<r 1 -1>":       {CV: 1, Value: -1},
+		"<r 0|7|17 192>": {CV: 17, Value: 192},
+	} {
+		reply, err := Parse(message)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", message, err)
+		}
+		if result, ok := reply.CVResult(); !ok || result != expected {
+			t.Errorf("CVResult(%q) = %+v, %v; want %+v", message, result, ok, expected)
+		}
+	}
+
+	// speed byte 0xAA is forward, 128 steps speed 42; F0, F2 and F68 are on
+	reply, _ = Parse("<l 3 0 170 295147905179352825861>")
+	state, ok := reply.LocoState()
+	if !ok || state.Cab != 3 || state.Speed != 42 || !state.Forward || state.Functions != 5 {
+		t.Errorf("LocoState() = %+v, %v", state, ok)
+	}
+
+	reply, _ = Parse("<iDCC-EX V-5.0.4 / MEGA / STANDARD_MOTOR_SHIELD G-c389fe9>")
+	if version, ok := reply.Version(); !ok || version != "DCC-EX V-5.0.4 / MEGA / STANDARD_MOTOR_SHIELD G-c389fe9" {
+		t.Errorf("Version() = %q, %v", version, ok)
+	}
+
+	for _, malformed := range []string{"", "<>", "r 1 3", "<r 1 3"} {
+		if _, err := Parse(malformed); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Parse(%q) = %v; want ErrMalformed", malformed, err)
+		}
+	}
+}
+
+func TestSplitMessages(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("booting...\r\n<iDCC-EX V-5.0.4><p0>\n<r 1 3><l 3"))
+	scanner.Split(SplitMessages)
+	var messages []string
+	for scanner.Scan() {
+		messages = append(messages, scanner.Text())
+	}
+	if expected := []string{"<iDCC-EX V-5.0.4>", "<p0>", "<r 1 3>"}; !reflect.DeepEqual(messages, expected) {
+		t.Fatalf("messages = %q; want %q", messages, expected)
+	}
+}
@@ -0,0 +1,61 @@
+package commandstation
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTimeout is wrapped by the errors of a command station that did not answer in time, test it with errors.Is
+var ErrTimeout = errors.New("timeout")
+
+// Capability names a feature a command station backend may or may not implement
+type Capability string
+
+const (
+	// CapabilityReadBack is receiving any answer from the station, e.g. a CV value
+	CapabilityReadBack Capability = "read-back"
+	// CapabilityLocoState is reading the speed, direction and functions of a loco
+	CapabilityLocoState Capability = "loco-state"
+	// CapabilityFnOnProg is switching functions on the programming track
+	CapabilityFnOnProg Capability = "fn-prog"
+	// CapabilityMMRead is reading registers of a Märklin-Motorola decoder
+	CapabilityMMRead Capability = "mm-read"
+	// CapabilityMMOnMain is programming a Märklin-Motorola decoder on the main track
+	CapabilityMMOnMain Capability = "mm-pom"
+	// CapabilityMMFormat is programming Märklin-Motorola decoders at all
+	CapabilityMMFormat Capability = "mm"
+	// CapabilityBinaryState is switching the DCC binary states
+	CapabilityBinaryState Capability = "binary-state"
+	// CapabilityFeedback is reading and programming R-BUS feedback modules
+	CapabilityFeedback Capability = "feedback"
+	// CapabilityMonitor is listening to the broadcasts of the station
+	CapabilityMonitor Capability = "monitor"
+	// CapabilityCVProgramming is reading and writing CVs at all
+	CapabilityCVProgramming Capability = "cv"
+	// CapabilityLANProgramming is programming CVs over LAN, which a z21start does only when it is unlocked
+	CapabilityLANProgramming Capability = "lan-programming"
+	// CapabilityDryRun is passing the packets to Environment.DryRun instead of sending them
+	CapabilityDryRun Capability = "dry-run"
+	// CapabilityStationState is reading the currents, temperature and error conditions of the station
+	CapabilityStationState Capability = "station-state"
+)
+
+// ErrNotSupported is returned when the backend, or the mode it is used in, does not implement a capability.
+// It is not a failure of the command station itself, so the caller may offer an alternative instead.
+type ErrNotSupported struct {
+	Capability Capability
+	// Reason is a human-readable explanation, optional
+	Reason string
+}
+
+func (e *ErrNotSupported) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("not supported (%s): %s", e.Capability, e.Reason)
+	}
+	return fmt.Sprintf("not supported by the command station: %s", e.Capability)
+}
+
+// NotSupported builds an ErrNotSupported
+func NotSupported(capability Capability, reason string) error {
+	return &ErrNotSupported{Capability: capability, Reason: reason}
+}
@@ -28,13 +28,16 @@ type Station interface {
 	// WriteCV sends a write request to the command station to write CV of specific value for a given locomotive
 	WriteCV(mode Mode, lcv LocoCV, options ...ctxOptions) error
 	ReadCV(mode Mode, lcv LocoCV, options ...ctxOptions) (int, error)
-	SendFn(mode Mode, addr LocoAddr, num FuncNum, toggle bool) error
+	// SendFn switches a function on or off, or toggles it (see FnAction)
+	SendFn(mode Mode, addr LocoAddr, num FuncNum, action FnAction, options ...ctxOptions) error
+	// SendBinaryState switches a DCC binary state (1-32767), the functions beyond F31 of modern sound decoders
+	SendBinaryState(addr LocoAddr, state uint16, on bool, options ...ctxOptions) error
 	// ListFunctions returns a list of function numbers that are currently active (on) for the given locomotive
-	ListFunctions(addr LocoAddr) ([]int, error)
+	ListFunctions(addr LocoAddr, options ...ctxOptions) ([]int, error)
 	// SetSpeed sets the speed and direction of a locomotive
-	SetSpeed(addr LocoAddr, speed uint8, forward bool, speedSteps uint8) error
+	SetSpeed(addr LocoAddr, speed uint8, forward bool, speedSteps uint8, options ...ctxOptions) error
 	// GetSpeed retrieves the current speed and direction of a locomotive
-	GetSpeed(addr LocoAddr) (speed uint8, forward bool, err error)
+	GetSpeed(addr LocoAddr, options ...ctxOptions) (speed uint8, forward bool, err error)
 	CleanUp() error
 }
 
@@ -47,6 +50,24 @@ type LocoAddr uint16
 // Function number
 type FuncNum int
 
+// FnAction is what SendFn does with a function
+type FnAction byte
+
+const (
+	FnOff FnAction = iota
+	FnOn
+	// FnToggle inverts the function in a single command, e.g. to trigger a horn or a whistle
+	FnToggle
+)
+
+// FnSwitch returns FnOn or FnOff
+func FnSwitch(on bool) FnAction {
+	if on {
+		return FnOn
+	}
+	return FnOff
+}
+
 // Mode could be PoM or programming track. Depending on what's supported by your command station
 type Mode string
 
@@ -55,6 +76,15 @@ const (
 	ProgrammingTrackMode Mode = "prog"
 )
 
+// Format is the decoder protocol used for programming
+type Format string
+
+const (
+	DCCFormat Format = "dcc"
+	// MMFormat is Märklin-Motorola, registers can only be written on the programming track
+	MMFormat Format = "mm"
+)
+
 // internal key for function-group cache
 type fnStateKey struct {
 	addr   LocoAddr
@@ -67,11 +97,19 @@ type fnStateKey struct {
 
 type ctxOptions func(*RequestContext) error
 
+// RequestOption allows collecting the contextual options outside of this package, e.g. as station defaults
+type RequestOption = ctxOptions
+
 type RequestContext struct {
-	timeout time.Duration
-	verify  bool
-	retries uint8
-	settle  time.Duration
+	timeout    time.Duration
+	verify     bool
+	retries    uint8
+	retryDelay time.Duration
+	settle     time.Duration
+	format     Format
+	// repeat and repeatInterval apply to the driving commands, see Repeat
+	repeat         uint8
+	repeatInterval time.Duration
 }
 
 func Timeout(timeout time.Duration) func(*RequestContext) error {
@@ -88,6 +126,47 @@ func Retries(retries uint8) func(*RequestContext) error {
 	}
 }
 
+// RetryDelay is the pause between two attempts of the same request
+func RetryDelay(delay time.Duration) func(*RequestContext) error {
+	return func(ctx *RequestContext) error {
+		ctx.retryDelay = delay
+		return nil
+	}
+}
+
+// Settle is the time given to the decoder after a write, before it is read back
+func Settle(settle time.Duration) func(*RequestContext) error {
+	return func(ctx *RequestContext) error {
+		ctx.settle = settle
+		return nil
+	}
+}
+
+// ProgrammingFormat selects the decoder protocol, DCC is used by default
+func ProgrammingFormat(format Format) func(*RequestContext) error {
+	return func(ctx *RequestContext) error {
+		ctx.format = format
+		return nil
+	}
+}
+
+// Repeat sends a function or speed command again the given number of times, as single packets are easily missed on dirty track.
+// Toggling a function is never repeated, every repetition would invert it again.
+func Repeat(times uint8) func(*RequestContext) error {
+	return func(ctx *RequestContext) error {
+		ctx.repeat = times
+		return nil
+	}
+}
+
+// RepeatInterval is the pause between two repetitions of a command
+func RepeatInterval(interval time.Duration) func(*RequestContext) error {
+	return func(ctx *RequestContext) error {
+		ctx.repeatInterval = interval
+		return nil
+	}
+}
+
 func Verify(shouldVerify bool) func(*RequestContext) error {
 	return func(ctx *RequestContext) error {
 		ctx.verify = shouldVerify
@@ -0,0 +1,496 @@
+package commandstation
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/loconet"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: Digitrax and Uhlenbrock command stations on a LocoNet, reached through LbServer (LoconetOverTcp),
+// e.g. JMRI, a Digitrax LNWI or an Uhlenbrock 63820. A locomotive is driven through the slot the command station
+// assigns to its address. The slot holds F0-F8, so the higher functions cannot be switched this way.
+// CVs are programmed through the programmer slot, which answers when the programming is finished.
+//
+
+// LocoNetFunctionMax is the highest function number held by a LocoNet slot
+const LocoNetFunctionMax = 8
+
+const (
+	// locoNetDialTimeout is how long connecting to LbServer may take
+	locoNetDialTimeout = 5 * time.Second
+	// locoNetSentTimeout is how long LbServer may take to confirm a message was put on the bus
+	locoNetSentTimeout = 500 * time.Millisecond
+)
+
+// errLocoNetClosed is returned to the waiting requests when the connection is closed
+var errLocoNetClosed = errors.New("the connection to LbServer was closed")
+
+// errProgrammerBusy is returned when the command station refuses a programming task while another one runs
+var errProgrammerBusy = errors.New("the programmer of the command station is busy")
+
+// LocoNetTCPConfig is the configuration of the "loconet-tcp" station type
+type LocoNetTCPConfig struct {
+	Address string
+	Port    uint16
+}
+
+func init() {
+	register("loconet-tcp", func(config *LocoNetTCPConfig, env Environment) (*LocoNet, error) {
+		if err := refuseDryRun("loconet-tcp", env); err != nil {
+			return nil, err
+		}
+		return NewLocoNetTCP(config.Address, config.Port, env.Defaults...)
+	})
+}
+
+// NewLocoNetTCP connects to LbServer, port 0 is the default 1234
+func NewLocoNetTCP(address string, port uint16, defaults ...ctxOptions) (*LocoNet, error) {
+	if port == 0 {
+		port = loconet.DefaultTCPPort
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, strconv.Itoa(int(port))), locoNetDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("TCP dial error while connecting to LbServer: %w", err)
+	}
+	return newLocoNet(conn, defaults), nil
+}
+
+func newLocoNet(conn io.ReadWriteCloser, defaults []ctxOptions) *LocoNet {
+	l := &LocoNet{
+		conn:     conn,
+		Timeout:  time.Second * 10,
+		defaults: defaults,
+		lines:    make(chan loconet.Line, 64),
+		closed:   make(chan struct{}),
+		slots:    map[byte]loconet.SlotData{},
+	}
+	go l.readLines(conn)
+	return l
+}
+
+// LocoNet implements Station for a LocoNet command station behind LbServer
+type LocoNet struct {
+	conn     io.ReadWriteCloser
+	Timeout  time.Duration
+	defaults []ctxOptions
+	// lines are read from conn, the messages of all devices on the bus included
+	lines  chan loconet.Line
+	closed chan struct{}
+	// mu serializes the requests, so every one of them sees only the replies to itself
+	mu sync.Mutex
+	// slots are the slots taken by this throttle, they are given back by CleanUp
+	slots map[byte]loconet.SlotData
+}
+
+// readLines parses the lines from conn until it is closed
+func (l *LocoNet) readLines(conn io.Reader) {
+	defer close(l.closed)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line, err := loconet.ParseLine(scanner.Text())
+		if err != nil {
+			logrus.Debugf("loconet: %s", err)
+			continue
+		}
+		logrus.Debugf("loconet: res %s", scanner.Text())
+		select {
+		case l.lines <- line:
+		default:
+			logrus.Debugf("loconet: nobody waits, dropping %q", scanner.Text())
+		}
+	}
+}
+
+// newRequestContext builds the context from built-in defaults, station defaults and request options, in this order
+func (l *LocoNet) newRequestContext(options []ctxOptions) RequestContext {
+	ctx := RequestContext{
+		timeout:        l.Timeout,
+		retries:        2,
+		retryDelay:     200 * time.Millisecond,
+		settle:         200 * time.Millisecond,
+		format:         DCCFormat,
+		repeatInterval: 50 * time.Millisecond,
+	}
+	applyMethodsToCtx(&ctx, l.defaults)
+	applyMethodsToCtx(&ctx, options)
+	return ctx
+}
+
+// transmit drops what was received so far and sends the message, the caller holds mu
+func (l *LocoNet) transmit(req loconet.Message) error {
+	for drained := false; !drained; {
+		select {
+		case <-l.lines:
+		default:
+			drained = true
+		}
+	}
+	line := loconet.EncodeSend(req)
+	logrus.Debugf("loconet: req %s (%T)", line, req)
+	if _, err := io.WriteString(l.conn, line+"\n"); err != nil {
+		return fmt.Errorf("cannot send to LbServer: %w", err)
+	}
+	return nil
+}
+
+// wait returns the first message on the bus accepted by match. A nil match waits only for LbServer
+// to confirm the message was put on the bus.
+func (l *LocoNet) wait(req loconet.Message, timeout time.Duration, match func(loconet.Message) bool) (loconet.Message, error) {
+	if match == nil {
+		timeout = locoNetSentTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case line := <-l.lines:
+			switch line.Keyword {
+			case "SENT":
+				if line.Text != "OK" {
+					return nil, fmt.Errorf("LbServer did not send %T: %s", req, line.Text)
+				}
+				if match == nil {
+					return nil, nil
+				}
+			case "ERROR":
+				return nil, fmt.Errorf("LbServer: %s", line.Text)
+			case "RECEIVE":
+				msg, err := loconet.Decode(line.Message)
+				if err != nil {
+					continue
+				}
+				if match != nil && match(msg) {
+					return msg, nil
+				}
+			}
+		case <-l.closed:
+			return nil, errLocoNetClosed
+		case <-timer.C:
+			if match == nil {
+				// older servers do not confirm the messages
+				logrus.Debugf("loconet: %T was not confirmed by LbServer", req)
+				return nil, nil
+			}
+			return nil, errResponseTimeout
+		}
+	}
+}
+
+// request sends the message and waits for the first reply accepted by match, see wait
+func (l *LocoNet) request(req loconet.Message, timeout time.Duration, match func(loconet.Message) bool) (loconet.Message, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.transmit(req); err != nil {
+		return nil, err
+	}
+	return l.wait(req, timeout, match)
+}
+
+// send puts a message on the bus that is not answered
+func (l *LocoNet) send(req loconet.Message) error {
+	_, err := l.request(req, 0, nil)
+	return err
+}
+
+// sendRepeated sends a driving command and then repeats it as requested, see Repeat
+func (l *LocoNet) sendRepeated(req loconet.Message, ctx RequestContext) error {
+	if err := l.send(req); err != nil {
+		return err
+	}
+	for i := 0; i < int(ctx.repeat); i++ {
+		time.Sleep(ctx.repeatInterval)
+		if err := l.send(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// programmer runs a programming task and waits until it has finished. A blind task (on the main track)
+// returns as soon as it is accepted, with a nil result.
+func (l *LocoNet) programmer(task loconet.ProgrammerTask, ctx RequestContext) (*loconet.ProgrammerResult, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.transmit(task); err != nil {
+		return nil, err
+	}
+	msg, err := l.wait(task, ctx.timeout, func(msg loconet.Message) bool {
+		ack, ok := msg.(loconet.LongAck)
+		return ok && ack.Opcode == loconet.OpcWriteSlotData
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch msg.(loconet.LongAck).Ack {
+	case loconet.AckRefused:
+		return nil, errProgrammerBusy
+	case loconet.AckNotImplemented:
+		return nil, errors.New("the command station has no programmer")
+	case loconet.AckAcceptedBlind:
+		return nil, nil
+	}
+
+	msg, err = l.wait(task, ctx.timeout, func(msg loconet.Message) bool {
+		_, ok := msg.(loconet.ProgrammerResult)
+		return ok
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := msg.(loconet.ProgrammerResult)
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+	if result.CV != task.CV {
+		return nil, fmt.Errorf("the command station reported cv%d instead of cv%d", result.CV, task.CV)
+	}
+	return &result, nil
+}
+
+// programmerWithRetries repeats a programming task that failed, but not when the connection is closed
+func (l *LocoNet) programmerWithRetries(task loconet.ProgrammerTask, ctx RequestContext) (*loconet.ProgrammerResult, error) {
+	var lastErr error
+	for i := 0; i <= int(ctx.retries); i++ {
+		logrus.Debugf("Try [%d/%d]", i, ctx.retries)
+		result, err := l.programmer(task, ctx)
+		if err == nil {
+			return result, nil
+		}
+		if errors.Is(err, errLocoNetClosed) {
+			return nil, err
+		}
+		lastErr = err
+		time.Sleep(ctx.retryDelay)
+	}
+	return nil, lastErr
+}
+
+func (l *LocoNet) WriteCV(mode Mode, lcv LocoCV, options ...ctxOptions) error {
+	ctx := l.newRequestContext(options)
+	if ctx.format == MMFormat {
+		return NotSupported(CapabilityMMFormat, "LocoNet programs only DCC decoders")
+	}
+	if lcv.Cv.Value < 0 || lcv.Cv.Value > 255 {
+		return fmt.Errorf("cannot write CV: value %d out of range (0-255)", lcv.Cv.Value)
+	}
+	if lcv.Cv.Num < 1 || lcv.Cv.Num > 1024 {
+		return fmt.Errorf("cannot write CV: cv%d out of range (1-1024)", lcv.Cv.Num)
+	}
+	task := loconet.ProgrammerTask{CV: uint16(lcv.Cv.Num), Value: byte(lcv.Cv.Value)}
+	logrus.Debugf("Writing CV: loco=%d, CV%d=%d", lcv.LocoId, lcv.Cv.Num, lcv.Cv.Value)
+
+	switch mode {
+	case MainTrackMode:
+		if ctx.verify {
+			return NotSupported(CapabilityReadBack, "LocoNet reads CVs only on the programming track, a main track write cannot be verified")
+		}
+		task.Command, task.Addr = loconet.ProgOpsWrite, uint16(lcv.LocoId)
+	case ProgrammingTrackMode:
+		task.Command = loconet.ProgDirectWrite
+	default:
+		return fmt.Errorf("cannot write CV: unsupported mode %s", mode)
+	}
+	if _, err := l.programmerWithRetries(task, ctx); err != nil {
+		return fmt.Errorf("cannot write CV: %w", err)
+	}
+	if ctx.verify {
+		logrus.Debug("Verifying written CV")
+		time.Sleep(ctx.settle)
+		read, err := l.ReadCV(mode, lcv, options...)
+		if err != nil {
+			return fmt.Errorf("cannot verify CV was written: %w", err)
+		}
+		if read != lcv.Cv.Value {
+			return fmt.Errorf("cannot write CV, the value differs after a write")
+		}
+	}
+	return nil
+}
+
+func (l *LocoNet) ReadCV(mode Mode, lcv LocoCV, options ...ctxOptions) (int, error) {
+	ctx := l.newRequestContext(options)
+	if ctx.format == MMFormat {
+		return 0, NotSupported(CapabilityMMRead, "MM decoders cannot be read")
+	}
+	if mode != ProgrammingTrackMode {
+		return 0, NotSupported(CapabilityReadBack, "LocoNet reads CVs only on the programming track")
+	}
+	if lcv.Cv.Num < 1 || lcv.Cv.Num > 1024 {
+		return 0, fmt.Errorf("cannot read CV: cv%d out of range (1-1024)", lcv.Cv.Num)
+	}
+	result, err := l.programmerWithRetries(loconet.ProgrammerTask{Command: loconet.ProgDirectRead, CV: uint16(lcv.Cv.Num)}, ctx)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read CV: %w", err)
+	}
+	if result == nil {
+		return 0, errors.New("cannot read CV: the command station did not report the value")
+	}
+	return int(result.Value), nil
+}
+
+// slot asks the command station for the slot of a locomotive and takes it with a null move, unless this throttle has it already
+func (l *LocoNet) slot(addr LocoAddr, ctx RequestContext) (loconet.SlotData, error) {
+	var data loconet.SlotData
+	var lastErr error
+	for i := 0; i <= int(ctx.retries); i++ {
+		msg, err := l.request(loconet.LocoAddress{Addr: uint16(addr)}, ctx.timeout, func(msg loconet.Message) bool {
+			switch m := msg.(type) {
+			case loconet.SlotData:
+				return m.Addr == uint16(addr)
+			case loconet.LongAck:
+				return m.Opcode == loconet.OpcLocoAddress
+			}
+			return false
+		})
+		if err == nil {
+			if _, ok := msg.(loconet.LongAck); ok {
+				return data, fmt.Errorf("the command station has no free slot for locomotive %d", addr)
+			}
+			data, lastErr = msg.(loconet.SlotData), nil
+			break
+		}
+		lastErr = err
+		if errors.Is(err, errLocoNetClosed) {
+			break
+		}
+		time.Sleep(ctx.retryDelay)
+	}
+	if lastErr != nil {
+		return data, fmt.Errorf("cannot find the slot of locomotive %d: %w", addr, lastErr)
+	}
+	if _, taken := l.slots[data.Slot]; taken || data.Status == loconet.SlotInUse {
+		return data, nil
+	}
+
+	msg, err := l.request(loconet.MoveSlots{From: data.Slot, To: data.Slot}, ctx.timeout, func(msg loconet.Message) bool {
+		m, ok := msg.(loconet.SlotData)
+		return ok && m.Slot == data.Slot
+	})
+	if err != nil {
+		return data, fmt.Errorf("cannot take the slot of locomotive %d: %w", addr, err)
+	}
+	data = msg.(loconet.SlotData)
+	l.slots[data.Slot] = data
+	return data, nil
+}
+
+// SendFn switches F0-F8 in the slot of the locomotive, the other functions sent with it keep their state
+func (l *LocoNet) SendFn(mode Mode, addr LocoAddr, num FuncNum, action FnAction, options ...ctxOptions) error {
+	if mode != MainTrackMode {
+		return NotSupported(CapabilityFnOnProg, fmt.Sprintf("SendFn: unsupported mode %s", mode))
+	}
+	fn := int(num)
+	if fn < 0 || fn > LocoNetFunctionMax {
+		return fmt.Errorf("SendFn: unsupported function number %d (must be 0-%d)", num, LocoNetFunctionMax)
+	}
+	ctx := l.newRequestContext(options)
+	if action == FnToggle {
+		ctx.repeat = 0
+	}
+	data, err := l.slot(addr, ctx)
+	if err != nil {
+		return fmt.Errorf("SendFn: %w", err)
+	}
+	on := action == FnOn || (action == FnToggle && data.Functions&(1<<fn) == 0)
+	functions := data.Functions &^ (1 << fn)
+	if on {
+		functions |= 1 << fn
+	}
+	var req loconet.Message = loconet.LocoDirF{Slot: data.Slot, Forward: data.Forward, Functions: functions}
+	if fn > 4 {
+		req = loconet.LocoSound{Slot: data.Slot, Functions: functions}
+	}
+	if err := l.sendRepeated(req, ctx); err != nil {
+		return fmt.Errorf("SendFn: cannot write function command: %w", err)
+	}
+	return nil
+}
+
+func (l *LocoNet) SendBinaryState(addr LocoAddr, state uint16, on bool, options ...ctxOptions) error {
+	return NotSupported(CapabilityBinaryState, "binary states are not sent over LocoNet")
+}
+
+func (l *LocoNet) ListFunctions(addr LocoAddr, options ...ctxOptions) ([]int, error) {
+	data, err := l.slot(addr, l.newRequestContext(options))
+	if err != nil {
+		return nil, err
+	}
+	var active []int
+	for fn := 0; fn <= LocoNetFunctionMax; fn++ {
+		if data.Functions&(1<<fn) != 0 {
+			active = append(active, fn)
+		}
+	}
+	return active, nil
+}
+
+// SetSpeed sets the speed and direction of a locomotive, the speed has the meaning of Z21Roco.SetSpeed.
+// The slot speed is always in 128 steps, the command station converts it to the speed steps of the slot.
+func (l *LocoNet) SetSpeed(addr LocoAddr, speed uint8, forward bool, speedSteps uint8, options ...ctxOptions) error {
+	var steps int
+	switch speedSteps {
+	case 14:
+		steps = scaleSpeed(speed, 1, 14)
+	case 28:
+		steps = scaleSpeed(speed, 0, 28)
+	case 128:
+		steps = scaleSpeed(speed, 1, 126)
+	default:
+		return fmt.Errorf("invalid speed steps: %d (must be 14, 28, or 128)", speedSteps)
+	}
+	ctx := l.newRequestContext(options)
+	data, err := l.slot(addr, ctx)
+	if err != nil {
+		return fmt.Errorf("SetSpeed: %w", err)
+	}
+	if data.Forward != forward {
+		if err := l.send(loconet.LocoDirF{Slot: data.Slot, Forward: forward, Functions: data.Functions}); err != nil {
+			return fmt.Errorf("SetSpeed: cannot write direction command: %w", err)
+		}
+	}
+	if err := l.sendRepeated(loconet.LocoSpeed{Slot: data.Slot, Speed: slotSpeed(steps)}, ctx); err != nil {
+		return fmt.Errorf("SetSpeed: cannot write speed command: %w", err)
+	}
+	return nil
+}
+
+// slotSpeed converts the 0-126 steps of scaleSpeed and -1 for an emergency stop to 0=stop, 1=emergency stop and 2-127
+func slotSpeed(steps int) uint8 {
+	switch {
+	case steps == 0:
+		return 0
+	case steps < 0:
+		return 1
+	}
+	return uint8(steps + 1)
+}
+
+// GetSpeed reads the speed and direction of a locomotive from its slot.
+// Returns: speed (0-127 as in 128 steps), forward (true for forward, false for reverse), error
+func (l *LocoNet) GetSpeed(addr LocoAddr, options ...ctxOptions) (uint8, bool, error) {
+	data, err := l.slot(addr, l.newRequestContext(options))
+	if err != nil {
+		return 0, false, err
+	}
+	return data.Speed, data.Forward, nil
+}
+
+// CleanUp gives the taken slots back as common ones, so the locomotives keep running and other throttles can take them
+func (l *LocoNet) CleanUp() error {
+	for _, data := range l.slots {
+		if err := l.send(loconet.SlotStatus{Slot: data.Slot, Status: loconet.SlotCommon, Steps: data.Steps}); err != nil {
+			logrus.Errorf("cannot release slot %d: %s", data.Slot, err)
+		}
+	}
+	l.slots = map[byte]loconet.SlotData{}
+	return l.conn.Close()
+}
@@ -0,0 +1,443 @@
+// Package loconet is a codec for LocoNet, the bus of Digitrax and Uhlenbrock command stations,
+// and for LoconetOverTcp, the text protocol of LbServer carrying LocoNet over a TCP connection.
+//
+// A LocoNet message starts with an opcode, its bits 6-5 give the length: 2, 4 or 6 bytes,
+// or a variable length given by the second byte. The last byte is the checksum, the inverted XOR of the others.
+//
+// LbServer exchanges lines of text, every message as hexadecimal bytes:
+//
+//	SEND A0 03 00 5C      client → server
+//	SENT OK               server → client, the message was put on the bus
+//	RECEIVE A0 03 00 5C   server → client, every message on the bus, the sent ones included
+//
+// Locomotives are driven through slots: the command station assigns a slot to an address, and the speed
+// and functions are sent to the slot. CVs are programmed through the programmer slot 0x7C.
+package loconet
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultTCPPort is the port of LbServer
+const DefaultTCPPort = 1234
+
+// ProgrammerSlot is the slot of the programming tasks
+const ProgrammerSlot = 0x7C
+
+// LocoNet opcodes
+const (
+	OpcGlobalPowerOff byte = 0x82
+	OpcGlobalPowerOn  byte = 0x83
+	OpcLocoSpeed      byte = 0xA0
+	OpcLocoDirF       byte = 0xA1
+	OpcLocoSound      byte = 0xA2
+	OpcLongAck        byte = 0xB4
+	OpcSlotStatus     byte = 0xB5
+	OpcMoveSlots      byte = 0xBA
+	OpcLocoAddress    byte = 0xBF
+	OpcSlotReadData   byte = 0xE7
+	OpcWriteSlotData  byte = 0xEF
+)
+
+var (
+	// ErrMalformed is returned by Decode when the length or the checksum of a message is invalid
+	ErrMalformed = errors.New("malformed LocoNet message")
+	// ErrUnknownMessage is returned by Decode for well-formed messages the codec does not know
+	ErrUnknownMessage = errors.New("unrecognized LocoNet message")
+)
+
+// Message is a single LocoNet message
+type Message interface {
+	// Encode returns the complete message including the checksum
+	Encode() []byte
+}
+
+// message appends the checksum
+func message(b ...byte) []byte {
+	return append(b, checksum(b))
+}
+
+func checksum(b []byte) byte {
+	sum := byte(0xFF)
+	for _, v := range b {
+		sum ^= v
+	}
+	return sum
+}
+
+// Length returns the length of a message by its first bytes, false when it cannot be known yet
+func Length(data []byte) (int, bool) {
+	if len(data) == 0 {
+		return 0, false
+	}
+	switch data[0] & 0x60 {
+	case 0x00:
+		return 2, true
+	case 0x20:
+		return 4, true
+	case 0x40:
+		return 6, true
+	}
+	if len(data) < 2 {
+		return 0, false
+	}
+	return int(data[1]), true
+}
+
+// Decode parses a single message
+func Decode(b []byte) (Message, error) {
+	length, ok := Length(b)
+	if !ok || length < 2 || length != len(b) || b[0]&0x80 == 0 {
+		return nil, fmt.Errorf("%w: % X", ErrMalformed, b)
+	}
+	if sum := checksum(b[:len(b)-1]); sum != b[len(b)-1] {
+		return nil, fmt.Errorf("%w: checksum 0x%02X, expected 0x%02X", ErrMalformed, b[len(b)-1], sum)
+	}
+	data := b[1 : len(b)-1]
+
+	switch b[0] {
+	case OpcGlobalPowerOff:
+		return GlobalPowerOff{}, nil
+	case OpcGlobalPowerOn:
+		return GlobalPowerOn{}, nil
+	case OpcLocoSpeed:
+		return LocoSpeed{Slot: data[0], Speed: data[1]}, nil
+	case OpcLocoDirF:
+		return LocoDirF{Slot: data[0], Forward: data[1]&0x20 == 0, Functions: dirfFunctions(data[1])}, nil
+	case OpcLocoSound:
+		return LocoSound{Slot: data[0], Functions: sndFunctions(data[1])}, nil
+	case OpcLongAck:
+		return LongAck{Opcode: data[0] | 0x80, Ack: data[1]}, nil
+	case OpcSlotStatus:
+		return SlotStatus{Slot: data[0], Status: data[1] & 0x30, Steps: stepsFromStat(data[1])}, nil
+	case OpcMoveSlots:
+		return MoveSlots{From: data[0], To: data[1]}, nil
+	case OpcLocoAddress:
+		return LocoAddress{Addr: uint16(data[0])<<7 | uint16(data[1])}, nil
+	case OpcSlotReadData, OpcWriteSlotData:
+		if len(data) != 12 {
+			break
+		}
+		if data[1] == ProgrammerSlot {
+			task := decodeProgrammerTask(data)
+			if b[0] == OpcWriteSlotData {
+				return task, nil
+			}
+			return ProgrammerResult{ProgrammerTask: task, Status: data[3]}, nil
+		}
+		if b[0] == OpcSlotReadData {
+			return decodeSlotData(data), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: opcode 0x%02X, %d byte(s)", ErrUnknownMessage, b[0], len(b))
+}
+
+// GlobalPowerOff is OPC_GPOFF, switching the track power off
+type GlobalPowerOff struct{}
+
+func (m GlobalPowerOff) Encode() []byte {
+	return message(OpcGlobalPowerOff)
+}
+
+// GlobalPowerOn is OPC_GPON, switching the track power on
+type GlobalPowerOn struct{}
+
+func (m GlobalPowerOn) Encode() []byte {
+	return message(OpcGlobalPowerOn)
+}
+
+// LocoAddress is OPC_LOCO_ADR, asking for the slot of an address, answered with SlotData
+// or with a LongAck when no slot is free
+type LocoAddress struct {
+	Addr uint16
+}
+
+func (m LocoAddress) Encode() []byte {
+	return message(OpcLocoAddress, byte(m.Addr>>7)&0x7F, byte(m.Addr)&0x7F)
+}
+
+// MoveSlots is OPC_MOVE_SLOTS, moving a slot to itself (a null move) marks it in use by this throttle
+type MoveSlots struct {
+	From, To byte
+}
+
+func (m MoveSlots) Encode() []byte {
+	return message(OpcMoveSlots, m.From, m.To)
+}
+
+// LocoSpeed is OPC_LOCO_SPD, Speed is 0=stop, 1=emergency stop, 2-127 are steps 1-126
+type LocoSpeed struct {
+	Slot  byte
+	Speed uint8
+}
+
+func (m LocoSpeed) Encode() []byte {
+	return message(OpcLocoSpeed, m.Slot, m.Speed&0x7F)
+}
+
+// LocoDirF is OPC_LOCO_DIRF, the direction with F0-F4
+type LocoDirF struct {
+	Slot    byte
+	Forward bool
+	// Functions has bit N set when FN is on, only F0-F4 are encoded
+	Functions uint32
+}
+
+func (m LocoDirF) Encode() []byte {
+	return message(OpcLocoDirF, m.Slot, dirfByte(m.Forward, m.Functions))
+}
+
+func dirfByte(forward bool, functions uint32) byte {
+	dirf := byte(functions>>1) & 0x0F
+	if functions&1 != 0 {
+		dirf |= 0x10
+	}
+	if !forward {
+		dirf |= 0x20
+	}
+	return dirf
+}
+
+func dirfFunctions(dirf byte) uint32 {
+	functions := uint32(dirf&0x0F) << 1
+	if dirf&0x10 != 0 {
+		functions |= 1
+	}
+	return functions
+}
+
+// LocoSound is OPC_LOCO_SND, F5-F8
+type LocoSound struct {
+	Slot byte
+	// Functions has bit N set when FN is on, only F5-F8 are encoded
+	Functions uint32
+}
+
+func (m LocoSound) Encode() []byte {
+	return message(OpcLocoSound, m.Slot, byte(m.Functions>>5)&0x0F)
+}
+
+func sndFunctions(snd byte) uint32 {
+	return uint32(snd&0x0F) << 5
+}
+
+// LongAck is OPC_LONG_ACK, the answer to a request that has no other reply, Opcode is the opcode of the request
+type LongAck struct {
+	Opcode byte
+	Ack    byte
+}
+
+// LongAck answers, AckRefused is the programmer being busy or no free slot for LocoAddress
+const (
+	AckRefused        byte = 0x00
+	AckAccepted       byte = 0x01
+	AckAcceptedBlind  byte = 0x40
+	AckNotImplemented byte = 0x7F
+)
+
+func (m LongAck) Encode() []byte {
+	return message(OpcLongAck, m.Opcode&0x7F, m.Ack)
+}
+
+// Slot status of SlotData, bits 5-4 of STAT1
+const (
+	SlotFree   byte = 0x00
+	SlotCommon byte = 0x10
+	SlotIdle   byte = 0x20
+	SlotInUse  byte = 0x30
+)
+
+// SlotData is OPC_SL_RD_DATA of a locomotive slot
+type SlotData struct {
+	Slot byte
+	// Status is one of SlotFree, SlotCommon, SlotIdle or SlotInUse
+	Status byte
+	// Steps is 14, 28 or 128
+	Steps   uint8
+	Addr    uint16
+	Speed   uint8
+	Forward bool
+	// Functions has bit N set when FN is on, the slot holds F0-F8
+	Functions uint32
+	// Track is the status of the track, bit 0 is set when the power is on
+	Track byte
+}
+
+// stepsFromStat returns the speed steps of STAT1
+func stepsFromStat(stat byte) uint8 {
+	switch stat & 0x07 {
+	case 0x02:
+		return 14
+	case 0x03, 0x04, 0x07:
+		return 128
+	}
+	return 28
+}
+
+func statByte(status byte, steps uint8) byte {
+	stat := status & 0x30
+	switch steps {
+	case 14:
+		stat |= 0x02
+	case 128:
+		stat |= 0x03
+	}
+	return stat
+}
+
+func decodeSlotData(data []byte) SlotData {
+	return SlotData{
+		Slot:      data[1],
+		Status:    data[2] & 0x30,
+		Steps:     stepsFromStat(data[2]),
+		Addr:      uint16(data[8])<<7 | uint16(data[3]),
+		Speed:     data[4],
+		Forward:   data[5]&0x20 == 0,
+		Functions: dirfFunctions(data[5]) | sndFunctions(data[9]),
+		Track:     data[6],
+	}
+}
+
+func (m SlotData) Encode() []byte {
+	return message(OpcSlotReadData, 0x0E, m.Slot, statByte(m.Status, m.Steps), byte(m.Addr)&0x7F, m.Speed&0x7F, dirfByte(m.Forward, m.Functions),
+		m.Track, 0, byte(m.Addr>>7)&0x7F, byte(m.Functions>>5)&0x0F, 0, 0)
+}
+
+// SlotStatus is OPC_SLOT_STAT1, changing the status of a slot, e.g. to SlotCommon when the throttle lets go of it
+type SlotStatus struct {
+	Slot   byte
+	Status byte
+	// Steps is 14, 28 or 128, they are kept in the same byte as the status
+	Steps uint8
+}
+
+func (m SlotStatus) Encode() []byte {
+	return message(OpcSlotStatus, m.Slot, statByte(m.Status, m.Steps))
+}
+
+// Programmer commands, PCMD of the programmer slot
+const (
+	// ProgDirectRead reads a byte in direct mode on the programming track
+	ProgDirectRead byte = 0x28
+	// ProgDirectWrite writes a byte in direct mode on the programming track
+	ProgDirectWrite byte = 0x68
+	// ProgOpsWrite writes a byte on the main track, there is no feedback
+	ProgOpsWrite byte = 0x64
+)
+
+// Programmer status bits, PSTAT of ProgrammerResult
+const (
+	ProgNoDecoder  byte = 0x01
+	ProgNoWriteAck byte = 0x02
+	ProgNoReadAck  byte = 0x04
+	ProgAborted    byte = 0x08
+)
+
+// ProgrammerTask is OPC_WR_SL_DATA to the programmer slot. The command station answers with a LongAck,
+// and unless the task is blind, with a ProgrammerResult when it has finished.
+type ProgrammerTask struct {
+	// Command is ProgDirectRead, ProgDirectWrite or ProgOpsWrite
+	Command byte
+	// Addr is the locomotive of ProgOpsWrite
+	Addr uint16
+	// CV is 1-1024
+	CV    uint16
+	Value byte
+}
+
+func (m ProgrammerTask) Encode() []byte {
+	return m.encode(OpcWriteSlotData, 0)
+}
+
+func (m ProgrammerTask) encode(opcode byte, status byte) []byte {
+	cv := m.CV - 1
+	cvh := byte(cv>>7)&0x01 | byte(cv>>4)&0x30 | (m.Value>>6)&0x02
+	return message(opcode, 0x0E, ProgrammerSlot, m.Command, status, byte(m.Addr>>7)&0x7F, byte(m.Addr)&0x7F,
+		0, cvh, byte(cv)&0x7F, m.Value&0x7F, 0, 0)
+}
+
+func decodeProgrammerTask(data []byte) ProgrammerTask {
+	cvh := data[7]
+	cv := uint16(cvh&0x01)<<7 | uint16(cvh&0x30)<<4 | uint16(data[8])
+	return ProgrammerTask{
+		Command: data[2],
+		Addr:    uint16(data[4])<<7 | uint16(data[5]),
+		CV:      cv + 1,
+		Value:   data[9] | (cvh&0x02)<<6,
+	}
+}
+
+// ProgrammerResult is OPC_SL_RD_DATA of the programmer slot, sent when a programming task has finished
+type ProgrammerResult struct {
+	ProgrammerTask
+	// Status has the Prog… bits set for the failures, 0 is success
+	Status byte
+}
+
+func (m ProgrammerResult) Encode() []byte {
+	return m.ProgrammerTask.encode(OpcSlotReadData, m.Status)
+}
+
+// Err returns nil for a successful task, otherwise an error naming the failure
+func (m ProgrammerResult) Err() error {
+	switch {
+	case m.Status == 0:
+		return nil
+	case m.Status&ProgNoDecoder != 0:
+		return errors.New("no locomotive on the programming track")
+	case m.Status&ProgNoWriteAck != 0:
+		return fmt.Errorf("the decoder did not acknowledge writing cv%d", m.CV)
+	case m.Status&ProgNoReadAck != 0:
+		return fmt.Errorf("the decoder did not acknowledge reading cv%d", m.CV)
+	case m.Status&ProgAborted != 0:
+		return errors.New("the programming was aborted")
+	}
+	return fmt.Errorf("programming failed with status 0x%02X", m.Status)
+}
+
+//
+// LoconetOverTcp
+//
+
+// Line is a single line of LoconetOverTcp
+type Line struct {
+	// Keyword is e.g. "RECEIVE", "SENT" or "VERSION"
+	Keyword string
+	// Message is the bytes of RECEIVE
+	Message []byte
+	// Text is the rest of the other lines, e.g. "OK" of "SENT OK"
+	Text string
+}
+
+// EncodeSend returns the line sending the message, without the line end
+func EncodeSend(m Message) string {
+	var b strings.Builder
+	b.WriteString("SEND")
+	for _, v := range m.Encode() {
+		fmt.Fprintf(&b, " %02X", v)
+	}
+	return b.String()
+}
+
+// ParseLine parses a line received from LbServer
+func ParseLine(line string) (Line, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return Line{}, fmt.Errorf("%w: empty line", ErrMalformed)
+	}
+	parsed := Line{Keyword: strings.ToUpper(fields[0]), Text: strings.Join(fields[1:], " ")}
+	if parsed.Keyword != "RECEIVE" && parsed.Keyword != "SEND" {
+		return parsed, nil
+	}
+	for _, field := range fields[1:] {
+		v, err := strconv.ParseUint(field, 16, 8)
+		if err != nil {
+			return Line{}, fmt.Errorf("%w: %q", ErrMalformed, line)
+		}
+		parsed.Message = append(parsed.Message, byte(v))
+	}
+	return parsed, nil
+}
@@ -0,0 +1,76 @@
+package loconet
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	cases := []struct {
+		msg      Message
+		expected []byte
+	}{
+		{GlobalPowerOn{}, []byte{0x83, 0x7C}},
+		{GlobalPowerOff{}, []byte{0x82, 0x7D}},
+		{LocoAddress{Addr: 3}, []byte{0xBF, 0x00, 0x03, 0x43}},
+		{LocoSpeed{Slot: 3, Speed: 0}, []byte{0xA0, 0x03, 0x00, 0x5C}},
+		{LocoDirF{Slot: 3, Forward: false, Functions: 1<<0 | 1<<2}, []byte{0xA1, 0x03, 0x32, 0x6F}},
+		{MoveSlots{From: 5, To: 5}, []byte{0xBA, 0x05, 0x05, 0x45}},
+		// CV29 is 28 (0-based), the value 0x86 has its high bit in CVH
+		{ProgrammerTask{Command: ProgDirectWrite, CV: 29, Value: 0x86}, []byte{0xEF, 0x0E, 0x7C, 0x68, 0x00, 0x00, 0x00, 0x00, 0x02, 0x1C, 0x06, 0x00, 0x00, 0x12}},
+	}
+	for _, c := range cases {
+		if got := c.msg.Encode(); !bytes.Equal(got, c.expected) {
+			t.Errorf("Encode(%T) = % X; want % X", c.msg, got, c.expected)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	messages := []Message{
+		LocoSound{Slot: 7, Functions: 1<<5 | 1<<8},
+		LongAck{Opcode: OpcWriteSlotData, Ack: AckAccepted},
+		SlotStatus{Slot: 7, Status: SlotCommon, Steps: 128},
+		SlotData{Slot: 7, Status: SlotInUse, Steps: 128, Addr: 1234, Speed: 42, Forward: true, Functions: 1<<0 | 1<<6, Track: 0x07},
+		ProgrammerTask{Command: ProgOpsWrite, Addr: 1234, CV: 1000, Value: 255},
+		ProgrammerResult{ProgrammerTask: ProgrammerTask{Command: ProgDirectRead, CV: 8, Value: 145}, Status: ProgNoReadAck},
+	}
+	for _, msg := range messages {
+		got, err := Decode(msg.Encode())
+		if err != nil {
+			t.Fatalf("Decode(%T): %v", msg, err)
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("Decode(% X) = %#v; want %#v", msg.Encode(), got, msg)
+		}
+	}
+
+	if _, err := Decode([]byte{0xA0, 0x03, 0x00, 0x5D}); !errors.Is(err, ErrMalformed) {
+		t.Errorf("a wrong checksum: %v", err)
+	}
+	if _, err := Decode([]byte{0xA0, 0x03, 0x5C}); !errors.Is(err, ErrMalformed) {
+		t.Errorf("a short message: %v", err)
+	}
+	if _, err := Decode(message(0xB0, 0x01, 0x20)); !errors.Is(err, ErrUnknownMessage) {
+		t.Errorf("OPC_SW_REQ: %v", err)
+	}
+}
+
+func TestLines(t *testing.T) {
+	if got := EncodeSend(LocoSpeed{Slot: 3}); got != "SEND A0 03 00 5C" {
+		t.Errorf("EncodeSend = %q", got)
+	}
+	line, err := ParseLine("RECEIVE 83 7C\r")
+	if err != nil || line.Keyword != "RECEIVE" || !bytes.Equal(line.Message, []byte{0x83, 0x7C}) {
+		t.Errorf("ParseLine = %#v, %v", line, err)
+	}
+	line, err = ParseLine("SENT ERROR invalid checksum")
+	if err != nil || line.Keyword != "SENT" || line.Text != "ERROR invalid checksum" {
+		t.Errorf("ParseLine = %#v, %v", line, err)
+	}
+	if _, err := ParseLine("RECEIVE 83 XY"); !errors.Is(err, ErrMalformed) {
+		t.Errorf("ParseLine of invalid bytes: %v", err)
+	}
+}
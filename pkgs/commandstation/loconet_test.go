@@ -0,0 +1,186 @@
+package commandstation
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/loconet"
+)
+
+// fakeLbServer answers like LbServer in front of a Digitrax command station with a decoder on the programming track
+type fakeLbServer struct {
+	mu       sync.Mutex
+	cvs      map[uint16]byte
+	slots    map[uint16]loconet.SlotData
+	received []loconet.Message
+}
+
+func (f *fakeLbServer) serve(conn io.ReadWriter) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line, err := loconet.ParseLine(scanner.Text())
+		if err != nil || line.Keyword != "SEND" {
+			continue
+		}
+		msg, err := loconet.Decode(line.Message)
+		if err != nil {
+			_, _ = fmt.Fprintf(conn, "SENT ERROR %s\n", err)
+			continue
+		}
+		f.mu.Lock()
+		f.received = append(f.received, msg)
+		// the sent message is received too, like every other one on the bus
+		reply := append([]loconet.Message{msg}, f.answer(msg)...)
+		f.mu.Unlock()
+		if _, err := io.WriteString(conn, "SENT OK\n"); err != nil {
+			return
+		}
+		for _, m := range reply {
+			if _, err := io.WriteString(conn, "RECEIVE"+loconet.EncodeSend(m)[len("SEND"):]+"\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (f *fakeLbServer) slotOf(slot byte) (uint16, loconet.SlotData) {
+	for addr, data := range f.slots {
+		if data.Slot == slot {
+			return addr, data
+		}
+	}
+	return 0, loconet.SlotData{}
+}
+
+func (f *fakeLbServer) answer(msg loconet.Message) []loconet.Message {
+	switch m := msg.(type) {
+	case loconet.LocoAddress:
+		data, ok := f.slots[m.Addr]
+		if !ok {
+			return []loconet.Message{loconet.LongAck{Opcode: loconet.OpcLocoAddress, Ack: loconet.AckRefused}}
+		}
+		return []loconet.Message{data}
+	case loconet.MoveSlots:
+		addr, data := f.slotOf(m.From)
+		data.Status = loconet.SlotInUse
+		f.slots[addr] = data
+		return []loconet.Message{data}
+	case loconet.SlotStatus:
+		addr, data := f.slotOf(m.Slot)
+		data.Status = m.Status
+		f.slots[addr] = data
+	case loconet.ProgrammerTask:
+		if m.Command == loconet.ProgOpsWrite {
+			return []loconet.Message{loconet.LongAck{Opcode: loconet.OpcWriteSlotData, Ack: loconet.AckAcceptedBlind}}
+		}
+		ack := loconet.LongAck{Opcode: loconet.OpcWriteSlotData, Ack: loconet.AckAccepted}
+		result := loconet.ProgrammerResult{ProgrammerTask: m}
+		if m.Command == loconet.ProgDirectWrite {
+			f.cvs[m.CV] = m.Value
+		}
+		value, ok := f.cvs[m.CV]
+		if !ok {
+			result.Status = loconet.ProgNoReadAck
+		}
+		result.Value = value
+		return []loconet.Message{ack, result}
+	}
+	return nil
+}
+
+func (f *fakeLbServer) messages() []loconet.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]loconet.Message(nil), f.received...)
+}
+
+func startFakeLbServer(t *testing.T) (*fakeLbServer, *LocoNet) {
+	t.Helper()
+	client, server := net.Pipe()
+	fake := &fakeLbServer{
+		cvs: map[uint16]byte{1: 3, 29: 6},
+		slots: map[uint16]loconet.SlotData{
+			3: {Slot: 5, Status: loconet.SlotCommon, Steps: 128, Addr: 3, Speed: 42, Forward: true, Functions: 1 << 1},
+		},
+	}
+	go fake.serve(server)
+	t.Cleanup(func() { _ = server.Close() })
+	l := newLocoNet(client, []ctxOptions{RetryDelay(0)})
+	l.Timeout = time.Second
+	return fake, l
+}
+
+func TestLocoNet_CV(t *testing.T) {
+	fake, l := startFakeLbServer(t)
+	defer l.CleanUp()
+
+	if err := l.WriteCV(ProgrammingTrackMode, LocoCV{Cv: CV{Num: 3, Value: 5}}, Verify(true)); err != nil {
+		t.Fatalf("WriteCV: %v", err)
+	}
+	if value, err := l.ReadCV(ProgrammingTrackMode, LocoCV{Cv: CV{Num: 29}}); err != nil || value != 6 {
+		t.Fatalf("ReadCV = %d, %v", value, err)
+	}
+	if _, err := l.ReadCV(ProgrammingTrackMode, LocoCV{Cv: CV{Num: 200}}, Retries(0)); err == nil {
+		t.Fatal("ReadCV of a CV the decoder does not acknowledge succeeded")
+	}
+	if err := l.WriteCV(MainTrackMode, LocoCV{LocoId: 3, Cv: CV{Num: 3, Value: 10}}); err != nil {
+		t.Fatalf("WriteCV on the main track: %v", err)
+	}
+	messages := fake.messages()
+	if task, ok := messages[len(messages)-1].(loconet.ProgrammerTask); !ok || task.Addr != 3 || task.Command != loconet.ProgOpsWrite {
+		t.Fatalf("last message = %#v", messages[len(messages)-1])
+	}
+}
+
+func TestLocoNet_Driving(t *testing.T) {
+	fake, l := startFakeLbServer(t)
+
+	speed, forward, err := l.GetSpeed(3)
+	if err != nil || speed != 42 || !forward {
+		t.Fatalf("GetSpeed = %d %v %v", speed, forward, err)
+	}
+	functions, err := l.ListFunctions(3)
+	if err != nil || len(functions) != 1 || functions[0] != 1 {
+		t.Fatalf("ListFunctions = %v %v", functions, err)
+	}
+	if err := l.SetSpeed(3, 0, false, 128); err != nil {
+		t.Fatalf("SetSpeed: %v", err)
+	}
+	// F1 is kept on when F2 is switched with it
+	if err := l.SendFn(MainTrackMode, 3, 2, FnOn); err != nil {
+		t.Fatalf("SendFn: %v", err)
+	}
+	if err := l.SendFn(MainTrackMode, 3, 9, FnOn); err == nil {
+		t.Fatal("SendFn of F9 succeeded")
+	}
+	if _, _, err := l.GetSpeed(4); err == nil {
+		t.Fatal("GetSpeed of a locomotive without a slot succeeded")
+	}
+	if err := l.CleanUp(); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+
+	var sent []loconet.Message
+	for _, msg := range fake.messages() {
+		switch msg.(type) {
+		case loconet.MoveSlots, loconet.LocoSpeed, loconet.LocoDirF, loconet.SlotStatus:
+			sent = append(sent, msg)
+		}
+	}
+	expected := []loconet.Message{
+		loconet.MoveSlots{From: 5, To: 5},
+		loconet.LocoDirF{Slot: 5, Forward: false, Functions: 1 << 1},
+		loconet.LocoSpeed{Slot: 5, Speed: 0},
+		loconet.LocoDirF{Slot: 5, Forward: true, Functions: 1<<1 | 1<<2},
+		// the slot is given back
+		loconet.SlotStatus{Slot: 5, Status: loconet.SlotCommon, Steps: 128},
+	}
+	if fmt.Sprint(sent) != fmt.Sprint(expected) {
+		t.Fatalf("sent %v; want %v", sent, expected)
+	}
+}
@@ -0,0 +1,258 @@
+package commandstation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: a command station without hardware. Locomotives and their decoders are modelled in memory,
+// optionally persisted to a JSON file, so consecutive CLI commands can see each other's changes.
+//
+
+// MockDecoder is the state of a single decoder in the MockStation
+type MockDecoder struct {
+	CVs       map[CVNum]int `json:"cvs"`
+	Functions uint32        `json:"functions"` // bit N is FN
+	// BinaryStates lists the binary states that are on
+	BinaryStates map[uint16]bool `json:"binaryStates,omitempty"`
+	Speed        uint8           `json:"speed"`
+	Forward      bool            `json:"forward"`
+}
+
+// MockStation implements Station in memory
+type MockStation struct {
+	// Decoders by locomotive address, the programming track reaches the decoder at ProgTrackLoco
+	Decoders      map[LocoAddr]*MockDecoder `json:"decoders"`
+	ProgTrackLoco LocoAddr                  `json:"progTrackLoco"`
+
+	statePath string
+	mu        sync.Mutex
+}
+
+// MockConfig is the configuration of the "mock" station type
+type MockConfig struct {
+	// MockState is the file keeping the state between commands, empty keeps it in memory only
+	MockState string `mapstructure:"mock_state"`
+}
+
+func init() {
+	register("mock", func(config *MockConfig, env Environment) (*MockStation, error) {
+		if err := refuseDryRun("mock", env); err != nil {
+			return nil, err
+		}
+		return NewMockStation(config.MockState)
+	})
+}
+
+// newMockDecoder returns a decoder with factory defaults for the given short address
+func newMockDecoder(addr LocoAddr) *MockDecoder {
+	return &MockDecoder{
+		CVs: map[CVNum]int{
+			1:  int(addr),
+			7:  1,  // version
+			8:  13, // manufacturer: public domain & DIY
+			17: 192,
+			18: 0,
+			29: 6,
+		},
+		Forward: true,
+	}
+}
+
+// NewMockStation creates a station with a single locomotive under address 3, standing on the programming track.
+// When statePath is not empty the state is loaded from that file if it exists, and saved on CleanUp.
+func NewMockStation(statePath string) (*MockStation, error) {
+	m := &MockStation{
+		Decoders:      map[LocoAddr]*MockDecoder{3: newMockDecoder(3)},
+		ProgTrackLoco: 3,
+		statePath:     statePath,
+	}
+	if statePath == "" {
+		return m, nil
+	}
+
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read mock station state: %w", err)
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("cannot parse mock station state %q: %w", statePath, err)
+	}
+	// a state edited by hand may leave out the maps, they are written to later
+	if m.Decoders == nil {
+		m.Decoders = map[LocoAddr]*MockDecoder{}
+	}
+	for addr, d := range m.Decoders {
+		if d == nil {
+			delete(m.Decoders, addr)
+		} else if d.CVs == nil {
+			d.CVs = map[CVNum]int{}
+		}
+	}
+	return m, nil
+}
+
+// decoder selects the decoder reached in the given mode
+func (m *MockStation) decoder(mode Mode, addr LocoAddr) (*MockDecoder, error) {
+	if mode == ProgrammingTrackMode {
+		addr = m.ProgTrackLoco
+	}
+	d, ok := m.Decoders[addr]
+	if !ok {
+		if mode == ProgrammingTrackMode {
+			return nil, errors.New("no locomotive on the programming track")
+		}
+		return nil, fmt.Errorf("no response from decoder %d", addr)
+	}
+	return d, nil
+}
+
+// loco returns the locomotive for driving, locomotives not known yet are added like a throttle would do
+func (m *MockStation) loco(addr LocoAddr) *MockDecoder {
+	d, ok := m.Decoders[addr]
+	if !ok {
+		d = newMockDecoder(addr)
+		m.Decoders[addr] = d
+	}
+	return d
+}
+
+func (m *MockStation) WriteCV(mode Mode, lcv LocoCV, options ...ctxOptions) error {
+	ctx := RequestContext{format: DCCFormat}
+	applyMethodsToCtx(&ctx, options)
+	if ctx.format == MMFormat && mode != ProgrammingTrackMode {
+		return NotSupported(CapabilityMMOnMain, "MM decoders can be programmed only on the programming track")
+	}
+	if lcv.Cv.Value < 0 || lcv.Cv.Value > 255 {
+		return fmt.Errorf("cannot write CV: value %d out of range (0-255)", lcv.Cv.Value)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, err := m.decoder(mode, lcv.LocoId)
+	if err != nil {
+		return fmt.Errorf("cannot write CV: %w", err)
+	}
+	logrus.Debugf("mock: CV%d=%d", lcv.Cv.Num, lcv.Cv.Value)
+	d.CVs[lcv.Cv.Num] = lcv.Cv.Value
+	return nil
+}
+
+func (m *MockStation) ReadCV(mode Mode, lcv LocoCV, options ...ctxOptions) (int, error) {
+	ctx := RequestContext{format: DCCFormat}
+	applyMethodsToCtx(&ctx, options)
+	if ctx.format == MMFormat {
+		return 0, NotSupported(CapabilityMMRead, "MM decoders cannot be read")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, err := m.decoder(mode, lcv.LocoId)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read CV: %w", err)
+	}
+	return d.CVs[lcv.Cv.Num], nil
+}
+
+func (m *MockStation) SendFn(mode Mode, addr LocoAddr, num FuncNum, action FnAction, options ...ctxOptions) error {
+	if mode != MainTrackMode {
+		return NotSupported(CapabilityFnOnProg, fmt.Sprintf("SendFn: unsupported mode %s", mode))
+	}
+	if num < 0 || num > 31 {
+		return fmt.Errorf("SendFn: unsupported function number %d (must be 0-31)", num)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := m.loco(addr)
+	switch action {
+	case FnOn:
+		d.Functions |= 1 << num
+	case FnOff:
+		d.Functions &^= 1 << num
+	case FnToggle:
+		d.Functions ^= 1 << num
+	}
+	return nil
+}
+
+func (m *MockStation) SendBinaryState(addr LocoAddr, state uint16, on bool, options ...ctxOptions) error {
+	if state == 0 || state > 32767 {
+		return fmt.Errorf("SendBinaryState: unsupported binary state %d (must be 1-32767)", state)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := m.loco(addr)
+	if !on {
+		delete(d.BinaryStates, state)
+		return nil
+	}
+	if d.BinaryStates == nil {
+		d.BinaryStates = make(map[uint16]bool)
+	}
+	d.BinaryStates[state] = true
+	return nil
+}
+
+func (m *MockStation) ListFunctions(addr LocoAddr, options ...ctxOptions) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := m.loco(addr)
+
+	var active []int
+	for fn := 0; fn <= 31; fn++ {
+		if d.Functions&(1<<fn) != 0 {
+			active = append(active, fn)
+		}
+	}
+	return active, nil
+}
+
+func (m *MockStation) SetSpeed(addr LocoAddr, speed uint8, forward bool, speedSteps uint8, options ...ctxOptions) error {
+	switch speedSteps {
+	case 14, 28, 128:
+	default:
+		return fmt.Errorf("invalid speed steps: %d (must be 14, 28, or 128)", speedSteps)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := m.loco(addr)
+	d.Speed = speed
+	d.Forward = forward
+	return nil
+}
+
+func (m *MockStation) GetSpeed(addr LocoAddr, options ...ctxOptions) (uint8, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := m.loco(addr)
+	return d.Speed, d.Forward, nil
+}
+
+// CleanUp saves the state, when the station was created with a state file
+func (m *MockStation) CleanUp() error {
+	if m.statePath == "" {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot serialize mock station state: %w", err)
+	}
+	if err := os.WriteFile(m.statePath, data, 0644); err != nil {
+		return fmt.Errorf("cannot save mock station state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package commandstation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMockStation_PartialState(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "mock.json")
+	require.NoError(t, os.WriteFile(statePath, []byte(`{"decoders": {"3": {"functions": 1}, "4": null}, "progTrackLoco": 3}`), 0o644))
+
+	station, err := NewMockStation(statePath)
+	require.NoError(t, err)
+	assert.NoError(t, station.WriteCV(ProgrammingTrackMode, LocoCV{Cv: CV{Num: 1, Value: 5}}))
+	value, err := station.ReadCV(ProgrammingTrackMode, LocoCV{Cv: CV{Num: 1}})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, value)
+	assert.ErrorContains(t, station.WriteCV(MainTrackMode, LocoCV{LocoId: 4, Cv: CV{Num: 1, Value: 5}}), "no response from decoder 4")
+
+	require.NoError(t, os.WriteFile(statePath, []byte(`{"progTrackLoco": 3}`), 0o644))
+	station, err = NewMockStation(statePath)
+	require.NoError(t, err)
+	assert.NoError(t, station.SendFn(MainTrackMode, 3, 1, FnOn))
+}
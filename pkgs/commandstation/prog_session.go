@@ -0,0 +1,62 @@
+package commandstation
+
+import "fmt"
+
+//
+// Context: a batch of operations on the programming track. The command station enters the programming mode
+// with the first operation and stays in it, the main track is powered again once, when the session ends.
+//
+
+// trackPowerRestorer is implemented by stations that switch the main track off in the programming mode
+type trackPowerRestorer interface {
+	restoreTrackPower() error
+}
+
+// ProgSession reads and writes CVs on the programming track until End is called
+type ProgSession struct {
+	station    Station
+	operations int
+	ended      bool
+}
+
+// BeginProgSession starts a session on the station, the programming mode is entered by the first operation
+func BeginProgSession(station Station) *ProgSession {
+	return &ProgSession{station: station}
+}
+
+// ReadCV reads a CV of the decoder on the programming track
+func (s *ProgSession) ReadCV(cv CVNum, options ...ctxOptions) (int, error) {
+	if s.ended {
+		return 0, fmt.Errorf("cannot read cv%d, the programming session has ended", cv)
+	}
+	s.operations++
+	return s.station.ReadCV(ProgrammingTrackMode, LocoCV{Cv: CV{Num: cv}}, options...)
+}
+
+// WriteCV writes a CV of the decoder on the programming track
+func (s *ProgSession) WriteCV(cv CV, options ...ctxOptions) error {
+	if s.ended {
+		return fmt.Errorf("cannot write cv%d, the programming session has ended", cv.Num)
+	}
+	s.operations++
+	return s.station.WriteCV(ProgrammingTrackMode, LocoCV{Cv: cv}, options...)
+}
+
+// Operations is the number of reads and writes done in the session
+func (s *ProgSession) Operations() int {
+	return s.operations
+}
+
+// End leaves the programming mode and restores the track power, calling it again does nothing
+func (s *ProgSession) End() error {
+	if s.ended {
+		return nil
+	}
+	s.ended = true
+	if restorer, ok := s.station.(trackPowerRestorer); ok {
+		if err := restorer.restoreTrackPower(); err != nil {
+			return fmt.Errorf("cannot restore the track power after %d operation(s): %w", s.operations, err)
+		}
+	}
+	return nil
+}
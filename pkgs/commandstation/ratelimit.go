@@ -0,0 +1,56 @@
+package commandstation
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of outgoing commands. Every command takes one token,
+// tokens are refilled at a constant rate up to the burst size.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// replaceable in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// wait blocks until a token is available and takes it
+func (b *tokenBucket) wait() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		missing := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.sleep(missing)
+		b.last = b.last.Add(missing)
+		b.tokens = 1
+	}
+	b.tokens--
+}
@@ -0,0 +1,46 @@
+package commandstation
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	clock := time.Unix(0, 0)
+	var slept time.Duration
+
+	b := newTokenBucket(10, 3)
+	b.now = func() time.Time { return clock }
+	b.sleep = func(d time.Duration) {
+		slept += d
+		clock = clock.Add(d)
+	}
+
+	// burst passes without waiting
+	for i := 0; i < 3; i++ {
+		b.wait()
+	}
+	if slept != 0 {
+		t.Fatalf("burst should not wait, slept %s", slept)
+	}
+
+	// the next command waits for one token (1/10 s)
+	b.wait()
+	if slept != 100*time.Millisecond {
+		t.Fatalf("expected to wait 100ms, slept %s", slept)
+	}
+
+	// after a pause the bucket is refilled, but not above the burst size
+	clock = clock.Add(10 * time.Second)
+	slept = 0
+	for i := 0; i < 3; i++ {
+		b.wait()
+	}
+	if slept != 0 {
+		t.Fatalf("refilled burst should not wait, slept %s", slept)
+	}
+	b.wait()
+	if slept != 100*time.Millisecond {
+		t.Fatalf("expected to wait 100ms after the burst, slept %s", slept)
+	}
+}
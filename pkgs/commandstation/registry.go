@@ -0,0 +1,97 @@
+package commandstation
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+//
+// Context: the command station types that can be configured. Every backend registers itself by the name
+// used as "type" in the configuration, so a new station is added without changes outside of this package.
+//
+
+// Environment is what the application passes to a backend opening a station, next to its configuration
+type Environment struct {
+	// Defaults are applied to every request before the per-request options
+	Defaults []RequestOption
+	// DryRun is set when packets should be passed to it instead of being sent. Nothing may reach the station then,
+	// the backends that cannot simulate refuse to open, see refuseDryRun
+	DryRun func(packet []byte)
+	// SessionLog is a file where the traffic is appended, backends that cannot record ignore it
+	SessionLog string
+}
+
+// Backend opens a command station of a single type
+type Backend struct {
+	// Config returns a pointer to a new configuration of the backend, filled from the station profile
+	// before it is passed to Open. The fields are decoded like the rest of the configuration file.
+	Config func() any
+	// Open connects to the station, config is the value returned by Config. A backend that cannot simulate
+	// returns an ErrNotSupported of CapabilityDryRun when the environment asks for a dry-run.
+	Open func(config any, env Environment) (Station, error)
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]Backend{}
+)
+
+// Register makes a backend available under the given type name.
+// It is meant to be called from init(), registering the same name twice panics.
+func Register(name string, backend Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if _, ok := backends[name]; ok {
+		panic(fmt.Sprintf("command station type '%s' is already registered", name))
+	}
+	backends[name] = backend
+}
+
+// Lookup returns the backend registered under the given type name
+func Lookup(name string) (Backend, bool) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	backend, ok := backends[name]
+	return backend, ok
+}
+
+// Backends returns the registered type names, sorted
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// refuseDryRun is the error of a backend that cannot simulate when a dry-run is asked for, a dry-run
+// must never reach a real station
+func refuseDryRun(name string, env Environment) error {
+	if env.DryRun == nil {
+		return nil
+	}
+	return NotSupported(CapabilityDryRun, fmt.Sprintf("the command station type '%s' cannot simulate the commands, they would be sent", name))
+}
+
+// register registers a backend of this package, with a configuration of type C
+func register[C any, S Station](name string, open func(config *C, env Environment) (S, error)) {
+	Register(name, Backend{
+		Config: func() any { return new(C) },
+		Open: func(config any, env Environment) (Station, error) {
+			typed, ok := config.(*C)
+			if !ok {
+				return nil, fmt.Errorf("unexpected configuration %T of command station type '%s', %T was expected", config, name, typed)
+			}
+			station, err := open(typed, env)
+			if err != nil {
+				// not a typed nil wrapped in the interface
+				return nil, err
+			}
+			return station, nil
+		},
+	})
+}
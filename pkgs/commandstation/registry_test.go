@@ -0,0 +1,66 @@
+package commandstation
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_BuiltinBackends(t *testing.T) {
+	assert.Subset(t, Backends(), []string{"dccex-serial", "dccex-tcp", "loconet-tcp", "mock", "withrottle", "xpressnet-serial", "z21"})
+}
+
+func TestRegistry_Open(t *testing.T) {
+	backend, ok := Lookup("mock")
+	require.True(t, ok)
+	config := backend.Config()
+	assert.IsType(t, &MockConfig{}, config)
+
+	station, err := backend.Open(config, Environment{})
+	require.NoError(t, err)
+	assert.IsType(t, &MockStation{}, station)
+
+	_, err = backend.Open(&Z21Config{}, Environment{})
+	assert.ErrorContains(t, err, "unexpected configuration")
+}
+
+func TestRegistry_FailedOpenIsNil(t *testing.T) {
+	register("test-failing", func(config *MockConfig, env Environment) (*MockStation, error) {
+		return nil, errors.New("unreachable")
+	})
+	backend, _ := Lookup("test-failing")
+	station, err := backend.Open(backend.Config(), Environment{})
+	assert.Error(t, err)
+	assert.Nil(t, station)
+
+	assert.Panics(t, func() { Register("test-failing", backend) })
+}
+
+func TestRegistry_DryRunRefused(t *testing.T) {
+	// every backend except z21 would send the commands
+	for _, name := range Backends() {
+		if name == "z21" || name == "test-failing" {
+			continue
+		}
+		backend, _ := Lookup(name)
+		// the address is never opened, a dry-run fails before
+		station, err := backend.Open(backend.Config(), Environment{DryRun: func(packet []byte) {}})
+		var notSupported *ErrNotSupported
+		if assert.ErrorAs(t, err, &notSupported, name) {
+			assert.Equal(t, CapabilityDryRun, notSupported.Capability, name)
+		}
+		assert.Nil(t, station, name)
+	}
+}
+
+func TestRegistry_Z21DryRun(t *testing.T) {
+	var packets [][]byte
+	backend, _ := Lookup("z21")
+	station, err := backend.Open(backend.Config(), Environment{DryRun: func(packet []byte) { packets = append(packets, packet) }})
+	require.NoError(t, err)
+	require.IsType(t, &Z21Roco{}, station)
+	require.NoError(t, station.SendFn(MainTrackMode, 3, 5, FnOn))
+	assert.NotEmpty(t, packets)
+}
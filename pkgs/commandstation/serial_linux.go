@@ -0,0 +1,69 @@
+//go:build linux
+
+package commandstation
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// cbaud masks the baud rate bits of Cflag, the syscall package does not export CBAUD
+const cbaud = 0x100f
+
+var baudRates = map[int]uint32{
+	9600:   syscall.B9600,
+	19200:  syscall.B19200,
+	38400:  syscall.B38400,
+	57600:  syscall.B57600,
+	115200: syscall.B115200,
+	230400: syscall.B230400,
+}
+
+// openSerial opens the device in raw mode, 8 data bits without parity, at the given baud rate
+func openSerial(device string, baud int) (*os.File, error) {
+	speed, ok := baudRates[baud]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate %d", baud)
+	}
+	port, err := os.OpenFile(device, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	// the raw connection keeps the file in non-blocking mode, so Close interrupts a pending Read
+	raw, err := port.SyscallConn()
+	if err != nil {
+		_ = port.Close()
+		return nil, err
+	}
+	var ioctlErr error
+	if err := raw.Control(func(fd uintptr) {
+		var t syscall.Termios
+		if ioctlErr = termios(fd, syscall.TCGETS, &t); ioctlErr != nil {
+			return
+		}
+		t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+		t.Oflag &^= syscall.OPOST
+		t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+		t.Cflag &^= syscall.CSIZE | syscall.PARENB | cbaud
+		t.Cflag |= syscall.CS8 | syscall.CREAD | syscall.CLOCAL | speed
+		t.Ispeed, t.Ospeed = speed, speed
+		t.Cc[syscall.VMIN], t.Cc[syscall.VTIME] = 1, 0
+		ioctlErr = termios(fd, syscall.TCSETS, &t)
+	}); err != nil {
+		ioctlErr = err
+	}
+	if ioctlErr != nil {
+		_ = port.Close()
+		return nil, fmt.Errorf("cannot configure the serial port: %w", ioctlErr)
+	}
+	return port, nil
+}
+
+func termios(fd uintptr, request uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package commandstation
+
+import (
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// openSerial opens the device as it is configured by the system, the baud rate is set up only on Linux
+func openSerial(device string, baud int) (*os.File, error) {
+	logrus.Warnf("the serial port %s is used as configured by the system, set it to %d baud in raw mode with stty", device, baud)
+	return os.OpenFile(device, os.O_RDWR, 0)
+}
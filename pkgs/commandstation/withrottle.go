@@ -0,0 +1,426 @@
+package commandstation
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/withrottle"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: an existing WiThrottle server on the network, e.g. JMRI or EX-CommandStation, which keeps talking
+// to the command station itself. loco acts as one more throttle: locomotives are acquired, driven and released
+// without knowing what hardware is behind. The protocol has no CV programming.
+//
+
+// WiThrottleFunctionMax is the highest function number of a WiThrottle locomotive
+const WiThrottleFunctionMax = 68
+
+const (
+	// wiThrottleDialTimeout is how long connecting to the server may take
+	wiThrottleDialTimeout = 5 * time.Second
+	// wiThrottleName is the throttle of the multi throttle messages
+	wiThrottleName byte = 'T'
+)
+
+// errWiThrottleClosed is returned to the waiting requests when the connection is closed
+var errWiThrottleClosed = errors.New("the connection to the WiThrottle server was closed")
+
+// WiThrottleConfig is the configuration of the "withrottle" station type
+type WiThrottleConfig struct {
+	Address string
+	Port    uint16
+}
+
+func init() {
+	register("withrottle", func(config *WiThrottleConfig, env Environment) (*WiThrottle, error) {
+		if err := refuseDryRun("withrottle", env); err != nil {
+			return nil, err
+		}
+		return NewWiThrottleTCP(config.Address, config.Port, env.Defaults...)
+	})
+}
+
+// NewWiThrottleTCP connects to a WiThrottle server, port 0 is the default 12090
+func NewWiThrottleTCP(address string, port uint16, defaults ...ctxOptions) (*WiThrottle, error) {
+	if port == 0 {
+		port = withrottle.DefaultTCPPort
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, strconv.Itoa(int(port))), wiThrottleDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("TCP dial error while connecting to WiThrottle: %w", err)
+	}
+	w := newWiThrottle(conn, defaults)
+	hostname, _ := os.Hostname()
+	for _, cmd := range []withrottle.Command{withrottle.Name{Name: "loco"}, withrottle.HardwareID{ID: "loco-" + hostname}} {
+		if err := w.write(cmd); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func newWiThrottle(conn io.ReadWriteCloser, defaults []ctxOptions) *WiThrottle {
+	w := &WiThrottle{
+		conn:     conn,
+		Timeout:  time.Second * 10,
+		defaults: defaults,
+		replies:  make(chan withrottle.Reply, 64),
+		closed:   make(chan struct{}),
+		locos:    map[string]*wiThrottleLoco{},
+	}
+	go w.readReplies(conn)
+	return w
+}
+
+// WiThrottle implements Station as a throttle of a WiThrottle server
+type WiThrottle struct {
+	conn     io.ReadWriteCloser
+	Timeout  time.Duration
+	defaults []ctxOptions
+	// replies are read from conn, the state of the acquired locomotives included
+	replies chan withrottle.Reply
+	closed  chan struct{}
+	// mu serializes the requests, so every one of them sees only the replies to itself
+	mu sync.Mutex
+	// writeMu keeps the heartbeats from interleaving with the requests
+	writeMu   sync.Mutex
+	heartbeat sync.Once
+	// stateMu guards locos, which are updated by readReplies
+	stateMu sync.Mutex
+	locos   map[string]*wiThrottleLoco
+}
+
+// wiThrottleLoco is the last state the server reported for an acquired locomotive
+type wiThrottleLoco struct {
+	addr LocoAddr
+	// speed is 0-126, -1 for an emergency stop
+	speed     int
+	forward   bool
+	functions map[int]bool
+}
+
+// readReplies parses the lines from conn until it is closed and keeps the state of the acquired locomotives
+func (w *WiThrottle) readReplies(conn io.Reader) {
+	defer close(w.closed)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		reply, err := withrottle.Parse(scanner.Text())
+		if err != nil {
+			logrus.Debugf("withrottle: %s", err)
+			continue
+		}
+		logrus.Debugf("withrottle: res %s", reply.Line)
+		if interval, ok := reply.Heartbeat(); ok {
+			w.heartbeat.Do(func() { go w.sendHeartbeats(interval) })
+		}
+		w.remember(reply)
+		select {
+		case w.replies <- reply:
+		default:
+			logrus.Debugf("withrottle: nobody waits, dropping %q", reply.Line)
+		}
+	}
+}
+
+// remember updates the state of an acquired locomotive from a message of the server
+func (w *WiThrottle) remember(reply withrottle.Reply) {
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+	loco, ok := w.locos[reply.Key]
+	if !ok {
+		return
+	}
+	if speed, ok := reply.Speed(); ok {
+		loco.speed = speed
+	}
+	if forward, ok := reply.Direction(); ok {
+		loco.forward = forward
+	}
+	if fn, on, ok := reply.Function(); ok {
+		loco.functions[fn] = on
+	}
+}
+
+// sendHeartbeats keeps the server from stopping the locomotives, it expects a heartbeat within the interval
+func (w *WiThrottle) sendHeartbeats(interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.write(withrottle.Heartbeat{}); err != nil {
+				return
+			}
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+// newRequestContext builds the context from built-in defaults, station defaults and request options, in this order
+func (w *WiThrottle) newRequestContext(options []ctxOptions) RequestContext {
+	ctx := RequestContext{
+		timeout:        w.Timeout,
+		retries:        2,
+		retryDelay:     200 * time.Millisecond,
+		settle:         200 * time.Millisecond,
+		format:         DCCFormat,
+		repeatInterval: 50 * time.Millisecond,
+	}
+	applyMethodsToCtx(&ctx, w.defaults)
+	applyMethodsToCtx(&ctx, options)
+	return ctx
+}
+
+func (w *WiThrottle) write(cmd withrottle.Command) error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	logrus.Debugf("withrottle: req %s", cmd.Encode())
+	if _, err := io.WriteString(w.conn, cmd.Encode()+"\n"); err != nil {
+		return fmt.Errorf("cannot send to the WiThrottle server: %w", err)
+	}
+	return nil
+}
+
+// request sends the command and waits for the first reply accepted by match, other messages are skipped
+func (w *WiThrottle) request(cmd withrottle.Command, timeout time.Duration, match func(withrottle.Reply) bool) (withrottle.Reply, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for drained := false; !drained; {
+		select {
+		case <-w.replies:
+		default:
+			drained = true
+		}
+	}
+	if err := w.write(cmd); err != nil {
+		return withrottle.Reply{}, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case reply := <-w.replies:
+			if match(reply) {
+				return reply, nil
+			}
+		case <-w.closed:
+			return withrottle.Reply{}, errWiThrottleClosed
+		case <-timer.C:
+			return withrottle.Reply{}, errResponseTimeout
+		}
+	}
+}
+
+// sendRepeated sends a driving command and then repeats it as requested, see Repeat
+func (w *WiThrottle) sendRepeated(cmd withrottle.Command, ctx RequestContext) error {
+	if err := w.write(cmd); err != nil {
+		return err
+	}
+	for i := 0; i < int(ctx.repeat); i++ {
+		time.Sleep(ctx.repeatInterval)
+		if err := w.write(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// acquire adds the locomotive to the throttle, unless it is there already
+func (w *WiThrottle) acquire(addr LocoAddr, ctx RequestContext) error {
+	key := withrottle.LocoKey(uint16(addr))
+	w.stateMu.Lock()
+	_, acquired := w.locos[key]
+	if !acquired {
+		// the state sent right after the acquisition is remembered
+		w.locos[key] = &wiThrottleLoco{addr: addr, forward: true, functions: map[int]bool{}}
+	}
+	w.stateMu.Unlock()
+	if acquired {
+		return nil
+	}
+
+	reply, err := w.request(withrottle.Acquire{Throttle: wiThrottleName, Addr: uint16(addr)}, ctx.timeout, func(reply withrottle.Reply) bool {
+		return reply.Throttle == wiThrottleName && reply.Key == key && (reply.Action == withrottle.ActionAdd || reply.Action == withrottle.ActionSteal)
+	})
+	if err == nil && reply.Action != withrottle.ActionAdd {
+		err = errors.New("it is driven by another throttle")
+	}
+	if err != nil {
+		w.stateMu.Lock()
+		delete(w.locos, key)
+		w.stateMu.Unlock()
+		return fmt.Errorf("cannot acquire locomotive %d: %w", addr, err)
+	}
+	return nil
+}
+
+// locoState acquires the locomotive and asks for its speed and direction. The functions are those sent by the server
+// after the acquisition, the answers arrive after them.
+func (w *WiThrottle) locoState(addr LocoAddr, ctx RequestContext) (wiThrottleLoco, error) {
+	if err := w.acquire(addr, ctx); err != nil {
+		return wiThrottleLoco{}, err
+	}
+	key := withrottle.LocoKey(uint16(addr))
+	queries := []struct {
+		what  byte
+		match func(withrottle.Reply) bool
+	}{
+		{'V', func(reply withrottle.Reply) bool { _, ok := reply.Speed(); return ok && reply.Key == key }},
+		{'R', func(reply withrottle.Reply) bool { _, ok := reply.Direction(); return ok && reply.Key == key }},
+	}
+	for _, query := range queries {
+		if _, err := w.request(throttleAction(addr, withrottle.Query(query.what)), ctx.timeout, query.match); err != nil {
+			return wiThrottleLoco{}, fmt.Errorf("cannot read the state of locomotive %d: %w", addr, err)
+		}
+	}
+
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+	state := *w.locos[key]
+	state.functions = make(map[int]bool, len(w.locos[key].functions))
+	for fn, on := range w.locos[key].functions {
+		state.functions[fn] = on
+	}
+	return state, nil
+}
+
+// throttleAction is a command for a locomotive of the throttle
+func throttleAction(addr LocoAddr, command string) withrottle.Command {
+	return withrottle.Action{Throttle: wiThrottleName, Addr: uint16(addr), Command: command}
+}
+
+func (w *WiThrottle) WriteCV(mode Mode, lcv LocoCV, options ...ctxOptions) error {
+	return NotSupported(CapabilityCVProgramming, "WiThrottle has no CV programming")
+}
+
+func (w *WiThrottle) ReadCV(mode Mode, lcv LocoCV, options ...ctxOptions) (int, error) {
+	return 0, NotSupported(CapabilityCVProgramming, "WiThrottle has no CV programming")
+}
+
+// SendFn switches a function. On and off are forced, so they work for momentary functions too;
+// a toggle is a press of the throttle button.
+func (w *WiThrottle) SendFn(mode Mode, addr LocoAddr, num FuncNum, action FnAction, options ...ctxOptions) error {
+	if mode != MainTrackMode {
+		return NotSupported(CapabilityFnOnProg, fmt.Sprintf("SendFn: unsupported mode %s", mode))
+	}
+	fn := int(num)
+	if fn < 0 || fn > WiThrottleFunctionMax {
+		return fmt.Errorf("SendFn: unsupported function number %d (must be 0-%d)", num, WiThrottleFunctionMax)
+	}
+	ctx := w.newRequestContext(options)
+	if err := w.acquire(addr, ctx); err != nil {
+		return fmt.Errorf("SendFn: %w", err)
+	}
+	switch action {
+	case FnOn, FnOff:
+		if err := w.sendRepeated(throttleAction(addr, withrottle.ForceFunction(fn, action == FnOn)), ctx); err != nil {
+			return fmt.Errorf("SendFn: cannot write function command: %w", err)
+		}
+	case FnToggle:
+		for _, pressed := range []bool{true, false} {
+			if err := w.write(throttleAction(addr, withrottle.PressFunction(fn, pressed))); err != nil {
+				return fmt.Errorf("SendFn: cannot write function command: %w", err)
+			}
+		}
+	default:
+		return fmt.Errorf("SendFn: unsupported function action %d", action)
+	}
+	return nil
+}
+
+func (w *WiThrottle) SendBinaryState(addr LocoAddr, state uint16, on bool, options ...ctxOptions) error {
+	return NotSupported(CapabilityBinaryState, "binary states are not sent over WiThrottle")
+}
+
+func (w *WiThrottle) ListFunctions(addr LocoAddr, options ...ctxOptions) ([]int, error) {
+	state, err := w.locoState(addr, w.newRequestContext(options))
+	if err != nil {
+		return nil, err
+	}
+	var active []int
+	for fn, on := range state.functions {
+		if on {
+			active = append(active, fn)
+		}
+	}
+	sort.Ints(active)
+	return active, nil
+}
+
+// SetSpeed sets the speed and direction of a locomotive, the speed has the meaning of Z21Roco.SetSpeed
+func (w *WiThrottle) SetSpeed(addr LocoAddr, speed uint8, forward bool, speedSteps uint8, options ...ctxOptions) error {
+	var steps int
+	switch speedSteps {
+	case 14:
+		steps = scaleSpeed(speed, 1, 14)
+	case 28:
+		steps = scaleSpeed(speed, 0, 28)
+	case 128:
+		steps = scaleSpeed(speed, 1, 126)
+	default:
+		return fmt.Errorf("invalid speed steps: %d (must be 14, 28, or 128)", speedSteps)
+	}
+	ctx := w.newRequestContext(options)
+	if err := w.acquire(addr, ctx); err != nil {
+		return fmt.Errorf("SetSpeed: %w", err)
+	}
+	if err := w.write(throttleAction(addr, withrottle.SetDirection(forward))); err != nil {
+		return fmt.Errorf("SetSpeed: cannot write direction command: %w", err)
+	}
+	command := withrottle.SetSpeed(steps)
+	if steps < 0 {
+		command = withrottle.EmergencyStop()
+	}
+	if err := w.sendRepeated(throttleAction(addr, command), ctx); err != nil {
+		return fmt.Errorf("SetSpeed: cannot write speed command: %w", err)
+	}
+	return nil
+}
+
+// GetSpeed asks the server for the speed and direction of a locomotive, converted to 128 steps.
+// Returns: speed (0-127 as in 128 steps), forward (true for forward, false for reverse), error
+func (w *WiThrottle) GetSpeed(addr LocoAddr, options ...ctxOptions) (uint8, bool, error) {
+	state, err := w.locoState(addr, w.newRequestContext(options))
+	if err != nil {
+		return 0, false, err
+	}
+	switch {
+	case state.speed < 0:
+		return 1, state.forward, nil
+	case state.speed == 0:
+		return 0, state.forward, nil
+	}
+	return uint8(state.speed + 1), state.forward, nil
+}
+
+// CleanUp releases the acquired locomotives, they keep running, and disconnects
+func (w *WiThrottle) CleanUp() error {
+	w.stateMu.Lock()
+	locos := make([]LocoAddr, 0, len(w.locos))
+	for _, loco := range w.locos {
+		locos = append(locos, loco.addr)
+	}
+	w.locos = map[string]*wiThrottleLoco{}
+	w.stateMu.Unlock()
+	for _, addr := range locos {
+		if err := w.write(withrottle.Release{Throttle: wiThrottleName, Addr: uint16(addr)}); err != nil {
+			logrus.Errorf("cannot release locomotive %d: %s", addr, err)
+		}
+	}
+	if err := w.write(withrottle.Quit{}); err != nil {
+		logrus.Debugf("withrottle: %s", err)
+	}
+	return w.conn.Close()
+}
@@ -0,0 +1,237 @@
+// Package withrottle is a codec for the WiThrottle protocol of JMRI, also served by EX-CommandStation.
+//
+// Every message is a line of text. The locomotives are driven through a multi throttle, named by a single character:
+//
+//	MT+S3<;>S3    client → server, acquire locomotive 3 on throttle T ("S" short, "L" long address)
+//	MTAS3<;>V50   client → server, set its speed to 50 (0-126)
+//	MTAS3<;>F10   server → client, function 0 is on ("F" state function)
+//	MT-S3<;>r     client → server, release it, it keeps running
+//
+// The server sends the state of a locomotive after it is acquired and whenever it changes.
+// The protocol has no CV programming.
+package withrottle
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTCPPort is the port of the WiThrottle server of JMRI and EX-CommandStation
+const DefaultTCPPort = 12090
+
+// ErrMalformed is returned by Parse for a multi throttle message without its separator
+var ErrMalformed = errors.New("malformed WiThrottle message")
+
+// Separator divides the locomotive of a multi throttle message from its command
+const Separator = "<;>"
+
+// Throttle actions
+const (
+	ActionAdd     byte = '+'
+	ActionRemove  byte = '-'
+	ActionCommand byte = 'A'
+	ActionLabels  byte = 'L'
+	// ActionSteal is the answer to Acquire when the locomotive is in use by another throttle
+	ActionSteal byte = 'S'
+)
+
+// Command is a single line sent to the server
+type Command interface {
+	// Encode returns the line without the line end
+	Encode() string
+}
+
+// LocoKey returns how a locomotive is named in the multi throttle messages, e.g. "S3" or "L1234".
+// Addresses above 127 are long ones.
+func LocoKey(addr uint16) string {
+	if addr > 127 {
+		return fmt.Sprintf("L%d", addr)
+	}
+	return fmt.Sprintf("S%d", addr)
+}
+
+// Name is "N<name>", the name of the device shown by the server
+type Name struct {
+	Name string
+}
+
+func (m Name) Encode() string {
+	return "N" + m.Name
+}
+
+// HardwareID is "HU<id>", the identifier the server uses to recognize a device that reconnects
+type HardwareID struct {
+	ID string
+}
+
+func (m HardwareID) Encode() string {
+	return "HU" + m.ID
+}
+
+// Heartbeat is "*", it has to be sent within the interval announced by the server, see Reply.Heartbeat
+type Heartbeat struct{}
+
+func (m Heartbeat) Encode() string {
+	return "*"
+}
+
+// Quit is "Q", disconnecting from the server
+type Quit struct{}
+
+func (m Quit) Encode() string {
+	return "Q"
+}
+
+// Acquire is "MT+<key><;><key>", adding a locomotive to a throttle
+type Acquire struct {
+	Throttle byte
+	Addr     uint16
+}
+
+func (m Acquire) Encode() string {
+	key := LocoKey(m.Addr)
+	return "M" + string(m.Throttle) + string(ActionAdd) + key + Separator + key
+}
+
+// Release is "MT-<key><;>r", removing a locomotive from a throttle, it keeps running
+type Release struct {
+	Throttle byte
+	Addr     uint16
+}
+
+func (m Release) Encode() string {
+	return "M" + string(m.Throttle) + string(ActionRemove) + LocoKey(m.Addr) + Separator + "r"
+}
+
+// Action is "MTA<key><;><command>", a command for a locomotive of a throttle, e.g. "V50".
+// See the constructors below.
+type Action struct {
+	Throttle byte
+	Addr     uint16
+	Command  string
+}
+
+func (m Action) Encode() string {
+	return "M" + string(m.Throttle) + string(ActionCommand) + LocoKey(m.Addr) + Separator + m.Command
+}
+
+// SetSpeed is the command "V<speed>", 0-126
+func SetSpeed(speed int) string {
+	return "V" + strconv.Itoa(speed)
+}
+
+// EmergencyStop is the command "X"
+func EmergencyStop() string {
+	return "X"
+}
+
+// SetDirection is the command "R1" for forward or "R0" for reverse
+func SetDirection(forward bool) string {
+	if forward {
+		return "R1"
+	}
+	return "R0"
+}
+
+// PressFunction is the command "F1<fn>" when pressed and "F0<fn>" when released.
+// Like a throttle button, a press toggles a latching function.
+func PressFunction(fn int, pressed bool) string {
+	return "F" + boolDigit(pressed) + strconv.Itoa(fn)
+}
+
+// ForceFunction is the command "f<state><fn>", switching a function regardless of it being latching or momentary
+func ForceFunction(fn int, on bool) string {
+	return "f" + boolDigit(on) + strconv.Itoa(fn)
+}
+
+// Query is the command "q<what>", answered with the current value, e.g. "qV" with "V50"
+func Query(what byte) string {
+	return "q" + string(what)
+}
+
+func boolDigit(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// Reply is a single line received from the server
+type Reply struct {
+	// Line is the whole message
+	Line string
+	// Throttle, Action, Key and Payload are set for the multi throttle messages
+	Throttle byte
+	Action   byte
+	Key      string
+	Payload  string
+}
+
+// Parse parses a single line. Multi throttle messages are split into their parts, the others are kept as the Line.
+func Parse(line string) (Reply, error) {
+	line = strings.TrimRight(line, "\r\n")
+	reply := Reply{Line: line}
+	if len(line) < 3 || line[0] != 'M' {
+		return reply, nil
+	}
+	rest := line[3:]
+	separator := strings.Index(rest, Separator)
+	if separator < 0 {
+		return Reply{}, fmt.Errorf("%w: %q", ErrMalformed, line)
+	}
+	reply.Throttle, reply.Action = line[1], line[2]
+	reply.Key, reply.Payload = rest[:separator], rest[separator+len(Separator):]
+	return reply, nil
+}
+
+// Heartbeat returns the interval announced with "*<seconds>", within which the client has to send a Heartbeat
+func (r Reply) Heartbeat() (time.Duration, bool) {
+	if !strings.HasPrefix(r.Line, "*") {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(r.Line[1:])
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// Version returns the protocol version announced with "VN<version>", e.g. "2.0"
+func (r Reply) Version() (string, bool) {
+	if !strings.HasPrefix(r.Line, "VN") {
+		return "", false
+	}
+	return r.Line[2:], true
+}
+
+// Speed decodes the payload "V<speed>" of a command message, -1 is an emergency stop
+func (r Reply) Speed() (int, bool) {
+	if r.Action != ActionCommand || !strings.HasPrefix(r.Payload, "V") {
+		return 0, false
+	}
+	speed, err := strconv.Atoi(r.Payload[1:])
+	return speed, err == nil
+}
+
+// Direction decodes the payload "R<direction>" of a command message
+func (r Reply) Direction() (forward bool, ok bool) {
+	if r.Action != ActionCommand || (r.Payload != "R0" && r.Payload != "R1") {
+		return false, false
+	}
+	return r.Payload == "R1", true
+}
+
+// Function decodes the payload "F<state><fn>" of a command message
+func (r Reply) Function() (fn int, on bool, ok bool) {
+	if r.Action != ActionCommand || len(r.Payload) < 3 || r.Payload[0] != 'F' || (r.Payload[1] != '0' && r.Payload[1] != '1') {
+		return 0, false, false
+	}
+	fn, err := strconv.Atoi(r.Payload[2:])
+	if err != nil {
+		return 0, false, false
+	}
+	return fn, r.Payload[1] == '1', true
+}
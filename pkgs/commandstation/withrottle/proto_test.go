@@ -0,0 +1,58 @@
+package withrottle
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEncode(t *testing.T) {
+	cases := []struct {
+		cmd      Command
+		expected string
+	}{
+		{Name{Name: "loco"}, "Nloco"},
+		{Acquire{Throttle: 'T', Addr: 3}, "MT+S3<;>S3"},
+		{Acquire{Throttle: 'T', Addr: 1234}, "MT+L1234<;>L1234"},
+		{Release{Throttle: 'T', Addr: 3}, "MT-S3<;>r"},
+		{Action{Throttle: 'T', Addr: 3, Command: SetSpeed(50)}, "MTAS3<;>V50"},
+		{Action{Throttle: 'T', Addr: 3, Command: SetDirection(false)}, "MTAS3<;>R0"},
+		{Action{Throttle: 'T', Addr: 3, Command: ForceFunction(12, true)}, "MTAS3<;>f112"},
+		{Action{Throttle: 'T', Addr: 3, Command: PressFunction(0, false)}, "MTAS3<;>F00"},
+		{Action{Throttle: 'T', Addr: 3, Command: Query('V')}, "MTAS3<;>qV"},
+	}
+	for _, c := range cases {
+		if got := c.cmd.Encode(); got != c.expected {
+			t.Errorf("Encode(%T) = %q; want %q", c.cmd, got, c.expected)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	reply, err := Parse("MTAL1234<;>F112\r\n")
+	if err != nil || reply.Throttle != 'T' || reply.Action != ActionCommand || reply.Key != "L1234" {
+		t.Fatalf("Parse = %#v, %v", reply, err)
+	}
+	if fn, on, ok := reply.Function(); !ok || fn != 12 || !on {
+		t.Errorf("Function = %d %v %v", fn, on, ok)
+	}
+	reply, _ = Parse("MTAS3<;>V-1")
+	if speed, ok := reply.Speed(); !ok || speed != -1 {
+		t.Errorf("Speed = %d %v", speed, ok)
+	}
+	reply, _ = Parse("MTAS3<;>R0")
+	if forward, ok := reply.Direction(); !ok || forward {
+		t.Errorf("Direction = %v %v", forward, ok)
+	}
+	reply, _ = Parse("*10")
+	if interval, ok := reply.Heartbeat(); !ok || interval != 10*time.Second {
+		t.Errorf("Heartbeat = %s %v", interval, ok)
+	}
+	reply, _ = Parse("VN2.0")
+	if version, ok := reply.Version(); !ok || version != "2.0" {
+		t.Errorf("Version = %q %v", version, ok)
+	}
+	if _, err := Parse("MTAS3"); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Parse without the separator: %v", err)
+	}
+}
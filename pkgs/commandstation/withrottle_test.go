@@ -0,0 +1,117 @@
+package commandstation
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWiThrottle answers like the WiThrottle server of JMRI, locomotive 4 is driven by another throttle
+type fakeWiThrottle struct {
+	mu       sync.Mutex
+	received []string
+}
+
+func (f *fakeWiThrottle) serve(conn io.ReadWriter) {
+	_, _ = io.WriteString(conn, "VN2.0\n*10\n")
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		f.mu.Lock()
+		f.received = append(f.received, line)
+		f.mu.Unlock()
+		var answer []string
+		switch line {
+		case "MT+S3<;>S3":
+			answer = []string{"MT+S3<;>", "MTLS3<;>]\\[Headlight]\\[Bell", "MTAS3<;>F10", "MTAS3<;>F01", "MTAS3<;>F16", "MTAS3<;>V0", "MTAS3<;>R1"}
+		case "MT+S4<;>S4":
+			answer = []string{"MTSS4<;>S4"}
+		case "MTAS3<;>qV":
+			answer = []string{"MTAS3<;>V42"}
+		case "MTAS3<;>qR":
+			answer = []string{"MTAS3<;>R0"}
+		}
+		for _, a := range answer {
+			if _, err := io.WriteString(conn, a+"\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// waitFor polls until the server has received the lines, the commands without an answer are not awaited by the station
+func (f *fakeWiThrottle) waitFor(t *testing.T, expected ...string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		f.mu.Lock()
+		got := strings.Join(f.received, "\n")
+		f.mu.Unlock()
+		if strings.Contains(got, strings.Join(expected, "\n")) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("received:\n%s\nwant:\n%s", got, strings.Join(expected, "\n"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func startFakeWiThrottle(t *testing.T) (*fakeWiThrottle, *WiThrottle) {
+	t.Helper()
+	client, server := net.Pipe()
+	fake := &fakeWiThrottle{}
+	go fake.serve(server)
+	t.Cleanup(func() { _ = server.Close() })
+	w := newWiThrottle(client, []ctxOptions{RetryDelay(0)})
+	w.Timeout = time.Second
+	return fake, w
+}
+
+func TestWiThrottle_Driving(t *testing.T) {
+	fake, w := startFakeWiThrottle(t)
+
+	speed, forward, err := w.GetSpeed(3)
+	if err != nil || speed != 43 || forward {
+		t.Fatalf("GetSpeed = %d %v %v", speed, forward, err)
+	}
+	functions, err := w.ListFunctions(3)
+	if err != nil || fmt.Sprint(functions) != "[0 6]" {
+		t.Fatalf("ListFunctions = %v %v", functions, err)
+	}
+	if err := w.SetSpeed(3, 1, true, 128); err != nil {
+		t.Fatalf("SetSpeed: %v", err)
+	}
+	if err := w.SendFn(MainTrackMode, 3, 2, FnOn); err != nil {
+		t.Fatalf("SendFn: %v", err)
+	}
+	if err := w.SendFn(MainTrackMode, 3, 1, FnToggle); err != nil {
+		t.Fatalf("SendFn toggle: %v", err)
+	}
+	if _, _, err := w.GetSpeed(4); err == nil || !strings.Contains(err.Error(), "another throttle") {
+		t.Fatalf("GetSpeed of a stolen locomotive = %v", err)
+	}
+	if err := w.CleanUp(); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+	fake.waitFor(t, "MTAS3<;>R1", "MTAS3<;>X", "MTAS3<;>f12", "MTAS3<;>F11", "MTAS3<;>F01", "MT+S4<;>S4", "MT-S3<;>r", "Q")
+}
+
+func TestWiThrottle_CV(t *testing.T) {
+	_, w := startFakeWiThrottle(t)
+	defer w.CleanUp()
+
+	var notSupported *ErrNotSupported
+	if _, err := w.ReadCV(ProgrammingTrackMode, LocoCV{Cv: CV{Num: 1}}); !errors.As(err, &notSupported) {
+		t.Fatalf("ReadCV = %v", err)
+	}
+	if err := w.WriteCV(MainTrackMode, LocoCV{LocoId: 3, Cv: CV{Num: 1, Value: 3}}); !errors.As(err, &notSupported) {
+		t.Fatalf("WriteCV = %v", err)
+	}
+}
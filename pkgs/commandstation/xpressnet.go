@@ -0,0 +1,422 @@
+package commandstation
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/xpressnet"
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: Lenz command stations reached through a PC interface (LI-USB, LI101F, GenLi) on a serial port.
+// XpressNet is the X-BUS of the Z21, so the Z21 messages are sent without the LAN header. The programming track
+// is used in service mode: the command station is asked for the result until it has finished,
+// and it stays in service mode (main track off) until normal operations are resumed.
+//
+
+// XpressNetFunctionMax is the highest function number of the XpressNet function groups
+const XpressNetFunctionMax = 28
+
+const (
+	// xpressNetAckTimeout is how long the interface may take to confirm a command is passed on
+	xpressNetAckTimeout = 500 * time.Millisecond
+	// xpressNetResultPoll is the pause between two questions for the result of a service mode command
+	xpressNetResultPoll = 100 * time.Millisecond
+)
+
+// errXpressNetClosed is returned to the waiting requests when the serial port is closed
+var errXpressNetClosed = errors.New("the connection to the XpressNet interface was closed")
+
+// XpressNetSerialConfig is the configuration of the "xpressnet-serial" station type
+type XpressNetSerialConfig struct {
+	// Address is the serial port, e.g. "/dev/ttyUSB0"
+	Address string
+	// Baud is the speed of the serial port, 0 is the default of the LI-USB interfaces
+	Baud int
+}
+
+func init() {
+	register("xpressnet-serial", func(config *XpressNetSerialConfig, env Environment) (*XpressNet, error) {
+		if err := refuseDryRun("xpressnet-serial", env); err != nil {
+			return nil, err
+		}
+		return NewXpressNetSerial(config.Address, config.Baud, env.Defaults...)
+	})
+}
+
+// NewXpressNetSerial opens the serial port of an XpressNet PC interface, e.g. "/dev/ttyUSB0"
+func NewXpressNetSerial(device string, baud int, defaults ...ctxOptions) (*XpressNet, error) {
+	if baud == 0 {
+		baud = xpressnet.DefaultBaudRate
+	}
+	port, err := openSerial(device, baud)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the XpressNet serial port %q: %w", device, err)
+	}
+	return newXpressNet(port, defaults), nil
+}
+
+func newXpressNet(conn io.ReadWriteCloser, defaults []ctxOptions) *XpressNet {
+	x := &XpressNet{
+		conn:     conn,
+		Timeout:  time.Second * 10,
+		defaults: defaults,
+		replies:  make(chan z21proto.Message, 64),
+		closed:   make(chan struct{}),
+	}
+	go x.readReplies(conn)
+	return x
+}
+
+// XpressNet implements Station for a command station behind an XpressNet PC interface
+type XpressNet struct {
+	conn     io.ReadWriteCloser
+	Timeout  time.Duration
+	defaults []ctxOptions
+	// replies are the packets read from conn, broadcasts included
+	replies chan z21proto.Message
+	closed  chan struct{}
+	// mu serializes the requests, so every one of them sees only the replies to itself
+	mu sync.Mutex
+	// serviceMode is set after a programming track command, normal operations are resumed by CleanUp
+	serviceMode bool
+}
+
+// readReplies decodes the packets from conn until it is closed
+func (x *XpressNet) readReplies(conn io.Reader) {
+	defer close(x.closed)
+	reader := bufio.NewReader(conn)
+	for {
+		header, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+		length, _ := xpressnet.Split(header)
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(reader, packet); err != nil {
+			return
+		}
+		msg, err := xpressnet.Decode(packet)
+		if err != nil {
+			logrus.Debugf("xpressnet: % X: %s", packet, err)
+			continue
+		}
+		logrus.Debugf("xpressnet: res % X (%T)", packet, msg)
+		select {
+		case x.replies <- msg:
+		default:
+			logrus.Debugf("xpressnet: nobody waits, dropping % X", packet)
+		}
+	}
+}
+
+// newRequestContext builds the context from built-in defaults, station defaults and request options, in this order
+func (x *XpressNet) newRequestContext(options []ctxOptions) RequestContext {
+	ctx := RequestContext{
+		timeout:        x.Timeout,
+		retries:        2,
+		retryDelay:     200 * time.Millisecond,
+		settle:         200 * time.Millisecond,
+		format:         DCCFormat,
+		repeatInterval: 50 * time.Millisecond,
+	}
+	applyMethodsToCtx(&ctx, x.defaults)
+	applyMethodsToCtx(&ctx, options)
+	return ctx
+}
+
+// request sends the message and waits for the first reply accepted by match, other messages are skipped.
+// A nil match waits only for the interface to confirm the message was passed to the command station.
+func (x *XpressNet) request(req z21proto.Message, timeout time.Duration, match func(z21proto.Message) bool) (z21proto.Message, error) {
+	packet, err := xpressnet.Encode(req)
+	if err != nil {
+		return nil, err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	// late replies to previous requests and broadcasts nobody asked for
+	for drained := false; !drained; {
+		select {
+		case <-x.replies:
+		default:
+			drained = true
+		}
+	}
+	logrus.Debugf("xpressnet: req % X (%T)", packet, req)
+	if _, err := x.conn.Write(packet); err != nil {
+		return nil, fmt.Errorf("cannot send to the XpressNet interface: %w", err)
+	}
+
+	if match == nil {
+		timeout = xpressNetAckTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case msg := <-x.replies:
+			if status, ok := msg.(xpressnet.InterfaceStatus); ok {
+				if err := status.Err(); err != nil {
+					return nil, err
+				}
+				if match == nil {
+					return msg, nil
+				}
+				continue
+			}
+			if _, ok := msg.(z21proto.UnknownCommand); ok {
+				return nil, fmt.Errorf("the command station does not know %T", req)
+			}
+			if match != nil && match(msg) {
+				return msg, nil
+			}
+		case <-x.closed:
+			return nil, errXpressNetClosed
+		case <-timer.C:
+			if match == nil {
+				// not every interface confirms the commands
+				logrus.Debugf("xpressnet: %T was not confirmed by the interface", req)
+				return nil, nil
+			}
+			return nil, errResponseTimeout
+		}
+	}
+}
+
+// send passes a command that is not answered by the command station
+func (x *XpressNet) send(req z21proto.Message) error {
+	_, err := x.request(req, 0, nil)
+	return err
+}
+
+// sendRepeated sends a driving command and then repeats it as requested, see Repeat
+func (x *XpressNet) sendRepeated(req z21proto.Message, ctx RequestContext) error {
+	if err := x.send(req); err != nil {
+		return err
+	}
+	for i := 0; i < int(ctx.repeat); i++ {
+		time.Sleep(ctx.repeatInterval)
+		if err := x.send(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// programmingTrack sends a service mode command and asks for its result until the command station has finished
+func (x *XpressNet) programmingTrack(req z21proto.Message, cv uint16, ctx RequestContext) (byte, error) {
+	if cv < 1 || cv > xpressnet.MaxServiceModeCV {
+		return 0, fmt.Errorf("cv%d cannot be reached in direct mode (1-%d)", cv, xpressnet.MaxServiceModeCV)
+	}
+	if err := x.send(req); err != nil {
+		return 0, err
+	}
+	x.serviceMode = true
+
+	deadline := time.Now().Add(ctx.timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(xpressNetResultPoll)
+		msg, err := x.request(xpressnet.ServiceModeResultRequest{}, time.Until(deadline), func(msg z21proto.Message) bool {
+			switch msg.(type) {
+			case xpressnet.ServiceModeResult, xpressnet.ServiceModeBusy, z21proto.CVNack, z21proto.CVNackShortCircuit:
+				return true
+			}
+			return false
+		})
+		if err != nil {
+			return 0, err
+		}
+		switch m := msg.(type) {
+		case xpressnet.ServiceModeBusy:
+			continue
+		case z21proto.CVNack:
+			return 0, fmt.Errorf("the decoder did not acknowledge cv%d, is the locomotive on the programming track?", cv)
+		case z21proto.CVNackShortCircuit:
+			return 0, errors.New("short circuit on the programming track")
+		case xpressnet.ServiceModeResult:
+			if m.CV != cv {
+				return 0, fmt.Errorf("the command station reported cv%d instead of cv%d", m.CV, cv)
+			}
+			return m.Value, nil
+		}
+	}
+	return 0, errResponseTimeout
+}
+
+func (x *XpressNet) WriteCV(mode Mode, lcv LocoCV, options ...ctxOptions) error {
+	ctx := x.newRequestContext(options)
+	if ctx.format == MMFormat {
+		return NotSupported(CapabilityMMFormat, "XpressNet programs only DCC decoders")
+	}
+	if lcv.Cv.Value < 0 || lcv.Cv.Value > 255 {
+		return fmt.Errorf("cannot write CV: value %d out of range (0-255)", lcv.Cv.Value)
+	}
+	cv, value := uint16(lcv.Cv.Num), byte(lcv.Cv.Value)
+	logrus.Debugf("Writing CV: loco=%d, CV%d=%d", lcv.LocoId, lcv.Cv.Num, lcv.Cv.Value)
+
+	switch mode {
+	case MainTrackMode:
+		if ctx.verify {
+			return NotSupported(CapabilityReadBack, "XpressNet reads CVs only on the programming track, a main track write cannot be verified")
+		}
+		if err := x.send(z21proto.CVPomWriteByte{Addr: uint16(lcv.LocoId), CV: cv, Value: value}); err != nil {
+			return fmt.Errorf("cannot write CV: %w", err)
+		}
+		return nil
+	case ProgrammingTrackMode:
+		if _, err := x.programmingTrack(xpressnet.DirectModeWrite{CV: cv, Value: value}, cv, ctx); err != nil {
+			return fmt.Errorf("cannot write CV: %w", err)
+		}
+		if ctx.verify {
+			logrus.Debug("Verifying written CV")
+			time.Sleep(ctx.settle)
+			read, err := x.ReadCV(mode, lcv, options...)
+			if err != nil {
+				return fmt.Errorf("cannot verify CV was written: %w", err)
+			}
+			if read != int(value) {
+				return fmt.Errorf("cannot write CV, the value differs after a write")
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot write CV: unsupported mode %s", mode)
+}
+
+func (x *XpressNet) ReadCV(mode Mode, lcv LocoCV, options ...ctxOptions) (int, error) {
+	ctx := x.newRequestContext(options)
+	if ctx.format == MMFormat {
+		return 0, NotSupported(CapabilityMMRead, "MM decoders cannot be read")
+	}
+	if mode != ProgrammingTrackMode {
+		return 0, NotSupported(CapabilityReadBack, "XpressNet reads CVs only on the programming track")
+	}
+	cv := uint16(lcv.Cv.Num)
+	var lastErr error
+	for i := 0; i <= int(ctx.retries); i++ {
+		logrus.Debugf("Try [%d/%d]", i, ctx.retries)
+		value, err := x.programmingTrack(xpressnet.DirectModeRead{CV: cv}, cv, ctx)
+		if err == nil {
+			return int(value), nil
+		}
+		if errors.Is(err, errXpressNetClosed) {
+			return 0, fmt.Errorf("cannot read CV: %w", err)
+		}
+		lastErr = err
+		time.Sleep(ctx.retryDelay)
+	}
+	return 0, fmt.Errorf("cannot read CV: %w", lastErr)
+}
+
+// locoInfo reads the speed and F0-F28 of a locomotive. Command stations without the F13-F28 request report them off.
+func (x *XpressNet) locoInfo(addr LocoAddr, ctx RequestContext) (xpressnet.LocoInfo, error) {
+	var info xpressnet.LocoInfo
+	var lastErr error
+	for i := 0; i <= int(ctx.retries); i++ {
+		msg, err := x.request(xpressnet.GetLocoInfo{Addr: uint16(addr)}, ctx.timeout, func(msg z21proto.Message) bool {
+			_, ok := msg.(xpressnet.LocoInfo)
+			return ok
+		})
+		if err == nil {
+			info, lastErr = msg.(xpressnet.LocoInfo), nil
+			break
+		}
+		lastErr = err
+		if errors.Is(err, errXpressNetClosed) {
+			break
+		}
+		time.Sleep(ctx.retryDelay)
+	}
+	if lastErr != nil {
+		return info, fmt.Errorf("cannot read the state of locomotive %d: %w", addr, lastErr)
+	}
+
+	msg, err := x.request(xpressnet.GetFunctionStatesF13F28{Addr: uint16(addr)}, ctx.timeout, func(msg z21proto.Message) bool {
+		_, ok := msg.(xpressnet.FunctionStatesF13F28)
+		return ok
+	})
+	if err != nil {
+		logrus.Debugf("xpressnet: F13-F28 of locomotive %d are not known: %s", addr, err)
+		return info, nil
+	}
+	info.Functions |= msg.(xpressnet.FunctionStatesF13F28).Functions
+	return info, nil
+}
+
+// SendFn switches a function with its function group, the other functions of the group keep their state
+func (x *XpressNet) SendFn(mode Mode, addr LocoAddr, num FuncNum, action FnAction, options ...ctxOptions) error {
+	if mode != MainTrackMode {
+		return NotSupported(CapabilityFnOnProg, fmt.Sprintf("SendFn: unsupported mode %s", mode))
+	}
+	fn := int(num)
+	if fn < 0 || fn > XpressNetFunctionMax {
+		return fmt.Errorf("SendFn: unsupported function number %d (must be 0-%d)", num, XpressNetFunctionMax)
+	}
+	ctx := x.newRequestContext(options)
+	if action == FnToggle {
+		ctx.repeat = 0
+	}
+	group, _ := z21proto.FunctionGroupOf(fn)
+	info, err := x.locoInfo(addr, ctx)
+	if err != nil {
+		return fmt.Errorf("SendFn: cannot read the other functions of the group: %w", err)
+	}
+	on := action == FnOn || (action == FnToggle && !info.Functions.Get(fn))
+	req := z21proto.SetLocoFunctionGroup{Addr: uint16(addr), Group: group, Functions: info.Functions.Set(fn, on)}
+	if err := x.sendRepeated(req, ctx); err != nil {
+		return fmt.Errorf("SendFn: cannot write function command: %w", err)
+	}
+	return nil
+}
+
+func (x *XpressNet) SendBinaryState(addr LocoAddr, state uint16, on bool, options ...ctxOptions) error {
+	return NotSupported(CapabilityBinaryState, "binary states are not sent over XpressNet")
+}
+
+func (x *XpressNet) ListFunctions(addr LocoAddr, options ...ctxOptions) ([]int, error) {
+	info, err := x.locoInfo(addr, x.newRequestContext(options))
+	if err != nil {
+		return nil, err
+	}
+	return info.Functions.Active(), nil
+}
+
+// SetSpeed sets the speed and direction of a locomotive, the speed has the meaning of Z21Roco.SetSpeed
+func (x *XpressNet) SetSpeed(addr LocoAddr, speed uint8, forward bool, speedSteps uint8, options ...ctxOptions) error {
+	switch speedSteps {
+	case 14, 28, 128:
+	default:
+		return fmt.Errorf("invalid speed steps: %d (must be 14, 28, or 128)", speedSteps)
+	}
+	req := z21proto.SetLocoDrive{Addr: uint16(addr), Steps: z21proto.SpeedSteps(speedSteps), Speed: speed, Forward: forward}
+	if err := x.sendRepeated(req, x.newRequestContext(options)); err != nil {
+		return fmt.Errorf("SetSpeed: cannot write speed command: %w", err)
+	}
+	return nil
+}
+
+// GetSpeed reads the speed and direction of a locomotive, in the speed steps it is driven with
+func (x *XpressNet) GetSpeed(addr LocoAddr, options ...ctxOptions) (uint8, bool, error) {
+	info, err := x.locoInfo(addr, x.newRequestContext(options))
+	if err != nil {
+		return 0, false, err
+	}
+	return info.Speed, info.Forward, nil
+}
+
+// CleanUp resumes normal operations after the programming track was used, which switches the main track on again
+func (x *XpressNet) CleanUp() error {
+	if x.serviceMode {
+		logrus.Debug("Resuming normal operations after service mode")
+		if err := x.send(z21proto.SetTrackPowerOn{}); err != nil {
+			logrus.Errorf("cannot resume normal operations: %s", err)
+		}
+	}
+	return x.conn.Close()
+}
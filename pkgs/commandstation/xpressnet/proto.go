@@ -0,0 +1,266 @@
+// Package xpressnet is a codec for XpressNet as spoken by the PC interfaces of Lenz command stations
+// (LI-USB, LI101F) and compatible ones (GenLi).
+//
+// Every packet has the form:
+//
+//	Header (1 byte) | Data (n bytes) | XOR checksum (1 byte)
+//
+// where the low nibble of Header is n. These are the X-BUS bytes the Z21 tunnels in its LAN_X records,
+// so the messages both share (driving, functions, track power, POM) are the z21proto ones, sent without the LAN header.
+// This package adds the messages the Z21 replaced with its own: programming in service mode, reading
+// the locomotive information, and the answers of the PC interface itself.
+package xpressnet
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+)
+
+// DefaultBaudRate is the speed of LI-USB
+const DefaultBaudRate = 57600
+
+// ErrMalformed is returned by Decode when the length or the checksum of a packet is invalid
+var ErrMalformed = errors.New("malformed XpressNet packet")
+
+// Encode returns the XpressNet packet of a z21proto message with the X-BUS header
+func Encode(m z21proto.Message) ([]byte, error) {
+	packet, ok := z21proto.XBus(m.Encode())
+	if !ok {
+		return nil, fmt.Errorf("%T is not an X-BUS message", m)
+	}
+	return packet, nil
+}
+
+// Decode parses a single packet in either direction. Messages of this package are returned as such,
+// the others as z21proto messages.
+func Decode(packet []byte) (z21proto.Message, error) {
+	if len(packet) < 2 || len(packet) != int(packet[0]&0x0F)+2 {
+		return nil, fmt.Errorf("%w: % X", ErrMalformed, packet)
+	}
+	x := packet[:len(packet)-1]
+	if sum := xorSum(x); sum != packet[len(packet)-1] {
+		return nil, fmt.Errorf("%w: XOR checksum 0x%02X, expected 0x%02X", ErrMalformed, packet[len(packet)-1], sum)
+	}
+	if m, ok := decode(x[0], x[1:]); ok {
+		return m, nil
+	}
+	return z21proto.Decode(z21proto.XRecord(x...))
+}
+
+func decode(header byte, db []byte) (z21proto.Message, bool) {
+	switch {
+	case header == 0x01 && len(db) == 1:
+		return InterfaceStatus{Code: db[0]}, true
+	case header == 0x21 && len(db) == 1 && db[0] == 0x10:
+		return ServiceModeResultRequest{}, true
+	case header == 0x22 && len(db) == 2 && db[0] == 0x15:
+		return DirectModeRead{CV: cvFromWire(db[1])}, true
+	case header == 0x23 && len(db) == 3 && db[0] == 0x16:
+		return DirectModeWrite{CV: cvFromWire(db[1]), Value: db[2]}, true
+	case header == 0xE3 && len(db) == 3 && db[0] == 0x00:
+		return GetLocoInfo{Addr: z21proto.LocoAddrFromBytes(db[1], db[2])}, true
+	case header == 0xE3 && len(db) == 3 && db[0] == 0x08:
+		return GetFunctionStatesF13F28{Addr: z21proto.LocoAddrFromBytes(db[1], db[2])}, true
+	case header == 0x61 && len(db) == 1 && db[0] == 0x1F:
+		return ServiceModeBusy{}, true
+	case header == 0x63 && len(db) == 3 && db[0] == 0x14:
+		return ServiceModeResult{CV: cvFromWire(db[1]), Value: db[2]}, true
+	case header == 0xE4 && len(db) == 4 && db[0]&0xF0 == 0x00:
+		steps := z21proto.SpeedStepsFromID(db[0] & 0x07)
+		speed, forward := z21proto.DecodeSpeed(steps, db[1])
+		functions := functionsFromBits(db[2], db[3])
+		return LocoInfo{Busy: db[0]&0x08 != 0, Steps: steps, Speed: speed, Forward: forward, Functions: functions}, true
+	case header == 0xE3 && len(db) == 3 && db[0] == 0x52:
+		return FunctionStatesF13F28{Functions: z21proto.FunctionStates(db[1])<<13 | z21proto.FunctionStates(db[2])<<21}, true
+	}
+	return nil, false
+}
+
+// Split returns the length of the first packet in data, false when it is not complete yet
+func Split(data []byte) (int, bool) {
+	if len(data) == 0 {
+		return 0, false
+	}
+	length := int(data[0]&0x0F) + 2
+	return length, len(data) >= length
+}
+
+func xorSum(b []byte) byte {
+	var x byte
+	for _, v := range b {
+		x ^= v
+	}
+	return x
+}
+
+// record builds the z21proto form of a message of this package, so it can be sent like the shared ones
+func record(x ...byte) []byte {
+	return z21proto.XRecord(x...)
+}
+
+// cvToWire translates CV1-256 to the service mode byte, where 0 is CV256
+func cvToWire(cv uint16) byte {
+	return byte(cv)
+}
+
+func cvFromWire(b byte) uint16 {
+	if b == 0 {
+		return 256
+	}
+	return uint16(b)
+}
+
+// MaxServiceModeCV is the highest CV reached in the service mode direct mode
+const MaxServiceModeCV = 256
+
+// InterfaceStatus is the answer of the PC interface itself (0x01), e.g. that a command was passed to the command station
+type InterfaceStatus struct {
+	Code byte
+}
+
+// InterfaceStatus codes
+const (
+	InterfaceTimeout    byte = 0x01 // the interface did not finish receiving the packet in time
+	InterfaceNoAnswer   byte = 0x02 // the command station did not answer
+	InterfaceUnknown    byte = 0x03 // unknown communication error
+	InterfaceSent       byte = 0x04 // the command was passed to the command station
+	InterfaceNoTimeslot byte = 0x05 // the command station no longer gives the interface a timeslot
+	InterfaceOverflow   byte = 0x06 // the buffer of the interface overflowed
+)
+
+func (m InterfaceStatus) Encode() []byte {
+	return record(0x01, m.Code)
+}
+
+// Err returns nil for InterfaceSent, otherwise an error naming the failure
+func (m InterfaceStatus) Err() error {
+	switch m.Code {
+	case InterfaceSent:
+		return nil
+	case InterfaceTimeout:
+		return errors.New("the XpressNet interface did not receive the whole packet in time")
+	case InterfaceNoAnswer:
+		return errors.New("the command station does not answer the XpressNet interface")
+	case InterfaceNoTimeslot:
+		return errors.New("the command station no longer gives the XpressNet interface a timeslot")
+	case InterfaceOverflow:
+		return errors.New("the buffer of the XpressNet interface overflowed")
+	}
+	return fmt.Errorf("XpressNet interface error 0x%02X", m.Code)
+}
+
+// DirectModeRead (0x22 0x15) reads CV1-256 on the programming track, the result is asked with ServiceModeResultRequest
+type DirectModeRead struct {
+	CV uint16
+}
+
+func (m DirectModeRead) Encode() []byte {
+	return record(0x22, 0x15, cvToWire(m.CV))
+}
+
+// DirectModeWrite (0x23 0x16) writes CV1-256 on the programming track
+type DirectModeWrite struct {
+	CV    uint16
+	Value byte
+}
+
+func (m DirectModeWrite) Encode() []byte {
+	return record(0x23, 0x16, cvToWire(m.CV), m.Value)
+}
+
+// ServiceModeResultRequest (0x21 0x10) asks for the result of the last service mode command
+type ServiceModeResultRequest struct{}
+
+func (m ServiceModeResultRequest) Encode() []byte {
+	return record(0x21, 0x10)
+}
+
+// ServiceModeResult (0x63 0x14) is the value of a CV read or written in direct mode.
+// A decoder that did not acknowledge is reported as z21proto.CVNack, a short circuit as z21proto.CVNackShortCircuit.
+type ServiceModeResult struct {
+	CV    uint16
+	Value byte
+}
+
+func (m ServiceModeResult) Encode() []byte {
+	return record(0x63, 0x14, cvToWire(m.CV), m.Value)
+}
+
+// ServiceModeBusy (0x61 0x1F) is the answer to ServiceModeResultRequest while the command station is still programming
+type ServiceModeBusy struct{}
+
+func (m ServiceModeBusy) Encode() []byte {
+	return record(0x61, 0x1F)
+}
+
+// GetLocoInfo (0xE3 0x00) asks for the speed and F0-F12 of a locomotive, answered with LocoInfo
+type GetLocoInfo struct {
+	Addr uint16
+}
+
+func (m GetLocoInfo) Encode() []byte {
+	msb, lsb := z21proto.LocoAddrBytes(m.Addr)
+	return record(0xE3, 0x00, msb, lsb)
+}
+
+// LocoInfo (0xE4) is the normal locomotive information, Functions holds F0-F12
+type LocoInfo struct {
+	// Busy is set when another device drives the locomotive
+	Busy      bool
+	Steps     z21proto.SpeedSteps
+	Speed     uint8
+	Forward   bool
+	Functions z21proto.FunctionStates
+}
+
+func (m LocoInfo) Encode() []byte {
+	id := byte(0)
+	switch m.Steps {
+	case z21proto.Steps28:
+		id = 2
+	case z21proto.Steps128:
+		id = 4
+	}
+	if m.Busy {
+		id |= 0x08
+	}
+	// the speed byte of SetLocoDrive, without its header
+	drive, _ := z21proto.XBus(z21proto.SetLocoDrive{Steps: m.Steps, Speed: m.Speed, Forward: m.Forward}.Encode())
+	fa := byte(m.Functions>>1)&0x0F | boolBit(m.Functions.Get(0), 0x10)
+	fb := byte(m.Functions >> 5)
+	return record(0xE4, id, drive[4], fa, fb)
+}
+
+// functionsFromBits decodes FA (000 F0 F4 F3 F2 F1) and FB (F12-F5) of LocoInfo
+func functionsFromBits(fa, fb byte) z21proto.FunctionStates {
+	functions := z21proto.FunctionStates(fa&0x0F)<<1 | z21proto.FunctionStates(fb)<<5
+	return functions.Set(0, fa&0x10 != 0)
+}
+
+func boolBit(on bool, bit byte) byte {
+	if on {
+		return bit
+	}
+	return 0
+}
+
+// GetFunctionStatesF13F28 (0xE3 0x08) asks for F13-F28 of a locomotive, answered with FunctionStatesF13F28
+type GetFunctionStatesF13F28 struct {
+	Addr uint16
+}
+
+func (m GetFunctionStatesF13F28) Encode() []byte {
+	msb, lsb := z21proto.LocoAddrBytes(m.Addr)
+	return record(0xE3, 0x08, msb, lsb)
+}
+
+// FunctionStatesF13F28 (0xE3 0x52) holds F13-F28, the other functions are off
+type FunctionStatesF13F28 struct {
+	Functions z21proto.FunctionStates
+}
+
+func (m FunctionStatesF13F28) Encode() []byte {
+	return record(0xE3, 0x52, byte(m.Functions>>13), byte(m.Functions>>21))
+}
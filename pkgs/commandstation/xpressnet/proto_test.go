@@ -0,0 +1,79 @@
+package xpressnet
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+)
+
+func TestEncode(t *testing.T) {
+	cases := []struct {
+		msg      z21proto.Message
+		expected []byte
+	}{
+		// shared with the Z21
+		{z21proto.SetTrackPowerOn{}, []byte{0x21, 0x81, 0xA0}},
+		{z21proto.SetLocoDrive{Addr: 3, Steps: z21proto.Steps128, Speed: 42, Forward: true}, []byte{0xE4, 0x13, 0x00, 0x03, 0xAA, 0x5E}},
+		// XpressNet only
+		{DirectModeRead{CV: 29}, []byte{0x22, 0x15, 0x1D, 0x2A}},
+		{DirectModeWrite{CV: 256, Value: 5}, []byte{0x23, 0x16, 0x00, 0x05, 0x30}},
+		{ServiceModeResultRequest{}, []byte{0x21, 0x10, 0x31}},
+		{GetLocoInfo{Addr: 1234}, []byte{0xE3, 0x00, 0xC4, 0xD2, 0xF5}},
+	}
+	for _, c := range cases {
+		got, err := Encode(c.msg)
+		if err != nil {
+			t.Fatalf("Encode(%T): %v", c.msg, err)
+		}
+		if !bytes.Equal(got, c.expected) {
+			t.Errorf("Encode(%T) = % X; want % X", c.msg, got, c.expected)
+		}
+	}
+	if _, err := Encode(z21proto.GetSerialNumber{}); err == nil {
+		t.Error("a LAN record without X-BUS bytes was encoded")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	infoF13F28 := FunctionStatesF13F28{Functions: z21proto.FunctionStates(0).Set(13, true).Set(28, true)}
+	cases := []z21proto.Message{
+		DirectModeRead{CV: 29},
+		DirectModeWrite{CV: 256, Value: 5},
+		ServiceModeResultRequest{},
+		GetLocoInfo{Addr: 1234},
+		GetFunctionStatesF13F28{Addr: 3},
+		InterfaceStatus{Code: InterfaceSent},
+		ServiceModeBusy{},
+		ServiceModeResult{CV: 256, Value: 7},
+		LocoInfo{Busy: true, Steps: z21proto.Steps28, Speed: 14, Forward: true, Functions: z21proto.FunctionStates(0).Set(0, true).Set(4, true).Set(12, true)},
+		infoF13F28,
+		z21proto.CVNack{},
+		z21proto.TrackPowerOn{},
+	}
+	for _, msg := range cases {
+		packet, err := Encode(msg)
+		if err != nil {
+			t.Fatalf("Encode(%T): %v", msg, err)
+		}
+		got, err := Decode(packet)
+		if err != nil {
+			t.Fatalf("Decode(% X): %v", packet, err)
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("Decode(% X) = %#v; want %#v", packet, got, msg)
+		}
+	}
+
+	for _, malformed := range [][]byte{{}, {0x21, 0x81}, {0x21, 0x81, 0x00}} {
+		if _, err := Decode(malformed); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Decode(% X) = %v; want ErrMalformed", malformed, err)
+		}
+	}
+
+	if length, complete := Split([]byte{0x63, 0x14}); length != 5 || complete {
+		t.Errorf("Split of a partial packet = %d, %v", length, complete)
+	}
+}
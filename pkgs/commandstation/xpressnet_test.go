@@ -0,0 +1,162 @@
+package commandstation
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/xpressnet"
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+)
+
+// fakeLI answers like a PC interface in front of a Lenz command station with a decoder on the programming track
+type fakeLI struct {
+	mu       sync.Mutex
+	cvs      map[uint16]byte
+	received []z21proto.Message
+	// lastCV is the CV of the last service mode command, busy is how many result requests are answered as busy
+	lastCV uint16
+	busy   int
+}
+
+func (f *fakeLI) serve(conn io.ReadWriter) {
+	reader := bufio.NewReader(conn)
+	for {
+		header, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+		length, _ := xpressnet.Split(header)
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(reader, packet); err != nil {
+			return
+		}
+		msg, err := xpressnet.Decode(packet)
+		if err != nil {
+			continue
+		}
+		f.mu.Lock()
+		f.received = append(f.received, msg)
+		reply := f.answer(msg)
+		f.mu.Unlock()
+		for _, m := range reply {
+			out, _ := xpressnet.Encode(m)
+			if _, err := conn.Write(out); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (f *fakeLI) answer(msg z21proto.Message) []z21proto.Message {
+	sent := xpressnet.InterfaceStatus{Code: xpressnet.InterfaceSent}
+	switch m := msg.(type) {
+	case xpressnet.DirectModeRead:
+		f.lastCV, f.busy = m.CV, 1
+		return []z21proto.Message{sent}
+	case xpressnet.DirectModeWrite:
+		f.lastCV, f.busy = m.CV, 1
+		f.cvs[m.CV] = m.Value
+		return []z21proto.Message{sent}
+	case xpressnet.ServiceModeResultRequest:
+		if f.busy > 0 {
+			f.busy--
+			return []z21proto.Message{xpressnet.ServiceModeBusy{}}
+		}
+		value, ok := f.cvs[f.lastCV]
+		if !ok {
+			return []z21proto.Message{z21proto.CVNack{}}
+		}
+		return []z21proto.Message{xpressnet.ServiceModeResult{CV: f.lastCV, Value: value}}
+	case xpressnet.GetLocoInfo:
+		return []z21proto.Message{xpressnet.LocoInfo{Steps: z21proto.Steps128, Speed: 42, Forward: true, Functions: z21proto.FunctionStates(0).Set(1, true)}}
+	case xpressnet.GetFunctionStatesF13F28:
+		return []z21proto.Message{xpressnet.FunctionStatesF13F28{Functions: z21proto.FunctionStates(0).Set(20, true)}}
+	}
+	return []z21proto.Message{sent}
+}
+
+func (f *fakeLI) messages() []z21proto.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]z21proto.Message(nil), f.received...)
+}
+
+func startFakeLI(t *testing.T) (*fakeLI, *XpressNet) {
+	t.Helper()
+	client, server := net.Pipe()
+	fake := &fakeLI{cvs: map[uint16]byte{1: 3, 29: 6}}
+	go fake.serve(server)
+	t.Cleanup(func() { _ = server.Close() })
+	x := newXpressNet(client, []ctxOptions{RetryDelay(0)})
+	x.Timeout = time.Second
+	return fake, x
+}
+
+func TestXpressNet_CV(t *testing.T) {
+	fake, x := startFakeLI(t)
+
+	if err := x.WriteCV(ProgrammingTrackMode, LocoCV{Cv: CV{Num: 3, Value: 5}}, Verify(true)); err != nil {
+		t.Fatalf("WriteCV: %v", err)
+	}
+	if value, err := x.ReadCV(ProgrammingTrackMode, LocoCV{Cv: CV{Num: 29}}); err != nil || value != 6 {
+		t.Fatalf("ReadCV = %d, %v", value, err)
+	}
+	if _, err := x.ReadCV(ProgrammingTrackMode, LocoCV{Cv: CV{Num: 200}}, Retries(0)); err == nil {
+		t.Fatal("ReadCV of a CV the decoder does not acknowledge succeeded")
+	}
+	if _, err := x.ReadCV(ProgrammingTrackMode, LocoCV{Cv: CV{Num: 300}}, Retries(0)); err == nil {
+		t.Fatal("ReadCV beyond the direct mode succeeded")
+	}
+	if err := x.WriteCV(MainTrackMode, LocoCV{LocoId: 3, Cv: CV{Num: 3, Value: 10}}); err != nil {
+		t.Fatalf("WriteCV on the main track: %v", err)
+	}
+
+	// normal operations are resumed after the programming track was used
+	if err := x.CleanUp(); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+	messages := fake.messages()
+	if _, ok := messages[len(messages)-1].(z21proto.SetTrackPowerOn); !ok {
+		t.Fatalf("last message = %#v", messages[len(messages)-1])
+	}
+}
+
+func TestXpressNet_Driving(t *testing.T) {
+	fake, x := startFakeLI(t)
+	defer x.CleanUp()
+
+	speed, forward, err := x.GetSpeed(3)
+	if err != nil || speed != 42 || !forward {
+		t.Fatalf("GetSpeed = %d %v %v", speed, forward, err)
+	}
+	functions, err := x.ListFunctions(3)
+	if err != nil || len(functions) != 2 || functions[0] != 1 || functions[1] != 20 {
+		t.Fatalf("ListFunctions = %v %v", functions, err)
+	}
+	if err := x.SetSpeed(3, 10, false, 28); err != nil {
+		t.Fatalf("SetSpeed: %v", err)
+	}
+	// F1 is kept on when F2 is switched in the same group
+	if err := x.SendFn(MainTrackMode, 3, 2, FnOn); err != nil {
+		t.Fatalf("SendFn: %v", err)
+	}
+	if err := x.SendFn(MainTrackMode, 3, 29, FnOn); err == nil {
+		t.Fatal("SendFn of F29 succeeded")
+	}
+
+	var group []byte
+	for _, msg := range fake.messages() {
+		if m, ok := msg.(z21proto.SetLocoFunctionGroup); ok {
+			group, _ = xpressnet.Encode(m)
+		}
+	}
+	expected, _ := xpressnet.Encode(z21proto.SetLocoFunctionGroup{Addr: 3, Group: z21proto.FunctionGroupF0F4, Functions: z21proto.FunctionStates(0).Set(1, true).Set(2, true)})
+	if !bytes.Equal(group, expected) {
+		t.Fatalf("function group % X; want % X", group, expected)
+	}
+}
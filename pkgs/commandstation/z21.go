@@ -1,71 +1,180 @@
 package commandstation
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
 	"github.com/sirupsen/logrus"
 )
 
-// NewZ21Roco constructor
-func NewZ21Roco(netAddr string, netPort uint16) (*Z21Roco, error) {
-	roco := Z21Roco{Timeout: time.Second * 10, wasPowerCutOff: false}
-	return &roco, roco.connect(fmt.Sprintf("%s:%d", netAddr, netPort))
+// Z21 queues only a few commands, keep some headroom for other clients (throttles, apps)
+const (
+	Z21DefaultRateLimit = 20 // commands per second
+	Z21DefaultBurst     = 5
+)
+
+// NewZ21Roco constructor, transport is TransportUDP or TransportTCP.
+// Defaults are applied to every request before the per-request options.
+func NewZ21Roco(transport string, netAddr string, netPort uint16, defaults ...ctxOptions) (*Z21Roco, error) {
+	return NewZ21RocoWithBackups(transport, netAddr, netPort, nil, defaults...)
 }
 
-type Z21Roco struct {
-	conn           net.Conn
-	Timeout        time.Duration
-	wasPowerCutOff bool
-	// fnStateCache keeps the last known function state bytes per locomotive.
-	// Keyed by address; value is 5 bytes covering F0..F31 as in LAN_X_LOCO_INFO (DB4..DB8).
-	fnStateCache map[LocoAddr]fnState
-	fnStateMu    sync.Mutex
+// NewZ21RocoDryRun creates a station that does not connect anywhere, every packet that would be sent
+// is passed to observe instead. Requests waiting for an answer fail, as there is nobody to respond.
+func NewZ21RocoDryRun(observe func(packet []byte), defaults ...ctxOptions) *Z21Roco {
+	return &Z21Roco{
+		Timeout:     time.Second * 10,
+		StateMaxAge: DefaultLocoStateMaxAge,
+		defaults:    defaults,
+		dryRun:      observe,
+	}
 }
 
-// fnState represents function bits F0..F31 for a single loco, as reported
-// by LAN_X_LOCO_INFO. The layout follows DB4..DB8.
-//
-// Bit mapping (per Z21 spec, simplified):
-//
-//	DB4 (b7..b0): F0..F4 and direction bits (we only care about F0..F4 here)
-//	DB5: F5..F12
-//	DB6: F13..F20
-//	DB7: F21..F28
-//	DB8: F29..F31 (not all bits used)
-type fnState struct {
-	B0_4   byte // DB4
-	B5_12  byte // DB5
-	B13_20 byte // DB6
-	B21_28 byte // DB7
-	B29_31 byte // DB8
+// Z21Config is the configuration of the "z21" station type
+type Z21Config struct {
+	Address string
+	Port    uint16
+	// Transport is TransportUDP or TransportTCP
+	Transport string
+	// Backup is the address of a backup station, "host" or "host:port" when the port differs
+	Backup string
+	// RateLimit is in commands per second, 0 is Z21DefaultRateLimit and a negative value disables the limit
+	RateLimit float64 `mapstructure:"rate_limit"`
+	// Burst is the number of commands sent at once before the limit applies, 0 is Z21DefaultBurst
+	Burst int
 }
 
-func (z *Z21Roco) connect(netAddr string) error {
-	conn, err := net.Dial("udp", netAddr)
+func init() {
+	register("z21", func(config *Z21Config, env Environment) (*Z21Roco, error) {
+		if env.DryRun != nil {
+			return NewZ21RocoDryRun(env.DryRun, env.Defaults...), nil
+		}
+		return OpenZ21(*config, env)
+	})
+}
+
+// OpenZ21 connects to a Z21 described by its configuration, recording the session when the environment asks for it
+func OpenZ21(config Z21Config, env Environment) (*Z21Roco, error) {
+	var backups []string
+	if config.Backup != "" {
+		backup := config.Backup
+		if _, _, err := net.SplitHostPort(backup); err != nil {
+			backup = net.JoinHostPort(backup, strconv.Itoa(int(config.Port)))
+		}
+		backups = append(backups, backup)
+	}
+	z, err := NewZ21RocoWithBackups(config.Transport, config.Address, config.Port, backups, env.Defaults...)
 	if err != nil {
-		return fmt.Errorf("UDP dial error while connecting to Roco Z21: %s", err)
+		return nil, err
 	}
-	z.conn = conn
-	// initialize cache
-	z.fnStateMu.Lock()
-	if z.fnStateCache == nil {
-		z.fnStateCache = make(map[LocoAddr]fnState)
+	if rate := config.RateLimit; rate != 0 {
+		burst := config.Burst
+		if burst == 0 {
+			burst = Z21DefaultBurst
+		}
+		z.LimitRate(rate, burst)
+	}
+	if env.SessionLog != "" {
+		// appending, so monitoring multiple stations or running a few commands ends in a single file
+		file, err := os.OpenFile(env.SessionLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			z.CleanUp()
+			return nil, fmt.Errorf("cannot open the session log: %w", err)
+		}
+		if err := z.RecordSession(file); err != nil {
+			file.Close()
+			z.CleanUp()
+			return nil, err
+		}
+	}
+	return z, nil
+}
+
+// LimitRate sets how many commands per second are sent to the Z21, allowing bursts of up to burst commands.
+// A rate of 0 or less disables the limit.
+func (z *Z21Roco) LimitRate(perSecond float64, burst int) {
+	if perSecond <= 0 {
+		z.limiter = nil
+		return
+	}
+	z.limiter = newTokenBucket(perSecond, burst)
+}
+
+type Z21Roco struct {
+	conn net.Conn
+	// endpoints are the primary station followed by backups, active is the one conn is connected to
+	endpoints []string
+	active    int
+	transport string
+	Timeout   time.Duration
+	// StateMaxAge is how long ListFunctions and GetSpeed answer from the cached state, 0 always asks the Z21
+	StateMaxAge    time.Duration
+	defaults       []ctxOptions
+	limiter        *tokenBucket
+	dryRun         func(packet []byte)
+	wasPowerCutOff bool
+	// locos keep the last known state per locomotive, as reported by LAN_X_LOCO_INFO or set by SendFn and SetSpeed
+	locos locoStates
+	// events are subscribers of broadcasts
+	events subscribers
+	// session records the traffic, see RecordSession
+	session *sessionRecorder
+	// demux passes what is read from conn to the waiting requests
+	demux demux
+	// failingOver serializes the failovers of concurrent requests, see failover
+	failingOver sync.Mutex
+	// central is the last reported state of the command station
+	central stationStates
+	// xBus is the X-BUS version of the command station, it selects how functions are switched
+	xBus xBusVersion
+	// lock tells whether the command station is a z21start that ignores CV commands, see lockedStart
+	lock featureLock
+}
+
+func (z *Z21Roco) connect(transport string, netAddr string) error {
+	conn, err := dialZ21(transport, netAddr)
+	if err != nil {
+		return err
 	}
-	z.fnStateMu.Unlock()
+	z.demux.mu.Lock()
+	z.conn = conn
+	z.demux.mu.Unlock()
 	return nil
 }
 
 func (Z *Z21Roco) CleanUp() error {
-	if Z.wasPowerCutOff {
-		logrus.Debug("Restoring power on programming track")
-		Z.buildTrackPowerOn()
+	if err := Z.restoreTrackPower(); err != nil {
+		logrus.Errorf("cannot restore track power: %s", err)
+	}
+	if Z.session != nil {
+		if err := Z.session.close(); err != nil {
+			logrus.Errorf("cannot close the session recording: %s", err)
+		}
+	}
+	conn := Z.activeConn()
+	if conn == nil {
+		return nil
 	}
-	return Z.conn.Close()
+	return conn.Close()
+}
+
+// restoreTrackPower ends the programming mode, when an operation on the programming track switched the main track off
+func (Z *Z21Roco) restoreTrackPower() error {
+	if !Z.wasPowerCutOff {
+		return nil
+	}
+	logrus.Debug("Restoring power on programming track")
+	if err := Z.send(z21proto.SetTrackPowerOn{}); err != nil {
+		return err
+	}
+	Z.wasPowerCutOff = false
+	return nil
 }
 
 func (Z *Z21Roco) markBuildTrackPowerOff() {
@@ -73,37 +182,32 @@ func (Z *Z21Roco) markBuildTrackPowerOff() {
 	Z.wasPowerCutOff = true
 }
 
-func (z *Z21Roco) buildCVRequest(mode Mode, lcv LocoCV, isWriteRequest bool) ([]byte, error) {
-	var err error
-	var req []byte
-
-	switch mode {
-	case MainTrackMode:
-		if isWriteRequest {
-			req = z.buildPomWriteByte(lcv)
-		} else {
-			req = z.buildPomReadPacket(lcv)
-		}
-	case ProgrammingTrackMode:
-		if isWriteRequest {
-			req = z.buildProgWritePacket(lcv)
-		} else {
-			req = z.buildProgReadPacket(lcv.Cv)
-		}
-	default:
-		return []byte{}, errors.New("unrecognized mode")
-	}
-
-	return req, err
+// newRequestContext builds the context from built-in defaults, station defaults and request options, in this order
+func (z *Z21Roco) newRequestContext(options []ctxOptions) RequestContext {
+	ctx := RequestContext{
+		timeout:    z.Timeout,
+		verify:     false,
+		retries:    2,
+		retryDelay: 200 * time.Millisecond,
+		settle:     200 * time.Millisecond,
+		format:     DCCFormat,
+		// a DCC packet takes about 6 ms, leave room for the refresh of other locomotives
+		repeatInterval: 50 * time.Millisecond,
+	}
+	applyMethodsToCtx(&ctx, z.defaults)
+	applyMethodsToCtx(&ctx, options)
+	return ctx
 }
 
 func (z *Z21Roco) WriteCV(mode Mode, lcv LocoCV, options ...ctxOptions) error {
-	ctx := RequestContext{timeout: z.Timeout, verify: false, retries: 2, settle: 200}
-	applyMethodsToCtx(&ctx, options)
+	ctx := z.newRequestContext(options)
+	if ctx.format == MMFormat {
+		return z.writeMMRegister(mode, lcv, ctx)
+	}
 
 	req, err := z.buildCVRequest(mode, lcv, true)
 	if err != nil {
-		return fmt.Errorf("cannot build CV request in WriteCV: %s", err.Error())
+		return fmt.Errorf("cannot build CV request in WriteCV: %w", err)
 	}
 
 	// we need to restore the power later on
@@ -112,16 +216,16 @@ func (z *Z21Roco) WriteCV(mode Mode, lcv LocoCV, options ...ctxOptions) error {
 	}
 
 	logrus.Debugf("Writing CV: loco=%d, CV%d=%d", lcv.LocoId, lcv.Cv.Num, lcv.Cv.Value)
-	if _, writeErr := z.write(req); writeErr != nil {
-		return fmt.Errorf("cannot write CV: %s", writeErr.Error())
+	if writeErr := z.send(req); writeErr != nil {
+		return fmt.Errorf("cannot write CV: %w", writeErr)
 	}
 
 	if ctx.verify {
 		logrus.Debug("Verifying written CV")
 		time.Sleep(ctx.settle)
-		res, readErr := z.readCVValue(mode, lcv, ctx.timeout, ctx.retries)
+		res, readErr := z.readCVValue(mode, lcv, ctx)
 		if readErr != nil {
-			return fmt.Errorf("cannot verify CV was written: %s", readErr.Error())
+			return fmt.Errorf("cannot verify CV was written: %w", readErr)
 		}
 		if res.value != byte(lcv.Cv.Value) {
 			return fmt.Errorf("cannot write CV, the value differs after a write")
@@ -131,27 +235,60 @@ func (z *Z21Roco) WriteCV(mode Mode, lcv LocoCV, options ...ctxOptions) error {
 	return nil
 }
 
+// writeMMRegister programs a Motorola decoder register, waiting until the Z21 reports the programming has finished
+func (z *Z21Roco) writeMMRegister(mode Mode, lcv LocoCV, ctx RequestContext) error {
+	if mode != ProgrammingTrackMode {
+		return NotSupported(CapabilityMMOnMain, "MM decoders can be programmed only on the programming track")
+	}
+	if ctx.verify {
+		return NotSupported(CapabilityMMRead, "MM decoders cannot be read back, verification is not possible")
+	}
+	if lcv.Cv.Num < 1 || lcv.Cv.Num > 79 {
+		return fmt.Errorf("MM register %d out of range (1-79)", lcv.Cv.Num)
+	}
+	if lcv.Cv.Value < 0 || lcv.Cv.Value > 255 {
+		return fmt.Errorf("MM register value %d out of range (0-255)", lcv.Cv.Value)
+	}
+	defer z.markBuildTrackPowerOff()
+
+	logrus.Debugf("Writing MM register: %d=%d", lcv.Cv.Num, lcv.Cv.Value)
+	req := z21proto.MMWriteByte{Register: uint8(lcv.Cv.Num), Value: byte(lcv.Cv.Value)}
+	if z.dryRun != nil {
+		return z.send(req)
+	}
+	res, err := z.sendAndAwait(req, uint16(lcv.Cv.Num), ctx.timeout)
+	if err != nil {
+		return fmt.Errorf("cannot write MM register: %w", err)
+	}
+	if responseErr := res.Error(); responseErr != nil {
+		return fmt.Errorf("cannot write MM register: %w", responseErr)
+	}
+	return nil
+}
+
 // ReadCV reads a CV
 func (z *Z21Roco) ReadCV(mode Mode, lcv LocoCV, options ...ctxOptions) (int, error) {
-	ctx := RequestContext{timeout: z.Timeout, verify: false, retries: 2, settle: 200}
-	applyMethodsToCtx(&ctx, options)
+	ctx := z.newRequestContext(options)
+	if ctx.format == MMFormat {
+		return 0, NotSupported(CapabilityMMRead, "MM decoders cannot be read")
+	}
 
 	// we need to restore the power later on
 	if mode == ProgrammingTrackMode {
 		defer z.markBuildTrackPowerOff()
 	}
 
-	res, readErr := z.readCVValue(mode, lcv, ctx.timeout, ctx.retries)
+	res, readErr := z.readCVValue(mode, lcv, ctx)
 	if readErr != nil {
-		return 0, fmt.Errorf("cannot read CV: %s", readErr.Error())
+		return 0, fmt.Errorf("cannot read CV: %w", readErr)
 	}
 	return int(res.value), nil
 }
 
 // Sends a function request to the decoder
-func (z *Z21Roco) SendFn(mode Mode, addr LocoAddr, num FuncNum, toggle bool) error {
+func (z *Z21Roco) SendFn(mode Mode, addr LocoAddr, num FuncNum, action FnAction, options ...ctxOptions) error {
 	if mode != MainTrackMode {
-		return fmt.Errorf("SendFn: unsupported mode %s", mode)
+		return NotSupported(CapabilityFnOnProg, fmt.Sprintf("SendFn: unsupported mode %s", mode))
 	}
 
 	fn := int(num)
@@ -160,56 +297,53 @@ func (z *Z21Roco) SendFn(mode Mode, addr LocoAddr, num FuncNum, toggle bool) err
 	}
 
 	// Build and send the function command
-	req := z.buildSetLocoFunction(addr, fn, toggle)
-	logrus.Debugf("req(LAN_X_SET_LOCO_FUNCTION): %v", req)
-	if _, err := z.write(req); err != nil {
-		return fmt.Errorf("SendFn: cannot write function command: %s", err)
+	var fnType z21proto.FunctionType
+	switch action {
+	case FnOff:
+		fnType = z21proto.FunctionOff
+	case FnOn:
+		fnType = z21proto.FunctionOn
+	case FnToggle:
+		fnType = z21proto.FunctionToggle
+	default:
+		return fmt.Errorf("SendFn: unsupported function action %d", action)
+	}
+	ctx := z.newRequestContext(options)
+	if action == FnToggle {
+		ctx.repeat = 0
+	}
+	if z.xBusVersion(ctx.timeout) < xBusSingleFunction {
+		if err := z.sendFnGroup(addr, fn, action, ctx); err != nil {
+			return err
+		}
+	} else {
+		req := z21proto.SetLocoFunction{Addr: uint16(addr), Function: uint8(fn), Type: fnType}
+		logrus.Debugf("req(LAN_X_SET_LOCO_FUNCTION): % X", req.Encode())
+		if err := z.sendRepeated(req, ctx); err != nil {
+			return fmt.Errorf("SendFn: cannot write function command: %w", err)
+		}
 	}
 
 	// Update our cache with the new state
-	z.updateFunctionStateCache(addr, fn, toggle)
+	z.locos.update(addr, func(state *LocoState) {
+		on := action == FnOn || (action == FnToggle && !state.Functions.Get(fn))
+		state.Functions = state.Functions.Set(fn, on)
+		state.Busy = false
+	})
 
 	return nil
 }
 
-// ListFunctions retrieves all active functions for a locomotive and returns their numbers
-func (z *Z21Roco) ListFunctions(addr LocoAddr) ([]int, error) {
-	// Query the command station using LAN_X_GET_LOCO_INFO
-	req := z.buildGetLocoInfo(addr)
-	logrus.Debugf("req(LAN_X_GET_LOCO_INFO): %v", req)
-	if _, err := z.write(req); err != nil {
-		return nil, fmt.Errorf("failed to send LAN_X_GET_LOCO_INFO: %w", err)
-	}
-
-	// Wait for response (LAN_X_LOCO_INFO)
-	_ = z.conn.SetReadDeadline(time.Now().Add(z.Timeout))
-	buf := make([]byte, 1500)
-	n, err := z.conn.Read(buf)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read LAN_X_LOCO_INFO response: %w", err)
-	}
-	logrus.Debugf("resp(LAN_X_LOCO_INFO): % X", buf[:n])
-
-	// Parse the response
-	state, err := z.parseLocoInfo(buf[:n])
+// ListFunctions retrieves all active functions for a locomotive and returns their numbers.
+// A state recently reported by the Z21 is used without asking, see StateMaxAge.
+func (z *Z21Roco) ListFunctions(addr LocoAddr, options ...ctxOptions) ([]int, error) {
+	info, err := z.locoInfo(addr, z.newRequestContext(options))
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse LAN_X_LOCO_INFO: %w", err)
+		return nil, err
 	}
 
-	// Cache the state for future reference
-	z.fnStateMu.Lock()
-	z.fnStateCache[addr] = state
-	z.fnStateMu.Unlock()
-
 	// Extract all active functions (F0..F31)
-	var activeFunctions []int
-	for fnNum := 0; fnNum <= 31; fnNum++ {
-		if z.extractFunctionBit(&state, fnNum) {
-			activeFunctions = append(activeFunctions, fnNum)
-		}
-	}
-
-	return activeFunctions, nil
+	return info.Functions.Active(), nil
 }
 
 type cvResult struct {
@@ -232,72 +366,72 @@ func (res *cvResult) Error() error {
 	return fmt.Errorf("unknown error (%s)", res.source)
 }
 
-func (z *Z21Roco) parseCVResponse(pkt []byte) (cvResult, bool) {
-	if len(pkt) < 6 {
-		return cvResult{}, false
-	}
-	dataLen := binary.LittleEndian.Uint16(pkt[0:2])
-	header := binary.LittleEndian.Uint16(pkt[2:4])
-	if header != 0x0040 || int(dataLen) != len(pkt) {
-		return cvResult{}, false
-	}
-
-	// RESULT: 64 14 CV_MSB CV_LSB Value XOR
-	if len(pkt) >= 10 && pkt[4] == 0x64 && pkt[5] == 0x14 {
-		return cvResult{
-			cv:     (uint16(pkt[6]) << 8) | uint16(pkt[7]),
-			value:  pkt[8],
-			source: "LAN_X_CV_RESULT",
-		}, true
-	}
-	// NACKs
-	if pkt[4] == 0x61 && pkt[5] == 0x13 {
+// parseCVResponse maps LAN_X_CV_RESULT/NACK/NACK_SC messages to a cvResult
+func (z *Z21Roco) parseCVResponse(msg z21proto.Message) (cvResult, bool) {
+	switch m := msg.(type) {
+	case z21proto.CVResult:
+		return cvResult{cv: m.CV - 1, value: m.Value, source: "LAN_X_CV_RESULT"}, true
+	case z21proto.CVNack:
 		return cvResult{source: "LAN_X_CV_NACK"}, true
-	}
-	if pkt[4] == 0x61 && pkt[5] == 0x12 {
+	case z21proto.CVNackShortCircuit:
 		return cvResult{source: "LAN_X_CV_NACK_SC"}, true
 	}
 	return cvResult{}, false
 }
 
-// Sends and waits for LAN_X_CV_* (read or write-result)
-func (z *Z21Roco) sendAndAwait(req []byte, timeout time.Duration) (cvResult, error) {
-	logrus.Debugf("z21.sendAndAwait: % X", req)
-	if _, err := z.write(req); err != nil {
-		return cvResult{}, err
-	}
-	_ = z.conn.SetReadDeadline(time.Now().Add(timeout))
-	buf := make([]byte, 1500)
-	end := time.Now().Add(timeout)
-	for time.Now().Before(end) {
-		n, err := z.conn.Read(buf)
-		if err != nil {
-			if ne, ok := err.(net.Error); ok && ne.Timeout() {
-				return cvResult{}, errors.New("response timeout")
-			}
-			return cvResult{}, err
+// sendRepeated sends a driving command and then repeats it as requested, see Repeat
+func (z *Z21Roco) sendRepeated(req z21proto.Message, ctx RequestContext) error {
+	if err := z.send(req); err != nil {
+		return err
+	}
+	for i := 0; i < int(ctx.repeat); i++ {
+		if z.dryRun == nil {
+			time.Sleep(ctx.repeatInterval)
 		}
-		if res, ok := z.parseCVResponse(buf[:n]); ok {
-			return res, nil
+		logrus.Debugf("repeat [%d/%d]: % X", i+1, ctx.repeat, req.Encode())
+		if err := z.send(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sends and waits for LAN_X_CV_* (read or write-result) for the given CV number.
+// Results for other CVs are late answers to previous requests (e.g. a write that was not awaited) and are skipped.
+func (z *Z21Roco) sendAndAwait(req z21proto.Message, cv uint16, timeout time.Duration) (cvResult, error) {
+	logrus.Debugf("z21.sendAndAwait: % X", req.Encode())
+	conn := z.activeConn()
+	msg, err := z.request(req, time.Now().Add(timeout), func(msg z21proto.Message) bool {
+		if result, ok := msg.(z21proto.CVResult); ok && result.CV != cv {
+			logrus.Debugf("z21.sendAndAwait: skipping a late result for CV%d", result.CV)
+			return false
+		}
+		return true
+	}, z21proto.CVResult{}, z21proto.CVNack{}, z21proto.CVNackShortCircuit{})
+	if err != nil {
+		if z.failover(conn, err) {
+			return z.sendAndAwait(req, cv, timeout)
 		}
+		return cvResult{}, z.explainFailure(z.explainTimeout(err))
 	}
-	return cvResult{}, errors.New("no response or unrecognized response")
+	res, _ := z.parseCVResponse(msg)
+	return res, nil
 }
 
 // readCVValue is reading the POM/PROG CV response
-func (z *Z21Roco) readCVValue(mode Mode, lcv LocoCV, timeout time.Duration, retries uint8) (cvResult, error) {
+func (z *Z21Roco) readCVValue(mode Mode, lcv LocoCV, ctx RequestContext) (cvResult, error) {
 	req, reqErr := z.buildCVRequest(mode, lcv, false)
 	if reqErr != nil {
-		return cvResult{}, fmt.Errorf("cannot build CV request: %s", reqErr)
+		return cvResult{}, fmt.Errorf("cannot build CV request: %w", reqErr)
 	}
 
 	var lastErr error
-	for i := 0; i <= int(retries); i++ {
-		logrus.Debugf("Try [%d/%d]", i, retries)
-		res, err := z.sendAndAwait(req, timeout)
+	for i := 0; i <= int(ctx.retries); i++ {
+		logrus.Debugf("Try [%d/%d]", i, ctx.retries)
+		res, err := z.sendAndAwait(req, uint16(lcv.Cv.Num), ctx.timeout)
 		if err == nil {
 			if responseErr := res.Error(); responseErr != nil {
-				lastErr = fmt.Errorf("cannot read CV: %s", responseErr.Error())
+				lastErr = z.explainFailure(fmt.Errorf("cannot read CV: %w", responseErr))
 				err = lastErr
 				continue
 			}
@@ -305,237 +439,47 @@ func (z *Z21Roco) readCVValue(mode Mode, lcv LocoCV, timeout time.Duration, retr
 			return res, nil
 		}
 		lastErr = err
-		time.Sleep(200 * time.Millisecond)
-	}
-	return cvResult{}, lastErr
-}
-
-// parseLocoInfo parses LAN_X_LOCO_INFO response (0xEF)
-func (z *Z21Roco) parseLocoInfo(pkt []byte) (fnState, error) {
-	if len(pkt) < 7 {
-		return fnState{}, fmt.Errorf("packet too short: %d bytes", len(pkt))
-	}
-
-	dataLen := binary.LittleEndian.Uint16(pkt[0:2])
-	header := binary.LittleEndian.Uint16(pkt[2:4])
-
-	if header != 0x0040 || int(dataLen) != len(pkt) {
-		return fnState{}, fmt.Errorf("invalid header or length")
-	}
-
-	if pkt[4] != 0xEF {
-		return fnState{}, fmt.Errorf("not a LAN_X_LOCO_INFO packet (X-Header: 0x%02X)", pkt[4])
-	}
-
-	// LAN_X_LOCO_INFO structure:
-	// Byte 0-1: DataLen (little endian)
-	// Byte 2-3: Header 0x0040 (little endian)
-	// Byte 4: X-Header 0xEF
-	// Byte 5: DB0 (address MSB)
-	// Byte 6: DB1 (address LSB)
-	// Byte 7: DB2 (speed/direction info)
-	// Byte 8: DB3 (speed value)
-	// Byte 9: DB4 (F0-F4 with direction)
-	// Byte 10: DB5 (F5-F12)
-	// Byte 11: DB6 (F13-F20) [optional]
-	// Byte 12: DB7 (F21-F28) [optional]
-	// Byte 13: DB8 (F29-F31) [optional, from FW 1.42+]
-	// Last byte: XOR
-
-	var state fnState
-
-	// DB4 (F0-F4) is at byte 9
-	if len(pkt) > 9 {
-		state.B0_4 = pkt[9]
-	}
-
-	// DB5 (F5-F12) is at byte 10
-	if len(pkt) > 10 {
-		state.B5_12 = pkt[10]
-	}
-
-	// DB6 (F13-F20) is at byte 11
-	if len(pkt) > 11 {
-		state.B13_20 = pkt[11]
-	}
-
-	// DB7 (F21-F28) is at byte 12
-	if len(pkt) > 12 {
-		state.B21_28 = pkt[12]
-	}
-
-	// DB8 (F29-F31) is at byte 13
-	if len(pkt) > 13 {
-		state.B29_31 = pkt[13]
-	}
-
-	return state, nil
-}
-
-// extractFunctionBit extracts the state of a specific function from fnState
-func (z *Z21Roco) extractFunctionBit(state *fnState, fnNum int) bool {
-	switch {
-	case fnNum == 0:
-		// F0 is bit 4 in DB4
-		return (state.B0_4 & 0x10) != 0
-	case fnNum >= 1 && fnNum <= 4:
-		// F1-F4 are bits 0-3 in DB4
-		return (state.B0_4 & (1 << (fnNum - 1))) != 0
-	case fnNum >= 5 && fnNum <= 12:
-		// F5-F12 are bits 0-7 in DB5
-		return (state.B5_12 & (1 << (fnNum - 5))) != 0
-	case fnNum >= 13 && fnNum <= 20:
-		// F13-F20 are bits 0-7 in DB6
-		return (state.B13_20 & (1 << (fnNum - 13))) != 0
-	case fnNum >= 21 && fnNum <= 28:
-		// F21-F28 are bits 0-7 in DB7
-		return (state.B21_28 & (1 << (fnNum - 21))) != 0
-	case fnNum >= 29 && fnNum <= 31:
-		// F29-F31 are bits 0-2 in DB8
-		return (state.B29_31 & (1 << (fnNum - 29))) != 0
-	default:
-		return false
-	}
-}
-
-// updateFunctionStateCache updates the cached function state for a locomotive
-func (z *Z21Roco) updateFunctionStateCache(addr LocoAddr, fnNum int, on bool) {
-	z.fnStateMu.Lock()
-	defer z.fnStateMu.Unlock()
-
-	state, ok := z.fnStateCache[addr]
-	if !ok {
-		// Initialize empty state if not present
-		state = fnState{}
-	}
-
-	// Update the appropriate bit
-	switch {
-	case fnNum == 0:
-		if on {
-			state.B0_4 |= 0x10
-		} else {
-			state.B0_4 &^= 0x10
-		}
-	case fnNum >= 1 && fnNum <= 4:
-		mask := byte(1 << (fnNum - 1))
-		if on {
-			state.B0_4 |= mask
-		} else {
-			state.B0_4 &^= mask
-		}
-	case fnNum >= 5 && fnNum <= 12:
-		mask := byte(1 << (fnNum - 5))
-		if on {
-			state.B5_12 |= mask
-		} else {
-			state.B5_12 &^= mask
-		}
-	case fnNum >= 13 && fnNum <= 20:
-		mask := byte(1 << (fnNum - 13))
-		if on {
-			state.B13_20 |= mask
-		} else {
-			state.B13_20 &^= mask
-		}
-	case fnNum >= 21 && fnNum <= 28:
-		mask := byte(1 << (fnNum - 21))
-		if on {
-			state.B21_28 |= mask
-		} else {
-			state.B21_28 &^= mask
-		}
-	case fnNum >= 29 && fnNum <= 31:
-		mask := byte(1 << (fnNum - 29))
-		if on {
-			state.B29_31 |= mask
-		} else {
-			state.B29_31 &^= mask
+		var notSupported *ErrNotSupported
+		if errors.As(err, &notSupported) {
+			break
 		}
+		time.Sleep(ctx.retryDelay)
 	}
-
-	z.fnStateCache[addr] = state
+	return cvResult{}, lastErr
 }
 
 // SetSpeed sets the speed and direction of a locomotive
 // speed: 0=stop, 1=emergency stop, 2+ for actual speed (max depends on speedSteps)
 // forward: true for forward, false for reverse
 // speedSteps: 14, 28, or 128 (will be converted to 0, 2, or 4 for the protocol)
-func (z *Z21Roco) SetSpeed(addr LocoAddr, speed uint8, forward bool, speedSteps uint8) error {
-	// Convert speedSteps to protocol value
-	var speedStepsProto uint8
+func (z *Z21Roco) SetSpeed(addr LocoAddr, speed uint8, forward bool, speedSteps uint8, options ...ctxOptions) error {
 	switch speedSteps {
-	case 14:
-		speedStepsProto = 0
-	case 28:
-		speedStepsProto = 2
-	case 128:
-		speedStepsProto = 4
+	case 14, 28, 128:
 	default:
 		return fmt.Errorf("invalid speed steps: %d (must be 14, 28, or 128)", speedSteps)
 	}
 
 	// Build and send the speed command
-	req := z.buildSetLocoSpeed(addr, speed, forward, speedStepsProto)
-	logrus.Debugf("req(LAN_X_SET_LOCO_DRIVE): % X", req)
-	if _, err := z.write(req); err != nil {
+	req := z21proto.SetLocoDrive{Addr: uint16(addr), Steps: z21proto.SpeedSteps(speedSteps), Speed: speed, Forward: forward}
+	logrus.Debugf("req(LAN_X_SET_LOCO_DRIVE): % X", req.Encode())
+	if err := z.sendRepeated(req, z.newRequestContext(options)); err != nil {
 		return fmt.Errorf("SetSpeed: cannot write speed command: %w", err)
 	}
+	z.locos.update(addr, func(state *LocoState) {
+		state.Speed, state.Forward, state.Steps = speed, forward, z21proto.SpeedSteps(speedSteps)
+		// the command took the locomotive over
+		state.Busy = false
+	})
 
 	return nil
 }
 
-// GetSpeed retrieves the current speed and direction of a locomotive
+// GetSpeed retrieves the current speed and direction of a locomotive, from the cache when it is fresh (see StateMaxAge)
 // Returns: speed (0-127), forward (true for forward, false for reverse), error
-func (z *Z21Roco) GetSpeed(addr LocoAddr) (uint8, bool, error) {
-	// Query the command station using LAN_X_GET_LOCO_INFO
-	req := z.buildGetLocoInfo(addr)
-	logrus.Debugf("req(LAN_X_GET_LOCO_INFO): %v", req)
-	if _, err := z.write(req); err != nil {
-		return 0, false, fmt.Errorf("failed to send LAN_X_GET_LOCO_INFO: %w", err)
-	}
-
-	// Wait for response (LAN_X_LOCO_INFO)
-	_ = z.conn.SetReadDeadline(time.Now().Add(z.Timeout))
-	buf := make([]byte, 1500)
-	n, err := z.conn.Read(buf)
+func (z *Z21Roco) GetSpeed(addr LocoAddr, options ...ctxOptions) (uint8, bool, error) {
+	info, err := z.locoInfo(addr, z.newRequestContext(options))
 	if err != nil {
-		return 0, false, fmt.Errorf("failed to read LAN_X_LOCO_INFO response: %w", err)
-	}
-	logrus.Debugf("resp(LAN_X_LOCO_INFO): % X", buf[:n])
-
-	// Parse the response to extract speed and direction
-	// LAN_X_LOCO_INFO structure:
-	// Byte 0-1: DataLen (little endian)
-	// Byte 2-3: Header 0x0040 (little endian)
-	// Byte 4: X-Header 0xEF
-	// Byte 5: DB0 (address MSB)
-	// Byte 6: DB1 (address LSB)
-	// Byte 7: DB2 (speed/direction info) - bit 7: direction (0=forward, 1=reverse), bits 5-0: speed steps
-	// Byte 8: DB3 (speed value)
-
-	if len(buf) < 9 {
-		return 0, false, fmt.Errorf("response too short")
+		return 0, false, err
 	}
-
-	dataLen := binary.LittleEndian.Uint16(buf[0:2])
-	header := binary.LittleEndian.Uint16(buf[2:4])
-
-	if header != 0x0040 || int(dataLen) != n {
-		return 0, false, fmt.Errorf("invalid header or length in response")
-	}
-
-	if buf[4] != 0xEF {
-		return 0, false, fmt.Errorf("not a LAN_X_LOCO_INFO packet (X-Header: 0x%02X)", buf[4])
-	}
-
-	// Extract direction from DB2 (byte 7): bit 7 indicates direction
-	// bit 7: 0 = forward, 1 = reverse
-	directionBit := (buf[7] & 0x80) != 0
-	forward := !directionBit // invert because 1 means reverse
-
-	// Extract speed from DB3 (byte 8)
-	speed := buf[8]
-
-	return speed, forward, nil
+	return info.Speed, info.Forward, nil
 }
@@ -0,0 +1,157 @@
+package commandstation
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+)
+
+//
+// Context: the state of the command station itself (emergency stop, short circuit, programming mode).
+// It is reported by LAN_X_STATUS_CHANGED, LAN_SYSTEMSTATE_DATACHANGED and the LAN_X_BC_* broadcasts, and explains
+// why a decoder does not answer, e.g. nothing is read on a track without power.
+//
+
+// StationState is the last reported state of the command station
+type StationState struct {
+	Central   z21proto.CentralState
+	CentralEx z21proto.CentralStateEx
+	LastSeen  time.Time
+}
+
+// Conditions names everything that is not normal operation, empty when the station works normally
+func (s StationState) Conditions() []string {
+	return append(s.Central.Conditions(), s.CentralEx.Conditions()...)
+}
+
+type stationStates struct {
+	mu    sync.Mutex
+	state StationState
+	known bool
+}
+
+// StationState returns the last state reported by the command station, false when none was received yet
+func (z *Z21Roco) StationState() (StationState, bool) {
+	z.central.mu.Lock()
+	defer z.central.mu.Unlock()
+	return z.central.state, z.central.known
+}
+
+// OnStationState registers a callback called when the conditions of the command station change.
+// The returned function removes the subscription.
+func (z *Z21Roco) OnStationState(callback func(state StationState)) (unsubscribe func()) {
+	z.events.mu.Lock()
+	defer z.events.mu.Unlock()
+	if z.events.stationState == nil {
+		z.events.stationState = make(map[int]func(StationState))
+	}
+	id := z.events.nextId
+	z.events.nextId++
+	z.events.stationState[id] = callback
+	return func() {
+		z.events.mu.Lock()
+		defer z.events.mu.Unlock()
+		delete(z.events.stationState, id)
+	}
+}
+
+// ReadStationState asks the command station for LAN_SYSTEMSTATE_DATACHANGED and waits for it
+func (z *Z21Roco) ReadStationState(timeout time.Duration) (z21proto.SystemState, error) {
+	msg, err := z.request(z21proto.SystemStateGetData{}, time.Now().Add(timeout), nil, z21proto.SystemState{})
+	if err != nil {
+		return z21proto.SystemState{}, fmt.Errorf("cannot read the state of the command station: %w", err)
+	}
+	return msg.(z21proto.SystemState), nil
+}
+
+// rememberStationState updates the state from a message, the subscribers are called when the state changed
+func (z *Z21Roco) rememberStationState(msg z21proto.Message, at time.Time) {
+	const powerStates = z21proto.CsEmergencyStop | z21proto.CsTrackVoltageOff | z21proto.CsShortCircuit | z21proto.CsProgrammingModeActive
+
+	z.central.mu.Lock()
+	state := z.central.state
+	switch m := msg.(type) {
+	case z21proto.SystemState:
+		state.Central, state.CentralEx = m.CentralState, m.CentralStateEx
+	case z21proto.StatusChanged:
+		state.Central = m.Status
+	case z21proto.Stopped:
+		state.Central |= z21proto.CsEmergencyStop
+	case z21proto.TrackPowerOff:
+		state.Central |= z21proto.CsTrackVoltageOff
+	case z21proto.TrackShortCircuit:
+		state.Central |= z21proto.CsShortCircuit
+	case z21proto.ProgrammingMode:
+		state.Central |= z21proto.CsProgrammingModeActive
+	case z21proto.TrackPowerOn:
+		state.Central &^= powerStates
+	default:
+		z.central.mu.Unlock()
+		return
+	}
+	changed := !z.central.known || state.Central != z.central.state.Central || state.CentralEx != z.central.state.CentralEx
+	state.LastSeen = at
+	z.central.state, z.central.known = state, true
+	z.central.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	z.events.mu.Lock()
+	callbacks := make([]func(StationState), 0, len(z.events.stationState))
+	for _, cb := range z.events.stationState {
+		callbacks = append(callbacks, cb)
+	}
+	z.events.mu.Unlock()
+	for _, cb := range callbacks {
+		cb(state)
+	}
+}
+
+// explainFailure adds the known conditions of the command station to an error of a request
+func (z *Z21Roco) explainFailure(err error) error {
+	state, known := z.StationState()
+	if err == nil || !known {
+		return err
+	}
+	// expected while a CV is read or written on the programming track
+	state.Central &^= z21proto.CsProgrammingModeActive
+	if conditions := state.Conditions(); len(conditions) > 0 {
+		return fmt.Errorf("%w (command station: %s)", err, strings.Join(conditions, ", "))
+	}
+	return err
+}
+
+// ErrStationUnreachable is returned by Preflight when the command station does not answer
+var ErrStationUnreachable = errors.New("the command station does not answer")
+
+// Preflight checks, before a batch of operations, that the command station answers and that the track can be used
+// in the given mode, so the batch does not fail in its middle. The programming track works without the main track
+// power, only a short circuit stops it.
+func (z *Z21Roco) Preflight(mode Mode, timeout time.Duration) error {
+	if z.dryRun != nil {
+		return nil
+	}
+	if _, err := z.request(z21proto.GetSerialNumber{}, time.Now().Add(timeout), nil, z21proto.SerialNumber{}); err != nil {
+		return fmt.Errorf("%w: %w", ErrStationUnreachable, err)
+	}
+	if z.lockedStart() {
+		return errLockedStart()
+	}
+	msg, err := z.request(z21proto.GetStatus{}, time.Now().Add(timeout), nil, z21proto.StatusChanged{})
+	if err != nil {
+		return fmt.Errorf("cannot read the track power state: %w", err)
+	}
+	blocking := z21proto.CsEmergencyStop | z21proto.CsTrackVoltageOff | z21proto.CsShortCircuit
+	if mode == ProgrammingTrackMode {
+		blocking = z21proto.CsShortCircuit
+	}
+	if state := msg.(z21proto.StatusChanged).Status & blocking; state != 0 {
+		return fmt.Errorf("the track cannot be used: %s", state)
+	}
+	return nil
+}
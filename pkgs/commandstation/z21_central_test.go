@@ -0,0 +1,40 @@
+package commandstation
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+)
+
+func TestStationState(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	z := &Z21Roco{conn: client}
+	defer z.CleanUp()
+
+	var changes []StationState
+	z.OnStationState(func(state StationState) { changes = append(changes, state) })
+
+	go func() {
+		_, _ = server.Write(append(z21proto.TrackPowerOff{}.Encode(), z21proto.StatusChanged{Status: z21proto.CsTrackVoltageOff}.Encode()...))
+	}()
+	if _, err := z.receive(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+
+	state, ok := z.StationState()
+	if !ok || len(state.Conditions()) != 1 || state.Conditions()[0] != "track voltage off" {
+		t.Fatalf("unexpected state %+v", state)
+	}
+	if len(changes) != 1 {
+		t.Fatalf("expected a single change, got %d", len(changes))
+	}
+	err := z.explainFailure(errors.New("cannot read CV"))
+	if !strings.HasSuffix(err.Error(), "(command station: track voltage off)") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package commandstation
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: a single goroutine reads the socket and routes every message to the operation waiting for it.
+// Operations register a wait queue for the message types of the answer before sending the request,
+// so overlapping operations (e.g. ListFunctions while a CV is read) cannot consume each other's answers.
+//
+
+// waiter is a registered wait for a single answer
+type waiter struct {
+	types  []reflect.Type
+	accept func(z21proto.Message) bool
+	result chan waitResult
+}
+
+type waitResult struct {
+	msg z21proto.Message
+	err error
+}
+
+// demux routes messages read by the reader to the waiters, keyed by message type in registration order
+type demux struct {
+	mu      sync.Mutex
+	waiters map[reflect.Type][]*waiter
+	// conn is read by the current reader, stopped is closed with err set when the reader ends
+	conn    net.Conn
+	stopped chan struct{}
+	err     error
+}
+
+// startReader makes sure the active connection is read, after a failover a new reader is started for the new connection.
+// The returned channel is closed when the reader stops.
+func (z *Z21Roco) startReader() <-chan struct{} {
+	z.demux.mu.Lock()
+	defer z.demux.mu.Unlock()
+	if z.conn == nil || z.demux.conn == z.conn {
+		return z.demux.stopped
+	}
+	conn, stopped := z.conn, make(chan struct{})
+	z.demux.conn, z.demux.stopped, z.demux.err = conn, stopped, nil
+	go z.read(conn, stopped)
+	return stopped
+}
+
+// activeConn is the connection to the active station. A failover replaces it while the reader and Listen run,
+// so it is read and replaced under the lock of the demux.
+func (z *Z21Roco) activeConn() net.Conn {
+	z.demux.mu.Lock()
+	defer z.demux.mu.Unlock()
+	return z.conn
+}
+
+// read receives until the connection is closed. ECONNREFUSED is reported by UDP once per ICMP message
+// and the reading goes on, any other error stops the reader.
+func (z *Z21Roco) read(conn net.Conn, stopped chan struct{}) {
+	defer close(stopped)
+	for {
+		_, err := z.receiveFrom(conn, time.Time{})
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, net.ErrClosed) {
+			logrus.Debugf("z21.read: %s", err)
+			z.demux.fail(err)
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			continue
+		}
+		z.demux.mu.Lock()
+		if z.demux.conn == conn {
+			z.demux.err = err
+		}
+		z.demux.mu.Unlock()
+		return
+	}
+}
+
+// expect registers a wait for the first message of the given types accepted by accept, nil accepts any of them
+func (z *Z21Roco) expect(accept func(z21proto.Message) bool, types ...z21proto.Message) *waiter {
+	z.startReader()
+	w := &waiter{accept: accept, result: make(chan waitResult, 1)}
+	z.demux.mu.Lock()
+	defer z.demux.mu.Unlock()
+	if z.demux.waiters == nil {
+		z.demux.waiters = make(map[reflect.Type][]*waiter)
+	}
+	for _, t := range types {
+		key := reflect.TypeOf(t)
+		w.types = append(w.types, key)
+		z.demux.waiters[key] = append(z.demux.waiters[key], w)
+	}
+	return w
+}
+
+// await waits for the answer until the deadline, the waiter is removed afterwards
+func (z *Z21Roco) await(w *waiter, deadline time.Time) (z21proto.Message, error) {
+	defer z.demux.remove(w)
+	if z.dryRun != nil {
+		return nil, NotSupported(CapabilityReadBack, "dry-run: no response from the command station")
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	z.demux.mu.Lock()
+	stopped, readerErr := z.demux.stopped, z.demux.err
+	z.demux.mu.Unlock()
+	if readerErr != nil {
+		return nil, readerErr
+	}
+
+	select {
+	case res := <-w.result:
+		return res.msg, res.err
+	case <-stopped:
+		// the reader may have delivered the answer just before it ended
+		select {
+		case res := <-w.result:
+			return res.msg, res.err
+		default:
+		}
+		z.demux.mu.Lock()
+		defer z.demux.mu.Unlock()
+		if z.demux.err != nil {
+			return nil, z.demux.err
+		}
+		return nil, net.ErrClosed
+	case <-timer.C:
+		return nil, errNoResponse
+	}
+}
+
+// request sends req and waits for its answer, see expect
+func (z *Z21Roco) request(req z21proto.Message, deadline time.Time, accept func(z21proto.Message) bool, answers ...z21proto.Message) (z21proto.Message, error) {
+	w := z.expect(accept, answers...)
+	if err := z.send(req); err != nil {
+		z.demux.remove(w)
+		return nil, err
+	}
+	return z.await(w, deadline)
+}
+
+// route passes the message to the oldest waiter of its type that accepts it, it returns false when nobody waits for it
+func (d *demux) route(msg z21proto.Message) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, w := range d.waiters[reflect.TypeOf(msg)] {
+		if w.accept == nil || w.accept(msg) {
+			d.removeLocked(w)
+			w.result <- waitResult{msg: msg}
+			return true
+		}
+	}
+	return false
+}
+
+// fail passes a read error to everybody waiting
+func (d *demux) fail(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	failed := map[*waiter]bool{}
+	for _, waiters := range d.waiters {
+		for _, w := range waiters {
+			failed[w] = true
+		}
+	}
+	for w := range failed {
+		d.removeLocked(w)
+		w.result <- waitResult{err: err}
+	}
+}
+
+func (d *demux) remove(w *waiter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.removeLocked(w)
+}
+
+func (d *demux) removeLocked(w *waiter) {
+	for _, key := range w.types {
+		waiters := d.waiters[key]
+		for i, candidate := range waiters {
+			if candidate == w {
+				d.waiters[key] = append(waiters[:i:i], waiters[i+1:]...)
+				break
+			}
+		}
+	}
+	w.types = nil
+}
@@ -0,0 +1,70 @@
+package commandstation
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+)
+
+func TestDemux_OverlappingRequests(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	z := &Z21Roco{conn: client, Timeout: time.Second}
+	defer z.CleanUp()
+
+	go func() {
+		// wait for both requests, then answer them in a single datagram, preceded by a late result of another CV
+		buf := make([]byte, 1500)
+		for i := 0; i < 2; i++ {
+			if _, err := server.Read(buf); err != nil {
+				return
+			}
+		}
+		datagram := append(z21proto.CVResult{CV: 8, Value: 13}.Encode(), z21proto.LocoInfo{Addr: 3, Functions: z21proto.FunctionStates(0).Set(5, true)}.Encode()...)
+		datagram = append(datagram, z21proto.CVResult{CV: 29, Value: 6}.Encode()...)
+		_, _ = server.Write(datagram)
+	}()
+
+	type cvRead struct {
+		value int
+		err   error
+	}
+	cv := make(chan cvRead, 1)
+	go func() {
+		value, err := z.ReadCV(MainTrackMode, LocoCV{LocoId: 3, Cv: CV{Num: 29}}, Retries(0), Timeout(time.Second))
+		cv <- cvRead{value, err}
+	}()
+
+	functions, err := z.ListFunctions(3)
+	if err != nil {
+		t.Fatalf("ListFunctions: %v", err)
+	}
+	if len(functions) != 1 || functions[0] != 5 {
+		t.Fatalf("unexpected functions: %v", functions)
+	}
+	read := <-cv
+	if read.err != nil || read.value != 6 {
+		t.Fatalf("ReadCV: got %d, %v, expected 6", read.value, read.err)
+	}
+}
+
+func TestDemux_NoResponse(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	z := &Z21Roco{conn: client}
+	defer z.CleanUp()
+
+	go func() {
+		buf := make([]byte, 1500)
+		_, _ = server.Read(buf)
+		// an answer nobody waits for
+		_, _ = server.Write(z21proto.CVResult{CV: 1, Value: 3}.Encode())
+	}()
+
+	_, err := z.request(z21proto.GetSerialNumber{}, time.Now().Add(200*time.Millisecond), nil, z21proto.SerialNumber{})
+	if err != errNoResponse {
+		t.Fatalf("expected errNoResponse, got %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package commandstation
+
+import (
+	"sync"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: broadcasts sent by the Z21 on its own, e.g. when another throttle changes a locomotive.
+// Every message read from the socket is passed to the subscribers - also the ones received while
+// waiting for an answer to a request.
+//
+
+type subscribers struct {
+	mu          sync.Mutex
+	nextId      int
+	locoInfo    map[int]func(z21proto.LocoInfo)
+	systemState map[int]func(z21proto.SystemState)
+	// stationState is called on changes only, see OnStationState
+	stationState map[int]func(StationState)
+	all          map[int]func(z21proto.Message)
+	records      map[int]func([]byte)
+}
+
+// OnRecord registers a callback for every raw record read from the socket, before it is decoded.
+// Records that cannot be decoded are passed as well. The record must not be modified or kept by the callback.
+// The returned function removes the subscription.
+func (z *Z21Roco) OnRecord(callback func(record []byte)) (unsubscribe func()) {
+	z.events.mu.Lock()
+	defer z.events.mu.Unlock()
+	if z.events.records == nil {
+		z.events.records = make(map[int]func([]byte))
+	}
+	id := z.events.nextId
+	z.events.nextId++
+	z.events.records[id] = callback
+	return func() {
+		z.events.mu.Lock()
+		defer z.events.mu.Unlock()
+		delete(z.events.records, id)
+	}
+}
+
+// OnMessage registers a callback for every decoded message read from the socket, including answers to requests.
+// The returned function removes the subscription.
+func (z *Z21Roco) OnMessage(callback func(msg z21proto.Message)) (unsubscribe func()) {
+	z.events.mu.Lock()
+	defer z.events.mu.Unlock()
+	if z.events.all == nil {
+		z.events.all = make(map[int]func(z21proto.Message))
+	}
+	id := z.events.nextId
+	z.events.nextId++
+	z.events.all[id] = callback
+	return func() {
+		z.events.mu.Lock()
+		defer z.events.mu.Unlock()
+		delete(z.events.all, id)
+	}
+}
+
+// OnLocoInfo registers a callback for LAN_X_LOCO_INFO. The Z21 sends it only for locomotives
+// the client is subscribed to (by a previous LAN_X_GET_LOCO_INFO), or for all of them with z21proto.BroadcastAllLocoInfo.
+// The returned function removes the subscription.
+func (z *Z21Roco) OnLocoInfo(callback func(info z21proto.LocoInfo)) (unsubscribe func()) {
+	z.events.mu.Lock()
+	defer z.events.mu.Unlock()
+	if z.events.locoInfo == nil {
+		z.events.locoInfo = make(map[int]func(z21proto.LocoInfo))
+	}
+	id := z.events.nextId
+	z.events.nextId++
+	z.events.locoInfo[id] = callback
+	return func() {
+		z.events.mu.Lock()
+		defer z.events.mu.Unlock()
+		delete(z.events.locoInfo, id)
+	}
+}
+
+// OnSystemState registers a callback for LAN_SYSTEMSTATE_DATACHANGED, sent with z21proto.BroadcastSystemState.
+// The returned function removes the subscription.
+func (z *Z21Roco) OnSystemState(callback func(state z21proto.SystemState)) (unsubscribe func()) {
+	z.events.mu.Lock()
+	defer z.events.mu.Unlock()
+	if z.events.systemState == nil {
+		z.events.systemState = make(map[int]func(z21proto.SystemState))
+	}
+	id := z.events.nextId
+	z.events.nextId++
+	z.events.systemState[id] = callback
+	return func() {
+		z.events.mu.Lock()
+		defer z.events.mu.Unlock()
+		delete(z.events.systemState, id)
+	}
+}
+
+// dispatchRecord passes a raw record to the subscribers, before it is decoded
+func (z *Z21Roco) dispatchRecord(record []byte) {
+	z.events.mu.Lock()
+	callbacks := make([]func([]byte), 0, len(z.events.records))
+	for _, cb := range z.events.records {
+		callbacks = append(callbacks, cb)
+	}
+	z.events.mu.Unlock()
+
+	for _, cb := range callbacks {
+		cb(record)
+	}
+}
+
+// dispatch passes a message to the subscribers, callbacks run synchronously on the reading goroutine
+func (z *Z21Roco) dispatch(msg z21proto.Message) {
+	z.events.mu.Lock()
+	var callbacks []func()
+	for _, cb := range z.events.all {
+		cb := cb
+		callbacks = append(callbacks, func() { cb(msg) })
+	}
+	switch m := msg.(type) {
+	case z21proto.LocoInfo:
+		for _, cb := range z.events.locoInfo {
+			cb := cb
+			callbacks = append(callbacks, func() { cb(m) })
+		}
+	case z21proto.SystemState:
+		for _, cb := range z.events.systemState {
+			cb := cb
+			callbacks = append(callbacks, func() { cb(m) })
+		}
+	}
+	z.events.mu.Unlock()
+
+	// called without the lock, so a callback may unsubscribe itself
+	for _, cb := range callbacks {
+		cb()
+	}
+}
+
+// Subscribe asks the Z21 to send the given broadcasts to this client.
+// The Z21 forgets the flags when the client logs off or stays silent for over a minute.
+func (z *Z21Roco) Subscribe(flags z21proto.BroadcastFlags) error {
+	return z.send(z21proto.SetBroadcastFlags{Flags: flags})
+}
+
+// PollSystemState asks for LAN_SYSTEMSTATE_DATACHANGED without waiting, the answer is passed to the subscribers
+// by the next receive, e.g. in Listen
+func (z *Z21Roco) PollSystemState() error {
+	return z.send(z21proto.SystemStateGetData{})
+}
+
+// Listen keeps passing broadcasts to the subscribers until stop is closed or the connection fails.
+// Requests may be sent from other goroutines meanwhile, their answers are routed to them.
+func (z *Z21Roco) Listen(stop <-chan struct{}) error {
+	if z.dryRun != nil {
+		return NotSupported(CapabilityReadBack, "dry-run: no response from the command station")
+	}
+	for {
+		stopped := z.startReader()
+		select {
+		case <-stop:
+			return nil
+		case <-stopped:
+		}
+
+		z.demux.mu.Lock()
+		restarted := z.demux.stopped != stopped || z.demux.conn != z.conn
+		err := z.demux.err
+		z.demux.mu.Unlock()
+		if restarted {
+			continue // failed over, read the new connection
+		}
+		if err != nil {
+			logrus.Debugf("z21.Listen: %s", err)
+			return err
+		}
+		return nil // closed by CleanUp
+	}
+}
@@ -0,0 +1,71 @@
+package commandstation
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+)
+
+func TestBroadcastSubscribers(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	z := &Z21Roco{conn: client}
+
+	var infos []z21proto.LocoInfo
+	var states []z21proto.SystemState
+	unsubscribe := z.OnLocoInfo(func(info z21proto.LocoInfo) { infos = append(infos, info) })
+	z.OnSystemState(func(state z21proto.SystemState) { states = append(states, state) })
+
+	go func() {
+		// two records in one datagram, as the Z21 does for bursts of broadcasts
+		datagram := append(z21proto.LocoInfo{Addr: 3, Steps: z21proto.Steps128, Speed: 20}.Encode(),
+			z21proto.SystemState{MainCurrent: 120, CentralState: z21proto.CsTrackVoltageOff}.Encode()...)
+		_, _ = server.Write(datagram)
+		_, _ = server.Write(z21proto.LocoInfo{Addr: 4}.Encode())
+	}()
+
+	if _, err := z.receive(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	unsubscribe()
+	if _, err := z.receive(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+
+	if len(infos) != 1 || infos[0].Addr != 3 || infos[0].Speed != 20 {
+		t.Fatalf("unexpected loco info broadcasts: %+v", infos)
+	}
+	if len(states) != 1 || states[0].MainCurrent != 120 || states[0].CentralState != z21proto.CsTrackVoltageOff {
+		t.Fatalf("unexpected system state broadcasts: %+v", states)
+	}
+}
+
+func TestRecordSubscribers(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	z := &Z21Roco{conn: client}
+
+	var records [][]byte
+	z.OnRecord(func(record []byte) { records = append(records, append([]byte(nil), record...)) })
+
+	go func() {
+		// the second record has an unknown header and is not decoded, but still reported
+		datagram := append(z21proto.TrackPowerOff{}.Encode(), 0x04, 0x00, 0xEE, 0x00)
+		_, _ = server.Write(datagram)
+	}()
+
+	messages, err := z.receive(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("expected one decoded message, got %+v", messages)
+	}
+	if len(records) != 2 || records[1][2] != 0xEE {
+		t.Fatalf("unexpected records: % X", records)
+	}
+}
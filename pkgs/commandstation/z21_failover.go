@@ -0,0 +1,108 @@
+package commandstation
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: failover to a backup command station, e.g. on club layouts with redundant controllers.
+// The primary station is used as long as it answers. When it is unreachable at start,
+// or stops answering a request, the next station is used for the rest of the session.
+//
+
+// failoverProbeTimeout is how long a station has to answer LAN_GET_SERIAL_NUMBER at start, when there are backups
+const failoverProbeTimeout = time.Second
+
+// errNoResponse is returned when the station kept silent, or sent only unrelated packets until the deadline
+var errNoResponse = fmt.Errorf("no response or unrecognized response until the %w", ErrTimeout)
+
+// NewZ21RocoWithBackups is NewZ21Roco with backup stations given as "host:port".
+// The first station that answers is used, a warning is logged for every station that does not.
+func NewZ21RocoWithBackups(transport string, netAddr string, netPort uint16, backups []string, defaults ...ctxOptions) (*Z21Roco, error) {
+	roco := Z21Roco{Timeout: time.Second * 10, StateMaxAge: DefaultLocoStateMaxAge, wasPowerCutOff: false, defaults: defaults, transport: transport}
+	roco.LimitRate(Z21DefaultRateLimit, Z21DefaultBurst)
+	roco.endpoints = append([]string{fmt.Sprintf("%s:%d", netAddr, netPort)}, backups...)
+
+	if len(roco.endpoints) == 1 {
+		return &roco, roco.connect(transport, roco.endpoints[0])
+	}
+	var lastErr error
+	for i, endpoint := range roco.endpoints {
+		roco.active = i
+		if err := roco.connect(transport, endpoint); err != nil {
+			lastErr = err
+		} else if err := roco.probe(); err != nil {
+			_ = roco.activeConn().Close()
+			roco.demux.mu.Lock()
+			roco.conn = nil
+			roco.demux.mu.Unlock()
+			lastErr = fmt.Errorf("command station %s does not answer: %w", endpoint, err)
+		} else {
+			return &roco, nil
+		}
+		logrus.Warnf("%s, trying the next command station", lastErr)
+	}
+	return &roco, lastErr
+}
+
+// probe checks that the connected station answers
+func (z *Z21Roco) probe() error {
+	_, err := z.request(z21proto.GetSerialNumber{}, time.Now().Add(failoverProbeTimeout), nil, z21proto.SerialNumber{})
+	return err
+}
+
+// unanswered tells if the error means the station is gone, not that it refused the request
+func unanswered(err error) bool {
+	return errors.Is(err, errResponseTimeout) || errors.Is(err, errNoResponse) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// failover switches to the next station after the connection used for a request stopped answering with reason.
+// It returns false when there is no other station, then the caller reports the original error.
+// Requests that timed out together fail over once: when used was already replaced, the caller
+// tries again with the station that replaced it.
+func (z *Z21Roco) failover(used net.Conn, reason error) bool {
+	if z.dryRun != nil {
+		return false
+	}
+	z.failingOver.Lock()
+	defer z.failingOver.Unlock()
+	if z.activeConn() != used {
+		// closing used ended the requests still waiting on it
+		return unanswered(reason) || errors.Is(reason, net.ErrClosed)
+	}
+	if !unanswered(reason) {
+		return false
+	}
+	for next := z.active + 1; next < len(z.endpoints); next++ {
+		conn, err := dialZ21(z.transport, z.endpoints[next])
+		if err != nil {
+			logrus.Warnf("cannot fail over to command station %s: %s", z.endpoints[next], err)
+			continue
+		}
+		logrus.Warnf("command station %s does not answer (%s), failing over to %s", z.endpoints[z.active], reason, z.endpoints[next])
+		// the new connection is in place before the old one is closed, the reader of the old one ends
+		// and a reader of the new one is started, Listen goes on with it
+		z.demux.mu.Lock()
+		previous := z.conn
+		z.conn = conn
+		z.demux.mu.Unlock()
+		z.active = next
+		if previous != nil {
+			_ = previous.Close()
+		}
+		z.startReader()
+		if z.session != nil {
+			z.session.setPeer(conn.RemoteAddr().String())
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package commandstation
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: R-BUS feedback modules connected to the Z21
+//
+
+// FeedbackStatus polls the state of a group of feedback modules (0 = modules 1-10, 1 = modules 11-20)
+func (z *Z21Roco) FeedbackStatus(group uint8) (z21proto.RMBusDataChanged, error) {
+	if group > 1 {
+		return z21proto.RMBusDataChanged{}, fmt.Errorf("invalid feedback group %d, must be 0 or 1", group)
+	}
+	w := z.expect(func(msg z21proto.Message) bool {
+		return msg.(z21proto.RMBusDataChanged).Group == group
+	}, z21proto.RMBusDataChanged{})
+	conn := z.activeConn()
+	if err := z.send(z21proto.RMBusGetData{Group: group}); err != nil {
+		z.demux.remove(w)
+		return z21proto.RMBusDataChanged{}, fmt.Errorf("failed to send LAN_RMBUS_GETDATA: %w", err)
+	}
+
+	msg, err := z.await(w, time.Now().Add(z.Timeout))
+	if err != nil {
+		if z.failover(conn, err) {
+			return z.FeedbackStatus(group)
+		}
+		return z21proto.RMBusDataChanged{}, fmt.Errorf("failed to read LAN_RMBUS_DATACHANGED: %w", err)
+	}
+	return msg.(z21proto.RMBusDataChanged), nil
+}
+
+// StartFeedbackProgramming makes the Z21 send the programming sequence for the address (1-20) on the R-BUS.
+// Only one feedback module may be connected to the R-BUS until StopFeedbackProgramming is called.
+func (z *Z21Roco) StartFeedbackProgramming(address uint8) error {
+	if address < 1 || address > 20 {
+		return fmt.Errorf("invalid feedback module address %d, must be 1-20", address)
+	}
+	logrus.Debugf("Programming R-BUS feedback module address %d", address)
+	return z.send(z21proto.RMBusProgramModule{Address: address})
+}
+
+// StopFeedbackProgramming ends the R-BUS programming sequence
+func (z *Z21Roco) StopFeedbackProgramming() error {
+	return z.send(z21proto.RMBusProgramModule{Address: 0})
+}
@@ -0,0 +1,75 @@
+package commandstation
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: LAN_X_SET_LOCO_FUNCTION switches a single function, but command stations with an X-BUS older than V3.0
+// ignore it. Those get LAN_X_SET_LOCO_FUNCTION_GROUP instead, the other functions of the group are sent
+// in their last known state.
+//
+
+// xBusSingleFunction is the first X-BUS version that accepts LAN_X_SET_LOCO_FUNCTION
+const xBusSingleFunction = 0x30
+
+type xBusVersion struct {
+	once    sync.Once
+	version uint8
+}
+
+// xBusVersion asks the command station for its X-BUS version once per connection.
+// When it does not answer, single functions are assumed to be supported.
+func (z *Z21Roco) xBusVersion(timeout time.Duration) uint8 {
+	z.xBus.once.Do(func() {
+		z.xBus.version = xBusSingleFunction
+		if z.dryRun != nil {
+			return
+		}
+		msg, err := z.request(z21proto.GetVersion{}, time.Now().Add(timeout), nil, z21proto.Version{})
+		if err != nil {
+			logrus.Debugf("cannot read the X-BUS version, assuming V%X: %s", xBusSingleFunction, err)
+			return
+		}
+		z.xBus.version = msg.(z21proto.Version).XBusVersion
+		logrus.Debugf("X-BUS version: 0x%02X", z.xBus.version)
+	})
+	return z.xBus.version
+}
+
+// sendFnGroup switches a function by sending its whole function group
+func (z *Z21Roco) sendFnGroup(addr LocoAddr, fn int, action FnAction, ctx RequestContext) error {
+	group, ok := z21proto.FunctionGroupOf(fn)
+	if !ok {
+		return fmt.Errorf("SendFn: unsupported function number %d (must be 0-31)", fn)
+	}
+	info, err := z.locoInfo(addr, ctx)
+	if err != nil {
+		return fmt.Errorf("SendFn: cannot read the other functions of the group: %w", err)
+	}
+	on := action == FnOn || (action == FnToggle && !info.Functions.Get(fn))
+	req := z21proto.SetLocoFunctionGroup{Addr: uint16(addr), Group: group, Functions: info.Functions.Set(fn, on)}
+	logrus.Debugf("req(LAN_X_SET_LOCO_FUNCTION_GROUP): % X", req.Encode())
+	if err := z.sendRepeated(req, ctx); err != nil {
+		return fmt.Errorf("SendFn: cannot write function command: %w", err)
+	}
+	return nil
+}
+
+// SendBinaryState sends LAN_X_SET_LOCO_BINARY_STATE, the Z21 does not report binary states back, so nothing is cached
+func (z *Z21Roco) SendBinaryState(addr LocoAddr, state uint16, on bool, options ...ctxOptions) error {
+	if state == 0 || state > z21proto.MaxBinaryState {
+		return fmt.Errorf("SendBinaryState: unsupported binary state %d (must be 1-%d)", state, z21proto.MaxBinaryState)
+	}
+	req := z21proto.SetLocoBinaryState{Addr: uint16(addr), State: state, On: on}
+	logrus.Debugf("req(LAN_X_SET_LOCO_BINARY_STATE): % X", req.Encode())
+	if err := z.sendRepeated(req, z.newRequestContext(options)); err != nil {
+		return fmt.Errorf("SendBinaryState: cannot write binary state command: %w", err)
+	}
+	return nil
+}
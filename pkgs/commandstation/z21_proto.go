@@ -1,229 +1,137 @@
 package commandstation
 
 import (
-	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
 
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
 	"github.com/sirupsen/logrus"
 )
 
 //
-// Context: This file is containing methods to communicate with a DCC device using a Z21 protocol
+// Context: This file is containing methods to communicate with a DCC device using a Z21 protocol.
+// The packet encoding and decoding itself lives in the z21proto package.
 //
 
-// Read: LAN_X_CV_POM_READ_BYTE (E6 30 … option 0xE4)
-func (z *Z21Roco) buildPomReadPacket(lcv LocoCV) []byte {
-	const dataLen, header = 0x000C, 0x0040
-	cvWire := lcv.Cv.Translate()
+// errResponseTimeout is returned by receive when nothing arrives until the deadline
+var errResponseTimeout = fmt.Errorf("response %w", ErrTimeout)
 
-	adrMSB := byte((lcv.LocoId >> 8) & 0x3F)
-	if lcv.LocoId >= 128 {
-		adrMSB |= 0xC0
-	}
-	adrLSB := byte(lcv.LocoId & 0xFF)
-	db3 := byte(0xE4 | byte((cvWire>>8)&0x03)) // 111001MM
-	db4 := byte(cvWire & 0xFF)
-	x := []byte{0xE6, 0x30, adrMSB, adrLSB, db3, db4, 0x00}
-	x = append(x, xorSum(x))
-	buf := make([]byte, 0, 2+2+len(x))
-	tmp := make([]byte, 2)
-	binary.LittleEndian.PutUint16(tmp, dataLen)
-	buf = append(buf, tmp...)
-	binary.LittleEndian.PutUint16(tmp, header)
-	buf = append(buf, tmp...)
-	return append(buf, x...)
-}
-
-// Write BYTE: LAN_X_CV_POM_WRITE_BYTE (E6 30 … option 0xEC)
-func (z *Z21Roco) buildPomWriteByte(lcv LocoCV) []byte {
-	const dataLen, header = 0x000C, 0x0040
-	addr := lcv.LocoId
-	cvWire := lcv.Cv.Translate()
+// buildCVRequest selects the CV message depending on the track mode
+func (z *Z21Roco) buildCVRequest(mode Mode, lcv LocoCV, isWriteRequest bool) (z21proto.Message, error) {
+	cv := uint16(lcv.Cv.Num)
 	value := byte(lcv.Cv.Value)
 
-	adrMSB := byte((addr >> 8) & 0x3F)
-	if addr >= 128 {
-		adrMSB |= 0xC0
+	switch mode {
+	case MainTrackMode:
+		if isWriteRequest {
+			return z21proto.CVPomWriteByte{Addr: uint16(lcv.LocoId), CV: cv, Value: value}, nil
+		}
+		return z21proto.CVPomReadByte{Addr: uint16(lcv.LocoId), CV: cv}, nil
+	case ProgrammingTrackMode:
+		if isWriteRequest {
+			return z21proto.CVWrite{CV: cv, Value: value}, nil
+		}
+		return z21proto.CVRead{CV: cv}, nil
 	}
-	adrLSB := byte(addr & 0xFF)
-	db3 := byte(0xEC | byte((cvWire>>8)&0x03)) // 111011MM
-	db4 := byte(cvWire & 0xFF)
-	x := []byte{0xE6, 0x30, adrMSB, adrLSB, db3, db4, value}
-	x = append(x, xorSum(x))
-	buf := make([]byte, 0, 2+2+len(x))
-	tmp := make([]byte, 2)
-	binary.LittleEndian.PutUint16(tmp, dataLen)
-	buf = append(buf, tmp...)
-	binary.LittleEndian.PutUint16(tmp, header)
-	buf = append(buf, tmp...)
-	return append(buf, x...)
-}
-
-// ===== PROG (Programming Track / Direct Mode) =====
-// Read: LAN_X_CV_READ (23 11)
-func (z *Z21Roco) buildProgReadPacket(cv CV) []byte {
-	const dataLen, header = 0x000B, 0x0040
-	cvWire := cv.Translate()
-
-	x := []byte{0x23, 0x11, byte(cvWire >> 8), byte(cvWire & 0xFF)}
-	x = append(x, xorSum(x))
-	buf := make([]byte, 0, 2+2+len(x))
-	tmp := make([]byte, 2)
-	binary.LittleEndian.PutUint16(tmp, dataLen)
-	buf = append(buf, tmp...)
-	binary.LittleEndian.PutUint16(tmp, header)
-	buf = append(buf, tmp...)
-	return append(buf, x...)
-}
-
-// Write: LAN_X_CV_WRITE (24 12)
-func (z *Z21Roco) buildProgWritePacket(lcv LocoCV) []byte {
-	const dataLen, header = 0x000A, 0x0040
-	cvWire := lcv.Cv.Translate()
-	value := byte(lcv.Cv.Value)
-
-	x := []byte{0x24, 0x12, byte(cvWire >> 8), byte(cvWire & 0xFF), value}
-	x = append(x, xorSum(x))
-	buf := make([]byte, 0, 2+2+len(x))
-	tmp := make([]byte, 2)
-	binary.LittleEndian.PutUint16(tmp, dataLen)
-	buf = append(buf, tmp...)
-	binary.LittleEndian.PutUint16(tmp, header)
-	buf = append(buf, tmp...)
-	return append(buf, x...)
+	return nil, errors.New("unrecognized mode")
 }
 
-// Track power ON (get back from programming mode)
-func (z *Z21Roco) buildTrackPowerOn() []byte {
-	const dataLen, header = 0x0007, 0x0040
-	x := []byte{0x21, 0x81}
-	x = append(x, xorSum(x))
-	buf := make([]byte, 0, 2+2+len(x))
-	tmp := make([]byte, 2)
-	binary.LittleEndian.PutUint16(tmp, dataLen)
-	buf = append(buf, tmp...)
-	binary.LittleEndian.PutUint16(tmp, header)
-	buf = append(buf, tmp...)
-	return append(buf, x...)
+// send encodes and writes a single message
+func (z *Z21Roco) send(m z21proto.Message) error {
+	_, err := z.write(m.Encode())
+	return err
 }
 
-// buildGetLocoInfo builds LAN_X_GET_LOCO_INFO command (0xE3 0xF0)
-func (z *Z21Roco) buildGetLocoInfo(addr LocoAddr) []byte {
-	const dataLen, header = 0x0009, 0x0040
-
-	adrMSB := byte((addr >> 8) & 0x3F)
-	if addr >= 128 {
-		adrMSB |= 0xC0
+func (z *Z21Roco) write(b []byte) (n int, err error) {
+	if z.dryRun != nil {
+		z.dryRun(b)
+		return len(b), nil
 	}
-	adrLSB := byte(addr & 0xFF)
-
-	x := []byte{0xE3, 0xF0, adrMSB, adrLSB}
-	x = append(x, xorSum(x))
-
-	buf := make([]byte, 0, 2+2+len(x))
-	tmp := make([]byte, 2)
-	binary.LittleEndian.PutUint16(tmp, dataLen)
-	buf = append(buf, tmp...)
-	binary.LittleEndian.PutUint16(tmp, header)
-	buf = append(buf, tmp...)
-	return append(buf, x...)
-}
-
-// buildSetLocoFunction builds LAN_X_SET_LOCO_FUNCTION command (0xE4 0xF8)
-func (z *Z21Roco) buildSetLocoFunction(addr LocoAddr, fnNum int, on bool) []byte {
-	const dataLen, header = 0x000A, 0x0040
-
-	adrMSB := byte((addr >> 8) & 0x3F)
-	if addr >= 128 {
-		adrMSB |= 0xC0
+	if z.limiter != nil {
+		z.limiter.wait()
 	}
-	adrLSB := byte(addr & 0xFF)
-
-	// DB3: TT FFFFFF where TT = type (00=off, 01=on, 10=toggle), FFFFFF = function number
-	var typeBits byte
-	if on {
-		typeBits = 0x40 // 01 << 6 = turn on
-	} else {
-		typeBits = 0x00 // 00 << 6 = turn off
+	logrus.Debugf("write: % X", b)
+	conn := z.activeConn()
+	n, err = conn.Write(b)
+	if err != nil && z.failover(conn, err) {
+		n, err = z.activeConn().Write(b)
 	}
-	db3 := typeBits | byte(fnNum&0x3F)
-
-	x := []byte{0xE4, 0xF8, adrMSB, adrLSB, db3}
-	x = append(x, xorSum(x))
-
-	buf := make([]byte, 0, 2+2+len(x))
-	tmp := make([]byte, 2)
-	binary.LittleEndian.PutUint16(tmp, dataLen)
-	buf = append(buf, tmp...)
-	binary.LittleEndian.PutUint16(tmp, header)
-	buf = append(buf, tmp...)
-	return append(buf, x...)
+	if err == nil && z.session != nil {
+		z.session.record(SessionSent, b)
+	}
+	return n, err
 }
 
-// buildSetLocoSpeed builds LAN_X_SET_LOCO_DRIVE command (0xE4 0x1S)
-// speedSteps: 0=14 steps, 2=28 steps, 4=128 steps
-// speed: 0=stop, 1=emergency stop, 2-127 (for 128 steps) actual speed
-// forward: true for forward direction, false for reverse
-func (z *Z21Roco) buildSetLocoSpeed(addr LocoAddr, speed uint8, forward bool, speedSteps uint8) []byte {
-	const dataLen, header = 0x000A, 0x0040
-
-	adrMSB := byte((addr >> 8) & 0x3F)
-	if addr >= 128 {
-		adrMSB |= 0xC0
+// receive reads a single datagram from the active connection until the deadline, see receiveFrom
+func (z *Z21Roco) receive(deadline time.Time) ([]z21proto.Message, error) {
+	if z.dryRun != nil {
+		return nil, NotSupported(CapabilityReadBack, "dry-run: no response from the command station")
 	}
-	adrLSB := byte(addr & 0xFF)
-
-	// DB0: 0x1S where S = speed steps (0=14, 2=28, 4=128)
-	db0 := byte(0x10 | (speedSteps & 0x0F))
+	return z.receiveFrom(z.activeConn(), deadline)
+}
 
-	// DB3: RVVVVVVV where R = direction (1=forward) and V = speed
-	var db3 byte
-	if forward {
-		db3 = 0x80 // Set direction bit
+// receiveFrom reads a single datagram until the deadline (none when zero) and decodes all records inside.
+// The messages are passed to the subscribers and to the operation waiting for them.
+// Records that cannot be decoded are logged and skipped.
+func (z *Z21Roco) receiveFrom(conn net.Conn, deadline time.Time) ([]z21proto.Message, error) {
+	_ = conn.SetReadDeadline(deadline)
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, errResponseTimeout
+		}
+		return nil, err
+	}
+	logrus.Debugf("read: % X", buf[:n])
+	if z.session != nil {
+		z.session.record(SessionReceived, buf[:n])
 	}
 
-	// Speed encoding depends on speed steps
-	switch speedSteps {
-	case 0: // 14 speed steps
-		// For DCC 14: speed 0=stop, 1=e-stop, 2-15 are steps 1-14
-		if speed > 15 {
-			speed = 15
-		}
-		db3 |= (speed & 0x0F)
-	case 2: // 28 speed steps
-		// For DCC 28: more complex encoding with bit 5
-		if speed > 28 {
-			speed = 28
-		}
-		if speed > 0 {
-			// Map 1-28 to the encoding shown in the spec
-			speedBits := byte((speed + 3) / 2) // bits 0-3
-			speedBit5 := byte((speed + 3) % 2) // bit 5
-			db3 |= (speedBit5 << 4) | (speedBits & 0x0F)
+	records, splitErr := z21proto.Split(buf[:n])
+	if splitErr != nil {
+		logrus.Debugf("z21.receive: %s", splitErr)
+	}
+	messages := make([]z21proto.Message, 0, len(records))
+	for _, record := range records {
+		z.dispatchRecord(record)
+		msg, decodeErr := z21proto.Decode(record)
+		if decodeErr != nil {
+			logrus.Debugf("z21.receive: skipping record: %s", decodeErr)
+			continue
 		}
-	case 4: // 128 speed steps (default)
-		// For DCC 128: speed 0=stop, 1=e-stop, 2-127 are steps 1-126
-		if speed > 127 {
-			speed = 127
+		messages = append(messages, msg)
+		if info, ok := msg.(z21proto.LocoInfo); ok {
+			z.rememberLocoInfo(info, time.Now())
 		}
-		db3 |= (speed & 0x7F)
-	default:
-		// Default to 128 speed steps
-		db3 |= (speed & 0x7F)
+		z.rememberStationState(msg, time.Now())
+		z.dispatch(msg)
+		z.demux.route(msg)
 	}
-
-	x := []byte{0xE4, db0, adrMSB, adrLSB, db3}
-	x = append(x, xorSum(x))
-
-	buf := make([]byte, 0, 2+2+len(x))
-	tmp := make([]byte, 2)
-	binary.LittleEndian.PutUint16(tmp, dataLen)
-	buf = append(buf, tmp...)
-	binary.LittleEndian.PutUint16(tmp, header)
-	buf = append(buf, tmp...)
-	return append(buf, x...)
+	return messages, nil
 }
 
-func (z *Z21Roco) write(b []byte) (n int, err error) {
-	logrus.Debugf("write: % X", b)
-	return z.conn.Write(b)
+// queryLocoInfo sends LAN_X_GET_LOCO_INFO and waits for the matching LAN_X_LOCO_INFO
+func (z *Z21Roco) queryLocoInfo(addr LocoAddr, timeout time.Duration) (z21proto.LocoInfo, error) {
+	req := z21proto.GetLocoInfo{Addr: uint16(addr)}
+	logrus.Debugf("req(LAN_X_GET_LOCO_INFO): % X", req.Encode())
+	w := z.expect(func(msg z21proto.Message) bool {
+		return msg.(z21proto.LocoInfo).Addr == uint16(addr)
+	}, z21proto.LocoInfo{})
+	conn := z.activeConn()
+	if err := z.send(req); err != nil {
+		z.demux.remove(w)
+		return z21proto.LocoInfo{}, fmt.Errorf("failed to send LAN_X_GET_LOCO_INFO: %w", err)
+	}
+
+	msg, err := z.await(w, time.Now().Add(timeout))
+	if err != nil {
+		if z.failover(conn, err) {
+			return z.queryLocoInfo(addr, timeout)
+		}
+		return z21proto.LocoInfo{}, fmt.Errorf("failed to read LAN_X_LOCO_INFO response: %w", err)
+	}
+	return msg.(z21proto.LocoInfo), nil
 }
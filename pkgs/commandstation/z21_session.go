@@ -0,0 +1,139 @@
+package commandstation
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Context: recording of all datagrams exchanged with the Z21, so a problem seen by a user
+// can be analyzed without their hardware. Every session starts with a header line followed by one JSON object per datagram,
+// sessions of several commands or stations can be appended to a single file.
+//
+
+// ErrNotSession is returned by ReadSession for files that are not a session recording
+var ErrNotSession = errors.New("not a session recording")
+
+// SessionFormat identifies session recordings in the header line
+const SessionFormat = "z21-session"
+
+// SessionDirection tells if the datagram was sent to or received from the Z21
+type SessionDirection string
+
+const (
+	SessionSent     SessionDirection = "tx"
+	SessionReceived SessionDirection = "rx"
+)
+
+// SessionHeader is the first line of a session recording
+type SessionHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Started time.Time `json:"started"`
+}
+
+// SessionDatagram is a single recorded datagram, it may contain more than one Z21 packet
+type SessionDatagram struct {
+	Time      time.Time        `json:"time"`
+	Direction SessionDirection `json:"dir"`
+	Peer      string           `json:"peer,omitempty"`
+	Data      SessionBytes     `json:"data"`
+}
+
+// SessionBytes are stored as space separated hex, the same way they are logged in debug mode
+type SessionBytes []byte
+
+func (b SessionBytes) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("% X", []byte(b))), nil
+}
+
+func (b *SessionBytes) UnmarshalText(text []byte) error {
+	decoded, err := hex.DecodeString(strings.ReplaceAll(string(text), " ", ""))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// sessionRecorder writes datagrams as they are sent and received, it is safe for concurrent use
+type sessionRecorder struct {
+	mu   sync.Mutex
+	out  io.WriteCloser
+	enc  *json.Encoder
+	peer string
+}
+
+func (s *sessionRecorder) record(direction SessionDirection, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// a broken recording must not break the communication itself
+	_ = s.enc.Encode(SessionDatagram{Time: time.Now(), Direction: direction, Peer: s.peer, Data: append(SessionBytes(nil), data...)})
+}
+
+// setPeer changes the station the following datagrams are exchanged with, after a failover
+func (s *sessionRecorder) setPeer(peer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peer = peer
+}
+
+func (s *sessionRecorder) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.out.Close()
+}
+
+// RecordSession writes every datagram sent and received from now on to out, out is closed by CleanUp
+func (z *Z21Roco) RecordSession(out io.WriteCloser) error {
+	enc := json.NewEncoder(out)
+	if err := enc.Encode(SessionHeader{Format: SessionFormat, Version: 1, Started: time.Now()}); err != nil {
+		return fmt.Errorf("cannot write the session header: %w", err)
+	}
+	recorder := &sessionRecorder{out: out, enc: enc}
+	if conn := z.activeConn(); conn != nil {
+		recorder.peer = conn.RemoteAddr().String()
+	}
+	z.session = recorder
+	return nil
+}
+
+// ReadSession parses a recording written by RecordSession, the header of the first session is returned
+func ReadSession(r io.Reader) (SessionHeader, []SessionDatagram, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var header SessionHeader
+	if !scanner.Scan() {
+		return header, nil, fmt.Errorf("%w: the file is empty", ErrNotSession)
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Format != SessionFormat {
+		return header, nil, fmt.Errorf("%w: missing the %s header", ErrNotSession, SessionFormat)
+	}
+
+	var datagrams []SessionDatagram
+	for line := 2; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var entry struct {
+			SessionDatagram
+			Format string `json:"format"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return header, datagrams, fmt.Errorf("line %d: %w", line, err)
+		}
+		if entry.Format == SessionFormat {
+			continue // an appended session
+		}
+		datagrams = append(datagrams, entry.SessionDatagram)
+	}
+	return header, datagrams, scanner.Err()
+}
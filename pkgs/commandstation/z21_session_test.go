@@ -0,0 +1,74 @@
+package commandstation
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestSessionRecording(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	z := &Z21Roco{conn: client}
+	out := &bufferCloser{}
+	if err := z.RecordSession(out); err != nil {
+		t.Fatalf("RecordSession: %v", err)
+	}
+
+	go func() {
+		buf := make([]byte, 64)
+		_, _ = server.Read(buf)
+		_, _ = server.Write(z21proto.CVResult{CV: 8, Value: 145}.Encode())
+	}()
+	if err := z.send(z21proto.CVRead{CV: 8}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if _, err := z.receive(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if err := z.CleanUp(); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+	if !out.closed {
+		t.Error("the recording was not closed")
+	}
+
+	header, datagrams, err := ReadSession(&out.Buffer)
+	if err != nil {
+		t.Fatalf("ReadSession: %v", err)
+	}
+	if header.Format != SessionFormat {
+		t.Errorf("unexpected header: %+v", header)
+	}
+	if len(datagrams) != 2 {
+		t.Fatalf("expected 2 datagrams, got %+v", datagrams)
+	}
+	if datagrams[0].Direction != SessionSent || datagrams[0].Peer == "" || !bytes.Equal(datagrams[0].Data, z21proto.CVRead{CV: 8}.Encode()) {
+		t.Errorf("unexpected sent datagram: %+v", datagrams[0])
+	}
+	if datagrams[1].Direction != SessionReceived || z21proto.Annotate(datagrams[1].Data) != "LAN_X_CV_RESULT CV8=145" {
+		t.Errorf("unexpected received datagram: %+v", datagrams[1])
+	}
+}
+
+func TestReadSession_NotASession(t *testing.T) {
+	for _, input := range []string{"", `{"loco": 3, "events": []}`} {
+		if _, _, err := ReadSession(bytes.NewBufferString(input)); !errors.Is(err, ErrNotSession) {
+			t.Errorf("ReadSession(%q) = %v, expected ErrNotSession", input, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package commandstation
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: the last known state of every locomotive seen on the connection. LAN_X_LOCO_INFO is read on every
+// answer and broadcast, so while the client stays subscribed the cache is fresher than an explicit query would be.
+//
+
+// DefaultLocoStateMaxAge is how long a state reported by the Z21 is trusted without asking again
+const DefaultLocoStateMaxAge = 30 * time.Second
+
+// LocoState is the last known state of a locomotive
+type LocoState struct {
+	z21proto.LocoInfo
+	// LastSeen is when the command station reported the state, it is zero when it was only changed by this client
+	LastSeen time.Time
+}
+
+type locoStates struct {
+	mu     sync.Mutex
+	states map[LocoAddr]LocoState
+}
+
+// update changes the state of a locomotive under the lock, creating it when it is not known yet
+func (s *locoStates) update(addr LocoAddr, change func(state *LocoState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.states == nil {
+		s.states = make(map[LocoAddr]LocoState)
+	}
+	state, ok := s.states[addr]
+	if !ok {
+		state.Addr = uint16(addr)
+	}
+	change(&state)
+	s.states[addr] = state
+}
+
+func (s *locoStates) get(addr LocoAddr) (LocoState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[addr]
+	return state, ok
+}
+
+// LocoState returns the cached state of a locomotive, false when the connection has not seen it yet
+func (z *Z21Roco) LocoState(addr LocoAddr) (LocoState, bool) {
+	return z.locos.get(addr)
+}
+
+// rememberLocoInfo stores a LAN_X_LOCO_INFO, it is called for every one read from the socket
+func (z *Z21Roco) rememberLocoInfo(info z21proto.LocoInfo, at time.Time) {
+	z.locos.update(LocoAddr(info.Addr), func(state *LocoState) {
+		state.LocoInfo = info
+		state.LastSeen = at
+	})
+}
+
+// ControlledElsewhere tells whether another device (e.g. the Z21 app or a handset) drives the locomotive.
+// The Z21 hands a locomotive over to whoever sends the next driving command for it.
+func (z *Z21Roco) ControlledElsewhere(addr LocoAddr, options ...ctxOptions) (bool, error) {
+	info, err := z.locoInfo(addr, z.newRequestContext(options))
+	if err != nil {
+		return false, err
+	}
+	return info.Busy, nil
+}
+
+// locoInfo answers from the cache when the Z21 reported the locomotive within StateMaxAge, otherwise it asks the Z21
+func (z *Z21Roco) locoInfo(addr LocoAddr, ctx RequestContext) (z21proto.LocoInfo, error) {
+	if state, ok := z.locos.get(addr); ok && !state.LastSeen.IsZero() && time.Since(state.LastSeen) <= z.StateMaxAge {
+		return state.LocoInfo, nil
+	}
+	var info z21proto.LocoInfo
+	var err error
+	for attempt := 0; attempt <= int(ctx.retries); attempt++ {
+		if attempt > 0 {
+			logrus.Debugf("retry [%d/%d]: LAN_X_GET_LOCO_INFO for %d: %s", attempt, ctx.retries, addr, err)
+			time.Sleep(ctx.retryDelay)
+		}
+		info, err = z.queryLocoInfo(addr, ctx.timeout)
+		// only a missing answer is worth asking again
+		if err == nil || !(errors.Is(err, errResponseTimeout) || errors.Is(err, errNoResponse)) {
+			return info, err
+		}
+	}
+	return info, err
+}
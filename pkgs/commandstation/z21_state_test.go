@@ -0,0 +1,89 @@
+package commandstation
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+)
+
+func TestLocoStateCache(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	z := &Z21Roco{conn: client, Timeout: time.Second, StateMaxAge: time.Minute}
+	defer z.CleanUp()
+
+	// a broadcast caused by another throttle
+	go func() {
+		_, _ = server.Write(z21proto.LocoInfo{Addr: 3, Steps: z21proto.Steps128, Speed: 40, Forward: true, Functions: z21proto.FunctionStates(0).Set(0, true)}.Encode())
+	}()
+	if _, err := z.receive(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+
+	// answered from the cache, nobody reads the server side of the pipe
+	speed, forward, err := z.GetSpeed(3)
+	if err != nil || speed != 40 || !forward {
+		t.Fatalf("GetSpeed: %d %v %v", speed, forward, err)
+	}
+	functions, err := z.ListFunctions(3)
+	if err != nil || len(functions) != 1 || functions[0] != 0 {
+		t.Fatalf("ListFunctions: %v %v", functions, err)
+	}
+	state, ok := z.LocoState(3)
+	if !ok || state.LastSeen.IsZero() {
+		t.Fatalf("unexpected state %+v", state)
+	}
+
+	// a stale state is queried again
+	z.StateMaxAge = 0
+	go func() {
+		buf := make([]byte, 1500)
+		if _, err := server.Read(buf); err != nil {
+			return
+		}
+		_, _ = server.Write(z21proto.LocoInfo{Addr: 3, Steps: z21proto.Steps128, Speed: 0, Forward: true}.Encode())
+	}()
+	speed, _, err = z.GetSpeed(3)
+	if err != nil || speed != 0 {
+		t.Fatalf("GetSpeed after expiry: %d %v", speed, err)
+	}
+}
+
+func TestLocoInfo_TimeoutAndRetries(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	z := &Z21Roco{conn: client, Timeout: time.Minute}
+	defer z.CleanUp()
+
+	// the first question is lost, like on a slow WiFi, the second one is answered
+	go func() {
+		buf := make([]byte, 1500)
+		for i := 0; i < 2; i++ {
+			if _, err := server.Read(buf); err != nil {
+				return
+			}
+		}
+		_, _ = server.Write(z21proto.LocoInfo{Addr: 3, Steps: z21proto.Steps128, Speed: 12, Forward: true}.Encode())
+	}()
+
+	started := time.Now()
+	speed, _, err := z.GetSpeed(3, Timeout(100*time.Millisecond), Retries(1), RetryDelay(0))
+	if err != nil || speed != 12 {
+		t.Fatalf("GetSpeed: %d %v", speed, err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Fatalf("the per-request timeout was not used, took %s", elapsed)
+	}
+
+	// without retries the lost question is an error
+	z.StateMaxAge = 0
+	go func() {
+		buf := make([]byte, 1500)
+		_, _ = server.Read(buf)
+	}()
+	if _, err := z.ListFunctions(3, Timeout(100*time.Millisecond), Retries(0)); err == nil {
+		t.Fatal("ListFunctions succeeded without an answer")
+	}
+}
@@ -0,0 +1,90 @@
+package commandstation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+)
+
+func TestZ21_RepeatDrivingCommands(t *testing.T) {
+	var sent []string
+	z := NewZ21RocoDryRun(func(packet []byte) {
+		sent = append(sent, z21proto.Annotate(packet))
+	}, Repeat(1))
+
+	if err := z.SetSpeed(3, 40, true, 128, Repeat(2)); err != nil {
+		t.Fatalf("SetSpeed: %v", err)
+	}
+	if len(sent) != 3 {
+		t.Fatalf("expected the speed command 3 times, got %v", sent)
+	}
+
+	// the station default applies
+	sent = nil
+	if err := z.SendFn(MainTrackMode, 3, 5, FnOn); err != nil {
+		t.Fatalf("SendFn: %v", err)
+	}
+	if len(sent) != 2 || sent[0] != sent[1] {
+		t.Fatalf("expected the function command twice, got %v", sent)
+	}
+
+	// a repeated toggle would switch the function back
+	sent = nil
+	if err := z.SendFn(MainTrackMode, 3, 5, FnToggle, Repeat(3)); err != nil {
+		t.Fatalf("SendFn: %v", err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("expected a single toggle, got %v", sent)
+	}
+}
+
+func TestProgSession_RestoresPowerOnce(t *testing.T) {
+	var powerOn int
+	z := NewZ21RocoDryRun(func(packet []byte) {
+		if msg, err := z21proto.Decode(packet); err == nil && msg == (z21proto.SetTrackPowerOn{}) {
+			powerOn++
+		}
+	})
+
+	session := BeginProgSession(z)
+	for cv := CVNum(1); cv <= 3; cv++ {
+		if err := session.WriteCV(CV{Num: cv, Value: 3}); err != nil {
+			t.Fatalf("WriteCV: %v", err)
+		}
+	}
+	if powerOn != 0 {
+		t.Fatalf("the track power was restored during the session")
+	}
+	if err := session.End(); err != nil {
+		t.Fatalf("End: %v", err)
+	}
+	if err := session.WriteCV(CV{Num: 1, Value: 3}); err == nil {
+		t.Fatal("expected an error after the session has ended")
+	}
+	_ = session.End()
+	_ = z.CleanUp()
+	if powerOn != 1 || session.Operations() != 3 {
+		t.Fatalf("expected a single LAN_X_SET_TRACK_POWER_ON after 3 operations, got %d after %d", powerOn, session.Operations())
+	}
+}
+
+func TestZ21_RequestDefaults(t *testing.T) {
+	z := NewZ21RocoDryRun(func([]byte) {}, Retries(5), RetryDelay(time.Second), Settle(400*time.Millisecond))
+
+	// the configured policy replaces the built-in defaults
+	ctx := z.newRequestContext(nil)
+	if ctx.retries != 5 || ctx.retryDelay != time.Second || ctx.settle != 400*time.Millisecond {
+		t.Fatalf("station defaults not applied: %+v", ctx)
+	}
+	// the options of a request, e.g. --retry and --settle, win over the station defaults
+	ctx = z.newRequestContext([]ctxOptions{Retries(0), Settle(0)})
+	if ctx.retries != 0 || ctx.settle != 0 || ctx.retryDelay != time.Second {
+		t.Fatalf("request options not applied: %+v", ctx)
+	}
+	// without a policy the built-in defaults apply
+	ctx = NewZ21RocoDryRun(func([]byte) {}).newRequestContext(nil)
+	if ctx.retries != 2 || ctx.retryDelay != 200*time.Millisecond || ctx.settle != 200*time.Millisecond {
+		t.Fatalf("built-in defaults = %+v", ctx)
+	}
+}
@@ -0,0 +1,64 @@
+package commandstation
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+//
+// Context: transports for the Z21 protocol. Z21 speaks UDP, but the packets carry their own length,
+// so the same protocol can be tunneled over a TCP stream (e.g. through a VPN where UDP is unreliable).
+//
+
+const (
+	TransportUDP = "udp"
+	TransportTCP = "tcp"
+)
+
+// dialZ21 connects using the selected transport, an empty transport means UDP
+func dialZ21(transport string, netAddr string) (net.Conn, error) {
+	switch transport {
+	case "", TransportUDP:
+		conn, err := net.Dial("udp", netAddr)
+		if err != nil {
+			return nil, fmt.Errorf("UDP dial error while connecting to Roco Z21: %w", err)
+		}
+		return conn, nil
+	case TransportTCP:
+		conn, err := net.Dial("tcp", netAddr)
+		if err != nil {
+			return nil, fmt.Errorf("TCP dial error while connecting to Roco Z21: %w", err)
+		}
+		return newFramedConn(conn), nil
+	}
+	return nil, fmt.Errorf("unknown Z21 transport '%s', must be either 'udp' or 'tcp'", transport)
+}
+
+// framedConn restores packet boundaries on a stream: every Read returns exactly one Z21 packet,
+// like a UDP datagram would be
+type framedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newFramedConn(conn net.Conn) *framedConn {
+	return &framedConn{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *framedConn) Read(b []byte) (int, error) {
+	header, err := c.reader.Peek(2)
+	if err != nil {
+		return 0, err
+	}
+	length := int(binary.LittleEndian.Uint16(header))
+	if length < 4 {
+		return 0, fmt.Errorf("invalid Z21 packet length %d in TCP stream", length)
+	}
+	if length > len(b) {
+		return 0, fmt.Errorf("Z21 packet of %d bytes does not fit into the buffer", length)
+	}
+	return io.ReadFull(c.reader, b[:length])
+}
@@ -0,0 +1,36 @@
+package commandstation
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+)
+
+func TestFramedConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	first := z21proto.CVResult{CV: 8, Value: 145}.Encode()
+	second := z21proto.TrackPowerOn{}.Encode()
+	go func() {
+		// both packets in a single write, split in an unusual place on the second one
+		stream := append(append([]byte{}, first...), second...)
+		_, _ = server.Write(stream[:len(first)+1])
+		_, _ = server.Write(stream[len(first)+1:])
+		_ = server.Close()
+	}()
+
+	conn := newFramedConn(client)
+	buf := make([]byte, 1500)
+	for _, want := range [][]byte{first, second} {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Fatalf("Read = % X, want % X", buf[:n], want)
+		}
+	}
+}
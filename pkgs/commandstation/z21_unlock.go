@@ -0,0 +1,84 @@
+package commandstation
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: the z21start is sold with LAN control locked, it ignores CV commands from the network until
+// the activation code (Roco 10814 or 10818) is entered with the Z21 Maintenance Tool. A locked unit does not answer
+// at all, so without asking for LAN_GET_CODE every CV read would end in a timeout.
+//
+
+// featureLockTimeout is how long the command station may take to report its lock,
+// firmware older than 1.20 does not know LAN_GET_CODE and never answers
+const featureLockTimeout = time.Second
+
+// UnlockStatus is the hardware of the command station and the features it has unlocked
+type UnlockStatus struct {
+	Hardware z21proto.HardwareType
+	Firmware z21proto.FirmwareVersion
+	Lock     z21proto.FeatureLock
+}
+
+// Locked tells whether the command station is a z21start that ignores CV commands over LAN
+func (s UnlockStatus) Locked() bool {
+	return s.Lock == z21proto.FeatureStartLocked
+}
+
+type featureLock struct {
+	once   sync.Once
+	locked bool
+}
+
+// ReadUnlockStatus asks the command station for its hardware and LAN_GET_CODE
+func (z *Z21Roco) ReadUnlockStatus(timeout time.Duration) (UnlockStatus, error) {
+	msg, err := z.request(z21proto.GetHardwareInfo{}, time.Now().Add(timeout), nil, z21proto.HardwareInfo{})
+	if err != nil {
+		return UnlockStatus{}, z.explainFailure(err)
+	}
+	info := msg.(z21proto.HardwareInfo)
+	status := UnlockStatus{Hardware: info.Type, Firmware: info.Firmware}
+	msg, err = z.request(z21proto.GetCode{}, time.Now().Add(timeout), nil, z21proto.Code{})
+	if err != nil {
+		return status, z.explainFailure(err)
+	}
+	status.Lock = msg.(z21proto.Code).Lock
+	return status, nil
+}
+
+// lockedStart asks the command station once per connection whether it is a locked z21start.
+// A station that does not answer is assumed to be unlocked.
+func (z *Z21Roco) lockedStart() bool {
+	z.lock.once.Do(func() {
+		if z.dryRun != nil {
+			return
+		}
+		msg, err := z.request(z21proto.GetCode{}, time.Now().Add(featureLockTimeout), nil, z21proto.Code{})
+		if err != nil {
+			logrus.Debugf("cannot read the feature lock, assuming all features are unlocked: %s", err)
+			return
+		}
+		z.lock.locked = msg.(z21proto.Code).Lock == z21proto.FeatureStartLocked
+		logrus.Debugf("feature lock: %s", msg.(z21proto.Code).Lock)
+	})
+	return z.lock.locked
+}
+
+// errLockedStart is the targeted error for a CV command a locked z21start ignored
+func errLockedStart() error {
+	return NotSupported(CapabilityLANProgramming, "the z21start is locked and ignores CV commands over LAN until it is unlocked with the activation code (Roco 10814 or 10818)")
+}
+
+// explainTimeout replaces a timeout of a CV command with errLockedStart when the command station is a locked z21start
+func (z *Z21Roco) explainTimeout(err error) error {
+	if (errors.Is(err, errResponseTimeout) || errors.Is(err, errNoResponse)) && z.lockedStart() {
+		return errLockedStart()
+	}
+	return err
+}
@@ -0,0 +1,164 @@
+package z21proto
+
+import (
+	"fmt"
+	"strings"
+)
+
+//
+// Context: human-readable descriptions of packets, used for debugging and dry-runs
+//
+
+// Annotate decodes a single packet and describes it, e.g. "LAN_X_CV_WRITE CV8=8".
+// Packets that cannot be decoded are described by the reason.
+func Annotate(pkt []byte) string {
+	m, err := Decode(pkt)
+	if err != nil {
+		return fmt.Sprintf("undecodable packet (%s)", err)
+	}
+	return Describe(m)
+}
+
+// Describe returns the protocol name of a message followed by its parameters
+func Describe(m Message) string {
+	switch v := m.(type) {
+	case GetSerialNumber:
+		return "LAN_GET_SERIAL_NUMBER"
+	case SerialNumber:
+		return fmt.Sprintf("LAN_GET_SERIAL_NUMBER reply serial=%d", v.Serial)
+	case GetCode:
+		return "LAN_GET_CODE"
+	case Code:
+		return fmt.Sprintf("LAN_GET_CODE reply code=0x%02X (%s)", byte(v.Lock), v.Lock)
+	case GetHardwareInfo:
+		return "LAN_GET_HWINFO"
+	case HardwareInfo:
+		return fmt.Sprintf("LAN_GET_HWINFO reply type=0x%08X (%s) firmware=%s", uint32(v.Type), v.Type, v.Firmware)
+	case Logoff:
+		return "LAN_LOGOFF"
+	case SetBroadcastFlags:
+		return fmt.Sprintf("LAN_SET_BROADCASTFLAGS flags=0x%08X", uint32(v.Flags))
+	case GetBroadcastFlags:
+		return "LAN_GET_BROADCASTFLAGS"
+	case BroadcastFlagsInfo:
+		return fmt.Sprintf("LAN_GET_BROADCASTFLAGS reply flags=0x%08X", uint32(v.Flags))
+	case SystemStateGetData:
+		return "LAN_SYSTEMSTATE_GETDATA"
+	case SystemState:
+		return fmt.Sprintf("LAN_SYSTEMSTATE_DATACHANGED main=%dmA prog=%dmA temp=%d°C supply=%dmV track=%dmV state=0x%02X stateEx=0x%02X (%s)",
+			v.MainCurrent, v.ProgCurrent, v.Temperature, v.SupplyVoltage, v.VCCVoltage, byte(v.CentralState), byte(v.CentralStateEx),
+			joinConditions(append(v.CentralState.Conditions(), v.CentralStateEx.Conditions()...)))
+	case GetVersion:
+		return "LAN_X_GET_VERSION"
+	case Version:
+		return fmt.Sprintf("LAN_X_GET_VERSION reply xbus=0x%02X id=0x%02X", v.XBusVersion, v.CommandStationID)
+	case GetStatus:
+		return "LAN_X_GET_STATUS"
+	case StatusChanged:
+		return fmt.Sprintf("LAN_X_STATUS_CHANGED state=0x%02X (%s)", byte(v.Status), v.Status)
+	case SetTrackPowerOff:
+		return "LAN_X_SET_TRACK_POWER_OFF"
+	case SetTrackPowerOn:
+		return "LAN_X_SET_TRACK_POWER_ON"
+	case TrackPowerOff:
+		return "LAN_X_BC_TRACK_POWER_OFF"
+	case TrackPowerOn:
+		return "LAN_X_BC_TRACK_POWER_ON"
+	case ProgrammingMode:
+		return "LAN_X_BC_PROGRAMMING_MODE"
+	case TrackShortCircuit:
+		return "LAN_X_BC_TRACK_SHORT_CIRCUIT"
+	case UnknownCommand:
+		return "LAN_X_UNKNOWN_COMMAND"
+	case SetStop:
+		return "LAN_X_SET_STOP"
+	case Stopped:
+		return "LAN_X_BC_STOPPED"
+	case GetFirmwareVersion:
+		return "LAN_X_GET_FIRMWARE_VERSION"
+	case FirmwareVersion:
+		return fmt.Sprintf("LAN_X_GET_FIRMWARE_VERSION reply %s", v)
+	case CVRead:
+		return fmt.Sprintf("LAN_X_CV_READ CV%d", v.CV)
+	case CVWrite:
+		return fmt.Sprintf("LAN_X_CV_WRITE CV%d=%d", v.CV, v.Value)
+	case CVPomReadByte:
+		return fmt.Sprintf("LAN_X_CV_POM_READ_BYTE loco=%d CV%d", v.Addr, v.CV)
+	case CVPomWriteByte:
+		return fmt.Sprintf("LAN_X_CV_POM_WRITE_BYTE loco=%d CV%d=%d", v.Addr, v.CV, v.Value)
+	case MMWriteByte:
+		return fmt.Sprintf("LAN_X_MM_WRITE_BYTE register%d=%d", v.Register, v.Value)
+	case CVResult:
+		return fmt.Sprintf("LAN_X_CV_RESULT CV%d=%d", v.CV, v.Value)
+	case CVNack:
+		return "LAN_X_CV_NACK"
+	case CVNackShortCircuit:
+		return "LAN_X_CV_NACK_SC"
+	case GetLocoInfo:
+		return fmt.Sprintf("LAN_X_GET_LOCO_INFO loco=%d", v.Addr)
+	case SetLocoDrive:
+		return fmt.Sprintf("LAN_X_SET_LOCO_DRIVE loco=%d steps=%d speed=%d %s", v.Addr, v.Steps, v.Speed, direction(v.Forward))
+	case SetLocoFunction:
+		return fmt.Sprintf("LAN_X_SET_LOCO_FUNCTION loco=%d F%d %s", v.Addr, v.Function, functionTypeName(v.Type))
+	case SetLocoBinaryState:
+		return fmt.Sprintf("LAN_X_SET_LOCO_BINARY_STATE loco=%d state=%d %s", v.Addr, v.State, onOff(v.On))
+	case SetLocoFunctionGroup:
+		var active []string
+		for _, fn := range v.Functions.Active() {
+			active = append(active, fmt.Sprintf("F%d", fn))
+		}
+		return strings.TrimSpace(fmt.Sprintf("LAN_X_SET_LOCO_FUNCTION_GROUP loco=%d group=0x%02X %s", v.Addr, byte(v.Group), strings.Join(active, " ")))
+	case LocoInfo:
+		var flags []string
+		if v.Busy {
+			flags = append(flags, "busy")
+		}
+		for _, fn := range v.Functions.Active() {
+			flags = append(flags, fmt.Sprintf("F%d", fn))
+		}
+		return strings.TrimSpace(fmt.Sprintf("LAN_X_LOCO_INFO loco=%d steps=%d speed=%d %s %s", v.Addr, v.Steps, v.Speed, direction(v.Forward), strings.Join(flags, " ")))
+	case RMBusGetData:
+		return fmt.Sprintf("LAN_RMBUS_GETDATA group=%d", v.Group)
+	case RMBusDataChanged:
+		return fmt.Sprintf("LAN_RMBUS_DATACHANGED group=%d status=% X", v.Group, v.Status[:])
+	case RMBusProgramModule:
+		return fmt.Sprintf("LAN_RMBUS_PROGRAMMODULE address=%d", v.Address)
+	case GetTurnoutInfo:
+		return fmt.Sprintf("LAN_X_GET_TURNOUT_INFO addr=%d", v.Addr)
+	case SetTurnout:
+		return fmt.Sprintf("LAN_X_SET_TURNOUT addr=%d output=%d activate=%t queue=%t", v.Addr, v.Output+1, v.Activate, v.Queue)
+	case TurnoutInfo:
+		return fmt.Sprintf("LAN_X_TURNOUT_INFO addr=%d position=%d", v.Addr, v.Position)
+	}
+	return fmt.Sprintf("%T", m)
+}
+
+// Name returns only the protocol name of a message, e.g. "LAN_X_LOCO_INFO"
+func Name(m Message) string {
+	name, _, _ := strings.Cut(Describe(m), " ")
+	return name
+}
+
+func direction(forward bool) string {
+	if forward {
+		return "forward"
+	}
+	return "reverse"
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+func functionTypeName(t FunctionType) string {
+	switch t {
+	case FunctionOn:
+		return "on"
+	case FunctionToggle:
+		return "toggle"
+	}
+	return "off"
+}
@@ -0,0 +1,119 @@
+package z21proto
+
+import "fmt"
+
+//
+// Context: reading and writing decoder CVs (chapter 6 of the Z21 LAN protocol)
+//
+
+// POM option bytes (DB3 without the two CV address bits)
+const (
+	pomOptionReadByte  byte = 0xE4 // 111001MM
+	pomOptionWriteBit  byte = 0xE8 // 111010MM
+	pomOptionWriteByte byte = 0xEC // 111011MM
+)
+
+// cvToWire translates a 1-based CV number into CVAdr_MSB, CVAdr_LSB (0=CV1)
+func cvToWire(cv uint16) (byte, byte) {
+	wire := cv - 1
+	return byte(wire >> 8), byte(wire & 0xFF)
+}
+
+// cvFromWire translates CVAdr_MSB, CVAdr_LSB into a 1-based CV number
+func cvFromWire(msb, lsb byte) uint16 {
+	return (uint16(msb)<<8 | uint16(lsb)) + 1
+}
+
+// CVRead is LAN_X_CV_READ (0x23 0x11), reading a CV in direct mode on the programming track
+type CVRead struct {
+	CV uint16
+}
+
+func (m CVRead) Encode() []byte {
+	msb, lsb := cvToWire(m.CV)
+	return xFrame(0x23, 0x11, msb, lsb)
+}
+
+// CVWrite is LAN_X_CV_WRITE (0x24 0x12), writing a CV in direct mode on the programming track
+type CVWrite struct {
+	CV    uint16
+	Value byte
+}
+
+func (m CVWrite) Encode() []byte {
+	msb, lsb := cvToWire(m.CV)
+	return xFrame(0x24, 0x12, msb, lsb, m.Value)
+}
+
+// CVPomReadByte is LAN_X_CV_POM_READ_BYTE (0xE6 0x30 … option 0xE4), RailCom is required for the answer
+type CVPomReadByte struct {
+	Addr uint16
+	CV   uint16
+}
+
+func (m CVPomReadByte) Encode() []byte {
+	return encodePom(m.Addr, pomOptionReadByte, m.CV, 0x00)
+}
+
+// CVPomWriteByte is LAN_X_CV_POM_WRITE_BYTE (0xE6 0x30 … option 0xEC), there is no reply
+type CVPomWriteByte struct {
+	Addr  uint16
+	CV    uint16
+	Value byte
+}
+
+func (m CVPomWriteByte) Encode() []byte {
+	return encodePom(m.Addr, pomOptionWriteByte, m.CV, m.Value)
+}
+
+func encodePom(addr uint16, option byte, cv uint16, value byte) []byte {
+	adrMSB, adrLSB := locoAddrBytes(addr)
+	cvMSB, cvLSB := cvToWire(cv)
+	db3 := option | (cvMSB & 0x03)
+	return xFrame(0xE6, 0x30, adrMSB, adrLSB, db3, cvLSB, value)
+}
+
+// decodePom decodes the POM parameters following the 0xE6 X-Header (DB0..DB5)
+func decodePom(db []byte) (Message, error) {
+	addr := locoAddrFromBytes(db[1], db[2])
+	cv := cvFromWire(db[3]&0x03, db[4])
+	switch db[3] & 0xFC {
+	case pomOptionReadByte:
+		return CVPomReadByte{Addr: addr, CV: cv}, nil
+	case pomOptionWriteByte:
+		return CVPomWriteByte{Addr: addr, CV: cv, Value: db[5]}, nil
+	}
+	return nil, fmt.Errorf("%w: POM option 0x%02X", ErrUnknownMessage, db[3]&0xFC)
+}
+
+// MMWriteByte is LAN_X_MM_WRITE_BYTE (0x24 0xFF), writing a register of a Motorola decoder on the programming track.
+// Register is 1-based (1-79). MM decoders cannot be read, so the LAN_X_CV_RESULT reply only means the programming has finished.
+type MMWriteByte struct {
+	Register uint8
+	Value    byte
+}
+
+func (m MMWriteByte) Encode() []byte {
+	return xFrame(0x24, 0xFF, 0x00, m.Register-1, m.Value)
+}
+
+// CVResult is LAN_X_CV_RESULT (0x64 0x14), a positive acknowledgement with the CV value
+type CVResult struct {
+	CV    uint16
+	Value byte
+}
+
+func (m CVResult) Encode() []byte {
+	msb, lsb := cvToWire(m.CV)
+	return xFrame(0x64, 0x14, msb, lsb, m.Value)
+}
+
+// CVNack is LAN_X_CV_NACK (0x61 0x13), the decoder did not acknowledge
+type CVNack struct{}
+
+func (CVNack) Encode() []byte { return xFrame(0x61, 0x13) }
+
+// CVNackShortCircuit is LAN_X_CV_NACK_SC (0x61 0x12), programming failed due to a short circuit
+type CVNackShortCircuit struct{}
+
+func (CVNackShortCircuit) Encode() []byte { return xFrame(0x61, 0x12) }
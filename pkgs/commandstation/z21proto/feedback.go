@@ -0,0 +1,57 @@
+package z21proto
+
+import "fmt"
+
+//
+// Context: R-BUS feedback modules (chapter 7 of the Z21 LAN protocol).
+// Roco 10787, 10819 and CAN detectors 10808 in R-BUS emulation are reported in groups of 10 modules,
+// 8 inputs each. Input modes of the 10808 can be changed only with the Z21 Maintenance Tool.
+//
+
+// RMBusModulesPerGroup is the number of feedback modules reported in one group
+const RMBusModulesPerGroup = 10
+
+// RMBusGetData is LAN_RMBUS_GETDATA (0x81), group 0 is modules 1-10, group 1 is modules 11-20
+type RMBusGetData struct {
+	Group uint8
+}
+
+func (m RMBusGetData) Encode() []byte { return frame(HeaderRMBusGetData, []byte{m.Group}) }
+
+// RMBusDataChanged is LAN_RMBUS_DATACHANGED (0x80), one byte per module, one bit per input
+type RMBusDataChanged struct {
+	Group  uint8
+	Status [RMBusModulesPerGroup]byte
+}
+
+func (m RMBusDataChanged) Encode() []byte {
+	return frame(HeaderRMBusDataChanged, append([]byte{m.Group}, m.Status[:]...))
+}
+
+// Occupied tells if the input (1-8) of the module (1-20) is active, modules outside of the group are reported as free
+func (m RMBusDataChanged) Occupied(module int, input int) bool {
+	index := module - 1 - int(m.Group)*RMBusModulesPerGroup
+	if index < 0 || index >= RMBusModulesPerGroup || input < 1 || input > 8 {
+		return false
+	}
+	return m.Status[index]&(1<<(input-1)) != 0
+}
+
+func decodeRMBusDataChanged(data []byte) (Message, error) {
+	if len(data) != 1+RMBusModulesPerGroup {
+		return nil, fmt.Errorf("%w: LAN_RMBUS_DATACHANGED has %d data bytes", ErrMalformed, len(data))
+	}
+	m := RMBusDataChanged{Group: data[0]}
+	copy(m.Status[:], data[1:])
+	return m, nil
+}
+
+// RMBusProgramModule is LAN_RMBUS_PROGRAMMODULE (0x82), there is no reply.
+// The Z21 keeps sending the programming sequence on the R-BUS until it receives this message with Address 0.
+type RMBusProgramModule struct {
+	Address uint8 // 1-20, 0 ends the programming
+}
+
+func (m RMBusProgramModule) Encode() []byte {
+	return frame(HeaderRMBusProgramModule, []byte{m.Address})
+}
@@ -0,0 +1,393 @@
+package z21proto
+
+import "fmt"
+
+//
+// Context: driving locomotives (chapter 4 of the Z21 LAN protocol)
+//
+
+// SpeedSteps is the number of DCC speed steps: 14, 28 or 128
+type SpeedSteps uint8
+
+const (
+	Steps14  SpeedSteps = 14
+	Steps28  SpeedSteps = 28
+	Steps128 SpeedSteps = 128
+)
+
+// driveWire returns S from the LAN_X_SET_LOCO_DRIVE 0x1S byte
+func (s SpeedSteps) driveWire() byte {
+	switch s {
+	case Steps14:
+		return 0
+	case Steps28:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// speedStepsFromInfo decodes KKK from DB2 of LAN_X_LOCO_INFO
+func speedStepsFromInfo(kkk byte) SpeedSteps {
+	switch kkk {
+	case 0:
+		return Steps14
+	case 2:
+		return Steps28
+	default:
+		return Steps128
+	}
+}
+
+// infoWire returns KKK for DB2 of LAN_X_LOCO_INFO
+func (s SpeedSteps) infoWire() byte {
+	switch s {
+	case Steps14:
+		return 0
+	case Steps28:
+		return 2
+	default:
+		return 4
+	}
+}
+
+// encodeSpeed encodes RVVVVVVV
+//
+//	14 steps: speed 0=stop, 1=emergency stop, 2-15 are steps 1-14
+//	28 steps: speed 0=stop, 1-28 are steps 1-28 (V5 is the intermediate step bit)
+//	128 steps: speed 0=stop, 1=emergency stop, 2-127 are steps 1-126
+func encodeSpeed(steps SpeedSteps, speed uint8, forward bool) byte {
+	var db byte
+	if forward {
+		db = 0x80
+	}
+	switch steps {
+	case Steps14:
+		if speed > 15 {
+			speed = 15
+		}
+		db |= speed & 0x0F
+	case Steps28:
+		if speed > 28 {
+			speed = 28
+		}
+		if speed > 0 {
+			speedBits := (speed + 3) / 2 // bits 0-3
+			speedBit5 := (speed + 3) % 2 // bit 4 (V5)
+			db |= (speedBit5 << 4) | (speedBits & 0x0F)
+		}
+	default:
+		if speed > 127 {
+			speed = 127
+		}
+		db |= speed & 0x7F
+	}
+	return db
+}
+
+// decodeSpeed is the reverse of encodeSpeed
+func decodeSpeed(steps SpeedSteps, db byte) (uint8, bool) {
+	forward := db&0x80 != 0
+	switch steps {
+	case Steps14:
+		return db & 0x0F, forward
+	case Steps28:
+		v := (db&0x0F)<<1 | (db>>4)&0x01
+		if v < 4 {
+			return 0, forward
+		}
+		return v - 3, forward
+	default:
+		return db & 0x7F, forward
+	}
+}
+
+// GetLocoInfo is LAN_X_GET_LOCO_INFO (0xE3 0xF0), it also subscribes the client to the loco address
+type GetLocoInfo struct {
+	Addr uint16
+}
+
+func (m GetLocoInfo) Encode() []byte {
+	msb, lsb := locoAddrBytes(m.Addr)
+	return xFrame(0xE3, 0xF0, msb, lsb)
+}
+
+// SetLocoDrive is LAN_X_SET_LOCO_DRIVE (0xE4 0x1S)
+type SetLocoDrive struct {
+	Addr    uint16
+	Steps   SpeedSteps
+	Speed   uint8 // see encodeSpeed for the meaning depending on Steps
+	Forward bool
+}
+
+func (m SetLocoDrive) Encode() []byte {
+	msb, lsb := locoAddrBytes(m.Addr)
+	return xFrame(0xE4, 0x10|m.Steps.driveWire(), msb, lsb, encodeSpeed(m.Steps, m.Speed, m.Forward))
+}
+
+func decodeSetLocoDrive(db []byte) (Message, error) {
+	var steps SpeedSteps
+	switch db[0] & 0x0F {
+	case 0:
+		steps = Steps14
+	case 2:
+		steps = Steps28
+	case 3:
+		steps = Steps128
+	default:
+		return nil, fmt.Errorf("%w: LAN_X_SET_LOCO_DRIVE speed steps 0x%02X", ErrUnknownMessage, db[0])
+	}
+	speed, forward := decodeSpeed(steps, db[3])
+	return SetLocoDrive{Addr: locoAddrFromBytes(db[1], db[2]), Steps: steps, Speed: speed, Forward: forward}, nil
+}
+
+// FunctionType is the TT switch type of LAN_X_SET_LOCO_FUNCTION
+type FunctionType byte
+
+const (
+	FunctionOff    FunctionType = 0x00
+	FunctionOn     FunctionType = 0x01
+	FunctionToggle FunctionType = 0x02
+)
+
+// SetLocoFunction is LAN_X_SET_LOCO_FUNCTION (0xE4 0xF8), function index 0-31
+type SetLocoFunction struct {
+	Addr     uint16
+	Function uint8
+	Type     FunctionType
+}
+
+func (m SetLocoFunction) Encode() []byte {
+	msb, lsb := locoAddrBytes(m.Addr)
+	// DB3: TT NNNNNN where TT = type (00=off, 01=on, 10=toggle), NNNNNN = function number
+	db3 := byte(m.Type)<<6 | (m.Function & 0x3F)
+	return xFrame(0xE4, 0xF8, msb, lsb, db3)
+}
+
+func decodeSetLocoFunction(db []byte) (Message, error) {
+	fnType := FunctionType(db[3] >> 6)
+	if fnType > FunctionToggle {
+		return nil, fmt.Errorf("%w: LAN_X_SET_LOCO_FUNCTION switch type %d", ErrMalformed, fnType)
+	}
+	return SetLocoFunction{Addr: locoAddrFromBytes(db[1], db[2]), Function: db[3] & 0x3F, Type: fnType}, nil
+}
+
+// MaxBinaryState is the highest binary state a DCC decoder can be addressed with
+const MaxBinaryState = 32767
+
+// SetLocoBinaryState is LAN_X_SET_LOCO_BINARY_STATE (0xE5 0x5F), the DCC binary state control instruction.
+// Sound decoders use the states beyond F31 e.g. for lighting scenarios, the states 1-32767 are addressable.
+type SetLocoBinaryState struct {
+	Addr  uint16
+	State uint16
+	On    bool
+}
+
+func (m SetLocoBinaryState) Encode() []byte {
+	msb, lsb := locoAddrBytes(m.Addr)
+	// DB3: O NNNNNNN where O = on and NNNNNNN = low bits of the state, DB4: high bits of the state
+	db3 := byte(m.State & 0x7F)
+	if m.On {
+		db3 |= 0x80
+	}
+	return xFrame(0xE5, 0x5F, msb, lsb, db3, byte(m.State>>7))
+}
+
+func decodeSetLocoBinaryState(db []byte) (Message, error) {
+	return SetLocoBinaryState{
+		Addr:  locoAddrFromBytes(db[1], db[2]),
+		State: uint16(db[3]&0x7F) | uint16(db[4])<<7,
+		On:    db[3]&0x80 != 0,
+	}, nil
+}
+
+// FunctionGroup is the DB0 of LAN_X_SET_LOCO_FUNCTION_GROUP, the functions switched together by one command
+type FunctionGroup byte
+
+const (
+	FunctionGroupF0F4   FunctionGroup = 0x20
+	FunctionGroupF5F8   FunctionGroup = 0x21
+	FunctionGroupF9F12  FunctionGroup = 0x22
+	FunctionGroupF13F20 FunctionGroup = 0x23
+	FunctionGroupF21F28 FunctionGroup = 0x28
+	FunctionGroupF29F31 FunctionGroup = 0x29
+)
+
+// functionGroups lists the first function and the number of functions of every group, F0 of the first group is extra
+var functionGroups = []struct {
+	group FunctionGroup
+	first int
+	count int
+}{
+	{FunctionGroupF0F4, 1, 4},
+	{FunctionGroupF5F8, 5, 4},
+	{FunctionGroupF9F12, 9, 4},
+	{FunctionGroupF13F20, 13, 8},
+	{FunctionGroupF21F28, 21, 8},
+	{FunctionGroupF29F31, 29, 3},
+}
+
+// FunctionGroupOf returns the group that switches function fn, false for numbers outside of 0-31
+func FunctionGroupOf(fn int) (FunctionGroup, bool) {
+	if fn == 0 {
+		return FunctionGroupF0F4, true
+	}
+	for _, g := range functionGroups {
+		if fn >= g.first && fn < g.first+g.count {
+			return g.group, true
+		}
+	}
+	return 0, false
+}
+
+// encode packs the states of the group functions into DB3, e.g. 000 F0 F4 F3 F2 F1 for the first group
+func (g FunctionGroup) encode(states FunctionStates) byte {
+	for _, def := range functionGroups {
+		if def.group != g {
+			continue
+		}
+		bits := byte(states>>def.first) & (1<<def.count - 1)
+		if g == FunctionGroupF0F4 && states.Get(0) {
+			bits |= 0x10
+		}
+		return bits
+	}
+	return 0
+}
+
+// decode is the reverse of encode, functions outside of the group are off
+func (g FunctionGroup) decode(bits byte) (FunctionStates, bool) {
+	for _, def := range functionGroups {
+		if def.group != g {
+			continue
+		}
+		states := FunctionStates(bits&(1<<def.count-1)) << def.first
+		if g == FunctionGroupF0F4 {
+			states = states.Set(0, bits&0x10 != 0)
+		}
+		return states, true
+	}
+	return 0, false
+}
+
+// SetLocoFunctionGroup is LAN_X_SET_LOCO_FUNCTION_GROUP (0xE4 0x20-0x29), it sets all functions of a group at once.
+// Older X-BUS firmware accepts only this form, see LAN_X_SET_LOCO_FUNCTION for switching a single function.
+type SetLocoFunctionGroup struct {
+	Addr  uint16
+	Group FunctionGroup
+	// Functions are the states to send, only the functions of Group are encoded
+	Functions FunctionStates
+}
+
+func (m SetLocoFunctionGroup) Encode() []byte {
+	msb, lsb := locoAddrBytes(m.Addr)
+	return xFrame(0xE4, byte(m.Group), msb, lsb, m.Group.encode(m.Functions))
+}
+
+func decodeSetLocoFunctionGroup(db []byte) (Message, error) {
+	group := FunctionGroup(db[0])
+	functions, ok := group.decode(db[3])
+	if !ok {
+		return nil, fmt.Errorf("%w: LAN_X_SET_LOCO_FUNCTION_GROUP group 0x%02X", ErrUnknownMessage, db[0])
+	}
+	return SetLocoFunctionGroup{Addr: locoAddrFromBytes(db[1], db[2]), Group: group, Functions: functions}, nil
+}
+
+// FunctionStates is a bitmask of functions F0..F31, bit N is FN
+type FunctionStates uint32
+
+// Get returns the state of function fn
+func (f FunctionStates) Get(fn int) bool {
+	if fn < 0 || fn > 31 {
+		return false
+	}
+	return f&(1<<fn) != 0
+}
+
+// Set returns a copy with function fn switched on or off
+func (f FunctionStates) Set(fn int, on bool) FunctionStates {
+	if fn < 0 || fn > 31 {
+		return f
+	}
+	if on {
+		return f | 1<<fn
+	}
+	return f &^ (1 << fn)
+}
+
+// Active returns the numbers of all functions that are on, in ascending order
+func (f FunctionStates) Active() []int {
+	var active []int
+	for fn := 0; fn <= 31; fn++ {
+		if f.Get(fn) {
+			active = append(active, fn)
+		}
+	}
+	return active
+}
+
+// LocoInfo is LAN_X_LOCO_INFO (0xEF)
+//
+// Data layout:
+//
+//	DB0: Adr_MSB, DB1: Adr_LSB
+//	DB2: 0000BKKK, B=busy (controlled by another X-BUS handset), KKK=speed steps
+//	DB3: RVVVVVVV, R=direction (1=forward), V=speed
+//	DB4: 0DSLFGHJ, D=double traction, S=smartsearch, L=F0, F=F4, G=F3, H=F2, J=F1
+//	DB5: F5-F12, DB6: F13-F20, DB7: F21-F28 [optional], DB8: F29-F31 [optional, FW 1.42+]
+type LocoInfo struct {
+	Addr           uint16
+	Busy           bool
+	Steps          SpeedSteps
+	Speed          uint8
+	Forward        bool
+	DoubleTraction bool
+	SmartSearch    bool
+	Functions      FunctionStates
+}
+
+func (m LocoInfo) Encode() []byte {
+	msb, lsb := locoAddrBytes(m.Addr)
+	db2 := m.Steps.infoWire()
+	if m.Busy {
+		db2 |= 0x08
+	}
+	f := uint32(m.Functions)
+	db4 := byte(f>>1)&0x0F | byte(f&0x01)<<4
+	if m.DoubleTraction {
+		db4 |= 0x40
+	}
+	if m.SmartSearch {
+		db4 |= 0x20
+	}
+	return xFrame(0xEF, msb, lsb, db2, encodeSpeed(m.Steps, m.Speed, m.Forward), db4,
+		byte(f>>5), byte(f>>13), byte(f>>21), byte(f>>29)&0x07)
+}
+
+func decodeLocoInfo(db []byte) (Message, error) {
+	// DB0..DB5 are mandatory, the function bytes above F12 are optional
+	if len(db) < 6 {
+		return nil, fmt.Errorf("%w: LAN_X_LOCO_INFO too short (%d data bytes)", ErrMalformed, len(db))
+	}
+	m := LocoInfo{
+		Addr:           locoAddrFromBytes(db[0], db[1]),
+		Busy:           db[2]&0x08 != 0,
+		Steps:          speedStepsFromInfo(db[2] & 0x07),
+		DoubleTraction: db[4]&0x40 != 0,
+		SmartSearch:    db[4]&0x20 != 0,
+	}
+	m.Speed, m.Forward = decodeSpeed(m.Steps, db[3])
+
+	f := uint32(db[4]&0x10)>>4 | uint32(db[4]&0x0F)<<1 | uint32(db[5])<<5
+	if len(db) > 6 {
+		f |= uint32(db[6]) << 13
+	}
+	if len(db) > 7 {
+		f |= uint32(db[7]) << 21
+	}
+	if len(db) > 8 {
+		f |= uint32(db[8]&0x07) << 29
+	}
+	m.Functions = FunctionStates(f)
+	return m, nil
+}
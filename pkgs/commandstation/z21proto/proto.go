@@ -0,0 +1,319 @@
+// Package z21proto is a codec for the Roco Z21 LAN protocol.
+//
+// Every Z21 data record has the form:
+//
+//	DataLen (2 bytes, little endian) | Header (2 bytes, little endian) | Data (n bytes)
+//
+// where DataLen covers the whole record (4+n). Records with Header 0x40
+// tunnel X-BUS commands: the Data field starts with an X-Header and ends
+// with an XOR checksum over the X-BUS bytes.
+//
+// Each message type has an Encode method returning a complete record ready to
+// be written to the socket. Decode does the opposite for a single record and
+// returns one of the typed messages declared in this package. Both directions
+// (client → Z21 and Z21 → client) are supported, so the same codec can be used
+// by a client, a packet monitor or a simulator.
+//
+// CV numbers are always 1-based (CV1 is 1), the codec translates them to the
+// 0-based wire format.
+package z21proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Z21 LAN headers
+const (
+	HeaderSerialNumber           uint16 = 0x0010
+	HeaderGetCode                uint16 = 0x0018
+	HeaderHardwareInfo           uint16 = 0x001A
+	HeaderLogoff                 uint16 = 0x0030
+	HeaderX                      uint16 = 0x0040
+	HeaderSetBroadcastFlags      uint16 = 0x0050
+	HeaderGetBroadcastFlags      uint16 = 0x0051
+	HeaderRMBusDataChanged       uint16 = 0x0080
+	HeaderRMBusGetData           uint16 = 0x0081
+	HeaderRMBusProgramModule     uint16 = 0x0082
+	HeaderSystemStateDataChanged uint16 = 0x0084
+	HeaderSystemStateGetData     uint16 = 0x0085
+)
+
+var (
+	// ErrUnknownMessage is returned by Decode for well-formed records the codec does not know
+	ErrUnknownMessage = errors.New("unrecognized Z21 message")
+	// ErrMalformed is returned by Decode when the record framing, length or checksum is invalid
+	ErrMalformed = errors.New("malformed Z21 message")
+)
+
+// Message is a single Z21 data record
+type Message interface {
+	// Encode returns the complete record including DataLen and Header
+	Encode() []byte
+}
+
+// frame wraps data into a Z21 record with the given header
+func frame(header uint16, data []byte) []byte {
+	buf := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint16(buf[0:2], uint16(4+len(data)))
+	binary.LittleEndian.PutUint16(buf[2:4], header)
+	return append(buf, data...)
+}
+
+// xFrame wraps an X-BUS command into a LAN_X record and appends the XOR checksum
+func xFrame(x ...byte) []byte {
+	return frame(HeaderX, append(x, xorSum(x)))
+}
+
+func xorSum(b []byte) byte {
+	var x byte
+	for _, v := range b {
+		x ^= v
+	}
+	return x
+}
+
+// locoAddrBytes encodes a locomotive address as Adr_MSB, Adr_LSB.
+// For addresses >= 128 the two highest bits of Adr_MSB must be set.
+func locoAddrBytes(addr uint16) (byte, byte) {
+	msb := byte((addr >> 8) & 0x3F)
+	if addr >= 128 {
+		msb |= 0xC0
+	}
+	return msb, byte(addr & 0xFF)
+}
+
+// locoAddrFromBytes decodes Adr_MSB, Adr_LSB ignoring the two highest bits
+func locoAddrFromBytes(msb, lsb byte) uint16 {
+	return uint16(msb&0x3F)<<8 | uint16(lsb)
+}
+
+// Split splits a UDP payload into individual Z21 records. The Z21 is allowed to
+// combine several records into one datagram.
+func Split(payload []byte) ([][]byte, error) {
+	var records [][]byte
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			return records, fmt.Errorf("%w: trailing %d byte(s)", ErrMalformed, len(payload))
+		}
+		dataLen := int(binary.LittleEndian.Uint16(payload[0:2]))
+		if dataLen < 4 || dataLen > len(payload) {
+			return records, fmt.Errorf("%w: invalid DataLen %d", ErrMalformed, dataLen)
+		}
+		records = append(records, payload[:dataLen])
+		payload = payload[dataLen:]
+	}
+	return records, nil
+}
+
+// Decode parses a single Z21 record into a typed message
+func Decode(pkt []byte) (Message, error) {
+	if len(pkt) < 4 {
+		return nil, fmt.Errorf("%w: packet too short (%d bytes)", ErrMalformed, len(pkt))
+	}
+	dataLen := binary.LittleEndian.Uint16(pkt[0:2])
+	header := binary.LittleEndian.Uint16(pkt[2:4])
+	if int(dataLen) != len(pkt) {
+		return nil, fmt.Errorf("%w: DataLen %d does not match packet length %d", ErrMalformed, dataLen, len(pkt))
+	}
+	data := pkt[4:]
+
+	switch header {
+	case HeaderX:
+		return decodeX(data)
+	case HeaderSerialNumber:
+		switch len(data) {
+		case 0:
+			return GetSerialNumber{}, nil
+		case 4:
+			return SerialNumber{Serial: binary.LittleEndian.Uint32(data)}, nil
+		}
+	case HeaderGetCode:
+		switch len(data) {
+		case 0:
+			return GetCode{}, nil
+		case 1:
+			return Code{Lock: FeatureLock(data[0])}, nil
+		}
+	case HeaderHardwareInfo:
+		switch len(data) {
+		case 0:
+			return GetHardwareInfo{}, nil
+		case 8:
+			return HardwareInfo{
+				Type:     HardwareType(binary.LittleEndian.Uint32(data[0:4])),
+				Firmware: FirmwareVersion{Major: fromBCD(data[5]), Minor: fromBCD(data[4])},
+			}, nil
+		}
+	case HeaderLogoff:
+		if len(data) == 0 {
+			return Logoff{}, nil
+		}
+	case HeaderSetBroadcastFlags:
+		if len(data) == 4 {
+			return SetBroadcastFlags{Flags: BroadcastFlags(binary.LittleEndian.Uint32(data))}, nil
+		}
+	case HeaderGetBroadcastFlags:
+		switch len(data) {
+		case 0:
+			return GetBroadcastFlags{}, nil
+		case 4:
+			return BroadcastFlagsInfo{Flags: BroadcastFlags(binary.LittleEndian.Uint32(data))}, nil
+		}
+	case HeaderSystemStateGetData:
+		if len(data) == 0 {
+			return SystemStateGetData{}, nil
+		}
+	case HeaderSystemStateDataChanged:
+		return decodeSystemState(data)
+	case HeaderRMBusDataChanged:
+		return decodeRMBusDataChanged(data)
+	case HeaderRMBusGetData:
+		if len(data) == 1 {
+			return RMBusGetData{Group: data[0]}, nil
+		}
+	case HeaderRMBusProgramModule:
+		if len(data) == 1 {
+			return RMBusProgramModule{Address: data[0]}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: header 0x%04X, %d data byte(s)", ErrUnknownMessage, header, len(data))
+}
+
+// decodeX parses the X-BUS part of a LAN_X record, validating its checksum
+func decodeX(data []byte) (Message, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("%w: LAN_X record too short", ErrMalformed)
+	}
+	x, sum := data[:len(data)-1], data[len(data)-1]
+	if xorSum(x) != sum {
+		return nil, fmt.Errorf("%w: XOR checksum 0x%02X, expected 0x%02X", ErrMalformed, sum, xorSum(x))
+	}
+	xHeader, db := x[0], x[1:]
+
+	switch xHeader {
+	case 0x21:
+		if len(db) == 1 {
+			switch db[0] {
+			case 0x21:
+				return GetVersion{}, nil
+			case 0x24:
+				return GetStatus{}, nil
+			case 0x80:
+				return SetTrackPowerOff{}, nil
+			case 0x81:
+				return SetTrackPowerOn{}, nil
+			}
+		}
+	case 0x23:
+		if len(db) == 3 && db[0] == 0x11 {
+			return CVRead{CV: cvFromWire(db[1], db[2])}, nil
+		}
+	case 0x24:
+		if len(db) == 4 && db[0] == 0x12 {
+			return CVWrite{CV: cvFromWire(db[1], db[2]), Value: db[3]}, nil
+		}
+		if len(db) == 4 && db[0] == 0xFF && db[1] == 0x00 {
+			return MMWriteByte{Register: db[2] + 1, Value: db[3]}, nil
+		}
+	case 0x43:
+		switch len(db) {
+		case 2:
+			return GetTurnoutInfo{Addr: binary.BigEndian.Uint16(db)}, nil
+		case 3:
+			return TurnoutInfo{Addr: binary.BigEndian.Uint16(db), Position: TurnoutPosition(db[2] & 0x03)}, nil
+		}
+	case 0x53:
+		if len(db) == 3 {
+			return SetTurnout{
+				Addr:     binary.BigEndian.Uint16(db),
+				Output:   db[2] & 0x01,
+				Activate: db[2]&0x08 != 0,
+				Queue:    db[2]&0x20 != 0,
+			}, nil
+		}
+	case 0x61:
+		if len(db) == 1 {
+			switch db[0] {
+			case 0x00:
+				return TrackPowerOff{}, nil
+			case 0x01:
+				return TrackPowerOn{}, nil
+			case 0x02:
+				return ProgrammingMode{}, nil
+			case 0x08:
+				return TrackShortCircuit{}, nil
+			case 0x12:
+				return CVNackShortCircuit{}, nil
+			case 0x13:
+				return CVNack{}, nil
+			case 0x82:
+				return UnknownCommand{}, nil
+			}
+		}
+	case 0x62:
+		if len(db) == 2 && db[0] == 0x22 {
+			return StatusChanged{Status: CentralState(db[1])}, nil
+		}
+	case 0x63:
+		if len(db) == 3 && db[0] == 0x21 {
+			return Version{XBusVersion: db[1], CommandStationID: db[2]}, nil
+		}
+	case 0x64:
+		if len(db) == 4 && db[0] == 0x14 {
+			return CVResult{CV: cvFromWire(db[1], db[2]), Value: db[3]}, nil
+		}
+	case 0x80:
+		if len(db) == 0 {
+			return SetStop{}, nil
+		}
+	case 0x81:
+		if len(db) == 1 && db[0] == 0x00 {
+			return Stopped{}, nil
+		}
+	case 0xE3:
+		if len(db) == 3 && db[0] == 0xF0 {
+			return GetLocoInfo{Addr: locoAddrFromBytes(db[1], db[2])}, nil
+		}
+	case 0xE4:
+		if len(db) == 4 {
+			if db[0] == 0xF8 {
+				return decodeSetLocoFunction(db)
+			}
+			if db[0]&0xF0 == 0x10 {
+				return decodeSetLocoDrive(db)
+			}
+			if db[0]&0xF0 == 0x20 {
+				return decodeSetLocoFunctionGroup(db)
+			}
+		}
+	case 0xE5:
+		if len(db) == 5 && db[0] == 0x5F {
+			return decodeSetLocoBinaryState(db)
+		}
+	case 0xE6:
+		if len(db) == 6 && db[0] == 0x30 {
+			return decodePom(db)
+		}
+	case 0xEF:
+		return decodeLocoInfo(db)
+	case 0xF1:
+		if len(db) == 1 && db[0] == 0x0A {
+			return GetFirmwareVersion{}, nil
+		}
+	case 0xF3:
+		if len(db) == 3 && db[0] == 0x0A {
+			return FirmwareVersion{Major: fromBCD(db[1]), Minor: fromBCD(db[2])}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: X-Header 0x%02X, %d data byte(s)", ErrUnknownMessage, xHeader, len(db))
+}
+
+func fromBCD(b byte) uint8 {
+	return (b>>4)*10 + (b & 0x0F)
+}
+
+func toBCD(v uint8) byte {
+	return byte((v/10)<<4 | (v % 10))
+}
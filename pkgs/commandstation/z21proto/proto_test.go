@@ -0,0 +1,243 @@
+package z21proto
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestXorSum(t *testing.T) {
+	cases := []struct {
+		input    []byte
+		expected byte
+	}{
+		{[]byte{}, 0},
+		{[]byte{0x00}, 0x00},
+		{[]byte{0x01}, 0x01},
+		{[]byte{0x01, 0x02}, 0x03},
+		{[]byte{0xFF, 0x01}, 0xFE},
+		{[]byte{0xAA, 0x55}, 0xFF},
+		{[]byte{0x10, 0x20, 0x30}, 0x00},
+		{[]byte{0x01, 0x01, 0x01}, 0x01},
+	}
+
+	for _, c := range cases {
+		got := xorSum(c.input)
+		if got != c.expected {
+			t.Errorf("xorSum(%v) = %02X; want %02X", c.input, got, c.expected)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	cases := []struct {
+		name     string
+		msg      Message
+		expected []byte
+	}{
+		{"LAN_GET_SERIAL_NUMBER", GetSerialNumber{}, []byte{0x04, 0x00, 0x10, 0x00}},
+		{"LAN_GET_CODE", GetCode{}, []byte{0x04, 0x00, 0x18, 0x00}},
+		{"LAN_GET_HWINFO reply", HardwareInfo{Type: HardwareZ21Start, Firmware: FirmwareVersion{Major: 1, Minor: 40}}, []byte{0x0C, 0x00, 0x1A, 0x00, 0x04, 0x02, 0x00, 0x00, 0x40, 0x01, 0x00, 0x00}},
+		{"LAN_SYSTEMSTATE_GETDATA", SystemStateGetData{}, []byte{0x04, 0x00, 0x85, 0x00}},
+		{"LAN_SET_BROADCASTFLAGS", SetBroadcastFlags{Flags: BroadcastDrivingSwitching | BroadcastSystemState}, []byte{0x08, 0x00, 0x50, 0x00, 0x01, 0x01, 0x00, 0x00}},
+		{"LAN_X_GET_VERSION", GetVersion{}, []byte{0x07, 0x00, 0x40, 0x00, 0x21, 0x21, 0x00}},
+		{"LAN_X_GET_STATUS", GetStatus{}, []byte{0x07, 0x00, 0x40, 0x00, 0x21, 0x24, 0x05}},
+		{"LAN_X_SET_TRACK_POWER_OFF", SetTrackPowerOff{}, []byte{0x07, 0x00, 0x40, 0x00, 0x21, 0x80, 0xA1}},
+		{"LAN_X_SET_TRACK_POWER_ON", SetTrackPowerOn{}, []byte{0x07, 0x00, 0x40, 0x00, 0x21, 0x81, 0xA0}},
+		{"LAN_X_SET_STOP", SetStop{}, []byte{0x06, 0x00, 0x40, 0x00, 0x80, 0x80}},
+		{"LAN_X_GET_FIRMWARE_VERSION", GetFirmwareVersion{}, []byte{0x07, 0x00, 0x40, 0x00, 0xF1, 0x0A, 0xFB}},
+		{"LAN_X_CV_READ CV1", CVRead{CV: 1}, []byte{0x09, 0x00, 0x40, 0x00, 0x23, 0x11, 0x00, 0x00, 0x32}},
+		{"LAN_X_CV_WRITE CV29=34", CVWrite{CV: 29, Value: 34}, []byte{0x0A, 0x00, 0x40, 0x00, 0x24, 0x12, 0x00, 0x1C, 0x22, 0x08}},
+		{"LAN_X_MM_WRITE_BYTE register 1=5", MMWriteByte{Register: 1, Value: 5}, []byte{0x0A, 0x00, 0x40, 0x00, 0x24, 0xFF, 0x00, 0x00, 0x05, 0xDE}},
+		{"LAN_X_CV_POM_READ_BYTE loco 3 CV8", CVPomReadByte{Addr: 3, CV: 8}, []byte{0x0C, 0x00, 0x40, 0x00, 0xE6, 0x30, 0x00, 0x03, 0xE4, 0x07, 0x00, 0x36}},
+		{"LAN_X_CV_POM_WRITE_BYTE loco 3 CV300=5", CVPomWriteByte{Addr: 3, CV: 300, Value: 5}, []byte{0x0C, 0x00, 0x40, 0x00, 0xE6, 0x30, 0x00, 0x03, 0xED, 0x2B, 0x05, 0x16}},
+		{"LAN_X_GET_LOCO_INFO long address", GetLocoInfo{Addr: 1000}, []byte{0x09, 0x00, 0x40, 0x00, 0xE3, 0xF0, 0xC3, 0xE8, 0x38}},
+		{"LAN_X_SET_LOCO_FUNCTION F5 on", SetLocoFunction{Addr: 3, Function: 5, Type: FunctionOn}, []byte{0x0A, 0x00, 0x40, 0x00, 0xE4, 0xF8, 0x00, 0x03, 0x45, 0x5A}},
+		{"LAN_X_SET_LOCO_FUNCTION_GROUP F0 and F2", SetLocoFunctionGroup{Addr: 3, Group: FunctionGroupF0F4, Functions: FunctionStates(0).Set(0, true).Set(2, true).Set(5, true)}, []byte{0x0A, 0x00, 0x40, 0x00, 0xE4, 0x20, 0x00, 0x03, 0x12, 0xD5}},
+		{"LAN_X_SET_LOCO_FUNCTION_GROUP F21-F28", SetLocoFunctionGroup{Addr: 3, Group: FunctionGroupF21F28, Functions: FunctionStates(0).Set(21, true).Set(28, true)}, []byte{0x0A, 0x00, 0x40, 0x00, 0xE4, 0x28, 0x00, 0x03, 0x81, 0x4E}},
+		{"LAN_X_SET_LOCO_BINARY_STATE 200 on", SetLocoBinaryState{Addr: 3, State: 200, On: true}, []byte{0x0B, 0x00, 0x40, 0x00, 0xE5, 0x5F, 0x00, 0x03, 0xC8, 0x01, 0x70}},
+		{"LAN_X_SET_LOCO_DRIVE 128 steps forward", SetLocoDrive{Addr: 3, Steps: Steps128, Speed: 40, Forward: true}, []byte{0x0A, 0x00, 0x40, 0x00, 0xE4, 0x13, 0x00, 0x03, 0xA8, 0x5C}},
+		{"LAN_X_SET_LOCO_DRIVE 28 steps step 2", SetLocoDrive{Addr: 3, Steps: Steps28, Speed: 2}, []byte{0x0A, 0x00, 0x40, 0x00, 0xE4, 0x12, 0x00, 0x03, 0x12, 0xE7}},
+		{"LAN_X_SET_TURNOUT #7 output 2 activate", SetTurnout{Addr: 6, Output: 1, Activate: true}, []byte{0x09, 0x00, 0x40, 0x00, 0x53, 0x00, 0x06, 0x89, 0xDC}},
+		{"LAN_X_GET_TURNOUT_INFO", GetTurnoutInfo{Addr: 4}, []byte{0x08, 0x00, 0x40, 0x00, 0x43, 0x00, 0x04, 0x47}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := c.msg.Encode()
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("Encode() = % X; want % X", got, c.expected)
+			}
+		})
+	}
+}
+
+func TestDecodeRoundTrip(t *testing.T) {
+	messages := []Message{
+		GetSerialNumber{},
+		SerialNumber{Serial: 0x0001E240},
+		GetCode{},
+		Code{Lock: FeatureStartLocked},
+		GetHardwareInfo{},
+		HardwareInfo{Type: HardwareZ21XL, Firmware: FirmwareVersion{Major: 1, Minor: 43}},
+		Logoff{},
+		SetBroadcastFlags{Flags: BroadcastDrivingSwitching},
+		GetBroadcastFlags{},
+		BroadcastFlagsInfo{Flags: BroadcastSystemState},
+		SystemStateGetData{},
+		SystemState{MainCurrent: 120, ProgCurrent: -1, Temperature: 35, SupplyVoltage: 18000, VCCVoltage: 16000, CentralState: CsProgrammingModeActive, Capabilities: CapDCC | CapRailCom},
+		GetVersion{},
+		Version{XBusVersion: 0x30, CommandStationID: 0x12},
+		GetStatus{},
+		StatusChanged{Status: CsTrackVoltageOff | CsShortCircuit},
+		SetTrackPowerOff{},
+		SetTrackPowerOn{},
+		TrackPowerOff{},
+		TrackPowerOn{},
+		ProgrammingMode{},
+		TrackShortCircuit{},
+		UnknownCommand{},
+		SetStop{},
+		Stopped{},
+		GetFirmwareVersion{},
+		FirmwareVersion{Major: 1, Minor: 43},
+		CVRead{CV: 1024},
+		CVWrite{CV: 1, Value: 3},
+		MMWriteByte{Register: 79, Value: 80},
+		RMBusGetData{Group: 1},
+		RMBusDataChanged{Group: 1, Status: [10]byte{0x01, 0x00, 0xC5}},
+		RMBusProgramModule{Address: 20},
+		CVPomReadByte{Addr: 10239, CV: 29},
+		CVPomWriteByte{Addr: 127, CV: 1, Value: 255},
+		CVResult{CV: 8, Value: 145},
+		CVNack{},
+		CVNackShortCircuit{},
+		GetLocoInfo{Addr: 3},
+		SetLocoDrive{Addr: 3, Steps: Steps14, Speed: 15, Forward: true},
+		SetLocoDrive{Addr: 200, Steps: Steps28, Speed: 28},
+		SetLocoDrive{Addr: 3, Steps: Steps128, Speed: 127, Forward: true},
+		SetLocoFunction{Addr: 3, Function: 31, Type: FunctionToggle},
+		SetLocoFunctionGroup{Addr: 3, Group: FunctionGroupF0F4, Functions: FunctionStates(0).Set(0, true).Set(4, true)},
+		SetLocoFunctionGroup{Addr: 1000, Group: FunctionGroupF13F20, Functions: FunctionStates(0).Set(13, true).Set(20, true)},
+		SetLocoFunctionGroup{Addr: 3, Group: FunctionGroupF29F31, Functions: FunctionStates(0).Set(31, true)},
+		SetLocoBinaryState{Addr: 1000, State: MaxBinaryState},
+		SetLocoBinaryState{Addr: 3, State: 32, On: true},
+		LocoInfo{Addr: 3, Busy: true, Steps: Steps128, Speed: 40, Forward: true, Functions: FunctionStates(0).Set(0, true).Set(4, true).Set(12, true).Set(31, true)},
+		LocoInfo{Addr: 1000, Steps: Steps28, Speed: 17, DoubleTraction: true},
+		GetTurnoutInfo{Addr: 4},
+		SetTurnout{Addr: 24, Output: 1, Activate: true, Queue: true},
+		TurnoutInfo{Addr: 4, Position: TurnoutOutput2},
+	}
+
+	for _, msg := range messages {
+		t.Run(reflect.TypeOf(msg).Name(), func(t *testing.T) {
+			decoded, err := Decode(msg.Encode())
+			if err != nil {
+				t.Fatalf("Decode(% X) returned error: %s", msg.Encode(), err)
+			}
+			if !reflect.DeepEqual(decoded, msg) {
+				t.Errorf("Decode(Encode()) = %#v; want %#v", decoded, msg)
+			}
+		})
+	}
+}
+
+func TestDecodeLocoInfo(t *testing.T) {
+	// loco 3, 128 steps, forward, speed 40, F0 + F1 + F5 on; F13..F31 bytes omitted
+	pkt := []byte{0x0C, 0x00, 0x40, 0x00, 0xEF, 0x00, 0x03, 0x04, 0xA8, 0x11, 0x01}
+	pkt = append(pkt, xorSum(pkt[4:]))
+	pkt[0] = byte(len(pkt))
+
+	msg, err := Decode(pkt)
+	if err != nil {
+		t.Fatalf("Decode() returned error: %s", err)
+	}
+	info, ok := msg.(LocoInfo)
+	if !ok {
+		t.Fatalf("Decode() = %T; want LocoInfo", msg)
+	}
+	if info.Addr != 3 || info.Speed != 40 || !info.Forward || info.Steps != Steps128 {
+		t.Errorf("unexpected loco info: %#v", info)
+	}
+	if !reflect.DeepEqual(info.Functions.Active(), []int{0, 1, 5}) {
+		t.Errorf("Functions.Active() = %v; want [0 1 5]", info.Functions.Active())
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    []byte
+		expected error
+	}{
+		{"too short", []byte{0x04, 0x00}, ErrMalformed},
+		{"length mismatch", []byte{0x08, 0x00, 0x10, 0x00}, ErrMalformed},
+		{"bad checksum", []byte{0x07, 0x00, 0x40, 0x00, 0x21, 0x81, 0x00}, ErrMalformed},
+		{"unknown header", []byte{0x04, 0x00, 0xFF, 0x00}, ErrUnknownMessage},
+		{"unknown X-Header", []byte{0x07, 0x00, 0x40, 0x00, 0x99, 0x01, 0x98}, ErrUnknownMessage},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := Decode(c.input)
+			if !errors.Is(err, c.expected) {
+				t.Errorf("Decode(% X) error = %v; want %v", c.input, err, c.expected)
+			}
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	payload := append(GetTurnoutInfo{Addr: 4}.Encode(), GetTurnoutInfo{Addr: 5}.Encode()...)
+	payload = append(payload, SystemStateGetData{}.Encode()...)
+
+	records, err := Split(payload)
+	if err != nil {
+		t.Fatalf("Split() returned error: %s", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Split() returned %d records; want 3", len(records))
+	}
+	if _, err := Split(payload[:len(payload)-1]); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Split() on truncated payload error = %v; want ErrMalformed", err)
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	tests := []struct {
+		pkt  []byte
+		want string
+	}{
+		{CVWrite{CV: 8, Value: 8}.Encode(), "LAN_X_CV_WRITE CV8=8"},
+		{CVPomWriteByte{Addr: 3, CV: 29, Value: 6}.Encode(), "LAN_X_CV_POM_WRITE_BYTE loco=3 CV29=6"},
+		{SetLocoFunction{Addr: 3, Function: 5, Type: FunctionOn}.Encode(), "LAN_X_SET_LOCO_FUNCTION loco=3 F5 on"},
+		{SetLocoFunctionGroup{Addr: 3, Group: FunctionGroupF5F8, Functions: FunctionStates(0).Set(6, true)}.Encode(), "LAN_X_SET_LOCO_FUNCTION_GROUP loco=3 group=0x21 F6"},
+		{SetLocoBinaryState{Addr: 3, State: 120}.Encode(), "LAN_X_SET_LOCO_BINARY_STATE loco=3 state=120 off"},
+		{LocoInfo{Addr: 3, Steps: Steps128, Speed: 10, Forward: true, Functions: FunctionStates(0).Set(0, true)}.Encode(), "LAN_X_LOCO_INFO loco=3 steps=128 speed=10 forward F0"},
+		{StatusChanged{Status: CsEmergencyStop | CsShortCircuit}.Encode(), "LAN_X_STATUS_CHANGED state=0x05 (emergency stop, short circuit)"},
+		{[]byte{0x04, 0x00, 0x99, 0x00}, "undecodable packet"},
+	}
+	for _, tt := range tests {
+		got := Annotate(tt.pkt)
+		if !strings.HasPrefix(got, tt.want) {
+			t.Errorf("Annotate(% X) = %q, want %q", tt.pkt, got, tt.want)
+		}
+	}
+	if got := Name(CVResult{CV: 8, Value: 145}); got != "LAN_X_CV_RESULT" {
+		t.Errorf("Name(CVResult) = %q", got)
+	}
+}
+
+func TestRMBusOccupied(t *testing.T) {
+	// the example from the specification: module #11 input 1, module #13 inputs 8, 7, 3 and 1
+	m := RMBusDataChanged{Group: 1, Status: [10]byte{0x01, 0x00, 0xC5}}
+	occupied := map[[2]int]bool{{11, 1}: true, {13, 1}: true, {13, 3}: true, {13, 7}: true, {13, 8}: true}
+	for module := 1; module <= 20; module++ {
+		for input := 1; input <= 8; input++ {
+			if got := m.Occupied(module, input); got != occupied[[2]int{module, input}] {
+				t.Errorf("Occupied(%d, %d) = %t", module, input, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package z21proto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+//
+// Context: system, status and version messages (chapter 2 of the Z21 LAN protocol)
+//
+
+// GetSerialNumber is LAN_GET_SERIAL_NUMBER (0x10)
+type GetSerialNumber struct{}
+
+func (GetSerialNumber) Encode() []byte { return frame(HeaderSerialNumber, nil) }
+
+// SerialNumber is the reply to LAN_GET_SERIAL_NUMBER
+type SerialNumber struct {
+	Serial uint32
+}
+
+func (m SerialNumber) Encode() []byte {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, m.Serial)
+	return frame(HeaderSerialNumber, data)
+}
+
+// GetCode is LAN_GET_CODE (0x18), asking which features the command station has unlocked
+type GetCode struct{}
+
+func (GetCode) Encode() []byte { return frame(HeaderGetCode, nil) }
+
+// FeatureLock is the software feature scope reported by LAN_GET_CODE
+type FeatureLock byte
+
+const (
+	// FeatureNoLock is a Z21 with all features
+	FeatureNoLock FeatureLock = 0x00
+	// FeatureStartLocked is a z21start that cannot drive or program over LAN until it is unlocked
+	FeatureStartLocked FeatureLock = 0x01
+	// FeatureStartUnlocked is a z21start unlocked with the activation code
+	FeatureStartUnlocked FeatureLock = 0x02
+)
+
+func (l FeatureLock) String() string {
+	switch l {
+	case FeatureNoLock:
+		return "all features"
+	case FeatureStartLocked:
+		return "z21start locked"
+	case FeatureStartUnlocked:
+		return "z21start unlocked"
+	}
+	return fmt.Sprintf("unknown (0x%02X)", byte(l))
+}
+
+// Code is the reply to LAN_GET_CODE
+type Code struct {
+	Lock FeatureLock
+}
+
+func (m Code) Encode() []byte { return frame(HeaderGetCode, []byte{byte(m.Lock)}) }
+
+// GetHardwareInfo is LAN_GET_HWINFO (0x1A)
+type GetHardwareInfo struct{}
+
+func (GetHardwareInfo) Encode() []byte { return frame(HeaderHardwareInfo, nil) }
+
+// HardwareType is the device reported by LAN_GET_HWINFO
+type HardwareType uint32
+
+const (
+	HardwareZ21Old        HardwareType = 0x00000200
+	HardwareZ21New        HardwareType = 0x00000201
+	HardwareSmartRail     HardwareType = 0x00000202
+	HardwareZ21Small      HardwareType = 0x00000203
+	HardwareZ21Start      HardwareType = 0x00000204
+	HardwareSingleBooster HardwareType = 0x00000205
+	HardwareDualBooster   HardwareType = 0x00000206
+	HardwareZ21XL         HardwareType = 0x00000211
+	HardwareXLBooster     HardwareType = 0x00000212
+	HardwareSwitchDecoder HardwareType = 0x00000301
+	HardwareSignalDecoder HardwareType = 0x00000302
+)
+
+func (h HardwareType) String() string {
+	switch h {
+	case HardwareZ21Old:
+		return "black Z21 (2012)"
+	case HardwareZ21New:
+		return "black Z21 (2013)"
+	case HardwareSmartRail:
+		return "SmartRail"
+	case HardwareZ21Small:
+		return "white z21"
+	case HardwareZ21Start:
+		return "z21start"
+	case HardwareSingleBooster:
+		return "Z21 single booster"
+	case HardwareDualBooster:
+		return "Z21 dual booster"
+	case HardwareZ21XL:
+		return "Z21 XL"
+	case HardwareXLBooster:
+		return "Z21 XL booster"
+	case HardwareSwitchDecoder:
+		return "Z21 switch decoder"
+	case HardwareSignalDecoder:
+		return "Z21 signal decoder"
+	}
+	return fmt.Sprintf("unknown (0x%08X)", uint32(h))
+}
+
+// HardwareInfo is the reply to LAN_GET_HWINFO, the firmware version is BCD encoded on the wire
+type HardwareInfo struct {
+	Type     HardwareType
+	Firmware FirmwareVersion
+}
+
+func (m HardwareInfo) Encode() []byte {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint32(data[0:4], uint32(m.Type))
+	data[4], data[5] = toBCD(m.Firmware.Minor), toBCD(m.Firmware.Major)
+	return frame(HeaderHardwareInfo, data)
+}
+
+// Logoff is LAN_LOGOFF (0x30), there is no reply
+type Logoff struct{}
+
+func (Logoff) Encode() []byte { return frame(HeaderLogoff, nil) }
+
+// BroadcastFlags is an OR-combination of the LAN_SET_BROADCASTFLAGS flags
+type BroadcastFlags uint32
+
+const (
+	// BroadcastDrivingSwitching delivers LAN_X_BC_*, LAN_X_LOCO_INFO (subscribed locos) and LAN_X_TURNOUT_INFO
+	BroadcastDrivingSwitching BroadcastFlags = 0x00000001
+	// BroadcastRMBus delivers LAN_RMBUS_DATACHANGED
+	BroadcastRMBus BroadcastFlags = 0x00000002
+	// BroadcastRailCom delivers LAN_RAILCOM_DATACHANGED for subscribed locos
+	BroadcastRailCom BroadcastFlags = 0x00000004
+	// BroadcastSystemState delivers LAN_SYSTEMSTATE_DATACHANGED
+	BroadcastSystemState BroadcastFlags = 0x00000100
+	// BroadcastAllLocoInfo delivers LAN_X_LOCO_INFO for all locos (FW 1.20+), generates a lot of traffic
+	BroadcastAllLocoInfo BroadcastFlags = 0x00010000
+)
+
+// SetBroadcastFlags is LAN_SET_BROADCASTFLAGS (0x50), there is no reply
+type SetBroadcastFlags struct {
+	Flags BroadcastFlags
+}
+
+func (m SetBroadcastFlags) Encode() []byte {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, uint32(m.Flags))
+	return frame(HeaderSetBroadcastFlags, data)
+}
+
+// GetBroadcastFlags is LAN_GET_BROADCASTFLAGS (0x51)
+type GetBroadcastFlags struct{}
+
+func (GetBroadcastFlags) Encode() []byte { return frame(HeaderGetBroadcastFlags, nil) }
+
+// BroadcastFlagsInfo is the reply to LAN_GET_BROADCASTFLAGS
+type BroadcastFlagsInfo struct {
+	Flags BroadcastFlags
+}
+
+func (m BroadcastFlagsInfo) Encode() []byte {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, uint32(m.Flags))
+	return frame(HeaderGetBroadcastFlags, data)
+}
+
+// CentralState is the command station status bitmask, shared by
+// LAN_X_STATUS_CHANGED and LAN_SYSTEMSTATE_DATACHANGED
+type CentralState uint8
+
+const (
+	CsEmergencyStop         CentralState = 0x01
+	CsTrackVoltageOff       CentralState = 0x02
+	CsShortCircuit          CentralState = 0x04
+	CsProgrammingModeActive CentralState = 0x20
+)
+
+var centralStateNames = []struct {
+	bit  CentralState
+	name string
+}{
+	{CsEmergencyStop, "emergency stop"},
+	{CsTrackVoltageOff, "track voltage off"},
+	{CsShortCircuit, "short circuit"},
+	{CsProgrammingModeActive, "programming mode active"},
+}
+
+// Conditions names the bits that are set, in the order of the bits
+func (s CentralState) Conditions() []string {
+	var conditions []string
+	for _, n := range centralStateNames {
+		if s&n.bit != 0 {
+			conditions = append(conditions, n.name)
+		}
+	}
+	return conditions
+}
+
+// String joins the conditions, "normal operation" when no bit is set
+func (s CentralState) String() string {
+	return joinConditions(s.Conditions())
+}
+
+// CentralStateEx is the extended command station status bitmask from LAN_SYSTEMSTATE_DATACHANGED
+type CentralStateEx uint8
+
+const (
+	CseHighTemperature      CentralStateEx = 0x01
+	CsePowerLost            CentralStateEx = 0x02
+	CseShortCircuitExternal CentralStateEx = 0x04
+	CseShortCircuitInternal CentralStateEx = 0x08
+	CseRCN213               CentralStateEx = 0x20
+)
+
+var centralStateExNames = []struct {
+	bit  CentralStateEx
+	name string
+}{
+	{CseHighTemperature, "high temperature"},
+	{CsePowerLost, "input voltage too low"},
+	{CseShortCircuitExternal, "short circuit on the booster bus"},
+	{CseShortCircuitInternal, "short circuit on the main or programming track"},
+}
+
+// Conditions names the error bits that are set. CseRCN213 is a setting (turnout addressing), not a condition.
+func (s CentralStateEx) Conditions() []string {
+	var conditions []string
+	for _, n := range centralStateExNames {
+		if s&n.bit != 0 {
+			conditions = append(conditions, n.name)
+		}
+	}
+	return conditions
+}
+
+// String joins the conditions, "normal operation" when no error bit is set
+func (s CentralStateEx) String() string {
+	return joinConditions(s.Conditions())
+}
+
+func joinConditions(conditions []string) string {
+	if len(conditions) == 0 {
+		return "normal operation"
+	}
+	return strings.Join(conditions, ", ")
+}
+
+// Capabilities is the feature bitmask from LAN_SYSTEMSTATE_DATACHANGED (FW 1.42+).
+// A zero value means an older firmware which does not report capabilities.
+type Capabilities uint8
+
+const (
+	CapDCC             Capabilities = 0x01
+	CapMM              Capabilities = 0x02
+	CapRailCom         Capabilities = 0x08
+	CapLocoCmds        Capabilities = 0x10
+	CapAccessoryCmds   Capabilities = 0x20
+	CapDetectorCmds    Capabilities = 0x40
+	CapNeedsUnlockCode Capabilities = 0x80
+)
+
+// SystemStateGetData is LAN_SYSTEMSTATE_GETDATA (0x85)
+type SystemStateGetData struct{}
+
+func (SystemStateGetData) Encode() []byte { return frame(HeaderSystemStateGetData, nil) }
+
+// SystemState is LAN_SYSTEMSTATE_DATACHANGED (0x84)
+type SystemState struct {
+	MainCurrent         int16  // mA
+	ProgCurrent         int16  // mA
+	FilteredMainCurrent int16  // mA
+	Temperature         int16  // °C
+	SupplyVoltage       uint16 // mV
+	VCCVoltage          uint16 // mV, identical to track voltage
+	CentralState        CentralState
+	CentralStateEx      CentralStateEx
+	Capabilities        Capabilities
+}
+
+func (m SystemState) Encode() []byte {
+	data := make([]byte, 16)
+	binary.LittleEndian.PutUint16(data[0:2], uint16(m.MainCurrent))
+	binary.LittleEndian.PutUint16(data[2:4], uint16(m.ProgCurrent))
+	binary.LittleEndian.PutUint16(data[4:6], uint16(m.FilteredMainCurrent))
+	binary.LittleEndian.PutUint16(data[6:8], uint16(m.Temperature))
+	binary.LittleEndian.PutUint16(data[8:10], m.SupplyVoltage)
+	binary.LittleEndian.PutUint16(data[10:12], m.VCCVoltage)
+	data[12] = byte(m.CentralState)
+	data[13] = byte(m.CentralStateEx)
+	data[15] = byte(m.Capabilities)
+	return frame(HeaderSystemStateDataChanged, data)
+}
+
+func decodeSystemState(data []byte) (Message, error) {
+	if len(data) < 14 {
+		return nil, fmt.Errorf("%w: LAN_SYSTEMSTATE_DATACHANGED too short (%d bytes)", ErrMalformed, len(data))
+	}
+	m := SystemState{
+		MainCurrent:         int16(binary.LittleEndian.Uint16(data[0:2])),
+		ProgCurrent:         int16(binary.LittleEndian.Uint16(data[2:4])),
+		FilteredMainCurrent: int16(binary.LittleEndian.Uint16(data[4:6])),
+		Temperature:         int16(binary.LittleEndian.Uint16(data[6:8])),
+		SupplyVoltage:       binary.LittleEndian.Uint16(data[8:10]),
+		VCCVoltage:          binary.LittleEndian.Uint16(data[10:12]),
+		CentralState:        CentralState(data[12]),
+		CentralStateEx:      CentralStateEx(data[13]),
+	}
+	// Capabilities exist from FW 1.42
+	if len(data) >= 16 {
+		m.Capabilities = Capabilities(data[15])
+	}
+	return m, nil
+}
+
+// GetVersion is LAN_X_GET_VERSION (0x21 0x21)
+type GetVersion struct{}
+
+func (GetVersion) Encode() []byte { return xFrame(0x21, 0x21) }
+
+// Version is the reply to LAN_X_GET_VERSION (0x63 0x21)
+type Version struct {
+	XBusVersion      byte // 0x30 = V3.0, 0x36 = V3.6, 0x40 = V4.0
+	CommandStationID byte // 0x12 = Z21 device family
+}
+
+func (m Version) Encode() []byte { return xFrame(0x63, 0x21, m.XBusVersion, m.CommandStationID) }
+
+// GetStatus is LAN_X_GET_STATUS (0x21 0x24), answered with LAN_X_STATUS_CHANGED
+type GetStatus struct{}
+
+func (GetStatus) Encode() []byte { return xFrame(0x21, 0x24) }
+
+// StatusChanged is LAN_X_STATUS_CHANGED (0x62 0x22)
+type StatusChanged struct {
+	Status CentralState
+}
+
+func (m StatusChanged) Encode() []byte { return xFrame(0x62, 0x22, byte(m.Status)) }
+
+// SetTrackPowerOff is LAN_X_SET_TRACK_POWER_OFF (0x21 0x80)
+type SetTrackPowerOff struct{}
+
+func (SetTrackPowerOff) Encode() []byte { return xFrame(0x21, 0x80) }
+
+// SetTrackPowerOn is LAN_X_SET_TRACK_POWER_ON (0x21 0x81), it also ends the emergency stop and the programming mode
+type SetTrackPowerOn struct{}
+
+func (SetTrackPowerOn) Encode() []byte { return xFrame(0x21, 0x81) }
+
+// TrackPowerOff is LAN_X_BC_TRACK_POWER_OFF (0x61 0x00)
+type TrackPowerOff struct{}
+
+func (TrackPowerOff) Encode() []byte { return xFrame(0x61, 0x00) }
+
+// TrackPowerOn is LAN_X_BC_TRACK_POWER_ON (0x61 0x01)
+type TrackPowerOn struct{}
+
+func (TrackPowerOn) Encode() []byte { return xFrame(0x61, 0x01) }
+
+// ProgrammingMode is LAN_X_BC_PROGRAMMING_MODE (0x61 0x02)
+type ProgrammingMode struct{}
+
+func (ProgrammingMode) Encode() []byte { return xFrame(0x61, 0x02) }
+
+// TrackShortCircuit is LAN_X_BC_TRACK_SHORT_CIRCUIT (0x61 0x08)
+type TrackShortCircuit struct{}
+
+func (TrackShortCircuit) Encode() []byte { return xFrame(0x61, 0x08) }
+
+// UnknownCommand is LAN_X_UNKNOWN_COMMAND (0x61 0x82), sent in response to an invalid request
+type UnknownCommand struct{}
+
+func (UnknownCommand) Encode() []byte { return xFrame(0x61, 0x82) }
+
+// SetStop is LAN_X_SET_STOP (0x80), the emergency stop keeps the track voltage on
+type SetStop struct{}
+
+func (SetStop) Encode() []byte { return xFrame(0x80) }
+
+// Stopped is LAN_X_BC_STOPPED (0x81 0x00)
+type Stopped struct{}
+
+func (Stopped) Encode() []byte { return xFrame(0x81, 0x00) }
+
+// GetFirmwareVersion is LAN_X_GET_FIRMWARE_VERSION (0xF1 0x0A)
+type GetFirmwareVersion struct{}
+
+func (GetFirmwareVersion) Encode() []byte { return xFrame(0xF1, 0x0A) }
+
+// FirmwareVersion is the reply to LAN_X_GET_FIRMWARE_VERSION (0xF3 0x0A), BCD encoded on the wire
+type FirmwareVersion struct {
+	Major uint8
+	Minor uint8
+}
+
+func (m FirmwareVersion) Encode() []byte { return xFrame(0xF3, 0x0A, toBCD(m.Major), toBCD(m.Minor)) }
+
+func (m FirmwareVersion) String() string { return fmt.Sprintf("%d.%02d", m.Major, m.Minor) }
@@ -0,0 +1,57 @@
+package z21proto
+
+//
+// Context: switching accessory decoders (chapter 5 of the Z21 LAN protocol)
+//
+// Addr is the function address FAdr as used on the wire: FAdr=0 is DCC address 0 port 0,
+// FAdr=4 is DCC address 1 port 0 etc. The mapping to user-visible turnout numbers is up to the caller.
+//
+
+// TurnoutPosition is ZZ from LAN_X_TURNOUT_INFO
+type TurnoutPosition byte
+
+const (
+	TurnoutNotSwitched TurnoutPosition = 0x00
+	TurnoutOutput1     TurnoutPosition = 0x01 // switched with P=0
+	TurnoutOutput2     TurnoutPosition = 0x02 // switched with P=1
+	TurnoutInvalid     TurnoutPosition = 0x03
+)
+
+// GetTurnoutInfo is LAN_X_GET_TURNOUT_INFO (0x43)
+type GetTurnoutInfo struct {
+	Addr uint16
+}
+
+func (m GetTurnoutInfo) Encode() []byte {
+	return xFrame(0x43, byte(m.Addr>>8), byte(m.Addr))
+}
+
+// SetTurnout is LAN_X_SET_TURNOUT (0x53)
+type SetTurnout struct {
+	Addr     uint16
+	Output   uint8 // P: 0 selects output 1, 1 selects output 2
+	Activate bool  // A: activate or deactivate the output
+	Queue    bool  // Q: put the command into the Z21 queue (FW 1.24+)
+}
+
+func (m SetTurnout) Encode() []byte {
+	// DB2: 10Q0A00P
+	db2 := byte(0x80) | m.Output&0x01
+	if m.Activate {
+		db2 |= 0x08
+	}
+	if m.Queue {
+		db2 |= 0x20
+	}
+	return xFrame(0x53, byte(m.Addr>>8), byte(m.Addr), db2)
+}
+
+// TurnoutInfo is LAN_X_TURNOUT_INFO (0x43)
+type TurnoutInfo struct {
+	Addr     uint16
+	Position TurnoutPosition
+}
+
+func (m TurnoutInfo) Encode() []byte {
+	return xFrame(0x43, byte(m.Addr>>8), byte(m.Addr), byte(m.Position)&0x03)
+}
@@ -0,0 +1,41 @@
+package z21proto
+
+import "encoding/binary"
+
+//
+// Context: the X-BUS part of a LAN_X record is an XpressNet packet. The PC interfaces of Lenz (LI-USB, LI101F)
+// exchange the same bytes over a serial port, so the messages of this package are reused by the xpressnet codec.
+//
+
+// XRecord wraps X-BUS bytes into a LAN_X record and appends the XOR checksum, for messages declared outside of this package
+func XRecord(x ...byte) []byte {
+	return xFrame(x...)
+}
+
+// XBus returns the X-BUS bytes of a LAN_X record including the checksum, false for other records
+func XBus(record []byte) ([]byte, bool) {
+	if len(record) < 6 || binary.LittleEndian.Uint16(record[2:4]) != HeaderX {
+		return nil, false
+	}
+	return record[4:], true
+}
+
+// LocoAddrBytes encodes a locomotive address as Adr_MSB, Adr_LSB
+func LocoAddrBytes(addr uint16) (byte, byte) {
+	return locoAddrBytes(addr)
+}
+
+// LocoAddrFromBytes decodes Adr_MSB, Adr_LSB
+func LocoAddrFromBytes(msb, lsb byte) uint16 {
+	return locoAddrFromBytes(msb, lsb)
+}
+
+// SpeedStepsFromID decodes the speed steps identification KKK, as in LAN_X_LOCO_INFO
+func SpeedStepsFromID(kkk byte) SpeedSteps {
+	return speedStepsFromInfo(kkk)
+}
+
+// DecodeSpeed decodes the speed byte RVVVVVVV, see SetLocoDrive for the meaning of the speed
+func DecodeSpeed(steps SpeedSteps, db byte) (uint8, bool) {
+	return decodeSpeed(steps, db)
+}
@@ -8,42 +8,205 @@ import (
 )
 
 type Server struct {
+	// Address is the host of the station, or the serial port of "dccex-serial" and "xpressnet-serial", e.g. "/dev/ttyACM0"
 	Address string
 	Port    uint16
 	Type    string
+	// Transport is "udp" (default) or "tcp" for Z21 tunneled over a stream
+	Transport string
+	// Backup is the address of a backup station, "host" or "host:port" when the port differs.
+	// It is used when this one does not answer.
+	Backup string
+	// Baud is the speed of the serial port, 0 is the default of the station type
+	Baud int
+
+	// request policy defaults, can be overridden per command with --retry and --settle
+	Retries    uint8
+	RetryDelay uint16 `mapstructure:"retry_delay"` // milliseconds between retries
+	Settle     uint16 // milliseconds to wait after a write, before the next write or verification
+
+	// function and speed commands are sent Repeat more times, can be overridden per command with --repeat
+	Repeat         uint8
+	RepeatInterval uint16 `mapstructure:"repeat_interval"` // milliseconds between repetitions
+
+	// outgoing commands rate limit, 0 uses the command station type default, a negative value disables it
+	RateLimit float64 `mapstructure:"rate_limit"` // commands per second
+	Burst     int     // commands that may be sent at once before the limit applies
+
+	// MockState is a JSON file keeping the state of the "mock" station between commands, empty keeps it in memory only
+	MockState string `mapstructure:"mock_state"`
+
+	// Options are the remaining keys, read by the station type from its own configuration, see Decode
+	Options map[string]any `mapstructure:",remain"`
+}
+
+// Decode fills the configuration of a station type, e.g. commandstation.Z21Config, from this profile.
+// The keys are the same as in the configuration file, Options take precedence over the fields above.
+func (s Server) Decode(target any) error {
+	values := map[string]any{
+		"address":         s.Address,
+		"port":            s.Port,
+		"type":            s.Type,
+		"transport":       s.Transport,
+		"backup":          s.Backup,
+		"baud":            s.Baud,
+		"retries":         s.Retries,
+		"retry_delay":     s.RetryDelay,
+		"settle":          s.Settle,
+		"repeat":          s.Repeat,
+		"repeat_interval": s.RepeatInterval,
+		"rate_limit":      s.RateLimit,
+		"burst":           s.Burst,
+		"mock_state":      s.MockState,
+	}
+	for key, value := range s.Options {
+		values[key] = value
+	}
+	v := viper.New()
+	if err := v.MergeConfigMap(values); err != nil {
+		return err
+	}
+	if err := v.Unmarshal(target); err != nil {
+		return fmt.Errorf("invalid configuration of the '%s' station: %w", s.Type, err)
+	}
+	return nil
 }
 
 type Configuration struct {
 	Server Server
+	// Stations are additional, named station profiles, selected with --station
+	Stations map[string]Server
 
 	// CurrentLoco describes a contextual configuration of current locomotive
 	Loco Loco
+
+	// Throttle shapes speed ramps sent by the CLI
+	Throttle Throttle
+
+	// Audit selects the CVs compared with the project files by "loco cv audit"
+	Audit Audit
+}
+
+type Audit struct {
+	// CVs are re-read from every audited locomotive, by default the address, CV29 and the consist address
+	CVs   []uint16 `mapstructure:"cvs"`
+	Locos []AuditLoco
+}
+
+// AuditLoco is a locomotive checked by the audit against the CV file of its project
+type AuditLoco struct {
+	Addr uint16
+	File string
+}
+
+type Throttle struct {
+	// Curve is "linear", "ease-in-out" or a path to a CSV file with "progress,speed" points in percent
+	Curve        string
+	StepInterval uint16 `mapstructure:"step_interval"` // milliseconds between two speed commands of a ramp
 }
 
 type Loco struct {
 	LocoAddr         uint16
 	DecoderType      string
 	RailboxSoundSlot uint8
+	// Name, Class, Era and Owner tell people which locomotive it is, e.g. "218 466-1", "BR 218", "IV", "club"
+	Name  string
+	Class string
+	Era   string
+	Owner string
+	// Image is a photo of the locomotive, relative to the locomotive directory
+	Image string
+	// DecoderAddress is where the WiFi of the decoder is reached, "192.168.4.1" when empty, see "--decoder-address"
+	DecoderAddress string `mapstructure:"decoder_address"`
+	// DecoderUsername and DecoderPassword are sent to a decoder protecting its web interface, or DecoderToken
+	DecoderUsername string `mapstructure:"decoder_username"`
+	DecoderPassword string `mapstructure:"decoder_password"`
+	DecoderToken    string `mapstructure:"decoder_token"`
+	// DecoderSchema is the file describing the CVs of the decoder, ~/.loco/decoders/<DecoderType>.yaml when empty
+	DecoderSchema string `mapstructure:"decoder_schema"`
+}
+
+// serverDefaults apply to the server section and to every profile in the stations section
+var serverDefaults = map[string]any{
+	"address":         "192.168.0.111",
+	"type":            "z21",
+	"transport":       "udp",
+	"retries":         2,
+	"retry_delay":     200,
+	"settle":          300,
+	"repeat":          0,
+	"repeat_interval": 50,
+}
+
+// defaultPorts are the ports of the station types, for a port that is not configured
+var defaultPorts = map[string]uint16{
+	"z21":         21105,
+	"dccex-tcp":   2560,
+	"loconet-tcp": 1234,
+	"withrottle":  12090,
+}
+
+// withDefaultPort sets the port of the station type, when it was not configured
+func withDefaultPort(server Server) Server {
+	if server.Port == 0 {
+		server.Port = defaultPorts[server.Type]
+	}
+	return server
+}
+
+// Station returns the station profile by name. An empty name, or "default", is the server section.
+func (c *Configuration) Station(name string) (Server, error) {
+	if name == "" || name == "default" {
+		return c.Server, nil
+	}
+	server, ok := c.Stations[name]
+	if !ok {
+		return Server{}, fmt.Errorf("unknown station profile '%s', add it to the stations section of ~/.loco.yaml", name)
+	}
+	return server, nil
 }
 
 // LocoAddr represents locomotive address
 type LocoAddr uint16
 
-func NewConfig() (*Configuration, error) {
-	config := Configuration{}
-	config.Loco = Loco{}
-
-	// application configuration
+// applicationConfig looks for ~/.loco.yaml, or .loco.yaml in the current directory
+func applicationConfig() *viper.Viper {
 	v := viper.New()
 	v.SetConfigType("yaml")
 	v.SetConfigName(".loco")
 	v.AddConfigPath("$HOME/")
 	v.AddConfigPath(".")
+	return v
+}
+
+// SaveDecoderAddress stores loco.decoder_address in the application configuration, the path of the file is returned
+func SaveDecoderAddress(address string) (string, error) {
+	v := applicationConfig()
+	_ = v.SafeWriteConfig()
+	if err := v.ReadInConfig(); err != nil {
+		return "", fmt.Errorf("cannot parse config: %s", err.Error())
+	}
+	v.Set("loco.decoder_address", address)
+	if err := v.WriteConfig(); err != nil {
+		return "", fmt.Errorf("cannot save config: %w", err)
+	}
+	return v.ConfigFileUsed(), nil
+}
+
+func NewConfig() (*Configuration, error) {
+	config := Configuration{}
+	config.Loco = Loco{}
+
+	// application configuration
+	v := applicationConfig()
 	_ = v.SafeWriteConfig()
 
-	v.SetDefault("server.address", "192.168.0.111")
-	v.SetDefault("server.port", 21105)
-	v.SetDefault("server.type", "z21")
+	for key, value := range serverDefaults {
+		v.SetDefault("server."+key, value)
+	}
+	v.SetDefault("throttle.curve", "linear")
+	v.SetDefault("throttle.step_interval", 100)
+	v.SetDefault("audit.cvs", []uint16{1, 17, 18, 19, 29})
 
 	// contextual locomotive configuration (when current working directory is a locomotive directory that contains loco.json file)
 	l := viper.New()
@@ -56,9 +219,19 @@ func NewConfig() (*Configuration, error) {
 	if err := v.ReadInConfig(); err != nil {
 		return &Configuration{}, fmt.Errorf("cannot parse config: %s", err.Error())
 	}
+	// profiles get the same defaults as the server section
+	for name := range v.GetStringMap("stations") {
+		for key, value := range serverDefaults {
+			v.SetDefault("stations."+name+"."+key, value)
+		}
+	}
 	if err := v.Unmarshal(&config); err != nil {
 		return &config, fmt.Errorf("cannot parse config: %s", err.Error())
 	}
+	config.Server = withDefaultPort(config.Server)
+	for name, server := range config.Stations {
+		config.Stations[name] = withDefaultPort(server)
+	}
 	if err := l.ReadInConfig(); err != nil {
 		// make loco.json fully optional
 		if !strings.Contains(err.Error(), "Not Found") {
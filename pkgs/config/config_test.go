@@ -0,0 +1,93 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type backendConfig struct {
+	Address   string
+	Port      uint16
+	RateLimit float64 `mapstructure:"rate_limit"`
+	Throttle  string
+	Slots     int
+}
+
+func TestServer_Decode(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	require.NoError(t, v.ReadConfig(strings.NewReader(`
+server:
+  type: custom
+  address: 10.0.0.5
+  port: 4000
+  rate_limit: 12.5
+  throttle: west
+  slots: 4
+`)))
+	var cfg Configuration
+	require.NoError(t, v.Unmarshal(&cfg))
+	assert.Equal(t, map[string]any{"throttle": "west", "slots": 4}, cfg.Server.Options)
+
+	var decoded backendConfig
+	require.NoError(t, cfg.Server.Decode(&decoded))
+	assert.Equal(t, backendConfig{Address: "10.0.0.5", Port: 4000, RateLimit: 12.5, Throttle: "west", Slots: 4}, decoded)
+}
+
+func TestServer_DecodeInvalidOption(t *testing.T) {
+	server := Server{Type: "custom", Options: map[string]any{"slots": "many"}}
+	var decoded backendConfig
+	assert.ErrorContains(t, server.Decode(&decoded), "invalid configuration of the 'custom' station")
+}
+
+func TestSaveDecoderAddress(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	require.NoError(t, os.WriteFile(filepath.Join(home, ".loco.yaml"), []byte("server:\n  address: 10.0.0.5\n"), 0o644))
+
+	path, err := SaveDecoderAddress("10.0.0.20")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(home, ".loco.yaml"), path)
+
+	cfg, err := NewConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.20", cfg.Loco.DecoderAddress)
+	assert.Equal(t, "10.0.0.5", cfg.Server.Address)
+}
+
+func TestNewConfig_RequestPolicy(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	cfg, err := NewConfig()
+	require.NoError(t, err)
+	assert.Equal(t, uint8(2), cfg.Server.Retries)
+	assert.Equal(t, uint16(200), cfg.Server.RetryDelay)
+	assert.Equal(t, uint16(300), cfg.Server.Settle)
+
+	require.NoError(t, os.WriteFile(filepath.Join(home, ".loco.yaml"), []byte("server:\n  retries: 5\n  retry_delay: 50\n  settle: 0\n"), 0o644))
+	cfg, err = NewConfig()
+	require.NoError(t, err)
+	assert.Equal(t, uint8(5), cfg.Server.Retries)
+	assert.Equal(t, uint16(50), cfg.Server.RetryDelay)
+	assert.Equal(t, uint16(0), cfg.Server.Settle)
+}
+
+func TestNewConfig_LocoMetadata(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	locoDir := t.TempDir()
+	t.Chdir(locoDir)
+	require.NoError(t, os.WriteFile(filepath.Join(locoDir, "loco.json"), []byte(`{"locoAddr": 218, "decoderType": "rb2300",
+"name": "218 466-1", "class": "BR 218", "era": "IV", "owner": "club", "image": "photos/218.jpg"}`), 0o644))
+
+	cfg, err := NewConfig()
+	require.NoError(t, err)
+	assert.Equal(t, Loco{LocoAddr: 218, DecoderType: "rb2300", Name: "218 466-1", Class: "BR 218", Era: "IV", Owner: "club",
+		Image: "photos/218.jpg"}, cfg.Loco)
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+//
+// Context: shared layout PCs, e.g. in a club. Guests may drive the trains, but must not reprogram the fleet.
+// The policy lives outside of the home directory, so a guest cannot change it, and it is optional:
+// without the file every command is allowed.
+//
+
+// DefaultPolicyPath is where the policy of the machine is read from
+const DefaultPolicyPath = "/etc/loco/policy.yaml"
+
+// CapabilityCVWrite is the capability of every command that writes CVs to a decoder, e.g. "cv apply", "addr set"
+// or "prog-session". It is denied by a rule "cv:write" and by any rule denying "cv set".
+const CapabilityCVWrite = "cv:write"
+
+// capabilityCommands are the commands a capability is denied together with
+var capabilityCommands = map[string]string{CapabilityCVWrite: "cv set"}
+
+// Policy selects a profile for every system user, the profile decides which commands may run
+type Policy struct {
+	// Default is the profile of the users not listed in Users, empty allows everything to them
+	Default string
+	// Users maps system user names to profiles
+	Users    map[string]string
+	Profiles map[string]PolicyProfile
+}
+
+// PolicyProfile lists commands as their path without "loco", e.g. "cv set". A command matches its subcommands too.
+// When Allow is empty everything that is not denied is allowed, Deny always wins and denies the capabilities too,
+// see CapabilityCVWrite.
+type PolicyProfile struct {
+	Allow []string
+	Deny  []string
+}
+
+// LoadPolicy reads the policy file, a missing file returns a nil policy
+func LoadPolicy(path string) (*Policy, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("yaml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("cannot read the policy %q: %s", path, err)
+	}
+	policy := &Policy{}
+	if err := v.Unmarshal(policy); err != nil {
+		return nil, fmt.Errorf("cannot parse the policy %q: %s", path, err)
+	}
+	// a profile without any rules, e.g. "admin: {}", is not unmarshalled
+	for name := range v.GetStringMap("profiles") {
+		if _, ok := policy.Profiles[name]; !ok {
+			if policy.Profiles == nil {
+				policy.Profiles = make(map[string]PolicyProfile)
+			}
+			policy.Profiles[name] = PolicyProfile{}
+		}
+	}
+	// viper lower-cases the keys of the maps
+	policy.Default = strings.ToLower(policy.Default)
+	for user, profile := range policy.Users {
+		policy.Users[user] = strings.ToLower(profile)
+	}
+	if _, ok := policy.Profiles[policy.Default]; policy.Default != "" && !ok {
+		return nil, fmt.Errorf("the policy %q has no profile '%s'", path, policy.Default)
+	}
+	for user, profile := range policy.Users {
+		if _, ok := policy.Profiles[profile]; !ok {
+			return nil, fmt.Errorf("the policy %q assigns user '%s' to a missing profile '%s'", path, user, profile)
+		}
+	}
+	return policy, nil
+}
+
+// ProfileOf returns the name of the profile applied to the user, empty when nothing is restricted
+func (p *Policy) ProfileOf(user string) string {
+	if profile, ok := p.Users[strings.ToLower(user)]; ok {
+		return profile
+	}
+	return p.Default
+}
+
+// Allows tells whether the user may run the command, given as its path without "loco", e.g. "cv set",
+// with the capabilities it needs
+func (p *Policy) Allows(user string, command string, capabilities ...string) bool {
+	name := p.ProfileOf(user)
+	if name == "" {
+		return true
+	}
+	profile := p.Profiles[name]
+	for _, denied := range profile.Deny {
+		if commandMatches(denied, command) {
+			return false
+		}
+		for _, capability := range capabilities {
+			if denied == capability || commandMatches(denied, capabilityCommands[capability]) {
+				return false
+			}
+		}
+	}
+	if len(profile.Allow) == 0 {
+		return true
+	}
+	for _, allowed := range profile.Allow {
+		if commandMatches(allowed, command) {
+			return true
+		}
+	}
+	return false
+}
+
+// commandMatches compares whole words, "cv" matches "cv set" but not "cvx"
+func commandMatches(rule string, command string) bool {
+	rule = strings.Join(strings.Fields(rule), " ")
+	return rule == "*" || command == rule || strings.HasPrefix(command, rule+" ")
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`default: Guest
+users:
+    club: admin
+profiles:
+    guest:
+        allow: ["speed", "fn", "status"]
+        deny: ["fn set"]
+    admin: {}
+`), 0o644))
+
+	policy, err := LoadPolicy(path)
+	assert.NoError(t, err)
+	assert.True(t, policy.Allows("visitor", "speed ramp"))
+	assert.False(t, policy.Allows("visitor", "fn set"))
+	assert.True(t, policy.Allows("visitor", "fn list"))
+	assert.False(t, policy.Allows("visitor", "cv get"))
+	assert.False(t, policy.Allows("visitor", "statusx"))
+	assert.True(t, policy.Allows("club", "cv set"))
+
+	// the CVs are written by other commands than "cv set" too
+	policy.Profiles["guest"] = PolicyProfile{Deny: []string{"cv set"}}
+	assert.False(t, policy.Allows("visitor", "prog-session", CapabilityCVWrite))
+	assert.True(t, policy.Allows("visitor", "cv29 compose"))
+	policy.Profiles["guest"] = PolicyProfile{Deny: []string{"cv:write"}}
+	assert.False(t, policy.Allows("visitor", "cv apply", CapabilityCVWrite))
+	assert.True(t, policy.Allows("visitor", "cv get"))
+	assert.True(t, policy.Allows("club", "cv apply", CapabilityCVWrite))
+
+	missing, err := LoadPolicy(filepath.Join(t.TempDir(), "none.yaml"))
+	assert.NoError(t, err)
+	assert.Nil(t, missing)
+
+	assert.NoError(t, os.WriteFile(path, []byte("default: nobody\n"), 0o644))
+	_, err = LoadPolicy(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,64 @@
+// Package cvdefs describes the standard NMRA configuration variables.
+package cvdefs
+
+import "sort"
+
+// Priority tells how valuable a CV is in a backup, a lower value is read first
+type Priority int
+
+const (
+	// PriorityIdentity are the addresses, the decoder identification and CV29 - without them the locomotive cannot be driven
+	PriorityIdentity Priority = iota
+	// PriorityConfiguration are the motor and speed settings
+	PriorityConfiguration
+	// PriorityFunctionMapping assigns the functions to outputs
+	PriorityFunctionMapping
+	// PriorityOther is every CV that is not described
+	PriorityOther
+	// PrioritySound are the indexed (CV31/32) or extended CVs above 256, mostly the sound banks
+	PrioritySound
+)
+
+var priorities = map[uint16]Priority{
+	1: PriorityIdentity, 7: PriorityIdentity, 8: PriorityIdentity, 17: PriorityIdentity, 18: PriorityIdentity,
+	19: PriorityIdentity, 29: PriorityIdentity, 105: PriorityIdentity, 106: PriorityIdentity,
+}
+
+// priorityRanges are applied in order, when the CV is not listed in priorities
+var priorityRanges = []struct {
+	from, to uint16
+	priority Priority
+}{
+	{2, 6, PriorityConfiguration},     // start, acceleration, deceleration, maximum and middle speed
+	{9, 16, PriorityConfiguration},    // PWM, EMF cutout, packet timeout, power source, analog functions, lock
+	{20, 28, PriorityConfiguration},   // extended consist address, consist functions, braking, RailCom
+	{31, 32, PriorityConfiguration},   // index of the extended CV pages
+	{33, 46, PriorityFunctionMapping}, // NMRA function mapping
+	{47, 64, PriorityConfiguration},   // manufacturer specific, mostly motor control
+	{66, 95, PriorityConfiguration},   // speed trim and speed table
+	{257, 1024, PrioritySound},
+}
+
+// PriorityOf returns the backup priority of a CV
+func PriorityOf(cv uint16) Priority {
+	if priority, ok := priorities[cv]; ok {
+		return priority
+	}
+	for _, r := range priorityRanges {
+		if cv >= r.from && cv <= r.to {
+			return r.priority
+		}
+	}
+	return PriorityOther
+}
+
+// SortByPriority orders CVs for reading: the most valuable first, by number within the same priority
+func SortByPriority(cvs []uint16) {
+	sort.SliceStable(cvs, func(i, j int) bool {
+		pi, pj := PriorityOf(cvs[i]), PriorityOf(cvs[j])
+		if pi != pj {
+			return pi < pj
+		}
+		return cvs[i] < cvs[j]
+	})
+}
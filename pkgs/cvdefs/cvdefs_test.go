@@ -0,0 +1,33 @@
+package cvdefs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSortByPriority(t *testing.T) {
+	cvs := []uint16{300, 3, 40, 1, 120, 29, 257, 2, 17}
+	SortByPriority(cvs)
+
+	expected := []uint16{1, 17, 29, 2, 3, 40, 120, 257, 300}
+	if !reflect.DeepEqual(cvs, expected) {
+		t.Errorf("SortByPriority() = %v; want %v", cvs, expected)
+	}
+}
+
+func TestPriorityOf(t *testing.T) {
+	cases := map[uint16]Priority{
+		1:   PriorityIdentity,
+		31:  PriorityConfiguration,
+		5:   PriorityConfiguration,
+		67:  PriorityConfiguration,
+		35:  PriorityFunctionMapping,
+		200: PriorityOther,
+		512: PrioritySound,
+	}
+	for cv, expected := range cases {
+		if got := PriorityOf(cv); got != expected {
+			t.Errorf("PriorityOf(%d) = %d; want %d", cv, got, expected)
+		}
+	}
+}
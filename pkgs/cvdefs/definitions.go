@@ -0,0 +1,178 @@
+package cvdefs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Definition describes a CV, or a block of CVs with the same meaning (e.g. the speed table)
+type Definition struct {
+	Number uint16
+	// Last is the last CV of a block, 0 for a single CV
+	Last        uint16
+	Name        string
+	Description string
+	// Default is the usual factory value, nil when it differs between decoders
+	Default *uint8
+	// Min and Max are the safe values, both 0 when the whole byte is allowed
+	Min, Max uint8
+	Bits     []Bit
+	ReadOnly bool
+}
+
+// Bit is the meaning of a single bit of a CV
+type Bit struct {
+	Bit  uint8
+	Name string
+	// Off and On describe the bit when it is cleared and set
+	Off, On string
+}
+
+// Covers tells if the CV belongs to the definition
+func (d Definition) Covers(cv uint16) bool {
+	if d.Last == 0 {
+		return cv == d.Number
+	}
+	return cv >= d.Number && cv <= d.Last
+}
+
+// Range returns "cv29" or "cv67-cv94"
+func (d Definition) Range() string {
+	if d.Last == 0 {
+		return fmt.Sprintf("cv%d", d.Number)
+	}
+	return fmt.Sprintf("cv%d-cv%d", d.Number, d.Last)
+}
+
+// Explain describes a value of the CV, e.g. "28/128 steps, long address (CV17/CV18), analog off" for 34 of CV29.
+// The set bits are listed, followed by the cleared bits that are set by default or, without a default,
+// by every cleared bit. An empty string is returned when there is nothing to tell about the value.
+func (d Definition) Explain(value uint8) string {
+	var notes []string
+	limit := d.Max
+	if limit == 0 {
+		limit = 255
+	}
+	if (d.Min != 0 || d.Max != 0) && (value < d.Min || value > limit) {
+		notes = append(notes, fmt.Sprintf("outside of the safe values %d-%d", d.Min, limit))
+	}
+	var described uint8
+	var cleared []string
+	for _, bit := range d.Bits {
+		mask := uint8(1) << bit.Bit
+		described |= mask
+		switch {
+		case value&mask != 0:
+			notes = append(notes, bit.On)
+		case d.Default == nil || *d.Default&mask != 0:
+			cleared = append(cleared, bit.Off)
+		}
+	}
+	notes = append(notes, cleared...)
+	if rest := value &^ described; len(d.Bits) > 0 && rest != 0 {
+		notes = append(notes, fmt.Sprintf("%d in the other bits", rest))
+	}
+	if d.Default != nil && value == *d.Default {
+		notes = append(notes, "default")
+	}
+	return strings.Join(notes, ", ")
+}
+
+// Check tells why a value cannot be written to a CV of the definition: it is read-only, or the value is outside
+// of the safe values
+func (d Definition) Check(cv uint16, value uint16) error {
+	limit := d.Max
+	if limit == 0 {
+		limit = 255
+	}
+	switch {
+	case d.ReadOnly:
+		return fmt.Errorf("cv%d (%s) is read-only", cv, d.Name)
+	case value > uint16(limit) || value < uint16(d.Min):
+		return fmt.Errorf("cv%d=%d is outside of the values %d-%d of %s", cv, value, d.Min, limit, d.Name)
+	}
+	return nil
+}
+
+// Find returns the definition of a CV, with the definitions of the decoder family in place of the standard ones
+func Find(cv uint16, family string) (Definition, bool) {
+	for _, def := range Definitions(family) {
+		if def.Covers(cv) {
+			return def, true
+		}
+	}
+	return Definition{}, false
+}
+
+// Definitions returns the NMRA definitions, with the definitions of the decoder family in place of the standard ones.
+// An unknown or empty family returns only the NMRA definitions.
+func Definitions(family string) []Definition {
+	familiesMu.RLock()
+	specific := families[strings.ToLower(family)]
+	familiesMu.RUnlock()
+	var all []Definition
+	for _, def := range nmra {
+		if !overridden(def, specific) {
+			all = append(all, def)
+		}
+	}
+	all = append(all, specific...)
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Number < all[j].Number })
+	return all
+}
+
+func overridden(def Definition, specific []Definition) bool {
+	for _, s := range specific {
+		if s.Covers(def.Number) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup finds a definition by a CV number ("29", "cv29") or by a part of its name ("speed table").
+// A name matching more than one CV is an error listing the candidates.
+func Lookup(query string, family string) (Definition, error) {
+	query = strings.TrimSpace(strings.ToLower(query))
+	definitions := Definitions(family)
+
+	if number, err := strconv.ParseUint(strings.TrimPrefix(query, "cv"), 10, 16); err == nil {
+		if def, ok := Find(uint16(number), family); ok {
+			return def, nil
+		}
+		return Definition{}, fmt.Errorf("cv%d is not described, see the manual of the decoder", number)
+	}
+
+	var matches []Definition
+	for _, def := range definitions {
+		name := strings.ToLower(def.Name)
+		if name == query {
+			return def, nil
+		}
+		if strings.Contains(name, query) {
+			matches = append(matches, def)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return Definition{}, fmt.Errorf("no CV is named %q", query)
+	case 1:
+		return matches[0], nil
+	}
+	candidates := make([]string, 0, len(matches))
+	for _, def := range matches {
+		candidates = append(candidates, fmt.Sprintf("%s (%s)", def.Range(), def.Name))
+	}
+	return Definition{}, fmt.Errorf("%q matches more than one CV: %s", query, strings.Join(candidates, ", "))
+}
+
+// Family returns the decoder family of a manufacturer ID (CV8), empty when there are no family specific definitions
+func Family(manufacturer uint8) string {
+	return manufacturers[manufacturer]
+}
+
+func value(v uint8) *uint8 {
+	return &v
+}
@@ -0,0 +1,73 @@
+package cvdefs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	cases := []struct {
+		query, family string
+		expected      string
+	}{
+		{"29", "", "Configuration Data #1"},
+		{"CV29", "", "Configuration Data #1"},
+		{"70", "", "Speed Table"},
+		{"speed table", "", "Speed Table"},
+		{"56", "zimo", "Motor Regulation"},
+		{"54", "ESU", "Load Control K"},
+	}
+	for _, c := range cases {
+		def, err := Lookup(c.query, c.family)
+		if err != nil {
+			t.Errorf("Lookup(%q, %q) returned error: %s", c.query, c.family, err)
+			continue
+		}
+		if def.Name != c.expected {
+			t.Errorf("Lookup(%q, %q) = %q; want %q", c.query, c.family, def.Name, c.expected)
+		}
+	}
+
+	if _, err := Lookup("56", ""); err == nil {
+		t.Error("Lookup(56) without a family should fail")
+	}
+	if _, err := Lookup("address", ""); err == nil || !strings.Contains(err.Error(), "cv1 (Primary Address)") {
+		t.Errorf("Lookup(address) should list the candidates, got %v", err)
+	}
+}
+
+func TestFamily(t *testing.T) {
+	if got := Family(145); got != "zimo" {
+		t.Errorf("Family(145) = %q; want zimo", got)
+	}
+	if got := Family(13); got != "" {
+		t.Errorf("Family(13) = %q; want none", got)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	cases := []struct {
+		cv       uint16
+		value    uint8
+		expected string
+	}{
+		{29, 34, "28/128 steps, long address (CV17/CV18), analog off"},
+		{29, 6, "28/128 steps, analog on, default"},
+		{29, 1, "reversed direction, 14 steps, analog off"},
+		{19, 133, "reversed in consist, 5 in the other bits"},
+		{28, 0, "no address broadcast, no data in channel 2"},
+		{1, 3, "default"},
+		{1, 0, "outside of the safe values 1-127"},
+		{17, 192, ""},
+		{3, 12, ""},
+	}
+	for _, c := range cases {
+		def, ok := Find(c.cv, "")
+		if !ok {
+			t.Fatalf("Find(%d) found no definition", c.cv)
+		}
+		if got := def.Explain(c.value); got != c.expected {
+			t.Errorf("cv%d.Explain(%d) = %q; want %q", c.cv, c.value, got, c.expected)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package cvdefs
+
+// manufacturers maps the NMRA manufacturer ID (CV8) to a decoder family with specific definitions
+var manufacturers = map[uint8]string{
+	145: "zimo",
+	151: "esu",
+}
+
+// families replace the NMRA definitions where the manufacturer uses the CVs differently
+var families = map[string][]Definition{
+	"esu": {
+		{Number: 52, Name: "Load Control K Slow", Description: "Proportional part of the load control at the lowest speed steps"},
+		{Number: 53, Name: "Control Reference Voltage", Description: "Back-EMF voltage the motor reaches at the maximum speed"},
+		{Number: 54, Name: "Load Control K", Description: "Proportional part of the load control, higher values regulate harder"},
+		{Number: 55, Name: "Load Control I", Description: "Integral part of the load control, to match the inertia of the motor"},
+	},
+	"zimo": {
+		{Number: 56, Name: "Motor Regulation", Description: "P and I values of the motor regulation, tens are P and units are I, 55 is the default", Default: value(55)},
+		{Number: 57, Name: "Voltage Reference", Description: "Voltage the motor speed is regulated to in tenths of a volt, 0 follows the track voltage"},
+		{Number: 58, Name: "Back-EMF Intensity", Description: "Strength of the load compensation at the lowest speed"},
+	},
+}
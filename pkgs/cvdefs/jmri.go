@@ -0,0 +1,216 @@
+package cvdefs
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//
+// Context: JMRI (DecoderPro) describes hundreds of decoder models in XML, a decoder definition lists the variables
+// of the decoder, each one a CV or some bits of a CV. ImportJMRI converts such a file into a schema, what a schema
+// cannot tell (indexed CVs, fields of several bits, the included files of JMRI) is reported as skipped.
+//
+
+// jmriDecoderConfig is the part of a JMRI decoder definition that is imported
+type jmriDecoderConfig struct {
+	XMLName xml.Name `xml:"decoder-config"`
+	Decoder struct {
+		Family struct {
+			Name   string `xml:"name,attr"`
+			Mfg    string `xml:"mfg,attr"`
+			Models []struct {
+				Model string `xml:"model,attr"`
+			} `xml:"model"`
+		} `xml:"family"`
+		Variables struct {
+			Variables []jmriVariable `xml:"variable"`
+			Includes  []jmriInclude  `xml:"include"`
+		} `xml:"variables"`
+	} `xml:"decoder"`
+}
+
+type jmriInclude struct {
+	Href string `xml:"href,attr"`
+}
+
+// jmriVariable is a variable of a decoder definition, the mask marks its bits with "V", e.g. "XXXXXXVX" for bit 1
+type jmriVariable struct {
+	CV       string `xml:"CV,attr"`
+	Item     string `xml:"item,attr"`
+	Mask     string `xml:"mask,attr"`
+	Default  string `xml:"default,attr"`
+	ReadOnly string `xml:"readOnly,attr"`
+	Tooltip  string `xml:"tooltip,attr"`
+	Tooltips []struct {
+		Lang string `xml:"lang,attr"`
+		Text string `xml:",chardata"`
+	} `xml:"tooltip"`
+	DecVal *struct {
+		Min string `xml:"min,attr"`
+		Max string `xml:"max,attr"`
+	} `xml:"decVal"`
+	EnumVal *struct {
+		Choices []struct {
+			Choice string `xml:"choice,attr"`
+			Value  string `xml:"value,attr"`
+		} `xml:"enumChoice"`
+	} `xml:"enumVal"`
+	SpeedTableVal *struct {
+		Entries string `xml:"entries,attr"`
+	} `xml:"speedTableVal"`
+}
+
+// ImportJMRI converts a JMRI decoder definition into a schema, the skipped variables are returned as notes
+func ImportJMRI(r io.Reader) (*Schema, []string, error) {
+	config := jmriDecoderConfig{}
+	if err := xml.NewDecoder(r).Decode(&config); err != nil {
+		return nil, nil, fmt.Errorf("cannot parse the JMRI decoder definition: %w", err)
+	}
+	family := config.Decoder.Family
+	schema := &Schema{Name: strings.TrimSpace(family.Mfg + " " + family.Name)}
+	if len(family.Models) > 0 {
+		models := make([]string, 0, len(family.Models))
+		for _, model := range family.Models {
+			models = append(models, model.Model)
+		}
+		schema.Models = models
+	}
+
+	var skipped []string
+	byNumber := map[uint16]int{}
+	full := map[uint16]bool{}
+	for _, variable := range config.Decoder.Variables.Variables {
+		item := strings.TrimSpace(variable.Item)
+		num, err := strconv.ParseUint(strings.TrimSpace(variable.CV), 10, 16)
+		if err != nil || num == 0 || num > 1024 {
+			skipped = append(skipped, fmt.Sprintf("%q: the cv %q is not a plain CV number", item, variable.CV))
+			continue
+		}
+		number := uint16(num)
+		index, known := byNumber[number]
+		if !known {
+			index = len(schema.CVs)
+			byNumber[number] = index
+			schema.CVs = append(schema.CVs, schemaCV{CV: strconv.Itoa(int(number))})
+		}
+		cv := &schema.CVs[index]
+
+		bits, err := jmriMaskBits(variable.Mask)
+		switch {
+		case err != nil:
+			skipped = append(skipped, fmt.Sprintf("cv%d %q: %s", number, item, err))
+		case variable.SpeedTableVal != nil:
+			entries, err := strconv.ParseUint(variable.SpeedTableVal.Entries, 10, 16)
+			if err != nil || entries < 2 {
+				entries = 28
+			}
+			cv.CV = fmt.Sprintf("%d-%d", number, int(number)+int(entries)-1)
+			cv.Name = item
+			full[number] = true
+		case len(bits) == 8:
+			if full[number] {
+				skipped = append(skipped, fmt.Sprintf("cv%d %q: cv%d is already described by %q", number, item, number, cv.Name))
+				continue
+			}
+			full[number] = true
+			cv.Name = item
+			cv.Description = variable.tooltip()
+			cv.ReadOnly = variable.ReadOnly == "yes" || variable.ReadOnly == "true"
+			if value, err := strconv.ParseUint(variable.Default, 10, 8); err == nil {
+				def := uint8(value)
+				cv.Default = &def
+			}
+			if variable.DecVal != nil {
+				minimum, _ := strconv.ParseUint(variable.DecVal.Min, 10, 8)
+				maximum, err := strconv.ParseUint(variable.DecVal.Max, 10, 8)
+				if err == nil && (minimum != 0 || maximum != 255) {
+					cv.Min, cv.Max = uint8(minimum), uint8(maximum)
+				}
+			}
+		case len(bits) == 1:
+			bit := Bit{Bit: bits[0], Name: item, Off: item + " off", On: item + " on"}
+			if variable.EnumVal != nil && len(variable.EnumVal.Choices) == 2 {
+				choices := variable.EnumVal.Choices
+				bit.Off, bit.On = choices[0].Choice, choices[1].Choice
+				if choices[0].Value == "1" && choices[1].Value != "1" {
+					bit.Off, bit.On = bit.On, bit.Off
+				}
+			}
+			if cv.hasBit(bit.Bit) {
+				skipped = append(skipped, fmt.Sprintf("cv%d %q: bit %d is already described", number, item, bit.Bit))
+				continue
+			}
+			cv.Bits = append(cv.Bits, bit)
+			if cv.Name == "" {
+				cv.Name = item
+			}
+		default:
+			skipped = append(skipped, fmt.Sprintf("cv%d %q: a field of %d bits", number, item, len(bits)))
+			if cv.Name == "" {
+				cv.Name = item
+			}
+		}
+	}
+
+	// a CV described by its bits only is named as in NMRA, e.g. CV29 is not "Locomotive Direction",
+	// a CV of which nothing could be imported is left out
+	cvs := schema.CVs[:0]
+	for _, cv := range schema.CVs {
+		first, _, _ := parseSchemaRange(cv.CV)
+		if def, ok := Find(first, ""); ok && !full[first] {
+			cv.Name = def.Name
+		}
+		if cv.Name != "" {
+			cvs = append(cvs, cv)
+		}
+	}
+	schema.CVs = cvs
+	for _, include := range config.Decoder.Variables.Includes {
+		skipped = append(skipped, fmt.Sprintf("the included definitions %s", include.Href))
+	}
+
+	if _, err := schema.Definitions(); err != nil {
+		return nil, skipped, fmt.Errorf("the JMRI decoder definition does not make a valid schema: %w", err)
+	}
+	return schema, skipped, nil
+}
+
+// tooltip is the english tooltip of the variable
+func (v jmriVariable) tooltip() string {
+	if v.Tooltip != "" {
+		return strings.TrimSpace(v.Tooltip)
+	}
+	for _, tooltip := range v.Tooltips {
+		if tooltip.Lang == "" || tooltip.Lang == "en" {
+			return strings.Join(strings.Fields(tooltip.Text), " ")
+		}
+	}
+	return ""
+}
+
+// jmriMaskBits returns the bits marked by a mask, the first character of the mask is bit 7, all bits without a mask
+func jmriMaskBits(mask string) ([]uint8, error) {
+	if mask == "" {
+		return []uint8{7, 6, 5, 4, 3, 2, 1, 0}, nil
+	}
+	if len(mask) != 8 {
+		return nil, fmt.Errorf("the mask %q is not 8 bits long", mask)
+	}
+	var bits []uint8
+	for i, c := range mask {
+		switch c {
+		case 'V':
+			bits = append(bits, uint8(7-i))
+		case 'X':
+		default:
+			return nil, fmt.Errorf("invalid mask %q", mask)
+		}
+	}
+	if len(bits) == 0 {
+		return nil, fmt.Errorf("the mask %q marks no bit", mask)
+	}
+	return bits, nil
+}
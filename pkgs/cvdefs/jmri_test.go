@@ -0,0 +1,86 @@
+package cvdefs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportJMRI(t *testing.T) {
+	file, err := os.Open(filepath.Join("testdata", "jmri_decoder.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	schema, skipped, err := ImportJMRI(file)
+	if err != nil {
+		t.Fatalf("ImportJMRI returned error: %s", err)
+	}
+	if schema.Name != "Railbox Sample Sound" || strings.Join(schema.Models, ",") != "RB2300,RB2310" {
+		t.Errorf("schema = %q %v", schema.Name, schema.Models)
+	}
+	for _, note := range []string{`cv49 "Headlight Effect": a field of 4 bits`, `"Indexed Volume": the cv "16.0.257" is not a plain CV number`, "shortAndLongAddress.xml"} {
+		if !strings.Contains(strings.Join(skipped, "\n"), note) {
+			t.Errorf("skipped %q does not contain %q", skipped, note)
+		}
+	}
+
+	// the schema is written and read back like a hand-written one
+	path := filepath.Join(t.TempDir(), "sample.yaml")
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.WriteYAML(out); err != nil {
+		t.Fatalf("WriteYAML returned error: %s", err)
+	}
+	_ = out.Close()
+	loaded, err := LoadSchema(path)
+	if err != nil {
+		t.Fatalf("LoadSchema returned error: %s", err)
+	}
+	definitions, err := loaded.Definitions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterFamily("jmri-test", definitions)
+
+	tests := []struct {
+		cv      uint16
+		value   uint8
+		name    string
+		explain string
+	}{
+		{3, 8, "Accel", "default"},
+		{3, 80, "Accel", "outside of the safe values 0-64"},
+		{29, 1, "Configuration Data #1", "Reverse, Off"},
+		{29, 4, "Configuration Data #1", "On, Normal"},
+		{49, 64, "Headlight Effect", "Dimmed Headlights on"},
+		{80, 0, "Speed Table", ""},
+	}
+	for _, tt := range tests {
+		def, ok := Find(tt.cv, "jmri-test")
+		if !ok || def.Name != tt.name {
+			t.Errorf("Find(%d) = %q, %v, want %q", tt.cv, def.Name, ok, tt.name)
+			continue
+		}
+		if got := def.Explain(tt.value); got != tt.explain {
+			t.Errorf("cv%d.Explain(%d) = %q, want %q", tt.cv, tt.value, got, tt.explain)
+		}
+	}
+	def, _ := Find(3, "jmri-test")
+	if def.Description != "Sets the time between two speed steps when accelerating" {
+		t.Errorf("cv3 description = %q", def.Description)
+	}
+	if def, _ := Find(7, "jmri-test"); !def.ReadOnly {
+		t.Error("cv7 should be read-only")
+	}
+}
+
+func TestImportJMRI_Invalid(t *testing.T) {
+	if _, _, err := ImportJMRI(strings.NewReader("<decoder-index/>")); err == nil {
+		t.Error("ImportJMRI of an index should fail")
+	}
+}
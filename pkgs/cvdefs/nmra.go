@@ -0,0 +1,55 @@
+package cvdefs
+
+// nmra are the CVs defined by NMRA S-9.2.2 for multifunction decoders
+var nmra = []Definition{
+	{Number: 1, Name: "Primary Address", Description: "Short address of the locomotive, used when CV29 bit 5 is cleared", Default: value(3), Min: 1, Max: 127},
+	{Number: 2, Name: "Vstart", Description: "Voltage applied to the motor at speed step 1"},
+	{Number: 3, Name: "Acceleration Rate", Description: "Time between two speed steps when accelerating, multiplied by 0.896 s / number of speed steps"},
+	{Number: 4, Name: "Deceleration Rate", Description: "Time between two speed steps when braking, multiplied by 0.896 s / number of speed steps"},
+	{Number: 5, Name: "Vhigh", Description: "Voltage applied to the motor at the highest speed step, 0 or 1 uses the maximum"},
+	{Number: 6, Name: "Vmid", Description: "Voltage applied to the motor at the middle speed step, shapes the three-point speed curve"},
+	{Number: 7, Name: "Manufacturer Version", Description: "Version of the decoder firmware", ReadOnly: true},
+	{Number: 8, Name: "Manufacturer ID", Description: "NMRA manufacturer ID, writing a value (usually 8) resets many decoders to factory settings", ReadOnly: true},
+	{Number: 9, Name: "Total PWM Period", Description: "Frequency of the motor drive"},
+	{Number: 10, Name: "EMF Feedback Cutout", Description: "Speed step above which the back-EMF compensation is reduced"},
+	{Number: 11, Name: "Packet Time-Out Value", Description: "Seconds without a valid packet before the decoder stops the locomotive, 0 disables the time-out"},
+	{Number: 12, Name: "Power Source Conversion", Description: "Alternative power sources allowed when there is no DCC signal"},
+	{Number: 13, Name: "Alternate Mode Function Status F1-F8", Description: "Functions F1-F8 switched on in analog mode, bit N-1 is FN"},
+	{Number: 14, Name: "Alternate Mode Function Status FL, F9-F12", Description: "Functions FL and F9-F12 switched on in analog mode"},
+	{Number: 15, Name: "Decoder Lock", Description: "Key to unlock the decoder, programming is allowed when it equals CV16"},
+	{Number: 16, Name: "Decoder Lock ID", Description: "Lock ID of the decoder, for multiple decoders in one locomotive"},
+	{Number: 17, Name: "Extended Address (high byte)", Description: "Long address: (CV17 - 192) * 256 + CV18, used when CV29 bit 5 is set", Min: 192, Max: 231},
+	{Number: 18, Name: "Extended Address (low byte)", Description: "Long address: (CV17 - 192) * 256 + CV18, used when CV29 bit 5 is set"},
+	{Number: 19, Name: "Consist Address", Description: "Address of the advanced consist in bits 0-6, 0 means the locomotive is not in a consist", Default: value(0),
+		Bits: []Bit{{Bit: 7, Name: "Direction in consist", Off: "normal direction in consist", On: "reversed in consist"}}},
+	{Number: 21, Name: "Consist Address Active for F1-F8", Description: "Functions F1-F8 controlled by the consist address, bit N-1 is FN"},
+	{Number: 22, Name: "Consist Address Active for FL and F9-F12", Description: "Functions FL and F9-F12 controlled by the consist address"},
+	{Number: 23, Name: "Acceleration Adjustment", Description: "Added to CV3 in a consist, bit 7 makes it negative"},
+	{Number: 24, Name: "Deceleration Adjustment", Description: "Added to CV4 in a consist, bit 7 makes it negative"},
+	{Number: 27, Name: "Decoder Automatic Stopping Configuration", Description: "Braking sections recognised by the decoder (ABC, asymmetric DCC, DC brake sections)"},
+	{Number: 28, Name: "RailCom Configuration", Description: "RailCom channels used by the decoder, RailCom itself is enabled in CV29 bit 3",
+		Bits: []Bit{
+			{Bit: 0, Name: "Channel 1", Off: "no address broadcast", On: "address broadcast"},
+			{Bit: 1, Name: "Channel 2", Off: "no data in channel 2", On: "data in channel 2"},
+		}},
+	{Number: 29, Name: "Configuration Data #1", Description: "Basic configuration of the decoder", Default: value(6),
+		Bits: []Bit{
+			{Bit: 0, Name: "Direction", Off: "normal direction", On: "reversed direction"},
+			{Bit: 1, Name: "Speed steps", Off: "14 steps", On: "28/128 steps"},
+			{Bit: 2, Name: "Analog operation", Off: "analog off", On: "analog on"},
+			{Bit: 3, Name: "RailCom", Off: "RailCom off", On: "RailCom on"},
+			{Bit: 4, Name: "Speed table", Off: "three-point speed curve (CV2, CV5, CV6)", On: "speed table (CV67-CV94)"},
+			{Bit: 5, Name: "Address", Off: "short address (CV1)", On: "long address (CV17/CV18)"},
+			{Bit: 7, Name: "Decoder type", Off: "multifunction decoder", On: "accessory decoder"},
+		}},
+	{Number: 30, Name: "Error Information", Description: "Last error detected by the decoder, e.g. an overloaded output, write 0 to clear it"},
+	{Number: 31, Name: "Index High Byte", Description: "Selects the page of the indexed CVs 257-512, values below 16 are reserved"},
+	{Number: 32, Name: "Index Low Byte", Description: "Selects the page of the indexed CVs 257-512"},
+	{Number: 33, Last: 46, Name: "Function Mapping", Description: "Outputs switched by FL(f), FL(r) and F1-F12 (CV33-CV46), one bit per output"},
+	{Number: 65, Name: "Kick Start", Description: "Extra voltage applied to start a stationary motor"},
+	{Number: 66, Name: "Forward Trim", Description: "Scales the motor voltage in forward direction by CV66/128"},
+	{Number: 67, Last: 94, Name: "Speed Table", Description: "Motor voltage of speed steps 1-28, used when CV29 bit 4 is set"},
+	{Number: 95, Name: "Reverse Trim", Description: "Scales the motor voltage in reverse direction by CV95/128"},
+	{Number: 105, Name: "User Identifier #1", Description: "Free for the owner, e.g. for an inventory number"},
+	{Number: 106, Name: "User Identifier #2", Description: "Free for the owner, e.g. for an inventory number"},
+}
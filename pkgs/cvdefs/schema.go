@@ -0,0 +1,188 @@
+package cvdefs
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+//
+// Context: the manuals of the decoders describe many more CVs than NMRA, and value ranges the NMRA leaves open.
+// A schema file describes the CVs of a decoder type, e.g. ~/.loco/decoders/rb2300.yaml, and is selected by
+// the decoder type of loco.json. Its definitions replace the NMRA ones like the definitions of a family.
+//
+
+// Schema is the content of a schema file, e.g.
+//
+//	name: Railbox RB2300
+//	cvs:
+//	  - cv: 3
+//	    name: Acceleration
+//	    description: Time between two speed steps when accelerating
+//	    default: 8
+//	    min: 0
+//	    max: 64
+//	  - cv: 67-94
+//	    name: Speed Table
+//	  - cv: 29
+//	    name: Configuration
+//	    default: 6
+//	    bits:
+//	      - bit: 1
+//	        name: Speed steps
+//	        off: 14 steps
+//	        on: 28/128 steps
+type Schema struct {
+	Name string
+	// Models are the decoder models described by the schema, informative only
+	Models []string
+	CVs    []schemaCV
+}
+
+// schemaCV is a CV of a schema file, the cv is a number or a block "67-94"
+type schemaCV struct {
+	CV          string
+	Name        string
+	Description string
+	Default     *uint8
+	Min         uint8
+	Max         uint8
+	ReadOnly    bool `mapstructure:"readonly"`
+	Bits        []Bit
+}
+
+// hasBit tells if the bit is already described
+func (cv schemaCV) hasBit(bit uint8) bool {
+	for _, b := range cv.Bits {
+		if b.Bit == bit {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadSchema reads a schema file, its CVs are checked for the numbers, names and bits
+func LoadSchema(path string) (*Schema, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("yaml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("cannot read the decoder schema %q: %s", path, err)
+	}
+	schema := &Schema{}
+	if err := v.Unmarshal(schema); err != nil {
+		return nil, fmt.Errorf("cannot parse the decoder schema %q: %s", path, err)
+	}
+	if _, err := schema.Definitions(); err != nil {
+		return nil, fmt.Errorf("invalid decoder schema %q: %w", path, err)
+	}
+	return schema, nil
+}
+
+// Definitions returns the CVs of the schema, all problems are returned together
+func (s *Schema) Definitions() ([]Definition, error) {
+	definitions := make([]Definition, 0, len(s.CVs))
+	var problems []string
+	for i, cv := range s.CVs {
+		first, last, err := parseSchemaRange(cv.CV)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("cvs[%d]: %s", i, err))
+			continue
+		case cv.Name == "":
+			problems = append(problems, fmt.Sprintf("cvs[%d]: cv%s has no name", i, cv.CV))
+		case cv.Max != 0 && cv.Min > cv.Max:
+			problems = append(problems, fmt.Sprintf("cvs[%d]: the min %d of cv%s is above its max %d", i, cv.Min, cv.CV, cv.Max))
+		}
+		for _, bit := range cv.Bits {
+			if bit.Bit > 7 {
+				problems = append(problems, fmt.Sprintf("cvs[%d]: cv%s has no bit %d", i, cv.CV, bit.Bit))
+			}
+		}
+		definitions = append(definitions, Definition{
+			Number:      first,
+			Last:        last,
+			Name:        cv.Name,
+			Description: cv.Description,
+			Default:     cv.Default,
+			Min:         cv.Min,
+			Max:         cv.Max,
+			Bits:        cv.Bits,
+			ReadOnly:    cv.ReadOnly,
+		})
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(problems, "\n  "))
+	}
+	return definitions, nil
+}
+
+// WriteYAML writes the schema in the format read by LoadSchema
+func (s *Schema) WriteYAML(w io.Writer) error {
+	var out strings.Builder
+	if s.Name != "" {
+		fmt.Fprintf(&out, "name: %s\n", strconv.Quote(s.Name))
+	}
+	if len(s.Models) > 0 {
+		out.WriteString("models:\n")
+		for _, model := range s.Models {
+			fmt.Fprintf(&out, "  - %s\n", strconv.Quote(model))
+		}
+	}
+	out.WriteString("cvs:\n")
+	for _, cv := range s.CVs {
+		fmt.Fprintf(&out, "  - cv: %s\n    name: %s\n", cv.CV, strconv.Quote(cv.Name))
+		if cv.Description != "" {
+			fmt.Fprintf(&out, "    description: %s\n", strconv.Quote(cv.Description))
+		}
+		if cv.Default != nil {
+			fmt.Fprintf(&out, "    default: %d\n", *cv.Default)
+		}
+		if cv.Min != 0 || cv.Max != 0 {
+			fmt.Fprintf(&out, "    min: %d\n    max: %d\n", cv.Min, cv.Max)
+		}
+		if cv.ReadOnly {
+			out.WriteString("    readonly: true\n")
+		}
+		if len(cv.Bits) > 0 {
+			out.WriteString("    bits:\n")
+		}
+		for _, bit := range cv.Bits {
+			fmt.Fprintf(&out, "      - bit: %d\n        name: %s\n        off: %s\n        on: %s\n",
+				bit.Bit, strconv.Quote(bit.Name), strconv.Quote(bit.Off), strconv.Quote(bit.On))
+		}
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// parseSchemaRange reads "29", "cv29" or a block "67-94", the last CV of a single one is 0
+func parseSchemaRange(raw string) (uint16, uint16, error) {
+	from, to, isBlock := strings.Cut(strings.ToLower(strings.TrimSpace(raw)), "-")
+	first, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(from), "cv"), 10, 16)
+	if err != nil || first == 0 || first > 1024 {
+		return 0, 0, fmt.Errorf("invalid cv %q", raw)
+	}
+	if !isBlock {
+		return uint16(first), 0, nil
+	}
+	last, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(to), "cv"), 10, 16)
+	if err != nil || last <= first || last > 1024 {
+		return 0, 0, fmt.Errorf("invalid cv block %q", raw)
+	}
+	return uint16(first), uint16(last), nil
+}
+
+var familiesMu sync.RWMutex
+
+// RegisterFamily makes the definitions of a schema the definitions of a decoder family, see Definitions.
+// The definitions of a known family are replaced.
+func RegisterFamily(family string, definitions []Definition) {
+	familiesMu.Lock()
+	defer familiesMu.Unlock()
+	families[strings.ToLower(family)] = definitions
+}
@@ -0,0 +1,61 @@
+package cvdefs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadSchema(t *testing.T) {
+	schema, err := LoadSchema(filepath.Join("testdata", "rb2300.yaml"))
+	if err != nil {
+		t.Fatalf("LoadSchema returned error: %s", err)
+	}
+	definitions, err := schema.Definitions()
+	if err != nil {
+		t.Fatalf("Definitions returned error: %s", err)
+	}
+	RegisterFamily("RB2300-test", definitions)
+
+	def, ok := Find(70, "rb2300-test")
+	if !ok || def.Name != "Speed Table" || def.Range() != "cv67-cv94" {
+		t.Errorf("Find(70) = %+v, %v", def, ok)
+	}
+	def, _ = Find(112, "rb2300-test")
+	if got := def.Explain(1); got != "flickering headlights" {
+		t.Errorf("cv112.Explain(1) = %q", got)
+	}
+	def, _ = Find(3, "rb2300-test")
+	if err := def.Check(3, 100); err == nil || !strings.Contains(err.Error(), "0-64") {
+		t.Errorf("Check(3, 100) = %v", err)
+	}
+	if err := def.Check(3, 12); err != nil {
+		t.Errorf("Check(3, 12) = %v", err)
+	}
+	def, _ = Find(8, "rb2300-test")
+	if err := def.Check(8, 8); err == nil {
+		t.Error("Check(8) of a read-only CV should fail")
+	}
+	// the NMRA definitions are kept where the schema has none
+	if def, _ := Find(1, "rb2300-test"); def.Name != "Primary Address" {
+		t.Errorf("Find(1) = %q", def.Name)
+	}
+}
+
+func TestLoadSchema_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broken.yaml")
+	content := "cvs:\n  - cv: 67-60\n    name: Backwards\n  - cv: 3\n  - cv: 4\n    name: Braking\n    bits:\n      - bit: 9\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadSchema(path)
+	if err == nil {
+		t.Fatal("LoadSchema should fail")
+	}
+	for _, problem := range []string{`invalid cv block "67-60"`, "cv3 has no name", "cv4 has no bit 9"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("error %q does not contain %q", err, problem)
+		}
+	}
+}
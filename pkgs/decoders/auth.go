@@ -0,0 +1,72 @@
+package decoders
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+//
+// Context: the RB23xx firmware does not protect its web interface, anyone in the WiFi of the decoder can upload
+// and delete the sounds. A firmware protecting its endpoints is expected to ask for HTTP basic authentication
+// or a bearer token. The credentials are added by the transport of the client, to every request, so the helpers
+// sending the requests do not need to know about them.
+//
+
+// ErrUnauthorized is returned when the decoder refuses a request without credentials or with the wrong ones
+var ErrUnauthorized = errors.New("the decoder refused the request")
+
+// WithCredentials sends a user name and a password with every request, as HTTP basic authentication
+func WithCredentials(username string, password string) Option {
+	return func(d *httpDecoder) {
+		d.credentials.username, d.credentials.password = username, password
+	}
+}
+
+// WithToken sends a bearer token with every request, in place of WithCredentials
+func WithToken(token string) Option {
+	return func(d *httpDecoder) {
+		d.credentials.token = token
+	}
+}
+
+// credentials of the decoder, the token is preferred to the user name and the password
+type credentials struct {
+	username string
+	password string
+	token    string
+}
+
+func (c credentials) set() bool {
+	return c.token != "" || c.username != ""
+}
+
+// authTransport adds the credentials to the requests and turns a refusal into ErrUnauthorized
+type authTransport struct {
+	base        http.RoundTripper
+	credentials credentials
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case t.credentials.token != "":
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+t.credentials.token)
+	case t.credentials.username != "":
+		req = req.Clone(req.Context())
+		req.SetBasicAuth(t.credentials.username, t.credentials.password)
+	}
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil || (resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden) {
+		return resp, err
+	}
+	_ = resp.Body.Close()
+	if !t.credentials.set() {
+		return nil, fmt.Errorf("%w with HTTP %d, it asks for credentials: set decoder_username and decoder_password or decoder_token in the loco section of the configuration", ErrUnauthorized, resp.StatusCode)
+	}
+	return nil, fmt.Errorf("%w with HTTP %d, check the credentials of the decoder", ErrUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,89 @@
+package decoders
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//
+// Context: at the workbench the decoder is often powered from a bare supply, without a command station
+// to program it. The firmware reads and writes its CVs over the WiFi: "/cv?n=29" answers the value,
+// "/cv?n=29&v=6" posted writes it. Older firmwares answer 404.
+//
+
+// CV_READ_ENDPOINT answers the value of a CV, as "6" or as "cv29=6"
+const CV_READ_ENDPOINT = "/cv?n=%d"
+
+// CV_WRITE_ENDPOINT stores the value of a CV on a POST
+const CV_WRITE_ENDPOINT = "/cv?n=%d&v=%d"
+
+// MAX_CV is the last CV of the DCC address space
+const MAX_CV = 1024
+
+func (d *RailboxRB23xx) ReadCV(num uint16) (int, error) {
+	if num < 1 || num > MAX_CV {
+		return 0, fmt.Errorf("invalid cv%d, must be between 1 and %d", num, MAX_CV)
+	}
+	resp, err := d.httpGet(fmt.Sprintf(CV_READ_ENDPOINT, num))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if err := cvStatusError(resp, "reading", num); err != nil {
+		return 0, err
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read cv%d: %w", num, err)
+	}
+	value, err := parseCVAnswer(body)
+	if err != nil {
+		return 0, fmt.Errorf("reading cv%d over WiFi: %w", num, err)
+	}
+	return value, nil
+}
+
+func (d *RailboxRB23xx) WriteCV(num uint16, value int) error {
+	if num < 1 || num > MAX_CV {
+		return fmt.Errorf("invalid cv%d, must be between 1 and %d", num, MAX_CV)
+	}
+	if value < 0 || value > 255 {
+		return fmt.Errorf("invalid value %d of cv%d, must be between 0 and 255", value, num)
+	}
+	url := d.baseURL + fmt.Sprintf(CV_WRITE_ENDPOINT, num, value)
+	resp, err := d.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, url, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("writing cv%d over WiFi failed: %w", num, err)
+	}
+	defer resp.Body.Close()
+	return cvStatusError(resp, "writing", num)
+}
+
+// cvStatusError tells a firmware without the CV endpoint from a refused CV
+func cvStatusError(resp *http.Response, what string, num uint16) error {
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%s cv%d over WiFi: %w", what, num, ErrNotSupported)
+	case resp.StatusCode >= 400:
+		return fmt.Errorf("%s cv%d over WiFi failed with HTTP %d", what, num, resp.StatusCode)
+	}
+	return nil
+}
+
+// parseCVAnswer reads the value of "6", "cv29=6" or "29=6", surrounded by spaces or a line end
+func parseCVAnswer(body []byte) (int, error) {
+	answer := strings.TrimSpace(string(body))
+	if _, after, found := strings.Cut(answer, "="); found {
+		answer = strings.TrimSpace(after)
+	}
+	value, err := strconv.Atoi(answer)
+	if err != nil || value < 0 || value > 255 {
+		return 0, fmt.Errorf("unexpected answer %q", strings.TrimSpace(string(body)))
+	}
+	return value, nil
+}
@@ -0,0 +1,19 @@
+package decoders
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCVAnswer(t *testing.T) {
+	for _, answer := range []string{"6", "6\n", "cv29=6", "29 = 6\r\n"} {
+		value, err := parseCVAnswer([]byte(answer))
+		assert.NoError(t, err, answer)
+		assert.Equal(t, 6, value, answer)
+	}
+	for _, answer := range []string{"", "<html>", "cv29=256", "-1"} {
+		_, err := parseCVAnswer([]byte(answer))
+		assert.Error(t, err, answer)
+	}
+}
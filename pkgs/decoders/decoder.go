@@ -0,0 +1,146 @@
+package decoders
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Context: the commands of "loco decoder" talk to the web interface of the decoder and not to the command station.
+// Every decoder with such an interface implements Decoder and registers itself under its types, the type of
+// the locomotive is the DecoderType of its loco.json.
+//
+
+// DEFAULT_DECODER_TYPE is used when the locomotive does not name the type of its decoder
+const DEFAULT_DECODER_TYPE = "rb23xx"
+
+// ErrNotSupported is returned by a Decoder for an operation its firmware does not offer
+var ErrNotSupported = errors.New("the decoder does not support this operation")
+
+// ErrUnknownDecoderType is returned by New for a type no decoder was registered under
+var ErrUnknownDecoderType = errors.New("unknown decoder type")
+
+// SoundManager keeps the sound files of a decoder in numbered slots
+type SoundManager interface {
+	ListSoundSlotNumbers() ([]uint8, error)
+	ListSoundSlot(slot uint8) ([]RemoteFileInfo, error)
+	ClearSoundSlot(slot uint8) error
+	DeleteSoundFile(slot uint8, filename string) error
+	UploadSoundFile(slot uint8, filename string, content io.Reader) error
+	DownloadSoundFile(slot uint8, filename string) ([]byte, error)
+	// Resumable tells if a file of the given size is sent in parts with UploadSoundFileResumable
+	Resumable(size int64) bool
+	UploadSoundFileResumable(slot uint8, filename string, content io.ReaderAt, size int64, offset int64, stored func(offset int64)) error
+	// Storage is the space of the sound storage, ErrStorageUnknown when the firmware does not report it
+	Storage() (Storage, error)
+}
+
+// OutputMapper reads and writes the AUX output mapping, in the format of outputmap.Parse
+type OutputMapper interface {
+	DownloadOutputMap() ([]byte, error)
+	UploadOutputMap(data []byte) error
+}
+
+// CVAccessor reads and writes the CVs over the WiFi of the decoder, without a command station
+type CVAccessor interface {
+	ReadCV(num uint16) (int, error)
+	WriteCV(num uint16, value int) error
+}
+
+// Decoder is a decoder managed through its web interface
+type Decoder interface {
+	Info() (Info, error)
+	SoundManager
+	OutputMapper
+	CVAccessor
+}
+
+// FirmwareUpdater is implemented by a Decoder that takes firmware updates over WiFi
+type FirmwareUpdater interface {
+	UploadFirmware(image []byte, progress func(sent int64)) error
+	WaitForRestart(timeout time.Duration, interval time.Duration) error
+}
+
+// SoundRenamer is implemented by a Decoder that renames a sound file in place, without sending it again.
+// The RB23xx firmware has no such endpoint.
+type SoundRenamer interface {
+	RenameSoundFile(slot uint8, from string, to string) error
+}
+
+// Factory creates a Decoder, the options configure its HTTP client
+type Factory func(opts ...Option) Decoder
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a decoder available under the given types. An "x" of a type stands for a digit,
+// so "rb23xx" is returned for "rb2300" and "rb2301" too.
+func Register(factory Factory, types ...string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, decoderType := range types {
+		registry[strings.ToLower(decoderType)] = factory
+	}
+}
+
+// New creates the decoder registered under decoderType, an empty type is DEFAULT_DECODER_TYPE
+func New(decoderType string, opts ...Option) (Decoder, error) {
+	decoderType = strings.ToLower(strings.TrimSpace(decoderType))
+	if decoderType == "" {
+		decoderType = DEFAULT_DECODER_TYPE
+	}
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if factory, ok := registry[decoderType]; ok {
+		return factory(opts...), nil
+	}
+	for _, registered := range sortedTypes() {
+		if typeMatches(registered, decoderType) {
+			return registry[registered](opts...), nil
+		}
+	}
+	return nil, fmt.Errorf("%w %q, the known decoder types are: %s", ErrUnknownDecoderType, decoderType, strings.Join(sortedTypes(), ", "))
+}
+
+// Types returns the registered decoder types
+func Types() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return sortedTypes()
+}
+
+func sortedTypes() []string {
+	types := make([]string, 0, len(registry))
+	for decoderType := range registry {
+		types = append(types, decoderType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// typeMatches compares a decoder type with a registered one, where an "x" stands for a digit
+func typeMatches(registered string, decoderType string) bool {
+	if len(registered) != len(decoderType) {
+		return false
+	}
+	for i := 0; i < len(registered); i++ {
+		if registered[i] == 'x' && decoderType[i] >= '0' && decoderType[i] <= '9' {
+			continue
+		}
+		if registered[i] != decoderType[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func init() {
+	Register(func(opts ...Option) Decoder { return NewRailboxRB23xx(opts...) }, "rb23xx", "railbox")
+}
@@ -0,0 +1,250 @@
+package decoders
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Context: a decoder that joined the home WiFi gets its address from the router. The candidates are the devices
+// answering an mDNS query for web servers, the neighbours in the ARP table and, on request, every host of the
+// local networks. Each of them is asked for the sound slot listing of the RB23xx web interface.
+//
+
+// MDNS_ADDRESS is the multicast group of mDNS
+const MDNS_ADDRESS = "224.0.0.251:5353"
+
+// MDNS_HTTP_SERVICE is the service asked for, the web interface of the decoder
+const MDNS_HTTP_SERVICE = "_http._tcp.local"
+
+// DISCOVER_WORKERS is the number of hosts probed at once
+const DISCOVER_WORKERS = 32
+
+// DISCOVER_SCAN_LIMIT is the largest network scanned, a /24
+const DISCOVER_SCAN_LIMIT = 254
+
+// ARP_TABLE is where Linux lists the neighbours
+const ARP_TABLE = "/proc/net/arp"
+
+// Found is a decoder answering at Address, Source tells how it was found: "default", "mdns", "arp" or "scan"
+type Found struct {
+	Address string
+	Source  string
+}
+
+// DiscoverOptions shape Discover
+type DiscoverOptions struct {
+	// Timeout is how long the mDNS answers are collected and how long every host may take to answer over HTTP
+	Timeout time.Duration
+	// Scan probes every host of the local IPv4 networks, up to DISCOVER_SCAN_LIMIT hosts per network
+	Scan bool
+}
+
+// Discover looks for RB23xx decoders on the local networks, see DiscoverOptions
+func Discover(options DiscoverOptions) ([]Found, error) {
+	if options.Timeout == 0 {
+		options.Timeout = 2 * time.Second
+	}
+	sources := map[string]string{}
+	add := func(source string, ips []net.IP) {
+		for _, ip := range ips {
+			if _, known := sources[ip.String()]; !known {
+				sources[ip.String()] = source
+			}
+		}
+	}
+
+	// connected to the access point of the decoder
+	add("default", []net.IP{net.ParseIP(strings.TrimPrefix(DEFAULT_RAILBOX_HTTP_ADDRESS, "http://"))})
+	mdns, err := mdnsCandidates(options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	add("mdns", mdns)
+	add("arp", arpCandidates())
+	if options.Scan {
+		scan, err := scanCandidates()
+		if err != nil {
+			return nil, err
+		}
+		add("scan", scan)
+	}
+
+	var mu sync.Mutex
+	var found []Found
+	queue := make(chan string, len(sources))
+	var wg sync.WaitGroup
+	for range min(DISCOVER_WORKERS, len(sources)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for address := range queue {
+				d := NewRailboxRB23xx(WithBaseURL(address))
+				d.client.Timeout = options.Timeout
+				if d.Identify() {
+					mu.Lock()
+					found = append(found, Found{Address: address, Source: sources[address]})
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for address := range sources {
+		queue <- address
+	}
+	close(queue)
+	wg.Wait()
+
+	sort.Slice(found, func(i, j int) bool { return found[i].Address < found[j].Address })
+	return found, nil
+}
+
+// Identify tells if the web interface of a RB23xx decoder answers at the address of the client
+func (d *RailboxRB23xx) Identify() bool {
+	resp, err := d.client.Get(d.baseURL + SOUND_PACKAGE_ROOT_ENDPOINT)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return false
+	}
+	// the listing of the root has a row per slot directory, in the same table as the files of a slot
+	return len(parseListingHTML(body)) > 0
+}
+
+// mdnsCandidates asks for the web servers on the network, every device that answers is a candidate
+func mdnsCandidates(timeout time.Duration) ([]net.IP, error) {
+	group, err := net.ResolveUDPAddr("udp4", MDNS_ADDRESS)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot send the mDNS query: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.WriteToUDP(mdnsQuery(MDNS_HTTP_SERVICE), group); err != nil {
+		// no multicast route, e.g. no network at all
+		return nil, nil
+	}
+
+	var ips []net.IP
+	buf := make([]byte, 9000)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return ips, nil
+		}
+		// answers have the QR bit set, the others are queries of other devices
+		if n >= 12 && buf[2]&0x80 != 0 {
+			ips = append(ips, from.IP)
+		}
+	}
+}
+
+// mdnsQuery is a DNS query for the PTR records of a service, asking for a unicast answer
+func mdnsQuery(service string) []byte {
+	query := make([]byte, 12, 64)
+	binary.BigEndian.PutUint16(query[4:], 1) // one question
+	for _, label := range strings.Split(service, ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0)
+	query = binary.BigEndian.AppendUint16(query, 12)     // PTR
+	query = binary.BigEndian.AppendUint16(query, 0x8001) // unicast response, IN
+	return query
+}
+
+// arpCandidates returns the neighbours known to the system, nothing where the ARP table cannot be read
+func arpCandidates() []net.IP {
+	file, err := os.Open(ARP_TABLE)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	return parseARPTable(file)
+}
+
+// parseARPTable reads the addresses of /proc/net/arp, skipping the incomplete entries (flags 0x0)
+func parseARPTable(r io.Reader) []net.IP {
+	var ips []net.IP
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[2] == "0x0" {
+			continue
+		}
+		if ip := net.ParseIP(fields[0]); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// scanCandidates returns the hosts of the IPv4 networks of the interfaces that are up
+func scanCandidates() ([]net.IP, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the network interfaces: %w", err)
+	}
+	var ips []net.IP
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if network, ok := addr.(*net.IPNet); ok {
+				ips = append(ips, networkHosts(network)...)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// networkHosts returns the hosts of an IPv4 network except the given address, a network larger than /24
+// is narrowed to the /24 around the address
+func networkHosts(network *net.IPNet) []net.IP {
+	own := network.IP.To4()
+	if own == nil {
+		return nil
+	}
+	mask := network.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	if ones, _ := mask.Size(); ones < 24 {
+		mask = net.CIDRMask(24, 32)
+	}
+	base := binary.BigEndian.Uint32(own.Mask(mask))
+	size := ^binary.BigEndian.Uint32(mask)
+	var hosts []net.IP
+	for i := uint32(1); i < size && len(hosts) < DISCOVER_SCAN_LIMIT; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+i)
+		if !ip.Equal(own) {
+			hosts = append(hosts, ip)
+		}
+	}
+	return hosts
+}
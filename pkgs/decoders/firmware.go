@@ -0,0 +1,92 @@
+package decoders
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+//
+// Context: a firmware update over the WiFi of the decoder. The decoder writes the image to its second
+// flash partition while it is received, checks it and restarts from it. An interrupted upload
+// leaves the running firmware in place, the update can be started again.
+//
+
+// FIRMWARE_UPDATE_ENDPOINT receives the firmware image
+const FIRMWARE_UPDATE_ENDPOINT = "/update"
+
+// FIRMWARE_UPLOAD_TIMEOUT is how long the decoder may take to receive and check the image
+const FIRMWARE_UPLOAD_TIMEOUT = 3 * time.Minute
+
+// FIRMWARE_POLL_INTERVAL is how often a restarting decoder is asked if it is back
+const FIRMWARE_POLL_INTERVAL = 2 * time.Second
+
+// FIRMWARE_RESTART_TIMEOUT is how long a decoder usually takes to check the image and restart
+const FIRMWARE_RESTART_TIMEOUT = 90 * time.Second
+
+// UploadFirmware sends a firmware image to the decoder, progress is called with the number of bytes sent.
+// The image is sent once: a decoder that dropped the connection has discarded what it received,
+// and a repeated request could reach a decoder that is already restarting.
+func (d *RailboxRB23xx) UploadFirmware(image []byte, progress func(sent int64)) error {
+	envelope, err := newFormEnvelope(FIRMWARE_FORM_FIELD, "firmware.bin")
+	if err != nil {
+		return fmt.Errorf("failed to build the firmware upload request: %w", err)
+	}
+	body := &countingReader{r: bytes.NewReader(image), progress: progress}
+	req, err := newFormRequest(d.baseURL+FIRMWARE_UPDATE_ENDPOINT, envelope, body, int64(len(image)))
+	if err != nil {
+		return fmt.Errorf("failed to build the firmware upload request: %w", err)
+	}
+
+	client := *d.client
+	client.Timeout = max(client.Timeout, FIRMWARE_UPLOAD_TIMEOUT)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("firmware upload failed (the running firmware is kept): %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("the decoder rejected the firmware with HTTP %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// WaitForRestart waits until the web interface of the decoder answers again after a firmware update,
+// asking every interval
+func (d *RailboxRB23xx) WaitForRestart(timeout time.Duration, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	// the decoder answers the upload before it restarts
+	time.Sleep(interval)
+	for {
+		// an empty decoder lists no slots, any answer of the web interface is enough
+		if resp, err := d.client.Get(d.baseURL + SOUND_PACKAGE_ROOT_ENDPOINT); err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the decoder did not come back within %s after the firmware update, reconnect to its WiFi", timeout)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// countingReader reports the bytes read from it
+type countingReader struct {
+	r        io.Reader
+	read     int64
+	progress func(sent int64)
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if n > 0 && c.progress != nil {
+		c.read += int64(n)
+		c.progress(c.read)
+	}
+	return n, err
+}
@@ -0,0 +1,106 @@
+package decoders
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DECODER_INFO_ENDPOINT is the status page of the firmware, a JSON object or a page of "name: value" rows
+const DECODER_INFO_ENDPOINT = "/info"
+
+// ErrInfoUnavailable is returned when the firmware has no status page, older firmwares do not
+var ErrInfoUnavailable = errors.New("the decoder does not report its model and firmware over WiFi")
+
+// Info identifies the decoder, a field is empty when the firmware does not report it
+type Info struct {
+	Model    string `json:"model"`
+	Firmware string `json:"firmware"`
+	Serial   string `json:"serial"`
+}
+
+// infoFields maps the names used by the firmwares to the fields of Info
+var infoFields = map[string]string{
+	"model": "model", "hardware": "model", "board": "model",
+	"firmware": "firmware", "version": "firmware", "fw": "firmware",
+	"serial": "serial", "sn": "serial", "serial number": "serial", "chip id": "serial",
+}
+
+var (
+	// reInfoCells matches a table row of a name and a value, e.g. <td>Firmware</td><td>1.4.2</td>
+	reInfoCells = regexp.MustCompile(`(?i)<t[dh][^>]*>\s*([a-z][a-z ]*?)\s*:?\s*</t[dh]>\s*<td[^>]*>\s*([^<]*?)\s*</td>`)
+	reInfoTag   = regexp.MustCompile(`<[^>]*>`)
+	// reInfoRow matches "Firmware: 1.4.2" or "version=1.4.2", after the HTML tags were replaced by line breaks
+	reInfoRow = regexp.MustCompile(`(?im)^\s*([a-z][a-z ]*?)\s*[:=]\s*(\S[^\n]*?)\s*$`)
+)
+
+// Info reads the model, the firmware version and the serial number of the decoder from its status page
+func (d *RailboxRB23xx) Info() (Info, error) {
+	resp, err := d.httpGet(DECODER_INFO_ENDPOINT)
+	if err != nil {
+		return Info{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return Info{}, ErrInfoUnavailable
+	}
+	if resp.StatusCode >= 400 {
+		return Info{}, fmt.Errorf("reading the decoder info failed with HTTP %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return Info{}, fmt.Errorf("failed to read the decoder info: %w", err)
+	}
+	info := parseInfo(body)
+	if info == (Info{}) {
+		return Info{}, ErrInfoUnavailable
+	}
+	return info, nil
+}
+
+func parseInfo(body []byte) Info {
+	var info Info
+	values := map[string]string{}
+	var object map[string]any
+	if err := json.Unmarshal(body, &object); err == nil {
+		for name, value := range object {
+			values[strings.ToLower(name)] = strings.TrimSpace(fmt.Sprint(value))
+		}
+	} else {
+		for _, m := range reInfoCells.FindAllSubmatch(body, -1) {
+			values[strings.ToLower(string(m[1]))] = string(m[2])
+		}
+		text := reInfoTag.ReplaceAllString(string(body), "\n")
+		for _, m := range reInfoRow.FindAllStringSubmatch(text, -1) {
+			values[strings.ToLower(m[1])] = m[2]
+		}
+	}
+	// the first of the names wins when a firmware reports more of them, e.g. "firmware" before "version"
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var field *string
+		switch infoFields[name] {
+		case "model":
+			field = &info.Model
+		case "firmware":
+			field = &info.Firmware
+		case "serial":
+			field = &info.Serial
+		default:
+			continue
+		}
+		if *field == "" {
+			*field = values[name]
+		}
+	}
+	return info
+}
@@ -0,0 +1,362 @@
+package decoders
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// Context: the web interface lists a directory as an HTML table, a row per file or directory. The table differs
+// between the firmware versions: the quotes and the case of the tags, a link or an input holding the name, the size
+// in KB or with its unit, a column with the modification time. The rows are read by their cells, not by their markup.
+// The newer versions also answer the same listing as JSON, it is asked for first.
+//
+
+const SOUND_PACKAGE_JSON_LIST_ENDPOINT = "/list?p=/%d/"
+const SOUND_PACKAGE_JSON_ROOT_ENDPOINT = "/list?p=/"
+
+// listingEntry is a row of a directory listing
+type listingEntry struct {
+	Name    string
+	Dir     bool
+	SizeKB  int64
+	ModTime time.Time
+}
+
+// the state of the JSON listing of a decoder, found out by its first listing
+const (
+	jsonListingUnknown int32 = iota
+	jsonListingAvailable
+	jsonListingUnavailable
+)
+
+// jsonListingEntry is an entry of the JSON listing, the size is in bytes and the time in seconds since the epoch
+type jsonListingEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	Time int64  `json:"time"`
+}
+
+// listDir lists a directory of the decoder, with the JSON listing when the firmware has it and with the HTML one otherwise.
+// what names the directory in the errors.
+func (d *RailboxRB23xx) listDir(jsonEndpoint string, htmlEndpoint string, what string) ([]listingEntry, error) {
+	if d.jsonListing.Load() != jsonListingUnavailable {
+		entries, ok, err := d.listDirJSON(jsonEndpoint, what)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			d.jsonListing.Store(jsonListingAvailable)
+			return entries, nil
+		}
+		d.jsonListing.Store(jsonListingUnavailable)
+	}
+
+	resp, err := d.httpGet(htmlEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// a decoder that is still overloaded after the retries would look like an empty directory
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("listing %s failed with HTTP %d", what, resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read listing response: %w", err)
+	}
+	return parseListingHTML(body), nil
+}
+
+// listDirJSON asks for the JSON listing, ok is false when the firmware does not have it
+func (d *RailboxRB23xx) listDirJSON(endpoint string, what string) (entries []listingEntry, ok bool, err error) {
+	resp, err := d.httpGet(endpoint)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented:
+		return nil, false, nil
+	case resp.StatusCode >= 500:
+		return nil, false, fmt.Errorf("listing %s failed with HTTP %d", what, resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return nil, false, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read listing response: %w", err)
+	}
+	// the older versions answer an unknown path with the listing of the root
+	var records []jsonListingEntry
+	if err := json.Unmarshal(body, &records); err != nil {
+		return nil, false, nil
+	}
+	entries = make([]listingEntry, 0, len(records))
+	for _, record := range records {
+		if record.Name == "" {
+			continue
+		}
+		entry := listingEntry{Name: record.Name, Dir: strings.EqualFold(record.Type, "dir"), SizeKB: (record.Size + 1023) / 1024}
+		if record.Time > 0 {
+			entry.ModTime = time.Unix(record.Time, 0)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, true, nil
+}
+
+// listingTimeLayouts are the modification times printed by the firmware versions, in the time of the decoder clock
+var listingTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"02.01.2006 15:04:05",
+	"02.01.2006 15:04",
+}
+
+// reListingSize matches the size of a file, in KB when it has no unit, e.g. "108", "108 KB" or "1.2 MB"
+var reListingSize = regexp.MustCompile(`(?i)^(\d+(?:\.\d+)?)\s*(B|KB|MB)?$`)
+
+// parseListingHTML reads the rows of a listing that have a "file" or a "dir" cell, the other rows are headers or
+// links of the page. The name is the placeholder or the value of the input of the row, or the text of its link,
+// or the first cell.
+func parseListingHTML(body []byte) []listingEntry {
+	var entries []listingEntry
+	for _, row := range listingRows(body) {
+		kind := slices.IndexFunc(row.cells, func(cell string) bool {
+			return strings.EqualFold(cell, "file") || strings.EqualFold(cell, "dir")
+		})
+		if kind < 0 {
+			continue
+		}
+		entry := listingEntry{Name: row.name, Dir: strings.EqualFold(row.cells[kind], "dir")}
+		if entry.Name == "" && kind > 0 {
+			entry.Name = row.cells[0]
+		}
+		if entry.Name == "" {
+			continue
+		}
+		for _, cell := range row.cells[kind+1:] {
+			if size, ok := parseListingSize(cell); ok && entry.SizeKB == 0 {
+				entry.SizeKB = size
+			} else if modTime, ok := parseListingTime(cell); ok && entry.ModTime.IsZero() {
+				entry.ModTime = modTime
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func parseListingSize(cell string) (int64, bool) {
+	m := reListingSize.FindStringSubmatch(cell)
+	if m == nil {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	switch strings.ToUpper(m[2]) {
+	case "B":
+		value /= 1024
+	case "MB":
+		value *= 1024
+	}
+	return int64(math.Ceil(value)), true
+}
+
+func parseListingTime(cell string) (time.Time, bool) {
+	for _, layout := range listingTimeLayouts {
+		if t, err := time.ParseInLocation(layout, cell, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// listingRow is a row of the table: the text of its cells and the name held by its input or its link
+type listingRow struct {
+	cells []string
+	name  string
+}
+
+// listingRows reads the rows of the tables of a page. The markup is read as the browser would: the tags are
+// matched in any case and with any quotes, an unclosed cell or row ends at the next one, comments and scripts are skipped.
+func listingRows(body []byte) []listingRow {
+	var rows []listingRow
+	var row *listingRow
+	var cell, link strings.Builder
+	inCell, inLink := false, false
+
+	endCell := func() {
+		if inCell && row != nil {
+			row.cells = append(row.cells, strings.Join(strings.Fields(cell.String()), " "))
+		}
+		cell.Reset()
+		inCell = false
+	}
+	endRow := func() {
+		endCell()
+		if row != nil {
+			rows = append(rows, *row)
+		}
+		row = nil
+	}
+
+	page := string(body)
+	for len(page) > 0 {
+		start := strings.IndexByte(page, '<')
+		if start < 0 {
+			start = len(page)
+		}
+		if text := page[:start]; inCell {
+			cell.WriteString(html.UnescapeString(text))
+			if inLink {
+				link.WriteString(html.UnescapeString(text))
+			}
+		}
+		page = page[start:]
+		if page == "" {
+			break
+		}
+
+		var t listingTag
+		t, page = readListingTag(page)
+		switch {
+		case t.name == "script" || t.name == "style":
+			if !t.closing {
+				if end := strings.Index(strings.ToLower(page), "</"+t.name); end >= 0 {
+					page = page[end:]
+				} else {
+					page = ""
+				}
+			}
+		case t.name == "tr" || t.name == "table":
+			endRow()
+			if t.name == "tr" && !t.closing {
+				row = &listingRow{}
+			}
+		case t.name == "td" || t.name == "th":
+			endCell()
+			inCell = !t.closing && row != nil
+		case t.name == "input" && row != nil && row.name == "":
+			row.name = strings.TrimSpace(t.attrs["placeholder"])
+			if row.name == "" {
+				row.name = strings.TrimSpace(t.attrs["value"])
+			}
+		case t.name == "a" && row != nil:
+			if t.closing && inLink && row.name == "" {
+				row.name = strings.TrimSpace(link.String())
+			}
+			link.Reset()
+			inLink = !t.closing
+		}
+	}
+	endRow()
+	return rows
+}
+
+// listingTag is an opening or a closing tag, with its name and attributes in lower case
+type listingTag struct {
+	name    string
+	closing bool
+	attrs   map[string]string
+}
+
+// readListingTag reads the tag at the start of page, which starts with '<', and returns the rest of the page.
+// A comment, a doctype or a '<' that starts no tag is returned as a tag without a name.
+func readListingTag(page string) (listingTag, string) {
+	if strings.HasPrefix(page, "<!--") {
+		if end := strings.Index(page[4:], "-->"); end >= 0 {
+			return listingTag{}, page[4+end+3:]
+		}
+		return listingTag{}, ""
+	}
+	if strings.HasPrefix(page, "<!") || strings.HasPrefix(page, "<?") {
+		if end := strings.IndexByte(page, '>'); end >= 0 {
+			return listingTag{}, page[end+1:]
+		}
+		return listingTag{}, ""
+	}
+
+	t := listingTag{attrs: map[string]string{}}
+	i := 1
+	if i < len(page) && page[i] == '/' {
+		t.closing = true
+		i++
+	}
+	nameStart := i
+	for i < len(page) && isListingNameByte(page[i]) {
+		i++
+	}
+	if i == nameStart {
+		// a lone '<' of the text
+		return listingTag{}, page[1:]
+	}
+	t.name = strings.ToLower(page[nameStart:i])
+
+	for i < len(page) && page[i] != '>' {
+		if !isListingNameByte(page[i]) {
+			i++
+			continue
+		}
+		attrStart := i
+		for i < len(page) && isListingNameByte(page[i]) {
+			i++
+		}
+		attr := strings.ToLower(page[attrStart:i])
+		for i < len(page) && isListingSpace(page[i]) {
+			i++
+		}
+		if i >= len(page) || page[i] != '=' {
+			t.attrs[attr] = ""
+			continue
+		}
+		i++
+		for i < len(page) && isListingSpace(page[i]) {
+			i++
+		}
+		var value string
+		if i < len(page) && (page[i] == '\'' || page[i] == '"') {
+			quote := page[i]
+			end := strings.IndexByte(page[i+1:], quote)
+			if end < 0 {
+				return t, ""
+			}
+			value = page[i+1 : i+1+end]
+			i += end + 2
+		} else {
+			valueStart := i
+			for i < len(page) && page[i] != '>' && !isListingSpace(page[i]) {
+				i++
+			}
+			value = page[valueStart:i]
+		}
+		t.attrs[attr] = html.UnescapeString(value)
+	}
+	if i < len(page) {
+		i++
+	}
+	return t, page[i:]
+}
+
+func isListingNameByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == ':'
+}
+
+func isListingSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
@@ -0,0 +1,104 @@
+package decoders
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListingHTML_FirmwareVersions(t *testing.T) {
+	local := func(year int, month time.Month, day, hour, minute, second int) time.Time {
+		return time.Date(year, month, day, hour, minute, second, 0, time.Local)
+	}
+	tests := []struct {
+		fixture string
+		want    []listingEntry
+	}{
+		{"fw-1.2-slot.html", []listingEntry{
+			{Name: "F1_Horn.wav", SizeKB: 20},
+			{Name: "F11_Decouple.wav", SizeKB: 108},
+		}},
+		{"fw-1.2-root.html", []listingEntry{
+			{Name: "1", Dir: true},
+			{Name: "3", Dir: true},
+			{Name: "config.txt", SizeKB: 1},
+		}},
+		{"fw-1.3-slot.html", []listingEntry{
+			{Name: "F1_Horn.wav", SizeKB: 20, ModTime: local(2024, time.March, 5, 14, 22, 0)},
+			{Name: "F2_Bell & Chime.wav", SizeKB: 7, ModTime: local(2024, time.March, 6, 8, 5, 0)},
+		}},
+		{"fw-1.4-slot.html", []listingEntry{
+			{Name: "F1_Horn.wav", SizeKB: 20, ModTime: local(2024, time.March, 5, 14, 22, 10)},
+			{Name: "F5_Engine.wav", SizeKB: 1229, ModTime: local(2024, time.March, 7, 19, 40, 0)},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			body, err := os.ReadFile(filepath.Join("testdata", "listing", test.fixture))
+			require.NoError(t, err)
+			assert.Equal(t, test.want, parseListingHTML(body))
+		})
+	}
+}
+
+func TestParseListingHTML_NoTable(t *testing.T) {
+	assert.Empty(t, parseListingHTML([]byte("<html><body><p>file</p> a < b <td>dir</td></body></html>")))
+	assert.Empty(t, parseListingHTML([]byte("<tr><td><input placeholder='F1_Horn.wav")))
+}
+
+func TestListSoundSlot_JSON(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RequestURI())
+		switch r.URL.RequestURI() {
+		case "/list?p=/1/":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprint(w, `[{"name":"F1_Horn.wav","type":"file","size":20480,"time":1709648530},{"name":"old","type":"dir"}]`)
+		case "/list?p=/":
+			_, _ = fmt.Fprint(w, `[{"name":"1","type":"dir"},{"name":"4","type":"dir"}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	rb := NewRailboxRB23xx(WithBaseURL(server.URL))
+
+	files, err := rb.ListSoundSlot(1)
+	require.NoError(t, err)
+	assert.Equal(t, []RemoteFileInfo{{Name: "F1_Horn.wav", SizeKB: 20, ModTime: time.Unix(1709648530, 0)}}, files)
+	slots, err := rb.ListSoundSlotNumbers()
+	require.NoError(t, err)
+	assert.Equal(t, []uint8{1, 4}, slots)
+	assert.Equal(t, []string{"/list?p=/1/", "/list?p=/"}, requests)
+}
+
+func TestListSoundSlot_FallsBackToHTML(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "listing", "fw-1.2-slot.html"))
+	require.NoError(t, err)
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RequestURI())
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+	rb := NewRailboxRB23xx(WithBaseURL(server.URL))
+
+	for range 2 {
+		files, err := rb.ListSoundSlot(1)
+		require.NoError(t, err)
+		assert.Equal(t, []RemoteFileInfo{{Name: "F1_Horn.wav", SizeKB: 20}, {Name: "F11_Decouple.wav", SizeKB: 108}}, files)
+	}
+	// the JSON listing is asked for once, the firmware does not have it
+	assert.Equal(t, []string{"/list?p=/1/", "/?p=/1/", "/?p=/1/"}, requests)
+}
@@ -2,51 +2,125 @@ package decoders
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/keskad/loco/pkgs/audio"
 )
 
 const DEFAULT_RAILBOX_HTTP_ADDRESS = "http://192.168.4.1"
 const SOUND_PACKAGE_CLEAR_ENDPOINT = "/delete?p=/%d/all"
 const SOUND_PACKAGE_DELETE_FILE_ENDPOINT = "/delete?p=/%d/%s"
 const SOUND_PACKAGE_LIST_ENDPOINT = "/?p=/%d/"
+const SOUND_PACKAGE_ROOT_ENDPOINT = "/?p=/"
 const SOUND_PACKAGE_UPLOAD_ENDPOINT = "/upload?p=/%d/%s"
+const SOUND_PACKAGE_DOWNLOAD_ENDPOINT = "/?p=/%d/%s"
 const DEFAULT_TIMEOUT = 10 * time.Second
 
-type Option func(*RailboxRB23xx)
+// VERIFY_BLOCK_SIZE is the size of the first and the last block compared after an upload
+const VERIFY_BLOCK_SIZE = 4096
+
+// UPLOAD_CHUNK_SIZE is the part of a file sent in a single request by UploadSoundFileResumable
+const UPLOAD_CHUNK_SIZE = 256 * 1024
+
+// SOUND_FORMAT is the WAV format played by the RB23xx firmware
+var SOUND_FORMAT = audio.Format{Channels: 1, SampleRate: 22050, BitsPerSample: 16}
+
+// ErrVerificationFailed is returned when a file read back from the decoder differs from the uploaded one
+var ErrVerificationFailed = errors.New("uploaded file differs from the local one")
+
+// Option configures the HTTP client of a decoder
+type Option func(*httpDecoder)
 
 func WithTimeout(seconds uint16) Option {
-	return func(d *RailboxRB23xx) {
+	return func(d *httpDecoder) {
 		d.client.Timeout = time.Duration(seconds) * time.Second
 	}
 }
 
-type RailboxRB23xx struct {
-	client *http.Client
+// WithBaseURL sets where the decoder is reached, e.g. "http://10.0.0.20:8080" behind a port forward.
+// A bare "host" or "host:port" is reached over HTTP, an empty address keeps DEFAULT_RAILBOX_HTTP_ADDRESS.
+func WithBaseURL(address string) Option {
+	return func(d *httpDecoder) {
+		if address == "" {
+			return
+		}
+		if !strings.Contains(address, "://") {
+			address = "http://" + address
+		}
+		d.baseURL = strings.TrimRight(address, "/")
+	}
 }
 
-func NewRailboxRB23xx(opts ...Option) *RailboxRB23xx {
-	d := &RailboxRB23xx{
-		client: newHTTPClient(),
+// WithUploadVerification makes UploadSoundFile read the file back after upload, see VerifySoundFile
+func WithUploadVerification() Option {
+	return func(d *httpDecoder) {
+		d.verifyUploads = true
+	}
+}
+
+// WithResumableUploads makes files larger than UPLOAD_CHUNK_SIZE go through UploadSoundFileResumable, see Resumable.
+// The firmware has to store every chunk at the position of its Content-Range header.
+func WithResumableUploads() Option {
+	return func(d *httpDecoder) {
+		d.resumable = true
+	}
+}
+
+// httpDecoder is the HTTP client shared by the decoders reached over their WiFi, the Options configure it
+type httpDecoder struct {
+	client        *http.Client
+	baseURL       string
+	verifyUploads bool
+	resumable     bool
+	retry         RetryPolicy
+	credentials   credentials
+}
+
+func newHTTPDecoder(baseURL string, opts ...Option) httpDecoder {
+	d := httpDecoder{
+		client:  newHTTPClient(),
+		baseURL: baseURL,
+		retry:   DefaultRetryPolicy,
 	}
 	for _, opt := range opts {
-		opt(d)
+		opt(&d)
 	}
+	d.client.Transport = &authTransport{base: d.client.Transport, credentials: d.credentials}
 	return d
 }
 
+type RailboxRB23xx struct {
+	httpDecoder
+	// jsonListing is found out by the first listing, see listDir
+	jsonListing atomic.Int32
+}
+
+func NewRailboxRB23xx(opts ...Option) *RailboxRB23xx {
+	return &RailboxRB23xx{httpDecoder: newHTTPDecoder(DEFAULT_RAILBOX_HTTP_ADDRESS, opts...)}
+}
+
 func newHTTPClient() *http.Client {
 	return &http.Client{
 		Timeout: DEFAULT_TIMEOUT,
 	}
 }
 
-func (d *RailboxRB23xx) httpGet(endpoint string) (*http.Response, error) {
-	url := DEFAULT_RAILBOX_HTTP_ADDRESS + endpoint
-	resp, err := d.client.Get(url)
+func (d *httpDecoder) httpGet(endpoint string) (*http.Response, error) {
+	url := d.baseURL + endpoint
+	resp, err := d.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, url, nil)
+	})
+	if errors.Is(err, ErrUnauthorized) {
+		return nil, err
+	}
 	if err != nil {
 		return nil, fmt.Errorf("cannot connect to loco wifi (are you connected to loco wifi? is loco wifi function on?): %w", err)
 	}
@@ -63,40 +137,46 @@ func (d *RailboxRB23xx) ClearSoundSlot(slot uint8) error {
 	return nil
 }
 
-// reFileEntry matches a file row in the listing HTML, capturing name and size in KB.
-// Example row fragment: placeholder='F11_Decouple.wav'> </td><td>file</td><td align='right'>108</td>
-var reFileEntry = regexp.MustCompile(`placeholder='([^']+)'[^<]*</td><td>file</td><td[^>]*>(\d+)</td>`)
-
 // RemoteFileInfo holds metadata about a file on the decoder.
+// ModTime is zero when the firmware does not print the modification time.
 type RemoteFileInfo struct {
-	Name   string
-	SizeKB int64
+	Name    string
+	SizeKB  int64
+	ModTime time.Time
 }
 
 // ListSoundSlot returns the files present in the given slot on the decoder.
 func (d *RailboxRB23xx) ListSoundSlot(slot uint8) ([]RemoteFileInfo, error) {
-	resp, err := d.httpGet(fmt.Sprintf(SOUND_PACKAGE_LIST_ENDPOINT, slot))
+	entries, err := d.listDir(fmt.Sprintf(SOUND_PACKAGE_JSON_LIST_ENDPOINT, slot), fmt.Sprintf(SOUND_PACKAGE_LIST_ENDPOINT, slot), fmt.Sprintf("slot %d", slot))
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	files := make([]RemoteFileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Dir {
+			files = append(files, RemoteFileInfo{Name: entry.Name, SizeKB: entry.SizeKB, ModTime: entry.ModTime})
+		}
+	}
+	return files, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+// ListSoundSlotNumbers returns the slots present on the decoder, sorted
+func (d *RailboxRB23xx) ListSoundSlotNumbers() ([]uint8, error) {
+	entries, err := d.listDir(SOUND_PACKAGE_JSON_ROOT_ENDPOINT, SOUND_PACKAGE_ROOT_ENDPOINT, "the slots")
 	if err != nil {
-		return nil, fmt.Errorf("failed to read listing response: %w", err)
+		return nil, err
 	}
-
-	matches := reFileEntry.FindAllSubmatch(body, -1)
-	files := make([]RemoteFileInfo, 0, len(matches))
-	for _, m := range matches {
-		var sizeKB int64
-		fmt.Sscan(string(m[2]), &sizeKB)
-		files = append(files, RemoteFileInfo{
-			Name:   string(m[1]),
-			SizeKB: sizeKB,
-		})
+	var slots []uint8
+	for _, entry := range entries {
+		if !entry.Dir {
+			continue
+		}
+		if slot, err := strconv.ParseUint(entry.Name, 10, 8); err == nil {
+			slots = append(slots, uint8(slot))
+		}
 	}
-	return files, nil
+	slices.Sort(slots)
+	return slices.Compact(slots), nil
 }
 
 // DeleteSoundFile deletes a single file from the given slot on the decoder.
@@ -114,20 +194,32 @@ func (d *RailboxRB23xx) DeleteSoundFile(slot uint8, filename string) error {
 }
 
 // UploadSoundFile uploads a file to the given slot on the decoder.
+// A seekable content, e.g. an *os.File, is streamed and rewound when the request is sent again.
 func (d *RailboxRB23xx) UploadSoundFile(slot uint8, filename string, content io.Reader) error {
-	data, err := io.ReadAll(content)
+	body, err := newUploadBody(content)
 	if err != nil {
 		return fmt.Errorf("failed to read file %q: %w", filename, err)
 	}
 
-	url := DEFAULT_RAILBOX_HTTP_ADDRESS + fmt.Sprintf(SOUND_PACKAGE_UPLOAD_ENDPOINT, slot, filename)
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	envelope, err := newFormEnvelope(UPLOAD_FORM_FIELD, filename)
 	if err != nil {
 		return fmt.Errorf("failed to build upload request for %q: %w", filename, err)
 	}
-	req.Header.Set("Content-Type", "multipart/form-data")
 
-	resp, err := d.client.Do(req)
+	url := d.baseURL + fmt.Sprintf(SOUND_PACKAGE_UPLOAD_ENDPOINT, slot, filename)
+	var digest *uploadDigest
+	resp, err := d.do(func() (*http.Request, error) {
+		digest = newUploadDigest()
+		reader, err := body.open(digest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %q: %w", filename, err)
+		}
+		req, err := newFormRequest(url, envelope, reader, body.size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build upload request for %q: %w", filename, err)
+		}
+		return req, nil
+	})
 	if err != nil {
 		return fmt.Errorf("upload %q failed: %w", filename, err)
 	}
@@ -136,5 +228,217 @@ func (d *RailboxRB23xx) UploadSoundFile(slot uint8, filename string, content io.
 	if resp.StatusCode >= 400 {
 		return fmt.Errorf("upload %q failed with HTTP %d", filename, resp.StatusCode)
 	}
+	if d.verifyUploads {
+		return d.verifyDigest(slot, filename, digest)
+	}
+	return nil
+}
+
+// Resumable tells if a file of the given size should be uploaded with UploadSoundFileResumable
+func (d *RailboxRB23xx) Resumable(size int64) bool {
+	return d.resumable && size > UPLOAD_CHUNK_SIZE
+}
+
+// UploadSoundFileResumable uploads a file of the given size in chunks of UPLOAD_CHUNK_SIZE, starting at offset.
+// Every chunk is sent with a Content-Range header, so the decoder stores it in place, and is sent again
+// as the RetryPolicy allows when the connection drops. stored is called with the number of bytes
+// on the decoder after every chunk, an interrupted upload continues from there when called again with that offset.
+func (d *RailboxRB23xx) UploadSoundFileResumable(slot uint8, filename string, content io.ReaderAt, size int64, offset int64, stored func(offset int64)) error {
+	url := d.baseURL + fmt.Sprintf(SOUND_PACKAGE_UPLOAD_ENDPOINT, slot, filename)
+	envelope, err := newFormEnvelope(UPLOAD_FORM_FIELD, filename)
+	if err != nil {
+		return fmt.Errorf("failed to build upload request for %q: %w", filename, err)
+	}
+	chunk := make([]byte, UPLOAD_CHUNK_SIZE)
+	for offset < size {
+		n, err := content.ReadAt(chunk[:min(int64(len(chunk)), size-offset)], offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read file %q: %w", filename, err)
+		}
+		contentRange := fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(n)-1, size)
+
+		if uploadErr := d.uploadChunk(url, envelope, chunk[:n], contentRange); uploadErr != nil {
+			return fmt.Errorf("upload %q failed at byte %d of %d: %w", filename, offset, size, uploadErr)
+		}
+		offset += int64(n)
+		stored(offset)
+	}
+
+	if d.verifyUploads {
+		digest, err := digestAt(content, size)
+		if err != nil {
+			return fmt.Errorf("failed to read file %q: %w", filename, err)
+		}
+		return d.verifyDigest(slot, filename, digest)
+	}
+	return nil
+}
+
+// uploadChunk sends a single part of a file as the file of the form, contentRange tells where the part belongs
+func (d *RailboxRB23xx) uploadChunk(url string, envelope *formEnvelope, data []byte, contentRange string) error {
+	resp, err := d.do(func() (*http.Request, error) {
+		req, err := newFormRequest(url, envelope, bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Range", contentRange)
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("HTTP %d for %s", resp.StatusCode, contentRange)
+	}
+	return nil
+}
+
+// VerifySoundFile compares a file stored on the decoder with the expected content.
+// The firmware does not expose file hashes, so the first and the last VERIFY_BLOCK_SIZE bytes
+// are fetched with HTTP range requests. When the decoder ignores the Range header the whole
+// file is downloaded and compared by SHA-256 instead.
+func (d *RailboxRB23xx) VerifySoundFile(slot uint8, filename string, expected []byte) error {
+	return d.verifyDigest(slot, filename, digestOf(expected))
+}
+
+// verifyDigest is VerifySoundFile for a file that was streamed, see uploadDigest
+func (d *RailboxRB23xx) verifyDigest(slot uint8, filename string, expected *uploadDigest) error {
+	if expected.size <= 2*VERIFY_BLOCK_SIZE {
+		_, err := d.verifyRange(slot, filename, expected, "")
+		return err
+	}
+	// a decoder ignoring the Range header sent the whole file already, it is not downloaded again for the tail
+	if whole, err := d.verifyRange(slot, filename, expected, fmt.Sprintf("bytes=0-%d", VERIFY_BLOCK_SIZE-1)); whole || err != nil {
+		return err
+	}
+	_, err := d.verifyRange(slot, filename, expected, fmt.Sprintf("bytes=-%d", VERIFY_BLOCK_SIZE))
+	return err
+}
+
+// verifyRange downloads a byte range (or the whole file when byteRange is empty) and compares it with expected,
+// whole tells the decoder sent the whole file instead of the range
+func (d *RailboxRB23xx) verifyRange(slot uint8, filename string, expected *uploadDigest, byteRange string) (whole bool, err error) {
+	url := d.baseURL + fmt.Sprintf(SOUND_PACKAGE_DOWNLOAD_ENDPOINT, slot, filename)
+	resp, err := d.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build verification request for %q: %w", filename, err)
+		}
+		if byteRange != "" {
+			req.Header.Set("Range", byteRange)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("cannot verify %q: %w", filename, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return false, fmt.Errorf("cannot verify %q: HTTP %d", filename, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("cannot verify %q: %w", filename, err)
+	}
+
+	// the decoder ignored the Range header and sent the whole file
+	if resp.StatusCode != http.StatusPartialContent {
+		if !expected.matches(body) {
+			return true, fmt.Errorf("%w: %q (local %d bytes, decoder %d bytes)", ErrVerificationFailed, filename, expected.size, len(body))
+		}
+		return true, nil
+	}
+
+	want := expected.head
+	if byteRange == fmt.Sprintf("bytes=-%d", VERIFY_BLOCK_SIZE) {
+		want = expected.tail
+	}
+	if !bytes.Equal(body, want) {
+		return false, fmt.Errorf("%w: %q (%s)", ErrVerificationFailed, filename, byteRange)
+	}
+	return false, nil
+}
+
+// DownloadSoundFile reads a whole file from the given slot on the decoder.
+func (d *RailboxRB23xx) DownloadSoundFile(slot uint8, filename string) ([]byte, error) {
+	resp, err := d.httpGet(fmt.Sprintf(SOUND_PACKAGE_DOWNLOAD_ENDPOINT, slot, filename))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("download %q failed with HTTP %d", filename, resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("download %q failed: %w", filename, err)
+	}
+	return data, nil
+}
+
+// OUTPUT_MAP_FILE is the AUX output mapping of the decoder, stored next to the sound slots, see outputmap.Parse
+const OUTPUT_MAP_FILE = "outputs.txt"
+
+// OUTPUT_MAP_ENDPOINT reads OUTPUT_MAP_FILE
+const OUTPUT_MAP_ENDPOINT = "/?p=/" + OUTPUT_MAP_FILE
+
+// OUTPUT_MAP_UPLOAD_ENDPOINT writes OUTPUT_MAP_FILE
+const OUTPUT_MAP_UPLOAD_ENDPOINT = "/upload?p=/" + OUTPUT_MAP_FILE
+
+// ErrNoOutputMap is returned when the decoder has no AUX output mapping file
+var ErrNoOutputMap = errors.New("the decoder has no AUX output mapping file")
+
+// DownloadOutputMap reads the AUX output mapping file of the decoder
+func (d *RailboxRB23xx) DownloadOutputMap() ([]byte, error) {
+	resp, err := d.httpGet(OUTPUT_MAP_ENDPOINT)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNoOutputMap
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("download of the output map failed with HTTP %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("download of the output map failed: %w", err)
+	}
+	return data, nil
+}
+
+// UploadOutputMap replaces the AUX output mapping file of the decoder, it is read back to be sure it was stored
+func (d *RailboxRB23xx) UploadOutputMap(data []byte) error {
+	envelope, err := newFormEnvelope(UPLOAD_FORM_FIELD, OUTPUT_MAP_FILE)
+	if err != nil {
+		return fmt.Errorf("failed to build the output map upload request: %w", err)
+	}
+	resp, err := d.do(func() (*http.Request, error) {
+		req, err := newFormRequest(d.baseURL+OUTPUT_MAP_UPLOAD_ENDPOINT, envelope, bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to build the output map upload request: %w", err)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("upload of the output map failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("upload of the output map failed with HTTP %d", resp.StatusCode)
+	}
+
+	stored, err := d.DownloadOutputMap()
+	if err != nil {
+		return fmt.Errorf("cannot read back the output map: %w", err)
+	}
+	if !bytes.Equal(stored, data) {
+		return fmt.Errorf("the output map read back from the decoder differs from the uploaded one (%d of %d bytes)", len(stored), len(data))
+	}
 	return nil
 }
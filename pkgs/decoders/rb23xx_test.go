@@ -0,0 +1,84 @@
+package decoders
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serveSoundFile serves content as /?p=/1/F1_Horn.wav, honouring the Range header when ranges is set,
+// the Range headers of the requests are recorded
+func serveSoundFile(t *testing.T, content []byte, ranges bool) (*RailboxRB23xx, *[]string) {
+	t.Helper()
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RequestURI() != "/?p=/1/F1_Horn.wav" {
+			http.NotFound(w, r)
+			return
+		}
+		requested = append(requested, r.Header.Get("Range"))
+		if !ranges {
+			_, _ = w.Write(content)
+			return
+		}
+		http.ServeContent(w, r, "F1_Horn.wav", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+	return NewRailboxRB23xx(WithBaseURL(server.URL)), &requested
+}
+
+// soundFile is a file longer than the two compared blocks, its head and tail differ
+func soundFile() []byte {
+	content := make([]byte, 3*VERIFY_BLOCK_SIZE)
+	for i := range content {
+		content[i] = byte(i / VERIFY_BLOCK_SIZE)
+	}
+	return content
+}
+
+func TestVerifySoundFile_Ranges(t *testing.T) {
+	content := soundFile()
+	rb, requested := serveSoundFile(t, content, true)
+
+	assert.NoError(t, rb.VerifySoundFile(1, "F1_Horn.wav", content))
+	assert.Equal(t, []string{"bytes=0-4095", "bytes=-4096"}, *requested)
+
+	// the middle of the file is not compared, the head and the tail are
+	changed := append([]byte(nil), content...)
+	changed[VERIFY_BLOCK_SIZE+1] = 9
+	assert.NoError(t, rb.VerifySoundFile(1, "F1_Horn.wav", changed))
+	changed[len(changed)-1] = 9
+	assert.ErrorIs(t, rb.VerifySoundFile(1, "F1_Horn.wav", changed), ErrVerificationFailed)
+	changed = append([]byte(nil), content...)
+	changed[0] = 9
+	assert.ErrorIs(t, rb.VerifySoundFile(1, "F1_Horn.wav", changed), ErrVerificationFailed)
+}
+
+func TestVerifySoundFile_RangeIgnored(t *testing.T) {
+	content := soundFile()
+	rb, requested := serveSoundFile(t, content, false)
+
+	// the whole file is compared by its SHA-256 and downloaded only once
+	assert.NoError(t, rb.VerifySoundFile(1, "F1_Horn.wav", content))
+	assert.Equal(t, []string{"bytes=0-4095"}, *requested)
+
+	changed := append([]byte(nil), content...)
+	changed[VERIFY_BLOCK_SIZE+1] = 9
+	assert.ErrorIs(t, rb.VerifySoundFile(1, "F1_Horn.wav", changed), ErrVerificationFailed)
+	assert.ErrorIs(t, rb.VerifySoundFile(1, "F1_Horn.wav", content[:len(content)-1]), ErrVerificationFailed)
+}
+
+func TestVerifySoundFile_SmallFile(t *testing.T) {
+	content := []byte("RIFF small")
+	rb, requested := serveSoundFile(t, content, true)
+
+	assert.NoError(t, rb.VerifySoundFile(1, "F1_Horn.wav", content))
+	assert.Equal(t, []string{""}, *requested)
+	assert.ErrorIs(t, rb.VerifySoundFile(1, "F1_Horn.wav", []byte("RIFF smalL")), ErrVerificationFailed)
+
+	assert.Error(t, rb.VerifySoundFile(1, "F2_Bell.wav", content))
+}
@@ -0,0 +1,92 @@
+package decoders
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+//
+// Context: the WiFi of a decoder drops packets, especially while the locomotive is moving or its motor is running.
+// Every request is sent again a few times before an operation gives up, with a growing pause in between.
+//
+
+// RetryPolicy tells how the requests to the decoder are repeated
+type RetryPolicy struct {
+	// Attempts is the number of times a request is sent, 1 sends it once
+	Attempts int
+	// Backoff is the pause before the second attempt, doubled before every next one up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// RetryStatus are the HTTP statuses answered by an overloaded decoder, a request is sent again after them too
+	RetryStatus []int
+}
+
+// DefaultRetryPolicy rides out a short dropout of the WiFi
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:    4,
+	Backoff:     500 * time.Millisecond,
+	MaxBackoff:  8 * time.Second,
+	RetryStatus: []int{http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+}
+
+// WithRetryPolicy replaces DefaultRetryPolicy, fields left at zero keep the defaults
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(d *httpDecoder) {
+		if policy.Attempts > 0 {
+			d.retry.Attempts = policy.Attempts
+		}
+		if policy.Backoff > 0 {
+			d.retry.Backoff = policy.Backoff
+		}
+		if policy.MaxBackoff > 0 {
+			d.retry.MaxBackoff = policy.MaxBackoff
+		}
+		if policy.RetryStatus != nil {
+			d.retry.RetryStatus = policy.RetryStatus
+		}
+	}
+}
+
+// delay is the pause before the given attempt, counted from 1
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	delay := p.Backoff
+	for i := 2; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxBackoff)
+}
+
+// do sends the request again while the connection fails or the decoder answers with one of the RetryStatus.
+// newRequest is called for every attempt, so a request body is sent whole each time. The response to the last
+// attempt is returned as it is, the caller checks its status.
+func (d *httpDecoder) do(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	attempts := max(d.retry.Attempts, 1)
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := d.client.Do(req)
+		if errors.Is(err, ErrUnauthorized) {
+			// the same credentials are refused again
+			return nil, err
+		}
+		retry := err != nil || slices.Contains(d.retry.RetryStatus, resp.StatusCode)
+		if !retry {
+			return resp, nil
+		}
+		if attempt >= attempts {
+			if err != nil {
+				return nil, fmt.Errorf("%w (%d attempts)", err, attempts)
+			}
+			return resp, nil
+		}
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		time.Sleep(d.retry.delay(attempt + 1))
+	}
+}
@@ -0,0 +1,74 @@
+package decoders
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//
+// Context: the sounds are stored in the flash memory of the decoder, or on its SD card. The web interface
+// prints the occupied and the total space under the listing of the root, e.g. "Used: 2310 KB Total: 3904 KB".
+//
+
+// ErrStorageUnknown is returned when the firmware does not report the storage space
+var ErrStorageUnknown = errors.New("the decoder does not report its storage space")
+
+// Storage is the space for the sounds, in bytes
+type Storage struct {
+	Total int64
+	Used  int64
+}
+
+func (s Storage) Free() int64 {
+	return max(0, s.Total-s.Used)
+}
+
+// reStorage matches a figure of the storage report, e.g. "Free: 1.5 MB"
+var reStorage = regexp.MustCompile(`(?i)\b(total|used|free)(?:\s+space)?\s*[:=]?\s*(\d+(?:\.\d+)?)\s*(B|KB|MB|GB)\b`)
+
+// Storage reads the occupied and the total space of the decoder storage
+func (d *RailboxRB23xx) Storage() (Storage, error) {
+	resp, err := d.httpGet(SOUND_PACKAGE_ROOT_ENDPOINT)
+	if err != nil {
+		return Storage{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return Storage{}, fmt.Errorf("listing the slots failed with HTTP %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Storage{}, fmt.Errorf("failed to read listing response: %w", err)
+	}
+	return parseStorage(string(body))
+}
+
+// parseStorage reads the figures of the storage report, two of total, used and free are enough
+func parseStorage(listing string) (Storage, error) {
+	figures := map[string]int64{}
+	for _, m := range reStorage.FindAllStringSubmatch(listing, -1) {
+		value, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			continue
+		}
+		unit := map[string]float64{"B": 1, "KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30}[strings.ToUpper(m[3])]
+		figures[strings.ToLower(m[1])] = int64(value * unit)
+	}
+
+	total, hasTotal := figures["total"]
+	used, hasUsed := figures["used"]
+	free, hasFree := figures["free"]
+	switch {
+	case hasTotal && hasUsed:
+		return Storage{Total: total, Used: used}, nil
+	case hasTotal && hasFree:
+		return Storage{Total: total, Used: total - free}, nil
+	case hasUsed && hasFree:
+		return Storage{Total: used + free, Used: used}, nil
+	}
+	return Storage{}, ErrStorageUnknown
+}
@@ -0,0 +1,148 @@
+package decoders
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"mime/multipart"
+	"net/http"
+)
+
+//
+// Context: a sound file takes a few megabytes and the sync uploads several of them at once. The file is streamed
+// into the request, with its Content-Length, instead of being read into memory first. A request sent again after
+// a dropout rewinds the file, and what is compared by VerifySoundFile is collected while the file is sent.
+//
+
+// UPLOAD_FORM_FIELD is the file field of the upload form of the web interface
+const UPLOAD_FORM_FIELD = "data"
+
+// FIRMWARE_FORM_FIELD is the file field of the firmware update form
+const FIRMWARE_FORM_FIELD = "firmware"
+
+// formEnvelope is a multipart/form-data body of a single file, as sent by the form of the web interface.
+// Its headers and its closing boundary are kept apart from the file, so the file is streamed between them
+// and the length of the body is known in advance.
+type formEnvelope struct {
+	contentType string
+	head        []byte
+	tail        []byte
+}
+
+// newFormEnvelope prepares the envelope of a file sent in the given field of the form
+func newFormEnvelope(field string, filename string) (*formEnvelope, error) {
+	var head bytes.Buffer
+	w := multipart.NewWriter(&head)
+	if _, err := w.CreateFormFile(field, filename); err != nil {
+		return nil, err
+	}
+	return &formEnvelope{
+		contentType: w.FormDataContentType(),
+		head:        head.Bytes(),
+		tail:        []byte(fmt.Sprintf("\r\n--%s--\r\n", w.Boundary())),
+	}, nil
+}
+
+// wrap puts the file into the envelope
+func (e *formEnvelope) wrap(file io.Reader) io.Reader {
+	return io.MultiReader(bytes.NewReader(e.head), file, bytes.NewReader(e.tail))
+}
+
+// length is the length of the body carrying a file of the given size
+func (e *formEnvelope) length(size int64) int64 {
+	return int64(len(e.head)) + size + int64(len(e.tail))
+}
+
+// newFormRequest builds a POST of a file of the given size in the envelope
+func newFormRequest(url string, envelope *formEnvelope, file io.Reader, size int64) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, url, envelope.wrap(file))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = envelope.length(size)
+	req.Header.Set("Content-Type", envelope.contentType)
+	return req, nil
+}
+
+// uploadBody is the content of an upload, sent again from its start by every attempt of do
+type uploadBody struct {
+	r     io.ReadSeeker
+	start int64
+	size  int64
+}
+
+// newUploadBody measures a seekable content, e.g. an *os.File or a bytes.Reader. A content that cannot seek
+// is read into memory, as it could not be sent again otherwise.
+func newUploadBody(content io.Reader) (*uploadBody, error) {
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			var end int64
+			if end, err = seeker.Seek(0, io.SeekEnd); err == nil {
+				return &uploadBody{r: seeker, start: start, size: end - start}, nil
+			}
+		}
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadBody{r: bytes.NewReader(data), size: int64(len(data))}, nil
+}
+
+// open rewinds the content, what is read from it is also written to digest
+func (b *uploadBody) open(digest io.Writer) (io.Reader, error) {
+	if _, err := b.r.Seek(b.start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.TeeReader(io.LimitReader(b.r, b.size), digest), nil
+}
+
+// uploadDigest keeps what VerifySoundFile compares: the first and the last VERIFY_BLOCK_SIZE bytes and the SHA-256
+type uploadDigest struct {
+	size int64
+	head []byte
+	tail []byte
+	sum  hash.Hash
+}
+
+func newUploadDigest() *uploadDigest {
+	return &uploadDigest{sum: sha256.New()}
+}
+
+// digestOf collects the digest of a content held in memory
+func digestOf(data []byte) *uploadDigest {
+	digest := newUploadDigest()
+	_, _ = digest.Write(data)
+	return digest
+}
+
+// digestAt collects the digest of the first size bytes of content
+func digestAt(content io.ReaderAt, size int64) (*uploadDigest, error) {
+	digest := newUploadDigest()
+	if _, err := io.Copy(digest, io.NewSectionReader(content, 0, size)); err != nil {
+		return nil, err
+	}
+	return digest, nil
+}
+
+func (g *uploadDigest) Write(p []byte) (int, error) {
+	g.size += int64(len(p))
+	g.sum.Write(p)
+	if missing := VERIFY_BLOCK_SIZE - len(g.head); missing > 0 {
+		g.head = append(g.head, p[:min(missing, len(p))]...)
+	}
+	g.tail = append(g.tail, p...)
+	if len(g.tail) > VERIFY_BLOCK_SIZE {
+		g.tail = append(g.tail[:0], g.tail[len(g.tail)-VERIFY_BLOCK_SIZE:]...)
+	}
+	return len(p), nil
+}
+
+// matches compares a whole file with the digest
+func (g *uploadDigest) matches(data []byte) bool {
+	sum := sha256.Sum256(data)
+	return int64(len(data)) == g.size && bytes.Equal(sum[:], g.sum.Sum(nil))
+}
@@ -0,0 +1,386 @@
+package sim
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keskad/loco/pkgs/decoders"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// Context: the web interface of a RB23xx, reached over the WiFi of the decoder. The sounds are files in the
+// numbered directories of the slots, "/?p=/1/" lists a slot as a HTML table, "/?p=/1/F1_Horn.wav" downloads
+// a file, "/upload?p=/1/F1_Horn.wav" stores the body of a POST and "/delete?p=/1/F1_Horn.wav" removes it.
+// "/cv?n=29" answers a CV and "/cv?n=29&v=6" posted writes it, the CVs are kept in memory.
+//
+
+// RB23xxOptions describes the simulated decoder
+type RB23xxOptions struct {
+	// Dir keeps the files on disk, one directory per slot, so they survive a restart. Empty keeps them in memory.
+	Dir string
+	// CapacityKB is the storage space reported under the listing of the root, 0 means unlimited and not reported
+	CapacityKB int64
+	// Model, Firmware and Serial are reported by the status page, /info
+	Model    string
+	Firmware string
+	Serial   string
+	// Latency delays every answer, like a decoder reached over a weak WiFi
+	Latency time.Duration
+	// CVs are the values the decoder starts with, a CV that is not set reads 0
+	CVs map[uint16]int
+}
+
+// RB23xx is a fake Railbox RB23xx answering its HTTP interface
+type RB23xx struct {
+	options RB23xxOptions
+
+	mu    sync.Mutex
+	files map[string][]byte // by "slot/name", or by name for the files of the root, e.g. outputs.txt
+	cvs   map[uint16]int
+}
+
+// reRB23xxPath matches the files the decoder stores: a file of a numbered slot or a file of the root
+var reRB23xxPath = regexp.MustCompile(`^(?:\d{1,3}/)?[^/\\]+$`)
+
+// NewRB23xx creates a simulated decoder, the files of options.Dir are loaded
+func NewRB23xx(options RB23xxOptions) (*RB23xx, error) {
+	s := &RB23xx{options: options, files: make(map[string][]byte), cvs: make(map[uint16]int)}
+	for num, value := range options.CVs {
+		s.cvs[num] = value
+	}
+	if options.Dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(options.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("cannot create %s: %w", options.Dir, err)
+	}
+	err := filepath.WalkDir(options.Dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(options.Dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !reRB23xxPath.MatchString(name) {
+			logrus.Debugf("sim: %s is not a file of the decoder, ignored", name)
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		s.files[name] = data
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot load %s: %w", options.Dir, err)
+	}
+	return s, nil
+}
+
+// File returns the content of a file, e.g. "1/F1_Horn.wav"
+func (s *RB23xx) File(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[name]
+	return data, ok
+}
+
+// CV returns the value of a CV
+func (s *RB23xx) CV(num uint16) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cvs[num]
+}
+
+// Files returns the names of the stored files, sorted
+func (s *RB23xx) Files() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *RB23xx) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("sim: %s %s %s", r.RemoteAddr, r.Method, r.URL.RequestURI())
+	if s.options.Latency > 0 {
+		time.Sleep(s.options.Latency)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Query().Get("p"), "/")
+	switch r.URL.Path {
+	case "/upload":
+		s.upload(w, r, path)
+	case "/delete":
+		s.delete(w, path)
+	case "/info":
+		if s.options.Model == "" && s.options.Firmware == "" && s.options.Serial == "" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "<html><body><table><tr><td>Model</td><td>%s</td></tr><tr><td>Firmware</td><td>%s</td></tr><tr><td>Serial</td><td>%s</td></tr></table></body></html>",
+			s.options.Model, s.options.Firmware, s.options.Serial)
+	case "/cv":
+		s.cv(w, r)
+	case "/":
+		switch {
+		case path == "":
+			s.listRoot(w)
+		case strings.HasSuffix(path, "/"):
+			s.listSlot(w, r, strings.TrimSuffix(path, "/"))
+		default:
+			s.download(w, r, path)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// cv answers the value of the CV n, a POST with v writes it before
+func (s *RB23xx) cv(w http.ResponseWriter, r *http.Request) {
+	num, err := strconv.ParseUint(r.URL.Query().Get("n"), 10, 16)
+	if err != nil || num < 1 || num > decoders.MAX_CV {
+		http.Error(w, "invalid cv", http.StatusBadRequest)
+		return
+	}
+	if raw := r.URL.Query().Get("v"); raw != "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		value, err := strconv.ParseUint(raw, 10, 8)
+		if err != nil {
+			http.Error(w, "invalid value", http.StatusBadRequest)
+			return
+		}
+		s.cvs[uint16(num)] = int(value)
+	}
+	fmt.Fprintf(w, "%d", s.cvs[uint16(num)])
+}
+
+// upload stores the file of the upload form, a request with a Content-Range header stores a part of the file in place
+func (s *RB23xx) upload(w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST expected", http.StatusMethodNotAllowed)
+		return
+	}
+	if !reRB23xxPath.MatchString(path) {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	body, err := readUploadForm(r, decoders.UPLOAD_FORM_FIELD)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data := body
+	if contentRange := r.Header.Get("Content-Range"); contentRange != "" {
+		start, err := parseContentRange(contentRange, len(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// the first part starts the file again, the next ones continue what is stored
+		var stored []byte
+		if start > 0 {
+			stored = s.files[path]
+		}
+		if int64(len(stored)) < start {
+			http.Error(w, fmt.Sprintf("%d bytes stored, the part starts at %d", len(stored), start), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		data = append(append([]byte{}, stored[:start]...), body...)
+	}
+
+	if s.options.CapacityKB > 0 && (s.used()-int64(len(s.files[path]))+int64(len(data)))/1024 > s.options.CapacityKB {
+		http.Error(w, "not enough space", http.StatusInsufficientStorage)
+		return
+	}
+	if err := s.store(path, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, "OK")
+}
+
+// readUploadForm reads the file sent in the field of a multipart/form-data body, the firmware finds nothing else
+func readUploadForm(r *http.Request, field string) ([]byte, error) {
+	form, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("the upload is not a multipart form: %w", err)
+	}
+	for {
+		part, err := form.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("no file in the %q field of the upload form", field)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid upload form: %w", err)
+		}
+		if part.FormName() == field && part.FileName() != "" {
+			return io.ReadAll(part)
+		}
+	}
+}
+
+// delete removes a file, "slot/all" removes the whole slot
+func (s *RB23xx) delete(w http.ResponseWriter, path string) {
+	if slot, ok := strings.CutSuffix(path, "/all"); ok {
+		for name := range s.files {
+			if strings.HasPrefix(name, slot+"/") {
+				if err := s.remove(name); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+		fmt.Fprint(w, "OK")
+		return
+	}
+	if _, ok := s.files[path]; !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err := s.remove(path); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, "OK")
+}
+
+// download sends a file, honouring the Range header as the verification of the uploads expects
+func (s *RB23xx) download(w http.ResponseWriter, r *http.Request, path string) {
+	data, ok := s.files[path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, filepath.Base(path), time.Time{}, bytes.NewReader(data))
+}
+
+// listRoot lists the slots and the files of the root, followed by the storage report
+func (s *RB23xx) listRoot(w http.ResponseWriter) {
+	slots := map[int]bool{}
+	var files []string
+	for name := range s.files {
+		if slot, _, ok := strings.Cut(name, "/"); ok {
+			number, _ := strconv.Atoi(slot)
+			slots[number] = true
+		} else {
+			files = append(files, name)
+		}
+	}
+	numbers := make([]int, 0, len(slots))
+	for number := range slots {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	sort.Strings(files)
+
+	fmt.Fprint(w, "<html><body><table>")
+	for _, number := range numbers {
+		fmt.Fprintf(w, "<tr><td><input placeholder='%d'> </td><td>dir</td><td></td></tr>", number)
+	}
+	for _, name := range files {
+		fmt.Fprintf(w, "<tr><td><input placeholder='%s'> </td><td>file</td><td align='right'>%d</td></tr>", name, sizeKB(s.files[name]))
+	}
+	fmt.Fprint(w, "</table>")
+	if s.options.CapacityKB > 0 {
+		fmt.Fprintf(w, "<p>Used: %d KB Total: %d KB</p>", (s.used()+1023)/1024, s.options.CapacityKB)
+	}
+	fmt.Fprint(w, "</body></html>")
+}
+
+// listSlot lists the files of a slot, a slot without files is listed empty like on the decoder
+func (s *RB23xx) listSlot(w http.ResponseWriter, r *http.Request, slot string) {
+	if _, err := strconv.ParseUint(slot, 10, 8); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var names []string
+	for name := range s.files {
+		if file, ok := strings.CutPrefix(name, slot+"/"); ok {
+			names = append(names, file)
+		}
+	}
+	sort.Strings(names)
+
+	fmt.Fprint(w, "<html><body><table>")
+	for _, name := range names {
+		fmt.Fprintf(w, "<tr><td><input placeholder='%s'> </td><td>file</td><td align='right'>%d</td></tr>", name, sizeKB(s.files[slot+"/"+name]))
+	}
+	fmt.Fprint(w, "</table></body></html>")
+}
+
+// store keeps a file, and writes it to options.Dir
+func (s *RB23xx) store(path string, data []byte) error {
+	if s.options.Dir != "" {
+		target := filepath.Join(s.options.Dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, data, 0o644); err != nil {
+			return err
+		}
+	}
+	s.files[path] = data
+	return nil
+}
+
+// remove forgets a file, and deletes it from options.Dir
+func (s *RB23xx) remove(path string) error {
+	if s.options.Dir != "" {
+		if err := os.Remove(filepath.Join(s.options.Dir, filepath.FromSlash(path))); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	delete(s.files, path)
+	return nil
+}
+
+// used is the number of bytes stored
+func (s *RB23xx) used() int64 {
+	var used int64
+	for _, data := range s.files {
+		used += int64(len(data))
+	}
+	return used
+}
+
+// sizeKB is the size the listing shows, rounded up like the firmware does
+func sizeKB(data []byte) int64 {
+	return (int64(len(data)) + 1023) / 1024
+}
+
+// parseContentRange reads the start of "bytes 0-262143/1048576", the part must be as long as the body
+func parseContentRange(header string, length int) (int64, error) {
+	var start, end, size int64
+	if _, err := fmt.Sscanf(header, "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		return 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	if start < 0 || end < start || end >= size || end-start+1 != int64(length) {
+		return 0, fmt.Errorf("invalid Content-Range %q for %d bytes", header, length)
+	}
+	return start, nil
+}
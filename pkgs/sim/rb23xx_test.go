@@ -0,0 +1,276 @@
+package sim
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keskad/loco/pkgs/decoders"
+)
+
+func startRB23xx(t *testing.T, options RB23xxOptions) (*RB23xx, *decoders.RailboxRB23xx) {
+	t.Helper()
+	simulator, err := NewRB23xx(options)
+	if err != nil {
+		t.Fatalf("NewRB23xx: %v", err)
+	}
+	server := httptest.NewServer(simulator)
+	t.Cleanup(server.Close)
+	return simulator, decoders.NewRailboxRB23xx(decoders.WithBaseURL(server.URL), decoders.WithUploadVerification())
+}
+
+func TestRB23xx_Files(t *testing.T) {
+	simulator, client := startRB23xx(t, RB23xxOptions{})
+
+	horn := bytes.Repeat([]byte("horn"), 5000)
+	if err := client.UploadSoundFile(1, "F1_Horn.wav", bytes.NewReader(horn)); err != nil {
+		t.Fatalf("UploadSoundFile: %v", err)
+	}
+	if err := client.UploadSoundFile(1, "F2_Bell.wav", strings.NewReader("bell")); err != nil {
+		t.Fatalf("UploadSoundFile: %v", err)
+	}
+	if err := client.UploadSoundFile(3, "F1_Horn.wav", strings.NewReader("other")); err != nil {
+		t.Fatalf("UploadSoundFile: %v", err)
+	}
+
+	slots, err := client.ListSoundSlotNumbers()
+	if err != nil || !slices.Equal(slots, []uint8{1, 3}) {
+		t.Fatalf("ListSoundSlotNumbers = %v, %v", slots, err)
+	}
+	files, err := client.ListSoundSlot(1)
+	if err != nil {
+		t.Fatalf("ListSoundSlot: %v", err)
+	}
+	want := []decoders.RemoteFileInfo{{Name: "F1_Horn.wav", SizeKB: 20}, {Name: "F2_Bell.wav", SizeKB: 1}}
+	if !slices.Equal(files, want) {
+		t.Fatalf("ListSoundSlot = %v, want %v", files, want)
+	}
+	data, err := client.DownloadSoundFile(1, "F1_Horn.wav")
+	if err != nil || !bytes.Equal(data, horn) {
+		t.Fatalf("DownloadSoundFile = %d bytes, %v", len(data), err)
+	}
+
+	if err := client.DeleteSoundFile(1, "F2_Bell.wav"); err != nil {
+		t.Fatalf("DeleteSoundFile: %v", err)
+	}
+	if err := client.ClearSoundSlot(3); err != nil {
+		t.Fatalf("ClearSoundSlot: %v", err)
+	}
+	if got := simulator.Files(); !slices.Equal(got, []string{"1/F1_Horn.wav"}) {
+		t.Fatalf("files = %v", got)
+	}
+}
+
+func TestRB23xx_ResumableUpload(t *testing.T) {
+	simulator, err := NewRB23xx(RB23xxOptions{})
+	if err != nil {
+		t.Fatalf("NewRB23xx: %v", err)
+	}
+	server := httptest.NewServer(simulator)
+	defer server.Close()
+	client := decoders.NewRailboxRB23xx(decoders.WithBaseURL(server.URL), decoders.WithResumableUploads(), decoders.WithUploadVerification())
+
+	data := make([]byte, 2*decoders.UPLOAD_CHUNK_SIZE+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	var offsets []int64
+	if err := client.UploadSoundFileResumable(1, "F5_Engine.wav", bytes.NewReader(data), int64(len(data)), 0, func(offset int64) {
+		offsets = append(offsets, offset)
+	}); err != nil {
+		t.Fatalf("UploadSoundFileResumable: %v", err)
+	}
+	if len(offsets) != 3 {
+		t.Fatalf("offsets = %v, want 3 chunks", offsets)
+	}
+	if stored, _ := simulator.File("1/F5_Engine.wav"); !bytes.Equal(stored, data) {
+		t.Fatalf("stored %d bytes, want %d", len(stored), len(data))
+	}
+
+	// an interrupted upload continues from the last chunk
+	if err := client.UploadSoundFileResumable(1, "F5_Engine.wav", bytes.NewReader(data), int64(len(data)), offsets[1], func(int64) {}); err != nil {
+		t.Fatalf("UploadSoundFileResumable from %d: %v", offsets[1], err)
+	}
+	if stored, _ := simulator.File("1/F5_Engine.wav"); !bytes.Equal(stored, data) {
+		t.Fatalf("stored %d bytes after resuming, want %d", len(stored), len(data))
+	}
+}
+
+func TestRB23xx_Storage(t *testing.T) {
+	_, client := startRB23xx(t, RB23xxOptions{CapacityKB: 8, Model: "RB2300", Firmware: "1.4.2"})
+
+	if err := client.UploadSoundFile(1, "F1_Horn.wav", bytes.NewReader(make([]byte, 6*1024))); err != nil {
+		t.Fatalf("UploadSoundFile: %v", err)
+	}
+	storage, err := client.Storage()
+	if err != nil || storage.Total != 8*1024 || storage.Used != 6*1024 {
+		t.Fatalf("Storage = %+v, %v", storage, err)
+	}
+	if err := client.UploadSoundFile(1, "F2_Bell.wav", bytes.NewReader(make([]byte, 4*1024))); err == nil {
+		t.Fatal("expected the upload to fail on a full decoder")
+	}
+
+	info, err := client.Info()
+	if err != nil || info.Model != "RB2300" || info.Firmware != "1.4.2" {
+		t.Fatalf("Info = %+v, %v", info, err)
+	}
+}
+
+func TestRB23xx_Dir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "2"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "2", "F3_Whistle.wav"), []byte("whistle"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, client := startRB23xx(t, RB23xxOptions{Dir: dir})
+	files, err := client.ListSoundSlot(2)
+	if err != nil || !slices.Equal(files, []decoders.RemoteFileInfo{{Name: "F3_Whistle.wav", SizeKB: 1}}) {
+		t.Fatalf("ListSoundSlot = %v, %v", files, err)
+	}
+	if err := client.UploadSoundFile(1, "F1_Horn.wav", strings.NewReader("horn")); err != nil {
+		t.Fatalf("UploadSoundFile: %v", err)
+	}
+	if err := client.DeleteSoundFile(2, "F3_Whistle.wav"); err != nil {
+		t.Fatalf("DeleteSoundFile: %v", err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, "1", "F1_Horn.wav")); err != nil || string(data) != "horn" {
+		t.Fatalf("stored file = %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2", "F3_Whistle.wav")); !os.IsNotExist(err) {
+		t.Fatalf("deleted file still on disk: %v", err)
+	}
+	// a restarted simulator finds the files again
+	restarted, err := NewRB23xx(RB23xxOptions{Dir: dir})
+	if err != nil || !slices.Equal(restarted.Files(), []string{"1/F1_Horn.wav"}) {
+		t.Fatalf("files after a restart = %v, %v", restarted.Files(), err)
+	}
+}
+
+func TestRB23xx_StreamedUpload(t *testing.T) {
+	simulator, err := NewRB23xx(RB23xxOptions{})
+	if err != nil {
+		t.Fatalf("NewRB23xx: %v", err)
+	}
+	// the first upload is refused, like by an overloaded decoder, and the lengths of the requests are recorded
+	var lengths []int64
+	refused := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/upload" {
+			lengths = append(lengths, r.ContentLength)
+			if !refused {
+				refused = true
+				_, _ = io.Copy(io.Discard, r.Body)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		simulator.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	client := decoders.NewRailboxRB23xx(decoders.WithBaseURL(server.URL), decoders.WithUploadVerification(),
+		decoders.WithRetryPolicy(decoders.RetryPolicy{Backoff: time.Millisecond}))
+
+	data := make([]byte, 3*decoders.VERIFY_BLOCK_SIZE+7)
+	for i := range data {
+		data[i] = byte(i % 253)
+	}
+	path := filepath.Join(t.TempDir(), "F1_Horn.wav")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := client.UploadSoundFile(1, "F1_Horn.wav", f); err != nil {
+		t.Fatalf("UploadSoundFile: %v", err)
+	}
+	// the file is sent whole, in the upload form, by both attempts
+	if len(lengths) != 2 || lengths[0] != lengths[1] || lengths[0] <= int64(len(data)) {
+		t.Fatalf("Content-Length of the attempts = %v, want the same length above %d twice", lengths, len(data))
+	}
+	if stored, _ := simulator.File("1/F1_Horn.wav"); !bytes.Equal(stored, data) {
+		t.Fatalf("stored %d bytes, want %d", len(stored), len(data))
+	}
+}
+
+func TestRB23xx_UploadForm(t *testing.T) {
+	simulator, err := NewRB23xx(RB23xxOptions{})
+	if err != nil {
+		t.Fatalf("NewRB23xx: %v", err)
+	}
+	// the form is read the way the firmware reads it, by its field and the name of the file
+	var fields, filenames []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/upload" {
+			body, _ := io.ReadAll(r.Body)
+			copied := r.Clone(r.Context())
+			copied.Body = io.NopCloser(bytes.NewReader(body))
+			if form, err := copied.MultipartReader(); err == nil {
+				for part, err := form.NextPart(); err == nil; part, err = form.NextPart() {
+					fields, filenames = append(fields, part.FormName()), append(filenames, part.FileName())
+				}
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		simulator.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	client := decoders.NewRailboxRB23xx(decoders.WithBaseURL(server.URL))
+
+	if err := client.UploadSoundFile(1, "F1_Horn.wav", strings.NewReader("horn")); err != nil {
+		t.Fatalf("UploadSoundFile: %v", err)
+	}
+	if err := client.UploadOutputMap([]byte("AUX1=F1\n")); err != nil {
+		t.Fatalf("UploadOutputMap: %v", err)
+	}
+	if !slices.Equal(fields, []string{decoders.UPLOAD_FORM_FIELD, decoders.UPLOAD_FORM_FIELD}) || !slices.Equal(filenames, []string{"F1_Horn.wav", decoders.OUTPUT_MAP_FILE}) {
+		t.Fatalf("form fields = %v, file names = %v", fields, filenames)
+	}
+	if stored, _ := simulator.File("1/F1_Horn.wav"); string(stored) != "horn" {
+		t.Fatalf("stored %q, want the file without the form", stored)
+	}
+
+	// a raw body, as sent by the older versions, is not a form
+	resp, err := http.Post(server.URL+"/upload?p=/1/F2_Bell.wav", "multipart/form-data", strings.NewReader("bell"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("raw upload answered with HTTP %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestRB23xx_CV(t *testing.T) {
+	simulator, client := startRB23xx(t, RB23xxOptions{CVs: map[uint16]int{1: 3}})
+
+	if value, err := client.ReadCV(1); err != nil || value != 3 {
+		t.Fatalf("ReadCV(1) = %d, %v", value, err)
+	}
+	if err := client.WriteCV(29, 34); err != nil {
+		t.Fatalf("WriteCV: %v", err)
+	}
+	if value, err := client.ReadCV(29); err != nil || value != 34 || simulator.CV(29) != 34 {
+		t.Fatalf("ReadCV(29) = %d, %v", value, err)
+	}
+	if err := client.WriteCV(29, 256); err == nil {
+		t.Fatal("expected a value above 255 to be refused")
+	}
+	if _, err := client.ReadCV(1025); err == nil {
+		t.Fatal("expected cv1025 to be refused")
+	}
+}
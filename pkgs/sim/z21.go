@@ -0,0 +1,438 @@
+// Package sim contains simulators of the hardware loco talks to, for demos, tests and reproducing bug reports.
+package sim
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+	"github.com/sirupsen/logrus"
+)
+
+// Z21Options describes the simulated layout
+type Z21Options struct {
+	// Locos are the addresses of the virtual locomotives
+	Locos []uint16
+	// ProgTrackLoco is the locomotive standing on the programming track, 0 means an empty programming track
+	ProgTrackLoco uint16
+	// NackRate is the probability (0-1) that a CV read or write on the programming track is not acknowledged
+	NackRate float64
+	// RailCom enables answers to POM reads, without it every POM read ends with LAN_X_CV_NACK
+	RailCom bool
+	// Seed makes the NACKs reproducible
+	Seed int64
+	// SerialNumber reported by LAN_GET_SERIAL_NUMBER
+	SerialNumber uint32
+	// XBusVersion reported by LAN_X_GET_VERSION, 0 means V3.0. Older versions do not know LAN_X_SET_LOCO_FUNCTION.
+	XBusVersion uint8
+	// LockedStart simulates a z21start without the activation code: it reports itself by LAN_GET_HWINFO
+	// and LAN_GET_CODE, and ignores CV commands over LAN
+	LockedStart bool
+}
+
+// Loco is the state of a virtual locomotive and its decoder
+type Loco struct {
+	CVs       map[uint16]byte
+	Steps     z21proto.SpeedSteps
+	Speed     uint8
+	Forward   bool
+	Functions z21proto.FunctionStates
+	// BinaryStates lists the binary states that are on
+	BinaryStates map[uint16]bool
+	// Owner is the client that drove the locomotive last, the others see it as busy
+	Owner string
+}
+
+func newLoco(addr uint16) *Loco {
+	l := &Loco{
+		CVs:     map[uint16]byte{1: byte(addr), 7: 1, 8: 13, 17: 192, 18: 0, 29: 6},
+		Steps:   z21proto.Steps128,
+		Forward: true,
+	}
+	if addr > 127 {
+		l.CVs[1] = 3
+		l.CVs[17] = byte(0xC0 | addr>>8)
+		l.CVs[18] = byte(addr)
+		l.CVs[29] = 6 | 0x20
+	}
+	return l
+}
+
+type z21Client struct {
+	addr  net.Addr
+	flags z21proto.BroadcastFlags
+	locos map[uint16]bool // subscribed by LAN_X_GET_LOCO_INFO
+}
+
+// Z21 is a fake Z21 command station speaking the LAN protocol over UDP
+type Z21 struct {
+	options Z21Options
+	conn    net.PacketConn
+
+	mu      sync.Mutex
+	locos   map[uint16]*Loco
+	clients map[string]*z21Client
+	state   z21proto.CentralState
+	random  *rand.Rand
+}
+
+// NewZ21 creates a simulator with the given virtual locomotives
+func NewZ21(options Z21Options) *Z21 {
+	s := &Z21{
+		options: options,
+		locos:   make(map[uint16]*Loco),
+		clients: make(map[string]*z21Client),
+		random:  rand.New(rand.NewSource(options.Seed)),
+	}
+	for _, addr := range options.Locos {
+		s.locos[addr] = newLoco(addr)
+	}
+	if options.ProgTrackLoco != 0 && s.locos[options.ProgTrackLoco] == nil {
+		s.locos[options.ProgTrackLoco] = newLoco(options.ProgTrackLoco)
+	}
+	return s
+}
+
+// Loco returns a copy of the state of the virtual locomotive, false when there is none. The simulator keeps
+// changing its own state while it serves, use SetCV to change a CV.
+func (s *Z21) Loco(addr uint16) (Loco, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.locos[addr]
+	if !ok {
+		return Loco{}, false
+	}
+	snapshot := *l
+	snapshot.CVs = make(map[uint16]byte, len(l.CVs))
+	for cv, value := range l.CVs {
+		snapshot.CVs[cv] = value
+	}
+	snapshot.BinaryStates = make(map[uint16]bool, len(l.BinaryStates))
+	for state, on := range l.BinaryStates {
+		snapshot.BinaryStates[state] = on
+	}
+	return snapshot, true
+}
+
+// SetCV changes a CV of the decoder of a virtual locomotive, false when there is no such locomotive
+func (s *Z21) SetCV(addr uint16, cv uint16, value byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.locos[addr]
+	if ok {
+		l.CVs[cv] = value
+	}
+	return ok
+}
+
+// Serve answers the clients until conn is closed
+func (s *Z21) Serve(conn net.PacketConn) error {
+	s.conn = conn
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		records, splitErr := z21proto.Split(buf[:n])
+		if splitErr != nil {
+			logrus.Debugf("sim: %s from %s", splitErr, addr)
+		}
+		for _, record := range records {
+			msg, decodeErr := z21proto.Decode(record)
+			if decodeErr != nil {
+				logrus.Debugf("sim: %s from %s", decodeErr, addr)
+				if errors.Is(decodeErr, z21proto.ErrUnknownMessage) {
+					s.reply(addr, z21proto.UnknownCommand{})
+				}
+				continue
+			}
+			logrus.Debugf("sim: %s: %s", addr, z21proto.Describe(msg))
+			s.handle(addr, msg)
+		}
+	}
+}
+
+func (s *Z21) reply(addr net.Addr, msg z21proto.Message) {
+	logrus.Debugf("sim: → %s: %s", addr, z21proto.Describe(msg))
+	if _, err := s.conn.WriteTo(msg.Encode(), addr); err != nil {
+		logrus.Warnf("sim: cannot reply to %s: %s", addr, err)
+	}
+}
+
+// broadcast sends msg to every client subscribed to flag
+func (s *Z21) broadcast(flag z21proto.BroadcastFlags, msg z21proto.Message) {
+	s.mu.Lock()
+	var targets []net.Addr
+	for _, c := range s.clients {
+		if c.flags&flag != 0 {
+			targets = append(targets, c.addr)
+		}
+	}
+	s.mu.Unlock()
+	for _, addr := range targets {
+		s.reply(addr, msg)
+	}
+}
+
+// broadcastLocoInfo informs the clients subscribed to the locomotive
+func (s *Z21) broadcastLocoInfo(addr uint16) {
+	s.mu.Lock()
+	infos := map[net.Addr]z21proto.LocoInfo{}
+	for _, c := range s.clients {
+		if c.flags&z21proto.BroadcastAllLocoInfo != 0 || (c.flags&z21proto.BroadcastDrivingSwitching != 0 && c.locos[addr]) {
+			infos[c.addr] = s.locoInfo(addr, c.addr)
+		}
+	}
+	s.mu.Unlock()
+	for target, info := range infos {
+		s.reply(target, info)
+	}
+}
+
+func (s *Z21) client(addr net.Addr) *z21Client {
+	c, ok := s.clients[addr.String()]
+	if !ok {
+		c = &z21Client{addr: addr, locos: make(map[uint16]bool)}
+		s.clients[addr.String()] = c
+	}
+	return c
+}
+
+// loco returns the locomotive for driving, unknown addresses are created like on a real layout where any address can be driven
+func (s *Z21) loco(addr uint16) *Loco {
+	l, ok := s.locos[addr]
+	if !ok {
+		l = newLoco(addr)
+		s.locos[addr] = l
+	}
+	return l
+}
+
+// locoInfo is the state of the locomotive as seen by the client, busy when another client drives it
+func (s *Z21) locoInfo(addr uint16, client net.Addr) z21proto.LocoInfo {
+	l := s.loco(addr)
+	busy := l.Owner != "" && l.Owner != client.String()
+	return z21proto.LocoInfo{Addr: addr, Busy: busy, Steps: l.Steps, Speed: l.Speed, Forward: l.Forward, Functions: l.Functions}
+}
+
+func (s *Z21) xBusVersion() uint8 {
+	if s.options.XBusVersion == 0 {
+		return 0x30
+	}
+	return s.options.XBusVersion
+}
+
+// nack decides if the next programming track operation fails
+func (s *Z21) nack() bool {
+	return s.options.NackRate > 0 && s.random.Float64() < s.options.NackRate
+}
+
+func (s *Z21) handle(addr net.Addr, msg z21proto.Message) {
+	s.mu.Lock()
+	c := s.client(addr)
+	s.mu.Unlock()
+
+	if s.options.LockedStart {
+		switch msg.(type) {
+		case z21proto.CVRead, z21proto.CVWrite, z21proto.MMWriteByte, z21proto.CVPomReadByte, z21proto.CVPomWriteByte:
+			return
+		}
+	}
+
+	switch m := msg.(type) {
+	case z21proto.GetSerialNumber:
+		s.reply(addr, z21proto.SerialNumber{Serial: s.options.SerialNumber})
+	case z21proto.GetHardwareInfo:
+		hardware := z21proto.HardwareZ21New
+		if s.options.LockedStart {
+			hardware = z21proto.HardwareZ21Start
+		}
+		s.reply(addr, z21proto.HardwareInfo{Type: hardware, Firmware: z21proto.FirmwareVersion{Major: 1, Minor: 43}})
+	case z21proto.GetCode:
+		lock := z21proto.FeatureNoLock
+		if s.options.LockedStart {
+			lock = z21proto.FeatureStartLocked
+		}
+		s.reply(addr, z21proto.Code{Lock: lock})
+	case z21proto.GetVersion:
+		s.reply(addr, z21proto.Version{XBusVersion: s.xBusVersion(), CommandStationID: 0x12})
+	case z21proto.GetFirmwareVersion:
+		s.reply(addr, z21proto.FirmwareVersion{Major: 1, Minor: 43})
+	case z21proto.GetStatus:
+		s.mu.Lock()
+		state := s.state
+		s.mu.Unlock()
+		s.reply(addr, z21proto.StatusChanged{Status: state})
+	case z21proto.SystemStateGetData:
+		s.reply(addr, s.systemState())
+	case z21proto.SetBroadcastFlags:
+		s.mu.Lock()
+		c.flags = m.Flags
+		s.mu.Unlock()
+	case z21proto.GetBroadcastFlags:
+		s.mu.Lock()
+		flags := c.flags
+		s.mu.Unlock()
+		s.reply(addr, z21proto.BroadcastFlagsInfo{Flags: flags})
+	case z21proto.Logoff:
+		s.mu.Lock()
+		delete(s.clients, addr.String())
+		s.mu.Unlock()
+
+	case z21proto.SetTrackPowerOn:
+		s.setState(0)
+		s.broadcast(z21proto.BroadcastDrivingSwitching, z21proto.TrackPowerOn{})
+	case z21proto.SetTrackPowerOff:
+		s.setState(z21proto.CsTrackVoltageOff)
+		s.broadcast(z21proto.BroadcastDrivingSwitching, z21proto.TrackPowerOff{})
+	case z21proto.SetStop:
+		s.setState(z21proto.CsEmergencyStop)
+		s.broadcast(z21proto.BroadcastDrivingSwitching, z21proto.Stopped{})
+
+	case z21proto.CVRead, z21proto.CVWrite, z21proto.MMWriteByte:
+		s.programmingTrack(addr, msg)
+	case z21proto.CVPomReadByte:
+		s.mu.Lock()
+		l, known := s.locos[m.Addr]
+		var value byte
+		if known {
+			value = l.CVs[m.CV]
+		}
+		s.mu.Unlock()
+		if !known || !s.options.RailCom {
+			s.reply(addr, z21proto.CVNack{})
+			return
+		}
+		s.reply(addr, z21proto.CVResult{CV: m.CV, Value: value})
+	case z21proto.CVPomWriteByte:
+		s.mu.Lock()
+		if l, known := s.locos[m.Addr]; known {
+			l.CVs[m.CV] = m.Value
+		}
+		s.mu.Unlock()
+
+	case z21proto.GetLocoInfo:
+		s.mu.Lock()
+		c.locos[m.Addr] = true
+		info := s.locoInfo(m.Addr, addr)
+		s.mu.Unlock()
+		s.reply(addr, info)
+	case z21proto.SetLocoDrive:
+		s.mu.Lock()
+		l := s.loco(m.Addr)
+		l.Steps, l.Speed, l.Forward = m.Steps, m.Speed, m.Forward
+		l.Owner = addr.String()
+		s.mu.Unlock()
+		s.broadcastLocoInfo(m.Addr)
+	case z21proto.SetLocoFunction:
+		if s.xBusVersion() < 0x30 {
+			s.reply(addr, z21proto.UnknownCommand{})
+			return
+		}
+		s.mu.Lock()
+		l := s.loco(m.Addr)
+		l.Owner = addr.String()
+		fn := int(m.Function)
+		switch m.Type {
+		case z21proto.FunctionOn:
+			l.Functions = l.Functions.Set(fn, true)
+		case z21proto.FunctionOff:
+			l.Functions = l.Functions.Set(fn, false)
+		case z21proto.FunctionToggle:
+			l.Functions = l.Functions.Set(fn, !l.Functions.Get(fn))
+		}
+		s.mu.Unlock()
+		s.broadcastLocoInfo(m.Addr)
+	case z21proto.SetLocoBinaryState:
+		s.mu.Lock()
+		l := s.loco(m.Addr)
+		if l.BinaryStates == nil {
+			l.BinaryStates = make(map[uint16]bool)
+		}
+		l.BinaryStates[m.State] = m.On
+		s.mu.Unlock()
+	case z21proto.SetLocoFunctionGroup:
+		s.mu.Lock()
+		l := s.loco(m.Addr)
+		l.Owner = addr.String()
+		for fn := 0; fn <= 31; fn++ {
+			if group, _ := z21proto.FunctionGroupOf(fn); group == m.Group {
+				l.Functions = l.Functions.Set(fn, m.Functions.Get(fn))
+			}
+		}
+		s.mu.Unlock()
+		s.broadcastLocoInfo(m.Addr)
+
+	case z21proto.GetTurnoutInfo:
+		s.reply(addr, z21proto.TurnoutInfo{Addr: m.Addr, Position: z21proto.TurnoutNotSwitched})
+	case z21proto.SetTurnout:
+		position := z21proto.TurnoutOutput1
+		if m.Output == 1 {
+			position = z21proto.TurnoutOutput2
+		}
+		s.broadcast(z21proto.BroadcastDrivingSwitching, z21proto.TurnoutInfo{Addr: m.Addr, Position: position})
+	case z21proto.RMBusGetData:
+		s.reply(addr, z21proto.RMBusDataChanged{Group: m.Group})
+	case z21proto.RMBusProgramModule:
+		// nothing is connected to the simulated R-BUS
+
+	default:
+		s.reply(addr, z21proto.UnknownCommand{})
+	}
+}
+
+// programmingTrack handles direct CV access, which switches the Z21 into the programming mode
+func (s *Z21) programmingTrack(addr net.Addr, msg z21proto.Message) {
+	s.setState(z21proto.CsProgrammingModeActive)
+	s.broadcast(z21proto.BroadcastDrivingSwitching, z21proto.ProgrammingMode{})
+
+	s.mu.Lock()
+	l, onTrack := s.locos[s.options.ProgTrackLoco]
+	failed := !onTrack || s.options.ProgTrackLoco == 0 || s.nack()
+	var result z21proto.CVResult
+	if !failed {
+		switch m := msg.(type) {
+		case z21proto.CVRead:
+			result = z21proto.CVResult{CV: m.CV, Value: l.CVs[m.CV]}
+		case z21proto.CVWrite:
+			l.CVs[m.CV] = m.Value
+			result = z21proto.CVResult{CV: m.CV, Value: m.Value}
+		case z21proto.MMWriteByte:
+			l.CVs[uint16(m.Register)] = m.Value
+			result = z21proto.CVResult{CV: uint16(m.Register), Value: m.Value}
+		}
+	}
+	s.mu.Unlock()
+
+	if failed {
+		s.reply(addr, z21proto.CVNack{})
+		return
+	}
+	s.reply(addr, result)
+}
+
+func (s *Z21) setState(state z21proto.CentralState) {
+	s.mu.Lock()
+	s.state = state
+	s.mu.Unlock()
+	s.broadcast(z21proto.BroadcastSystemState, s.systemState())
+}
+
+func (s *Z21) systemState() z21proto.SystemState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return z21proto.SystemState{
+		MainCurrent:   150,
+		Temperature:   35,
+		SupplyVoltage: 18000,
+		VCCVoltage:    16000,
+		CentralState:  s.state,
+		Capabilities:  z21proto.CapDCC | z21proto.CapMM | z21proto.CapRailCom | z21proto.CapLocoCmds | z21proto.CapAccessoryCmds | z21proto.CapDetectorCmds,
+	}
+}
@@ -0,0 +1,364 @@
+package sim
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keskad/loco/pkgs/commandstation"
+	"github.com/keskad/loco/pkgs/commandstation/z21proto"
+)
+
+func startZ21(t *testing.T, options Z21Options) (*Z21, *commandstation.Z21Roco) {
+	t.Helper()
+	simulator, conn := serveZ21(t, options)
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	client, err := commandstation.NewZ21Roco(commandstation.TransportUDP, "127.0.0.1", uint16(port), commandstation.Retries(0))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	client.Timeout = time.Second
+	t.Cleanup(func() { _ = client.CleanUp() })
+	return simulator, client
+}
+
+func TestZ21_ProgrammingTrack(t *testing.T) {
+	simulator, client := startZ21(t, Z21Options{Locos: []uint16{3}, ProgTrackLoco: 3})
+
+	lcv := commandstation.LocoCV{Cv: commandstation.CV{Num: 29, Value: 34}}
+	if err := client.WriteCV(commandstation.ProgrammingTrackMode, lcv, commandstation.Verify(true), commandstation.Settle(0)); err != nil {
+		t.Fatalf("WriteCV: %v", err)
+	}
+	value, err := client.ReadCV(commandstation.ProgrammingTrackMode, commandstation.LocoCV{Cv: commandstation.CV{Num: 1}})
+	if err != nil {
+		t.Fatalf("ReadCV: %v", err)
+	}
+	if value != 3 {
+		t.Fatalf("CV1 = %d, want 3", value)
+	}
+	if loco, _ := simulator.Loco(3); loco.CVs[29] != 34 {
+		t.Fatalf("simulated CV29 = %d, want 34", loco.CVs[29])
+	}
+}
+
+func TestZ21_NackAndRailCom(t *testing.T) {
+	_, client := startZ21(t, Z21Options{Locos: []uint16{3}, ProgTrackLoco: 3, NackRate: 1})
+
+	if _, err := client.ReadCV(commandstation.ProgrammingTrackMode, commandstation.LocoCV{Cv: commandstation.CV{Num: 1}}); err == nil {
+		t.Fatal("expected a NACK on the programming track")
+	}
+	// RailCom is off, so POM reads are not answered either
+	if _, err := client.ReadCV(commandstation.MainTrackMode, commandstation.LocoCV{LocoId: 3, Cv: commandstation.CV{Num: 1}}); err == nil {
+		t.Fatal("expected a NACK without RailCom")
+	}
+}
+
+func TestZ21_Driving(t *testing.T) {
+	_, client := startZ21(t, Z21Options{Locos: []uint16{1000}})
+
+	if err := client.SetSpeed(1000, 40, true, 128); err != nil {
+		t.Fatalf("SetSpeed: %v", err)
+	}
+	if err := client.SendFn(commandstation.MainTrackMode, 1000, 2, commandstation.FnOn); err != nil {
+		t.Fatalf("SendFn: %v", err)
+	}
+
+	speed, forward, err := client.GetSpeed(1000)
+	if err != nil {
+		t.Fatalf("GetSpeed: %v", err)
+	}
+	if speed != 40 || !forward {
+		t.Fatalf("GetSpeed = %d, %t, want 40, true", speed, forward)
+	}
+	functions, err := client.ListFunctions(1000)
+	if err != nil {
+		t.Fatalf("ListFunctions: %v", err)
+	}
+	if len(functions) != 1 || functions[0] != 2 {
+		t.Fatalf("ListFunctions = %v, want [2]", functions)
+	}
+
+	if err := client.SendFn(commandstation.MainTrackMode, 1000, 2, commandstation.FnToggle); err != nil {
+		t.Fatalf("SendFn: %v", err)
+	}
+	client.StateMaxAge = 0
+	functions, err = client.ListFunctions(1000)
+	if err != nil {
+		t.Fatalf("ListFunctions: %v", err)
+	}
+	if len(functions) != 0 {
+		t.Fatalf("ListFunctions after toggle = %v, want []", functions)
+	}
+}
+
+func TestZ21_StationState(t *testing.T) {
+	_, client := startZ21(t, Z21Options{Locos: []uint16{3}})
+
+	state, err := client.ReadStationState(time.Second)
+	if err != nil {
+		t.Fatalf("ReadStationState: %v", err)
+	}
+	if conditions := state.CentralState.Conditions(); len(conditions) != 0 {
+		t.Fatalf("unexpected conditions %v", conditions)
+	}
+	if known, ok := client.StationState(); !ok || known.LastSeen.IsZero() {
+		t.Fatalf("the state was not remembered: %+v", known)
+	}
+}
+
+func TestZ21_FunctionGroups(t *testing.T) {
+	sim, client := startZ21(t, Z21Options{Locos: []uint16{3}, XBusVersion: 0x23})
+
+	for _, fn := range []commandstation.FuncNum{0, 2, 14} {
+		if err := client.SendFn(commandstation.MainTrackMode, 3, fn, commandstation.FnOn); err != nil {
+			t.Fatalf("SendFn F%d: %v", fn, err)
+		}
+	}
+	if err := client.SendFn(commandstation.MainTrackMode, 3, 2, commandstation.FnToggle); err != nil {
+		t.Fatalf("SendFn: %v", err)
+	}
+
+	client.StateMaxAge = 0
+	functions, err := client.ListFunctions(3)
+	if err != nil {
+		t.Fatalf("ListFunctions: %v", err)
+	}
+	if len(functions) != 2 || functions[0] != 0 || functions[1] != 14 {
+		t.Fatalf("ListFunctions = %v, want [0 14]", functions)
+	}
+	if loco, _ := sim.Loco(3); len(loco.Functions.Active()) != 2 {
+		t.Fatalf("simulated functions = %v, want [0 14]", loco.Functions.Active())
+	}
+}
+
+func TestZ21_BinaryStates(t *testing.T) {
+	sim, client := startZ21(t, Z21Options{Locos: []uint16{3}})
+
+	if err := client.SendBinaryState(3, 200, true); err != nil {
+		t.Fatalf("SendBinaryState: %v", err)
+	}
+	if err := client.SendBinaryState(3, 0, true); err == nil {
+		t.Fatal("binary state 0 was accepted")
+	}
+	// answered after the binary state was handled
+	client.StateMaxAge = 0
+	if _, err := client.ListFunctions(3); err != nil {
+		t.Fatalf("ListFunctions: %v", err)
+	}
+	if loco, _ := sim.Loco(3); !loco.BinaryStates[200] {
+		t.Fatalf("binary state 200 is not on: %v", loco.BinaryStates)
+	}
+}
+
+func TestZ21_Takeover(t *testing.T) {
+	_, conn := serveZ21(t, Z21Options{Locos: []uint16{3}})
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	connect := func() *commandstation.Z21Roco {
+		client, err := commandstation.NewZ21Roco(commandstation.TransportUDP, "127.0.0.1", port, commandstation.Retries(0))
+		if err != nil {
+			t.Fatalf("connect: %v", err)
+		}
+		client.Timeout = time.Second
+		t.Cleanup(func() { _ = client.CleanUp() })
+		return client
+	}
+	app, client := connect(), connect()
+
+	// the smartphone app drives the locomotive
+	if err := app.SetSpeed(3, 20, true, 128); err != nil {
+		t.Fatalf("SetSpeed: %v", err)
+	}
+	if busy, err := client.ControlledElsewhere(3); err != nil || !busy {
+		t.Fatalf("ControlledElsewhere = %v, %v, want busy", busy, err)
+	}
+
+	// taken over
+	if err := client.SetSpeed(3, 0, true, 128); err != nil {
+		t.Fatalf("SetSpeed: %v", err)
+	}
+	if busy, _ := client.ControlledElsewhere(3); busy {
+		t.Fatal("still busy after the takeover")
+	}
+	app.StateMaxAge = 0
+	if busy, err := app.ControlledElsewhere(3); err != nil || !busy {
+		t.Fatalf("ControlledElsewhere for the previous owner = %v, %v, want busy", busy, err)
+	}
+}
+
+func TestZ21_Preflight(t *testing.T) {
+	simulator, client := startZ21(t, Z21Options{Locos: []uint16{3}})
+
+	if err := client.Preflight(commandstation.MainTrackMode, time.Second); err != nil {
+		t.Fatalf("Preflight: %v", err)
+	}
+	simulator.setState(z21proto.CsTrackVoltageOff)
+	if err := client.Preflight(commandstation.MainTrackMode, time.Second); err == nil || !strings.Contains(err.Error(), "track voltage off") {
+		t.Fatalf("Preflight without track power = %v", err)
+	}
+	if err := client.Preflight(commandstation.ProgrammingTrackMode, time.Second); err != nil {
+		t.Fatalf("Preflight on the programming track: %v", err)
+	}
+
+	// a station that never answers
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer silent.Close()
+	unreachable, err := commandstation.NewZ21Roco(commandstation.TransportUDP, "127.0.0.1", uint16(silent.LocalAddr().(*net.UDPAddr).Port))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer unreachable.CleanUp()
+	if err := unreachable.Preflight(commandstation.MainTrackMode, 100*time.Millisecond); !errors.Is(err, commandstation.ErrStationUnreachable) {
+		t.Fatalf("Preflight of a silent station = %v", err)
+	}
+}
+
+func TestZ21_LockedStart(t *testing.T) {
+	_, client := startZ21(t, Z21Options{Locos: []uint16{3}, ProgTrackLoco: 3, LockedStart: true})
+
+	status, err := client.ReadUnlockStatus(time.Second)
+	if err != nil || status.Hardware != z21proto.HardwareZ21Start || !status.Locked() {
+		t.Fatalf("ReadUnlockStatus = %+v, %v", status, err)
+	}
+	var notSupported *commandstation.ErrNotSupported
+	_, err = client.ReadCV(commandstation.ProgrammingTrackMode, commandstation.LocoCV{Cv: commandstation.CV{Num: 1}})
+	if !errors.As(err, &notSupported) || notSupported.Capability != commandstation.CapabilityLANProgramming {
+		t.Fatalf("ReadCV on a locked z21start = %v", err)
+	}
+	if err := client.Preflight(commandstation.ProgrammingTrackMode, time.Second); !errors.As(err, &notSupported) {
+		t.Fatalf("Preflight on a locked z21start = %v", err)
+	}
+}
+
+func serveZ21(t *testing.T, options Z21Options) (*Z21, net.PacketConn) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	simulator := NewZ21(options)
+	go func() { _ = simulator.Serve(conn) }()
+	return simulator, conn
+}
+
+func TestZ21_Failover(t *testing.T) {
+	// a station that never answers, e.g. switched off
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer silent.Close()
+	_, primary := serveZ21(t, Z21Options{Locos: []uint16{3}, ProgTrackLoco: 3})
+	backup, backupConn := serveZ21(t, Z21Options{Locos: []uint16{3}, ProgTrackLoco: 3})
+	backup.SetCV(3, 8, 99)
+
+	// unreachable at start: the first answering station is used
+	silentPort := silent.LocalAddr().(*net.UDPAddr).Port
+	client, err := commandstation.NewZ21RocoWithBackups(commandstation.TransportUDP, "127.0.0.1", uint16(silentPort),
+		[]string{backupConn.LocalAddr().String()}, commandstation.Retries(0))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	client.Timeout = 300 * time.Millisecond
+	if value, err := client.ReadCV(commandstation.ProgrammingTrackMode, commandstation.LocoCV{Cv: commandstation.CV{Num: 8}}); err != nil || value != 99 {
+		t.Fatalf("ReadCV after failover at start = %d, %v", value, err)
+	}
+	_ = client.CleanUp()
+
+	// stops answering mid-operation
+	primaryPort := primary.LocalAddr().(*net.UDPAddr).Port
+	client, err = commandstation.NewZ21RocoWithBackups(commandstation.TransportUDP, "127.0.0.1", uint16(primaryPort),
+		[]string{backupConn.LocalAddr().String()}, commandstation.Retries(0))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.CleanUp()
+	client.Timeout = 300 * time.Millisecond
+	if value, err := client.ReadCV(commandstation.ProgrammingTrackMode, commandstation.LocoCV{Cv: commandstation.CV{Num: 8}}); err != nil || value == 99 {
+		t.Fatalf("ReadCV from the primary = %d, %v", value, err)
+	}
+	_ = primary.Close()
+	if value, err := client.ReadCV(commandstation.ProgrammingTrackMode, commandstation.LocoCV{Cv: commandstation.CV{Num: 8}}); err != nil || value != 99 {
+		t.Fatalf("ReadCV after failover = %d, %v", value, err)
+	}
+}
+
+func TestZ21_FailoverConcurrent(t *testing.T) {
+	_, primary := serveZ21(t, Z21Options{Locos: []uint16{3}, ProgTrackLoco: 3})
+	backup, backupConn := serveZ21(t, Z21Options{Locos: []uint16{3}, ProgTrackLoco: 3})
+	backup.SetCV(3, 8, 99)
+	last, lastConn := serveZ21(t, Z21Options{Locos: []uint16{3}, ProgTrackLoco: 3})
+	last.SetCV(3, 8, 77)
+
+	primaryPort := primary.LocalAddr().(*net.UDPAddr).Port
+	client, err := commandstation.NewZ21RocoWithBackups(commandstation.TransportUDP, "127.0.0.1", uint16(primaryPort),
+		[]string{backupConn.LocalAddr().String(), lastConn.LocalAddr().String()}, commandstation.Retries(0))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.CleanUp()
+	client.Timeout = 300 * time.Millisecond
+
+	// two requests time out on the primary together, both go on with the backup and the last station is not used
+	_ = primary.Close()
+	read := make(chan error, 1)
+	go func() {
+		value, err := client.ReadCV(commandstation.ProgrammingTrackMode, commandstation.LocoCV{Cv: commandstation.CV{Num: 8}})
+		if err == nil && value != 99 {
+			err = errors.New("not read from the backup")
+		}
+		read <- err
+	}()
+	if _, err := client.FeedbackStatus(0); err != nil {
+		t.Fatalf("FeedbackStatus after failover: %v", err)
+	}
+	if err := <-read; err != nil {
+		t.Fatalf("ReadCV after failover: %v", err)
+	}
+	if value, err := client.ReadCV(commandstation.ProgrammingTrackMode, commandstation.LocoCV{Cv: commandstation.CV{Num: 8}}); err != nil || value != 99 {
+		t.Fatalf("ReadCV from the backup = %d, %v", value, err)
+	}
+}
+
+func TestZ21_FailoverWhileListening(t *testing.T) {
+	_, primary := serveZ21(t, Z21Options{Locos: []uint16{3}, ProgTrackLoco: 3})
+	backup, backupConn := serveZ21(t, Z21Options{Locos: []uint16{3}, ProgTrackLoco: 3})
+	backup.SetCV(3, 8, 99)
+
+	primaryPort := primary.LocalAddr().(*net.UDPAddr).Port
+	client, err := commandstation.NewZ21RocoWithBackups(commandstation.TransportUDP, "127.0.0.1", uint16(primaryPort),
+		[]string{backupConn.LocalAddr().String()}, commandstation.Retries(0))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.CleanUp()
+	client.Timeout = 300 * time.Millisecond
+
+	stop := make(chan struct{})
+	listened := make(chan error, 1)
+	go func() { listened <- client.Listen(stop) }()
+	if _, err := client.ReadCV(commandstation.ProgrammingTrackMode, commandstation.LocoCV{Cv: commandstation.CV{Num: 8}}); err != nil {
+		t.Fatalf("ReadCV from the primary: %v", err)
+	}
+
+	_ = primary.Close()
+	if value, err := client.ReadCV(commandstation.ProgrammingTrackMode, commandstation.LocoCV{Cv: commandstation.CV{Num: 8}}); err != nil || value != 99 {
+		t.Fatalf("ReadCV after failover = %d, %v", value, err)
+	}
+	// Listen goes on with the backup
+	select {
+	case err := <-listened:
+		t.Fatalf("Listen ended by the failover: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(stop)
+	if err := <-listened; err != nil {
+		t.Fatalf("Listen = %v", err)
+	}
+}
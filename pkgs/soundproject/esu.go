@@ -0,0 +1,83 @@
+package soundproject
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//
+// Context: a LokSound project exported by the ESU LokProgrammer, as a directory or packed into a .esux/.zip archive.
+// The export keeps the samples of every sound slot in a folder named after the slot, e.g. "Slot 04 - Horn".
+// The function mapping of the project is a LokProgrammer setting that is not exported, a folder may name its
+// function as "Slot 04 - Horn (F2)", otherwise the function is left to the importer.
+//
+
+var (
+	// reESUSlotDir matches the folder of a sound slot, e.g. "Slot 04 - Horn", "Sound slot 4 Horn" or "04_Horn"
+	reESUSlotDir = regexp.MustCompile(`(?i)^(?:sound[ _]*)?(?:slot[ _]*)?(\d{1,3})(?:[ _]*[-_.:][ _]*|[ _]+|$)(.*)$`)
+	// reESUFunction matches the function a folder names, e.g. "(F2)"
+	reESUFunction = regexp.MustCompile(`(?i)\s*\(F(\d+)\)\s*`)
+)
+
+// ReadESU reads an exported LokSound project, a directory or a .esux/.zip archive
+func ReadESU(projectPath string) (*Project, error) {
+	files, closeProject, err := listFiles(projectPath)
+	if err != nil {
+		return nil, err
+	}
+	defer closeProject()
+
+	project := &Project{Format: "esu"}
+	slots := map[int]*Slot{}
+	for _, file := range files {
+		if !strings.EqualFold(path.Ext(file.path), ".wav") {
+			project.Skipped = append(project.Skipped, file.path)
+			continue
+		}
+		number, name, function, ok := esuSlot(file.path)
+		if !ok {
+			project.Skipped = append(project.Skipped, file.path)
+			continue
+		}
+		data, err := file.read()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %q of the sound project: %w", file.path, err)
+		}
+		slot, exists := slots[number]
+		if !exists {
+			slot = &Slot{Number: number, Name: name, Function: function}
+			slots[number] = slot
+		}
+		slot.Samples = append(slot.Samples, Sample{Name: path.Base(file.path), Path: file.path, Data: data})
+	}
+	if len(slots) == 0 {
+		return nil, fmt.Errorf("no sound slots found in %q, the samples are expected in folders like \"Slot 04 - Horn\"", projectPath)
+	}
+	for _, slot := range slots {
+		project.Slots = append(project.Slots, *slot)
+	}
+	project.sortSlots()
+	return project, nil
+}
+
+// esuSlot finds the slot of a sample by the nearest folder named after a slot
+func esuSlot(filePath string) (number int, name string, function int, ok bool) {
+	dirs := strings.Split(path.Dir(filePath), "/")
+	for i := len(dirs) - 1; i >= 0; i-- {
+		m := reESUSlotDir.FindStringSubmatch(dirs[i])
+		if m == nil {
+			continue
+		}
+		number, _ = strconv.Atoi(m[1])
+		name, function = m[2], -1
+		if fm := reESUFunction.FindStringSubmatch(name); fm != nil {
+			function, _ = strconv.Atoi(fm[1])
+			name = reESUFunction.ReplaceAllString(name, " ")
+		}
+		return number, strings.TrimSpace(name), function, true
+	}
+	return 0, "", -1, false
+}
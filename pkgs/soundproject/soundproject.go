@@ -0,0 +1,113 @@
+// Package soundproject reads the sound projects of other decoder manufacturers, so their samples can be
+// laid out as a sound directory of a Railbox decoder.
+package soundproject
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Project is the content of a sound project, its samples grouped by the sound slot that plays them
+type Project struct {
+	// Format is the format the project was read from, e.g. "esu"
+	Format string
+	Slots  []Slot
+	// Skipped are the files of the project that are not samples of a slot
+	Skipped []string
+}
+
+// Slot is a sound slot of the project, a sound played by the decoder, made of one or more samples
+type Slot struct {
+	Number int
+	Name   string
+	// Function is the function that plays the slot, -1 when the project does not tell
+	Function int
+	Samples  []Sample
+}
+
+// Sample is an audio file of a slot
+type Sample struct {
+	// Name is the file name in the project, e.g. "horn_start.wav"
+	Name string
+	// Path is where the file is in the project, with forward slashes
+	Path string
+	Data []byte
+}
+
+// Samples returns the number of samples in all slots
+func (p *Project) Samples() int {
+	count := 0
+	for _, slot := range p.Slots {
+		count += len(slot.Samples)
+	}
+	return count
+}
+
+// sortSlots orders the slots by number and their samples by name
+func (p *Project) sortSlots() {
+	sort.Slice(p.Slots, func(i, j int) bool { return p.Slots[i].Number < p.Slots[j].Number })
+	for _, slot := range p.Slots {
+		sort.Slice(slot.Samples, func(i, j int) bool { return slot.Samples[i].Path < slot.Samples[j].Path })
+	}
+	sort.Strings(p.Skipped)
+}
+
+// projectFile is a file of a project, in a directory or in a ZIP archive
+type projectFile struct {
+	path string
+	read func() ([]byte, error)
+}
+
+// listFiles returns the files of a project directory, or of a project packed in a ZIP archive
+func listFiles(projectPath string) ([]projectFile, func() error, error) {
+	info, err := os.Stat(projectPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot open the sound project: %w", err)
+	}
+	if info.IsDir() {
+		var files []projectFile
+		err := filepath.WalkDir(projectPath, func(filePath string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(projectPath, filePath)
+			if err != nil {
+				return err
+			}
+			files = append(files, projectFile{path: filepath.ToSlash(rel), read: func() ([]byte, error) { return os.ReadFile(filePath) }})
+			return nil
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read the sound project: %w", err)
+		}
+		return files, func() error { return nil }, nil
+	}
+
+	archive, err := zip.OpenReader(projectPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot open the sound project %q as an archive: %w", filepath.Base(projectPath), err)
+	}
+	var files []projectFile
+	for _, entry := range archive.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		entry := entry
+		files = append(files, projectFile{path: path.Clean(strings.ReplaceAll(entry.Name, "\\", "/")), read: func() ([]byte, error) {
+			r, err := entry.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return io.ReadAll(r)
+		}})
+	}
+	return files, archive.Close, nil
+}
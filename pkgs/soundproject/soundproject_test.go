@@ -0,0 +1,107 @@
+package soundproject
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/keskad/loco/pkgs/audio"
+)
+
+// esuExport is the content of an exported LokSound project
+var esuExport = map[string]string{
+	"BR218/Slot 01 - Diesel/start.wav":    "start",
+	"BR218/Slot 01 - Diesel/loop.wav":     "loop",
+	"BR218/Slot 04 - Horn (F2)/horn.wav":  "horn",
+	"BR218/Sound slot 12 Brake/brake.WAV": "brake",
+	"BR218/readme.txt":                    "notes",
+	"BR218/Scripts/extra.wav":             "unassigned",
+}
+
+func TestReadESU_Archive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "BR218.esux")
+	file, err := os.Create(path)
+	assert.NoError(t, err)
+	archive := zip.NewWriter(file)
+	for name, content := range esuExport {
+		w, err := archive.Create(name)
+		assert.NoError(t, err)
+		_, _ = w.Write([]byte(content))
+	}
+	assert.NoError(t, archive.Close())
+	assert.NoError(t, file.Close())
+
+	project, err := ReadESU(path)
+	assert.NoError(t, err)
+	assertESUProject(t, project)
+}
+
+func TestReadESU_Directory(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range esuExport {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+
+	project, err := ReadESU(dir)
+	assert.NoError(t, err)
+	assertESUProject(t, project)
+
+	_, err = ReadESU(filepath.Join(dir, "BR218", "Scripts"))
+	assert.ErrorContains(t, err, "no sound slots found")
+}
+
+func assertESUProject(t *testing.T, project *Project) {
+	t.Helper()
+	assert.Equal(t, "esu", project.Format)
+	assert.Len(t, project.Slots, 3)
+	assert.Equal(t, 4, project.Samples())
+
+	diesel := project.Slots[0]
+	assert.Equal(t, 1, diesel.Number)
+	assert.Equal(t, "Diesel", diesel.Name)
+	assert.Equal(t, -1, diesel.Function)
+	assert.Equal(t, []string{"loop.wav", "start.wav"}, []string{diesel.Samples[0].Name, diesel.Samples[1].Name})
+	assert.Equal(t, "loop", string(diesel.Samples[0].Data))
+
+	assert.Equal(t, Slot{Number: 4, Name: "Horn", Function: 2, Samples: []Sample{{Name: "horn.wav", Path: "BR218/Slot 04 - Horn (F2)/horn.wav", Data: []byte("horn")}}}, project.Slots[1])
+	assert.Equal(t, 12, project.Slots[2].Number)
+	assert.Equal(t, "Brake", project.Slots[2].Name)
+	assert.Equal(t, []string{"BR218/Scripts/extra.wav", "BR218/readme.txt"}, project.Skipped)
+}
+
+func TestReadZimo(t *testing.T) {
+	var horn, bell bytes.Buffer
+	assert.NoError(t, audio.WriteWAV(&horn, &audio.Clip{SampleRate: 22050, Samples: [][]float64{make([]float64, 50)}}, 16))
+	assert.NoError(t, audio.WriteWAV(&bell, &audio.Clip{SampleRate: 11025, Samples: [][]float64{make([]float64, 20)}}, 8))
+	var container bytes.Buffer
+	container.WriteString("ZIMO-SP\x00\x01\x02RIFF-not-a-wave")
+	container.WriteString("\x00\x00Pfiff_kurz.wav\x00\x10")
+	container.Write(horn.Bytes())
+	container.WriteString("\x00\x00\x00")
+	container.Write(bell.Bytes())
+	path := filepath.Join(t.TempDir(), "BR218.zpp")
+	assert.NoError(t, os.WriteFile(path, container.Bytes(), 0o644))
+
+	project, err := ReadZimo(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "zimo", project.Format)
+	assert.Len(t, project.Slots, 2)
+	assert.Equal(t, "Pfiff_kurz", project.Slots[0].Name)
+	assert.Equal(t, -1, project.Slots[0].Function)
+	assert.Equal(t, horn.Bytes(), project.Slots[0].Samples[0].Data)
+	assert.Equal(t, "sample_002.wav", project.Slots[1].Samples[0].Name, "the name of the first sample is not reused")
+	assert.Equal(t, bell.Bytes(), project.Slots[1].Samples[0].Data)
+
+	assert.NoError(t, os.WriteFile(path, container.Bytes()[:container.Len()-10], 0o644))
+	_, err = ReadZimo(path)
+	assert.ErrorContains(t, err, "sample 2 of \"BR218.zpp\" is truncated")
+
+	assert.NoError(t, os.WriteFile(path, []byte("ZIMO-SP"), 0o644))
+	_, err = ReadZimo(path)
+	assert.ErrorContains(t, err, "no WAV samples found")
+}
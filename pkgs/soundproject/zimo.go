@@ -0,0 +1,77 @@
+package soundproject
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+//
+// Context: a ZIMO sound project, a .zpp file loaded into MX decoders by ZIRC or the MXULF. The layout of the container
+// is not published. The samples are kept in it as complete WAV files, so they are found by their RIFF headers,
+// in the order they are stored. The name of a sample precedes its data in the sample table, the schedules
+// assigning the samples to functions are not read.
+//
+
+// zimoNameWindow is how far before a sample its name is looked for
+const zimoNameWindow = 256
+
+// reZimoSampleName matches the name of a sample in the sample table, e.g. "Pfiff_kurz.wav"
+var reZimoSampleName = regexp.MustCompile(`(?i)[A-Za-z0-9 _\-.()]{1,64}\.wav`)
+
+// ReadZimo reads the samples embedded in a ZIMO .zpp sound project, every sample is a slot of its own
+func ReadZimo(projectPath string) (*Project, error) {
+	data, err := os.ReadFile(projectPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the sound project: %w", err)
+	}
+
+	project := &Project{Format: "zimo"}
+	previousEnd := 0
+	for offset := 0; ; {
+		start := bytes.Index(data[offset:], []byte("RIFF"))
+		if start < 0 {
+			break
+		}
+		start += offset
+		offset = start + 4
+		if start+12 > len(data) || string(data[start+8:start+12]) != "WAVE" {
+			continue
+		}
+		end := start + 8 + int(binary.LittleEndian.Uint32(data[start+4:start+8]))
+		if end > len(data) || end < start+12 {
+			return nil, fmt.Errorf("sample %d of %q is truncated at offset %d", len(project.Slots)+1, filepath.Base(projectPath), start)
+		}
+
+		number := len(project.Slots) + 1
+		// the name is not looked for in the previous sample
+		name := zimoSampleName(data[max(previousEnd, start-zimoNameWindow):start])
+		if name == "" {
+			name = fmt.Sprintf("sample_%03d.wav", number)
+		}
+		project.Slots = append(project.Slots, Slot{
+			Number:   number,
+			Name:     strings.TrimSuffix(name, filepath.Ext(name)),
+			Function: -1,
+			Samples:  []Sample{{Name: name, Path: fmt.Sprintf("%s@%d", name, start), Data: data[start:end]}},
+		})
+		offset, previousEnd = end, end
+	}
+	if len(project.Slots) == 0 {
+		return nil, fmt.Errorf("no WAV samples found in %q, the samples of this project are not stored as WAV files", filepath.Base(projectPath))
+	}
+	return project, nil
+}
+
+// zimoSampleName returns the last sample name in the bytes before a sample
+func zimoSampleName(before []byte) string {
+	names := reZimoSampleName.FindAll(before, -1)
+	if len(names) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(string(names[len(names)-1]))
+}
@@ -5,34 +5,179 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/sirupsen/logrus"
 )
 
 type CVEntry struct {
 	Number uint16
 	Value  uint16
+	// Assert marks an assertion "cv8==145", the decoder is expected to hold the value and it is never written
+	Assert bool
+	// Modify marks a read-modify-write "cv29|=0x04" or "cv29&=~0x10": the bits of Value are set and the bits
+	// of Clear cleared in the value the decoder holds, see Apply
+	Modify bool
+	Clear  uint16
+}
+
+// Apply returns the value written for the entry into a CV holding current
+func (e CVEntry) Apply(current uint16) uint16 {
+	if !e.Modify {
+		return e.Value
+	}
+	return current&^e.Clear | e.Value
+}
+
+// ParseOption customizes the behaviour of ParseCVString
+type ParseOption func(*parseOptions)
+
+type parseOptions struct {
+	strict        bool
+	assertions    bool
+	modifications bool
+	includeDir    string
+	readCV        func(cv uint16) (int, error)
+	position      func(pos int) string
+}
+
+// Strict makes ParseCVString fail when the same CV is defined more than once with different values.
+// When not strict, the last definition wins and a warning is logged.
+func Strict(strict bool) ParseOption {
+	return func(o *parseOptions) {
+		o.strict = strict
+	}
+}
+
+// Assertions allows the assertions "cv8==145" in the input, otherwise they are an error
+func Assertions(allowed bool) ParseOption {
+	return func(o *parseOptions) {
+		o.assertions = allowed
+	}
+}
+
+// Modifications allows the read-modify-writes "cv29|=0x04" and "cv29&=~0x10" in the input, otherwise they are an error
+func Modifications(allowed bool) ParseOption {
+	return func(o *parseOptions) {
+		o.modifications = allowed
+	}
+}
+
+// Positions names the positions of the entries in the errors instead of "entry <pos>" or "line <pos>",
+// e.g. the lines of a file joined into a single input
+func Positions(position func(pos int) string) ParseOption {
+	return func(o *parseOptions) {
+		o.position = position
+	}
+}
+
+// DuplicateCVError describes a CV that was defined twice with different values
+type DuplicateCVError struct {
+	Number        uint16
+	PreviousValue uint16
+	PreviousPos   int
+	Value         uint16
+	Pos           int
+	// Unit is "line" or "entry" depending on the separator used
+	Unit string
+	// PreviousAt and At name the positions when Positions was given
+	PreviousAt string
+	At         string
 }
 
-// ParseCVString parses input string to array of CVEntry (CV number and value)
-func ParseCVString(input string, separator string) ([]CVEntry, error) {
+func (e *DuplicateCVError) Error() string {
+	previous, at := e.PreviousAt, e.At
+	if previous == "" {
+		previous = fmt.Sprintf("%s %d", e.Unit, e.PreviousPos)
+	}
+	if at == "" {
+		at = fmt.Sprintf("%s %d", e.Unit, e.Pos)
+	}
+	return fmt.Sprintf("conflicting values for cv%d: %d (%s) and %d (%s)", e.Number, e.PreviousValue, previous, e.Value, at)
+}
+
+// ParseCVString parses input string to array of CVEntry (CV number and value). The input may define variables
+// "$addr=3", include other files "@include common.cv" and hold conditional blocks "@if cv8==145", see expandCVLines.
+func ParseCVString(input string, separator string, options ...ParseOption) ([]CVEntry, error) {
 	if separator == "" {
 		separator = "\n"
 	}
+	opts := parseOptions{}
+	for _, option := range options {
+		option(&opts)
+	}
+	if read := opts.readCV; read != nil {
+		// the conditions of a file read the same identity CVs again and again
+		values := map[uint16]int{}
+		opts.readCV = func(cv uint16) (int, error) {
+			if value, ok := values[cv]; ok {
+				return value, nil
+			}
+			value, err := read(cv)
+			if err == nil {
+				values[cv] = value
+			}
+			return value, err
+		}
+	}
+	unit := "entry"
+	if separator == "\n" {
+		unit = "line"
+	}
+	at := func(pos int) string {
+		if opts.position != nil {
+			return opts.position(pos)
+		}
+		return fmt.Sprintf("%s %d", unit, pos)
+	}
 
+	// an assertion and a value of the same CV do not conflict, e.g. "cv29==6" before "cv29=34"
+	type key struct {
+		num    uint16
+		assert bool
+	}
 	var result []CVEntry
-	unique := make(map[uint16]uint16)
-	lines := strings.Split(input, separator)
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	unique := make(map[key]uint16)
+	definedAt := make(map[key]int)
+	// the modifications of a CV are combined in their order, "cv29|=0x14, cv29&=~0x10" sets only 0x04
+	modified := make(map[uint16]CVEntry)
+	assert := false
+	define := func(num uint16, val uint16, pos int) error {
+		k := key{num, assert}
+		if prev, exists := unique[k]; exists && prev != val {
+			conflict := &DuplicateCVError{Number: num, PreviousValue: prev, PreviousPos: definedAt[k], Value: val, Pos: pos, Unit: unit}
+			if opts.position != nil {
+				conflict.PreviousAt, conflict.At = at(definedAt[k]), at(pos)
+			}
+			if opts.strict {
+				return conflict
+			}
+			logrus.Warnf("%s, the last one wins", conflict)
 		}
-		// remove inline comment
-		if idx := strings.Index(line, "#"); idx != -1 {
-			line = strings.TrimSpace(line[:idx])
+		if _, exists := modified[num]; exists && !assert {
+			return fmt.Errorf("cv%d is both written and modified (%s), write its value or change its bits", num, at(pos))
 		}
-		if line == "" {
-			continue
+		unique[k] = val
+		definedAt[k] = pos
+		return nil
+	}
+	modify := func(num uint16, set uint16, clear uint16, pos int) error {
+		if _, exists := unique[key{num, false}]; exists {
+			return fmt.Errorf("cv%d is both written and modified (%s), write its value or change its bits", num, at(pos))
 		}
+		entry := modified[num]
+		entry.Value = entry.Value&^clear | set
+		entry.Clear |= clear
+		modified[num] = entry
+		return nil
+	}
+
+	// the comments are removed, the variables substituted and the includes expanded, see expandCVLines
+	lines, err := expandCVLines(input, separator, opts, map[string]string{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range lines {
+		pos, line := l.pos, l.text
 
 		var cvNum, cvVal string
 		parts := strings.SplitN(line, "=", 2)
@@ -43,6 +188,29 @@ func ParseCVString(input string, separator string) ([]CVEntry, error) {
 			cvNum = strings.TrimSpace(line)
 			cvVal = "0" // default value when no value is provided
 		}
+		// "cv29|=0x04" sets bits, "cv29&=~0x10" clears them
+		var set, clear uint16
+		operator := ""
+		if strings.HasSuffix(cvNum, "|") || strings.HasSuffix(cvNum, "&") {
+			operator = cvNum[len(cvNum)-1:]
+			cvNum = strings.TrimSpace(cvNum[:len(cvNum)-1])
+			if !opts.modifications {
+				return nil, fmt.Errorf("the modification %q cannot be used here, it is applied by \"loco cv set\"", line)
+			}
+			if set, clear, err = parseModification(operator, cvVal); err != nil {
+				return nil, err
+			}
+		}
+		// "cv8==145" asserts the value
+		assert = strings.HasPrefix(cvVal, "=") && operator == ""
+		if assert {
+			if !opts.assertions {
+				return nil, fmt.Errorf("the assertion %q cannot be used here, it is checked by \"loco cv check\" and \"loco cv apply\"", line)
+			}
+			if cvVal = strings.TrimSpace(cvVal[1:]); cvVal == "" {
+				return nil, fmt.Errorf("the assertion %q has no value", line)
+			}
+		}
 
 		// Support ranges cvX-cvY
 		cvNumLower := strings.ToLower(cvNum)
@@ -55,12 +223,22 @@ func ParseCVString(input string, separator string) ([]CVEntry, error) {
 			if err1 != nil || err2 != nil || startNum > endNum {
 				return nil, fmt.Errorf("invalid CV range: %s", cvNum)
 			}
-			val, err := strconv.ParseUint(cvVal, 10, 16)
+			if operator != "" {
+				for i := uint16(startNum); i <= uint16(endNum); i++ {
+					if err := modify(i, set, clear, pos); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+			values, err := rangeValues(cvVal, int(endNum-startNum)+1)
 			if err != nil {
-				return nil, fmt.Errorf("invalid CV value: %s", cvVal)
+				return nil, err
 			}
 			for i := uint16(startNum); i <= uint16(endNum); i++ {
-				unique[i] = uint16(val)
+				if err := define(i, values[i-uint16(startNum)], pos); err != nil {
+					return nil, err
+				}
 			}
 			continue
 		}
@@ -71,22 +249,137 @@ func ParseCVString(input string, separator string) ([]CVEntry, error) {
 		if err != nil {
 			return nil, fmt.Errorf("invalid CV number: %s", cvNum)
 		}
+		if operator != "" {
+			if err := modify(uint16(num), set, clear, pos); err != nil {
+				return nil, err
+			}
+			continue
+		}
 
 		// Parse value
-		val, err := strconv.ParseUint(cvVal, 10, 16)
+		val, err := ParseCVValue(cvVal)
 		if err != nil {
-			return nil, fmt.Errorf("invalid CV value: %s", cvVal)
+			return nil, err
 		}
 
-		unique[uint16(num)] = uint16(val)
+		if err := define(uint16(num), val, pos); err != nil {
+			return nil, err
+		}
 	}
 
 	for k, v := range unique {
-		result = append(result, CVEntry{Number: k, Value: v})
+		result = append(result, CVEntry{Number: k.num, Value: v, Assert: k.assert})
 	}
-	// Sort result by CVEntry.Number
+	for num, entry := range modified {
+		result = append(result, CVEntry{Number: num, Value: entry.Value, Modify: true, Clear: entry.Clear})
+	}
+	// Sort result by CVEntry.Number, the assertion of a CV before its value
 	sort.Slice(result, func(i, j int) bool {
-		return result[i].Number < result[j].Number
+		if result[i].Number != result[j].Number {
+			return result[i].Number < result[j].Number
+		}
+		return result[i].Assert
 	})
 	return result, nil
 }
+
+// parseModification returns the bits set and cleared by "|=mask", "&=~mask" or "&=mask" (the bits outside
+// of the mask are cleared)
+func parseModification(operator, raw string) (set uint16, clear uint16, err error) {
+	inverted := operator == "&" && strings.HasPrefix(raw, "~")
+	if inverted {
+		raw = strings.TrimSpace(raw[1:])
+	}
+	mask, err := ParseCVValue(raw)
+	if err != nil {
+		return 0, 0, err
+	}
+	if mask > 255 {
+		return 0, 0, fmt.Errorf("invalid bit mask: %s exceeds 8 bits", raw)
+	}
+	switch {
+	case operator == "|":
+		return mask, 0, nil
+	case inverted:
+		return 0, mask, nil
+	}
+	return 0, ^mask & 0xFF, nil
+}
+
+// rangeValues are the values of the count CVs of a range: a single value for all of them, an evenly spaced
+// series "10..255" from the first to the last CV, or a series stepping by "+9" from the step, "4+9" from 4
+func rangeValues(raw string, count int) ([]uint16, error) {
+	values := make([]uint16, count)
+	if from, to, ok := strings.Cut(raw, ".."); ok {
+		first, err1 := ParseCVValue(strings.TrimSpace(from))
+		last, err2 := ParseCVValue(strings.TrimSpace(to))
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid CV series: %s", raw)
+		}
+		for i := range values {
+			// rounded to the nearest value, the series ends exactly at its last value
+			spaced := float64(first)
+			if count > 1 {
+				spaced += (float64(last) - float64(first)) * float64(i) / float64(count-1)
+			}
+			values[i] = uint16(spaced + 0.5)
+		}
+		return values, nil
+	}
+	if from, step, ok := strings.Cut(raw, "+"); ok {
+		increment, err := ParseCVValue(strings.TrimSpace(step))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CV series: %s", raw)
+		}
+		first := increment
+		if strings.TrimSpace(from) != "" {
+			if first, err = ParseCVValue(strings.TrimSpace(from)); err != nil {
+				return nil, fmt.Errorf("invalid CV series: %s", raw)
+			}
+		}
+		for i := range values {
+			value := int(first) + i*int(increment)
+			if value > 255 {
+				return nil, fmt.Errorf("invalid CV series: %s exceeds 255 at its %d. CV", raw, i+1)
+			}
+			values[i] = uint16(value)
+		}
+		return values, nil
+	}
+	val, err := ParseCVValue(raw)
+	if err != nil {
+		return nil, err
+	}
+	for i := range values {
+		values[i] = val
+	}
+	return values, nil
+}
+
+// ParseCVValue parses a decimal value, a hexadecimal "0x2E" or a binary "0b00101110". The bits of a binary
+// value can be grouped with underscores, e.g. "0b0010_1110". A leading zero is decimal, "017" is 17.
+func ParseCVValue(raw string) (uint16, error) {
+	digits, base := raw, 10
+	switch lower := strings.ToLower(raw); {
+	case strings.HasPrefix(lower, "0x"):
+		digits, base = raw[2:], 16
+	case strings.HasPrefix(lower, "0b"):
+		digits, base = strings.ReplaceAll(raw[2:], "_", ""), 2
+	}
+	val, err := strconv.ParseUint(digits, base, 16)
+	if err != nil || digits == "" {
+		return 0, fmt.Errorf("invalid CV value: %s", raw)
+	}
+	return uint16(val), nil
+}
+
+// FormatCVValue prints a value in the base 10, 16 ("0x2E") or 2 ("0b00101110", all eight bits)
+func FormatCVValue(value int, base int) string {
+	switch base {
+	case 16:
+		return fmt.Sprintf("0x%02X", value)
+	case 2:
+		return fmt.Sprintf("0b%08b", value)
+	}
+	return strconv.Itoa(value)
+}
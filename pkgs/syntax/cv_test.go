@@ -1,6 +1,9 @@
 package syntax
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -186,6 +189,74 @@ func TestParseCVString(t *testing.T) {
 			},
 			separator: ",",
 		},
+		{
+			name:  "hexadecimal and binary values",
+			input: "cv29=0x2E, cv33=0B00101110, cv34=0b0000_0100, cv35=0xff, cv1=017",
+			expected: []CVEntry{
+				{Number: 1, Value: 17},
+				{Number: 29, Value: 46},
+				{Number: 33, Value: 46},
+				{Number: 34, Value: 4},
+				{Number: 35, Value: 255},
+			},
+			separator: ",",
+		},
+		{
+			name:  "cv range with hexadecimal value",
+			input: "cv1-cv2=0x10",
+			expected: []CVEntry{
+				{Number: 1, Value: 16},
+				{Number: 2, Value: 16},
+			},
+			separator: "",
+		},
+		{
+			name:  "cv range with an evenly spaced series",
+			input: "cv67-70=10..255",
+			expected: []CVEntry{
+				{Number: 67, Value: 10},
+				{Number: 68, Value: 92},
+				{Number: 69, Value: 173},
+				{Number: 70, Value: 255},
+			},
+			separator: "",
+		},
+		{
+			name:  "cv range with a step",
+			input: "cv67-cv69=+9, cv1-2=4+0x10",
+			expected: []CVEntry{
+				{Number: 1, Value: 4},
+				{Number: 2, Value: 20},
+				{Number: 67, Value: 9},
+				{Number: 68, Value: 18},
+				{Number: 69, Value: 27},
+			},
+			separator: ",",
+		},
+		{
+			name:      "cv range with a step beyond 255",
+			input:     "cv67-94=+10",
+			separator: "",
+			wantErr:   true,
+		},
+		{
+			name:      "invalid series",
+			input:     "cv67-94=10..x",
+			separator: "",
+			wantErr:   true,
+		},
+		{
+			name:      "invalid binary value",
+			input:     "cv29=0b102",
+			separator: "",
+			wantErr:   true,
+		},
+		{
+			name:      "hexadecimal prefix without digits",
+			input:     "cv29=0x",
+			separator: "",
+			wantErr:   true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -201,3 +272,224 @@ func TestParseCVString(t *testing.T) {
 		})
 	}
 }
+
+func TestParseCVStringStrict(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		separator string
+		wantErr   bool
+		errPos    []int
+	}{
+		{name: "conflicting duplicate", input: "CV1=2\nCV2=5\nCV1=3", wantErr: true, errPos: []int{1, 3}},
+		{name: "identical duplicate is allowed", input: "CV1=2\nCV1=2"},
+		{name: "range overlapping a single cv", input: "cv5=1, cv1-cv10=0", separator: ",", wantErr: true, errPos: []int{1, 2}},
+		{name: "no duplicates", input: "cv1=3, cv2=4", separator: ","},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseCVString(tt.input, tt.separator, Strict(true))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCVString() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				return
+			}
+			var dupErr *DuplicateCVError
+			if !errors.As(err, &dupErr) {
+				t.Fatalf("ParseCVString() error = %T, want *DuplicateCVError", err)
+			}
+			if dupErr.PreviousPos != tt.errPos[0] || dupErr.Pos != tt.errPos[1] {
+				t.Errorf("conflict positions = %d, %d, want %d, %d", dupErr.PreviousPos, dupErr.Pos, tt.errPos[0], tt.errPos[1])
+			}
+		})
+	}
+}
+
+func TestParseCVStringAssertions(t *testing.T) {
+	entries, err := ParseCVString("cv8==145\ncv29 == 0x06\ncv29=34\ncv1-cv2==3", "\n", Strict(true), Assertions(true))
+	if err != nil {
+		t.Fatalf("ParseCVString() error = %v", err)
+	}
+	expected := []CVEntry{
+		{Number: 1, Value: 3, Assert: true},
+		{Number: 2, Value: 3, Assert: true},
+		{Number: 8, Value: 145, Assert: true},
+		{Number: 29, Value: 6, Assert: true},
+		{Number: 29, Value: 34},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("ParseCVString() = %v, want %v", entries, expected)
+	}
+
+	if _, err := ParseCVString("cv8==145, cv8==151", ",", Strict(true), Assertions(true)); err == nil {
+		t.Error("conflicting assertions should fail in strict mode")
+	}
+	if _, err := ParseCVString("cv8==", ",", Assertions(true)); err == nil {
+		t.Error("an assertion without a value should fail")
+	}
+	if _, err := ParseCVString("cv8==145", ","); err == nil {
+		t.Error("assertions should fail without Assertions(true)")
+	}
+}
+
+func TestParseCVStringModifications(t *testing.T) {
+	entries, err := ParseCVString("cv29|=0x14, cv29&=~0x10, cv33-cv34 &= 0b1111_0000, cv29==6, cv1=3", ",", Assertions(true), Modifications(true))
+	if err != nil {
+		t.Fatalf("ParseCVString() error = %v", err)
+	}
+	expected := []CVEntry{
+		{Number: 1, Value: 3},
+		{Number: 29, Value: 6, Assert: true},
+		{Number: 29, Value: 0x04, Modify: true, Clear: 0x10},
+		{Number: 33, Modify: true, Clear: 0x0F},
+		{Number: 34, Modify: true, Clear: 0x0F},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("ParseCVString() = %v, want %v", entries, expected)
+	}
+	if got := entries[2].Apply(0x36); got != 0x26 {
+		t.Errorf("Apply(0x36) = %#x, want 0x26", got)
+	}
+	if got := entries[0].Apply(0x36); got != 3 {
+		t.Errorf("Apply() of a value = %d, want 3", got)
+	}
+
+	if _, err := ParseCVString("cv29=6, cv29|=0x04", ",", Modifications(true)); err == nil {
+		t.Error("a CV both written and modified should fail")
+	}
+	if _, err := ParseCVString("cv29|=0x100", ",", Modifications(true)); err == nil {
+		t.Error("a mask above 8 bits should fail")
+	}
+	if _, err := ParseCVString("cv29|=0x04", ","); err == nil {
+		t.Error("modifications should fail without Modifications(true)")
+	}
+}
+
+func TestFormatCVValue(t *testing.T) {
+	tests := []struct {
+		base     int
+		expected string
+	}{
+		{base: 10, expected: "46"},
+		{base: 16, expected: "0x2E"},
+		{base: 2, expected: "0b00101110"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatCVValue(46, tt.base); got != tt.expected {
+			t.Errorf("FormatCVValue(46, %d) = %s, want %s", tt.base, got, tt.expected)
+		}
+		value, err := ParseCVValue(FormatCVValue(46, tt.base))
+		if err != nil || value != 46 {
+			t.Errorf("ParseCVValue(%s) = %d, %v", tt.expected, value, err)
+		}
+	}
+}
+
+func TestParseCVStringIncludes(t *testing.T) {
+	dir := t.TempDir()
+	club := "# club standard\n$light=${brightness}\ncv1=$addr\ncv49-cv52=$light  # headlights\n"
+	if err := os.WriteFile(filepath.Join(dir, "club.cv"), []byte(club), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "locos"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	loco := "$addr=3\n$brightness = 0x20\n@include ../club.cv\ncv3=$light\n"
+
+	entries, err := ParseCVString(loco, "\n", Strict(true), IncludeDir(filepath.Join(dir, "locos")))
+	if err != nil {
+		t.Fatalf("ParseCVString() error = %v", err)
+	}
+	expected := []CVEntry{
+		{Number: 1, Value: 3},
+		{Number: 3, Value: 32},
+		{Number: 49, Value: 32},
+		{Number: 50, Value: 32},
+		{Number: 51, Value: 32},
+		{Number: 52, Value: 32},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("ParseCVString() = %v, want %v", entries, expected)
+	}
+
+	// the variables work in a single line too
+	entries, err = ParseCVString("$addr=5, cv1=$addr", ",")
+	if err != nil || len(entries) != 1 || entries[0].Value != 5 {
+		t.Errorf("ParseCVString() = %v, %v", entries, err)
+	}
+
+	// a tab separates the directive as well
+	entries, err = ParseCVString("$addr=3\n$brightness=1\n@include\t../club.cv", "\n", IncludeDir(filepath.Join(dir, "locos")))
+	if err != nil || len(entries) != 5 {
+		t.Errorf("ParseCVString() = %v, %v", entries, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "loop.cv"), []byte("@include loop.cv\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, input := range []string{"cv1=$missing", "@include missing.cv", "@include loop.cv", "@define x"} {
+		if _, err := ParseCVString(input, "\n", IncludeDir(dir)); err == nil {
+			t.Errorf("ParseCVString(%q) should fail", input)
+		}
+	}
+}
+
+func TestParseCVStringConditions(t *testing.T) {
+	decoder := map[uint16]int{7: 5, 8: 145}
+	reads := 0
+	read := func(cv uint16) (int, error) {
+		reads++
+		value, ok := decoder[cv]
+		if !ok {
+			return 0, errors.New("no answer")
+		}
+		return value, nil
+	}
+	fleet := `cv1=3
+@if cv8==151
+cv3=1
+@elif cv8==145 && cv7>=4
+cv3=2
+@if cv7 < 5
+cv4=1
+@else
+cv4=2
+@endif
+@else
+$unused=${undefined}
+cv3=3
+@endif
+@if cv8==151 || cv7!=0
+cv5=7
+@endif
+`
+	entries, err := ParseCVString(fleet, "\n", Strict(true), Conditions(read))
+	if err != nil {
+		t.Fatalf("ParseCVString() error = %v", err)
+	}
+	expected := []CVEntry{{Number: 1, Value: 3}, {Number: 3, Value: 2}, {Number: 4, Value: 2}, {Number: 5, Value: 7}}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("ParseCVString() = %v, want %v", entries, expected)
+	}
+	if reads != 2 {
+		t.Errorf("the CVs of the conditions were read %d times, want 2", reads)
+	}
+
+	for _, input := range []string{"@if cv8==145\ncv1=3", "@endif", "@if cv8==145\n@else\n@else\n@endif", "@if cv8=145\n@endif", "@if cv9==1\n@endif", "@if\n@endif"} {
+		if _, err := ParseCVString(input, "\n", Conditions(read)); err == nil {
+			t.Errorf("ParseCVString(%q) should fail", input)
+		}
+	}
+	if _, err := ParseCVString("@if cv8==145\ncv1=3\n@endif", "\n"); err == nil {
+		t.Error("conditions should fail without Conditions()")
+	}
+
+	// a tab separates the directive as well
+	entries, err = ParseCVString("@if\tcv8==145\ncv1=3\n@else\ncv1=4\n@endif", "\n", Conditions(read))
+	if err != nil || !reflect.DeepEqual(entries, []CVEntry{{Number: 1, Value: 3}}) {
+		t.Errorf("ParseCVString() = %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,271 @@
+package syntax
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxIncludeDepth limits how deep the included files include other files
+const maxIncludeDepth = 8
+
+// blockDirectives are the directives of the conditional blocks
+var blockDirectives = map[string]bool{"@if": true, "@elif": true, "@else": true, "@endif": true}
+
+var (
+	reVariableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// reVariable matches a use of a variable, "$name" or "${name}"
+	reVariable = regexp.MustCompile(`\$(?:\{([A-Za-z_][A-Za-z0-9_]*)\}|([A-Za-z_][A-Za-z0-9_]*))`)
+	// reComparison matches a comparison of a condition, e.g. "cv8==145"
+	reComparison = regexp.MustCompile(`(?i)^cv(\d+)\s*(==|!=|<=|>=|<|>)\s*(\S+)$`)
+)
+
+// IncludeDir resolves the relative paths of "@include" against dir, by default against the current directory
+func IncludeDir(dir string) ParseOption {
+	return func(o *parseOptions) {
+		o.includeDir = dir
+	}
+}
+
+// Conditions evaluates the blocks "@if cv8==145 && cv7>=4" with the CVs returned by read, e.g. from the decoder
+// the file is written to. Without it a condition is an error.
+func Conditions(read func(cv uint16) (int, error)) ParseOption {
+	return func(o *parseOptions) {
+		o.readCV = read
+	}
+}
+
+// cvLine is a line of the input without its comment, the included lines are at the position of their "@include"
+type cvLine struct {
+	text string
+	pos  int
+}
+
+// cvBlock is an "@if" block being expanded, active when the lines of its current branch are used
+type cvBlock struct {
+	// outer is set when the lines around the block are used, the conditions of an unused block are not evaluated
+	outer  bool
+	active bool
+	// taken is set once a branch of the block was used, the later "@elif" and "@else" are not
+	taken  bool
+	inElse bool
+}
+
+// expandCVLines splits the input into lines. A line "$name=value" defines a variable, used by the lines after it
+// as "$name" or "${name}". A line "@include common.cv" inserts the lines of another file, relative to the include
+// directory, its variables are defined for the lines after the include. The lines between "@if <condition>",
+// "@elif <condition>", "@else" and "@endif" are used only when the condition holds, see evalCondition.
+// included are the files including the input.
+func expandCVLines(input, separator string, opts parseOptions, vars map[string]string, included []string) ([]cvLine, error) {
+	var lines []cvLine
+	var blocks []cvBlock
+	active := func() bool {
+		return len(blocks) == 0 || blocks[len(blocks)-1].active
+	}
+	for i, raw := range strings.Split(input, separator) {
+		pos := i + 1
+		line, _, _ := strings.Cut(raw, "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		if directive, condition := cutDirective(line); blockDirectives[directive] {
+			switch directive {
+			case "@if":
+				block := cvBlock{outer: active()}
+				if block.outer {
+					holds, err := evalCondition(condition, opts, vars)
+					if err != nil {
+						return nil, err
+					}
+					block.active, block.taken = holds, holds
+				}
+				blocks = append(blocks, block)
+			case "@elif", "@else":
+				if len(blocks) == 0 || blocks[len(blocks)-1].inElse {
+					return nil, fmt.Errorf("%s without @if", directive)
+				}
+				block := &blocks[len(blocks)-1]
+				block.active = false
+				if block.outer && !block.taken {
+					holds := true
+					if directive == "@elif" {
+						var err error
+						if holds, err = evalCondition(condition, opts, vars); err != nil {
+							return nil, err
+						}
+					}
+					block.active, block.taken = holds, holds
+				}
+				block.inElse = directive == "@else"
+			case "@endif":
+				if len(blocks) == 0 {
+					return nil, fmt.Errorf("@endif without @if")
+				}
+				blocks = blocks[:len(blocks)-1]
+			}
+			continue
+		}
+		if !active() {
+			continue
+		}
+
+		if name, value, ok := strings.Cut(line[1:], "="); strings.HasPrefix(line, "$") && ok && reVariableName.MatchString(strings.TrimSpace(name)) {
+			value, err := substituteVariables(strings.TrimSpace(value), vars)
+			if err != nil {
+				return nil, err
+			}
+			vars[strings.TrimSpace(name)] = value
+			continue
+		}
+		line, err := substituteVariables(line, vars)
+		if err != nil {
+			return nil, err
+		}
+
+		if !strings.HasPrefix(line, "@") {
+			lines = append(lines, cvLine{text: line, pos: pos})
+			continue
+		}
+		directive, path := cutDirective(line)
+		if directive != "@include" {
+			return nil, fmt.Errorf("unknown directive %q, expected \"@include <file>\" or \"@if <condition>\"", line)
+		}
+		nested, err := includeCVFile(strings.Trim(strings.TrimSpace(path), `"'`), opts, vars, included)
+		if err != nil {
+			return nil, err
+		}
+		for _, nestedLine := range nested {
+			lines = append(lines, cvLine{text: nestedLine.text, pos: pos})
+		}
+	}
+	if len(blocks) > 0 {
+		return nil, fmt.Errorf("@if without @endif")
+	}
+	return lines, nil
+}
+
+// includeCVFile returns the expanded lines of an included file
+func includeCVFile(path string, opts parseOptions, vars map[string]string, included []string) ([]cvLine, error) {
+	if path == "" {
+		return nil, fmt.Errorf("@include needs a file")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(opts.includeDir, path)
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	for _, parent := range included {
+		if parent == path {
+			return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(included, " -> "), path)
+		}
+	}
+	if len(included) >= maxIncludeDepth {
+		return nil, fmt.Errorf("cannot include %s, the includes are nested deeper than %d files", path, maxIncludeDepth)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot include %s: %w", path, err)
+	}
+	opts.includeDir = filepath.Dir(path)
+	lines, err := expandCVLines(string(content), "\n", opts, vars, append(included, path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return lines, nil
+}
+
+// substituteVariables replaces the uses of the variables in line
+func substituteVariables(line string, vars map[string]string) (string, error) {
+	var undefined string
+	line = reVariable.ReplaceAllStringFunc(line, func(use string) string {
+		match := reVariable.FindStringSubmatch(use)
+		name := match[1] + match[2]
+		value, ok := vars[name]
+		if !ok && undefined == "" {
+			undefined = name
+		}
+		return value
+	})
+	if undefined != "" {
+		return "", fmt.Errorf("undefined variable $%s", undefined)
+	}
+	return line, nil
+}
+
+// evalCondition tells whether a condition of "@if" holds, comparisons of CVs with values like "cv8==145" or
+// "cv7>=4" (==, !=, <, <=, >, >=) joined by "&&" and "||", "&&" binding stronger. The CVs are read by the reader
+// of Conditions, each only once.
+func evalCondition(condition string, opts parseOptions, vars map[string]string) (bool, error) {
+	condition, err := substituteVariables(strings.TrimSpace(condition), vars)
+	if err != nil {
+		return false, err
+	}
+	if condition == "" {
+		return false, fmt.Errorf("@if needs a condition, e.g. \"@if cv8==145\"")
+	}
+	if opts.readCV == nil {
+		return false, fmt.Errorf("the condition %q needs the decoder, it is evaluated by \"loco cv apply\" and \"loco cv check\"", condition)
+	}
+	for _, alternative := range strings.Split(condition, "||") {
+		holds := true
+		for _, comparison := range strings.Split(alternative, "&&") {
+			matches := reComparison.FindStringSubmatch(strings.TrimSpace(comparison))
+			if matches == nil {
+				return false, fmt.Errorf("invalid condition %q, expected e.g. \"cv8==145 && cv7>=4\"", strings.TrimSpace(comparison))
+			}
+			num, err := strconv.ParseUint(matches[1], 10, 16)
+			if err != nil {
+				return false, fmt.Errorf("invalid CV number: %s", matches[1])
+			}
+			expected, err := ParseCVValue(matches[3])
+			if err != nil {
+				return false, err
+			}
+			// the comparisons after a false one are still checked, so a typo is found on every decoder
+			if !holds {
+				continue
+			}
+			value, err := opts.readCV(uint16(num))
+			if err != nil {
+				return false, fmt.Errorf("cannot read cv%d of the condition %q: %w", num, condition, err)
+			}
+			holds = compareCV(value, matches[2], int(expected))
+		}
+		if holds {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// compareCV compares the value of a CV by the operator of a condition
+func compareCV(value int, operator string, expected int) bool {
+	switch operator {
+	case "==":
+		return value == expected
+	case "!=":
+		return value != expected
+	case "<":
+		return value < expected
+	case "<=":
+		return value <= expected
+	case ">":
+		return value > expected
+	}
+	return value >= expected
+}
+
+// cutDirective splits a directive from its argument at the first whitespace, a tab as well as a space
+func cutDirective(line string) (directive, argument string) {
+	i := strings.IndexFunc(line, unicode.IsSpace)
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], line[i+1:]
+}
@@ -62,6 +62,18 @@ type OutputEntry struct {
 	Direction Direction // A, B, or "" (none)
 }
 
+// String renders the entry as a mapping line, e.g. "O1:F0>".
+func (e OutputEntry) String() string {
+	suffix := ""
+	switch e.Direction {
+	case DirA:
+		suffix = ">"
+	case DirB:
+		suffix = "<"
+	}
+	return fmt.Sprintf("O%d:F%d%s", e.Output, e.Function, suffix)
+}
+
 // FunctionRoles maps semantic roles to the actual function numbers found in the
 // mapping file.  A value of 255 means "not detected / not present".
 type FunctionRoles struct {
@@ -103,6 +115,35 @@ var reFnToken = regexp.MustCompile(`(?i)\(F(\d+)\)`)
 // Lines starting with "#" are inspected for role declarations before being
 // skipped as comments.  Blank lines are silently ignored.
 func Parse(r io.Reader) (*OutputMap, error) {
+	m, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// ---- reject boards where F0 is driven by a microcontroller -------------
+	if err := checkMicrocontrollerBoard(m); err != nil {
+		return nil, err
+	}
+
+	// ---- auto-detect additional Pc5 functions (no-comment files) -----------
+	autoDetectPc5Extra(m)
+
+	return m, nil
+}
+
+// ParseEntries reads a mapping file from r and returns its mapping lines only.
+// Unlike Parse it accepts the files of microcontroller boards, it is meant for
+// checking a file before it is written to a decoder, not for classifying it.
+func ParseEntries(r io.Reader) ([]OutputEntry, error) {
+	m, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	return m.Entries, nil
+}
+
+// parse reads the mapping lines and the role declarations of a mapping file.
+func parse(r io.Reader) (*OutputMap, error) {
 	m := &OutputMap{
 		Roles: defaults(),
 	}
@@ -154,14 +195,6 @@ func Parse(r io.Reader) (*OutputMap, error) {
 	// ---- apply detected roles (override defaults where found) ---------------
 	applyDetected(&m.Roles, detected)
 
-	// ---- reject boards where F0 is driven by a microcontroller -------------
-	if err := checkMicrocontrollerBoard(m); err != nil {
-		return nil, err
-	}
-
-	// ---- auto-detect additional Pc5 functions (no-comment files) -----------
-	autoDetectPc5Extra(m)
-
 	return m, nil
 }
 
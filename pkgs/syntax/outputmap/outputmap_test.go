@@ -482,6 +482,28 @@ func TestParse_Pc5Extra_AutoDetect_NotTriggeredForUnrelatedFn(t *testing.T) {
 	}
 }
 
+func TestParseEntries_AcceptsMicrocontrollerBoard(t *testing.T) {
+	input := "# Pc1 (F0)\nO1:F0>\nO2:F0<\nO3:F8\n"
+	if _, err := outputmap.Parse(strings.NewReader(input)); !errors.Is(err, outputmap.ErrMicrocontrollerBoard) {
+		t.Fatalf("expected ErrMicrocontrollerBoard from Parse, got: %v", err)
+	}
+	entries, err := outputmap.ParseEntries(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for i, want := range []string{"O1:F0>", "O2:F0<", "O3:F8"} {
+		if got := entries[i].String(); got != want {
+			t.Errorf("entry %d: expected %s, got %s", i, want, got)
+		}
+	}
+	if _, err := outputmap.ParseEntries(strings.NewReader("O1-F0>\n")); err == nil {
+		t.Errorf("expected an error for a malformed line")
+	}
+}
+
 // ----- helpers ---------------------------------------------------------------
 
 func mustContain(t *testing.T, name string, s []uint8, v uint8) {
@@ -0,0 +1,123 @@
+// Package throttle implements driving helpers: speed ramps shaped by acceleration curves and recorded driving sessions.
+package throttle
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Curve maps the ramp progress (0-1) to the reached fraction of the speed change (0-1)
+type Curve func(progress float64) float64
+
+// Built-in curve names
+const (
+	CurveLinear    = "linear"
+	CurveEaseInOut = "ease-in-out"
+)
+
+// Linear changes the speed at a constant rate
+func Linear(progress float64) float64 {
+	return clamp(progress)
+}
+
+// EaseInOut starts and ends slowly, like a train gaining and losing momentum
+func EaseInOut(progress float64) float64 {
+	return (1 - math.Cos(math.Pi*clamp(progress))) / 2
+}
+
+// NewCurve returns a built-in curve by name, any other name is read as a CSV file (see ReadCSVCurve)
+func NewCurve(name string) (Curve, error) {
+	switch name {
+	case "", CurveLinear:
+		return Linear, nil
+	case CurveEaseInOut:
+		return EaseInOut, nil
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown curve '%s', must be '%s', '%s' or a CSV file: %w", name, CurveLinear, CurveEaseInOut, err)
+	}
+	defer file.Close()
+	curve, err := ReadCSVCurve(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read curve %q: %w", name, err)
+	}
+	return curve, nil
+}
+
+type curvePoint struct {
+	progress float64
+	value    float64
+}
+
+// ReadCSVCurve reads a custom curve as "progress,speed" rows, both in percent (0-100).
+// A header row and lines starting with # are skipped. Between the points the curve is linear,
+// points at 0% and 100% are implied when missing.
+//
+//	progress,speed
+//	25,10
+//	50,30
+//	75,70
+func ReadCSVCurve(r io.Reader) (Curve, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	points := []curvePoint{{0, 0}, {1, 1}}
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		progress, progressErr := strconv.ParseFloat(strings.TrimSpace(record[0]), 64)
+		value, valueErr := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if progressErr != nil || valueErr != nil {
+			if row == 1 {
+				continue // header
+			}
+			return nil, fmt.Errorf("row %d: both columns must be numbers, got %q", row, record)
+		}
+		if progress < 0 || progress > 100 || value < 0 || value > 100 {
+			return nil, fmt.Errorf("row %d: values must be within 0-100, got %q", row, record)
+		}
+		points = setPoint(points, curvePoint{progress / 100, value / 100})
+	}
+
+	return func(progress float64) float64 {
+		progress = clamp(progress)
+		i := sort.Search(len(points), func(i int) bool { return points[i].progress >= progress })
+		if i == 0 {
+			return points[0].value
+		}
+		prev, next := points[i-1], points[i]
+		return prev.value + (next.value-prev.value)*(progress-prev.progress)/(next.progress-prev.progress)
+	}, nil
+}
+
+// setPoint inserts the point keeping points sorted by progress, an existing point at the same progress is replaced
+func setPoint(points []curvePoint, p curvePoint) []curvePoint {
+	i := sort.Search(len(points), func(i int) bool { return points[i].progress >= p.progress })
+	if i < len(points) && points[i].progress == p.progress {
+		points[i] = p
+		return points
+	}
+	points = append(points, curvePoint{})
+	copy(points[i+1:], points[i:])
+	points[i] = p
+	return points
+}
+
+func clamp(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
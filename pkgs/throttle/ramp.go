@@ -0,0 +1,60 @@
+package throttle
+
+import (
+	"math"
+	"time"
+)
+
+// Step is a single speed command of a ramp, At is counted from the start of the ramp
+type Step struct {
+	At    time.Duration
+	Speed uint8
+}
+
+// Ramp changes the speed from From to To within Duration, one command per Interval at most
+type Ramp struct {
+	From     uint8
+	To       uint8
+	Duration time.Duration
+	Interval time.Duration
+	Curve    Curve
+	// AvoidSpeed is a speed value that is never sent, e.g. 1 which means emergency stop in 14 and 128 speed steps.
+	// The step is moved towards the target instead. Zero disables it.
+	AvoidSpeed uint8
+}
+
+// Steps returns the commands to send. Intervals in which the speed does not change are left out,
+// the last step is always To.
+func (r Ramp) Steps() []Step {
+	curve := r.Curve
+	if curve == nil {
+		curve = Linear
+	}
+	count := 1
+	if r.Interval > 0 && r.Duration > r.Interval {
+		count = int(r.Duration / r.Interval)
+	}
+
+	var steps []Step
+	last := int(r.From)
+	for i := 1; i <= count; i++ {
+		progress := float64(i) / float64(count)
+		speed := int(math.Round(float64(r.From) + (float64(r.To)-float64(r.From))*curve(progress)))
+		if i == count {
+			speed = int(r.To)
+		}
+		if r.AvoidSpeed != 0 && speed == int(r.AvoidSpeed) && speed != int(r.To) {
+			if r.To > r.From {
+				speed++
+			} else {
+				speed--
+			}
+		}
+		if speed == last {
+			continue
+		}
+		steps = append(steps, Step{At: time.Duration(i) * r.Duration / time.Duration(count), Speed: uint8(speed)})
+		last = speed
+	}
+	return steps
+}
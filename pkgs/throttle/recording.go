@@ -0,0 +1,133 @@
+package throttle
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Recording is a driving session of a single locomotive, stored as JSON
+type Recording struct {
+	Loco   uint16  `json:"loco"`
+	Events []Event `json:"events"`
+}
+
+// Event types
+const (
+	EventSpeed    = "speed"
+	EventFunction = "function"
+)
+
+// Event is a single command of a recording. At is counted in milliseconds from the start of the recording.
+type Event struct {
+	At   int64  `json:"at"`
+	Type string `json:"type"`
+
+	// EventSpeed
+	Speed   uint8 `json:"speed,omitempty"`
+	Forward bool  `json:"forward,omitempty"`
+	Steps   uint8 `json:"steps,omitempty"`
+
+	// EventFunction
+	Function uint8 `json:"function,omitempty"`
+	On       bool  `json:"on,omitempty"`
+}
+
+// Offset returns At as a duration
+func (e Event) Offset() time.Duration {
+	return time.Duration(e.At) * time.Millisecond
+}
+
+// State is the observed state of a locomotive, Functions is a bitmask of F0..F31
+type State struct {
+	Speed     uint8
+	Forward   bool
+	Steps     uint8
+	Functions uint32
+}
+
+// Recorder turns observed states into events, only the changes are recorded
+type Recorder struct {
+	recording Recording
+	last      *State
+}
+
+// NewRecorder starts a recording of the given locomotive
+func NewRecorder(loco uint16) *Recorder {
+	return &Recorder{recording: Recording{Loco: loco, Events: []Event{}}}
+}
+
+// Observe records the difference to the previously observed state.
+// The first state is recorded completely, so the replay starts from the same state.
+func (r *Recorder) Observe(at time.Duration, state State) {
+	ms := at.Milliseconds()
+	if r.last == nil || r.last.Speed != state.Speed || r.last.Forward != state.Forward || r.last.Steps != state.Steps {
+		r.recording.Events = append(r.recording.Events, Event{At: ms, Type: EventSpeed, Speed: state.Speed, Forward: state.Forward, Steps: state.Steps})
+	}
+	for fn := uint8(0); fn <= 31; fn++ {
+		on := state.Functions&(1<<fn) != 0
+		if r.last == nil {
+			if on {
+				r.recording.Events = append(r.recording.Events, Event{At: ms, Type: EventFunction, Function: fn, On: true})
+			}
+			continue
+		}
+		if on != (r.last.Functions&(1<<fn) != 0) {
+			r.recording.Events = append(r.recording.Events, Event{At: ms, Type: EventFunction, Function: fn, On: on})
+		}
+	}
+	r.last = &state
+}
+
+// Recording returns everything recorded so far
+func (r *Recorder) Recording() Recording {
+	return r.recording
+}
+
+// Save writes the recording as JSON
+func (r Recording) Save(path string) error {
+	encoded, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot serialize recording: %w", err)
+	}
+	if err := os.WriteFile(path, encoded, 0o644); err != nil {
+		return fmt.Errorf("cannot save recording: %w", err)
+	}
+	return nil
+}
+
+// LoadRecording reads a recording saved by Save
+func LoadRecording(path string) (Recording, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return Recording{}, fmt.Errorf("cannot read recording: %w", err)
+	}
+	var recording Recording
+	if err := json.Unmarshal(raw, &recording); err != nil {
+		return Recording{}, fmt.Errorf("cannot parse recording %q: %w", path, err)
+	}
+	for i, event := range recording.Events {
+		if event.Type != EventSpeed && event.Type != EventFunction {
+			return Recording{}, fmt.Errorf("cannot parse recording %q: event %d has unknown type '%s'", path, i+1, event.Type)
+		}
+		if i > 0 && event.At < recording.Events[i-1].At {
+			return Recording{}, fmt.Errorf("cannot parse recording %q: event %d is out of order", path, i+1)
+		}
+	}
+	return recording, nil
+}
+
+func (e Event) String() string {
+	if e.Type == EventFunction {
+		if e.On {
+			return fmt.Sprintf("F%d on", e.Function)
+		}
+		return fmt.Sprintf("F%d off", e.Function)
+	}
+	direction := "reverse"
+	if e.Forward {
+		direction = "forward"
+	}
+	return fmt.Sprintf("speed %d %s", e.Speed, direction)
+}
@@ -0,0 +1,119 @@
+package throttle
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCurves(t *testing.T) {
+	custom, err := ReadCSVCurve(strings.NewReader("progress,speed\n# slow start\n50,20\n75, 60\n"))
+	if err != nil {
+		t.Fatalf("ReadCSVCurve: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		curve    Curve
+		progress float64
+		want     float64
+	}{
+		{"linear start", Linear, 0, 0},
+		{"linear middle", Linear, 0.3, 0.3},
+		{"linear clamped", Linear, 1.5, 1},
+		{"ease-in-out start is slow", EaseInOut, 0.1, 0.0245},
+		{"ease-in-out middle", EaseInOut, 0.5, 0.5},
+		{"ease-in-out end", EaseInOut, 1, 1},
+		{"csv implied start", custom, 0, 0},
+		{"csv between implied start and first point", custom, 0.25, 0.1},
+		{"csv point", custom, 0.75, 0.6},
+		{"csv implied end", custom, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.curve(tt.progress); math.Abs(got-tt.want) > 0.001 {
+				t.Errorf("curve(%v) = %v, want %v", tt.progress, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadCSVCurve_Invalid(t *testing.T) {
+	for _, input := range []string{"10,20\nx,30\n", "10,120\n", "10\n"} {
+		if _, err := ReadCSVCurve(strings.NewReader(input)); err == nil {
+			t.Errorf("ReadCSVCurve(%q) expected an error", input)
+		}
+	}
+}
+
+func TestRampSteps(t *testing.T) {
+	tests := []struct {
+		name string
+		ramp Ramp
+		want []Step
+	}{
+		{
+			name: "linear acceleration",
+			ramp: Ramp{From: 0, To: 40, Duration: 400 * time.Millisecond, Interval: 100 * time.Millisecond},
+			want: []Step{{100 * time.Millisecond, 10}, {200 * time.Millisecond, 20}, {300 * time.Millisecond, 30}, {400 * time.Millisecond, 40}},
+		},
+		{
+			name: "unchanged speed is not repeated",
+			ramp: Ramp{From: 10, To: 12, Duration: 400 * time.Millisecond, Interval: 100 * time.Millisecond},
+			want: []Step{{100 * time.Millisecond, 11}, {300 * time.Millisecond, 12}},
+		},
+		{
+			name: "emergency stop is avoided when braking",
+			ramp: Ramp{From: 4, To: 0, Duration: 400 * time.Millisecond, Interval: 100 * time.Millisecond, AvoidSpeed: 1},
+			want: []Step{{100 * time.Millisecond, 3}, {200 * time.Millisecond, 2}, {300 * time.Millisecond, 0}},
+		},
+		{
+			name: "no duration jumps to the target",
+			ramp: Ramp{From: 0, To: 50},
+			want: []Step{{0, 50}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ramp.Steps(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Steps() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	recorder := NewRecorder(3)
+	recorder.Observe(0, State{Speed: 0, Forward: true, Steps: 128, Functions: 1})
+	recorder.Observe(500*time.Millisecond, State{Speed: 0, Forward: true, Steps: 128, Functions: 1})
+	recorder.Observe(time.Second, State{Speed: 20, Forward: true, Steps: 128, Functions: 1 | 1<<5})
+	recorder.Observe(2*time.Second, State{Speed: 20, Forward: true, Steps: 128, Functions: 1 << 5})
+
+	want := []Event{
+		{At: 0, Type: EventSpeed, Speed: 0, Forward: true, Steps: 128},
+		{At: 0, Type: EventFunction, Function: 0, On: true},
+		{At: 1000, Type: EventSpeed, Speed: 20, Forward: true, Steps: 128},
+		{At: 1000, Type: EventFunction, Function: 5, On: true},
+		{At: 2000, Type: EventFunction, Function: 0, On: false},
+	}
+	if got := recorder.Recording().Events; !reflect.DeepEqual(got, want) {
+		t.Errorf("Events = %+v, want %+v", got, want)
+	}
+}
+
+func TestRecordingSaveLoad(t *testing.T) {
+	path := t.TempDir() + "/run.json"
+	saved := Recording{Loco: 3, Events: []Event{{At: 0, Type: EventSpeed, Speed: 10, Forward: true, Steps: 28}, {At: 1500, Type: EventFunction, Function: 2, On: true}}}
+	if err := saved.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	loaded, err := LoadRecording(path)
+	if err != nil {
+		t.Fatalf("LoadRecording: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, saved) {
+		t.Errorf("LoadRecording = %+v, want %+v", loaded, saved)
+	}
+}